@@ -0,0 +1,520 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+// Package attachment handles files attached to documents, tasks and tests, like topology diagrams, pcap files and screenshots.
+package attachment
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/gathering/tech-online-backend/storage"
+	"github.com/google/uuid"
+)
+
+const defaultMaxSize = 10 * 1024 * 1024
+
+// multipartOverhead is the room for the form fields and multipart headers in the request body, in addition to the file.
+const multipartOverhead = 64 * 1024
+
+// OwnerType is the type of object an attachment belongs to.
+type OwnerType string
+
+const (
+	// OwnerTypeDocument is for documents, where the owner ID is "<family>/<shortname>".
+	OwnerTypeDocument OwnerType = "document"
+	// OwnerTypeTask is for tasks, where the owner ID is the task ID.
+	OwnerTypeTask OwnerType = "task"
+	// OwnerTypeTest is for test artifacts (e.g. pcaps, config dumps and screenshots from checkers), where the owner ID is the test ID.
+	// Handled by the registered owner type handler.
+	OwnerTypeTest OwnerType = "test"
+)
+
+// OwnerTypeHandler handles an owner type defined outside this package, to avoid import cycles.
+type OwnerTypeHandler struct {
+	Exists    func(ownerID string) (bool, error)                              // Checks if the owner exists
+	CanUpload func(token rest.AccessTokenEntry) bool                          // Checks if the token may upload attachments for owners of the type, in addition to admins
+	CanView   func(ownerID string, token rest.AccessTokenEntry) (bool, error) // Checks if the token may see attachments of the owner
+}
+
+var ownerTypeHandlers = make(map[OwnerType]OwnerTypeHandler)
+
+// RegisterOwnerType registers the handler for an owner type.
+// Meant to be called from init functions.
+func RegisterOwnerType(ownerType OwnerType, handler OwnerTypeHandler) {
+	ownerTypeHandlers[ownerType] = handler
+}
+
+// Attachment is the metadata for an uploaded file.
+type Attachment struct {
+	ID          *uuid.UUID `column:"id" json:"id"`                     // Generated, required, unique
+	OwnerType   OwnerType  `column:"owner_type" json:"owner_type"`     // Required
+	OwnerID     string     `column:"owner_id" json:"owner_id"`         // Required
+	Filename    string     `column:"filename" json:"filename"`         // Required
+	ContentType string     `column:"content_type" json:"content_type"` // Required
+	Size        int64      `column:"size" json:"size"`                 // Generated
+	Checksum    string     `column:"checksum" json:"checksum"`         // Generated, SHA256 hex
+	Uploader    string     `column:"uploader" json:"uploader"`         // Generated
+	Timestamp   *time.Time `column:"timestamp" json:"timestamp"`       // Generated
+}
+
+// Attachments is a list of attachments.
+type Attachments []*Attachment
+
+// AttachmentFile is the content of an attachment, for downloading.
+type AttachmentFile struct {
+	attachment Attachment
+	data       []byte
+}
+
+func init() {
+	rest.AddHandler("/attachments/", "^$", func() interface{} { return &Attachments{} })
+	rest.AddHandler("/attachment/", "^(?P<id>[^/]+)/$", func() interface{} { return &Attachment{} })
+	rest.AddHandler("/attachment/", "^(?P<id>[^/]+)/download/$", func() interface{} { return &AttachmentFile{} })
+	rest.SetBodyLimit(&Attachments{}, func() int64 { return maxSize() + multipartOverhead })
+}
+
+// Get gets multiple attachments.
+func (attachments *Attachments) Get(request *rest.Request) rest.Result {
+	// Check params, prep filtering
+	var whereArgs []interface{}
+	if ownerType, ok := request.QueryArgs["owner_type"]; ok {
+		whereArgs = append(whereArgs, "owner_type", "=", ownerType)
+	}
+	if ownerID, ok := request.QueryArgs["owner_id"]; ok {
+		whereArgs = append(whereArgs, "owner_id", "=", ownerID)
+	}
+
+	// Get
+	var allAttachments Attachments
+	dbResult := db.SelectMany(&allAttachments, "attachments", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	for _, attachment := range allAttachments {
+		if visible, err := attachment.isVisibleTo(request.AccessToken); err != nil {
+			return rest.Result{Code: 500, Error: err}
+		} else if visible {
+			*attachments = append(*attachments, attachment)
+		}
+	}
+	return rest.Result{}
+}
+
+// Post uploads a new attachment.
+// The body must be multipart form data with the fields "owner_type", "owner_id" and "file".
+// The owner type may be set as a query arg instead, to check the perms for it before parsing the form.
+func (attachments *Attachments) Post(request *rest.Request) rest.Result {
+	// Check perms before parsing, for the owner type if known or else for any owner type
+	queryOwnerType, hasQueryOwnerType := request.QueryArgs["owner_type"]
+	if hasQueryOwnerType && !canUpload(request.AccessToken, OwnerType(queryOwnerType)) {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+	if !hasQueryOwnerType && !canUploadAny(request.AccessToken) {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Parse form
+	mediaType, mediaParams, mediaErr := mime.ParseMediaType(request.ContentType)
+	if mediaErr != nil || mediaType != "multipart/form-data" || mediaParams["boundary"] == "" {
+		return rest.Result{Code: 415, Message: "body must be multipart/form-data"}
+	}
+	form, formErr := multipart.NewReader(bytes.NewReader(request.Body), mediaParams["boundary"]).ReadForm(maxSize())
+	if formErr != nil {
+		return rest.Result{Code: 400, Message: "malformed multipart form"}
+	}
+	defer form.RemoveAll()
+
+	// Check perms for the owner type
+	ownerType := OwnerType(formValue(form, "owner_type"))
+	if hasQueryOwnerType {
+		if ownerType != "" && ownerType != OwnerType(queryOwnerType) {
+			return rest.Result{Code: 400, Message: "mismatch for owner type between query and form"}
+		}
+		ownerType = OwnerType(queryOwnerType)
+	}
+	if !canUpload(request.AccessToken, ownerType) {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	fileHeaders := form.File["file"]
+	if len(fileHeaders) != 1 {
+		return rest.Result{Code: 400, Message: "exactly one file must be provided"}
+	}
+	fileHeader := fileHeaders[0]
+	if fileHeader.Size > maxSize() {
+		return rest.Result{Code: 413, Message: fmt.Sprintf("file is larger than %v bytes", maxSize())}
+	}
+	file, fileErr := fileHeader.Open()
+	if fileErr != nil {
+		return rest.Result{Code: 500, Error: fileErr}
+	}
+	defer file.Close()
+	data, readErr := io.ReadAll(file)
+	if readErr != nil {
+		return rest.Result{Code: 500, Error: readErr}
+	}
+
+	// Prepare and validate
+	id := uuid.New()
+	now := time.Now()
+	checksum := sha256.Sum256(data)
+	attachment := Attachment{
+		ID:          &id,
+		OwnerType:   ownerType,
+		OwnerID:     formValue(form, "owner_id"),
+		Filename:    filepath.Base(fileHeader.Filename),
+		ContentType: detectContentType(fileHeader, data),
+		Size:        int64(len(data)),
+		Checksum:    hex.EncodeToString(checksum[:]),
+		Uploader:    request.AccessToken.GetName(),
+		Timestamp:   &now,
+	}
+	if result := attachment.validate(); !result.IsOk() {
+		return result
+	}
+
+	// Store file and metadata, then redirect
+	fileStorage, err := getStorage()
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	if err := fileStorage.Save(attachment.ID.String(), data, attachment.ContentType); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	dbResult := db.Insert("attachments", attachment)
+	if dbResult.IsFailed() {
+		fileStorage.Remove(attachment.ID.String())
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	return rest.Result{Code: 201, Location: fmt.Sprintf("%v/attachment/%v/", config.Config.SitePrefix, attachment.ID)}
+}
+
+// Get gets a single attachment's metadata.
+func (attachment *Attachment) Get(request *rest.Request) rest.Result {
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+
+	// Get
+	return attachment.loadVisible(id, request.AccessToken)
+}
+
+// Delete deletes an attachment, including the file.
+func (attachment *Attachment) Delete(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+
+	// Check if exists
+	if result := attachment.load(id); !result.IsOk() {
+		return result
+	}
+
+	// Delete
+	fileStorage, err := getStorage()
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	dbResult := db.Delete("attachments", "id", "=", attachment.ID)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if err := fileStorage.Remove(attachment.ID.String()); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	return rest.Result{}
+}
+
+// Get gets the file of an attachment.
+// If the storage supports it and signed URLs are enabled, it redirects to a signed URL instead.
+func (file *AttachmentFile) Get(request *rest.Request) rest.Result {
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+
+	// Get
+	if result := file.attachment.loadVisible(id, request.AccessToken); !result.IsOk() {
+		return result
+	}
+	fileStorage, err := getStorage()
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	if signer, ok := fileStorage.(storage.URLSigner); ok && storage.SignedURLExpiry() > 0 {
+		signedURL, err := signer.SignedURL(file.attachment.ID.String(), file.attachment.Filename, file.attachment.ContentType, storage.SignedURLExpiry())
+		if err != nil {
+			return rest.Result{Code: 500, Error: err}
+		}
+		return rest.Result{Code: 303, Location: signedURL}
+	}
+	data, err := fileStorage.Load(file.attachment.ID.String())
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	file.data = data
+	return rest.Result{}
+}
+
+// RawResponse returns the file for downloading.
+func (file *AttachmentFile) RawResponse() *rest.RawResponse {
+	return &rest.RawResponse{
+		ContentType: file.attachment.ContentType,
+		Filename:    file.attachment.Filename,
+		Data:        file.data,
+	}
+}
+
+func (attachment *Attachment) load(id string) rest.Result {
+	dbResult := db.Select(attachment, "attachments", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+	return rest.Result{}
+}
+
+// loadVisible loads the attachment, but pretends it doesn't exist if the token can't see the owner.
+func (attachment *Attachment) loadVisible(id string, token rest.AccessTokenEntry) rest.Result {
+	if result := attachment.load(id); !result.IsOk() {
+		return result
+	}
+	if visible, err := attachment.isVisibleTo(token); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	} else if !visible {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+	return rest.Result{}
+}
+
+// isVisibleTo checks if the token may see the attachment, i.e. not if attached to an unpublished document.
+func (attachment *Attachment) isVisibleTo(token rest.AccessTokenEntry) (bool, error) {
+	if token.GetRole() == rest.RoleOperator || token.GetRole() == rest.RoleAdmin {
+		return true, nil
+	}
+	if handler, ok := ownerTypeHandlers[attachment.OwnerType]; ok {
+		if handler.CanView == nil {
+			return false, nil
+		}
+		return handler.CanView(attachment.OwnerID, token)
+	}
+	if attachment.OwnerType != OwnerTypeDocument {
+		return true, nil
+	}
+	parts := strings.SplitN(attachment.OwnerID, "/", 2)
+	if len(parts) != 2 {
+		return false, nil
+	}
+	dbResult := db.Exists("documents", "family", "=", parts[0], "shortname", "=", parts[1], "status", "=", "published")
+	if dbResult.IsFailed() {
+		return false, dbResult.Error
+	}
+	return dbResult.IsSuccess(), nil
+}
+
+func (attachment *Attachment) validate() rest.Result {
+	switch {
+	case attachment.ID == nil:
+		return rest.Result{Code: 400, Message: "missing ID"}
+	case attachment.OwnerID == "":
+		return rest.Result{Code: 400, Message: "missing owner ID"}
+	case attachment.Filename == "" || attachment.Filename == "." || attachment.Filename == "/":
+		return rest.Result{Code: 400, Message: "missing filename"}
+	case !isAllowedContentType(attachment.ContentType):
+		return rest.Result{Code: 415, Message: fmt.Sprintf("content type not allowed: %v", attachment.ContentType)}
+	}
+
+	if exists, err := attachment.ownerExists(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	} else if !exists {
+		return rest.Result{Code: 400, Message: "referenced owner does not exist"}
+	}
+
+	return rest.Result{}
+}
+
+func (attachment *Attachment) ownerExists() (bool, error) {
+	var dbResult db.Result
+	switch attachment.OwnerType {
+	case OwnerTypeDocument:
+		parts := strings.SplitN(attachment.OwnerID, "/", 2)
+		if len(parts) != 2 {
+			return false, nil
+		}
+		dbResult = db.Exists("documents", "family", "=", parts[0], "shortname", "=", parts[1])
+	case OwnerTypeTask:
+		if _, err := uuid.Parse(attachment.OwnerID); err != nil {
+			return false, nil
+		}
+		dbResult = db.Exists("tasks", "id", "=", attachment.OwnerID)
+	default:
+		if handler, ok := ownerTypeHandlers[attachment.OwnerType]; ok && handler.Exists != nil {
+			return handler.Exists(attachment.OwnerID)
+		}
+		return false, nil
+	}
+	if dbResult.IsFailed() {
+		return false, dbResult.Error
+	}
+	return dbResult.IsSuccess(), nil
+}
+
+// detectContentType uses the provided type if specific, else guesses it from the filename extension or content.
+func detectContentType(fileHeader *multipart.FileHeader, data []byte) string {
+	if mediaType, _, err := mime.ParseMediaType(fileHeader.Header.Get("Content-Type")); err == nil && mediaType != "application/octet-stream" {
+		return mediaType
+	}
+	if mediaType, _, err := mime.ParseMediaType(mime.TypeByExtension(filepath.Ext(fileHeader.Filename))); err == nil {
+		return mediaType
+	}
+	mediaType, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	return mediaType
+}
+
+func isAllowedContentType(contentType string) bool {
+	if len(config.Config.Attachments.AllowedTypes) == 0 {
+		return true
+	}
+	for _, allowedType := range config.Config.Attachments.AllowedTypes {
+		if contentType == allowedType {
+			return true
+		}
+	}
+	return false
+}
+
+// canUpload checks if the token may upload attachments for owners of the type.
+func canUpload(token rest.AccessTokenEntry, ownerType OwnerType) bool {
+	if token.GetRole() == rest.RoleAdmin {
+		return true
+	}
+	handler, ok := ownerTypeHandlers[ownerType]
+	return ok && handler.CanUpload != nil && handler.CanUpload(token)
+}
+
+// canUploadAny checks if the token may upload attachments for owners of any type.
+func canUploadAny(token rest.AccessTokenEntry) bool {
+	if token.GetRole() == rest.RoleAdmin {
+		return true
+	}
+	for ownerType := range ownerTypeHandlers {
+		if canUpload(token, ownerType) {
+			return true
+		}
+	}
+	return false
+}
+
+func maxSize() int64 {
+	if config.Config.Attachments.MaxSize > 0 {
+		return config.Config.Attachments.MaxSize
+	}
+	return defaultMaxSize
+}
+
+func formValue(form *multipart.Form, key string) string {
+	if values := form.Value[key]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// DeleteForOwner deletes all attachments for an owner, including the files.
+// To be called when the owner is deleted.
+func DeleteForOwner(ownerType OwnerType, ownerID string) error {
+	var attachments Attachments
+	dbResult := db.SelectMany(&attachments, "attachments", "owner_type", "=", ownerType, "owner_id", "=", ownerID)
+	if dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	fileStorage, err := getStorage()
+	if err != nil {
+		return err
+	}
+	for _, attachment := range attachments {
+		if dbResult := db.Delete("attachments", "id", "=", attachment.ID); dbResult.IsFailed() {
+			return dbResult.Error
+		}
+		if err := fileStorage.Remove(attachment.ID.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteOrphans deletes the attachments whose owner no longer exists, including the files, or only counts them for dry runs.
+func DeleteOrphans(dryRun bool) (int, error) {
+	var attachments Attachments
+	dbResult := db.SelectMany(&attachments, "attachments")
+	if dbResult.IsFailed() {
+		return 0, dbResult.Error
+	}
+	var fileStorage storage.Storage
+	count := 0
+	for _, attachment := range attachments {
+		if exists, err := attachment.ownerExists(); err != nil {
+			return count, err
+		} else if exists {
+			continue
+		}
+		count++
+		if dryRun {
+			continue
+		}
+		if fileStorage == nil {
+			var err error
+			if fileStorage, err = getStorage(); err != nil {
+				return count - 1, err
+			}
+		}
+		if dbResult := db.Delete("attachments", "id", "=", attachment.ID); dbResult.IsFailed() {
+			return count - 1, dbResult.Error
+		}
+		if err := fileStorage.Remove(attachment.ID.String()); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
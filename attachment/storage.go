@@ -0,0 +1,37 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package attachment
+
+import (
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/storage"
+)
+
+const defaultDirectory = "attachments"
+
+// getStorage returns the configured storage for the files, keyed by attachment ID.
+func getStorage() (storage.Storage, error) {
+	directory := config.Config.Attachments.Directory
+	if directory == "" {
+		directory = defaultDirectory
+	}
+	return storage.Get(directory)
+}
@@ -0,0 +1,110 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+// Package bmc controls the power of physical machines through their baseboard management controllers, using IPMI or Redfish.
+package bmc
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const commandTimeout = 30 * time.Second
+
+// Driver is the protocol used to talk to a BMC.
+type Driver string
+
+const (
+	// DriverIPMI uses IPMI over LAN through ipmitool, which must be installed.
+	DriverIPMI Driver = "ipmi"
+	// DriverRedfish uses the Redfish REST API.
+	DriverRedfish Driver = "redfish"
+)
+
+// Action is a power action.
+type Action string
+
+const (
+	// ActionOn powers on the machine.
+	ActionOn Action = "on"
+	// ActionOff powers off the machine immediately.
+	ActionOff Action = "off"
+	// ActionSoft asks the OS to shut down gracefully.
+	ActionSoft Action = "soft"
+	// ActionReset resets the machine without powering it off.
+	ActionReset Action = "reset"
+	// ActionCycle powers the machine off and on again.
+	ActionCycle Action = "cycle"
+)
+
+// PowerState is the power state of a machine.
+type PowerState string
+
+const (
+	// PowerStateUnknown means the BMC reported something unexpected.
+	PowerStateUnknown PowerState = "unknown"
+	// PowerStateOn means the machine is on (or powering on).
+	PowerStateOn PowerState = "on"
+	// PowerStateOff means the machine is off (or powering off).
+	PowerStateOff PowerState = "off"
+)
+
+// ErrInvalidAction is returned for unknown power actions.
+var ErrInvalidAction = errors.New("invalid power action")
+
+// Credentials are the credentials for a BMC.
+type Credentials struct {
+	Username    string
+	Password    string
+	InsecureTLS bool // Skip verifying the TLS certificate (Redfish)
+}
+
+// Controller controls the power of a single machine.
+type Controller interface {
+	PowerState() (PowerState, error)
+	Power(action Action) error
+}
+
+// New creates a controller for the BMC at the address, which is the host (and optionally port) for IPMI
+// and the base URL or the URL of the computer system for Redfish.
+func New(driver Driver, address string, credentials Credentials) (Controller, error) {
+	if address == "" {
+		return nil, errors.New("missing BMC address")
+	}
+	switch driver {
+	case DriverIPMI:
+		return &ipmiController{address: address, credentials: credentials}, nil
+	case DriverRedfish:
+		return newRedfishController(address, credentials), nil
+	default:
+		return nil, fmt.Errorf("unknown BMC driver %q", driver)
+	}
+}
+
+// IsValidAction checks if the action is a known power action.
+func IsValidAction(action Action) bool {
+	switch action {
+	case ActionOn, ActionOff, ActionSoft, ActionReset, ActionCycle:
+		return true
+	default:
+		return false
+	}
+}
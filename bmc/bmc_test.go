@@ -0,0 +1,79 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package bmc
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gathering/tech-online-backend/helper"
+)
+
+func TestParseIPMIPowerState(t *testing.T) {
+	helper.CheckEqual(t, parseIPMIPowerState("Chassis Power is on\n"), PowerStateOn)
+	helper.CheckEqual(t, parseIPMIPowerState("Chassis Power is off"), PowerStateOff)
+	helper.CheckEqual(t, parseIPMIPowerState("Error: Unable to establish IPMI v2 / RMCP+ session"), PowerStateUnknown)
+}
+
+func TestRedfish(t *testing.T) {
+	var resetType string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "root" || password != "calvin" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.Method + " " + r.URL.Path {
+		case "GET /redfish/v1/Systems":
+			w.Write([]byte(`{"Members": [{"@odata.id": "/redfish/v1/Systems/System.Embedded.1"}]}`))
+		case "GET /redfish/v1/Systems/System.Embedded.1":
+			w.Write([]byte(`{"Id": "System.Embedded.1", "PowerState": "PoweringOff"}`))
+		case "POST /redfish/v1/Systems/System.Embedded.1/Actions/ComputerSystem.Reset":
+			var body map[string]string
+			json.NewDecoder(r.Body).Decode(&body)
+			resetType = body["ResetType"]
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	controller, err := New(DriverRedfish, server.URL, Credentials{Username: "root", Password: "calvin"})
+	helper.CheckEqual(t, err, nil)
+	state, err := controller.PowerState()
+	helper.CheckEqual(t, err, nil)
+	helper.CheckEqual(t, state, PowerStateOff)
+	helper.CheckEqual(t, controller.Power(ActionCycle), nil)
+	helper.CheckEqual(t, resetType, "PowerCycle")
+	helper.CheckEqual(t, controller.Power(Action("explode")), ErrInvalidAction)
+
+	// Explicit system
+	controller, _ = New(DriverRedfish, server.URL+"/redfish/v1/Systems/System.Embedded.1/", Credentials{Username: "root", Password: "calvin"})
+	helper.CheckEqual(t, controller.Power(ActionSoft), nil)
+	helper.CheckEqual(t, resetType, "GracefulShutdown")
+
+	// Bad credentials
+	controller, _ = New(DriverRedfish, server.URL, Credentials{Username: "root", Password: "wrong"})
+	_, err = controller.PowerState()
+	helper.CheckEqual(t, err != nil, true)
+}
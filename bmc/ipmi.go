@@ -0,0 +1,95 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package bmc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+type ipmiController struct {
+	address     string
+	credentials Credentials
+}
+
+func (controller *ipmiController) PowerState() (PowerState, error) {
+	output, err := controller.ipmitool("chassis", "power", "status")
+	if err != nil {
+		return PowerStateUnknown, err
+	}
+	return parseIPMIPowerState(output), nil
+}
+
+func (controller *ipmiController) Power(action Action) error {
+	if !IsValidAction(action) {
+		return ErrInvalidAction
+	}
+	// The actions are named the same as the ipmitool commands
+	_, err := controller.ipmitool("chassis", "power", string(action))
+	return err
+}
+
+// ipmitool runs ipmitool against the BMC, returning stdout or an error containing stderr.
+// The password is passed through the environment to keep it out of the process list.
+func (controller *ipmiController) ipmitool(args ...string) (string, error) {
+	host, port := controller.address, ""
+	if splitHost, splitPort, err := net.SplitHostPort(controller.address); err == nil {
+		host, port = splitHost, splitPort
+	}
+	baseArgs := []string{"-I", "lanplus", "-H", host}
+	if port != "" {
+		baseArgs = append(baseArgs, "-p", port)
+	}
+	if controller.credentials.Username != "" {
+		baseArgs = append(baseArgs, "-U", controller.credentials.Username)
+	}
+	baseArgs = append(baseArgs, "-E")
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ipmitool", append(baseArgs, args...)...)
+	cmd.Env = append(os.Environ(), "IPMI_PASSWORD="+controller.credentials.Password)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("ipmitool %v on %v failed: %v: %v", strings.Join(args, " "), controller.address, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// parseIPMIPowerState parses the output of "ipmitool chassis power status", e.g. "Chassis Power is on".
+func parseIPMIPowerState(output string) PowerState {
+	output = strings.ToLower(strings.TrimSpace(output))
+	switch {
+	case strings.HasSuffix(output, " is on"):
+		return PowerStateOn
+	case strings.HasSuffix(output, " is off"):
+		return PowerStateOff
+	default:
+		return PowerStateUnknown
+	}
+}
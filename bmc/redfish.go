@@ -0,0 +1,160 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package bmc
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const (
+	redfishSystemsPath = "/redfish/v1/Systems"
+	maxResponseSize    = 1 << 20
+)
+
+var redfishResetTypes = map[Action]string{
+	ActionOn:    "On",
+	ActionOff:   "ForceOff",
+	ActionSoft:  "GracefulShutdown",
+	ActionReset: "ForceRestart",
+	ActionCycle: "PowerCycle",
+}
+
+type redfishController struct {
+	baseURL     string
+	systemPath  string // Found from the systems collection if not part of the address
+	credentials Credentials
+	httpClient  *http.Client
+}
+
+func newRedfishController(address string, credentials Credentials) *redfishController {
+	if !strings.Contains(address, "://") {
+		address = "https://" + address
+	}
+	address = strings.TrimSuffix(address, "/")
+	controller := &redfishController{baseURL: address, credentials: credentials}
+	if index := strings.Index(address, redfishSystemsPath+"/"); index >= 0 {
+		controller.baseURL = address[:index]
+		controller.systemPath = address[index:]
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if credentials.InsecureTLS {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	controller.httpClient = &http.Client{Transport: transport, Timeout: commandTimeout}
+	return controller
+}
+
+func (controller *redfishController) PowerState() (PowerState, error) {
+	systemPath, err := controller.system()
+	if err != nil {
+		return PowerStateUnknown, err
+	}
+	var system struct {
+		PowerState string `json:"PowerState"`
+	}
+	if err := controller.do(http.MethodGet, systemPath, nil, &system); err != nil {
+		return PowerStateUnknown, err
+	}
+	switch system.PowerState {
+	case "On", "PoweringOn":
+		return PowerStateOn, nil
+	case "Off", "PoweringOff":
+		return PowerStateOff, nil
+	default:
+		return PowerStateUnknown, nil
+	}
+}
+
+func (controller *redfishController) Power(action Action) error {
+	resetType, ok := redfishResetTypes[action]
+	if !ok {
+		return ErrInvalidAction
+	}
+	systemPath, err := controller.system()
+	if err != nil {
+		return err
+	}
+	return controller.do(http.MethodPost, systemPath+"/Actions/ComputerSystem.Reset", map[string]string{"ResetType": resetType}, nil)
+}
+
+// system gets the path of the computer system, using the first one in the systems collection if not specified.
+func (controller *redfishController) system() (string, error) {
+	if controller.systemPath != "" {
+		return controller.systemPath, nil
+	}
+	var systems struct {
+		Members []struct {
+			ID string `json:"@odata.id"`
+		} `json:"Members"`
+	}
+	if err := controller.do(http.MethodGet, redfishSystemsPath, nil, &systems); err != nil {
+		return "", err
+	}
+	if len(systems.Members) == 0 || systems.Members[0].ID == "" {
+		return "", errors.New("redfish service has no computer systems")
+	}
+	controller.systemPath = systems.Members[0].ID
+	return controller.systemPath, nil
+}
+
+func (controller *redfishController) do(method string, path string, requestBody interface{}, response interface{}) error {
+	var bodyReader io.Reader
+	if requestBody != nil {
+		rawBody, err := json.Marshal(requestBody)
+		if err != nil {
+			return err
+		}
+		bodyReader = bytes.NewReader(rawBody)
+	}
+	request, err := http.NewRequest(method, controller.baseURL+path, bodyReader)
+	if err != nil {
+		return err
+	}
+	request.SetBasicAuth(controller.credentials.Username, controller.credentials.Password)
+	request.Header.Set("Accept", "application/json")
+	if requestBody != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	httpResponse, err := controller.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(httpResponse.Body, maxResponseSize))
+	if err != nil {
+		return err
+	}
+	if httpResponse.StatusCode < 200 || httpResponse.StatusCode > 299 {
+		return fmt.Errorf("redfish returned status %v for %v %v", httpResponse.StatusCode, method, path)
+	}
+	if response == nil {
+		return nil
+	}
+	return json.Unmarshal(body, response)
+}
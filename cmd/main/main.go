@@ -21,20 +21,89 @@ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	_ "github.com/gathering/tech-online-backend/attachment"
 	"github.com/gathering/tech-online-backend/config"
 	"github.com/gathering/tech-online-backend/db"
 	_ "github.com/gathering/tech-online-backend/doc"
+	"github.com/gathering/tech-online-backend/jobs"
 	"github.com/gathering/tech-online-backend/rest"
-	_ "github.com/gathering/tech-online-backend/yolo"
+	"github.com/gathering/tech-online-backend/rpc"
+	"github.com/gathering/tech-online-backend/scheduler"
+	"github.com/gathering/tech-online-backend/systemd"
+	"github.com/gathering/tech-online-backend/tenant"
+	"github.com/gathering/tech-online-backend/yolo"
+	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
 )
 
+const usage = `Usage: %v [-config <file>] [-tenant <id>] [command]
+
+Commands:
+  serve                              Serve the API (default)
+  migrate [schema.sql]               Create missing tables, indexes and columns
+  seed <file.json>                   Insert example data, skipping existing rows (see dev/seed.json)
+  token create <role> [comment] [days]
+                                     Create a non-user token (operator, admin, tester or runner), valid for 365 days by default
+  token list                         List all tokens, without keys
+  token revoke <id>                  Delete a non-static token
+  export-track <track-id> [file]     Export a track bundle (YAML or JSON by file extension, YAML to stdout)
+  import-track <file> [prune]        Import a track bundle
+  import-participants <file.csv> [dry-run]
+                                     Import participants, teams and timeslots from a CSV export of the signup system
+  demo populate|reset                Generate or delete the demo event (requires demo mode)
+  config validate                    Validate the config file without connecting to the database
+  self-check                         Check the handlers against the DB schema, which is also done when serving
+`
+
 func main() {
-	if err := config.ParseConfig("config.json"); err != nil {
+	configFile := flag.String("config", "config.json", "Config file")
+	tenantID := flag.String("tenant", "", "Run as (or run the command for) the tenant with this ID from the config")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), usage, os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	command := "serve"
+	args := flag.Args()
+	if len(args) > 0 && args[0] != "" {
+		command = args[0]
+		args = args[1:]
+	}
+
+	// Commands without DB
+	if command == "config" {
+		if len(args) != 1 || args[0] != "validate" {
+			flag.Usage()
+			os.Exit(2)
+		}
+		if err := config.ValidateFile(*configFile); err != nil {
+			log.WithError(err).Fatal("Invalid config file")
+		}
+		fmt.Println("Config file is valid")
+		return
+	}
+
+	if *tenantID != "" {
+		config.SelectTenant(*tenantID)
+	}
+	if err := config.ParseConfig(*configFile); err != nil {
 		log.WithError(err).Fatal("Failed to read config file")
 		return
 	}
 	log.Info("Read config file")
+	tenant.SetupWorker()
 
 	if err := db.Connect(); err != nil {
 		log.WithError(err).Fatal("Failed to connect to database")
@@ -42,11 +111,323 @@ func main() {
 	}
 	log.Info("Connected to database")
 
+	if command == "self-check" {
+		if err := selfCheck(); err != nil {
+			log.WithError(err).Fatal("Self-check failed")
+		}
+		fmt.Println("Self-check passed")
+		return
+	}
+
+	if command != "serve" {
+		if err := runCommand(command, args); err != nil {
+			log.WithError(err).Fatal("Command failed")
+		}
+		return
+	}
+
+	if config.Config.MigrateOnStart {
+		if err := migrate("schema.sql"); err != nil {
+			log.WithError(err).Fatal("Failed to migrate database")
+			return
+		}
+	}
+
+	if err := selfCheck(); err != nil {
+		log.WithError(err).Fatal("Self-check failed, fix the handlers or migrate the database")
+		return
+	}
+	log.Info("Passed self-check")
+
 	if err := rest.UpdateStaticAccessTokens(); err != nil {
 		log.WithError(err).Fatal("Failed to update static access tokens")
 		return
 	}
 	log.Info("Updated static access tokens")
 
-	rest.StartReceiver()
+	scheduler.Start()
+	log.Info("Started scheduler")
+
+	go reloadOnSignal()
+	go drainOnSignal()
+
+	if config.Config.GRPC.ListenAddress != "" {
+		go rpc.Serve()
+	}
+
+	if err := tenant.StartWorkers(*configFile); err != nil {
+		log.WithError(err).Fatal("Failed to start tenant workers")
+		return
+	}
+
+	rest.StartReceiver(func(address net.Addr) {
+		systemd.Ready()
+		go systemd.RunWatchdog(func(timeout time.Duration) error {
+			return checkHealth(address, timeout)
+		})
+	})
+}
+
+// checkHealth checks that the DB responds and that the server accepts connections, for the systemd watchdog.
+func checkHealth(address net.Addr, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := db.DB.PingContext(ctx); err != nil {
+		return fmt.Errorf("database: %v", err)
+	}
+	conn, err := net.DialTimeout(address.Network(), address.String(), timeout)
+	if err != nil {
+		return fmt.Errorf("server: %v", err)
+	}
+	conn.Close()
+	return nil
+}
+
+// migrate applies the schema file to the DB.
+func migrate(file string) error {
+	schema, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	summary, err := db.ApplySchema(string(schema))
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"applied":       summary.Applied,
+		"existing":      summary.Existing,
+		"added_columns": summary.AddedColumns,
+	}).Info("Applied schema")
+	return nil
+}
+
+// selfCheck checks the handlers against the DB schema, logging each problem.
+func selfCheck() error {
+	problems, err := rest.SelfCheck()
+	if err != nil {
+		return err
+	}
+	for _, problem := range problems {
+		log.WithField("problem", problem).Error("Self-check problem")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%v problems found", len(problems))
+	}
+	return nil
+}
+
+// reloadOnSignal reloads the reloadable config sections on SIGHUP, keeping the old config if the new one is invalid.
+func reloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		log.Info("Got SIGHUP, reloading config")
+		if _, err := config.Reload(); err != nil {
+			log.WithError(err).Error("Failed to reload config, keeping the old one")
+		}
+	}
+}
+
+// drainOnSignal lets the queued background jobs (e.g. notifications) finish before exiting on SIGTERM or SIGINT.
+func drainOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	log.WithField("signal", sig).Info("Shutting down, waiting for background jobs")
+	systemd.Notify("STOPPING=1")
+	tenant.StopWorkers()
+	jobs.Drain()
+	os.Exit(0)
+}
+
+// runCommand runs a one-off command instead of serving.
+func runCommand(command string, args []string) error {
+	switch command {
+	case "migrate":
+		// migrate [schema.sql]
+		file := "schema.sql"
+		if len(args) > 0 {
+			file = args[0]
+		}
+		return migrate(file)
+	case "seed":
+		// seed <file.json>
+		if len(args) < 1 {
+			return fmt.Errorf("usage: seed <file.json>")
+		}
+		data, err := os.ReadFile(args[0])
+		if err != nil {
+			return err
+		}
+		var tables []db.SeedTable
+		if err := json.Unmarshal(data, &tables); err != nil {
+			return err
+		}
+		inserted, err := db.Seed(tables)
+		if err != nil {
+			return err
+		}
+		log.WithField("inserted", inserted).Info("Seeded database")
+		return nil
+	case "token":
+		return runTokenCommand(args)
+	case "export-track":
+		// export-track <track-id> [file.yaml|file.json]
+		if len(args) < 1 {
+			return fmt.Errorf("usage: export-track <track-id> [file]")
+		}
+		bundle, err := yolo.ExportTrackBundle(args[0], args[0])
+		if err != nil {
+			return err
+		}
+		if bundle == nil {
+			return fmt.Errorf("track not found: %v", args[0])
+		}
+		format := yolo.TrackBundleFormatYAML
+		if len(args) > 1 {
+			format = yolo.TrackBundleFormatFromFilename(args[1])
+		}
+		data, err := bundle.Marshal(format)
+		if err != nil {
+			return err
+		}
+		if len(args) > 1 {
+			return os.WriteFile(args[1], data, 0644)
+		}
+		_, err = os.Stdout.Write(data)
+		return err
+	case "import-track":
+		// import-track <file.yaml|file.json> [prune]
+		if len(args) < 1 {
+			return fmt.Errorf("usage: import-track <file> [prune]")
+		}
+		data, err := os.ReadFile(args[0])
+		if err != nil {
+			return err
+		}
+		bundle, err := yolo.UnmarshalTrackBundle(data, yolo.TrackBundleFormatFromFilename(args[0]))
+		if err != nil {
+			return err
+		}
+		prune := len(args) > 1 && args[1] == "prune"
+		summary, result := bundle.Import(prune, "cli")
+		if !result.IsOk() {
+			if result.Error != nil {
+				return result.Error
+			}
+			return fmt.Errorf("%v", result.Message)
+		}
+		log.WithField("summary", fmt.Sprintf("%+v", summary)).Info("Imported track bundle")
+		return nil
+	case "import-participants":
+		// import-participants <file.csv> [dry-run]
+		if len(args) < 1 {
+			return fmt.Errorf("usage: import-participants <file.csv> [dry-run]")
+		}
+		data, err := os.ReadFile(args[0])
+		if err != nil {
+			return err
+		}
+		report, result := yolo.ImportParticipants(data, len(args) > 1 && args[1] == "dry-run", "cli")
+		if !result.IsOk() {
+			if result.Error != nil {
+				return result.Error
+			}
+			return fmt.Errorf("%v", result.Message)
+		}
+		writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, "LINE\tUSERNAME\tCONFLICT")
+		for _, conflict := range report.Conflicts {
+			fmt.Fprintf(writer, "%v\t%v\t%v\n", conflict.Line, conflict.Username, conflict.Message)
+		}
+		writer.Flush()
+		fmt.Printf("%v rows: %v users created, %v updated, %v teams created, %v members added, %v timeslots booked, %v conflicts (dry run: %v)\n",
+			report.Rows, report.UsersCreated, report.UsersUpdated, report.TeamsCreated, report.MembersAdded, report.TimeslotsBooked, len(report.Conflicts), report.DryRun)
+		return nil
+	case "demo":
+		// demo populate|reset
+		if len(args) != 1 || (args[0] != "populate" && args[0] != "reset") {
+			return fmt.Errorf("usage: demo populate|reset")
+		}
+		var result rest.Result
+		if args[0] == "populate" {
+			result = yolo.PopulateDemo()
+		} else {
+			result = yolo.ResetDemo()
+		}
+		if !result.IsOk() {
+			if result.Error != nil {
+				return result.Error
+			}
+			return fmt.Errorf("%v", result.Message)
+		}
+		log.WithField("action", args[0]).Info("Updated demo event")
+		return nil
+	default:
+		return fmt.Errorf("unknown command: %v", command)
+	}
+}
+
+// runTokenCommand runs the token subcommands.
+func runTokenCommand(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: token create|list|revoke")
+	}
+	switch args[0] {
+	case "create":
+		// token create <role> [comment] [days]
+		if len(args) < 2 {
+			return fmt.Errorf("usage: token create <role> [comment] [days]")
+		}
+		comment := ""
+		if len(args) > 2 {
+			comment = args[2]
+		}
+		days := 365
+		if len(args) > 3 {
+			var err error
+			if days, err = strconv.Atoi(args[3]); err != nil || days <= 0 {
+				return fmt.Errorf("invalid number of days: %v", args[3])
+			}
+		}
+		token, err := rest.CreateNonUserAccessToken(rest.Role(args[1]), comment, time.Duration(days)*24*time.Hour)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("ID:      %v\nKey:     %v\nExpires: %v\n", token.ID, token.Key, token.ExpirationTime.Format(time.RFC3339))
+		return nil
+	case "list":
+		tokens, err := rest.ListAccessTokens()
+		if err != nil {
+			return err
+		}
+		writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, "ID\tOWNER\tSTATIC\tEXPIRES\tCOMMENT")
+		for _, token := range tokens {
+			owner := ""
+			if token.OwnerUserID != nil {
+				owner = "user " + token.OwnerUserID.String()
+			} else if token.NonUserRole != nil {
+				owner = string(*token.NonUserRole)
+			}
+			fmt.Fprintf(writer, "%v\t%v\t%v\t%v\t%v\n", token.ID, owner, token.IsStatic, token.ExpirationTime.Format(time.RFC3339), token.Comment)
+		}
+		return writer.Flush()
+	case "revoke":
+		// token revoke <id>
+		if len(args) < 2 {
+			return fmt.Errorf("usage: token revoke <id>")
+		}
+		id, err := uuid.Parse(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid token ID: %v", args[1])
+		}
+		if err := rest.RevokeAccessToken(id); err != nil {
+			return err
+		}
+		log.WithField("id", id).Info("Revoked access token")
+		return nil
+	default:
+		return fmt.Errorf("unknown token command: %v", args[0])
+	}
 }
@@ -0,0 +1,121 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// client is a minimal client for the REST API, authenticating with a token key.
+type client struct {
+	baseURL    string // Including the site prefix, e.g. "https://techo.example.net/api"
+	token      string
+	httpClient *http.Client
+}
+
+// apiError is a non-2xx response, with the message from the API if any.
+type apiError struct {
+	Code    int
+	Message string
+}
+
+func (err *apiError) Error() string {
+	if err.Message == "" {
+		return fmt.Sprintf("request failed with status %v", err.Code)
+	}
+	return fmt.Sprintf("request failed with status %v: %v", err.Code, err.Message)
+}
+
+func newClient(baseURL string, token string) *client {
+	return &client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		token:      token,
+		httpClient: &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+// do sends the request and decodes the JSON response into the result (if not nil), returning the Location header.
+func (c *client) do(method string, path string, query url.Values, contentType string, body []byte, result interface{}) (string, error) {
+	requestURL := c.baseURL + path
+	if len(query) > 0 {
+		requestURL += "?" + query.Encode()
+	}
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+	request, err := http.NewRequest(method, requestURL, bodyReader)
+	if err != nil {
+		return "", err
+	}
+	if c.token != "" {
+		request.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	request.Header.Set("Accept", "application/json")
+
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		var message struct {
+			Message string `json:"message"`
+		}
+		json.Unmarshal(data, &message)
+		return "", &apiError{Code: response.StatusCode, Message: message.Message}
+	}
+	if result != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, result); err != nil {
+			return "", fmt.Errorf("invalid response: %v", err)
+		}
+	}
+	return response.Header.Get("Location"), nil
+}
+
+func (c *client) get(path string, query url.Values, result interface{}) error {
+	_, err := c.do("GET", path, query, "", nil, result)
+	return err
+}
+
+// sendJSON sends the value as JSON with the method.
+func (c *client) sendJSON(method string, path string, value interface{}, result interface{}) error {
+	body, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = c.do(method, path, nil, "application/json", body, result)
+	return err
+}
@@ -0,0 +1,332 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+// Command techoctl is a client for the REST API for common crew tasks.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `Usage: %v [-o table|json] <command>
+
+The API URL (including the site prefix) is read from TECHO_URL (defaults to http://localhost:8080)
+and the access token key from TECHO_TOKEN.
+
+Commands:
+  stations [-track <>] [-status <>]  List stations (credentials require admin)
+  assign [-station <id>] <timeslot-id>
+                                     Assign a station (any available if not given) to a timeslot
+  rotate-credentials <station-id> [credentials]
+                                     Replace the credentials of a station, read from stdin if not given
+  import-bundle [-prune] <file>      Import a track bundle (YAML or JSON by file extension)
+  tail-tests [-track <>] [-interval <seconds>]
+                                     Print test results as they change, until interrupted
+`
+
+// Output formats
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+var outputFormat string
+
+func main() {
+	flag.StringVar(&outputFormat, "o", outputTable, "Output format (table or json)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), usage, os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if outputFormat != outputTable && outputFormat != outputJSON {
+		flag.Usage()
+		os.Exit(2)
+	}
+	args := flag.Args()
+	if len(args) < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	baseURL := os.Getenv("TECHO_URL")
+	if baseURL == "" {
+		baseURL = "http://localhost:8080"
+	}
+	c := newClient(baseURL, os.Getenv("TECHO_TOKEN"))
+	if err := runCommand(c, args[0], args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// runCommand runs the command with its args (including its flags).
+func runCommand(c *client, command string, args []string) error {
+	switch command {
+	case "stations":
+		return listStations(c, args)
+	case "assign":
+		return assignStation(c, args)
+	case "rotate-credentials":
+		return rotateCredentials(c, args)
+	case "import-bundle":
+		return importBundle(c, args)
+	case "tail-tests":
+		return tailTests(c, args)
+	default:
+		return fmt.Errorf("unknown command: %v", command)
+	}
+}
+
+// listStations lists the stations, with credentials if the token may see them.
+func listStations(c *client, args []string) error {
+	flags := flag.NewFlagSet("stations", flag.ExitOnError)
+	track := flags.String("track", "", "Track ID")
+	status := flags.String("status", "", "Station status")
+	flags.Parse(args)
+
+	query := url.Values{}
+	if *track != "" {
+		query.Set("track", *track)
+	}
+	if *status != "" {
+		query.Set("status", *status)
+	}
+	var stations []map[string]interface{}
+	if err := c.get("/admin/stations/", query, &stations); err != nil {
+		return err
+	}
+	sort.SliceStable(stations, func(i, j int) bool {
+		a, b := fmt.Sprint(stations[i]["track"]), fmt.Sprint(stations[j]["track"])
+		if a != b {
+			return a < b
+		}
+		return fmt.Sprint(stations[i]["shortname"]) < fmt.Sprint(stations[j]["shortname"])
+	})
+	return printObjects(stations, []string{"id", "track", "shortname", "status", "health", "timeslot"})
+}
+
+// assignStation assigns the station, or any available one, to the timeslot and prints the station.
+func assignStation(c *client, args []string) error {
+	flags := flag.NewFlagSet("assign", flag.ExitOnError)
+	stationID := flags.String("station", "", "Station ID, any available station if empty")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: assign [-station <id>] <timeslot-id>")
+	}
+
+	query := url.Values{}
+	if *stationID != "" {
+		query.Set("station", *stationID)
+	}
+	// Responds with a redirect to the station
+	var station map[string]interface{}
+	if _, err := c.do("POST", fmt.Sprintf("/timeslot/%v/assign-station/", url.PathEscape(flags.Arg(0))), query, "", nil, &station); err != nil {
+		return err
+	}
+	return printObjects([]map[string]interface{}{station}, []string{"id", "track", "shortname", "status", "timeslot"})
+}
+
+// rotateCredentials replaces the credentials of the station, keeping the rest of it.
+func rotateCredentials(c *client, args []string) error {
+	// rotate-credentials <station-id> [credentials]
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("usage: rotate-credentials <station-id> [credentials]")
+	}
+	var credentials string
+	if len(args) == 2 {
+		credentials = args[1]
+	} else {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		credentials = strings.TrimSuffix(string(data), "\n")
+	}
+	if strings.TrimSpace(credentials) == "" {
+		return fmt.Errorf("empty credentials")
+	}
+
+	// The admin endpoint includes the hidden fields, so they're not cleared when putting the station back
+	var station map[string]interface{}
+	if err := c.get(fmt.Sprintf("/admin/station/%v/", url.PathEscape(args[0])), nil, &station); err != nil {
+		return err
+	}
+	station["credentials"] = credentials
+	if err := c.sendJSON("PUT", fmt.Sprintf("/station/%v/", url.PathEscape(args[0])), station, nil); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Rotated credentials of station %v/%v\n", station["track"], station["shortname"])
+	return nil
+}
+
+// importBundle imports the track bundle file.
+func importBundle(c *client, args []string) error {
+	flags := flag.NewFlagSet("import-bundle", flag.ExitOnError)
+	prune := flags.Bool("prune", false, "Delete tasks, hints, checks and flags not in the bundle")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: import-bundle [-prune] <file>")
+	}
+
+	data, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	contentType := "application/yaml"
+	if strings.HasSuffix(strings.ToLower(flags.Arg(0)), ".json") {
+		contentType = "application/json"
+	}
+	query := url.Values{}
+	if *prune {
+		query.Set("prune", "true")
+	}
+	var summary map[string]interface{}
+	if _, err := c.do("POST", "/tracks/import-bundle/", query, contentType, data, &summary); err != nil {
+		return err
+	}
+	if outputFormat == outputJSON {
+		return printJSON(summary)
+	}
+	keys := make([]string, 0, len(summary))
+	for key := range summary {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, key := range keys {
+		fmt.Fprintf(writer, "%v\t%v\n", strings.ToUpper(key), formatValue(summary[key]))
+	}
+	return writer.Flush()
+}
+
+// tailTests polls the latest test results and prints the ones which changed since the last poll.
+func tailTests(c *client, args []string) error {
+	flags := flag.NewFlagSet("tail-tests", flag.ExitOnError)
+	track := flags.String("track", "", "Track ID")
+	interval := flags.Int("interval", 5, "Poll interval in seconds")
+	flags.Parse(args)
+	if *interval <= 0 {
+		return fmt.Errorf("invalid interval: %v", *interval)
+	}
+
+	query := url.Values{"latest": {""}}
+	if *track != "" {
+		query.Set("track", *track)
+	}
+	columns := []string{"timestamp", "track", "station_shortname", "task_shortname", "shortname", "status_success", "status_description"}
+	var since time.Time
+	printHeader := outputFormat == outputTable
+	for {
+		var tests []map[string]interface{}
+		if err := c.get("/tests/", query, &tests); err != nil {
+			return err
+		}
+		var changed []map[string]interface{}
+		timestamps := make(map[string]time.Time)
+		for _, test := range tests {
+			timestamp, err := time.Parse(time.RFC3339Nano, fmt.Sprint(test["timestamp"]))
+			if err != nil || !timestamp.After(since) {
+				continue
+			}
+			timestamps[fmt.Sprint(test["id"])] = timestamp
+			changed = append(changed, test)
+		}
+		sort.SliceStable(changed, func(i, j int) bool {
+			return timestamps[fmt.Sprint(changed[i]["id"])].Before(timestamps[fmt.Sprint(changed[j]["id"])])
+		})
+		if len(changed) > 0 {
+			since = timestamps[fmt.Sprint(changed[len(changed)-1]["id"])]
+			if outputFormat == outputJSON {
+				encoder := json.NewEncoder(os.Stdout)
+				for _, test := range changed {
+					if err := encoder.Encode(test); err != nil {
+						return err
+					}
+				}
+			} else {
+				writeTable(os.Stdout, changed, columns, printHeader)
+				printHeader = false
+			}
+		}
+		time.Sleep(time.Duration(*interval) * time.Second)
+	}
+}
+
+// printObjects prints the objects as JSON or as a table of the columns.
+func printObjects(objects []map[string]interface{}, columns []string) error {
+	if outputFormat == outputJSON {
+		return printJSON(objects)
+	}
+	return writeTable(os.Stdout, objects, columns, true)
+}
+
+func printJSON(value interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+func writeTable(out io.Writer, objects []map[string]interface{}, columns []string, header bool) error {
+	writer := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	if header {
+		names := make([]string, len(columns))
+		for i, column := range columns {
+			names[i] = strings.ToUpper(column)
+		}
+		fmt.Fprintln(writer, strings.Join(names, "\t"))
+	}
+	for _, object := range objects {
+		values := make([]string, len(columns))
+		for i, column := range columns {
+			values[i] = formatValue(object[column])
+		}
+		fmt.Fprintln(writer, strings.Join(values, "\t"))
+	}
+	return writer.Flush()
+}
+
+// formatValue formats a JSON value for a table cell, on a single line.
+func formatValue(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "-"
+	case string:
+		if value == "" {
+			return "-"
+		}
+		return strings.ReplaceAll(value, "\n", " ")
+	case float64:
+		return fmt.Sprint(value)
+	case bool:
+		return fmt.Sprint(value)
+	}
+	data, _ := json.Marshal(value)
+	return string(data)
+}
@@ -25,29 +25,226 @@ import (
 	"io/ioutil"
 
 	"github.com/google/uuid"
-	log "github.com/sirupsen/logrus"
 )
 
+// Version is the release version, set when building with e.g. "-ldflags '-X github.com/gathering/tech-online-backend/config.Version=2022.1'".
+var Version = "dev"
+
 // Config covers global configuration, and if need be it will provide
 // mechanisms for local overrides (similar to Skogul).
-var Config struct {
-	ListenAddress  string                               `json:"listen_address"`  // Defaults to :8080
-	DatabaseString string                               `json:"database_string"` // For database connections
-	SitePrefix     string                               `json:"site_prefix"`     // URL prefix, e.g. "/api"
-	Debug          bool                                 `json:"debug"`           // Enables trace-debugging
-	OAuth2         OAuth2Config                         `json:"oauth2"`          // OAuth2 section
-	Unicorn        UnicornConfig                        `json:"unicorn"`         // Unicorn IdP section
-	ServerTracks   map[string]ServerTrackConfig         `json:"server_tracks"`   // Static config for server tracks
-	AccessTokens   map[uuid.UUID]AccessTokenEntryConfig `json:"access_tokens"`   // Static config for server tracks
+var Config MainConfig
+
+// MainConfig is the root of the config file.
+type MainConfig struct {
+	ListenAddress        string                               `json:"listen_address"`         // Defaults to :8080
+	HTTPServer           HTTPServerConfig                     `json:"http_server"`            // Timeouts and limits of the HTTP server
+	DatabaseString       string                               `json:"database_string"`        // For database connections
+	DatabasePassword     string                               `json:"database_password"`      // Added to the database string if set, may be a Vault reference
+	DatabasePasswordFile string                               `json:"database_password_file"` // File to read the database password from instead
+	DatabaseSchema       string                               `json:"database_schema"`        // Postgres schema of the tables, defaults to "public"
+	MigrateOnStart       bool                                 `json:"migrate_on_start"`       // Apply "schema.sql" (like the migrate command) before serving
+	QueryTimeoutSeconds  int                                  `json:"query_timeout_seconds"`  // Timeout for each of the concurrent queries of aggregate endpoints, defaults to 10
+	SitePrefix           string                               `json:"site_prefix"`            // URL prefix, e.g. "/api"
+	PublicURL            string                               `json:"public_url"`             // Public URL of the backend (without the site prefix) for absolute links in feeds, e.g. "https://techo.example.net"
+	LogFormat            string                               `json:"log_format"`             // "text" (default) or "json" for structured logs
+	Debug                bool                                 `json:"debug"`                  // Enables trace-debugging, same as the trace log level
+	Log                  LogConfig                            `json:"log"`                    // Log level and output section
+	Archived             bool                                 `json:"archived"`               // Makes the whole event read-only for non-admins after it's over
+	ReadOnly             bool                                 `json:"read_only"`              // Makes mutating requests from non-admins respond with 503, e.g. during DB maintenance
+	ReadOnlyMessage      string                               `json:"read_only_message"`      // Shown to clients in read-only mode, with a default message if empty
+	CORSOrigins          []string                             `json:"cors_origins"`           // Allowed origins for browsers, any if empty
+	OAuth2               OAuth2Config                         `json:"oauth2"`                 // OAuth2 section
+	LDAP                 LDAPConfig                           `json:"ldap"`                   // LDAP/AD login section, for crew without Unicorn accounts
+	Unicorn              UnicornConfig                        `json:"unicorn"`                // Unicorn IdP section
+	Tracks               map[string]TrackConfig               `json:"tracks"`                 // General static config for tracks
+	ServerTracks         map[string]ServerTrackConfig         `json:"server_tracks"`          // Static config for server tracks
+	AccessTokens         map[uuid.UUID]AccessTokenEntryConfig `json:"access_tokens"`          // Static config for server tracks
+	Attachments          AttachmentsConfig                    `json:"attachments"`            // Attachments section
+	Storage              StorageConfig                        `json:"storage"`                // Where attachment files (including test artifacts) are stored
+	Redis                RedisConfig                          `json:"redis"`                  // Shared state (rate limits and caches) for running multiple instances
+	Consoles             ConsolesConfig                       `json:"consoles"`               // Station consoles section
+	TestRunner           TestRunnerConfig                     `json:"test_runner"`            // Built-in test runner section
+	Webhooks             []WebhookConfig                      `json:"webhooks"`               // Outgoing event webhooks
+	EventBus             EventBusConfig                       `json:"event_bus"`              // Publishing events to a NATS or AMQP broker
+	Cron                 []CronEntryConfig                    `json:"cron"`                   // Scheduled actions
+	Flags                FlagsConfig                          `json:"flags"`                  // Flag submissions section
+	Email                EmailConfig                          `json:"email"`                  // Email notifications section
+	Discord              DiscordConfig                        `json:"discord"`                // Discord notifications section
+	CrewAlerts           CrewAlertsConfig                     `json:"crew_alerts"`            // Crew alerts section
+	Gondul               GondulConfig                         `json:"gondul"`                 // Gondul network data section
+	BMC                  BMCConfig                            `json:"bmc"`                    // Power control of physical stations through their BMCs
+	DNS                  DNSConfig                            `json:"dns"`                    // DNS records for station hostnames
+	TimeslotCategories   map[string]TimeslotCategoryConfig    `json:"timeslot_categories"`    // Booking rules and priorities per timeslot category, replacing the defaults
+	ErrorReporting       ErrorReportingConfig                 `json:"error_reporting"`        // Reporting of internal errors and panics
+	Jobs                 JobsConfig                           `json:"jobs"`                   // Worker pool for outbound side effects like notifications and webhooks
+	Retention            RetentionConfig                      `json:"retention"`              // Periodic cleanup of stale data
+	GRPC                 GRPCConfig                           `json:"grpc"`                   // gRPC server for internal integrations like checkers and provisioning agents
+	Calendar             CalendarConfig                       `json:"calendar"`               // iCalendar feeds of timeslots
+	Schedule             ScheduleConfig                       `json:"schedule"`               // Event schedule section
+	Feed                 FeedConfig                           `json:"feed"`                   // Atom feed of announcements and document changes
+	QRCodes              QRCodesConfig                        `json:"qr_codes"`               // QR codes of station and document links for printed table cards
+	Checkers             map[string]CheckerConfig             `json:"checkers"`               // External test checkers posting signed results to the test result hook, by checker ID
+	Demo                 DemoConfig                           `json:"demo"`                   // Generated demo event with simulated participants, for frontend development and crew training
+	Vault                VaultConfig                          `json:"vault"`                  // HashiCorp Vault for secrets given as "vault:<path>#<field>"
+	Mirror               MirrorConfig                         `json:"mirror"`                 // Replaying sampled read requests against a staging instance, logging differing responses
+	Tenants              []TenantConfig                       `json:"tenants"`                // Other events served from the same deployment, each by its own worker process and DB schema
+	TenantID             string                               `json:"-"`                      // Set when running as the worker of a tenant
+}
+
+// HTTPServerConfig contains the timeouts and limits of the HTTP server, to avoid slow clients tying up connections.
+// Timeouts of zero mean the default and negative timeouts disable them.
+type HTTPServerConfig struct {
+	ReadHeaderTimeoutSeconds int   `json:"read_header_timeout_seconds"` // Time to read the request headers, defaults to 10
+	ReadTimeoutSeconds       int   `json:"read_timeout_seconds"`        // Time to read the whole request, defaults to 60
+	WriteTimeoutSeconds      int   `json:"write_timeout_seconds"`       // Time from the end of the request headers until the response is written, defaults to 60
+	IdleTimeoutSeconds       int   `json:"idle_timeout_seconds"`        // Time to keep idle keep-alive connections open, defaults to 120
+	MaxHeaderBytes           int   `json:"max_header_bytes"`            // Max size of the request headers, defaults to 1 MiB
+	MaxBodyBytes             int64 `json:"max_body_bytes"`              // Max size of request bodies, defaults to 4 MiB, higher for attachment uploads (by the attachments max size)
+	DisableKeepAlives        bool  `json:"disable_keep_alives"`         // Close the connection after each request
+	TCPKeepAliveSeconds      int   `json:"tcp_keep_alive_seconds"`      // Interval of TCP keep-alive probes, defaults to 15
+}
+
+// ErrorReportingConfig contains the config for reporting internal errors (5XX responses) and panics to Sentry or a generic webhook.
+type ErrorReportingConfig struct {
+	SentryDSN   string `json:"sentry_dsn"`  // Sentry project DSN, e.g. "https://<key>@sentry.example.net/<project>"
+	WebhookURL  string `json:"webhook_url"` // Reports are POSTed as JSON to it
+	Environment string `json:"environment"` // E.g. "production", sent along with the reports
+}
+
+// RetentionConfig contains the config for the periodic cleanup of stale data.
+type RetentionConfig struct {
+	ExpiredTokenDays        int    `json:"expired_token_days"`        // Expired access tokens are deleted after this many days, defaults to 0 (right away), negative to keep them
+	TerminatedStationDays   int    `json:"terminated_station_days"`   // Terminated stations are cleaned up after this many days, disabled if zero
+	TerminatedStationAction string `json:"terminated_station_action"` // "delete" (default) or "anonymize" (clear credentials, notes and addresses, keeping the station)
+	CaptureHours            int    `json:"capture_hours"`             // Captured requests are dropped after this many hours, defaults to 24, negative to keep them
+	OrphanedAttachments     bool   `json:"orphaned_attachments"`      // Delete attachments (including test artifacts) whose owner no longer exists
+	ReportDays              int    `json:"report_days"`               // Cleanup reports are kept this many days, defaults to 30
+}
+
+// MirrorConfig contains the config for mirroring read requests to a staging instance, to validate changes (e.g. to the
+// DB layer) against production traffic. The replays are sent in the background after responding and don't affect the responses.
+type MirrorConfig struct {
+	BaseURL              string   `json:"base_url"`              // Staging URL including the site prefix, e.g. "https://staging.techo.example.net/api", disabled if empty
+	SamplePercent        float64  `json:"sample_percent"`        // Percentage of the GET requests to replay, 0 to 100
+	PathPattern          string   `json:"path_pattern"`          // Regex for the paths (without the site prefix) to replay, all if empty
+	IgnoreFields         []string `json:"ignore_fields"`         // JSON keys which are expected to differ and are skipped when comparing, e.g. "last_change"
+	ForwardAuthorization bool     `json:"forward_authorization"` // Send the Authorization header along, if staging has a copy of the production tokens
+	TimeoutSeconds       int      `json:"timeout_seconds"`       // Timeout of each replay, defaults to 10
+	MaxConcurrent        int      `json:"max_concurrent"`        // Replays in flight, more are skipped, defaults to 10
+}
+
+// JobsConfig contains the config for the worker pool running outbound side effects in the background.
+type JobsConfig struct {
+	Workers             int `json:"workers"`               // Concurrent jobs, defaults to 4
+	QueueSize           int `json:"queue_size"`            // Jobs waiting beyond this are dropped, defaults to 1000
+	Attempts            int `json:"attempts"`              // Default attempts per job before giving up, defaults to 3
+	RetryDelaySeconds   int `json:"retry_delay_seconds"`   // Default delay between attempts, defaults to 5
+	DrainTimeoutSeconds int `json:"drain_timeout_seconds"` // How long to wait for queued jobs when shutting down, defaults to 30
+}
+
+// GRPCConfig contains the config for the gRPC server, which runs on a separate port.
+type GRPCConfig struct {
+	ListenAddress   string `json:"listen_address"`    // E.g. ":9090", disabled if empty
+	MaxMessageBytes int    `json:"max_message_bytes"` // Max size of request messages, defaults to 4 MiB
+	CertFile        string `json:"cert_file"`         // TLS certificate (PEM, with any intermediates), serves HTTP/2 over TLS instead of cleartext if set
+	KeyFile         string `json:"key_file"`          // TLS private key (PEM), required with cert_file
+}
+
+// CalendarConfig contains the config for the iCalendar feeds of timeslots, which calendar apps subscribe to through signed URLs.
+type CalendarConfig struct {
+	Secret string `json:"secret"` // Signs the feed URLs (HMAC-SHA256), required for signed URLs, changing it invalidates all of them
+}
+
+// ScheduleConfig contains the config for the event schedule, which is stored in UTC.
+type ScheduleConfig struct {
+	Timezone string `json:"timezone"` // IANA timezone to display times in, e.g. "Europe/Oslo", defaults to the server's local timezone
+}
+
+// FeedConfig contains the config for the Atom feed of announcements and document changes.
+type FeedConfig struct {
+	Title      string `json:"title"`       // Defaults to "Tech:Online"
+	MaxEntries int    `json:"max_entries"` // Max entries in the feed, defaults to 50
+}
+
+// QRCodesConfig contains the config for QR codes of station and document links.
+// The URLs are templates, with ".ID", ".Track", ".Shortname" and ".Name" for stations and ".Family" and ".Shortname" for documents.
+type QRCodesConfig struct {
+	StationURL  string `json:"station_url"`  // E.g. "https://techo.example/station/{{.ID}}", no station codes if empty
+	DocumentURL string `json:"document_url"` // E.g. "https://techo.example/docs/{{.Family}}/{{.Shortname}}", no document codes if empty
+	DefaultSize int    `json:"default_size"` // Default width and height in pixels, defaults to 300
+	Level       string `json:"level"`        // Default error correction level, "L", "M" (default), "Q" or "H"
+}
+
+// DemoConfig contains the config for the demo mode, which generates an event with tracks, stations and users and simulates participants.
+// It should only be enabled against a separate database, populating is refused if it contains other tracks.
+type DemoConfig struct {
+	Enabled                   bool  `json:"enabled"`
+	Seed                      int64 `json:"seed"`                        // Seed for the generated data, for reproducible events, random if 0
+	Tracks                    int   `json:"tracks"`                      // Defaults to 2
+	StationsPerTrack          int   `json:"stations_per_track"`          // Defaults to 8
+	TasksPerTrack             int   `json:"tasks_per_track"`             // Defaults to 5
+	TestsPerTask              int   `json:"tests_per_task"`              // Defaults to 3
+	Users                     int   `json:"users"`                       // Defaults to 40
+	TimeslotMinutes           int   `json:"timeslot_minutes"`            // How long simulated participants stay, defaults to 20
+	SimulationIntervalSeconds int   `json:"simulation_interval_seconds"` // How often the simulated participants make progress, defaults to 30
+}
+
+// CheckerConfig contains the config for an external test checker, which posts HMAC-signed test results instead of using an access token.
+// The checker's own IDs for checks and stations are mapped to task and station shortnames within the track.
+type CheckerConfig struct {
+	Secret   string            `json:"secret"`   // Required, signs the payloads (HMAC-SHA256)
+	TrackID  string            `json:"track"`    // Required, the track the results are for
+	Tasks    map[string]string `json:"tasks"`    // Check ID to task shortname, checks are used as task shortnames if empty, unlisted checks are rejected otherwise
+	Stations map[string]string `json:"stations"` // Checker station ID (e.g. hostname) to station shortname, unlisted stations are used as shortnames
+}
+
+// VaultConfig contains the config for reading secrets from HashiCorp Vault (KV secrets engine).
+type VaultConfig struct {
+	Address   string `json:"address"`    // E.g. "https://vault.example.net:8200", defaults to the VAULT_ADDR env var
+	Token     string `json:"token"`      // Defaults to the VAULT_TOKEN env var
+	TokenFile string `json:"token_file"` // File to read the token from instead, e.g. from a Vault agent
+	Namespace string `json:"namespace"`  // Vault Enterprise namespace, if any
+}
+
+// TimeslotCategoryConfig contains the booking rules and assignment priority for a timeslot category.
+type TimeslotCategoryConfig struct {
+	Priority           int  `json:"priority"`             // Higher goes first in the queue and automatic assignment
+	SelfBooking        bool `json:"self_booking"`         // If participants may create timeslots of it for themselves, else only operators/admins
+	MaxDurationSeconds int  `json:"max_duration_seconds"` // Max length of scheduled timeslots, no limit if zero
+	MaxActive          int  `json:"max_active"`           // Max timeslots of it per track with stations at once (operators may exceed it manually), no limit if zero
+	RequireApproval    bool `json:"require_approval"`     // If self-booked timeslots are requested and must be approved by operators/admins before they may begin
+}
+
+// LogConfig contains the config for the log level and output.
+type LogConfig struct {
+	Level      string            `json:"level"`       // "error", "warning", "info" (default), "debug" or "trace"
+	Subsystems map[string]string `json:"subsystems"`  // Levels per subsystem (package), e.g. {"db": "trace"}, overriding the level
+	File       string            `json:"file"`        // File to append to instead of stderr
+	MaxSizeMB  int               `json:"max_size_mb"` // Size before the file is rotated, defaults to 100
+	MaxBackups int               `json:"max_backups"` // Rotated files to keep (as "<file>.1" etc.), defaults to 5
 }
 
 // OAuth2Config contains the OAuth2 config
 type OAuth2Config struct {
-	ClientID     string `json:"client_id"`     // Client ID
-	ClientSecret string `json:"client_secret"` // Client Secret
-	AuthURL      string `json:"auth_url"`      // Authorize URL
-	TokenURL     string `json:"token_url"`     // Token URL
-	RedirectURL  string `json:"redirect_url"`  // Redirect URL
+	ClientID         string `json:"client_id"`          // Client ID
+	ClientSecret     string `json:"client_secret"`      // Client Secret (optional if PKCE is used by a public client)
+	ClientSecretFile string `json:"client_secret_file"` // File to read the client secret from instead
+	AuthURL          string `json:"auth_url"`           // Authorize URL
+	TokenURL         string `json:"token_url"`          // Token URL
+	RedirectURL      string `json:"redirect_url"`       // Redirect URL
+	PKCE             bool   `json:"pkce"`               // Require PKCE (RFC 7636) for logins, allows an empty client secret for public clients
+}
+
+// LDAPConfig contains the config for logging in with LDAP (e.g. Active Directory) accounts.
+type LDAPConfig struct {
+	URL           string            `json:"url"`            // "ldap://<host>[:port]" or "ldaps://<host>[:port]", disabled if empty
+	StartTLS      bool              `json:"start_tls"`      // Upgrade "ldap://" connections using StartTLS
+	BindDN        string            `json:"bind_dn"`        // Service account used to search for users, anonymous if empty
+	BindPassword  string            `json:"bind_password"`  // Service account password
+	BaseDN        string            `json:"base_dn"`        // Required, where to search for users
+	UserAttribute string            `json:"user_attribute"` // Attribute matching the username, defaults to "uid" (e.g. "sAMAccountName" for AD)
+	GroupRoles    map[string]string `json:"group_roles"`    // Group DN (from the "memberOf" attribute) to role ("participant", "operator" or "admin"), the highest applies
+	DefaultRole   string            `json:"default_role"`   // Role for users in none of the groups, which are refused if empty
 }
 
 // UnicornConfig contains the Unicorn IdP config.
@@ -55,19 +252,289 @@ type UnicornConfig struct {
 	ProfileURL string `json:"profile_url"` // URL to the Unicorn IDP profile endpoint
 }
 
+// TrackConfig contains the general static config for a single track (of any type).
+type TrackConfig struct {
+	MaxTeamSize     int               `json:"max_team_size"`    // Max members per team, no limit if zero
+	Capacity        int               `json:"capacity"`         // Max pending/approved registrations before waitlisting, no limit if zero
+	RequireApproval bool              `json:"require_approval"` // If registrations must be approved by an operator/admin
+	AutoAssign      bool              `json:"auto_assign"`      // Automatically assign stations to timeslots when they begin
+	HealthCheck     HealthCheckConfig `json:"health_check"`     // How to check if the stations are up
+	TaskUnlocking   string            `json:"task_unlocking"`   // How participants see tasks with unpassed dependencies: "lock", "hide" or shown normally if empty
+	Reminders       RemindersConfig   `json:"reminders"`        // When and how participants are reminded about their timeslots
+	Teardown        TeardownConfig    `json:"teardown"`         // Automatic release of stations when timeslots expire
+	IPAM            IPAMConfig        `json:"ipam"`             // Pools to allocate station VLANs and prefixes from
+	DNSHostname     string            `json:"dns_hostname"`     // Template for the hostname of assigned stations, e.g. "{{.Team}}.server.techo.example", no records if empty
+	Anomalies       AnomaliesConfig   `json:"anomalies"`        // Detection of suspicious submissions for the anti-cheat crew
+}
+
+// AnomaliesConfig contains the thresholds for detecting suspicious submissions.
+type AnomaliesConfig struct {
+	MinCompletionSeconds int `json:"min_completion_seconds"` // Tasks completed sooner after the timeslot began are flagged, defaults to 60, negative to disable
+}
+
+// IPAMConfig contains the pools which stations get VLAN IDs and IPv4/IPv6 prefixes allocated from.
+// Each kind is allocated only if its pool is configured. Allocations are unique across all tracks.
+type IPAMConfig struct {
+	VLANMin          int    `json:"vlan_min"`           // First VLAN ID in the pool, VLANs are not allocated if zero
+	VLANMax          int    `json:"vlan_max"`           // Last VLAN ID in the pool (inclusive)
+	IPv4Pool         string `json:"ipv4_pool"`          // E.g. "10.100.0.0/16"
+	IPv4PrefixLength int    `json:"ipv4_prefix_length"` // Length of the prefix per station, defaults to 29
+	IPv6Pool         string `json:"ipv6_pool"`          // E.g. "2001:db8:100::/48"
+	IPv6PrefixLength int    `json:"ipv6_prefix_length"` // Length of the prefix per station, defaults to 64
+}
+
+// TeardownConfig contains the config for automatically ending expired timeslots, releasing their stations.
+// Server stations are terminated through the provisioner, net stations become dirty.
+type TeardownConfig struct {
+	Enabled            bool `json:"enabled"`
+	GraceSeconds       int  `json:"grace_seconds"`        // Time after the end time before teardown, defaults to 300
+	WarningLeadSeconds int  `json:"warning_lead_seconds"` // Time before teardown to warn the participants, defaults to 300
+}
+
+// RemindersConfig contains the config for reminding participants before their timeslots begin and end.
+type RemindersConfig struct {
+	UpcomingLeadSeconds int                    `json:"upcoming_lead_seconds"` // Time before the begin time, defaults to 900, disabled if negative
+	EndingLeadSeconds   int                    `json:"ending_lead_seconds"`   // Time before the end time, defaults to 600, disabled if negative
+	Upcoming            ReminderTemplateConfig `json:"upcoming"`              // Overrides the built-in upcoming reminder
+	Ending              ReminderTemplateConfig `json:"ending"`                // Overrides the built-in ending reminder
+}
+
+// ReminderTemplateConfig contains Go text templates for the title and message of a reminder, using the built-in ones if empty.
+// The templates get the track (".Track"), track name (".TrackName"), begin and end times (".BeginTime", ".EndTime") and minutes left (".Minutes").
+type ReminderTemplateConfig struct {
+	Title   string `json:"title"`
+	Message string `json:"message"`
+}
+
+// HealthCheckConfig contains the config for probing the stations of a track, using the station addresses.
+type HealthCheckConfig struct {
+	Kind             string `json:"kind"`              // "icmp", "tcp" or "http", disabled if empty
+	Port             int    `json:"port"`              // Port for TCP and HTTP, required for TCP
+	Path             string `json:"path"`              // Path for HTTP, defaults to "/"
+	IntervalSeconds  int    `json:"interval_seconds"`  // Time between checks, defaults to 60
+	TimeoutSeconds   int    `json:"timeout_seconds"`   // Time before a probe fails, defaults to 5
+	FailureThreshold int    `json:"failure_threshold"` // Consecutive failures before unhealthy, defaults to 3
+}
+
 // ServerTrackConfig contains the static config for a single server track.
 type ServerTrackConfig struct {
-	BaseURL          string `json:"base_url"`
-	TaskType         string `json:"task_type"`
-	MaxInstancesSoft int    `json:"max_instances_soft"` // Number of instances where participants are allowed to spin up their own
-	MaxInstancesHard int    `json:"max_instances_hard"` // Number of instances where operators/admins may spin up another one
-	AuthUsername     string `json:"auth_username"`
-	AuthPassword     string `json:"auth_password"`
+	Driver           string          `json:"driver"` // Provisioning driver, "api" (default), "libvirt", "terraform" or "proxmox"
+	BaseURL          string          `json:"base_url"`
+	TaskType         string          `json:"task_type"`
+	MaxInstancesSoft int             `json:"max_instances_soft"` // Number of instances where participants are allowed to spin up their own
+	MaxInstancesHard int             `json:"max_instances_hard"` // Number of instances where operators/admins may spin up another one
+	MaxSnapshots     int             `json:"max_snapshots"`      // Snapshots per station, defaults to 3
+	AuthUsername     string          `json:"auth_username"`
+	AuthPassword     string          `json:"auth_password"`
+	Libvirt          LibvirtConfig   `json:"libvirt"`   // Config for the libvirt driver
+	Terraform        TerraformConfig `json:"terraform"` // Config for the Terraform driver
+	Proxmox          ProxmoxConfig   `json:"proxmox"`   // Config for the Proxmox VE driver
+}
+
+// LibvirtConfig contains the config for provisioning stations as libvirt domains cloned from a template domain.
+type LibvirtConfig struct {
+	URI            string `json:"uri"`             // Connection URI, e.g. "qemu+ssh://root@host/system", defaults to the local system
+	TemplateDomain string `json:"template_domain"` // Shut off domain to clone new stations from
+	NamePrefix     string `json:"name_prefix"`     // Prefix for new domain names, defaults to "techo-<track>-"
+	Username       string `json:"username"`        // Username baked into the template, shown to participants
+	Password       string `json:"password"`        // Password baked into the template, shown to participants
+	SSHPort        int    `json:"ssh_port"`        // Defaults to 22
+}
+
+// TerraformConfig contains the config for provisioning stations by applying a Terraform module once per station.
+// The module gets the variable "name" (the instance ID) and may output "fqdn", "ipv4_address", "ipv6_address", "ssh_port", "username" and "password".
+type TerraformConfig struct {
+	Binary            string            `json:"binary"`              // Defaults to "terraform"
+	ModuleDirectory   string            `json:"module_directory"`    // Module to copy for each station
+	WorkDirectory     string            `json:"work_directory"`      // Where to keep the per-station copies and state, defaults to "terraform"
+	Variables         map[string]string `json:"variables"`           // Extra variables for the module, e.g. credentials for the cloud
+	MaxConcurrentRuns int               `json:"max_concurrent_runs"` // Max Terraform runs at once for the track, defaults to 2
+}
+
+// ProxmoxConfig contains the config for provisioning stations as Proxmox VE VMs cloned from a template VM.
+type ProxmoxConfig struct {
+	URL                string `json:"url"`                  // API base URL, e.g. "https://pve.example.net:8006"
+	Node               string `json:"node"`                 // Node to create the VMs on, which must have the template
+	TokenID            string `json:"token_id"`             // API token ID, e.g. "techo@pve!backend"
+	TokenSecret        string `json:"token_secret"`         // API token secret
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"` // Skip TLS certificate verification, for self-signed certificates
+	TemplateVMID       int    `json:"template_vmid"`        // Template VM to clone new stations from
+	FullClone          bool   `json:"full_clone"`           // Make full clones instead of linked clones
+	Pool               string `json:"pool"`                 // Resource pool to add the VMs to, if any
+	NamePrefix         string `json:"name_prefix"`          // Prefix for new VM names, defaults to "techo-<track>-"
+	CleanSnapshot      string `json:"clean_snapshot"`       // Snapshot taken after cloning and used for resetting, defaults to "techo-clean"
+	Username           string `json:"username"`             // Username baked into the template, shown to participants
+	Password           string `json:"password"`             // Password baked into the template, shown to participants
+	SSHPort            int    `json:"ssh_port"`             // Defaults to 22
+}
+
+// AttachmentsConfig contains the config for file attachments on documents and tasks.
+type AttachmentsConfig struct {
+	Directory    string   `json:"directory"`     // Where to store the files with the disk storage driver, defaults to "attachments"
+	MaxSize      int64    `json:"max_size"`      // Max file size in bytes, defaults to 10 MiB
+	AllowedTypes []string `json:"allowed_types"` // Allowed MIME types, all types are allowed if empty
+}
+
+// StorageConfig contains the config for where attachment files are stored.
+type StorageConfig struct {
+	Driver           string          `json:"driver"`             // "disk" (default, see the attachments section for the directory) or "s3"
+	S3               S3StorageConfig `json:"s3"`                 // S3-compatible object storage, e.g. AWS S3 or MinIO
+	SignedURLSeconds int             `json:"signed_url_seconds"` // If positive and supported by the driver (S3), downloads redirect to signed URLs valid for this long instead of going through the backend
+}
+
+// S3StorageConfig contains the config for S3-compatible object storage.
+type S3StorageConfig struct {
+	Endpoint        string `json:"endpoint"`          // Required, e.g. "https://s3.eu-north-1.amazonaws.com" or "http://minio:9000"
+	Region          string `json:"region"`            // Defaults to "us-east-1"
+	Bucket          string `json:"bucket"`            // Required
+	Prefix          string `json:"prefix"`            // Prepended to the object keys, e.g. "techo/attachments/"
+	AccessKeyID     string `json:"access_key_id"`     // Required
+	SecretAccessKey string `json:"secret_access_key"` // Required
+	PathStyle       bool   `json:"path_style"`        // Put the bucket in the path instead of the hostname, e.g. for MinIO
+}
+
+// RedisConfig contains the config for Redis, which keeps the rate limits and caches shared between instances instead of in-process.
+type RedisConfig struct {
+	Address   string `json:"address"`    // E.g. "redis:6379", disabled if empty
+	Password  string `json:"password"`   // Optional
+	DB        int    `json:"db"`         // Database number, defaults to 0
+	KeyPrefix string `json:"key_prefix"` // Prepended to all keys, defaults to "techo:"
+}
+
+// ConsolesConfig contains the config for the station console proxy.
+type ConsolesConfig struct {
+	RecordingDirectory string `json:"recording_directory"`  // Where to store session recordings, defaults to "console-recordings"
+	MaxDurationSeconds int    `json:"max_duration_seconds"` // Max session length, defaults to 4 hours
+}
+
+// TestRunnerConfig contains the config for the built-in test runner, which runs the task checks against the stations.
+type TestRunnerConfig struct {
+	Disabled            bool   `json:"disabled"`              // Don't run any checks, e.g. if an external checker is used instead
+	SSHUsername         string `json:"ssh_username"`          // Default username for SSH checks
+	SSHIdentityFile     string `json:"ssh_identity_file"`     // Private key for SSH checks, the ssh client defaults are used if empty
+	MaxConcurrentChecks int    `json:"max_concurrent_checks"` // Defaults to 20
+}
+
+// WebhookConfig contains the config for a single outgoing webhook, which gets events POSTed as JSON.
+type WebhookConfig struct {
+	URL            string   `json:"url"`             // Required
+	Secret         string   `json:"secret"`          // Used to sign the payloads (HMAC-SHA256), optional
+	EventTypes     []string `json:"event_types"`     // Event types to send, with "*" suffix wildcards (e.g. "test.*"), all if empty
+	Tracks         []string `json:"tracks"`          // Only send events for these tracks, all if empty
+	TimeoutSeconds int      `json:"timeout_seconds"` // Defaults to 10
+}
+
+// EventBusConfig contains the config for publishing events to a message broker, for other event infrastructure to consume.
+type EventBusConfig struct {
+	Driver     string   `json:"driver"`      // "nats" or "amqp" (0-9-1, e.g. RabbitMQ), disabled if empty
+	Address    string   `json:"address"`     // Required, host and port, e.g. "nats:4222" or "rabbitmq:5672"
+	Username   string   `json:"username"`    // Optional for NATS, defaults to "guest" for AMQP
+	Password   string   `json:"password"`    // Optional for NATS, defaults to "guest" for AMQP
+	VHost      string   `json:"vhost"`       // AMQP virtual host, defaults to "/"
+	Exchange   string   `json:"exchange"`    // AMQP topic exchange, defaults to "amq.topic"
+	Prefix     string   `json:"prefix"`      // Subject (NATS) or routing key (AMQP) prefix, followed by "." and the event type, defaults to "techo.events"
+	EventTypes []string `json:"event_types"` // Event types to publish, with "*" suffix wildcards (e.g. "test.*"), all if empty
+	Tracks     []string `json:"tracks"`      // Only publish events for these tracks, all if empty
+}
+
+// EmailConfig contains the config for sending events to the affected users by email.
+type EmailConfig struct {
+	Enabled     bool                           `json:"enabled"`
+	Host        string                         `json:"host"`         // SMTP server, required if enabled
+	Port        int                            `json:"port"`         // Defaults to 587 (or 465 with implicit TLS)
+	ImplicitTLS bool                           `json:"implicit_tls"` // Connect using TLS instead of STARTTLS (which is used if the server supports it)
+	Username    string                         `json:"username"`     // SMTP auth username, no auth if empty
+	Password    string                         `json:"password"`     // SMTP auth password
+	From        string                         `json:"from"`         // Sender address, required if enabled
+	EventTypes  []string                       `json:"event_types"`  // Event types to send, with "*" suffix wildcards, defaults to the ones with built-in templates
+	Templates   map[string]EmailTemplateConfig `json:"templates"`    // Templates per event type, overriding the built-in ones
+}
+
+// EmailTemplateConfig contains Go text templates for the subject and body of an email.
+// The templates get the event (".Event"), the recipient (".User") and the site prefix (".SitePrefix").
+type EmailTemplateConfig struct {
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// DiscordConfig contains the config for posting events to Discord channels and DMing participants.
+type DiscordConfig struct {
+	BotToken     string                 `json:"bot_token"`      // Required for DMs
+	DMEventTypes []string               `json:"dm_event_types"` // Event types to DM the affected users about (if they linked their Discord ID), with "*" suffix wildcards, none if empty
+	Channels     []DiscordChannelConfig `json:"channels"`       // Channels to post events to
+}
+
+// DiscordChannelConfig contains the config for posting events to a Discord channel using a channel webhook.
+type DiscordChannelConfig struct {
+	WebhookURL string   `json:"webhook_url"` // Required
+	EventTypes []string `json:"event_types"` // Event types to post, with "*" suffix wildcards, all if empty
+	Tracks     []string `json:"tracks"`      // Only post events for these tracks, all if empty
+}
+
+// CrewAlertsConfig contains the config for batching operational alerts to a Slack or Mattermost incoming webhook.
+type CrewAlertsConfig struct {
+	WebhookURL              string   `json:"webhook_url"`                // Alerts are disabled if empty
+	EventTypes              []string `json:"event_types"`                // Event types to alert about, with "*" suffix wildcards, defaults to health failures, provisioning failures and error spikes
+	Tracks                  []string `json:"tracks"`                     // Only alert for events for these tracks (events without track are always included), all if empty
+	BatchSeconds            int      `json:"batch_seconds"`              // Alerts are collected and sent together at most this often, defaults to 60
+	ErrorSpikeThreshold     int      `json:"error_spike_threshold"`      // Number of 5XX responses within the window which counts as a spike, defaults to 10
+	ErrorSpikeWindowSeconds int      `json:"error_spike_window_seconds"` // Defaults to 60
+}
+
+// GondulConfig contains the config for syncing network data for net-track stations from Gondul.
+type GondulConfig struct {
+	BaseURL             string   `json:"base_url"`              // Sync is disabled if empty
+	Username            string   `json:"username"`              // For basic auth
+	Password            string   `json:"password"`              // For basic auth
+	Tracks              []string `json:"tracks"`                // Net tracks to sync, all net tracks if empty
+	SyncIntervalSeconds int      `json:"sync_interval_seconds"` // Defaults to 300, 0 or less means the default
+}
+
+// BMCConfig contains the config for power control of physical stations (e.g. net-track gear) through IPMI or Redfish BMCs.
+// The BMC of each station is set on the station, referencing credentials by name so the secrets stay out of the database.
+type BMCConfig struct {
+	Credentials          map[string]BMCCredentialsConfig `json:"credentials"`             // Named credentials for stations to reference
+	MaxActionsPerStation int                             `json:"max_actions_per_station"` // Max power actions per station within the window, defaults to 2
+	MaxActions           int                             `json:"max_actions"`             // Max power actions for all stations within the window, defaults to 10
+	WindowSeconds        int                             `json:"window_seconds"`          // Defaults to 300
+}
+
+// BMCCredentialsConfig contains credentials for BMCs.
+type BMCCredentialsConfig struct {
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	InsecureTLS bool   `json:"insecure_tls"` // Skip verifying the TLS certificate (Redfish), since BMCs often have self-signed ones
+}
+
+// DNSConfig contains the config for managing DNS records for the hostnames of stations (see the per-track hostname template).
+type DNSConfig struct {
+	Driver      string `json:"driver"`        // "rfc2136" (using nsupdate) or "powerdns", disabled if empty
+	Zone        string `json:"zone"`          // Required, the zone the records are in, e.g. "techo.example"
+	TTL         int    `json:"ttl"`           // Defaults to 60
+	Server      string `json:"server"`        // RFC 2136: The primary name server, with optional port
+	TSIGKeyFile string `json:"tsig_key_file"` // RFC 2136: Optional TSIG key file for nsupdate
+	BaseURL     string `json:"base_url"`      // PowerDNS: The API URL, e.g. "http://ns1:8081"
+	APIKey      string `json:"api_key"`       // PowerDNS: The API key
+	ServerID    string `json:"server_id"`     // PowerDNS: Defaults to "localhost"
+}
+
+// CronEntryConfig contains the config for running a scheduler action at defined times.
+type CronEntryConfig struct {
+	Name     string `json:"name"`     // Required, shown in the run history
+	Schedule string `json:"schedule"` // Required, cron expression in the local time zone, e.g. "*/30 * * * *" or "@daily"
+	Action   string `json:"action"`   // Required, scheduler action (or periodic job) name
+}
+
+// FlagsConfig contains the config for flag submissions.
+type FlagsConfig struct {
+	MaxAttempts   int `json:"max_attempts"`   // Max attempts per timeslot and task within the window, defaults to 10
+	WindowSeconds int `json:"window_seconds"` // Defaults to 60
 }
 
 // AccessTokenEntryConfig contains the static config for a single non-user access token.
 type AccessTokenEntryConfig struct {
 	Key     string `json:"key"`
+	KeyFile string `json:"key_file"` // File to read the key from instead
 	Role    string `json:"role"`
 	Comment string `json:"comment"`
 }
@@ -75,15 +542,35 @@ type AccessTokenEntryConfig struct {
 // ParseConfig reads a file and parses it as JSON, assuming it will be a
 // valid configuration file.
 func ParseConfig(file string) error {
-	dat, err := ioutil.ReadFile(file)
+	parsed, err := readConfig(file)
 	if err != nil {
 		return err
 	}
-	if err := json.Unmarshal(dat, &Config); err != nil {
+	if err := setupLogging(parsed); err != nil {
 		return err
 	}
-	if Config.Debug {
-		log.SetLevel(log.TraceLevel)
-	}
+	Config = *parsed
+	configFile = file
 	return nil
 }
+
+// readConfig reads and parses a config file.
+func readConfig(file string) (*MainConfig, error) {
+	dat, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var parsed MainConfig
+	if err := json.Unmarshal(dat, &parsed); err != nil {
+		return nil, err
+	}
+	if selectedTenant != "" {
+		if err := applyTenant(&parsed, selectedTenant); err != nil {
+			return nil, err
+		}
+	}
+	if err := resolveSecrets(&parsed); err != nil {
+		return nil, err
+	}
+	return &parsed, nil
+}
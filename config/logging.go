@@ -0,0 +1,204 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const modulePrefix = "github.com/gathering/tech-online-backend/"
+const defaultLogMaxSizeMB = 100
+const defaultLogMaxBackups = 5
+
+// setupLogging sets the log format, levels and output for the config.
+func setupLogging(config *MainConfig) error {
+	var formatter log.Formatter
+	switch config.LogFormat {
+	case "", "text":
+		formatter = &log.TextFormatter{}
+	case "json":
+		formatter = &log.JSONFormatter{}
+	default:
+		return fmt.Errorf("invalid log format: %v", config.LogFormat)
+	}
+
+	level := log.InfoLevel
+	if config.Log.Level != "" {
+		var err error
+		if level, err = log.ParseLevel(config.Log.Level); err != nil {
+			return fmt.Errorf("invalid log level: %v", err)
+		}
+	}
+	if config.Debug {
+		level = log.TraceLevel
+	}
+
+	// The logger must let through the most verbose subsystem level, the formatter drops the rest
+	if len(config.Log.Subsystems) > 0 {
+		subsystemFormatter := subsystemLevelFormatter{formatter: formatter, level: level, subsystems: make(map[string]log.Level)}
+		maxLevel := level
+		for subsystem, rawLevel := range config.Log.Subsystems {
+			subsystemLevel, err := log.ParseLevel(rawLevel)
+			if err != nil {
+				return fmt.Errorf("invalid log level for subsystem %v: %v", subsystem, err)
+			}
+			subsystemFormatter.subsystems[subsystem] = subsystemLevel
+			if subsystemLevel > maxLevel {
+				maxLevel = subsystemLevel
+			}
+		}
+		formatter = subsystemFormatter
+		level = maxLevel
+		log.SetReportCaller(true)
+	} else {
+		log.SetReportCaller(false)
+	}
+	log.SetFormatter(formatter)
+	log.SetLevel(level)
+
+	if config.Log.File != "" {
+		writer, err := openRotatingFile(config.Log.File, config.Log.MaxSizeMB, config.Log.MaxBackups)
+		if err != nil {
+			return fmt.Errorf("failed to open log file: %v", err)
+		}
+		log.SetOutput(writer)
+	} else {
+		log.SetOutput(os.Stderr)
+	}
+	return nil
+}
+
+// subsystemLevelFormatter drops entries above the level of their subsystem, found from the package of the caller.
+type subsystemLevelFormatter struct {
+	formatter  log.Formatter
+	level      log.Level
+	subsystems map[string]log.Level
+}
+
+// Format formats the entry using the underlying formatter, or returns nothing if the entry is dropped.
+func (formatter subsystemLevelFormatter) Format(entry *log.Entry) ([]byte, error) {
+	level := formatter.level
+	if entry.Caller != nil {
+		if subsystemLevel, ok := formatter.subsystems[callerSubsystem(entry.Caller.Function)]; ok {
+			level = subsystemLevel
+		}
+	}
+	if entry.Level > level {
+		return nil, nil
+	}
+	// The caller is only needed for filtering, keep it out of the output
+	withoutCaller := *entry
+	withoutCaller.Caller = nil
+	return formatter.formatter.Format(&withoutCaller)
+}
+
+// callerSubsystem gets the subsystem (top-level package) from a function name,
+// e.g. "db" from "github.com/gathering/tech-online-backend/db.Select".
+func callerSubsystem(function string) string {
+	if !strings.HasPrefix(function, modulePrefix) {
+		return ""
+	}
+	name := strings.TrimPrefix(function, modulePrefix)
+	if index := strings.IndexAny(name, "./"); index >= 0 {
+		name = name[:index]
+	}
+	return name
+}
+
+// rotatingFile is a log file which is renamed to "<file>.1" (and so on) when it gets too big.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	lock       sync.Mutex
+	file       *os.File
+	size       int64
+}
+
+// openRotatingFile opens a log file for appending, with the size in megabytes before rotating it.
+func openRotatingFile(path string, maxSizeMB int, maxBackups int) (*rotatingFile, error) {
+	if maxSizeMB <= 0 {
+		maxSizeMB = defaultLogMaxSizeMB
+	}
+	if maxBackups <= 0 {
+		maxBackups = defaultLogMaxBackups
+	}
+	rotating := &rotatingFile{path: path, maxSize: int64(maxSizeMB) * 1024 * 1024, maxBackups: maxBackups}
+	if err := rotating.open(); err != nil {
+		return nil, err
+	}
+	return rotating, nil
+}
+
+// open opens the file for appending.
+func (rotating *rotatingFile) open() error {
+	file, err := os.OpenFile(rotating.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rotating.file = file
+	rotating.size = info.Size()
+	return nil
+}
+
+// Write writes to the file, rotating it first if it would get too big.
+func (rotating *rotatingFile) Write(data []byte) (int, error) {
+	rotating.lock.Lock()
+	defer rotating.lock.Unlock()
+
+	if rotating.size > 0 && rotating.size+int64(len(data)) > rotating.maxSize {
+		if err := rotating.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to rotate log file: %v\n", err)
+		}
+	}
+	n, err := rotating.file.Write(data)
+	rotating.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the backups, dropping the oldest, moves the file to the first backup and opens a new file.
+func (rotating *rotatingFile) rotate() error {
+	if err := rotating.file.Close(); err != nil {
+		return err
+	}
+	for i := rotating.maxBackups - 1; i >= 1; i-- {
+		// Missing backups are fine
+		os.Rename(fmt.Sprintf("%v.%d", rotating.path, i), fmt.Sprintf("%v.%d", rotating.path, i+1))
+	}
+	if err := os.Rename(rotating.path, rotating.path+".1"); err != nil {
+		// Keep writing to the old file
+		if openErr := rotating.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	return rotating.open()
+}
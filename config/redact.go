@@ -0,0 +1,125 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package config
+
+import (
+	"encoding/json"
+	"net/url"
+	"regexp"
+)
+
+const redactedValue = "<redacted>"
+
+// secretKeys are the JSON keys of secret values, which are redacted wherever they are in the config.
+// Webhook URLs are included since e.g. Discord and Slack webhooks embed the credentials in the URL.
+var secretKeys = map[string]bool{
+	"key":               true,
+	"password":          true,
+	"secret":            true,
+	"token":             true,
+	"client_secret":     true,
+	"database_password": true,
+	"auth_password":     true,
+	"token_secret":      true,
+	"bot_token":         true,
+	"api_key":           true,
+	"secret_access_key": true,
+	"bind_password":     true,
+	"sentry_dsn":        true,
+	"webhook_url":       true,
+	"variables":         true, // Terraform variables, often cloud credentials
+}
+
+// urlKeys are the JSON keys of URLs which may embed credentials (e.g. generic webhooks), which are shown with only the scheme and host.
+var urlKeys = map[string]bool{
+	"url": true,
+}
+
+// connectionPasswordRegex matches the password in key-value or URL database connection strings.
+var connectionPasswordRegex = regexp.MustCompile(`(password=)('(?:[^'\\]|\\.)*'|\S+)|(://[^:/@]*:)([^@]*)(@)`)
+
+// Redacted returns the loaded config as generic JSON values with the secrets replaced, e.g. for showing it to operators.
+// Empty secrets are kept empty, so it's visible which are set.
+func Redacted() (map[string]interface{}, error) {
+	reloadLock.Lock()
+	data, err := json.Marshal(Config)
+	reloadLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	var redacted map[string]interface{}
+	if err := json.Unmarshal(data, &redacted); err != nil {
+		return nil, err
+	}
+	redactValue(redacted)
+	if connectionString, ok := redacted["database_string"].(string); ok {
+		redacted["database_string"] = connectionPasswordRegex.ReplaceAllString(connectionString, "${1}${3}"+redactedValue+"${5}")
+	}
+	return redacted, nil
+}
+
+// redactValue replaces the values of secret keys within a generic JSON value.
+func redactValue(value interface{}) {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		for key, child := range typed {
+			if secretKeys[key] && !isEmptyValue(child) {
+				typed[key] = redactedValue
+				continue
+			}
+			if rawURL, ok := child.(string); ok && urlKeys[key] && rawURL != "" {
+				typed[key] = redactURL(rawURL)
+				continue
+			}
+			redactValue(child)
+		}
+	case []interface{}:
+		for _, child := range typed {
+			redactValue(child)
+		}
+	}
+}
+
+// redactURL keeps the scheme and host of the URL, replacing any credentials, path, query and fragment.
+func redactURL(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Host == "" {
+		return redactedValue
+	}
+	redacted := parsed.Scheme + "://" + parsed.Host
+	if parsed.User != nil || (parsed.Path != "" && parsed.Path != "/") || parsed.RawQuery != "" || parsed.Fragment != "" {
+		redacted += "/" + redactedValue
+	}
+	return redacted
+}
+
+// isEmptyValue checks if a generic JSON value is unset.
+func isEmptyValue(value interface{}) bool {
+	switch typed := value.(type) {
+	case nil:
+		return true
+	case string:
+		return typed == ""
+	case map[string]interface{}:
+		return len(typed) == 0
+	}
+	return false
+}
@@ -0,0 +1,171 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Validator checks a new config before it's reloaded, for checks which belong to other packages (e.g. known drivers).
+type Validator func(candidate *MainConfig) error
+
+// ReloadHook is called after a reload with the names of the sections which changed, e.g. to reset derived state.
+type ReloadHook func(changed []string)
+
+// reloadableSections are the sections which Reload swaps in, by JSON name. Other changes require a restart.
+var reloadableSections = []struct {
+	name string
+	get  func(config *MainConfig) interface{}
+	set  func(config *MainConfig, from *MainConfig)
+}{
+	{"access_tokens", func(c *MainConfig) interface{} { return c.AccessTokens }, func(c *MainConfig, from *MainConfig) { c.AccessTokens = from.AccessTokens }},
+	{"cors_origins", func(c *MainConfig) interface{} { return c.CORSOrigins }, func(c *MainConfig, from *MainConfig) { c.CORSOrigins = from.CORSOrigins }},
+	{"read_only", func(c *MainConfig) interface{} { return []interface{}{c.ReadOnly, c.ReadOnlyMessage} }, func(c *MainConfig, from *MainConfig) {
+		c.ReadOnly, c.ReadOnlyMessage = from.ReadOnly, from.ReadOnlyMessage
+	}},
+	{"flags", func(c *MainConfig) interface{} { return c.Flags }, func(c *MainConfig, from *MainConfig) { c.Flags = from.Flags }},
+	{"bmc", func(c *MainConfig) interface{} { return c.BMC }, func(c *MainConfig, from *MainConfig) { c.BMC = from.BMC }},
+	{"server_tracks", func(c *MainConfig) interface{} { return c.ServerTracks }, func(c *MainConfig, from *MainConfig) { c.ServerTracks = from.ServerTracks }},
+	{"mirror", func(c *MainConfig) interface{} { return c.Mirror }, func(c *MainConfig, from *MainConfig) { c.Mirror = from.Mirror }},
+}
+
+var configFile string
+var reloadLock sync.Mutex
+var validators []Validator
+var reloadHooks []ReloadHook
+
+// AddValidator registers a validator for reloads. Should be called from init functions.
+func AddValidator(validator Validator) {
+	validators = append(validators, validator)
+}
+
+// OnReload registers a hook for after reloads. Should be called from init functions.
+func OnReload(hook ReloadHook) {
+	reloadHooks = append(reloadHooks, hook)
+}
+
+// File returns the path of the loaded config file.
+func File() string {
+	return configFile
+}
+
+// Reload re-reads the config file given to ParseConfig and swaps in the reloadable sections (access tokens, CORS origins,
+// read-only mode, flag and BMC rate limits, server tracks and mirroring) if the whole file is valid, returning the names of the changed sections.
+// Nothing is changed if it fails. Each section is replaced as a whole, the rest of the file is ignored until restarting.
+func Reload() ([]string, error) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	if configFile == "" {
+		return nil, fmt.Errorf("no config file loaded")
+	}
+	candidate, err := readConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := Validate(candidate); err != nil {
+		return nil, err
+	}
+
+	changed := make([]string, 0)
+	for _, section := range reloadableSections {
+		if !reflect.DeepEqual(section.get(&Config), section.get(candidate)) {
+			section.set(&Config, candidate)
+			changed = append(changed, section.name)
+		}
+	}
+	log.WithField("changed", changed).Info("Reloaded config")
+	for _, hook := range reloadHooks {
+		hook(changed)
+	}
+	return changed, nil
+}
+
+// ValidateFile reads and validates a config file without loading it, e.g. before restarting or reloading.
+func ValidateFile(file string) error {
+	candidate, err := readConfig(file)
+	if err != nil {
+		return err
+	}
+	return Validate(candidate)
+}
+
+// Validate checks the config (mainly the reloadable sections) and runs the registered validators.
+func Validate(candidate *MainConfig) error {
+	if candidate.LogFormat != "" && candidate.LogFormat != "text" && candidate.LogFormat != "json" {
+		return fmt.Errorf("invalid log format: %v", candidate.LogFormat)
+	}
+	if candidate.Log.Level != "" {
+		if _, err := log.ParseLevel(candidate.Log.Level); err != nil {
+			return fmt.Errorf("invalid log level: %v", err)
+		}
+	}
+	for subsystem, level := range candidate.Log.Subsystems {
+		if _, err := log.ParseLevel(level); err != nil {
+			return fmt.Errorf("invalid log level for subsystem %v: %v", subsystem, err)
+		}
+	}
+	for id, token := range candidate.AccessTokens {
+		if token.Key == "" {
+			return fmt.Errorf("access token %v: missing key", id)
+		}
+	}
+	for _, origin := range candidate.CORSOrigins {
+		if origin != "*" && !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://") {
+			return fmt.Errorf("invalid CORS origin: %v", origin)
+		}
+	}
+	if candidate.Flags.MaxAttempts < 0 || candidate.Flags.WindowSeconds < 0 {
+		return fmt.Errorf("flags: negative limits")
+	}
+	if candidate.BMC.MaxActions < 0 || candidate.BMC.MaxActionsPerStation < 0 || candidate.BMC.WindowSeconds < 0 {
+		return fmt.Errorf("bmc: negative limits")
+	}
+	for trackID, trackConfig := range candidate.ServerTracks {
+		if trackConfig.MaxInstancesSoft > trackConfig.MaxInstancesHard {
+			return fmt.Errorf("server track %v: soft instance limit above hard limit", trackID)
+		}
+	}
+	if err := validateTenants(candidate); err != nil {
+		return err
+	}
+	for _, validator := range validators {
+		if err := validator(candidate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ChangedSection checks if the section (by JSON name) is in the list of changed sections from a reload.
+func ChangedSection(changed []string, name string) bool {
+	for _, section := range changed {
+		if section == name {
+			return true
+		}
+	}
+	return false
+}
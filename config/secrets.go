@@ -0,0 +1,227 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const vaultPrefix = "vault:"
+const vaultTimeout = 10 * time.Second
+
+// resolveSecrets reads the secrets given as files ("*_file" variants) and Vault references ("vault:<path>#<field>")
+// into the plain fields of a parsed config, so the rest of the backend only sees the plain secrets.
+func resolveSecrets(config *MainConfig) error {
+	vault := vaultReader{config: config.Vault, cache: make(map[string]map[string]interface{})}
+
+	// File variants
+	if err := readSecretFile(&config.OAuth2.ClientSecret, config.OAuth2.ClientSecretFile); err != nil {
+		return fmt.Errorf("oauth2 client secret: %v", err)
+	}
+	if err := readSecretFile(&config.DatabasePassword, config.DatabasePasswordFile); err != nil {
+		return fmt.Errorf("database password: %v", err)
+	}
+	for id, token := range config.AccessTokens {
+		if err := readSecretFile(&token.Key, token.KeyFile); err != nil {
+			return fmt.Errorf("access token %v: %v", id, err)
+		}
+		if err := vault.resolve(&token.Key); err != nil {
+			return fmt.Errorf("access token %v: %v", id, err)
+		}
+		config.AccessTokens[id] = token
+	}
+
+	// Vault references in other secrets
+	secrets := map[string]*string{
+		"oauth2 client secret": &config.OAuth2.ClientSecret,
+		"database password":    &config.DatabasePassword,
+		"email password":       &config.Email.Password,
+		"discord bot token":    &config.Discord.BotToken,
+		"gondul password":      &config.Gondul.Password,
+		"dns api key":          &config.DNS.APIKey,
+		"sentry dsn":           &config.ErrorReporting.SentryDSN,
+		"calendar secret":      &config.Calendar.Secret,
+		"s3 secret access key": &config.Storage.S3.SecretAccessKey,
+		"redis password":       &config.Redis.Password,
+		"event bus password":   &config.EventBus.Password,
+		"ldap bind password":   &config.LDAP.BindPassword,
+	}
+	for i := range config.Webhooks {
+		secrets[fmt.Sprintf("webhook %v secret", i)] = &config.Webhooks[i].Secret
+	}
+	for name, secret := range secrets {
+		if err := vault.resolve(secret); err != nil {
+			return fmt.Errorf("%v: %v", name, err)
+		}
+	}
+	for trackID, trackConfig := range config.ServerTracks {
+		for _, secret := range []*string{&trackConfig.AuthPassword, &trackConfig.Proxmox.TokenSecret} {
+			if err := vault.resolve(secret); err != nil {
+				return fmt.Errorf("server track %v: %v", trackID, err)
+			}
+		}
+		config.ServerTracks[trackID] = trackConfig
+	}
+	for name, credentials := range config.BMC.Credentials {
+		if err := vault.resolve(&credentials.Password); err != nil {
+			return fmt.Errorf("bmc credentials %v: %v", name, err)
+		}
+		config.BMC.Credentials[name] = credentials
+	}
+	for checkerID, checker := range config.Checkers {
+		if err := vault.resolve(&checker.Secret); err != nil {
+			return fmt.Errorf("checker %v: %v", checkerID, err)
+		}
+		config.Checkers[checkerID] = checker
+	}
+
+	if config.DatabasePassword != "" {
+		connectionString, err := withDatabasePassword(config.DatabaseString, config.DatabasePassword)
+		if err != nil {
+			return err
+		}
+		config.DatabaseString = connectionString
+	}
+	return nil
+}
+
+// readSecretFile sets the secret to the content of the file (without the trailing newline), if the file is set.
+func readSecretFile(secret *string, file string) error {
+	if file == "" {
+		return nil
+	}
+	dat, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	*secret = strings.TrimRight(string(dat), "\r\n")
+	return nil
+}
+
+// withDatabasePassword adds the password to a database connection string, either a URL or key-value pairs.
+func withDatabasePassword(connectionString string, password string) (string, error) {
+	if strings.HasPrefix(connectionString, "postgres://") || strings.HasPrefix(connectionString, "postgresql://") {
+		parsedURL, err := url.Parse(connectionString)
+		if err != nil {
+			return "", fmt.Errorf("invalid database string: %v", err)
+		}
+		username := ""
+		if parsedURL.User != nil {
+			username = parsedURL.User.Username()
+		}
+		parsedURL.User = url.UserPassword(username, password)
+		return parsedURL.String(), nil
+	}
+	escaped := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(password)
+	return fmt.Sprintf("%v password='%v'", connectionString, escaped), nil
+}
+
+// vaultReader reads secrets from the Vault KV secrets engine (version 1 or 2), caching each path for the config load.
+type vaultReader struct {
+	config VaultConfig
+	cache  map[string]map[string]interface{}
+}
+
+// resolve replaces the secret with the field from Vault if it's a reference like "vault:secret/data/techo#client_secret".
+func (vault *vaultReader) resolve(secret *string) error {
+	if !strings.HasPrefix(*secret, vaultPrefix) {
+		return nil
+	}
+	reference := strings.TrimPrefix(*secret, vaultPrefix)
+	hashIndex := strings.LastIndex(reference, "#")
+	if hashIndex <= 0 || hashIndex == len(reference)-1 {
+		return fmt.Errorf("invalid vault reference, expected \"vault:<path>#<field>\"")
+	}
+	path := strings.Trim(reference[:hashIndex], "/")
+	field := reference[hashIndex+1:]
+
+	data, ok := vault.cache[path]
+	if !ok {
+		var err error
+		data, err = vault.read(path)
+		if err != nil {
+			return fmt.Errorf("vault path %v: %v", path, err)
+		}
+		vault.cache[path] = data
+	}
+	value, ok := data[field].(string)
+	if !ok {
+		return fmt.Errorf("vault path %v: missing string field %v", path, field)
+	}
+	*secret = value
+	return nil
+}
+
+// read gets the data of a secret, unwrapping the KV version 2 data and metadata.
+func (vault *vaultReader) read(path string) (map[string]interface{}, error) {
+	address := vault.config.Address
+	if address == "" {
+		address = os.Getenv("VAULT_ADDR")
+	}
+	if address == "" {
+		return nil, fmt.Errorf("no vault address configured")
+	}
+	token := vault.config.Token
+	if err := readSecretFile(&token, vault.config.TokenFile); err != nil {
+		return nil, fmt.Errorf("token file: %v", err)
+	}
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+
+	request, err := http.NewRequest(http.MethodGet, strings.TrimRight(address, "/")+"/v1/"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("X-Vault-Token", token)
+	if vault.config.Namespace != "" {
+		request.Header.Set("X-Vault-Namespace", vault.config.Namespace)
+	}
+	client := http.Client{Timeout: vaultTimeout}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault responded with %v", response.Status)
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	if nested, ok := body.Data["data"].(map[string]interface{}); ok {
+		if _, hasMetadata := body.Data["metadata"]; hasMetadata {
+			return nested, nil
+		}
+	}
+	return body.Data, nil
+}
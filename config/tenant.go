@@ -0,0 +1,174 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// TenantConfig contains the config for another event served from the same deployment, e.g. a partner competition.
+// Requests to its hostnames or path prefix are proxied to its worker process, which is this binary running with the
+// main config turned into the tenant config (see SelectTenant). The worker uses its own DB schema, so the events share nothing but the DB server.
+type TenantConfig struct {
+	ID            string          `json:"id"`             // Required, lowercase letters, digits and underscores, e.g. "partner"
+	Hostnames     []string        `json:"hostnames"`      // Requests to these hosts go to the tenant, e.g. "partner.techo.example.net"
+	PathPrefix    string          `json:"path_prefix"`    // Requests under this path go to the tenant with the prefix stripped, e.g. "/partner"
+	ListenAddress string          `json:"listen_address"` // Required, internal address of the worker, e.g. "127.0.0.1:8081"
+	Schema        string          `json:"schema"`         // DB schema, defaults to the ID
+	Config        json.RawMessage `json:"config"`         // Top-level sections replacing the ones of the main config, e.g. "tracks", "oauth2" and "public_url"
+}
+
+var tenantIDRegex = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// tenantReservedSections are the sections which are set from the tenant itself and may not be overridden.
+var tenantReservedSections = map[string]bool{"listen_address": true, "database_schema": true, "tenants": true}
+
+// selectedTenant is the tenant to turn the config into when reading it, if running as the worker of a tenant.
+var selectedTenant string
+
+// SelectTenant makes ParseConfig and Reload turn the main config into the config of the tenant, for its worker process.
+// Must be called before ParseConfig.
+func SelectTenant(id string) {
+	selectedTenant = id
+}
+
+// SchemaName gets the DB schema of the tenant.
+func (tenant *TenantConfig) SchemaName() string {
+	if tenant.Schema != "" {
+		return tenant.Schema
+	}
+	return tenant.ID
+}
+
+// applyTenant turns the main config into the config of the tenant, replacing the sections the tenant overrides.
+// The gRPC server is disabled and Redis keys get the tenant ID in their prefix, unless overridden.
+func applyTenant(config *MainConfig, id string) error {
+	var tenant *TenantConfig
+	for i := range config.Tenants {
+		if config.Tenants[i].ID == id {
+			tenant = &config.Tenants[i]
+			break
+		}
+	}
+	if tenant == nil {
+		return fmt.Errorf("unknown tenant: %v", id)
+	}
+	tenantCopy := *tenant
+
+	var sections map[string]json.RawMessage
+	if len(tenantCopy.Config) > 0 {
+		if err := json.Unmarshal(tenantCopy.Config, &sections); err != nil {
+			return fmt.Errorf("tenant %v: invalid config: %v", id, err)
+		}
+	}
+	configValue := reflect.ValueOf(config).Elem()
+	for name, raw := range sections {
+		field, ok := configSection(configValue, name)
+		if !ok || tenantReservedSections[name] {
+			return fmt.Errorf("tenant %v: unknown or reserved config section: %v", id, name)
+		}
+		// Replace the whole section instead of merging into it
+		field.Set(reflect.Zero(field.Type()))
+		if err := json.Unmarshal(raw, field.Addr().Interface()); err != nil {
+			return fmt.Errorf("tenant %v: invalid config section %v: %v", id, name, err)
+		}
+	}
+
+	config.TenantID = id
+	config.ListenAddress = tenantCopy.ListenAddress
+	config.DatabaseSchema = tenantCopy.SchemaName()
+	config.Tenants = nil
+	if _, ok := sections["grpc"]; !ok {
+		config.GRPC.ListenAddress = ""
+	}
+	if _, ok := sections["redis"]; !ok {
+		prefix := config.Redis.KeyPrefix
+		if prefix == "" {
+			prefix = "techo:"
+		}
+		config.Redis.KeyPrefix = prefix + id + ":"
+	}
+	return nil
+}
+
+// configSection finds the top-level field of the config by JSON name.
+func configSection(configValue reflect.Value, name string) (reflect.Value, bool) {
+	configType := configValue.Type()
+	for i := 0; i < configType.NumField(); i++ {
+		if strings.Split(configType.Field(i).Tag.Get("json"), ",")[0] == name {
+			return configValue.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// validateTenants checks the tenants, including that their config sections apply.
+func validateTenants(candidate *MainConfig) error {
+	ids := make(map[string]bool)
+	hostnames := make(map[string]bool)
+	mainAddress := candidate.ListenAddress
+	if mainAddress == "" {
+		mainAddress = ":8080"
+	}
+	addresses := map[string]bool{mainAddress: true}
+	for _, tenant := range candidate.Tenants {
+		if !tenantIDRegex.MatchString(tenant.ID) {
+			return fmt.Errorf("tenant %q: invalid ID", tenant.ID)
+		}
+		if ids[tenant.ID] {
+			return fmt.Errorf("tenant %v: duplicate ID", tenant.ID)
+		}
+		ids[tenant.ID] = true
+		if tenant.Schema != "" && !tenantIDRegex.MatchString(tenant.Schema) {
+			return fmt.Errorf("tenant %v: invalid schema: %v", tenant.ID, tenant.Schema)
+		}
+		if tenant.SchemaName() == "public" {
+			return fmt.Errorf("tenant %v: the public schema belongs to the main event", tenant.ID)
+		}
+		if len(tenant.Hostnames) == 0 && tenant.PathPrefix == "" {
+			return fmt.Errorf("tenant %v: missing hostnames or path prefix", tenant.ID)
+		}
+		for _, hostname := range tenant.Hostnames {
+			hostname = strings.ToLower(hostname)
+			if hostnames[hostname] {
+				return fmt.Errorf("tenant %v: hostname %v used by multiple tenants", tenant.ID, hostname)
+			}
+			hostnames[hostname] = true
+		}
+		if tenant.PathPrefix != "" && (!strings.HasPrefix(tenant.PathPrefix, "/") || strings.HasSuffix(tenant.PathPrefix, "/")) {
+			return fmt.Errorf("tenant %v: path prefix must start and not end with \"/\"", tenant.ID)
+		}
+		if tenant.ListenAddress == "" || addresses[tenant.ListenAddress] {
+			return fmt.Errorf("tenant %v: missing or duplicate listen address", tenant.ID)
+		}
+		addresses[tenant.ListenAddress] = true
+
+		tenantConfig := *candidate
+		if err := applyTenant(&tenantConfig, tenant.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
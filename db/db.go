@@ -26,10 +26,14 @@ package db
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"net/url"
+	"strings"
 
 	"github.com/gathering/tech-online-backend/config"
 	_ "github.com/lib/pq" // For postgres support
+	log "github.com/sirupsen/logrus"
 )
 
 // DB is the main database handle used throughout the API
@@ -40,6 +44,7 @@ type Error error
 
 type dbError struct {
 	message interface{}
+	query   string // The failed query, if any
 }
 
 func (e dbError) Error() string {
@@ -56,7 +61,30 @@ func newErrorWithCause(messageFormat string, cause error, formatVars ...interfac
 	if cause != nil {
 		fullMessage = fmt.Sprintf("%s: %s", message, cause.Error())
 	}
-	return dbError{fullMessage}
+	return dbError{message: fullMessage}
+}
+
+// newQueryError creates an error for a failed query, keeping the query for error reports.
+func newQueryError(messageFormat string, query string, cause error, formatVars ...interface{}) Error {
+	err := newErrorWithCause(messageFormat, cause, formatVars...).(dbError)
+	err.query = query
+	return err
+}
+
+// ErrorQuery returns the failed query of a DB error, or an empty string if not a query error.
+func ErrorQuery(err error) string {
+	var queryErr dbError
+	if errors.As(err, &queryErr) {
+		return queryErr.query
+	}
+	return ""
+}
+
+// traceQuery logs the query at the trace level, without the cost of building the log entry otherwise.
+func traceQuery(query string, message string) {
+	if log.IsLevelEnabled(log.TraceLevel) {
+		log.WithField("query", query).Trace(message)
+	}
 }
 
 // Result is an update report on write-requests. The precise meaning might
@@ -105,6 +133,12 @@ func Connect() error {
 		return newError("Missing database credentials")
 	}
 
+	if schema := Schema(); schema != "public" {
+		if connectionString, err = withSearchPath(connectionString, schema); err != nil {
+			return err
+		}
+	}
+
 	DB, err = sql.Open("postgres", connectionString)
 	if err != nil {
 		return newError("Failed to connect to database: %v", err)
@@ -112,3 +146,26 @@ func Connect() error {
 
 	return Ping()
 }
+
+// Schema returns the Postgres schema of the tables, which is "public" unless configured (e.g. for tenants).
+func Schema() string {
+	if config.Config.DatabaseSchema != "" {
+		return config.Config.DatabaseSchema
+	}
+	return "public"
+}
+
+// withSearchPath makes the connections use the schema, by adding it to the connection string (either a URL or key-value pairs).
+func withSearchPath(connectionString string, schema string) (string, error) {
+	if strings.HasPrefix(connectionString, "postgres://") || strings.HasPrefix(connectionString, "postgresql://") {
+		parsedURL, err := url.Parse(connectionString)
+		if err != nil {
+			return "", newError("Invalid database string: %v", err)
+		}
+		query := parsedURL.Query()
+		query.Set("search_path", schema)
+		parsedURL.RawQuery = query.Encode()
+		return parsedURL.String(), nil
+	}
+	return fmt.Sprintf("%v search_path='%v'", connectionString, schema), nil
+}
@@ -0,0 +1,89 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package db
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// field is a struct field mapped to a column.
+type field struct {
+	column string
+	index  int  // In the struct
+	ptr    bool // Nil pointers are skipped for inserts and updates
+}
+
+// typeInfo is the column mapping of a struct type. It's computed once per type,
+// since redoing the reflection for every query and row is slow.
+type typeInfo struct {
+	fields  []field
+	columns string // Quoted and comma separated, for selecting all of them
+}
+
+var typeInfos sync.Map // reflect.Type to *typeInfo
+
+// getTypeInfo gets the column mapping of the struct type. It uses the exported fields,
+// named by the "column" tag if present and skipped if it's "-".
+func getTypeInfo(st reflect.Type) (*typeInfo, error) {
+	if cached, ok := typeInfos.Load(st); ok {
+		return cached.(*typeInfo), nil
+	}
+	if st.Kind() != reflect.Struct {
+		return nil, newError("Got the wrong data type. Got %s / %v.", st.Kind(), st)
+	}
+
+	info := typeInfo{}
+	var columns strings.Builder
+	for i := 0; i < st.NumField(); i++ {
+		structField := st.Field(i)
+		if !unicode.IsUpper(rune(structField.Name[0])) {
+			continue
+		}
+		column := structField.Name
+		if tagColumn, ok := structField.Tag.Lookup("column"); ok {
+			column = tagColumn
+		}
+		if column == "-" {
+			continue
+		}
+		info.fields = append(info.fields, field{
+			column: column,
+			index:  i,
+			ptr:    structField.Type.Kind() == reflect.Ptr,
+		})
+		if columns.Len() > 0 {
+			columns.WriteByte(',')
+		}
+		columns.WriteString(quoteColumn(column))
+	}
+	info.columns = columns.String()
+
+	cached, _ := typeInfos.LoadOrStore(st, &info)
+	return cached.(*typeInfo), nil
+}
+
+// quoteColumn quotes the column name, it might be a keyword (like "user").
+func quoteColumn(column string) string {
+	return "\"" + column + "\""
+}
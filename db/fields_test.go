@@ -0,0 +1,181 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package db
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// benchDriver is a fake driver returning the same rows for all queries, to benchmark the mapping without a DB.
+type benchDriver struct{}
+type benchConn struct {
+	rowCount int
+}
+type benchStmt struct {
+	rowCount int
+}
+type benchRows struct {
+	next     int
+	rowCount int
+}
+
+func (benchDriver) Open(name string) (driver.Conn, error) {
+	rowCount, err := strconv.Atoi(name)
+	return benchConn{rowCount: rowCount}, err
+}
+func (conn benchConn) Prepare(query string) (driver.Stmt, error) {
+	return benchStmt{rowCount: conn.rowCount}, nil
+}
+func (benchConn) Close() error                                    { return nil }
+func (benchConn) Begin() (driver.Tx, error)                       { return nil, io.EOF }
+func (benchStmt) Close() error                                    { return nil }
+func (benchStmt) NumInput() int                                   { return -1 }
+func (benchStmt) Exec(args []driver.Value) (driver.Result, error) { return driver.RowsAffected(1), nil }
+func (stmt benchStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return &benchRows{rowCount: stmt.rowCount}, nil
+}
+func (*benchRows) Close() error { return nil }
+
+func (*benchRows) Columns() []string {
+	return []string{"id", "track", "shortname", "name", "Status", "credentials", "notes", "timeslot", "sequence", "ready_time"}
+}
+
+func (rows *benchRows) Next(dest []driver.Value) error {
+	if rows.next >= rows.rowCount {
+		return io.EOF
+	}
+	rows.next++
+	values := []driver.Value{"0b7c1c4e-4f5e-4c53-9b8e-7c5d6a1e2f30", "net", "1", "Station 1", "ready", "hunter2", "", "", int64(rows.next), nil}
+	copy(dest, values)
+	return nil
+}
+
+func init() {
+	sql.Register("bench", benchDriver{})
+}
+
+func withBenchDB(b *testing.B, rowCount int) {
+	// The other tests enable trace logging of all queries
+	oldLevel := log.GetLevel()
+	log.SetLevel(log.InfoLevel)
+	oldDB := DB
+	var err error
+	if DB, err = sql.Open("bench", strconv.Itoa(rowCount)); err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		DB.Close()
+		DB = oldDB
+		log.SetLevel(oldLevel)
+	})
+}
+
+// benchStation is shaped like the typical row structs, with pointers, custom string types and skipped fields.
+type benchStation struct {
+	ID          *uuid.UUID `column:"id"`
+	TrackID     string     `column:"track"`
+	Shortname   string     `column:"shortname"`
+	Name        string     `column:"name"`
+	Status      benchStatus
+	Credentials string     `column:"credentials"`
+	Notes       string     `column:"notes"`
+	TimeslotID  string     `column:"timeslot"`
+	Sequence    *int       `column:"sequence"`
+	ReadyTime   *time.Time `column:"ready_time"`
+	Computed    bool       `column:"-"`
+	internal    string
+}
+
+type benchStatus string
+
+func TestGetTypeInfo(t *testing.T) {
+	info, err := getTypeInfo(reflect.TypeOf(benchStation{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `"id","track","shortname","name","Status","credentials","notes","timeslot","sequence","ready_time"`
+	if info.columns != expected {
+		t.Errorf("Wrong columns: %v", info.columns)
+	}
+	if !info.fields[0].ptr || info.fields[1].ptr || info.fields[4].index != 4 {
+		t.Errorf("Wrong fields: %+v", info.fields)
+	}
+	if _, err := getTypeInfo(reflect.TypeOf("")); err == nil {
+		t.Error("Expected error for non-struct")
+	}
+}
+
+func BenchmarkEnumerate(b *testing.B) {
+	id := uuid.New()
+	station := benchStation{ID: &id, TrackID: "net", Shortname: "1", Name: "Station 1", Status: "ready"}
+	haystacks := map[string]bool{"id": true}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := enumerate(haystacks, &station); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSelectMany(b *testing.B) {
+	withBenchDB(b, 100)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var stations []*benchStation
+		if result := SelectMany(&stations, "stations", "track", "=", "net"); result.Error != nil {
+			b.Fatal(result.Error)
+		}
+		if len(stations) != 100 || stations[0].Sequence == nil || *stations[0].Sequence != 1 {
+			b.Fatal("wrong rows")
+		}
+	}
+}
+
+func BenchmarkSelect(b *testing.B) {
+	withBenchDB(b, 1)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var station benchStation
+		if result := Select(&station, "stations", "id", "=", "x"); !result.IsSuccess() {
+			b.Fatal(result.Error)
+		}
+	}
+}
+
+func BenchmarkInsert(b *testing.B) {
+	withBenchDB(b, 0)
+	id := uuid.New()
+	station := benchStation{ID: &id, TrackID: "net", Shortname: "1", Name: "Station 1", Status: "ready"}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if result := Insert("stations", &station); result.Error != nil {
+			b.Fatal(result.Error)
+		}
+	}
+}
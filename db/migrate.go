@@ -0,0 +1,215 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// schemaColumnRegex matches a column definition line within a CREATE TABLE statement.
+var schemaColumnRegex = regexp.MustCompile(`^\s*"([a-z_0-9]+)"\s+(.+?),?\s*$`)
+
+// schemaTableRegex matches the table name of a CREATE TABLE statement.
+var schemaTableRegex = regexp.MustCompile(`(?i)^CREATE TABLE\s+([a-z_0-9."]+)\s*\(`)
+
+// publicSchemaRegex matches the schema of qualified names in the schema file, which is replaced for other schemas.
+var publicSchemaRegex = regexp.MustCompile(`\bpublic\.`)
+
+// identifierRegex matches the table and column names accepted for seeding.
+var identifierRegex = regexp.MustCompile(`^[a-z_][a-z_0-9]*$`)
+
+// alreadyExistsCodes are the Postgres error codes for objects which already exist.
+var alreadyExistsCodes = map[pq.ErrorCode]bool{
+	"42P06": true, // duplicate_schema
+	"42P07": true, // duplicate_table (and indexes)
+	"42710": true, // duplicate_object
+	"42701": true, // duplicate_column
+}
+
+// MigrationSummary contains what ApplySchema did.
+type MigrationSummary struct {
+	Applied      int      // Statements which created something
+	Existing     int      // Statements for things which already existed
+	AddedColumns []string // Columns added to existing tables, as "table.column"
+}
+
+// ApplySchema applies the SQL schema file content to the database, creating missing tables and indexes and adding
+// missing columns to existing tables. Existing columns are not changed and nothing is dropped.
+// If another schema than "public" is configured, it's created and used instead.
+// Adding a column without a default to a non-empty table fails and must be migrated manually.
+func ApplySchema(schema string) (MigrationSummary, error) {
+	var summary MigrationSummary
+	if DB == nil {
+		return summary, newError("Tried to apply schema without a DB object")
+	}
+
+	// Use a single connection, since the schema sets session settings
+	ctx := context.Background()
+	conn, err := DB.Conn(ctx)
+	if err != nil {
+		return summary, err
+	}
+	defer conn.Close()
+
+	dbSchema := Schema()
+	if dbSchema != "public" {
+		if _, err := conn.ExecContext(ctx, fmt.Sprintf(`CREATE SCHEMA IF NOT EXISTS "%s"`, dbSchema)); err != nil {
+			return summary, newErrorWithCause("Failed to create schema %v", err, dbSchema)
+		}
+	}
+
+	for _, statement := range splitSchemaStatements(schema) {
+		if dbSchema != "public" {
+			statement = publicSchemaRegex.ReplaceAllString(statement, dbSchema+".")
+		}
+		_, err := conn.ExecContext(ctx, statement)
+		if err == nil {
+			summary.Applied++
+			continue
+		}
+		if !isAlreadyExistsError(err) {
+			return summary, newErrorWithCause("Failed to apply schema statement %q", err, firstLine(statement))
+		}
+		summary.Existing++
+
+		// Add missing columns to existing tables
+		tableMatch := schemaTableRegex.FindStringSubmatch(statement)
+		if tableMatch == nil {
+			continue
+		}
+		tableName := strings.TrimPrefix(strings.ReplaceAll(tableMatch[1], `"`, ""), dbSchema+".")
+		for _, line := range strings.Split(statement, "\n")[1:] {
+			columnMatch := schemaColumnRegex.FindStringSubmatch(line)
+			if columnMatch == nil {
+				continue
+			}
+			var exists bool
+			row := conn.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_schema = $1 AND table_name = $2 AND column_name = $3)", dbSchema, tableName, columnMatch[1])
+			if err := row.Scan(&exists); err != nil {
+				return summary, err
+			}
+			if exists {
+				continue
+			}
+			if _, err := conn.ExecContext(ctx, fmt.Sprintf(`ALTER TABLE %s.%s ADD COLUMN "%s" %s`, dbSchema, tableName, columnMatch[1], columnMatch[2])); err != nil {
+				return summary, newErrorWithCause("Failed to add column %v to %v", err, columnMatch[1], tableName)
+			}
+			summary.AddedColumns = append(summary.AddedColumns, tableName+"."+columnMatch[1])
+		}
+	}
+	return summary, nil
+}
+
+// splitSchemaStatements splits the schema into statements, without comment lines. The schema must not contain
+// semicolons within statements (e.g. function bodies).
+func splitSchemaStatements(schema string) []string {
+	var lines []string
+	for _, line := range strings.Split(schema, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "--") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	var statements []string
+	for _, statement := range strings.Split(strings.Join(lines, "\n"), ";") {
+		statement = strings.TrimSpace(statement)
+		if statement != "" {
+			statements = append(statements, statement)
+		}
+	}
+	return statements
+}
+
+// isAlreadyExistsError checks if the error is from creating something which already exists.
+func isAlreadyExistsError(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && alreadyExistsCodes[pqErr.Code]
+}
+
+// firstLine returns the first line of a statement, for error messages.
+func firstLine(statement string) string {
+	return strings.SplitN(statement, "\n", 2)[0]
+}
+
+// SeedTable contains rows to seed into a table, as column values.
+type SeedTable struct {
+	Table string                   `json:"table"`
+	Rows  []map[string]interface{} `json:"rows"`
+}
+
+// Seed inserts rows into tables, skipping rows which conflict with existing ones.
+// Tables are seeded in the given order, so referenced rows can be seeded first. Returns the number of inserted rows.
+func Seed(tables []SeedTable) (int, error) {
+	if DB == nil {
+		return 0, newError("Tried to seed without a DB object")
+	}
+	inserted := 0
+	for _, seedTable := range tables {
+		table := seedTable.Table
+		if !identifierRegex.MatchString(table) {
+			return inserted, newError("Invalid table name: %v", table)
+		}
+		for _, row := range seedTable.Rows {
+			columns := make([]string, 0, len(row))
+			for column := range row {
+				if !identifierRegex.MatchString(column) {
+					return inserted, newError("Invalid column name for %v: %v", table, column)
+				}
+				columns = append(columns, column)
+			}
+			sort.Strings(columns)
+			quoted := make([]string, len(columns))
+			placeholders := make([]string, len(columns))
+			values := make([]interface{}, len(columns))
+			for i, column := range columns {
+				quoted[i] = fmt.Sprintf(`"%s"`, column)
+				placeholders[i] = fmt.Sprintf("$%d", i+1)
+				values[i] = row[column]
+				switch row[column].(type) {
+				case map[string]interface{}, []interface{}:
+					// JSON columns
+					encoded, err := json.Marshal(row[column])
+					if err != nil {
+						return inserted, err
+					}
+					values[i] = string(encoded)
+				}
+			}
+			query := fmt.Sprintf("INSERT INTO %s.%s (%s) VALUES (%s) ON CONFLICT DO NOTHING", Schema(), table, strings.Join(quoted, ", "), strings.Join(placeholders, ", "))
+			result, err := DB.Exec(query, values...)
+			if err != nil {
+				return inserted, newErrorWithCause("Failed to seed %v", err, table)
+			}
+			affected, _ := result.RowsAffected()
+			inserted += int(affected)
+		}
+		log.WithField("table", table).Trace("Seeded table")
+	}
+	return inserted, nil
+}
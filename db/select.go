@@ -21,10 +21,11 @@ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
 package db
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/lib/pq"
 )
 
 // Get gets stuff, fails if not found.
@@ -61,6 +62,11 @@ func Get(item interface{}, table string, searcher ...interface{}) Result {
 // zero-values of the relevant objects. After this, the query is executed
 // and the values are stored on the temporary values. The last pass stores
 func Select(d interface{}, table string, searcher ...interface{}) Result {
+	return SelectContext(context.Background(), d, table, searcher...)
+}
+
+// SelectContext is Select with a context for the query, e.g. for timeouts.
+func SelectContext(ctx context.Context, d interface{}, table string, searcher ...interface{}) Result {
 	st := reflect.ValueOf(d)
 	if st.Kind() != reflect.Ptr {
 		return Result{Error: newError("Select() called with non-pointer interface. This wouldn't really work.")}
@@ -72,7 +78,7 @@ func Select(d interface{}, table string, searcher ...interface{}) Result {
 	retvi := retv.Interface()
 
 	// Do the actual work :D
-	selectResult := SelectMany(&retvi, table, searcher...)
+	selectResult := SelectManyContext(ctx, &retvi, table, searcher...)
 	if selectResult.Error != nil {
 		return selectResult
 	}
@@ -109,9 +115,15 @@ func buildWhere(offset int, search []Selector) (string, []interface{}) {
 			whereand = "AND"
 		}
 		if item.Needle == nil {
-			strsearch = fmt.Sprintf("%s %s %s %s NULL", strsearch, whereand, item.Haystack, item.Operator)
+			strsearch = fmt.Sprintf("%s %s \"%s\" %s NULL", strsearch, whereand, item.Haystack, item.Operator)
+		} else if item.Operator == "IN" {
+			// The needle is a slice, for looking up a batch of rows in one query
+			strsearch = fmt.Sprintf("%s %s \"%s\" = ANY($%d)", strsearch, whereand, item.Haystack, offset+nextidx)
+			nextidx++
+			searcharr = append(searcharr, pq.Array(item.Needle))
 		} else {
-			strsearch = fmt.Sprintf("%s %s %s %s $%d", strsearch, whereand, item.Haystack, item.Operator, offset+nextidx)
+			// Quote the column, it might be a keyword (like "user")
+			strsearch = fmt.Sprintf("%s %s \"%s\" %s $%d", strsearch, whereand, item.Haystack, item.Operator, offset+nextidx)
 			nextidx++
 			searcharr = append(searcharr, item.Needle)
 		}
@@ -135,13 +147,17 @@ func buildWhere(offset int, search []Selector) (string, []interface{}) {
 // that, it will Just Work.
 //
 // It works by first determining the base object/type to fetch by digging
-// into d with reflection. Once that is established, it iterates over the
-// discovered base-structure and does two things: creates the list of
-// columns to SELECT, and creates a reflect.Value for each column to store
-// the result. Once this loop is done, it executes the query, then iterates
-// over the replies, storing them in new base elements. At the very end,
-// the *d is overwritten with the new slice.
+// into d with reflection. Once that is established, it gets the columns
+// of the base-structure (computed once per type, see getTypeInfo),
+// executes the query, then iterates over the replies, scanning them
+// directly into the fields of new base elements. At the very end, the *d
+// is overwritten with the new slice.
 func SelectMany(d interface{}, table string, searcher ...interface{}) Result {
+	return SelectManyContext(context.Background(), d, table, searcher...)
+}
+
+// SelectManyContext is SelectMany with a context for the query, e.g. for timeouts.
+func SelectManyContext(ctx context.Context, d interface{}, table string, searcher ...interface{}) Result {
 	if DB == nil {
 		return Result{Error: newError("Tried to issue SelectMany() without a DB object")}
 	}
@@ -181,64 +197,47 @@ func SelectMany(d interface{}, table string, searcher ...interface{}) Result {
 	// We make a new slice - this is what we will actually return/set
 	retv := reflect.MakeSlice(reflect.SliceOf(st), 0, 0)
 
-	keys, comma := "", ""
-	sample := reflect.New(fieldList)
-	sampleUnderscoreRaw := sample.Interface()
-	haystacks := make(map[string]bool, 0)
-	kvs, err := enumerate(haystacks, true, &sampleUnderscoreRaw)
+	info, err := getTypeInfo(fieldList)
 	if err != nil {
-		return Result{Error: newErrorWithCause("enumerate() failed during query. This is bad.", err)}
-	}
-	for idx := range kvs.keys {
-		keys = fmt.Sprintf("%s%s\"%s\"", keys, comma, kvs.keys[idx])
-		comma = ","
+		return Result{Error: newErrorWithCause("getTypeInfo() failed during query. This is bad.", err)}
 	}
 	strsearch, searcharr := buildWhere(0, search)
-	q := fmt.Sprintf("SELECT %s FROM %s%s", keys, table, strsearch)
-	log.WithField("query", q).Trace("Select()")
-	rows, err := DB.Query(q, searcharr...)
+	q := "SELECT " + info.columns + " FROM " + table + strsearch
+	traceQuery(q, "Select()")
+	rows, err := DB.QueryContext(ctx, q, searcharr...)
 	if err != nil {
-		return Result{Error: newErrorWithCause("Select(): SELECT failed on DB.Query", err)}
+		return Result{Error: newQueryError("Select(): SELECT failed on DB.Query", q, err)}
 	}
 	defer func() {
 		rows.Close()
 	}()
 
-	// Read the rows...
+	// Read the rows, scanning directly into the fields of new elements.
+	// The destination slice is reused for all rows.
+	dests := make([]interface{}, len(info.fields))
 	numElements := 0
-	for {
-		ok := rows.Next()
-		if !ok {
-			break
+	for rows.Next() {
+		newval := reflect.New(fieldList) // A pointer to the new element
+		newelem := newval.Elem()
+		for idx, field := range info.fields {
+			dests[idx] = newelem.Field(field.index).Addr().Interface()
 		}
-
-		err = rows.Scan(kvs.newvals...)
+		err = rows.Scan(dests...)
 		if err != nil {
 			return Result{Error: newErrorWithCause("Select(): SELECT failed to scan", err)}
 		}
 
-		// Create the new slice element
-		newidx := reflect.New(st)
-		newidx = reflect.Indirect(newidx)
-
-		// If it's an array of pointers, we need to fiddle a bit.
-		// This is probably not prefect.
-		newval := newidx
-		if newidx.Kind() == reflect.Ptr {
-			newval = reflect.New(st.Elem()) // returns a _pointer_ to the new value, which is why this works.
-			newidx.Set(newval)
-			newval = reflect.Indirect(newval)
-		}
-
-		for idx := range kvs.newvals {
-			newv := reflect.Indirect(reflect.ValueOf(kvs.newvals[idx]))
-			value := newval.Field(kvs.keyidx[idx])
-			value.Set(newv)
+		// If it's an array of pointers, append the pointer
+		if st.Kind() == reflect.Ptr {
+			retv = reflect.Append(retv, newval)
+		} else {
+			retv = reflect.Append(retv, newelem)
 		}
-
-		retv = reflect.Append(retv, newidx)
 		numElements++
 	}
+	if err := rows.Err(); err != nil {
+		return Result{Error: newQueryError("Select(): SELECT failed while reading rows", q, err)}
+	}
 
 	// Finally - store the new slice to the pointer provided as input
 	setthis := reflect.Indirect(reflect.ValueOf(d))
@@ -257,10 +256,10 @@ func Exists(table string, searcher ...interface{}) Result {
 	}
 	searchstr, searcharr := buildWhere(0, search)
 	q := fmt.Sprintf("SELECT * FROM %s %s LIMIT 1", table, searchstr)
-	log.WithField("query", q).Trace("Exists()")
+	traceQuery(q, "Exists()")
 	rows, err := DB.Query(q, searcharr...)
 	if err != nil {
-		return Result{Error: newErrorWithCause("Exists(): SELECT failed", err)}
+		return Result{Error: newQueryError("Exists(): SELECT failed", q, err)}
 	}
 	defer func() {
 		rows.Close()
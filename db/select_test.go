@@ -204,3 +204,40 @@ func TestInsert(t *testing.T) {
 	db.DB.Close()
 	db.DB = nil
 }
+
+// benchmarkSysnames are looked up by the batch benchmarks, like handlers looking up the users or timeslots of a list.
+var benchmarkSysnames = []string{"e1-1", "e1-2", "e1-3", "e1-4", "e3-1", "e3-2", "e3-3", "e3-4"}
+
+func BenchmarkSelectPerRow(b *testing.B) {
+	err := db.Connect()
+	helper.CheckEqual(b, err, nil)
+	log.SetLevel(log.InfoLevel)
+	defer log.SetLevel(log.TraceLevel)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, sysname := range benchmarkSysnames {
+			var item system
+			result := db.Select(&item, "things", "sysname", "=", sysname)
+			helper.CheckEqual(b, result.Error, nil)
+		}
+	}
+	b.StopTimer()
+	db.DB.Close()
+	db.DB = nil
+}
+
+func BenchmarkSelectBatch(b *testing.B) {
+	err := db.Connect()
+	helper.CheckEqual(b, err, nil)
+	log.SetLevel(log.InfoLevel)
+	defer log.SetLevel(log.TraceLevel)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var items []system
+		result := db.SelectMany(&items, "things", "sysname", "IN", benchmarkSysnames)
+		helper.CheckEqual(b, result.Error, nil)
+	}
+	b.StopTimer()
+	db.DB.Close()
+	db.DB = nil
+}
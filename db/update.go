@@ -52,19 +52,17 @@ package db
 import (
 	"fmt"
 	"reflect"
-	"unicode"
-
-	log "github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
 )
 
 type keyvals struct {
-	keys    []string // name
-	keyidx  []int    // mapping from our index to struct-index (in case of skipping)
-	values  []interface{}
-	newvals []interface{}
+	keys   []string // Column names
+	values []interface{}
 }
 
-func enumerate(haystacks map[string]bool, populate bool, d interface{}) (keyvals, error) {
+// enumerate gets the columns and values of the struct d points to, skipping nil pointers and the haystacks.
+func enumerate(haystacks map[string]bool, d interface{}) (keyvals, error) {
 	v := reflect.ValueOf(d)
 	v = reflect.Indirect(v)
 	if v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
@@ -72,41 +70,27 @@ func enumerate(haystacks map[string]bool, populate bool, d interface{}) (keyvals
 	}
 	v = reflect.Indirect(v)
 
-	st := v.Type()
 	kvs := keyvals{}
-	if st.Kind() != reflect.Struct {
-		return kvs, newError("Got the wrong data type. Got %s / %T.", st.Kind(), d)
+	info, err := getTypeInfo(v.Type())
+	if err != nil {
+		return kvs, err
 	}
 
-	kvs.keys = make([]string, 0)
-	kvs.values = make([]interface{}, 0)
-
-	for i := 0; i < st.NumField(); i++ {
-		field := st.Field(i)
-		value := v.Field(i)
-		if !unicode.IsUpper(rune(field.Name[0])) {
-			continue
-		}
-		col := field.Name
-		if ncol, ok := field.Tag.Lookup("column"); ok {
-			col = ncol
-		}
-		if haystacks[col] || col == "-" {
+	kvs.keys = make([]string, 0, len(info.fields))
+	kvs.values = make([]interface{}, 0, len(info.fields))
+	for _, field := range info.fields {
+		if haystacks[field.column] {
 			continue
 		}
-
-		if field.Type.Kind() == reflect.Ptr && value.IsNil() {
-			if !populate {
+		value := v.Field(field.index)
+		if field.ptr {
+			if value.IsNil() {
 				continue
 			}
-			value = reflect.New(field.Type.Elem())
-		} else {
-			value = reflect.Indirect(value)
+			value = value.Elem()
 		}
-		kvs.keys = append(kvs.keys, col)
+		kvs.keys = append(kvs.keys, field.column)
 		kvs.values = append(kvs.values, value.Interface())
-		kvs.newvals = append(kvs.newvals, reflect.New(value.Type()).Interface())
-		kvs.keyidx = append(kvs.keyidx, i)
 	}
 	return kvs, nil
 }
@@ -126,28 +110,33 @@ func Update(table string, d interface{}, searcher ...interface{}) Result {
 	for _, item := range search {
 		haystacks[item.Haystack] = true
 	}
-	kvs, err := enumerate(haystacks, false, d)
+	kvs, err := enumerate(haystacks, d)
 	if err != nil {
 		report.Failed++
 		report.Error = newErrorWithCause("Update(): enumerate() failed", err)
 		return report
 	}
-	lead := fmt.Sprintf("UPDATE %s SET ", table)
-	comma := ""
-	last := 0
+	var query strings.Builder
+	query.WriteString("UPDATE ")
+	query.WriteString(table)
+	query.WriteString(" SET ")
 	for idx := range kvs.keys {
-		lead = fmt.Sprintf("%s%s\"%s\" = $%d", lead, comma, kvs.keys[idx], idx+1)
-		comma = ", "
-		last = idx
+		if idx > 0 {
+			query.WriteString(", ")
+		}
+		query.WriteString(quoteColumn(kvs.keys[idx]))
+		query.WriteString(" = $")
+		query.WriteString(strconv.Itoa(idx + 1))
 	}
-	strsearch, searcharr := buildWhere(last+1, search)
-	lead = fmt.Sprintf("%s%s", lead, strsearch)
+	strsearch, searcharr := buildWhere(len(kvs.keys), search)
+	query.WriteString(strsearch)
+	lead := query.String()
 	kvs.values = append(kvs.values, searcharr...)
 	res, err := DB.Exec(lead, kvs.values...)
-	log.WithField("query", lead).Trace("Update()")
+	traceQuery(lead, "Update()")
 	if err != nil {
 		report.Failed++
-		report.Error = newErrorWithCause("Update(): EXEC failed", err)
+		report.Error = newQueryError("Update(): EXEC failed", lead, err)
 		return report
 	}
 	rowsaf, _ := res.RowsAffected()
@@ -165,25 +154,36 @@ func Update(table string, d interface{}, searcher ...interface{}) Result {
 func Insert(table string, d interface{}) Result {
 	report := Result{}
 	haystacks := make(map[string]bool, 0)
-	kvs, err := enumerate(haystacks, false, d)
+	kvs, err := enumerate(haystacks, d)
 	if err != nil {
 		report.Failed++
 		report.Error = newErrorWithCause("Insert(): Enumerate failed", err)
 		return report
 	}
-	lead := fmt.Sprintf("INSERT INTO %s (", table)
-	middle := ""
-	comma := ""
+	var query strings.Builder
+	query.WriteString("INSERT INTO ")
+	query.WriteString(table)
+	query.WriteString(" (")
+	for idx := range kvs.keys {
+		if idx > 0 {
+			query.WriteString(", ")
+		}
+		query.WriteString(quoteColumn(kvs.keys[idx]))
+	}
+	query.WriteString(") VALUES(")
 	for idx := range kvs.keys {
-		lead = fmt.Sprintf("%s%s\"%s\" ", lead, comma, kvs.keys[idx])
-		middle = fmt.Sprintf("%s%s$%d ", middle, comma, idx+1)
-		comma = ", "
+		if idx > 0 {
+			query.WriteString(", ")
+		}
+		query.WriteString("$")
+		query.WriteString(strconv.Itoa(idx + 1))
 	}
-	lead = fmt.Sprintf("%s) VALUES(%s)", lead, middle)
+	query.WriteString(")")
+	lead := query.String()
 	res, err := DB.Exec(lead, kvs.values...)
-	log.WithField("query", lead).Trace("Insert()")
+	traceQuery(lead, "Insert()")
 	if err != nil {
-		report.Error = newErrorWithCause("Insert(): EXEC failed", err)
+		report.Error = newQueryError("Insert(): EXEC failed", lead, err)
 		return report
 	}
 	rowsaf, _ := res.RowsAffected()
@@ -228,10 +228,10 @@ func Delete(table string, searcher ...interface{}) Result {
 	strsearch, searcharr := buildWhere(0, search)
 	q := fmt.Sprintf("DELETE FROM %s%s", table, strsearch)
 	res, err := DB.Exec(q, searcharr...)
-	log.WithField("query", q).Trace("Delete()")
+	traceQuery(q, "Delete()")
 	if err != nil {
 		report.Failed++
-		report.Error = newErrorWithCause("Delete(): Query failed", err)
+		report.Error = newQueryError("Delete(): Query failed", q, err)
 		return report
 	}
 	rowsaf, _ := res.RowsAffected()
@@ -0,0 +1,119 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+// Package dns manages DNS records for station hostnames, using RFC 2136 dynamic updates (through nsupdate) or the PowerDNS API.
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+)
+
+const (
+	defaultTTL     = 60
+	commandTimeout = 10 * time.Second
+)
+
+// ErrNotConfigured means DNS management is disabled.
+var ErrNotConfigured = errors.New("DNS is not configured")
+
+// Record types managed for hostnames. Setting a record replaces records of the other types.
+var managedTypes = []string{"A", "AAAA", "CNAME"}
+
+// Updater creates, replaces and deletes records for hostnames.
+type Updater interface {
+	// SetRecord sets the single record for the name, replacing any managed records.
+	SetRecord(name string, recordType string, value string) error
+	// DeleteRecords deletes all managed records for the name.
+	DeleteRecords(name string) error
+}
+
+// New creates an updater from the config.
+func New(dnsConfig config.DNSConfig) (Updater, error) {
+	if dnsConfig.Driver == "" {
+		return nil, ErrNotConfigured
+	}
+	if dnsConfig.Zone == "" {
+		return nil, errors.New("missing DNS zone")
+	}
+	if dnsConfig.TTL <= 0 {
+		dnsConfig.TTL = defaultTTL
+	}
+	switch dnsConfig.Driver {
+	case "rfc2136":
+		if dnsConfig.Server == "" {
+			return nil, errors.New("missing DNS server")
+		}
+		return &nsupdateUpdater{config: dnsConfig}, nil
+	case "powerdns":
+		if dnsConfig.BaseURL == "" {
+			return nil, errors.New("missing PowerDNS base URL")
+		}
+		return newPowerDNSUpdater(dnsConfig), nil
+	default:
+		return nil, fmt.Errorf("unknown DNS driver %q", dnsConfig.Driver)
+	}
+}
+
+// RecordFor gets the record type and value for pointing a name at the target, which is an IP address (A/AAAA) or hostname (CNAME).
+func RecordFor(target string) (string, string) {
+	if address, err := netip.ParseAddr(target); err == nil {
+		if address.Is4() || address.Is4In6() {
+			return "A", address.Unmap().String()
+		}
+		return "AAAA", address.String()
+	}
+	return "CNAME", Canonical(target)
+}
+
+// Canonical gets the fully qualified form of the name, lowercase with the trailing dot.
+func Canonical(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, ".")) + "."
+}
+
+// InZone checks if the name is within the zone (and not the apex).
+func InZone(name string, zone string) bool {
+	return strings.HasSuffix(Canonical(name), "."+Canonical(zone))
+}
+
+// Label makes a DNS label from a name, e.g. a team name, keeping letters and digits and replacing the rest with hyphens.
+func Label(name string) string {
+	var builder strings.Builder
+	lastHyphen := true
+	for _, char := range strings.ToLower(name) {
+		if (char >= 'a' && char <= 'z') || (char >= '0' && char <= '9') {
+			builder.WriteRune(char)
+			lastHyphen = false
+		} else if !lastHyphen {
+			builder.WriteByte('-')
+			lastHyphen = true
+		}
+	}
+	label := strings.TrimSuffix(builder.String(), "-")
+	if len(label) > 63 {
+		label = strings.TrimSuffix(label[:63], "-")
+	}
+	return label
+}
@@ -0,0 +1,103 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package dns
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/helper"
+)
+
+func TestRecordFor(t *testing.T) {
+	recordType, value := RecordFor("10.0.0.5")
+	helper.CheckEqual(t, recordType, "A")
+	helper.CheckEqual(t, value, "10.0.0.5")
+	recordType, value = RecordFor("2001:db8::5")
+	helper.CheckEqual(t, recordType, "AAAA")
+	helper.CheckEqual(t, value, "2001:db8::5")
+	recordType, value = RecordFor("VM-17.Cloud.example")
+	helper.CheckEqual(t, recordType, "CNAME")
+	helper.CheckEqual(t, value, "vm-17.cloud.example.")
+}
+
+func TestLabel(t *testing.T) {
+	helper.CheckEqual(t, Label("Team 3"), "team-3")
+	helper.CheckEqual(t, Label("--Blåbær & Co.--"), "bl-b-r-co")
+	helper.CheckEqual(t, Label("!!!"), "")
+}
+
+func TestInZone(t *testing.T) {
+	helper.CheckEqual(t, InZone("team3.server.techo.example", "techo.example."), true)
+	helper.CheckEqual(t, InZone("techo.example", "techo.example"), false)
+	helper.CheckEqual(t, InZone("team3.notecho.example", "techo.example"), false)
+}
+
+func TestBuildNSUpdateScript(t *testing.T) {
+	dnsConfig := config.DNSConfig{Zone: "techo.example", Server: "10.0.0.53:5353", TTL: 60}
+	script := buildNSUpdateScript(dnsConfig, "team3.server.techo.example", &nsupdateRecord{recordType: "A", value: "10.0.0.5"})
+	helper.CheckEqual(t, script, `server 10.0.0.53 5353
+zone techo.example.
+update delete team3.server.techo.example. A
+update delete team3.server.techo.example. AAAA
+update delete team3.server.techo.example. CNAME
+update add team3.server.techo.example. 60 A 10.0.0.5
+send
+`)
+}
+
+func TestPowerDNS(t *testing.T) {
+	var rrsets []powerDNSRRSet
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		helper.CheckEqual(t, r.Method, http.MethodPatch)
+		helper.CheckEqual(t, r.URL.Path, "/api/v1/servers/localhost/zones/techo.example.")
+		var body struct {
+			RRSets []powerDNSRRSet `json:"rrsets"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		rrsets = body.RRSets
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	updater, err := New(config.DNSConfig{Driver: "powerdns", Zone: "techo.example", BaseURL: server.URL, APIKey: "secret"})
+	helper.CheckEqual(t, err, nil)
+	helper.CheckEqual(t, updater.SetRecord("team3.server.techo.example", "AAAA", "2001:db8::5"), nil)
+	helper.CheckEqual(t, len(rrsets), 3)
+	helper.CheckEqual(t, rrsets[1].Type, "AAAA")
+	helper.CheckEqual(t, rrsets[1].ChangeType, "REPLACE")
+	helper.CheckEqual(t, rrsets[1].TTL, 60)
+	helper.CheckEqual(t, rrsets[1].Records[0].Content, "2001:db8::5")
+	helper.CheckEqual(t, rrsets[0].ChangeType, "DELETE")
+
+	helper.CheckEqual(t, updater.DeleteRecords("team3.server.techo.example"), nil)
+	helper.CheckEqual(t, rrsets[1].ChangeType, "DELETE")
+
+	_, err = New(config.DNSConfig{})
+	helper.CheckEqual(t, err, ErrNotConfigured)
+}
@@ -0,0 +1,87 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package dns
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+
+	"github.com/gathering/tech-online-backend/config"
+)
+
+// nsupdateUpdater sends RFC 2136 dynamic updates using nsupdate, which must be installed.
+type nsupdateUpdater struct {
+	config config.DNSConfig
+}
+
+func (updater *nsupdateUpdater) SetRecord(name string, recordType string, value string) error {
+	return updater.nsupdate(buildNSUpdateScript(updater.config, name, &nsupdateRecord{recordType: recordType, value: value}))
+}
+
+func (updater *nsupdateUpdater) DeleteRecords(name string) error {
+	return updater.nsupdate(buildNSUpdateScript(updater.config, name, nil))
+}
+
+type nsupdateRecord struct {
+	recordType string
+	value      string
+}
+
+// buildNSUpdateScript builds an nsupdate script deleting the managed records for the name and optionally adding a new one,
+// sent as a single atomic update.
+func buildNSUpdateScript(dnsConfig config.DNSConfig, name string, record *nsupdateRecord) string {
+	var script strings.Builder
+	server := dnsConfig.Server
+	if host, port, err := net.SplitHostPort(server); err == nil {
+		server = host + " " + port
+	}
+	fmt.Fprintf(&script, "server %v\n", server)
+	fmt.Fprintf(&script, "zone %v\n", Canonical(dnsConfig.Zone))
+	for _, recordType := range managedTypes {
+		fmt.Fprintf(&script, "update delete %v %v\n", Canonical(name), recordType)
+	}
+	if record != nil {
+		fmt.Fprintf(&script, "update add %v %v %v %v\n", Canonical(name), dnsConfig.TTL, record.recordType, record.value)
+	}
+	script.WriteString("send\n")
+	return script.String()
+}
+
+func (updater *nsupdateUpdater) nsupdate(script string) error {
+	var args []string
+	if updater.config.TSIGKeyFile != "" {
+		args = append(args, "-k", updater.config.TSIGKeyFile)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "nsupdate", args...)
+	cmd.Stdin = strings.NewReader(script)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("nsupdate failed: %v: %v", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package dns
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gathering/tech-online-backend/config"
+)
+
+const defaultPowerDNSServerID = "localhost"
+
+// powerDNSUpdater changes records using the PowerDNS authoritative server API.
+type powerDNSUpdater struct {
+	config     config.DNSConfig
+	httpClient *http.Client
+}
+
+type powerDNSRRSet struct {
+	Name       string           `json:"name"`
+	Type       string           `json:"type"`
+	TTL        int              `json:"ttl,omitempty"`
+	ChangeType string           `json:"changetype"`
+	Records    []powerDNSRecord `json:"records"`
+}
+
+type powerDNSRecord struct {
+	Content  string `json:"content"`
+	Disabled bool   `json:"disabled"`
+}
+
+func newPowerDNSUpdater(dnsConfig config.DNSConfig) *powerDNSUpdater {
+	if dnsConfig.ServerID == "" {
+		dnsConfig.ServerID = defaultPowerDNSServerID
+	}
+	return &powerDNSUpdater{config: dnsConfig, httpClient: &http.Client{Timeout: commandTimeout}}
+}
+
+func (updater *powerDNSUpdater) SetRecord(name string, recordType string, value string) error {
+	var rrsets []powerDNSRRSet
+	for _, managedType := range managedTypes {
+		if managedType == recordType {
+			rrsets = append(rrsets, powerDNSRRSet{
+				Name:       Canonical(name),
+				Type:       recordType,
+				TTL:        updater.config.TTL,
+				ChangeType: "REPLACE",
+				Records:    []powerDNSRecord{{Content: value}},
+			})
+		} else {
+			rrsets = append(rrsets, powerDNSRRSet{Name: Canonical(name), Type: managedType, ChangeType: "DELETE", Records: []powerDNSRecord{}})
+		}
+	}
+	return updater.patch(rrsets)
+}
+
+func (updater *powerDNSUpdater) DeleteRecords(name string) error {
+	var rrsets []powerDNSRRSet
+	for _, managedType := range managedTypes {
+		rrsets = append(rrsets, powerDNSRRSet{Name: Canonical(name), Type: managedType, ChangeType: "DELETE", Records: []powerDNSRecord{}})
+	}
+	return updater.patch(rrsets)
+}
+
+func (updater *powerDNSUpdater) patch(rrsets []powerDNSRRSet) error {
+	body, err := json.Marshal(map[string]interface{}{"rrsets": rrsets})
+	if err != nil {
+		return err
+	}
+	path := fmt.Sprintf("/api/v1/servers/%v/zones/%v", url.PathEscape(updater.config.ServerID), url.PathEscape(Canonical(updater.config.Zone)))
+	request, err := http.NewRequest(http.MethodPatch, strings.TrimSuffix(updater.config.BaseURL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("X-API-Key", updater.config.APIKey)
+	request.Header.Set("Content-Type", "application/json")
+	response, err := updater.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("powerdns returned status %v: %v", response.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
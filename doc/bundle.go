@@ -0,0 +1,104 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package content
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gathering/tech-online-backend/db"
+)
+
+// LoadFamily gets a family and all its documents, e.g. for track bundles. The family is nil if it doesn't exist.
+func LoadFamily(familyID string) (*DocumentFamily, Documents, error) {
+	var family DocumentFamily
+	dbResult := db.Select(&family, "document_families", "id", "=", familyID)
+	if dbResult.IsFailed() {
+		return nil, nil, dbResult.Error
+	}
+	if !dbResult.IsSuccess() {
+		return nil, nil, nil
+	}
+
+	var documents Documents
+	documentsDBResult := db.SelectMany(&documents, "documents", "family", "=", familyID)
+	if documentsDBResult.IsFailed() {
+		return nil, nil, documentsDBResult.Error
+	}
+	sortDocuments(documents)
+	return &family, documents, nil
+}
+
+// ImportFamily creates or updates a family and its documents, e.g. from track bundles.
+// Documents not in the list are left alone. A revision is saved for every document which changed.
+// Returns the number of created or changed documents.
+func ImportFamily(family *DocumentFamily, documents Documents, author string) (int, error) {
+	if family.ID == "" {
+		return 0, fmt.Errorf("missing family ID")
+	}
+	if result := family.createOrUpdate(); !result.IsOk() {
+		return 0, result.Error
+	}
+
+	changed := 0
+	now := time.Now()
+	for _, document := range documents {
+		document.FamilyID = family.ID
+		document.LastChange = &now
+		if document.Status == "" {
+			document.Status = DefaultDocumentStatus
+		}
+		if result := document.validate(); !result.IsOk() {
+			return changed, fmt.Errorf("document %v: %v", document.Shortname, result.Message)
+		}
+
+		var existing Document
+		dbResult := db.Select(&existing, "documents", "family", "=", document.FamilyID, "shortname", "=", document.Shortname)
+		if dbResult.IsFailed() {
+			return changed, dbResult.Error
+		}
+		if dbResult.IsSuccess() && !document.differsFrom(&existing) {
+			continue
+		}
+
+		if result := document.createOrUpdate(); !result.IsOk() {
+			return changed, result.Error
+		}
+		if err := document.saveRevision(author, "Imported from track bundle"); err != nil {
+			return changed, err
+		}
+		changed++
+	}
+	return changed, nil
+}
+
+// differsFrom checks if the content of the document differs from another version of it.
+func (document *Document) differsFrom(other *Document) bool {
+	sameSequence := (document.Sequence == nil && other.Sequence == nil) ||
+		(document.Sequence != nil && other.Sequence != nil && *document.Sequence == *other.Sequence)
+	samePublishAt := (document.PublishAt == nil && other.PublishAt == nil) ||
+		(document.PublishAt != nil && other.PublishAt != nil && document.PublishAt.Equal(*other.PublishAt))
+	return document.Name != other.Name ||
+		document.Content != other.Content ||
+		document.ContentFormat != other.ContentFormat ||
+		document.Status != other.Status ||
+		!sameSequence || !samePublishAt
+}
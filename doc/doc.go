@@ -21,14 +21,37 @@ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
 package content
 
 import (
+	"database/sql"
 	"fmt"
+	"sort"
 	"time"
 
+	"github.com/gathering/tech-online-backend/attachment"
 	"github.com/gathering/tech-online-backend/config"
 	"github.com/gathering/tech-online-backend/db"
 	"github.com/gathering/tech-online-backend/rest"
+	"github.com/gathering/tech-online-backend/scheduler"
+	log "github.com/sirupsen/logrus"
 )
 
+const publishInterval = 1 * time.Minute
+
+// DocumentStatus is the publishing status of a document.
+type DocumentStatus string
+
+const (
+	// DocumentStatusDraft means the document is only visible to operators and admins.
+	// It gets published automatically at the publish time, if set.
+	DocumentStatusDraft DocumentStatus = "draft"
+	// DocumentStatusPublished means the document is visible to everyone.
+	DocumentStatusPublished DocumentStatus = "published"
+	// DocumentStatusArchived means the document is no longer relevant and is only visible to operators and admins.
+	DocumentStatusArchived DocumentStatus = "archived"
+)
+
+// DefaultDocumentStatus is the status for new documents without one.
+const DefaultDocumentStatus = DocumentStatusPublished
+
 // DocumentFamily is a category of documents.
 type DocumentFamily struct {
 	ID   string `column:"id" json:"id"` // Required, unique
@@ -38,15 +61,22 @@ type DocumentFamily struct {
 // DocumentFamilies is a list of families.
 type DocumentFamilies []*DocumentFamily
 
+// DocumentFamilyReorderRequest is a request to set the order of the documents in a family.
+type DocumentFamilyReorderRequest struct {
+	Shortnames []string `json:"shortnames"` // Documents in the wanted order, unlisted documents are placed after these
+}
+
 // Document is a document.
 type Document struct {
-	FamilyID      string     `column:"family" json:"family"`       // Required
-	Shortname     string     `column:"shortname" json:"shortname"` // Required, unique with family ID
-	Name          string     `column:"name" json:"name"`
-	Content       string     `column:"content" json:"content"`
-	ContentFormat string     `column:"content_format" json:"content_format"` // E.g. "plaintext" or "markdown"
-	Sequence      *int       `column:"sequence" json:"sequence"`             // For sorting
-	LastChange    *time.Time `column:"last_change" json:"last_change"`
+	FamilyID      string         `column:"family" json:"family" brief:"true"`       // Required
+	Shortname     string         `column:"shortname" json:"shortname" brief:"true"` // Required, unique with family ID
+	Name          string         `column:"name" json:"name" brief:"true"`
+	Content       string         `column:"content" json:"content"`
+	ContentFormat string         `column:"content_format" json:"content_format"`  // E.g. "plaintext" or "markdown"
+	Sequence      *int           `column:"sequence" json:"sequence" brief:"true"` // For sorting
+	LastChange    *time.Time     `column:"last_change" json:"last_change"`
+	Status        DocumentStatus `column:"status" json:"status" brief:"true"` // Defaults to published
+	PublishAt     *time.Time     `column:"publish_at" json:"publish_at"`      // Optional, when to automatically publish a draft
 }
 
 // Documents is a list of documents.
@@ -55,8 +85,15 @@ type Documents []*Document
 func init() {
 	rest.AddHandler("/document-families/", "^$", func() interface{} { return &DocumentFamilies{} })
 	rest.AddHandler("/document-family/", "^(?:(?P<id>[^/]+)/)?$", func() interface{} { return &DocumentFamily{} })
+	rest.AddHandler("/document-family/", "^(?P<id>[^/]+)/reorder/$", func() interface{} { return &DocumentFamilyReorderRequest{} })
 	rest.AddHandler("/documents/", "^$", func() interface{} { return &Documents{} })
 	rest.AddHandler("/document/", "^(?:(?P<family_id>[^/]+)/(?P<shortname>[^/]+)/)?$", func() interface{} { return &Document{} })
+	// Mostly static, but drafts are visible to crew
+	rest.SetCachePolicy(&DocumentFamilies{}, rest.CachePolicy{MaxAge: time.Minute, VaryByRole: true})
+	rest.SetCachePolicy(&DocumentFamily{}, rest.CachePolicy{MaxAge: time.Minute, VaryByRole: true})
+	rest.SetCachePolicy(&Documents{}, rest.CachePolicy{MaxAge: time.Minute, VaryByRole: true})
+	rest.SetCachePolicy(&Document{}, rest.CachePolicy{MaxAge: time.Minute, VaryByRole: true})
+	scheduler.AddJob("publish-documents", publishInterval, publishScheduledDocuments)
 }
 
 // Get gets multiple families.
@@ -218,7 +255,78 @@ func (family *DocumentFamily) exists() (bool, error) {
 	return count > 0, nil
 }
 
-// Get gets multiple documents.
+// Post sets the sequence of all documents in the family according to the provided order.
+func (reorderRequest *DocumentFamilyReorderRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+
+	// Get current documents
+	var documents Documents
+	dbResult := db.SelectMany(&documents, "documents", "family", "=", id)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	sortDocuments(documents)
+
+	// Validate and build new order
+	documentMap := make(map[string]*Document)
+	for _, document := range documents {
+		documentMap[document.Shortname] = document
+	}
+	var orderedDocuments Documents
+	for _, shortname := range reorderRequest.Shortnames {
+		document, ok := documentMap[shortname]
+		if !ok {
+			return rest.Result{Code: 400, Message: fmt.Sprintf("unknown or duplicate shortname: %v", shortname)}
+		}
+		orderedDocuments = append(orderedDocuments, document)
+		delete(documentMap, shortname)
+	}
+	for _, document := range documents {
+		if _, remaining := documentMap[document.Shortname]; remaining {
+			orderedDocuments = append(orderedDocuments, document)
+		}
+	}
+
+	// Update all in one go
+	tx, txErr := db.DB.Begin()
+	if txErr != nil {
+		return rest.Result{Code: 500, Error: txErr}
+	}
+	for i, document := range orderedDocuments {
+		if _, err := tx.Exec("UPDATE documents SET sequence = $1, last_change = NOW() WHERE family = $2 AND shortname = $3", i+1, id, document.Shortname); err != nil {
+			tx.Rollback()
+			return rest.Result{Code: 500, Error: err}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+
+	return rest.Result{Code: 303, Location: fmt.Sprintf("%v/documents/?family=%v", config.Config.SitePrefix, id)}
+}
+
+// QueryFilterFields gets the fields which may be filtered with query operators.
+func (documents *Documents) QueryFilterFields() rest.QueryFilterFields {
+	return rest.QueryFilterFields{
+		"family":      rest.QueryFilterString,
+		"shortname":   rest.QueryFilterString,
+		"name":        rest.QueryFilterString,
+		"sequence":    rest.QueryFilterInt,
+		"last_change": rest.QueryFilterTime,
+		"publish_at":  rest.QueryFilterTime,
+	}
+}
+
+// Get gets multiple documents, sorted by family and sequence.
 func (documents *Documents) Get(request *rest.Request) rest.Result {
 	// Check params, prep filtering
 	var whereArgs []interface{}
@@ -228,36 +336,59 @@ func (documents *Documents) Get(request *rest.Request) rest.Result {
 	if familyID, ok := request.QueryArgs["family"]; ok {
 		whereArgs = append(whereArgs, "family", "=", familyID)
 	}
+	if canSeeUnpublished(request.AccessToken) {
+		if status, ok := request.QueryArgs["status"]; ok {
+			whereArgs = append(whereArgs, "status", "=", status)
+		}
+	} else {
+		whereArgs = append(whereArgs, "status", "=", DocumentStatusPublished)
+	}
+	whereArgs = append(whereArgs, request.Filters...)
 
 	// Get
 	dbResult := db.SelectMany(documents, "documents", whereArgs...)
 	if dbResult.IsFailed() {
 		return rest.Result{Code: 500, Error: dbResult.Error}
 	}
+	sortDocuments(*documents)
 	return rest.Result{}
 }
 
+// Version gets the number of documents and the last change of any of them, for caching.
+func (documents *Documents) Version(request *rest.Request) (string, error) {
+	var count int
+	var lastChange time.Time
+	row := db.DB.QueryRow("SELECT COUNT(*),COALESCE(MAX(last_change),'epoch') FROM documents")
+	if err := row.Scan(&count, &lastChange); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%v/%v", count, lastChange.UnixNano()), nil
+}
+
 // Put creates or updates multiple documents.
+// All documents are validated before any are written, see rest.WriteItems for the per-item errors.
 func (documents *Documents) Put(request *rest.Request) rest.Result {
-	// Check params
+	// Check perms
 	if request.AccessToken.GetRole() != rest.RoleAdmin {
 		return rest.UnauthorizedResult(request.AccessToken)
 	}
 
-	// Feed individual tests to the individual post endpoint, stop on first error
-	totalResult := rest.Result{}
-	for _, document := range *documents {
-		request.PathArgs["family_id"] = document.FamilyID
-		request.PathArgs["shortname"] = document.Shortname
-		result := document.Put(request)
-		if !result.IsOk() {
-			return result
+	// Prepare and validate all, then create or update each
+	seen := make(map[string]int)
+	return rest.WriteItems(request, len(*documents), func(i int) rest.Result {
+		document := (*documents)[i]
+		key := document.FamilyID + "/" + document.Shortname
+		if previous, ok := seen[key]; ok {
+			return rest.Result{Code: 400, Message: fmt.Sprintf("duplicate of item %v", previous)}
 		}
-	}
-	return totalResult
+		seen[key] = i
+		return document.prepare(document.FamilyID, document.Shortname)
+	}, func(i int) rest.Result {
+		return (*documents)[i].write(request.AccessToken.GetName())
+	})
 }
 
-// Get gets a single document.
+// Get gets a single document, rendered as a template if the "render" query arg is set.
 func (document *Document) Get(request *rest.Request) rest.Result {
 	// Check params
 	familyID, familyIDExists := request.PathArgs["family_id"]
@@ -274,12 +405,35 @@ func (document *Document) Get(request *rest.Request) rest.Result {
 	if dbResult.IsFailed() {
 		return rest.Result{Code: 500, Error: dbResult.Error}
 	}
-	if !dbResult.IsSuccess() {
+	// Pretend unpublished documents don't exist for participants
+	if !dbResult.IsSuccess() || (document.Status != DocumentStatusPublished && !canSeeUnpublished(request.AccessToken)) {
 		return rest.Result{Code: 404, Message: "not found"}
 	}
+
+	// Render as template if asked for
+	if _, ok := request.QueryArgs["render"]; ok {
+		return document.render(request)
+	}
 	return rest.Result{}
 }
 
+// Version gets the last change of the document, for caching.
+// Rendered documents depend on more than the document, so they're not versioned.
+func (document *Document) Version(request *rest.Request) (string, error) {
+	if _, ok := request.QueryArgs["render"]; ok {
+		return "", nil
+	}
+	var lastChange time.Time
+	var status DocumentStatus
+	row := db.DB.QueryRow("SELECT last_change,status FROM documents WHERE family = $1 AND shortname = $2", request.PathArgs["family_id"], request.PathArgs["shortname"])
+	if err := row.Scan(&lastChange, &status); err == sql.ErrNoRows {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%v/%v", lastChange.UnixNano(), status), nil
+}
+
 // Post creates a new document.
 func (document *Document) Post(request *rest.Request) rest.Result {
 	// Check perms
@@ -290,19 +444,26 @@ func (document *Document) Post(request *rest.Request) rest.Result {
 	// Overwrite stuff
 	now := time.Now()
 	document.LastChange = &now
+	if document.Status == "" {
+		document.Status = DefaultDocumentStatus
+	}
 
 	// Validate
 	if result := document.validate(); !result.IsOk() {
 		return result
 	}
 
-	// Create and redirect
+	// Create, save revision and redirect
 	result := document.create()
 	if !result.IsOk() {
 		return result
 	}
+	if err := document.saveRevision(request.AccessToken.GetName(), ""); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
 	result.Code = 201
 	result.Location = fmt.Sprintf("%v/document/%v/%v/", config.Config.SitePrefix, document.FamilyID, document.Shortname)
+	result.Warnings = document.warnings()
 	return result
 }
 
@@ -323,20 +484,53 @@ func (document *Document) Put(request *rest.Request) rest.Result {
 		return rest.Result{Code: 400, Message: "missing shortname"}
 	}
 
-	// Overwrite stuff
+	// Prepare and validate
+	if result := document.prepare(familyID, shortname); !result.IsOk() {
+		return result
+	}
+
+	// Create or update and save revision
+	return document.write(request.AccessToken.GetName())
+}
+
+// prepare sets the change time and status and validates the document against the family ID and shortname from the URL.
+// Without a status, existing documents keep their current one (so plain updates don't publish drafts) and new documents get the default.
+func (document *Document) prepare(familyID string, shortname string) rest.Result {
 	now := time.Now()
 	document.LastChange = &now
-
-	// Validate
 	if document.FamilyID != familyID || document.Shortname != shortname {
 		return rest.Result{Code: 400, Message: "mismatch for family ID or shortname between URL and JSON"}
 	}
-	if result := document.validate(); !result.IsOk() {
+	if document.Status == "" {
+		row := db.DB.QueryRow("SELECT status FROM documents WHERE family = $1 AND shortname = $2", document.FamilyID, document.Shortname)
+		if err := row.Scan(&document.Status); err == sql.ErrNoRows {
+			document.Status = DefaultDocumentStatus
+		} else if err != nil {
+			return rest.Result{Code: 500, Error: err}
+		}
+	}
+	return document.validate()
+}
+
+// write creates or updates the prepared document and saves a revision.
+func (document *Document) write(author string) rest.Result {
+	result := document.createOrUpdate()
+	if !result.IsOk() {
 		return result
 	}
+	if err := document.saveRevision(author, ""); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	result.Warnings = document.warnings()
+	return result
+}
 
-	// Create or update
-	return document.createOrUpdate()
+// warnings gets notes for the client about the saved document.
+func (document *Document) warnings() []string {
+	if document.Sequence == nil {
+		return []string{"missing sequence, the document is sorted last in the family"}
+	}
+	return nil
 }
 
 // Delete deletes a document.
@@ -372,6 +566,9 @@ func (document *Document) Delete(request *rest.Request) rest.Result {
 	if dbResult.IsFailed() {
 		return rest.Result{Code: 500, Error: dbResult.Error}
 	}
+	if err := attachment.DeleteForOwner(attachment.OwnerTypeDocument, document.FamilyID+"/"+document.Shortname); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
 	return rest.Result{}
 }
 
@@ -430,7 +627,55 @@ func (document *Document) validate() rest.Result {
 		return rest.Result{Code: 400, Message: "missing shortname"}
 	case document.LastChange == nil:
 		return rest.Result{Code: 400, Message: "missing last update time"}
+	case !validateDocumentStatus(document.Status):
+		return rest.Result{Code: 400, Message: "invalid status"}
+	case document.PublishAt != nil && document.Status != DocumentStatusDraft:
+		return rest.Result{Code: 400, Message: "publish time is only allowed for drafts"}
 	}
 
 	return rest.Result{}
 }
+
+func validateDocumentStatus(status DocumentStatus) bool {
+	switch status {
+	case DocumentStatusDraft, DocumentStatusPublished, DocumentStatusArchived:
+		return true
+	default:
+		return false
+	}
+}
+
+// canSeeUnpublished checks if the token may see drafts and archived documents.
+func canSeeUnpublished(token rest.AccessTokenEntry) bool {
+	return token.GetRole() == rest.RoleOperator || token.GetRole() == rest.RoleAdmin
+}
+
+// publishScheduledDocuments publishes drafts which have reached their publish time.
+func publishScheduledDocuments() error {
+	result, err := db.DB.Exec("UPDATE documents SET status = $1, publish_at = NULL, last_change = NOW() WHERE status = $2 AND publish_at IS NOT NULL AND publish_at <= NOW()",
+		DocumentStatusPublished, DocumentStatusDraft)
+	if err != nil {
+		return err
+	}
+	if count, err := result.RowsAffected(); err == nil && count > 0 {
+		log.WithField("count", count).Info("Published scheduled documents")
+	}
+	return nil
+}
+
+// sortDocuments sorts documents by family, then sequence (missing last), then shortname.
+func sortDocuments(documents Documents) {
+	sort.SliceStable(documents, func(i, j int) bool {
+		a, b := documents[i], documents[j]
+		if a.FamilyID != b.FamilyID {
+			return a.FamilyID < b.FamilyID
+		}
+		if (a.Sequence == nil) != (b.Sequence == nil) {
+			return a.Sequence != nil
+		}
+		if a.Sequence != nil && *a.Sequence != *b.Sequence {
+			return *a.Sequence < *b.Sequence
+		}
+		return a.Shortname < b.Shortname
+	})
+}
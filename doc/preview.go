@@ -0,0 +1,102 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package content
+
+import (
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+)
+
+// DocumentPreview is document content rendered as participants will see it, for authors to proof drafts before publishing.
+// Template data which isn't specified by the query args (e.g. "station") is replaced by sample data.
+// The content format is kept, the client renders markdown the same way as for published documents.
+type DocumentPreview struct {
+	FamilyID      string   `json:"family"`
+	Shortname     string   `json:"shortname"`
+	Content       string   `json:"content"` // The draft, rendered in the response
+	ContentFormat string   `json:"content_format"`
+	SampleData    []string `json:"sample_data"` // Template data names which got sample data, generated
+}
+
+func init() {
+	rest.AddHandler("/document-preview/", "^(?:(?P<family_id>[^/]+)/(?P<shortname>[^/]+)/)?$", func() interface{} { return &DocumentPreview{} })
+}
+
+// Get previews a saved document, regardless of status.
+func (preview *DocumentPreview) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if !canSeeUnpublished(request.AccessToken) {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	familyID, familyIDExists := request.PathArgs["family_id"]
+	if !familyIDExists || familyID == "" {
+		return rest.Result{Code: 400, Message: "missing family ID"}
+	}
+	shortname, shortnameExists := request.PathArgs["shortname"]
+	if !shortnameExists || shortname == "" {
+		return rest.Result{Code: 400, Message: "missing shortname"}
+	}
+
+	// Get
+	var document Document
+	dbResult := db.Select(&document, "documents", "family", "=", familyID, "shortname", "=", shortname)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+	preview.FamilyID = document.FamilyID
+	preview.Shortname = document.Shortname
+	preview.Content = document.Content
+	preview.ContentFormat = document.ContentFormat
+	return preview.render(request)
+}
+
+// Post previews unsaved content.
+func (preview *DocumentPreview) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if !canSeeUnpublished(request.AccessToken) {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	return preview.render(request)
+}
+
+func (preview *DocumentPreview) render(request *rest.Request) rest.Result {
+	data, sampleNames, result := loadTemplateData(request, true)
+	if !result.IsOk() {
+		return result
+	}
+	rendered, err := renderTemplate(preview.Shortname, preview.Content, data)
+	if err != nil {
+		// The author's mistake, unlike for saved documents
+		return rest.Result{Code: 400, Message: err.Error()}
+	}
+	preview.Content = rendered
+	preview.SampleData = sampleNames
+	if preview.SampleData == nil {
+		preview.SampleData = make([]string, 0)
+	}
+	return rest.Result{}
+}
@@ -0,0 +1,119 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package content
+
+import (
+	"fmt"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/qrcode"
+	"github.com/gathering/tech-online-backend/rest"
+)
+
+// DocumentQRCode is a QR code of the configured deep link to a document, for printed table cards.
+type DocumentQRCode struct {
+	raw *rest.RawResponse
+}
+
+// DocumentQRCodeData is the template data of the document URL.
+type DocumentQRCodeData struct {
+	Family    string
+	Shortname string
+}
+
+func init() {
+	rest.AddHandler("/document/", "^(?P<family_id>[^/]+)/(?P<shortname>[^/]+)/qr/$", func() interface{} { return &DocumentQRCode{} })
+}
+
+// Get renders the code as PNG or SVG, see qrcode.ParseOptions for the query args.
+// Like the document itself, codes of unpublished documents are only for operators and admins.
+// The "download" query arg makes clients save it as a file.
+func (code *DocumentQRCode) Get(request *rest.Request) rest.Result {
+	// Check params
+	if config.Config.QRCodes.DocumentURL == "" {
+		return rest.Result{Code: 404, Message: "document QR codes not configured"}
+	}
+	options, err := qrcode.ParseOptions(request.QueryArgs)
+	if err != nil {
+		return rest.Result{Code: 400, Message: err.Error()}
+	}
+
+	// Get
+	text, result := documentQRCodeText(request)
+	if !result.IsOk() {
+		return result
+	}
+	data, contentType, err := options.Render(text)
+	if err != nil {
+		return rest.Result{Code: 400, Message: err.Error()}
+	}
+	code.raw = &rest.RawResponse{
+		ContentType: contentType,
+		Data:        data,
+	}
+	if _, ok := request.QueryArgs["download"]; ok {
+		code.raw.Filename = fmt.Sprintf("%v-%v.%v", request.PathArgs["family_id"], request.PathArgs["shortname"], options.Format)
+	}
+	return rest.Result{}
+}
+
+// Version gets a version of the code, which changes with the URL and options, for caching.
+func (code *DocumentQRCode) Version(request *rest.Request) (string, error) {
+	options, err := qrcode.ParseOptions(request.QueryArgs)
+	if err != nil || config.Config.QRCodes.DocumentURL == "" {
+		return "", nil
+	}
+	text, result := documentQRCodeText(request)
+	if result.Error != nil {
+		return "", result.Error
+	}
+	if !result.IsOk() {
+		return "", nil
+	}
+	return options.Version(text), nil
+}
+
+// RawResponse returns the code.
+func (code *DocumentQRCode) RawResponse() *rest.RawResponse {
+	return code.raw
+}
+
+// documentQRCodeText checks that the document is visible to the requester and renders its URL.
+func documentQRCodeText(request *rest.Request) (string, rest.Result) {
+	var document Document
+	dbResult := db.Select(&document, "documents", "family", "=", request.PathArgs["family_id"], "shortname", "=", request.PathArgs["shortname"])
+	if dbResult.IsFailed() {
+		return "", rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	// Pretend unpublished documents don't exist for participants
+	if !dbResult.IsSuccess() || (document.Status != DocumentStatusPublished && !canSeeUnpublished(request.AccessToken)) {
+		return "", rest.Result{Code: 404, Message: "not found"}
+	}
+	text, err := qrcode.FormatURL(config.Config.QRCodes.DocumentURL, DocumentQRCodeData{
+		Family:    document.FamilyID,
+		Shortname: document.Shortname,
+	})
+	if err != nil {
+		return "", rest.Result{Code: 500, Error: err}
+	}
+	return text, rest.Result{}
+}
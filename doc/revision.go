@@ -0,0 +1,301 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package content
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/helper"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+)
+
+// DocumentRevision is a snapshot of a document, created every time the document is changed.
+type DocumentRevision struct {
+	ID            *uuid.UUID `column:"id" json:"id"`                         // Generated, required, unique
+	FamilyID      string     `column:"family" json:"family"`                 // Required
+	Shortname     string     `column:"shortname" json:"shortname"`           // Required
+	Revision      int        `column:"revision" json:"revision"`             // Generated, incrementing per document, starting at 1
+	Author        string     `column:"author" json:"author"`                 // Name of the user or token which made the change
+	Timestamp     *time.Time `column:"timestamp" json:"timestamp"`           // Generated, required
+	Comment       string     `column:"comment" json:"comment"`               // Optional, e.g. for rollbacks
+	Sequence      *int       `column:"sequence" json:"sequence"`             // Same as for the document
+	Name          string     `column:"name" json:"name"`                     // Same as for the document
+	Content       string     `column:"content" json:"content"`               // Same as for the document
+	ContentFormat string     `column:"content_format" json:"content_format"` // Same as for the document
+}
+
+// DocumentRevisions is a list of document revisions.
+type DocumentRevisions []*DocumentRevision
+
+// DocumentRevisionDiff is a unified diff between two revisions of a document.
+type DocumentRevisionDiff struct {
+	FamilyID      string `json:"family"`
+	Shortname     string `json:"shortname"`
+	FromRevision  int    `json:"from_revision"`
+	ToRevision    int    `json:"to_revision"`
+	NameChanged   bool   `json:"name_changed"`
+	FormatChanged bool   `json:"format_changed"`
+	Diff          string `json:"diff"` // Unified diff of the content, empty if unchanged
+}
+
+// DocumentRollbackRequest is a request to restore a document to an earlier revision.
+type DocumentRollbackRequest struct{}
+
+func init() {
+	rest.AddHandler("/document/", "^(?P<family_id>[^/]+)/(?P<shortname>[^/]+)/revisions/$", func() interface{} { return &DocumentRevisions{} })
+	rest.AddHandler("/document/", "^(?P<family_id>[^/]+)/(?P<shortname>[^/]+)/diff/$", func() interface{} { return &DocumentRevisionDiff{} })
+	rest.AddHandler("/document/", "^(?P<family_id>[^/]+)/(?P<shortname>[^/]+)/revision/(?P<revision>[^/]+)/$", func() interface{} { return &DocumentRevision{} })
+	rest.AddHandler("/document/", "^(?P<family_id>[^/]+)/(?P<shortname>[^/]+)/revision/(?P<revision>[^/]+)/rollback/$", func() interface{} { return &DocumentRollbackRequest{} })
+}
+
+// Get gets all revisions for a document, oldest first.
+func (revisions *DocumentRevisions) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	familyID, familyIDExists := request.PathArgs["family_id"]
+	if !familyIDExists || familyID == "" {
+		return rest.Result{Code: 400, Message: "missing family ID"}
+	}
+	shortname, shortnameExists := request.PathArgs["shortname"]
+	if !shortnameExists || shortname == "" {
+		return rest.Result{Code: 400, Message: "missing shortname"}
+	}
+
+	// Get
+	dbResult := db.SelectMany(revisions, "document_revisions", "family", "=", familyID, "shortname", "=", shortname)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	sortDocumentRevisions(*revisions)
+	return rest.Result{}
+}
+
+// Get gets a single revision of a document.
+func (revision *DocumentRevision) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	familyID, familyIDExists := request.PathArgs["family_id"]
+	if !familyIDExists || familyID == "" {
+		return rest.Result{Code: 400, Message: "missing family ID"}
+	}
+	shortname, shortnameExists := request.PathArgs["shortname"]
+	if !shortnameExists || shortname == "" {
+		return rest.Result{Code: 400, Message: "missing shortname"}
+	}
+	revisionNumber, revisionNumberErr := strconv.Atoi(request.PathArgs["revision"])
+	if revisionNumberErr != nil {
+		return rest.Result{Code: 400, Message: "invalid revision"}
+	}
+
+	// Get
+	return revision.load(familyID, shortname, revisionNumber)
+}
+
+// Get gets the diff between two revisions of a document.
+// Query args "from" and "to" select the revisions. "to" defaults to the latest revision and "from" to the one before "to".
+func (diff *DocumentRevisionDiff) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	familyID, familyIDExists := request.PathArgs["family_id"]
+	if !familyIDExists || familyID == "" {
+		return rest.Result{Code: 400, Message: "missing family ID"}
+	}
+	shortname, shortnameExists := request.PathArgs["shortname"]
+	if !shortnameExists || shortname == "" {
+		return rest.Result{Code: 400, Message: "missing shortname"}
+	}
+	toNumber := 0
+	if rawTo, ok := request.QueryArgs["to"]; ok {
+		var err error
+		if toNumber, err = strconv.Atoi(rawTo); err != nil {
+			return rest.Result{Code: 400, Message: "invalid to revision"}
+		}
+	} else {
+		row := db.DB.QueryRow("SELECT COALESCE(MAX(revision), 0) FROM document_revisions WHERE family = $1 AND shortname = $2", familyID, shortname)
+		if err := row.Scan(&toNumber); err != nil {
+			return rest.Result{Code: 500, Error: err}
+		}
+	}
+	fromNumber := toNumber - 1
+	if rawFrom, ok := request.QueryArgs["from"]; ok {
+		var err error
+		if fromNumber, err = strconv.Atoi(rawFrom); err != nil {
+			return rest.Result{Code: 400, Message: "invalid from revision"}
+		}
+	}
+
+	// Get revisions
+	var toRevision DocumentRevision
+	if result := toRevision.load(familyID, shortname, toNumber); !result.IsOk() {
+		return result
+	}
+	// Revision 0 is the empty document before the first revision
+	fromRevision := DocumentRevision{FamilyID: familyID, Shortname: shortname}
+	if fromNumber != 0 {
+		if result := fromRevision.load(familyID, shortname, fromNumber); !result.IsOk() {
+			return result
+		}
+	}
+
+	// Diff
+	diff.FamilyID = familyID
+	diff.Shortname = shortname
+	diff.FromRevision = fromNumber
+	diff.ToRevision = toNumber
+	diff.NameChanged = fromRevision.Name != toRevision.Name
+	diff.FormatChanged = fromRevision.ContentFormat != toRevision.ContentFormat
+	diff.Diff = helper.UnifiedDiff(
+		fmt.Sprintf("%v/%v (revision %v)", familyID, shortname, fromNumber),
+		fmt.Sprintf("%v/%v (revision %v)", familyID, shortname, toNumber),
+		fromRevision.Content, toRevision.Content, 3)
+	return rest.Result{}
+}
+
+// Post restores the document to the specified revision.
+// The rollback itself is stored as a new revision, so it can be rolled back too.
+// Documents which have been deleted may also be restored this way.
+func (rollbackRequest *DocumentRollbackRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	familyID, familyIDExists := request.PathArgs["family_id"]
+	if !familyIDExists || familyID == "" {
+		return rest.Result{Code: 400, Message: "missing family ID"}
+	}
+	shortname, shortnameExists := request.PathArgs["shortname"]
+	if !shortnameExists || shortname == "" {
+		return rest.Result{Code: 400, Message: "missing shortname"}
+	}
+	revisionNumber, revisionNumberErr := strconv.Atoi(request.PathArgs["revision"])
+	if revisionNumberErr != nil {
+		return rest.Result{Code: 400, Message: "invalid revision"}
+	}
+
+	// Get revision
+	var revision DocumentRevision
+	if result := revision.load(familyID, shortname, revisionNumber); !result.IsOk() {
+		return result
+	}
+
+	// Restore document from revision, but keep the current publishing status if it still exists
+	var document Document
+	dbResult := db.Select(&document, "documents", "family", "=", familyID, "shortname", "=", shortname)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		document.Status = DefaultDocumentStatus
+	}
+	now := time.Now()
+	document.FamilyID = revision.FamilyID
+	document.Shortname = revision.Shortname
+	document.Name = revision.Name
+	document.Content = revision.Content
+	document.ContentFormat = revision.ContentFormat
+	document.Sequence = revision.Sequence
+	document.LastChange = &now
+	if result := document.validate(); !result.IsOk() {
+		return result
+	}
+	if result := document.createOrUpdate(); !result.IsOk() {
+		return result
+	}
+	if err := document.saveRevision(request.AccessToken.GetName(), fmt.Sprintf("Rollback to revision %v", revision.Revision)); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+
+	return rest.Result{Code: 303, Location: fmt.Sprintf("%v/document/%v/%v/", config.Config.SitePrefix, document.FamilyID, document.Shortname)}
+}
+
+func (revision *DocumentRevision) load(familyID string, shortname string, revisionNumber int) rest.Result {
+	dbResult := db.Select(revision, "document_revisions",
+		"family", "=", familyID,
+		"shortname", "=", shortname,
+		"revision", "=", revisionNumber,
+	)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "revision not found"}
+	}
+	return rest.Result{}
+}
+
+// saveRevision stores the current state of the document as a new revision.
+// Should be called after every successful change to the document.
+func (document *Document) saveRevision(author string, comment string) error {
+	var lastRevision int
+	row := db.DB.QueryRow("SELECT COALESCE(MAX(revision), 0) FROM document_revisions WHERE family = $1 AND shortname = $2", document.FamilyID, document.Shortname)
+	if err := row.Scan(&lastRevision); err != nil {
+		return err
+	}
+
+	// Warning: Potential race condition for the revision number, but the unique constraint will catch it.
+	id := uuid.New()
+	now := time.Now()
+	revision := DocumentRevision{
+		ID:            &id,
+		FamilyID:      document.FamilyID,
+		Shortname:     document.Shortname,
+		Revision:      lastRevision + 1,
+		Author:        author,
+		Timestamp:     &now,
+		Comment:       comment,
+		Sequence:      document.Sequence,
+		Name:          document.Name,
+		Content:       document.Content,
+		ContentFormat: document.ContentFormat,
+	}
+	dbResult := db.Insert("document_revisions", revision)
+	if dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	return nil
+}
+
+// sortDocumentRevisions sorts revisions by revision number, oldest first.
+func sortDocumentRevisions(revisions DocumentRevisions) {
+	sort.Slice(revisions, func(i, j int) bool {
+		return revisions[i].Revision < revisions[j].Revision
+	})
+}
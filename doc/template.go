@@ -0,0 +1,124 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package content
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"text/template"
+
+	"github.com/gathering/tech-online-backend/rest"
+)
+
+// TemplateDataProvider provides data for rendering documents, e.g. about a station from the query args.
+// It returns nil data if the request doesn't ask for it.
+type TemplateDataProvider func(request *rest.Request) (interface{}, rest.Result)
+
+type templateDataEntry struct {
+	provider TemplateDataProvider
+	sample   TemplateDataProvider
+}
+
+var templateData = make(map[string]*templateDataEntry)
+var templateDataLock sync.RWMutex
+
+// RegisterTemplateData registers a provider for the data available as the name (e.g. ".Station") when rendering documents.
+func RegisterTemplateData(name string, provider TemplateDataProvider) {
+	templateDataLock.Lock()
+	defer templateDataLock.Unlock()
+	getTemplateDataEntry(name).provider = provider
+}
+
+// RegisterTemplateSample registers a provider for realistic sample data for the name, used when previewing documents
+// if the normal provider provides nothing.
+func RegisterTemplateSample(name string, sample TemplateDataProvider) {
+	templateDataLock.Lock()
+	defer templateDataLock.Unlock()
+	getTemplateDataEntry(name).sample = sample
+}
+
+func getTemplateDataEntry(name string) *templateDataEntry {
+	entry, ok := templateData[name]
+	if !ok {
+		entry = &templateDataEntry{}
+		templateData[name] = entry
+	}
+	return entry
+}
+
+// loadTemplateData gets the data from the registered providers, falling back to sample data if asked for.
+// The names which got sample data are returned too.
+func loadTemplateData(request *rest.Request, withSamples bool) (map[string]interface{}, []string, rest.Result) {
+	templateDataLock.RLock()
+	defer templateDataLock.RUnlock()
+	data := make(map[string]interface{}, len(templateData))
+	var sampleNames []string
+	for name, entry := range templateData {
+		var value interface{}
+		if entry.provider != nil {
+			var result rest.Result
+			value, result = entry.provider(request)
+			if !result.IsOk() {
+				return nil, nil, result
+			}
+		}
+		if value == nil && withSamples && entry.sample != nil {
+			var result rest.Result
+			value, result = entry.sample(request)
+			if !result.IsOk() {
+				return nil, nil, result
+			}
+			sampleNames = append(sampleNames, name)
+		}
+		data[name] = value
+	}
+	sort.Strings(sampleNames)
+	return data, sampleNames, rest.Result{}
+}
+
+// renderTemplate renders the content as a Go text template with the data.
+func renderTemplate(name string, content string, data map[string]interface{}) (string, error) {
+	parsed, err := template.New(name).Option("missingkey=zero").Parse(content)
+	if err != nil {
+		return "", fmt.Errorf("invalid document template: %w", err)
+	}
+	var rendered bytes.Buffer
+	if err := parsed.Execute(&rendered, data); err != nil {
+		return "", fmt.Errorf("failed to render document: %w", err)
+	}
+	return rendered.String(), nil
+}
+
+// render renders the content as a Go text template with the data from the registered providers.
+func (document *Document) render(request *rest.Request) rest.Result {
+	data, _, result := loadTemplateData(request, false)
+	if !result.IsOk() {
+		return result
+	}
+	rendered, err := renderTemplate(document.Shortname, document.Content, data)
+	if err != nil {
+		return rest.Result{Code: 500, Message: err.Error()}
+	}
+	document.Content = rendered
+	return rest.Result{}
+}
@@ -0,0 +1,199 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+// Package errorreport reports internal errors and panics to Sentry and/or a generic webhook, with the context they happened in.
+package errorreport
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	sendTimeout  = 10 * time.Second
+	maxQueued    = 100 // Reports beyond this are dropped until the queue is emptied
+	maxFrames    = 50
+	modulePrefix = "github.com/gathering/tech-online-backend/"
+)
+
+// Report is an internal error or panic, as sent to the webhook.
+type Report struct {
+	ID          string            `json:"id"`
+	Time        time.Time         `json:"time"`
+	Panic       bool              `json:"panic"`
+	Message     string            `json:"message"`
+	Release     string            `json:"release"`
+	Environment string            `json:"environment,omitempty"`
+	Context     map[string]string `json:"context,omitempty"` // Where it happened, e.g. "request_id", "method", "path" and "role" for requests or "job" for scheduled jobs
+	SQL         string            `json:"sql,omitempty"`     // The failed query, if from the DB
+	Stack       []Frame           `json:"stack,omitempty"`   // For panics, innermost frame last
+}
+
+// Frame is a stack frame of a panic.
+type Frame struct {
+	Function string `json:"function"`
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	InApp    bool   `json:"in_app"` // If it's in this program and not a library or the runtime
+}
+
+var queue chan Report
+var queueStart sync.Once
+
+// Enabled checks if any reporting is configured.
+func Enabled() bool {
+	reportingConfig := config.Config.ErrorReporting
+	return reportingConfig.SentryDSN != "" || reportingConfig.WebhookURL != ""
+}
+
+// CaptureError reports an internal error in the background, if reporting is enabled.
+func CaptureError(err error, context map[string]string, sql string) {
+	if err == nil || !Enabled() {
+		return
+	}
+	report := newReport(err.Error(), context)
+	report.SQL = sql
+	enqueue(report)
+}
+
+// CapturePanic reports a recovered panic in the background, if reporting is enabled.
+// Must be called from the deferred function which recovered, so the stack is the one which panicked.
+func CapturePanic(value interface{}, context map[string]string) {
+	if !Enabled() {
+		return
+	}
+	report := newReport(fmt.Sprintf("panic: %v", value), context)
+	report.Panic = true
+	report.Stack = panicStack()
+	enqueue(report)
+}
+
+// newReport creates a report for now with a random ID and the release and environment.
+func newReport(message string, context map[string]string) Report {
+	idBytes := make([]byte, 16)
+	rand.Read(idBytes)
+	return Report{
+		ID:          hex.EncodeToString(idBytes),
+		Time:        time.Now(),
+		Message:     message,
+		Release:     config.Version,
+		Environment: config.Config.ErrorReporting.Environment,
+		Context:     context,
+	}
+}
+
+// panicStack gets the stack of the current goroutine, without the recovery and panic functions.
+func panicStack() []Frame {
+	pcs := make([]uintptr, maxFrames)
+	count := runtime.Callers(1, pcs)
+	callersFrames := runtime.CallersFrames(pcs[:count])
+	var frames []Frame
+	for {
+		callerFrame, more := callersFrames.Next()
+		frames = append(frames, Frame{
+			Function: callerFrame.Function,
+			File:     callerFrame.File,
+			Line:     callerFrame.Line,
+			InApp:    strings.HasPrefix(callerFrame.Function, modulePrefix),
+		})
+		if !more {
+			break
+		}
+	}
+	// Drop everything up to and including the panic, which leaves the function which panicked first
+	for i, frame := range frames {
+		if frame.Function == "runtime.gopanic" {
+			frames = frames[i+1:]
+			break
+		}
+	}
+	// Innermost last
+	for i, j := 0, len(frames)-1; i < j; i, j = i+1, j-1 {
+		frames[i], frames[j] = frames[j], frames[i]
+	}
+	return frames
+}
+
+// enqueue adds the report to the queue and starts the sender if not already running.
+func enqueue(report Report) {
+	queueStart.Do(func() {
+		queue = make(chan Report, maxQueued)
+		go runSender()
+	})
+	select {
+	case queue <- report:
+	default:
+		log.WithField("report", report.ID).Warn("Error report queue is full, dropping report")
+	}
+}
+
+// runSender sends the queued reports to the configured destinations.
+func runSender() {
+	client := http.Client{Timeout: sendTimeout}
+	for report := range queue {
+		reportingConfig := config.Config.ErrorReporting
+		if reportingConfig.SentryDSN != "" {
+			if err := sendToSentry(&client, reportingConfig.SentryDSN, report); err != nil {
+				log.WithError(err).WithField("report", report.ID).Warn("Failed to send error report to Sentry")
+			}
+		}
+		if reportingConfig.WebhookURL != "" {
+			if err := postJSON(&client, reportingConfig.WebhookURL, nil, report); err != nil {
+				log.WithError(err).WithField("report", report.ID).Warn("Failed to send error report to webhook")
+			}
+		}
+	}
+}
+
+// postJSON POSTs the value as JSON, with extra headers.
+func postJSON(client *http.Client, url string, headers map[string]string, value interface{}) error {
+	body, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		request.Header.Set(key, value)
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("got status %v", response.Status)
+	}
+	return nil
+}
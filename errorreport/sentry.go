@@ -0,0 +1,151 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package errorreport
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// sentryDSN is a parsed Sentry DSN.
+type sentryDSN struct {
+	storeURL  string
+	publicKey string
+	secretKey string
+}
+
+// sentryEvent is an event for the Sentry store API.
+type sentryEvent struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   string            `json:"timestamp"`
+	Level       string            `json:"level"`
+	Platform    string            `json:"platform"`
+	Logger      string            `json:"logger"`
+	Release     string            `json:"release,omitempty"`
+	Environment string            `json:"environment,omitempty"`
+	ServerName  string            `json:"server_name,omitempty"`
+	Message     string            `json:"message"`
+	Exception   *sentryExceptions `json:"exception,omitempty"`
+	Request     *sentryRequest    `json:"request,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Extra       map[string]string `json:"extra,omitempty"`
+}
+
+type sentryExceptions struct {
+	Values []sentryException `json:"values"`
+}
+
+type sentryException struct {
+	Type       string            `json:"type"`
+	Value      string            `json:"value"`
+	Stacktrace *sentryStacktrace `json:"stacktrace,omitempty"`
+}
+
+type sentryStacktrace struct {
+	Frames []sentryFrame `json:"frames"`
+}
+
+type sentryFrame struct {
+	Function string `json:"function"`
+	AbsPath  string `json:"abs_path"`
+	Lineno   int    `json:"lineno"`
+	InApp    bool   `json:"in_app"`
+}
+
+type sentryRequest struct {
+	URL    string `json:"url"`
+	Method string `json:"method"`
+}
+
+// parseSentryDSN parses a DSN like "https://<public-key>[:<secret-key>]@<host>[/<path>]/<project-id>".
+func parseSentryDSN(dsn string) (sentryDSN, error) {
+	parsedURL, err := url.Parse(dsn)
+	if err != nil {
+		return sentryDSN{}, fmt.Errorf("invalid DSN: %v", err)
+	}
+	if parsedURL.User == nil || parsedURL.User.Username() == "" {
+		return sentryDSN{}, fmt.Errorf("invalid DSN: missing public key")
+	}
+	path := strings.TrimSuffix(parsedURL.Path, "/")
+	slashIndex := strings.LastIndex(path, "/")
+	projectID := path[slashIndex+1:]
+	if projectID == "" {
+		return sentryDSN{}, fmt.Errorf("invalid DSN: missing project ID")
+	}
+	secretKey, _ := parsedURL.User.Password()
+	return sentryDSN{
+		storeURL:  fmt.Sprintf("%v://%v%v/api/%v/store/", parsedURL.Scheme, parsedURL.Host, path[:slashIndex], projectID),
+		publicKey: parsedURL.User.Username(),
+		secretKey: secretKey,
+	}, nil
+}
+
+// buildSentryEvent converts a report to a Sentry event, with the context as tags.
+func buildSentryEvent(report Report) sentryEvent {
+	ev := sentryEvent{
+		EventID:     report.ID,
+		Timestamp:   report.Time.UTC().Format("2006-01-02T15:04:05.000000Z"),
+		Level:       "error",
+		Platform:    "go",
+		Logger:      "techo-backend",
+		Release:     report.Release,
+		Environment: report.Environment,
+		Message:     report.Message,
+		Tags:        report.Context,
+	}
+	ev.ServerName, _ = os.Hostname()
+	if report.Context["path"] != "" {
+		ev.Request = &sentryRequest{URL: report.Context["path"], Method: report.Context["method"]}
+	}
+	if report.SQL != "" {
+		ev.Extra = map[string]string{"sql": report.SQL}
+	}
+	if report.Panic {
+		ev.Level = "fatal"
+		exception := sentryException{Type: "panic", Value: report.Message, Stacktrace: &sentryStacktrace{}}
+		for _, frame := range report.Stack {
+			exception.Stacktrace.Frames = append(exception.Stacktrace.Frames, sentryFrame{
+				Function: frame.Function,
+				AbsPath:  frame.File,
+				Lineno:   frame.Line,
+				InApp:    frame.InApp,
+			})
+		}
+		ev.Exception = &sentryExceptions{Values: []sentryException{exception}}
+	}
+	return ev
+}
+
+// sendToSentry sends a report to the Sentry project of the DSN.
+func sendToSentry(client *http.Client, dsn string, report Report) error {
+	parsedDSN, err := parseSentryDSN(dsn)
+	if err != nil {
+		return err
+	}
+	auth := fmt.Sprintf("Sentry sentry_version=7, sentry_client=techo-backend/%v, sentry_key=%v", report.Release, parsedDSN.publicKey)
+	if parsedDSN.secretKey != "" {
+		auth += ", sentry_secret=" + parsedDSN.secretKey
+	}
+	return postJSON(client, parsedDSN.storeURL, map[string]string{"X-Sentry-Auth": auth}, buildSentryEvent(report))
+}
@@ -0,0 +1,137 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+// Package event is a simple in-process publish/subscribe bus for things happening in the backend,
+// which e.g. notifications are built on top of.
+package event
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/errorreport"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// Type is the type of event, named like "<object>.<what-happened>".
+type Type string
+
+// Event is something which happened, which subscribers may react to.
+type Event struct {
+	ID      uuid.UUID   `json:"id"`
+	Type    Type        `json:"type"`
+	Time    time.Time   `json:"time"`
+	TrackID string      `json:"track,omitempty"` // Related track, if any
+	UserIDs []uuid.UUID `json:"users,omitempty"` // Affected users which should be notified, if any
+	Title   string      `json:"title"`           // Short human readable summary
+	Message string      `json:"message"`         // Human readable details
+	Data    interface{} `json:"data,omitempty"`  // Related object, if any
+}
+
+// Handler handles published events.
+type Handler func(event Event)
+
+type subscriber struct {
+	name    string
+	handler Handler
+}
+
+var subscribers []subscriber
+var subscribersLock sync.RWMutex
+
+// Listeners are temporary subscribers receiving events through channels, e.g. for streaming to clients.
+var listeners = make(map[chan Event]struct{})
+var listenersLock sync.RWMutex
+
+// Subscribe registers a handler which gets called for every published event.
+// Handlers are called in the background, so they should not expect any particular ordering.
+func Subscribe(name string, handler Handler) {
+	subscribersLock.Lock()
+	defer subscribersLock.Unlock()
+	subscribers = append(subscribers, subscriber{name: name, handler: handler})
+}
+
+// Publish sends the event to all subscribers, without waiting for them.
+// The ID and time are set if missing.
+func Publish(event Event) {
+	if event.ID == uuid.Nil {
+		event.ID = uuid.New()
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	log.WithFields(log.Fields{
+		"id":    event.ID,
+		"type":  event.Type,
+		"track": event.TrackID,
+	}).Trace("Publishing event")
+
+	subscribersLock.RLock()
+	for _, sub := range subscribers {
+		go sub.handle(event)
+	}
+	subscribersLock.RUnlock()
+
+	// Never block on slow listeners, they just miss events
+	listenersLock.RLock()
+	for listener := range listeners {
+		select {
+		case listener <- event:
+		default:
+		}
+	}
+	listenersLock.RUnlock()
+}
+
+// Listen returns a channel which receives all events published from now on, until the returned stop function is called.
+// Events are dropped if the buffer is full.
+func Listen(bufferSize int) (<-chan Event, func()) {
+	listener := make(chan Event, bufferSize)
+	listenersLock.Lock()
+	listeners[listener] = struct{}{}
+	listenersLock.Unlock()
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			listenersLock.Lock()
+			delete(listeners, listener)
+			listenersLock.Unlock()
+			close(listener)
+		})
+	}
+	return listener, stop
+}
+
+func (sub subscriber) handle(event Event) {
+	// Don't let a panicking subscriber kill the program
+	defer func() {
+		if r := recover(); r != nil {
+			log.WithFields(log.Fields{
+				"subscriber": sub.name,
+				"event":      event.ID,
+				"panic":      r,
+			}).Error("Event subscriber panicked")
+			errorreport.CapturePanic(r, map[string]string{"subscriber": sub.name, "event": event.ID.String()})
+		}
+	}()
+	sub.handler(event)
+}
@@ -0,0 +1,111 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+// Package gondul is a client for the Gondul network management API, used to find the switches and ports of net-track stations.
+package gondul
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTimeout  = 10 * time.Second
+	maxResponseSize = 16 << 20
+)
+
+// Switch is the network data Gondul has about a switch.
+type Switch struct {
+	Name           string `json:"name"`
+	ManagementIPv4 string `json:"mgmt_v4_addr"`
+	ManagementIPv6 string `json:"mgmt_v6_addr"`
+	Distro         string `json:"distro_name"`     // Upstream distribution switch
+	DistroPort     string `json:"distro_phy_port"` // Port on the distribution switch
+}
+
+// Client talks to a Gondul API.
+type Client struct {
+	BaseURL    string
+	Username   string
+	Password   string
+	HTTPClient *http.Client // Optional
+}
+
+// Switches gets the management data for all switches, by name.
+func (client *Client) Switches() (map[string]*Switch, error) {
+	var response struct {
+		Switches map[string]*Switch `json:"switches"`
+	}
+	if err := client.get("/api/read/switches-management", &response); err != nil {
+		return nil, err
+	}
+	switches := make(map[string]*Switch, len(response.Switches))
+	for name, gondulSwitch := range response.Switches {
+		if gondulSwitch == nil {
+			continue
+		}
+		gondulSwitch.Name = name
+		gondulSwitch.ManagementIPv4 = stripPrefixLength(gondulSwitch.ManagementIPv4)
+		gondulSwitch.ManagementIPv6 = stripPrefixLength(gondulSwitch.ManagementIPv6)
+		switches[name] = gondulSwitch
+	}
+	return switches, nil
+}
+
+func (client *Client) get(path string, response interface{}) error {
+	httpClient := client.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: defaultTimeout}
+	}
+	request, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(client.BaseURL, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	if client.Username != "" {
+		request.SetBasicAuth(client.Username, client.Password)
+	}
+	request.Header.Set("Accept", "application/json")
+	httpResponse, err := httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(httpResponse.Body, maxResponseSize))
+	if err != nil {
+		return err
+	}
+	if httpResponse.StatusCode != http.StatusOK {
+		return fmt.Errorf("gondul returned status %v for %v", httpResponse.StatusCode, path)
+	}
+	return json.Unmarshal(body, response)
+}
+
+// stripPrefixLength removes the prefix length Gondul includes in addresses, e.g. "10.0.0.2/24".
+func stripPrefixLength(address string) string {
+	if i := strings.IndexByte(address, '/'); i >= 0 {
+		return address[:i]
+	}
+	return address
+}
@@ -0,0 +1,56 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package gondul
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gathering/tech-online-backend/helper"
+)
+
+func TestSwitches(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "techo" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		helper.CheckEqual(t, r.URL.Path, "/api/read/switches-management")
+		w.Write([]byte(`{"switches": {"e1-1": {"mgmt_v4_addr": "10.0.0.2/24", "mgmt_v6_addr": "2001:db8::2/64", "distro_name": "distro0", "distro_phy_port": "ge-0/0/1", "mgmt_vlan": "mgmt"}}, "hash": "abc"}`))
+	}))
+	defer server.Close()
+
+	client := Client{BaseURL: server.URL + "/", Username: "techo", Password: "secret"}
+	switches, err := client.Switches()
+	helper.CheckEqual(t, err, nil)
+	helper.CheckEqual(t, len(switches), 1)
+	gondulSwitch := switches["e1-1"]
+	helper.CheckEqual(t, gondulSwitch.Name, "e1-1")
+	helper.CheckEqual(t, gondulSwitch.ManagementIPv4, "10.0.0.2")
+	helper.CheckEqual(t, gondulSwitch.ManagementIPv6, "2001:db8::2")
+	helper.CheckEqual(t, gondulSwitch.Distro, "distro0")
+	helper.CheckEqual(t, gondulSwitch.DistroPort, "ge-0/0/1")
+
+	client.Password = "wrong"
+	_, err = client.Switches()
+	helper.CheckEqual(t, err != nil, true)
+}
@@ -0,0 +1,469 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+// Package graphql implements a small, read-only subset of GraphQL (queries with arguments, variables, aliases, fragments
+// and the skip/include directives, but no introspection) over schemas of batching resolvers.
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// maxDepth limits how deeply selections may be nested, since the object graph has cycles.
+const maxDepth = 10
+
+// Error is an error for the client, e.g. a syntax error or an unknown field. Other errors from resolvers are internal.
+type Error struct {
+	Message string `json:"message"`
+}
+
+func (err *Error) Error() string {
+	return err.Message
+}
+
+func errorf(format string, args ...interface{}) *Error {
+	return &Error{Message: fmt.Sprintf(format, args...)}
+}
+
+// Errorf creates an error for the client, e.g. for resolvers denying access.
+func Errorf(format string, args ...interface{}) error {
+	return errorf(format, args...)
+}
+
+// Schema is the root of the types.
+type Schema struct {
+	Query *Object
+}
+
+// Object is an object type with named fields.
+type Object struct {
+	Name   string
+	Fields map[string]*Field
+}
+
+// Field is a field of an object type. Scalar fields have no type and no resolver, they're read from the JSON
+// representation of the parent.
+type Field struct {
+	Type    *Object  // For object fields, nil for scalars
+	Args    []string // Allowed arguments
+	Resolve Resolver // For object fields
+}
+
+// Resolver resolves a field for all the parents at once, to allow batching queries. The result must have one value
+// for each parent (in the same order), which is nil, an object or a []interface{} of objects.
+type Resolver func(ctx context.Context, parents []interface{}, args Args) ([]interface{}, error)
+
+// Args contains the arguments of a field, with the variables substituted.
+type Args map[string]interface{}
+
+// String returns the argument as a string, if it's set.
+func (args Args) String(name string) (string, bool) {
+	value, ok := args[name]
+	if !ok || value == nil {
+		return "", false
+	}
+	return fmt.Sprint(value), true
+}
+
+// Bool returns the argument as a bool, false if not set.
+func (args Args) Bool(name string) bool {
+	value, _ := args[name].(bool)
+	return value
+}
+
+// Response is the result of a query, with either data or errors.
+type Response struct {
+	Data   interface{} `json:"data,omitempty"`
+	Errors []*Error    `json:"errors,omitempty"`
+}
+
+// NewObject creates an object type with a scalar field for each JSON field of the sample struct.
+func NewObject(name string, sample interface{}) *Object {
+	object := &Object{Name: name, Fields: make(map[string]*Field)}
+	structType := reflect.TypeOf(sample)
+	for structType.Kind() == reflect.Ptr {
+		structType = structType.Elem()
+	}
+	for i := 0; i < structType.NumField(); i++ {
+		structField := structType.Field(i)
+		if structField.PkgPath != "" {
+			continue
+		}
+		fieldName := structField.Name
+		if tag, ok := structField.Tag.Lookup("json"); ok {
+			if tag == "-" {
+				continue
+			}
+			if tagName := strings.Split(tag, ",")[0]; tagName != "" {
+				fieldName = tagName
+			}
+		}
+		object.Fields[fieldName] = &Field{}
+	}
+	return object
+}
+
+// Execute parses and runs the query (the named operation if there are multiple).
+// Errors for the client are returned in the response, other errors are internal.
+func Execute(ctx context.Context, schema *Schema, query string, operationName string, variables map[string]interface{}) (*Response, error) {
+	doc, err := parse(query)
+	if err != nil {
+		return &Response{Errors: []*Error{err.(*Error)}}, nil
+	}
+	op, err := doc.operation(operationName)
+	if err != nil {
+		return &Response{Errors: []*Error{err.(*Error)}}, nil
+	}
+	if op.kind != "query" {
+		return &Response{Errors: []*Error{errorf("only queries are supported, not %vs", op.kind)}}, nil
+	}
+	values := make(map[string]interface{})
+	for _, definition := range op.variables {
+		if value, ok := variables[definition.name]; ok {
+			values[definition.name] = value
+		} else if definition.hasDefault {
+			values[definition.name] = definition.defaultValue
+		}
+	}
+
+	exec := &execution{ctx: ctx, fragments: doc.fragments, variables: values}
+	results, err := exec.executeSelections(schema.Query, []interface{}{nil}, op.selections, 1)
+	if err != nil {
+		if clientErr, ok := err.(*Error); ok {
+			return &Response{Errors: []*Error{clientErr}}, nil
+		}
+		return nil, err
+	}
+	return &Response{Data: results[0]}, nil
+}
+
+// operation finds the operation to run.
+func (doc *document) operation(name string) (*operation, error) {
+	if name == "" {
+		if len(doc.operations) > 1 {
+			return nil, errorf("an operation name is required when the document has multiple operations")
+		}
+		return doc.operations[0], nil
+	}
+	for _, op := range doc.operations {
+		if op.name == name {
+			return op, nil
+		}
+	}
+	return nil, errorf("unknown operation %q", name)
+}
+
+type execution struct {
+	ctx       context.Context
+	fragments map[string]*fragment
+	variables map[string]interface{}
+}
+
+// collectedField is a field of a selection set, merged with other selections of the same response key.
+type collectedField struct {
+	key        string
+	selections []*selection
+}
+
+// executeSelections executes the selections for all the parents (of the object type) at once.
+func (exec *execution) executeSelections(object *Object, parents []interface{}, selections []*selection, depth int) ([]*orderedMap, error) {
+	if depth > maxDepth {
+		return nil, errorf("the query is nested deeper than %v levels", maxDepth)
+	}
+	fields, err := exec.collectFields(object, selections, nil, make(map[string]bool))
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*orderedMap, len(parents))
+	for i := range results {
+		results[i] = &orderedMap{}
+	}
+	jsonParents := make([]map[string]json.RawMessage, len(parents))
+	for _, collected := range fields {
+		first := collected.selections[0]
+		if first.name == "__typename" {
+			for _, result := range results {
+				result.set(collected.key, object.Name)
+			}
+			continue
+		}
+		field, ok := object.Fields[first.name]
+		if !ok {
+			return nil, errorf("cannot query field %q on type %q", first.name, object.Name)
+		}
+		args, err := exec.arguments(field, first)
+		if err != nil {
+			return nil, err
+		}
+		var subSelections []*selection
+		for _, sel := range collected.selections {
+			subSelections = append(subSelections, sel.selections...)
+		}
+
+		// Scalar
+		if field.Type == nil {
+			if len(subSelections) > 0 {
+				return nil, errorf("field %q of type %q is a scalar and can't have a selection", first.name, object.Name)
+			}
+			for i, parent := range parents {
+				if jsonParents[i] == nil {
+					if jsonParents[i], err = jsonFields(parent); err != nil {
+						return nil, err
+					}
+				}
+				value, ok := jsonParents[i][first.name]
+				if !ok {
+					value = json.RawMessage("null")
+				}
+				results[i].set(collected.key, value)
+			}
+			continue
+		}
+
+		// Object, resolved for all parents and then executed for all children at once
+		if len(subSelections) == 0 {
+			return nil, errorf("field %q of type %q must have a selection of subfields", first.name, object.Name)
+		}
+		values, err := field.Resolve(exec.ctx, parents, args)
+		if err != nil {
+			return nil, err
+		}
+		if len(values) != len(parents) {
+			return nil, fmt.Errorf("resolver for field %q of type %q returned %v values for %v parents", first.name, object.Name, len(values), len(parents))
+		}
+		var children []interface{}
+		for _, value := range values {
+			if list, ok := value.([]interface{}); ok {
+				for _, element := range list {
+					if !isNil(element) {
+						children = append(children, element)
+					}
+				}
+			} else if !isNil(value) {
+				children = append(children, value)
+			}
+		}
+		childResults, err := exec.executeSelections(field.Type, children, subSelections, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		for i, value := range values {
+			if list, ok := value.([]interface{}); ok {
+				resultList := make([]interface{}, 0, len(list))
+				for _, element := range list {
+					if isNil(element) {
+						resultList = append(resultList, nil)
+					} else {
+						resultList = append(resultList, childResults[0])
+						childResults = childResults[1:]
+					}
+				}
+				results[i].set(collected.key, resultList)
+			} else if !isNil(value) {
+				results[i].set(collected.key, childResults[0])
+				childResults = childResults[1:]
+			} else {
+				results[i].set(collected.key, nil)
+			}
+		}
+	}
+	return results, nil
+}
+
+// collectFields flattens the fragments and groups the fields by response key, in order.
+func (exec *execution) collectFields(object *Object, selections []*selection, fields []*collectedField, visitedFragments map[string]bool) ([]*collectedField, error) {
+	for _, sel := range selections {
+		include, err := exec.included(sel)
+		if err != nil {
+			return nil, err
+		}
+		if !include {
+			continue
+		}
+		switch {
+		case sel.fragment != "":
+			if visitedFragments[sel.fragment] {
+				continue
+			}
+			visitedFragments[sel.fragment] = true
+			frag, ok := exec.fragments[sel.fragment]
+			if !ok {
+				return nil, errorf("unknown fragment %q", sel.fragment)
+			}
+			if frag.typeCondition != object.Name {
+				continue
+			}
+			if fields, err = exec.collectFields(object, frag.selections, fields, visitedFragments); err != nil {
+				return nil, err
+			}
+		case sel.inline:
+			if sel.typeCondition != "" && sel.typeCondition != object.Name {
+				continue
+			}
+			if fields, err = exec.collectFields(object, sel.selections, fields, visitedFragments); err != nil {
+				return nil, err
+			}
+		default:
+			key := sel.name
+			if sel.alias != "" {
+				key = sel.alias
+			}
+			var existing *collectedField
+			for _, field := range fields {
+				if field.key == key {
+					existing = field
+					break
+				}
+			}
+			if existing == nil {
+				fields = append(fields, &collectedField{key: key, selections: []*selection{sel}})
+			} else if existing.selections[0].name != sel.name {
+				return nil, errorf("fields %q and %q conflict for the response key %q", existing.selections[0].name, sel.name, key)
+			} else {
+				existing.selections = append(existing.selections, sel)
+			}
+		}
+	}
+	return fields, nil
+}
+
+// included checks the skip and include directives.
+func (exec *execution) included(sel *selection) (bool, error) {
+	for _, dir := range sel.directives {
+		if dir.name != "skip" && dir.name != "include" {
+			return false, errorf("unknown directive %q", dir.name)
+		}
+		condition, ok := exec.resolve(dir.args["if"]).(bool)
+		if !ok {
+			return false, errorf("directive %q needs a boolean \"if\" argument", dir.name)
+		}
+		if condition == (dir.name == "skip") {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// arguments checks the arguments of the field and substitutes the variables.
+func (exec *execution) arguments(field *Field, sel *selection) (Args, error) {
+	args := make(Args, len(sel.args))
+	for name, value := range sel.args {
+		allowed := false
+		for _, allowedName := range field.Args {
+			if name == allowedName {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return nil, errorf("unknown argument %q for field %q", name, sel.name)
+		}
+		if value := exec.resolve(value); value != nil {
+			args[name] = value
+		}
+	}
+	return args, nil
+}
+
+// resolve substitutes the variables in the value.
+func (exec *execution) resolve(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case variable:
+		return exec.variables[string(typed)]
+	case []interface{}:
+		list := make([]interface{}, len(typed))
+		for i, element := range typed {
+			list[i] = exec.resolve(element)
+		}
+		return list
+	case map[string]interface{}:
+		object := make(map[string]interface{}, len(typed))
+		for key, element := range typed {
+			object[key] = exec.resolve(element)
+		}
+		return object
+	}
+	return value
+}
+
+// jsonFields gets the JSON fields of the value, to keep the same names and formats as the REST API.
+func jsonFields(value interface{}) (map[string]json.RawMessage, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+func isNil(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	reflected := reflect.ValueOf(value)
+	switch reflected.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface:
+		return reflected.IsNil()
+	}
+	return false
+}
+
+// orderedMap is a JSON object keeping the order of the selections.
+type orderedMap struct {
+	keys   []string
+	values []interface{}
+}
+
+func (m *orderedMap) set(key string, value interface{}) {
+	m.keys = append(m.keys, key)
+	m.values = append(m.values, value)
+}
+
+// MarshalJSON writes the object with the keys in order.
+func (m *orderedMap) MarshalJSON() ([]byte, error) {
+	var buffer bytes.Buffer
+	buffer.WriteByte('{')
+	for i, key := range m.keys {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		keyData, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		valueData, err := json.Marshal(m.values[i])
+		if err != nil {
+			return nil, err
+		}
+		buffer.Write(keyData)
+		buffer.WriteByte(':')
+		buffer.Write(valueData)
+	}
+	buffer.WriteByte('}')
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,155 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/gathering/tech-online-backend/helper"
+)
+
+type testTrack struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type testStation struct {
+	TrackID   string `json:"track"`
+	Shortname string `json:"shortname"`
+	Secret    string `json:"-"`
+}
+
+func testSchema(resolveCount *int) *Schema {
+	tracks := []*testTrack{{ID: "net", Name: "Network"}, {ID: "srv", Name: "Server"}}
+	stations := []*testStation{{TrackID: "net", Shortname: "net-1"}, {TrackID: "net", Shortname: "net-2"}, {TrackID: "srv", Shortname: "srv-1"}}
+
+	track := NewObject("Track", testTrack{})
+	station := NewObject("Station", testStation{})
+	track.Fields["stations"] = &Field{Type: station, Resolve: func(ctx context.Context, parents []interface{}, args Args) ([]interface{}, error) {
+		*resolveCount++
+		values := make([]interface{}, len(parents))
+		for i, parent := range parents {
+			list := make([]interface{}, 0)
+			for _, s := range stations {
+				if s.TrackID == parent.(*testTrack).ID {
+					list = append(list, s)
+				}
+			}
+			values[i] = list
+		}
+		return values, nil
+	}}
+	station.Fields["track"] = &Field{Type: track, Resolve: func(ctx context.Context, parents []interface{}, args Args) ([]interface{}, error) {
+		values := make([]interface{}, len(parents))
+		for i, parent := range parents {
+			for _, t := range tracks {
+				if t.ID == parent.(*testStation).TrackID {
+					values[i] = t
+				}
+			}
+		}
+		return values, nil
+	}}
+	query := &Object{Name: "Query", Fields: map[string]*Field{
+		"tracks": {Type: track, Resolve: func(ctx context.Context, parents []interface{}, args Args) ([]interface{}, error) {
+			list := make([]interface{}, len(tracks))
+			for i, t := range tracks {
+				list[i] = t
+			}
+			return []interface{}{list}, nil
+		}},
+		"track": {Type: track, Args: []string{"id"}, Resolve: func(ctx context.Context, parents []interface{}, args Args) ([]interface{}, error) {
+			id, _ := args.String("id")
+			if id == "secret" {
+				return nil, Errorf("not allowed")
+			}
+			for _, t := range tracks {
+				if t.ID == id {
+					return []interface{}{t}, nil
+				}
+			}
+			return []interface{}{(*testTrack)(nil)}, nil
+		}},
+	}}
+	return &Schema{Query: query}
+}
+
+func executeJSON(t *testing.T, query string, variables map[string]interface{}) string {
+	var resolveCount int
+	response, err := Execute(context.Background(), testSchema(&resolveCount), query, "", variables)
+	helper.CheckEqual(t, err, nil)
+	data, err := json.Marshal(response)
+	helper.CheckEqual(t, err, nil)
+	return string(data)
+}
+
+func TestExecute(t *testing.T) {
+	helper.CheckEqual(t, executeJSON(t, `{ tracks { id } }`, nil), `{"data":{"tracks":[{"id":"net"},{"id":"srv"}]}}`)
+	helper.CheckEqual(t, executeJSON(t, `query Q($id: String = "srv") { t: track(id: $id) { __typename name } }`, nil),
+		`{"data":{"t":{"__typename":"Track","name":"Server"}}}`)
+	helper.CheckEqual(t, executeJSON(t, `query Q($id: String!) { track(id: $id) { name } }`, map[string]interface{}{"id": "none"}),
+		`{"data":{"track":null}}`)
+	helper.CheckEqual(t, executeJSON(t, `
+		# Fragments, directives and merged fields
+		{
+			track(id: "net") {
+				...trackFields
+				stations @include(if: true) { shortname track { id } }
+				name @skip(if: true)
+				stations { ... on Station { secret: shortname } }
+			}
+		}
+		fragment trackFields on Track { name }`, nil),
+		`{"data":{"track":{"name":"Network","stations":[{"shortname":"net-1","track":{"id":"net"},"secret":"net-1"},{"shortname":"net-2","track":{"id":"net"},"secret":"net-2"}]}}}`)
+
+	// Errors for the client
+	helper.CheckEqual(t, executeJSON(t, `{ track(id: "secret") { id } }`, nil), `{"errors":[{"message":"not allowed"}]}`)
+	helper.CheckEqual(t, executeJSON(t, `{ tracks { Secret } }`, nil), `{"errors":[{"message":"cannot query field \"Secret\" on type \"Track\""}]}`)
+	helper.CheckEqual(t, executeJSON(t, `{ tracks }`, nil), `{"errors":[{"message":"field \"tracks\" of type \"Query\" must have a selection of subfields"}]}`)
+	helper.CheckEqual(t, executeJSON(t, `{ tracks(type: "x") { id } }`, nil), `{"errors":[{"message":"unknown argument \"type\" for field \"tracks\""}]}`)
+	helper.CheckEqual(t, executeJSON(t, `mutation { tracks { id } }`, nil), `{"errors":[{"message":"only queries are supported, not mutations"}]}`)
+	helper.CheckEqual(t, executeJSON(t, "{\n  tracks { id ", nil), `{"errors":[{"message":"syntax error at line 2, column 15: unexpected end of document"}]}`)
+	deepQuery := "{ tracks { id } }"
+	for i := 0; i < 5; i++ {
+		deepQuery = strings.Replace(deepQuery, "{ id }", "{ stations { track { id } } }", 1)
+	}
+	helper.CheckEqual(t, executeJSON(t, deepQuery, nil), `{"errors":[{"message":"the query is nested deeper than 10 levels"}]}`)
+}
+
+func TestExecuteBatching(t *testing.T) {
+	var resolveCount int
+	_, err := Execute(context.Background(), testSchema(&resolveCount), `{ tracks { stations { track { stations { shortname } } } } }`, "", nil)
+	helper.CheckEqual(t, err, nil)
+	// Once per level, not per track
+	helper.CheckEqual(t, resolveCount, 2)
+}
+
+func TestParseStrings(t *testing.T) {
+	doc, err := parse(`{ f(a: "x\"æ\n", b: """ block "quoted" """, c: [1, -2.5e1, ENUM, null, {d: true}]) }`)
+	helper.CheckEqual(t, err, nil)
+	args := doc.operations[0].selections[0].args
+	helper.CheckEqual(t, args["a"], "x\"æ\n")
+	helper.CheckEqual(t, args["b"], `block "quoted"`)
+	data, _ := json.Marshal(args["c"])
+	helper.CheckEqual(t, string(data), `[1,-25,"ENUM",null,{"d":true}]`)
+}
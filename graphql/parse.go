@@ -0,0 +1,497 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package graphql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// document is a parsed query document.
+type document struct {
+	operations []*operation
+	fragments  map[string]*fragment
+}
+
+// operation is a query (the only supported operation type) with its variables and selections.
+type operation struct {
+	kind       string // "query", "mutation" or "subscription"
+	name       string
+	variables  []variableDefinition
+	selections []*selection
+}
+
+type variableDefinition struct {
+	name         string
+	defaultValue interface{}
+	hasDefault   bool
+}
+
+type fragment struct {
+	name          string
+	typeCondition string
+	selections    []*selection
+}
+
+// selection is a field, a fragment spread (fragment set) or an inline fragment (inline set).
+type selection struct {
+	alias         string
+	name          string
+	args          map[string]interface{}
+	directives    []directive
+	selections    []*selection
+	fragment      string
+	inline        bool
+	typeCondition string
+}
+
+type directive struct {
+	name string
+	args map[string]interface{}
+}
+
+// variable is a reference to a variable in a value, resolved when executing.
+type variable string
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenPunctuator
+	tokenName
+	tokenInt
+	tokenFloat
+	tokenString
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+type parser struct {
+	source string
+	pos    int
+	token  token
+}
+
+// parse parses a query document.
+func parse(source string) (doc *document, err error) {
+	p := &parser{source: source}
+	defer func() {
+		if r := recover(); r != nil {
+			syntaxErr, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			err = syntaxErr
+		}
+	}()
+	p.next()
+	doc = &document{fragments: make(map[string]*fragment)}
+	for p.token.kind != tokenEOF {
+		switch {
+		case p.peek(tokenPunctuator, "{"):
+			doc.operations = append(doc.operations, &operation{kind: "query", selections: p.parseSelectionSet()})
+		case p.peek(tokenName, "query") || p.peek(tokenName, "mutation") || p.peek(tokenName, "subscription"):
+			doc.operations = append(doc.operations, p.parseOperation())
+		case p.peek(tokenName, "fragment"):
+			frag := p.parseFragment()
+			if _, exists := doc.fragments[frag.name]; exists {
+				return nil, errorf("there can be only one fragment named %q", frag.name)
+			}
+			doc.fragments[frag.name] = frag
+		default:
+			p.unexpected()
+		}
+	}
+	if len(doc.operations) == 0 {
+		return nil, errorf("the document has no operations")
+	}
+	return doc, nil
+}
+
+func (p *parser) fail(format string, args ...interface{}) {
+	line := 1 + strings.Count(p.source[:p.token.pos], "\n")
+	column := p.token.pos - strings.LastIndex(p.source[:p.token.pos], "\n")
+	panic(errorf("syntax error at line %v, column %v: %v", line, column, fmt.Sprintf(format, args...)))
+}
+
+func (p *parser) unexpected() {
+	if p.token.kind == tokenEOF {
+		p.fail("unexpected end of document")
+	}
+	p.fail("unexpected %q", p.token.value)
+}
+
+// next reads the next token, skipping whitespace, commas and comments.
+func (p *parser) next() {
+	for p.pos < len(p.source) {
+		c := p.source[p.pos]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' {
+			p.pos++
+		} else if c == '#' {
+			for p.pos < len(p.source) && p.source[p.pos] != '\n' {
+				p.pos++
+			}
+		} else if strings.HasPrefix(p.source[p.pos:], "\ufeff") {
+			p.pos += len("\ufeff") // Byte order mark
+		} else {
+			break
+		}
+	}
+	start := p.pos
+	p.token = token{pos: start}
+	if p.pos >= len(p.source) {
+		p.token.kind = tokenEOF
+		return
+	}
+	c := p.source[p.pos]
+	switch {
+	case strings.HasPrefix(p.source[p.pos:], "..."):
+		p.pos += 3
+		p.token.kind = tokenPunctuator
+	case strings.IndexByte("!$():=@[]{}|&", c) >= 0:
+		p.pos++
+		p.token.kind = tokenPunctuator
+	case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		for p.pos < len(p.source) && isNameChar(p.source[p.pos]) {
+			p.pos++
+		}
+		p.token.kind = tokenName
+	case c == '-' || c >= '0' && c <= '9':
+		p.token.kind = p.readNumber()
+	case c == '"':
+		p.token.kind = tokenString
+		p.token.value = p.readString()
+		return
+	default:
+		r, _ := utf8.DecodeRuneInString(p.source[p.pos:])
+		p.fail("unexpected character %q", r)
+	}
+	p.token.value = p.source[start:p.pos]
+}
+
+func isNameChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func (p *parser) readNumber() tokenKind {
+	kind := tokenInt
+	if p.source[p.pos] == '-' {
+		p.pos++
+	}
+	digits := func() {
+		start := p.pos
+		for p.pos < len(p.source) && p.source[p.pos] >= '0' && p.source[p.pos] <= '9' {
+			p.pos++
+		}
+		if p.pos == start {
+			p.fail("invalid number")
+		}
+	}
+	digits()
+	if p.pos < len(p.source) && p.source[p.pos] == '.' {
+		kind = tokenFloat
+		p.pos++
+		digits()
+	}
+	if p.pos < len(p.source) && (p.source[p.pos] == 'e' || p.source[p.pos] == 'E') {
+		kind = tokenFloat
+		p.pos++
+		if p.pos < len(p.source) && (p.source[p.pos] == '+' || p.source[p.pos] == '-') {
+			p.pos++
+		}
+		digits()
+	}
+	return kind
+}
+
+// readString reads a quoted string or block string and returns its value.
+func (p *parser) readString() string {
+	if strings.HasPrefix(p.source[p.pos:], `"""`) {
+		end := strings.Index(p.source[p.pos+3:], `"""`)
+		if end < 0 {
+			p.fail("unterminated string")
+		}
+		value := p.source[p.pos+3 : p.pos+3+end]
+		p.pos += 3 + end + 3
+		return strings.TrimSpace(value)
+	}
+	p.pos++
+	var value strings.Builder
+	for {
+		if p.pos >= len(p.source) || p.source[p.pos] == '\n' {
+			p.fail("unterminated string")
+		}
+		c := p.source[p.pos]
+		if c == '"' {
+			p.pos++
+			return value.String()
+		}
+		if c != '\\' {
+			value.WriteByte(c)
+			p.pos++
+			continue
+		}
+		if p.pos+1 >= len(p.source) {
+			p.fail("unterminated string")
+		}
+		escape := p.source[p.pos+1]
+		p.pos += 2
+		switch escape {
+		case '"', '\\', '/':
+			value.WriteByte(escape)
+		case 'b':
+			value.WriteByte('\b')
+		case 'f':
+			value.WriteByte('\f')
+		case 'n':
+			value.WriteByte('\n')
+		case 'r':
+			value.WriteByte('\r')
+		case 't':
+			value.WriteByte('\t')
+		case 'u':
+			if p.pos+4 > len(p.source) {
+				p.fail("invalid unicode escape")
+			}
+			code, err := strconv.ParseUint(p.source[p.pos:p.pos+4], 16, 32)
+			if err != nil {
+				p.fail("invalid unicode escape")
+			}
+			value.WriteRune(rune(code))
+			p.pos += 4
+		default:
+			p.fail("invalid escape %q", escape)
+		}
+	}
+}
+
+func (p *parser) peek(kind tokenKind, value string) bool {
+	return p.token.kind == kind && p.token.value == value
+}
+
+// skip consumes the token if it matches.
+func (p *parser) skip(kind tokenKind, value string) bool {
+	if p.peek(kind, value) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(value string) {
+	if !p.skip(tokenPunctuator, value) {
+		p.unexpected()
+	}
+}
+
+func (p *parser) parseName() string {
+	if p.token.kind != tokenName {
+		p.unexpected()
+	}
+	name := p.token.value
+	p.next()
+	return name
+}
+
+func (p *parser) parseOperation() *operation {
+	op := &operation{kind: p.parseName()}
+	if p.token.kind == tokenName {
+		op.name = p.parseName()
+	}
+	if p.skip(tokenPunctuator, "(") {
+		for !p.skip(tokenPunctuator, ")") {
+			p.expect("$")
+			definition := variableDefinition{name: p.parseName()}
+			p.expect(":")
+			p.parseType()
+			if p.skip(tokenPunctuator, "=") {
+				definition.defaultValue = p.parseValue(true)
+				definition.hasDefault = true
+			}
+			p.parseDirectives()
+			op.variables = append(op.variables, definition)
+		}
+	}
+	p.parseDirectives()
+	op.selections = p.parseSelectionSet()
+	return op
+}
+
+// parseType skips a type reference, variable types aren't checked.
+func (p *parser) parseType() {
+	if p.skip(tokenPunctuator, "[") {
+		p.parseType()
+		p.expect("]")
+	} else {
+		p.parseName()
+	}
+	p.skip(tokenPunctuator, "!")
+}
+
+func (p *parser) parseFragment() *fragment {
+	p.parseName()
+	frag := &fragment{name: p.parseName()}
+	if frag.name == "on" {
+		p.fail("fragments can't be named \"on\"")
+	}
+	if !p.skip(tokenName, "on") {
+		p.unexpected()
+	}
+	frag.typeCondition = p.parseName()
+	p.parseDirectives()
+	frag.selections = p.parseSelectionSet()
+	return frag
+}
+
+func (p *parser) parseSelectionSet() []*selection {
+	p.expect("{")
+	var selections []*selection
+	for !p.skip(tokenPunctuator, "}") {
+		selections = append(selections, p.parseSelection())
+	}
+	if len(selections) == 0 {
+		p.fail("empty selection set")
+	}
+	return selections
+}
+
+func (p *parser) parseSelection() *selection {
+	sel := &selection{}
+	if p.skip(tokenPunctuator, "...") {
+		if p.token.kind == tokenName && p.token.value != "on" {
+			sel.fragment = p.parseName()
+			sel.directives = p.parseDirectives()
+			return sel
+		}
+		sel.inline = true
+		if p.skip(tokenName, "on") {
+			sel.typeCondition = p.parseName()
+		}
+		sel.directives = p.parseDirectives()
+		sel.selections = p.parseSelectionSet()
+		return sel
+	}
+	sel.name = p.parseName()
+	if p.skip(tokenPunctuator, ":") {
+		sel.alias = sel.name
+		sel.name = p.parseName()
+	}
+	sel.args = p.parseArguments()
+	sel.directives = p.parseDirectives()
+	if p.peek(tokenPunctuator, "{") {
+		sel.selections = p.parseSelectionSet()
+	}
+	return sel
+}
+
+func (p *parser) parseArguments() map[string]interface{} {
+	args := make(map[string]interface{})
+	if !p.skip(tokenPunctuator, "(") {
+		return args
+	}
+	for !p.skip(tokenPunctuator, ")") {
+		name := p.parseName()
+		p.expect(":")
+		if _, exists := args[name]; exists {
+			p.fail("duplicate argument %q", name)
+		}
+		args[name] = p.parseValue(false)
+	}
+	return args
+}
+
+func (p *parser) parseDirectives() []directive {
+	var directives []directive
+	for p.skip(tokenPunctuator, "@") {
+		name := p.parseName()
+		directives = append(directives, directive{name: name, args: p.parseArguments()})
+	}
+	return directives
+}
+
+// parseValue parses a literal value, or a variable unless constant.
+func (p *parser) parseValue(constant bool) interface{} {
+	tok := p.token
+	switch tok.kind {
+	case tokenPunctuator:
+		switch tok.value {
+		case "$":
+			if constant {
+				p.fail("variables are not allowed here")
+			}
+			p.next()
+			return variable(p.parseName())
+		case "[":
+			p.next()
+			list := make([]interface{}, 0)
+			for !p.skip(tokenPunctuator, "]") {
+				list = append(list, p.parseValue(constant))
+			}
+			return list
+		case "{":
+			p.next()
+			object := make(map[string]interface{})
+			for !p.skip(tokenPunctuator, "}") {
+				name := p.parseName()
+				p.expect(":")
+				object[name] = p.parseValue(constant)
+			}
+			return object
+		}
+	case tokenInt:
+		p.next()
+		value, err := strconv.Atoi(tok.value)
+		if err != nil {
+			p.fail("invalid integer %q", tok.value)
+		}
+		return value
+	case tokenFloat:
+		p.next()
+		value, err := strconv.ParseFloat(tok.value, 64)
+		if err != nil {
+			p.fail("invalid float %q", tok.value)
+		}
+		return value
+	case tokenString:
+		p.next()
+		return tok.value
+	case tokenName:
+		p.next()
+		switch tok.value {
+		case "true":
+			return true
+		case "false":
+			return false
+		case "null":
+			return nil
+		}
+		// Enum values are treated as strings
+		return tok.value
+	}
+	p.unexpected()
+	return nil
+}
@@ -0,0 +1,168 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package helper
+
+import (
+	"fmt"
+	"strings"
+)
+
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	line string
+}
+
+// UnifiedDiff creates a line-based unified diff between two texts, with the
+// provided number of context lines around each change. Returns an empty
+// string if the texts are equal.
+//
+// It uses a plain LCS table, so it's quadratic in time and memory. That's fine
+// for documents, don't feed it log files.
+func UnifiedDiff(fromName string, toName string, from string, to string, contextLines int) string {
+	ops := diffLines(splitLines(from), splitLines(to))
+
+	// Find hunks, as ranges of ops, merging changes with overlapping context
+	type hunk struct{ begin, end int }
+	var hunks []hunk
+	for i, op := range ops {
+		if op.kind == ' ' {
+			continue
+		}
+		begin := i - contextLines
+		if begin < 0 {
+			begin = 0
+		}
+		end := i + contextLines + 1
+		if end > len(ops) {
+			end = len(ops)
+		}
+		if len(hunks) > 0 && begin <= hunks[len(hunks)-1].end {
+			hunks[len(hunks)-1].end = end
+		} else {
+			hunks = append(hunks, hunk{begin, end})
+		}
+	}
+	if len(hunks) == 0 {
+		return ""
+	}
+
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "--- %s\n+++ %s\n", fromName, toName)
+	fromLine, toLine, opIndex := 1, 1, 0
+	for _, h := range hunks {
+		// Skip to the hunk, counting lines
+		for ; opIndex < h.begin; opIndex++ {
+			fromLine, toLine = advanceDiffLines(ops[opIndex].kind, fromLine, toLine)
+		}
+		fromCount, toCount := 0, 0
+		for _, op := range ops[h.begin:h.end] {
+			if op.kind != '+' {
+				fromCount++
+			}
+			if op.kind != '-' {
+				toCount++
+			}
+		}
+		fmt.Fprintf(&builder, "@@ -%s +%s @@\n", formatDiffRange(fromLine, fromCount), formatDiffRange(toLine, toCount))
+		for ; opIndex < h.end; opIndex++ {
+			op := ops[opIndex]
+			builder.WriteByte(op.kind)
+			builder.WriteString(op.line)
+			builder.WriteByte('\n')
+			fromLine, toLine = advanceDiffLines(op.kind, fromLine, toLine)
+		}
+	}
+	return builder.String()
+}
+
+func advanceDiffLines(kind byte, fromLine int, toLine int) (int, int) {
+	if kind != '+' {
+		fromLine++
+	}
+	if kind != '-' {
+		toLine++
+	}
+	return fromLine, toLine
+}
+
+// formatDiffRange formats a hunk range like GNU diff. Empty ranges refer to the line before.
+func formatDiffRange(start int, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", start-1)
+	case 1:
+		return fmt.Sprintf("%d", start)
+	default:
+		return fmt.Sprintf("%d,%d", start, count)
+	}
+}
+
+// splitLines splits text into lines, ignoring a final trailing newline.
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// diffLines finds the shortest edit script between two lists of lines using the longest common subsequence.
+func diffLines(from []string, to []string) []diffOp {
+	// lcs[i][j] is the LCS length of from[i:] and to[j:]
+	lcs := make([][]int, len(from)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(to)+1)
+	}
+	for i := len(from) - 1; i >= 0; i-- {
+		for j := len(to) - 1; j >= 0; j-- {
+			if from[i] == to[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	ops := make([]diffOp, 0, len(from)+len(to))
+	i, j := 0, 0
+	for i < len(from) && j < len(to) {
+		switch {
+		case from[i] == to[j]:
+			ops = append(ops, diffOp{' ', from[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, diffOp{'-', from[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', to[j]})
+			j++
+		}
+	}
+	for ; i < len(from); i++ {
+		ops = append(ops, diffOp{'-', from[i]})
+	}
+	for ; j < len(to); j++ {
+		ops = append(ops, diffOp{'+', to[j]})
+	}
+	return ops
+}
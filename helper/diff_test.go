@@ -0,0 +1,46 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package helper_test
+
+import (
+	"testing"
+
+	"github.com/gathering/tech-online-backend/helper"
+)
+
+func TestUnifiedDiffEqual(t *testing.T) {
+	helper.CheckEqual(t, helper.UnifiedDiff("a", "b", "one\ntwo\n", "one\ntwo\n", 3), "")
+	helper.CheckEqual(t, helper.UnifiedDiff("a", "b", "", "", 3), "")
+}
+
+func TestUnifiedDiffChange(t *testing.T) {
+	from := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n"
+	to := "1\n2\n3\n4\nfive\n6\n7\n8\n9\n10\neleven\n"
+	expected := "--- a\n+++ b\n" +
+		"@@ -3,5 +3,5 @@\n 3\n 4\n-5\n+five\n 6\n 7\n" +
+		"@@ -9,2 +9,3 @@\n 9\n 10\n+eleven\n"
+	helper.CheckEqual(t, helper.UnifiedDiff("a", "b", from, to, 2), expected)
+}
+
+func TestUnifiedDiffFromEmpty(t *testing.T) {
+	expected := "--- a\n+++ b\n@@ -0,0 +1,2 @@\n+one\n+two\n"
+	helper.CheckEqual(t, helper.UnifiedDiff("a", "b", "", "one\ntwo", 3), expected)
+}
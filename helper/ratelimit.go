@@ -0,0 +1,96 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package helper
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter limits how many times something may happen per key within a sliding time window, e.g. answer attempts per team.
+// It's in-memory unless it has a backend, so limits reset on restarts and aren't shared between instances.
+type RateLimiter struct {
+	limit   int
+	window  time.Duration
+	events  map[string][]time.Time
+	lock    sync.Mutex
+	now     func() time.Time
+	backend RateLimitBackend
+}
+
+// RateLimitBackend keeps the events outside the process, e.g. in Redis, so limits are shared between instances.
+type RateLimitBackend interface {
+	// Allow works like RateLimiter.Allow, but may fail.
+	Allow(key string, limit int, window time.Duration) (bool, time.Duration, error)
+}
+
+// NewRateLimiter creates a rate limiter allowing limit events per key within the window.
+func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
+	return &RateLimiter{
+		limit:  limit,
+		window: window,
+		events: make(map[string][]time.Time),
+		now:    time.Now,
+	}
+}
+
+// NewRateLimiterWithBackend creates a rate limiter using the backend, falling back to in-memory limiting if the backend fails.
+func NewRateLimiterWithBackend(limit int, window time.Duration, backend RateLimitBackend) *RateLimiter {
+	limiter := NewRateLimiter(limit, window)
+	limiter.backend = backend
+	return limiter
+}
+
+// Allow records an event for the key and returns true, or returns false without recording it if the limit is reached.
+// The second return value is how long until the next event would be allowed, if not allowed.
+func (limiter *RateLimiter) Allow(key string) (bool, time.Duration) {
+	if limiter.backend != nil {
+		if allowed, wait, err := limiter.backend.Allow(key, limiter.limit, limiter.window); err == nil {
+			return allowed, wait
+		}
+	}
+
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	now := limiter.now()
+	limiter.prune(key, now)
+	events := limiter.events[key]
+	if len(events) >= limiter.limit {
+		return false, events[0].Add(limiter.window).Sub(now)
+	}
+	limiter.events[key] = append(events, now)
+	return true, 0
+}
+
+// prune removes the events for the key which are outside the window.
+func (limiter *RateLimiter) prune(key string, now time.Time) {
+	events := limiter.events[key]
+	cutoff := now.Add(-limiter.window)
+	i := 0
+	for i < len(events) && !events[i].After(cutoff) {
+		i++
+	}
+	if i == len(events) {
+		delete(limiter.events, key)
+		return
+	}
+	limiter.events[key] = events[i:]
+}
@@ -0,0 +1,72 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package helper
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2022, 4, 14, 12, 0, 0, 0, time.UTC)
+	limiter := NewRateLimiter(2, time.Minute)
+	limiter.now = func() time.Time { return now }
+
+	allowed, _ := limiter.Allow("a")
+	CheckEqual(t, allowed, true)
+	now = now.Add(10 * time.Second)
+	allowed, _ = limiter.Allow("a")
+	CheckEqual(t, allowed, true)
+	allowed, wait := limiter.Allow("a")
+	CheckEqual(t, allowed, false)
+	CheckEqual(t, wait, 50*time.Second)
+
+	// Other keys are independent
+	allowed, _ = limiter.Allow("b")
+	CheckEqual(t, allowed, true)
+
+	// The first event leaves the window
+	now = now.Add(51 * time.Second)
+	allowed, _ = limiter.Allow("a")
+	CheckEqual(t, allowed, true)
+	allowed, _ = limiter.Allow("a")
+	CheckEqual(t, allowed, false)
+}
+
+type failingRateLimitBackend struct {
+	calls int
+}
+
+func (backend *failingRateLimitBackend) Allow(key string, limit int, window time.Duration) (bool, time.Duration, error) {
+	backend.calls++
+	return false, 0, errors.New("unavailable")
+}
+
+func TestRateLimiterBackendFallback(t *testing.T) {
+	backend := &failingRateLimitBackend{}
+	limiter := NewRateLimiterWithBackend(1, time.Minute, backend)
+
+	allowed, _ := limiter.Allow("a")
+	CheckEqual(t, allowed, true)
+	allowed, _ = limiter.Allow("a")
+	CheckEqual(t, allowed, false)
+	CheckEqual(t, backend.calls, 2)
+}
@@ -0,0 +1,97 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package helper
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// SSHPublicKey is a parsed SSH public key in authorized_keys format.
+type SSHPublicKey struct {
+	Type    string // E.g. "ssh-ed25519"
+	Data    []byte // Wire format key blob
+	Comment string
+}
+
+var sshPublicKeyTypes = map[string]bool{
+	"ssh-ed25519":                        true,
+	"ssh-rsa":                            true,
+	"ecdsa-sha2-nistp256":                true,
+	"ecdsa-sha2-nistp384":                true,
+	"ecdsa-sha2-nistp521":                true,
+	"sk-ssh-ed25519@openssh.com":         true,
+	"sk-ecdsa-sha2-nistp256@openssh.com": true,
+}
+
+// ParseSSHPublicKey parses a single public key line like "ssh-ed25519 AAAA... comment".
+// Options (like in authorized_keys files) are not allowed. DSA keys are not accepted.
+func ParseSSHPublicKey(line string) (*SSHPublicKey, error) {
+	fields := strings.Fields(strings.TrimSpace(line))
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("expected key type and key data")
+	}
+	keyType := fields[0]
+	if !sshPublicKeyTypes[keyType] {
+		return nil, fmt.Errorf("unsupported key type: %v", keyType)
+	}
+	data, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid key data: %v", err)
+	}
+
+	// The blob starts with the length-prefixed key type, which must match
+	if len(data) < 4 {
+		return nil, fmt.Errorf("key data too short")
+	}
+	typeLength := binary.BigEndian.Uint32(data[:4])
+	if uint64(typeLength) > uint64(len(data)-4) || !bytes.Equal(data[4:4+typeLength], []byte(keyType)) {
+		return nil, fmt.Errorf("key data does not match key type")
+	}
+	if len(data) == int(4+typeLength) {
+		return nil, fmt.Errorf("key data too short")
+	}
+
+	return &SSHPublicKey{
+		Type:    keyType,
+		Data:    data,
+		Comment: strings.Join(fields[2:], " "),
+	}, nil
+}
+
+// String formats the key as an authorized_keys line.
+func (key *SSHPublicKey) String() string {
+	line := key.Type + " " + base64.StdEncoding.EncodeToString(key.Data)
+	if key.Comment != "" {
+		line += " " + key.Comment
+	}
+	return line
+}
+
+// Fingerprint gets the SHA256 fingerprint, formatted like OpenSSH does.
+func (key *SSHPublicKey) Fingerprint() string {
+	sum := sha256.Sum256(key.Data)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,57 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package helper_test
+
+import (
+	"testing"
+
+	"github.com/gathering/tech-online-backend/helper"
+)
+
+func TestParseSSHPublicKey(t *testing.T) {
+	// Generated with ssh-keygen -t ed25519, fingerprint from ssh-keygen -l
+	line := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIMikKEmZejaoS/nX4/AvGumSJnx4rOuNPTlSsWi8CoOe  alice@laptop \n"
+	key, err := helper.ParseSSHPublicKey(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	helper.CheckEqual(t, key.Type, "ssh-ed25519")
+	helper.CheckEqual(t, key.Comment, "alice@laptop")
+	helper.CheckEqual(t, key.String(), "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIMikKEmZejaoS/nX4/AvGumSJnx4rOuNPTlSsWi8CoOe alice@laptop")
+	helper.CheckEqual(t, key.Fingerprint(), "SHA256:ixSxX9ymnPue6AAQfszGuwRJIERqD9Qg0JzSc5AWiyU")
+}
+
+func TestParseSSHPublicKeyInvalid(t *testing.T) {
+	invalid := []string{
+		"",
+		"ssh-ed25519",
+		"ssh-dss AAAAB3NzaC1kc3MAAACBAP==",
+		"ssh-ed25519 not-base64!",
+		// RSA key data labeled as ed25519
+		"ssh-ed25519 AAAAB3NzaC1yc2EAAAADAQABAAAAgQC7",
+		// Only the type in the blob
+		"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5",
+	}
+	for _, line := range invalid {
+		_, err := helper.ParseSSHPublicKey(line)
+		helper.CheckNotEqual(t, err, nil)
+	}
+}
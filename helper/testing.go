@@ -29,7 +29,7 @@ import (
 )
 
 // CheckEqual compares a to b, ensuring they are equal.
-func CheckEqual(t *testing.T, a interface{}, b interface{}) {
+func CheckEqual(t testing.TB, a interface{}, b interface{}) {
 	t.Helper()
 	if a != b {
 		t.Errorf("Test failed, a != b: %v != %v", a, b)
@@ -39,7 +39,7 @@ func CheckEqual(t *testing.T, a interface{}, b interface{}) {
 // CheckNotEqual oh my god, really golint, this is not documenting stuff,
 // it is producing noise. A function named "CheckNotEqual" should not
 // require an explanation.
-func CheckNotEqual(t *testing.T, a interface{}, b interface{}) {
+func CheckNotEqual(t testing.TB, a interface{}, b interface{}) {
 	t.Helper()
 	if a == b {
 		t.Errorf("Test failed, a == b: %v == %v", a, b)
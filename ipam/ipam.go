@@ -0,0 +1,98 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+// Package ipam allocates VLAN IDs and IP prefixes from pools, given what's already in use.
+package ipam
+
+import (
+	"errors"
+	"math/big"
+	"net/netip"
+)
+
+// ErrPoolExhausted means the pool has nothing free left.
+var ErrPoolExhausted = errors.New("pool exhausted")
+
+// NextFreeVLAN finds the lowest VLAN ID in the range (inclusive) which is not used.
+func NextFreeVLAN(min int, max int, used map[int]bool) (int, error) {
+	if min < 1 || max > 4094 || min > max {
+		return 0, errors.New("invalid VLAN range")
+	}
+	for vlanID := min; vlanID <= max; vlanID++ {
+		if !used[vlanID] {
+			return vlanID, nil
+		}
+	}
+	return 0, ErrPoolExhausted
+}
+
+// NextFreePrefix finds the lowest prefix of the length within the pool which doesn't overlap any of the used prefixes.
+func NextFreePrefix(pool netip.Prefix, bits int, used []netip.Prefix) (netip.Prefix, error) {
+	pool = pool.Masked()
+	if !pool.IsValid() || bits < pool.Bits() || bits > pool.Addr().BitLen() {
+		return netip.Prefix{}, errors.New("invalid pool or prefix length")
+	}
+	step := new(big.Int).Lsh(big.NewInt(1), uint(pool.Addr().BitLen()-bits))
+	candidate := netip.PrefixFrom(pool.Addr(), bits)
+	for pool.Contains(candidate.Addr()) {
+		next := candidate
+		for _, usedPrefix := range used {
+			if !usedPrefix.Overlaps(candidate) {
+				continue
+			}
+			// Skip past the used prefix, it's aligned to at least the step if larger than the candidate
+			next = nextPrefix(candidate, step)
+			if usedPrefix.Bits() < bits {
+				size := new(big.Int).Lsh(big.NewInt(1), uint(usedPrefix.Addr().BitLen()-usedPrefix.Bits()))
+				next = nextPrefix(netip.PrefixFrom(usedPrefix.Masked().Addr(), bits), size)
+			}
+			break
+		}
+		if next == candidate {
+			return candidate, nil
+		}
+		if !next.IsValid() {
+			break
+		}
+		candidate = next
+	}
+	return netip.Prefix{}, ErrPoolExhausted
+}
+
+// FirstHost gets the first address after the network address, typically the gateway.
+func FirstHost(prefix netip.Prefix) netip.Addr {
+	return prefix.Masked().Addr().Next()
+}
+
+// nextPrefix gets the prefix with the same length starting the offset after the prefix, or an invalid prefix on overflow.
+func nextPrefix(prefix netip.Prefix, offset *big.Int) netip.Prefix {
+	addr := prefix.Addr()
+	value := new(big.Int).SetBytes(addr.AsSlice())
+	value.Add(value, offset)
+	raw := value.Bytes()
+	length := addr.BitLen() / 8
+	if len(raw) > length {
+		return netip.Prefix{}
+	}
+	padded := make([]byte, length)
+	copy(padded[length-len(raw):], raw)
+	nextAddr, _ := netip.AddrFromSlice(padded)
+	return netip.PrefixFrom(nextAddr, prefix.Bits())
+}
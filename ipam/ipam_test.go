@@ -0,0 +1,75 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package ipam
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/gathering/tech-online-backend/helper"
+)
+
+func TestNextFreeVLAN(t *testing.T) {
+	vlanID, err := NextFreeVLAN(100, 102, map[int]bool{100: true, 102: true})
+	helper.CheckEqual(t, err, nil)
+	helper.CheckEqual(t, vlanID, 101)
+
+	_, err = NextFreeVLAN(100, 101, map[int]bool{100: true, 101: true})
+	helper.CheckEqual(t, err, ErrPoolExhausted)
+
+	_, err = NextFreeVLAN(100, 5000, nil)
+	helper.CheckEqual(t, err != nil, true)
+}
+
+func TestNextFreePrefix(t *testing.T) {
+	pool := netip.MustParsePrefix("10.100.0.0/24")
+	prefix, err := NextFreePrefix(pool, 26, nil)
+	helper.CheckEqual(t, err, nil)
+	helper.CheckEqual(t, prefix.String(), "10.100.0.0/26")
+
+	// Skips smaller and larger used prefixes
+	used := []netip.Prefix{netip.MustParsePrefix("10.100.0.8/29"), netip.MustParsePrefix("10.100.0.128/25")}
+	prefix, err = NextFreePrefix(pool, 26, used)
+	helper.CheckEqual(t, err, nil)
+	helper.CheckEqual(t, prefix.String(), "10.100.0.64/26")
+
+	used = append(used, prefix)
+	prefix, err = NextFreePrefix(pool, 26, []netip.Prefix{netip.MustParsePrefix("10.100.0.0/25")})
+	helper.CheckEqual(t, err, nil)
+	helper.CheckEqual(t, prefix.String(), "10.100.0.128/26")
+	_, err = NextFreePrefix(pool, 26, used)
+	helper.CheckEqual(t, err, ErrPoolExhausted)
+
+	// IPv6, including the last prefix in the address space
+	prefix, err = NextFreePrefix(netip.MustParsePrefix("2001:db8:100::/48"), 64, []netip.Prefix{netip.MustParsePrefix("2001:db8:100::/64")})
+	helper.CheckEqual(t, err, nil)
+	helper.CheckEqual(t, prefix.String(), "2001:db8:100:1::/64")
+	_, err = NextFreePrefix(netip.MustParsePrefix("ffff:ffff:ffff:ffff::/64"), 64, []netip.Prefix{netip.MustParsePrefix("ffff:ffff:ffff:ffff::/64")})
+	helper.CheckEqual(t, err, ErrPoolExhausted)
+
+	_, err = NextFreePrefix(pool, 16, nil)
+	helper.CheckEqual(t, err != nil, true)
+}
+
+func TestFirstHost(t *testing.T) {
+	helper.CheckEqual(t, FirstHost(netip.MustParsePrefix("10.100.0.64/26")).String(), "10.100.0.65")
+	helper.CheckEqual(t, FirstHost(netip.MustParsePrefix("2001:db8:100:1::/64")).String(), "2001:db8:100:1::1")
+}
@@ -0,0 +1,226 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+// Package jobs runs outbound side effects like notifications, webhooks and provisioner calls in a bounded worker pool,
+// so they don't hold up requests. Failed jobs are retried, and logged as dead letters when giving up.
+package jobs
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/errorreport"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultWorkers      = 4
+	defaultQueueSize    = 1000
+	defaultAttempts     = 3
+	defaultRetryDelay   = 5 * time.Second
+	defaultDrainTimeout = 30 * time.Second
+)
+
+// Job is a side effect to run in the background.
+type Job struct {
+	Name       string                 // Kind of job for logging, e.g. "webhook"
+	Fields     map[string]interface{} // Extra log fields, e.g. the event ID
+	Attempts   int                    // Defaults to the config
+	RetryDelay time.Duration          // Defaults to the config
+	Run        func() error
+	GiveUp     func(err error) // Optional, called after the last failed attempt, e.g. to notify someone
+}
+
+// permanentError is an error which shouldn't be retried.
+type permanentError struct {
+	err error
+}
+
+func (err permanentError) Error() string {
+	return err.err.Error()
+}
+
+func (err permanentError) Unwrap() error {
+	return err.err
+}
+
+// Permanent marks the error as not worth retrying, e.g. for rejected requests.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err: err}
+}
+
+var queue chan *queuedJob
+var queueStart sync.Once
+var pending sync.WaitGroup
+var draining bool
+var drainingLock sync.RWMutex
+
+type queuedJob struct {
+	job     Job
+	attempt int
+}
+
+// Submit queues the job, starting the workers if not already started.
+// Returns false if the job was dropped because the queue is full or the pool is draining.
+func Submit(job Job) bool {
+	start()
+	drainingLock.RLock()
+	defer drainingLock.RUnlock()
+	if draining {
+		deadLetter(job, 0, errors.New("shutting down"))
+		return false
+	}
+	pending.Add(1)
+	if !enqueue(&queuedJob{job: job, attempt: 1}) {
+		pending.Done()
+		deadLetter(job, 0, errors.New("queue full"))
+		return false
+	}
+	return true
+}
+
+// Drain stops accepting new jobs and waits for the queued ones (including retries) to finish, for up to the configured timeout.
+// Returns false if it timed out.
+func Drain() bool {
+	drainingLock.Lock()
+	draining = true
+	drainingLock.Unlock()
+
+	timeout := defaultDrainTimeout
+	if config.Config.Jobs.DrainTimeoutSeconds > 0 {
+		timeout = time.Duration(config.Config.Jobs.DrainTimeoutSeconds) * time.Second
+	}
+	done := make(chan struct{})
+	go func() {
+		pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		log.WithField("timeout", timeout).Warn("Gave up waiting for background jobs")
+		return false
+	}
+}
+
+func start() {
+	queueStart.Do(func() {
+		jobsConfig := config.Config.Jobs
+		queueSize := jobsConfig.QueueSize
+		if queueSize <= 0 {
+			queueSize = defaultQueueSize
+		}
+		workers := jobsConfig.Workers
+		if workers <= 0 {
+			workers = defaultWorkers
+		}
+		queue = make(chan *queuedJob, queueSize)
+		for i := 0; i < workers; i++ {
+			go runWorker()
+		}
+	})
+}
+
+func enqueue(queued *queuedJob) bool {
+	select {
+	case queue <- queued:
+		return true
+	default:
+		return false
+	}
+}
+
+func runWorker() {
+	for queued := range queue {
+		run(queued)
+	}
+}
+
+// run runs the job and schedules a retry if it failed and has attempts left.
+func run(queued *queuedJob) {
+	err := runSafely(queued.job)
+	if err == nil {
+		pending.Done()
+		return
+	}
+
+	attempts := queued.job.Attempts
+	if attempts <= 0 {
+		attempts = config.Config.Jobs.Attempts
+	}
+	if attempts <= 0 {
+		attempts = defaultAttempts
+	}
+	var permanent permanentError
+	if queued.attempt >= attempts || errors.As(err, &permanent) {
+		deadLetter(queued.job, queued.attempt, err)
+		pending.Done()
+		return
+	}
+
+	logger(queued.job).WithError(err).WithField("attempt", queued.attempt).Debug("Background job failed, retrying")
+	queued.attempt++
+	time.AfterFunc(retryDelay(queued.job), func() {
+		if !enqueue(queued) {
+			deadLetter(queued.job, queued.attempt, errors.New("queue full"))
+			pending.Done()
+		}
+	})
+}
+
+// runSafely runs the job, turning panics into errors.
+func runSafely(job Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = Permanent(errors.New("job panicked"))
+			logger(job).WithField("panic", r).Error("Background job panicked")
+			errorreport.CapturePanic(r, map[string]string{"job": job.Name})
+		}
+	}()
+	return job.Run()
+}
+
+func retryDelay(job Job) time.Duration {
+	if job.RetryDelay > 0 {
+		return job.RetryDelay
+	}
+	if config.Config.Jobs.RetryDelaySeconds > 0 {
+		return time.Duration(config.Config.Jobs.RetryDelaySeconds) * time.Second
+	}
+	return defaultRetryDelay
+}
+
+// deadLetter logs a job which was given up on, with everything needed to redo it manually.
+func deadLetter(job Job, attempts int, err error) {
+	logger(job).WithError(err).WithField("attempts", attempts).Error("Dead letter: Gave up background job")
+	if job.GiveUp != nil {
+		job.GiveUp(err)
+	}
+}
+
+func logger(job Job) *log.Entry {
+	return log.WithFields(job.Fields).WithField("job", job.Name)
+}
@@ -0,0 +1,55 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package jobs
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gathering/tech-online-backend/helper"
+)
+
+func TestSubmitRetries(t *testing.T) {
+	var flakyRuns, permanentRuns, panickyRuns int32
+	helper.CheckEqual(t, Submit(Job{Name: "flaky", Attempts: 3, RetryDelay: time.Millisecond, Run: func() error {
+		if atomic.AddInt32(&flakyRuns, 1) < 2 {
+			return errors.New("try again")
+		}
+		return nil
+	}}), true)
+	Submit(Job{Name: "permanent", Attempts: 3, RetryDelay: time.Millisecond, Run: func() error {
+		atomic.AddInt32(&permanentRuns, 1)
+		return Permanent(errors.New("rejected"))
+	}})
+	Submit(Job{Name: "panicky", Attempts: 3, RetryDelay: time.Millisecond, Run: func() error {
+		atomic.AddInt32(&panickyRuns, 1)
+		panic("oops")
+	}})
+
+	helper.CheckEqual(t, Drain(), true)
+	helper.CheckEqual(t, atomic.LoadInt32(&flakyRuns), int32(2))
+	helper.CheckEqual(t, atomic.LoadInt32(&permanentRuns), int32(1))
+	helper.CheckEqual(t, atomic.LoadInt32(&panickyRuns), int32(1))
+
+	// Nothing new after draining
+	helper.CheckEqual(t, Submit(Job{Name: "late", Run: func() error { return nil }}), false)
+}
@@ -0,0 +1,187 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package ldap
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// BER tags used by LDAP (RFC 4511), as class and constructed bits and the tag number
+const (
+	tagBoolean     = 0x01
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagEnumerated  = 0x0A
+	tagSequence    = 0x30
+	tagSet         = 0x31
+
+	tagBindRequest       = 0x60 // [APPLICATION 0], constructed
+	tagBindResponse      = 0x61
+	tagUnbindRequest     = 0x42 // [APPLICATION 2], primitive
+	tagSearchRequest     = 0x63
+	tagSearchResultEntry = 0x64
+	tagSearchResultDone  = 0x65
+	tagExtendedRequest   = 0x77
+	tagExtendedResponse  = 0x78
+
+	tagSimpleAuth    = 0x80 // [0], primitive
+	tagEqualityMatch = 0xA3 // [3], constructed
+	tagRequestName   = 0x80 // [0], primitive
+)
+
+// maxMessageSize limits the size of received messages.
+const maxMessageSize = 1 << 20
+
+// berElement is a decoded BER element. Children are only parsed on demand.
+type berElement struct {
+	tag   byte
+	value []byte
+}
+
+// berEncode encodes an element with the definite length form.
+func berEncode(tag byte, value []byte) []byte {
+	encoded := []byte{tag}
+	switch length := len(value); {
+	case length < 0x80:
+		encoded = append(encoded, byte(length))
+	case length <= 0xFF:
+		encoded = append(encoded, 0x81, byte(length))
+	case length <= 0xFFFF:
+		encoded = append(encoded, 0x82, byte(length>>8), byte(length))
+	default:
+		encoded = append(encoded, 0x84, byte(length>>24), byte(length>>16), byte(length>>8), byte(length))
+	}
+	return append(encoded, value...)
+}
+
+// berConstructed encodes an element containing the encoded children.
+func berConstructed(tag byte, children ...[]byte) []byte {
+	var value []byte
+	for _, child := range children {
+		value = append(value, child...)
+	}
+	return berEncode(tag, value)
+}
+
+func berString(tag byte, value string) []byte {
+	return berEncode(tag, []byte(value))
+}
+
+// berInteger encodes a (non-negative) integer or enumerated value in the minimal number of octets.
+func berInteger(tag byte, value int) []byte {
+	encoded := []byte{byte(value)}
+	for value >>= 8; value > 0; value >>= 8 {
+		encoded = append([]byte{byte(value)}, encoded...)
+	}
+	if encoded[0]&0x80 != 0 {
+		encoded = append([]byte{0}, encoded...)
+	}
+	return berEncode(tag, encoded)
+}
+
+func berBoolean(value bool) []byte {
+	if value {
+		return berEncode(tagBoolean, []byte{0xFF})
+	}
+	return berEncode(tagBoolean, []byte{0})
+}
+
+// berDecode decodes the first element of the data and returns the rest.
+func berDecode(data []byte) (berElement, []byte, error) {
+	if len(data) < 2 {
+		return berElement{}, nil, fmt.Errorf("ldap: truncated element")
+	}
+	tag, length, offset := data[0], int(data[1]), 2
+	if length&0x80 != 0 {
+		octets := length & 0x7F
+		if octets == 0 || octets > 4 || len(data) < 2+octets {
+			return berElement{}, nil, fmt.Errorf("ldap: unsupported element length")
+		}
+		length = 0
+		for _, octet := range data[2 : 2+octets] {
+			length = length<<8 | int(octet)
+		}
+		offset += octets
+	}
+	if length < 0 || len(data)-offset < length {
+		return berElement{}, nil, fmt.Errorf("ldap: truncated element")
+	}
+	return berElement{tag: tag, value: data[offset : offset+length]}, data[offset+length:], nil
+}
+
+// children decodes the elements contained in a constructed element.
+func (element berElement) children() ([]berElement, error) {
+	var children []berElement
+	for data := element.value; len(data) > 0; {
+		child, rest, err := berDecode(data)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+		data = rest
+	}
+	return children, nil
+}
+
+// integer decodes an integer or enumerated value.
+func (element berElement) integer() (int, error) {
+	if len(element.value) == 0 || len(element.value) > 4 {
+		return 0, fmt.Errorf("ldap: unsupported integer length")
+	}
+	value := int(int8(element.value[0]))
+	for _, octet := range element.value[1:] {
+		value = value<<8 | int(octet)
+	}
+	return value, nil
+}
+
+// readBER reads a complete element from the stream.
+func readBER(reader *bufio.Reader) (berElement, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return berElement{}, err
+	}
+	length := int(header[1])
+	if length&0x80 != 0 {
+		octets := length & 0x7F
+		if octets == 0 || octets > 4 {
+			return berElement{}, fmt.Errorf("ldap: unsupported element length")
+		}
+		lengthOctets := make([]byte, octets)
+		if _, err := io.ReadFull(reader, lengthOctets); err != nil {
+			return berElement{}, err
+		}
+		length = 0
+		for _, octet := range lengthOctets {
+			length = length<<8 | int(octet)
+		}
+	}
+	if length < 0 || length > maxMessageSize {
+		return berElement{}, fmt.Errorf("ldap: message too large: %v", length)
+	}
+	value := make([]byte, length)
+	if _, err := io.ReadFull(reader, value); err != nil {
+		return berElement{}, err
+	}
+	return berElement{tag: header[0], value: value}, nil
+}
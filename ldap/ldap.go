@@ -0,0 +1,390 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+// Package ldap is a minimal LDAPv3 client (RFC 4511) for authenticating users with simple binds.
+package ldap
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+)
+
+const (
+	defaultUserAttribute = "uid"
+	timeout              = 10 * time.Second // For connecting and for the whole authentication
+	startTLSOID          = "1.3.6.1.4.1.1466.20037"
+	scopeWholeSubtree    = 2
+	derefNever           = 0
+	searchSizeLimit      = 2 // Enough to detect ambiguous usernames
+)
+
+// Result codes
+const (
+	resultSuccess            = 0
+	resultSizeLimitExceeded  = 4
+	resultInvalidCredentials = 49
+)
+
+// Attributes returned for users
+const (
+	AttributeDisplayName = "displayname"
+	AttributeCommonName  = "cn"
+	AttributeMail        = "mail"
+	AttributeMemberOf    = "memberof"
+)
+
+// ErrInvalidCredentials is returned for unknown users and wrong passwords.
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+// ResultError is an unsuccessful result from the server.
+type ResultError struct {
+	Code    int
+	Message string // Diagnostic message, may be empty
+}
+
+func (err *ResultError) Error() string {
+	return fmt.Sprintf("ldap: result code %v: %v", err.Code, err.Message)
+}
+
+// Entry is a directory entry.
+type Entry struct {
+	DN         string
+	Attributes map[string][]string // By lowercase attribute name
+}
+
+// Get returns the first value of the attribute, or empty if missing.
+func (entry *Entry) Get(attribute string) string {
+	values := entry.Attributes[strings.ToLower(attribute)]
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// conn is a connection with buffered reading.
+type conn struct {
+	netConn   net.Conn
+	reader    *bufio.Reader
+	messageID int
+}
+
+func init() {
+	config.AddValidator(validateConfig)
+}
+
+// Enabled checks if LDAP logins are configured.
+func Enabled() bool {
+	return config.Config.LDAP.URL != ""
+}
+
+// Authenticate searches for the user with the username (using the service account, if configured) and checks the password by binding as the user.
+// The user entry is returned with the display name, common name, mail and group membership attributes.
+func Authenticate(username string, password string) (*Entry, error) {
+	ldapConfig := config.Config.LDAP
+	// Empty passwords make unauthenticated binds, which succeed
+	if username == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+	userAttribute := ldapConfig.UserAttribute
+	if userAttribute == "" {
+		userAttribute = defaultUserAttribute
+	}
+
+	c, err := dial(ldapConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer c.close()
+	if ldapConfig.BindDN != "" {
+		if err := c.bind(ldapConfig.BindDN, ldapConfig.BindPassword); err != nil {
+			return nil, fmt.Errorf("ldap: service account bind failed: %w", err)
+		}
+	}
+	entries, err := c.search(ldapConfig.BaseDN, userAttribute, username,
+		[]string{AttributeDisplayName, AttributeCommonName, AttributeMail, AttributeMemberOf})
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case len(entries) == 0:
+		return nil, ErrInvalidCredentials
+	case len(entries) > 1:
+		return nil, fmt.Errorf("ldap: multiple entries match the username %q", username)
+	}
+	if err := c.bind(entries[0].DN, password); err != nil {
+		var resultErr *ResultError
+		if errors.As(err, &resultErr) && resultErr.Code == resultInvalidCredentials {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, err
+	}
+	return entries[0], nil
+}
+
+// dial connects, using TLS for "ldaps://" URLs or StartTLS if enabled.
+func dial(ldapConfig config.LDAPConfig) (*conn, error) {
+	ldapURL, err := url.Parse(ldapConfig.URL)
+	if err != nil {
+		return nil, err
+	}
+	host, port := ldapURL.Hostname(), ldapURL.Port()
+	tlsConfig := &tls.Config{ServerName: host}
+	var netConn net.Conn
+	switch ldapURL.Scheme {
+	case "ldap":
+		if port == "" {
+			port = "389"
+		}
+		netConn, err = net.DialTimeout("tcp", net.JoinHostPort(host, port), timeout)
+	case "ldaps":
+		if port == "" {
+			port = "636"
+		}
+		netConn, err = tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", net.JoinHostPort(host, port), tlsConfig)
+	default:
+		return nil, fmt.Errorf("ldap: unsupported URL scheme: %v", ldapURL.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	netConn.SetDeadline(time.Now().Add(timeout))
+	c := &conn{netConn: netConn, reader: bufio.NewReader(netConn)}
+
+	if ldapConfig.StartTLS && ldapURL.Scheme == "ldap" {
+		if err := c.startTLS(tlsConfig); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// startTLS upgrades the connection to TLS.
+func (c *conn) startTLS(tlsConfig *tls.Config) error {
+	op, err := c.request(berConstructed(tagExtendedRequest, berString(tagRequestName, startTLSOID)), tagExtendedResponse)
+	if err != nil {
+		return err
+	}
+	if err := parseResult(op); err != nil {
+		return fmt.Errorf("ldap: StartTLS failed: %w", err)
+	}
+	tlsConn := tls.Client(c.netConn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	c.netConn = tlsConn
+	c.reader = bufio.NewReader(tlsConn)
+	return nil
+}
+
+// bind makes a simple bind.
+func (c *conn) bind(dn string, password string) error {
+	op, err := c.request(berConstructed(tagBindRequest,
+		berInteger(tagInteger, 3),
+		berString(tagOctetString, dn),
+		berString(tagSimpleAuth, password),
+	), tagBindResponse)
+	if err != nil {
+		return err
+	}
+	return parseResult(op)
+}
+
+// search finds the entries below the base DN where the attribute equals the value.
+func (c *conn) search(baseDN string, attribute string, value string, attributes []string) ([]*Entry, error) {
+	var attributeList [][]byte
+	for _, attribute := range attributes {
+		attributeList = append(attributeList, berString(tagOctetString, attribute))
+	}
+	if err := c.send(berConstructed(tagSearchRequest,
+		berString(tagOctetString, baseDN),
+		berInteger(tagEnumerated, scopeWholeSubtree),
+		berInteger(tagEnumerated, derefNever),
+		berInteger(tagInteger, searchSizeLimit),
+		berInteger(tagInteger, int(timeout.Seconds())),
+		berBoolean(false),
+		berConstructed(tagEqualityMatch, berString(tagOctetString, attribute), berString(tagOctetString, value)),
+		berConstructed(tagSequence, attributeList...),
+	)); err != nil {
+		return nil, err
+	}
+
+	var entries []*Entry
+	for {
+		op, err := c.receive()
+		if err != nil {
+			return nil, err
+		}
+		switch op.tag {
+		case tagSearchResultEntry:
+			entry, err := parseEntry(op)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		case tagSearchResultDone:
+			err := parseResult(op)
+			var resultErr *ResultError
+			if err != nil && !(errors.As(err, &resultErr) && resultErr.Code == resultSizeLimitExceeded) {
+				return nil, err
+			}
+			return entries, nil
+		}
+		// Ignore references
+	}
+}
+
+// close unbinds and closes the connection.
+func (c *conn) close() {
+	c.send(berEncode(tagUnbindRequest, nil))
+	c.netConn.Close()
+}
+
+// request sends the operation and receives the response, which must have the tag.
+func (c *conn) request(op []byte, responseTag byte) (berElement, error) {
+	if err := c.send(op); err != nil {
+		return berElement{}, err
+	}
+	response, err := c.receive()
+	if err != nil {
+		return berElement{}, err
+	}
+	if response.tag != responseTag {
+		return berElement{}, fmt.Errorf("ldap: unexpected response tag 0x%02x", response.tag)
+	}
+	return response, nil
+}
+
+// send sends the operation as a new message.
+func (c *conn) send(op []byte) error {
+	c.messageID++
+	_, err := c.netConn.Write(berConstructed(tagSequence, berInteger(tagInteger, c.messageID), op))
+	return err
+}
+
+// receive receives the operation of the next message for the last request.
+func (c *conn) receive() (berElement, error) {
+	for {
+		message, err := readBER(c.reader)
+		if err != nil {
+			return berElement{}, err
+		}
+		children, err := message.children()
+		if err != nil {
+			return berElement{}, err
+		}
+		if message.tag != tagSequence || len(children) < 2 || children[0].tag != tagInteger {
+			return berElement{}, fmt.Errorf("ldap: malformed message")
+		}
+		messageID, err := children[0].integer()
+		if err != nil {
+			return berElement{}, err
+		}
+		if messageID == 0 {
+			// Unsolicited notification, only notices of disconnection are defined
+			if err := parseResult(children[1]); err != nil {
+				return berElement{}, fmt.Errorf("ldap: disconnected by the server: %w", err)
+			}
+			return berElement{}, fmt.Errorf("ldap: disconnected by the server")
+		}
+		if messageID == c.messageID {
+			return children[1], nil
+		}
+	}
+}
+
+// parseResult returns the result of the response as an error, if unsuccessful.
+func parseResult(op berElement) error {
+	children, err := op.children()
+	if err != nil {
+		return err
+	}
+	if len(children) < 3 || children[0].tag != tagEnumerated {
+		return fmt.Errorf("ldap: malformed result")
+	}
+	code, err := children[0].integer()
+	if err != nil {
+		return err
+	}
+	if code != resultSuccess {
+		return &ResultError{Code: code, Message: string(children[2].value)}
+	}
+	return nil
+}
+
+// parseEntry parses a search result entry.
+func parseEntry(op berElement) (*Entry, error) {
+	children, err := op.children()
+	if err != nil {
+		return nil, err
+	}
+	if len(children) < 2 {
+		return nil, fmt.Errorf("ldap: malformed entry")
+	}
+	entry := &Entry{DN: string(children[0].value), Attributes: make(map[string][]string)}
+	attributes, err := children[1].children()
+	if err != nil {
+		return nil, err
+	}
+	for _, attribute := range attributes {
+		parts, err := attribute.children()
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("ldap: malformed attribute")
+		}
+		values, err := parts[1].children()
+		if err != nil {
+			return nil, err
+		}
+		name := strings.ToLower(string(parts[0].value))
+		for _, value := range values {
+			entry.Attributes[name] = append(entry.Attributes[name], string(value.value))
+		}
+	}
+	return entry, nil
+}
+
+func validateConfig(candidate *config.MainConfig) error {
+	ldapConfig := candidate.LDAP
+	if ldapConfig.URL == "" {
+		return nil
+	}
+	ldapURL, err := url.Parse(ldapConfig.URL)
+	if err != nil || (ldapURL.Scheme != "ldap" && ldapURL.Scheme != "ldaps") || ldapURL.Hostname() == "" {
+		return fmt.Errorf("ldap: invalid URL: %v", ldapConfig.URL)
+	}
+	if ldapConfig.StartTLS && ldapURL.Scheme != "ldap" {
+		return fmt.Errorf("ldap: start_tls requires an ldap:// URL")
+	}
+	if ldapConfig.BaseDN == "" {
+		return fmt.Errorf("ldap: missing base_dn")
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package ldap
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/gathering/tech-online-backend/config"
+)
+
+func TestBERInteger(t *testing.T) {
+	for _, value := range []int{0, 1, 127, 128, 255, 256, 65535, 1 << 24} {
+		element, rest, err := berDecode(berInteger(tagInteger, value))
+		if err != nil || len(rest) != 0 {
+			t.Fatalf("%v: decode failed: %v", value, err)
+		}
+		decoded, err := element.integer()
+		if err != nil || decoded != value {
+			t.Errorf("%v: decoded as %v, %v", value, decoded, err)
+		}
+	}
+}
+
+func TestBERLongLength(t *testing.T) {
+	value := make([]byte, 300)
+	encoded := berEncode(tagOctetString, value)
+	if encoded[1] != 0x82 {
+		t.Errorf("length not in the long form: 0x%02x", encoded[1])
+	}
+	element, _, err := berDecode(encoded)
+	if err != nil || len(element.value) != 300 {
+		t.Errorf("decoded %v octets, %v", len(element.value), err)
+	}
+	if _, _, err := berDecode(encoded[:100]); err == nil {
+		t.Errorf("truncated element decoded")
+	}
+}
+
+// serveFake serves a directory with a service account and the users "alice" and "dup" (two entries).
+func serveFake(listener net.Listener) {
+	passwords := map[string]string{
+		"cn=svc,dc=example":              "svcpass",
+		"uid=alice,ou=people,dc=example": "hunter2",
+	}
+	for {
+		netConn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer netConn.Close()
+			reader := bufio.NewReader(netConn)
+			for {
+				message, err := readBER(reader)
+				if err != nil {
+					return
+				}
+				children, _ := message.children()
+				id, _ := children[0].integer()
+				respond := func(op []byte) {
+					netConn.Write(berConstructed(tagSequence, berInteger(tagInteger, id), op))
+				}
+				result := func(tag byte, code int) []byte {
+					return berConstructed(tag, berInteger(tagEnumerated, code), berString(tagOctetString, ""), berString(tagOctetString, "fake"))
+				}
+				switch op := children[1]; op.tag {
+				case tagBindRequest:
+					args, _ := op.children()
+					if password, ok := passwords[string(args[1].value)]; ok && password == string(args[2].value) {
+						respond(result(tagBindResponse, resultSuccess))
+					} else {
+						respond(result(tagBindResponse, resultInvalidCredentials))
+					}
+				case tagSearchRequest:
+					args, _ := op.children()
+					filter, _ := args[6].children()
+					entry := func(dn string) []byte {
+						return berConstructed(tagSearchResultEntry, berString(tagOctetString, dn), berConstructed(tagSequence,
+							berConstructed(tagSequence, berString(tagOctetString, "displayName"), berConstructed(tagSet, berString(tagOctetString, "Alice"))),
+							berConstructed(tagSequence, berString(tagOctetString, "memberOf"), berConstructed(tagSet,
+								berString(tagOctetString, "cn=crew,dc=example"), berString(tagOctetString, "cn=noc,dc=example"))),
+						))
+					}
+					if string(filter[0].value) == "uid" && string(filter[1].value) == "alice" {
+						respond(entry("uid=alice,ou=people,dc=example"))
+					}
+					if string(filter[1].value) == "dup" {
+						respond(entry("uid=dup,ou=people,dc=example"))
+						respond(entry("uid=dup,ou=other,dc=example"))
+					}
+					respond(result(tagSearchResultDone, resultSuccess))
+				case tagUnbindRequest:
+					return
+				}
+			}
+		}()
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go serveFake(listener)
+	defer func() { config.Config.LDAP = config.LDAPConfig{} }()
+	config.Config.LDAP = config.LDAPConfig{
+		URL:          "ldap://" + listener.Addr().String(),
+		BindDN:       "cn=svc,dc=example",
+		BindPassword: "svcpass",
+		BaseDN:       "dc=example",
+	}
+
+	entry, err := Authenticate("alice", "hunter2")
+	if err != nil {
+		t.Fatalf("valid credentials: %v", err)
+	}
+	if entry.DN != "uid=alice,ou=people,dc=example" || entry.Get("displayName") != "Alice" {
+		t.Errorf("unexpected entry: %+v", entry)
+	}
+	if groups := entry.Attributes[AttributeMemberOf]; !reflect.DeepEqual(groups, []string{"cn=crew,dc=example", "cn=noc,dc=example"}) {
+		t.Errorf("unexpected groups: %v", groups)
+	}
+
+	for _, credentials := range [][2]string{{"alice", "wrong"}, {"alice", ""}, {"bob", "hunter2"}} {
+		if _, err := Authenticate(credentials[0], credentials[1]); err != ErrInvalidCredentials {
+			t.Errorf("%v/%q: got %v, expected invalid credentials", credentials[0], credentials[1], err)
+		}
+	}
+	if _, err := Authenticate("dup", "hunter2"); err == nil || err == ErrInvalidCredentials {
+		t.Errorf("ambiguous username: got %v", err)
+	}
+
+	// A wrong service account password is a config error, not the user's
+	config.Config.LDAP.BindPassword = "wrong"
+	var resultErr *ResultError
+	if _, err := Authenticate("alice", "hunter2"); !errors.As(err, &resultErr) || resultErr.Code != resultInvalidCredentials {
+		t.Errorf("wrong service account password: got %v", err)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	check := func(ldapConfig config.LDAPConfig) error {
+		return validateConfig(&config.MainConfig{LDAP: ldapConfig})
+	}
+	if err := check(config.LDAPConfig{}); err != nil {
+		t.Errorf("disabled: %v", err)
+	}
+	if err := check(config.LDAPConfig{URL: "ldaps://ad.example", BaseDN: "dc=example"}); err != nil {
+		t.Errorf("valid: %v", err)
+	}
+	if err := check(config.LDAPConfig{URL: "http://ad.example", BaseDN: "dc=example"}); err == nil {
+		t.Errorf("invalid scheme accepted")
+	}
+	if err := check(config.LDAPConfig{URL: "ldaps://ad.example", BaseDN: "dc=example", StartTLS: true}); err == nil {
+		t.Errorf("StartTLS with ldaps accepted")
+	}
+	if err := check(config.LDAPConfig{URL: "ldap://ad.example"}); err == nil {
+		t.Errorf("missing base DN accepted")
+	}
+}
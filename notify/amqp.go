@@ -0,0 +1,368 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package notify
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/event"
+)
+
+// AMQP 0-9-1 frame types
+const (
+	amqpFrameMethod    = 1
+	amqpFrameHeader    = 2
+	amqpFrameBody      = 3
+	amqpFrameHeartbeat = 8
+	amqpFrameEnd       = 0xCE
+)
+
+// AMQP 0-9-1 methods used, as class ID << 16 | method ID
+const (
+	amqpConnectionStart    = 10<<16 | 10
+	amqpConnectionStartOk  = 10<<16 | 11
+	amqpConnectionTune     = 10<<16 | 30
+	amqpConnectionTuneOk   = 10<<16 | 31
+	amqpConnectionOpen     = 10<<16 | 40
+	amqpConnectionOpenOk   = 10<<16 | 41
+	amqpConnectionClose    = 10<<16 | 50
+	amqpConnectionCloseOk  = 10<<16 | 51
+	amqpChannelOpen        = 20<<16 | 10
+	amqpChannelOpenOk      = 20<<16 | 11
+	amqpChannelClose       = 20<<16 | 40
+	amqpBasicPublish       = 60<<16 | 40
+	amqpBasicAck           = 60<<16 | 80
+	amqpBasicNack          = 60<<16 | 120
+	amqpConfirmSelect      = 85<<16 | 10
+	amqpConfirmSelectOk    = 85<<16 | 11
+	amqpBasicClass         = 60
+	amqpDefaultFrameMax    = 131072
+	amqpMinFrameMax        = 4096
+	amqpPublishChannel     = 1
+	amqpDeliveryPersistent = 2
+)
+
+var amqpProtocolHeader = []byte{'A', 'M', 'Q', 'P', 0, 0, 9, 1}
+
+// amqpPublisher publishes to an AMQP 0-9-1 broker (e.g. RabbitMQ) on a single channel with publisher confirms.
+type amqpPublisher struct {
+	conn        net.Conn
+	reader      *bufio.Reader
+	exchange    string
+	frameMax    int
+	deliveryTag uint64
+}
+
+// amqpFrame is a received frame.
+type amqpFrame struct {
+	frameType byte
+	channel   uint16
+	payload   []byte
+}
+
+// method returns the class and method IDs of a method frame, and the arguments.
+func (frame amqpFrame) method() (int, []byte) {
+	if frame.frameType != amqpFrameMethod || len(frame.payload) < 4 {
+		return 0, nil
+	}
+	return int(binary.BigEndian.Uint16(frame.payload))<<16 | int(binary.BigEndian.Uint16(frame.payload[2:])), frame.payload[4:]
+}
+
+func connectAMQP(busConfig config.EventBusConfig) (busPublisher, error) {
+	conn, err := net.DialTimeout("tcp", busConfig.Address, eventBusTimeout)
+	if err != nil {
+		return nil, err
+	}
+	publisher := &amqpPublisher{conn: conn, reader: bufio.NewReader(conn), exchange: busConfig.Exchange, frameMax: amqpDefaultFrameMax}
+	if publisher.exchange == "" {
+		publisher.exchange = "amq.topic"
+	}
+	if err := publisher.handshake(busConfig); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return publisher, nil
+}
+
+// handshake opens the connection and the channel, and enables publisher confirms.
+func (publisher *amqpPublisher) handshake(busConfig config.EventBusConfig) error {
+	publisher.conn.SetDeadline(time.Now().Add(eventBusTimeout))
+	username, password, vhost := busConfig.Username, busConfig.Password, busConfig.VHost
+	if username == "" && password == "" {
+		username, password = "guest", "guest"
+	}
+	if vhost == "" {
+		vhost = "/"
+	}
+
+	if _, err := publisher.conn.Write(amqpProtocolHeader); err != nil {
+		return err
+	}
+	if _, err := publisher.expectMethod(0, amqpConnectionStart); err != nil {
+		return err
+	}
+	var startOk amqpWriter
+	startOk.table() // Client properties
+	startOk.shortString("PLAIN")
+	startOk.longString("\x00" + username + "\x00" + password)
+	startOk.shortString("en_US")
+	if err := publisher.writeMethod(0, amqpConnectionStartOk, startOk.data); err != nil {
+		return err
+	}
+
+	// Authentication failures close the connection, which shows up here
+	tune, err := publisher.expectMethod(0, amqpConnectionTune)
+	if err != nil {
+		return err
+	}
+	if len(tune) < 8 {
+		return fmt.Errorf("amqp: malformed tune")
+	}
+	channelMax := binary.BigEndian.Uint16(tune)
+	if frameMax := int(binary.BigEndian.Uint32(tune[2:])); frameMax >= amqpMinFrameMax && frameMax < publisher.frameMax {
+		publisher.frameMax = frameMax
+	}
+	var tuneOk amqpWriter
+	tuneOk.uint16(channelMax)
+	tuneOk.uint32(uint32(publisher.frameMax))
+	tuneOk.uint16(0) // No heartbeats, the connection is only used while publishing
+	if err := publisher.writeMethod(0, amqpConnectionTuneOk, tuneOk.data); err != nil {
+		return err
+	}
+
+	var open amqpWriter
+	open.shortString(vhost)
+	open.shortString("")
+	open.uint8(0)
+	if err := publisher.writeMethod(0, amqpConnectionOpen, open.data); err != nil {
+		return err
+	}
+	if _, err := publisher.expectMethod(0, amqpConnectionOpenOk); err != nil {
+		return err
+	}
+
+	var channelOpen amqpWriter
+	channelOpen.shortString("")
+	if err := publisher.writeMethod(amqpPublishChannel, amqpChannelOpen, channelOpen.data); err != nil {
+		return err
+	}
+	if _, err := publisher.expectMethod(amqpPublishChannel, amqpChannelOpenOk); err != nil {
+		return err
+	}
+	var confirmSelect amqpWriter
+	confirmSelect.uint8(0) // Wait for the reply
+	if err := publisher.writeMethod(amqpPublishChannel, amqpConfirmSelect, confirmSelect.data); err != nil {
+		return err
+	}
+	_, err = publisher.expectMethod(amqpPublishChannel, amqpConfirmSelectOk)
+	return err
+}
+
+// publish publishes the message as persistent JSON and waits for the broker to confirm it.
+func (publisher *amqpPublisher) publish(subject string, body []byte, ev event.Event) error {
+	publisher.conn.SetDeadline(time.Now().Add(eventBusTimeout))
+
+	var publish amqpWriter
+	publish.uint16(0)
+	publish.shortString(publisher.exchange)
+	publish.shortString(subject)
+	publish.uint8(0) // Not mandatory or immediate
+	if err := publisher.writeMethod(amqpPublishChannel, amqpBasicPublish, publish.data); err != nil {
+		return err
+	}
+
+	var header amqpWriter
+	header.uint16(amqpBasicClass)
+	header.uint16(0)
+	header.uint64(uint64(len(body)))
+	// Content type, delivery mode, message ID, timestamp and type, in this order
+	header.uint16(1<<15 | 1<<12 | 1<<7 | 1<<6 | 1<<5)
+	header.shortString("application/json")
+	header.uint8(amqpDeliveryPersistent)
+	header.shortString(ev.ID.String())
+	header.uint64(uint64(ev.Time.Unix()))
+	header.shortString(string(ev.Type))
+	if err := publisher.writeFrame(amqpFrameHeader, amqpPublishChannel, header.data); err != nil {
+		return err
+	}
+	maxBody := publisher.frameMax - 8
+	for offset := 0; offset < len(body); offset += maxBody {
+		end := offset + maxBody
+		if end > len(body) {
+			end = len(body)
+		}
+		if err := publisher.writeFrame(amqpFrameBody, amqpPublishChannel, body[offset:end]); err != nil {
+			return err
+		}
+	}
+	publisher.deliveryTag++
+
+	// Wait for the confirm
+	for {
+		frame, err := publisher.readFrame()
+		if err != nil {
+			return err
+		}
+		method, args := frame.method()
+		switch method {
+		case amqpBasicAck, amqpBasicNack:
+			if len(args) < 8 || binary.BigEndian.Uint64(args) < publisher.deliveryTag {
+				continue
+			}
+			if method == amqpBasicNack {
+				return fmt.Errorf("amqp: message rejected by the broker")
+			}
+			return nil
+		case amqpChannelClose, amqpConnectionClose:
+			return amqpCloseError(args)
+		}
+	}
+}
+
+func (publisher *amqpPublisher) close() {
+	publisher.conn.SetDeadline(time.Now().Add(eventBusTimeout))
+	var closeArgs amqpWriter
+	closeArgs.uint16(200)
+	closeArgs.shortString("bye")
+	closeArgs.uint16(0)
+	closeArgs.uint16(0)
+	if publisher.writeMethod(0, amqpConnectionClose, closeArgs.data) == nil {
+		publisher.expectMethod(0, amqpConnectionCloseOk)
+	}
+	publisher.conn.Close()
+}
+
+// expectMethod reads frames until a method frame, which must be the expected method on the channel.
+func (publisher *amqpPublisher) expectMethod(channel uint16, expected int) ([]byte, error) {
+	for {
+		frame, err := publisher.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		if frame.frameType != amqpFrameMethod {
+			continue
+		}
+		method, args := frame.method()
+		switch {
+		case method == amqpConnectionClose || method == amqpChannelClose:
+			return nil, amqpCloseError(args)
+		case method != expected || frame.channel != channel:
+			return nil, fmt.Errorf("amqp: expected method %v.%v, got %v.%v", expected>>16, expected&0xFFFF, method>>16, method&0xFFFF)
+		}
+		return args, nil
+	}
+}
+
+func (publisher *amqpPublisher) readFrame() (amqpFrame, error) {
+	var header [7]byte
+	if _, err := io.ReadFull(publisher.reader, header[:]); err != nil {
+		return amqpFrame{}, err
+	}
+	if string(header[:4]) == "AMQP" {
+		// The broker doesn't support our version
+		return amqpFrame{}, fmt.Errorf("amqp: unsupported protocol version")
+	}
+	size := binary.BigEndian.Uint32(header[3:])
+	if size > uint32(publisher.frameMax) {
+		return amqpFrame{}, fmt.Errorf("amqp: frame too large: %v", size)
+	}
+	payload := make([]byte, size+1)
+	if _, err := io.ReadFull(publisher.reader, payload); err != nil {
+		return amqpFrame{}, err
+	}
+	if payload[size] != amqpFrameEnd {
+		return amqpFrame{}, fmt.Errorf("amqp: malformed frame")
+	}
+	return amqpFrame{frameType: header[0], channel: binary.BigEndian.Uint16(header[1:]), payload: payload[:size]}, nil
+}
+
+func (publisher *amqpPublisher) writeMethod(channel uint16, method int, args []byte) error {
+	var payload amqpWriter
+	payload.uint16(uint16(method >> 16))
+	payload.uint16(uint16(method & 0xFFFF))
+	payload.data = append(payload.data, args...)
+	return publisher.writeFrame(amqpFrameMethod, channel, payload.data)
+}
+
+func (publisher *amqpPublisher) writeFrame(frameType byte, channel uint16, payload []byte) error {
+	var frame amqpWriter
+	frame.uint8(frameType)
+	frame.uint16(channel)
+	frame.uint32(uint32(len(payload)))
+	frame.data = append(frame.data, payload...)
+	frame.uint8(amqpFrameEnd)
+	_, err := publisher.conn.Write(frame.data)
+	return err
+}
+
+// amqpCloseError makes an error from the arguments of a connection or channel close, with the reply code and text.
+func amqpCloseError(args []byte) error {
+	if len(args) < 3 || len(args) < 3+int(args[2]) {
+		return fmt.Errorf("amqp: closed by the broker")
+	}
+	return fmt.Errorf("amqp: closed by the broker: %v %s", binary.BigEndian.Uint16(args), args[3:3+int(args[2])])
+}
+
+// amqpWriter encodes AMQP data types.
+type amqpWriter struct {
+	data []byte
+}
+
+func (writer *amqpWriter) uint8(value uint8) {
+	writer.data = append(writer.data, value)
+}
+
+func (writer *amqpWriter) uint16(value uint16) {
+	writer.data = append(writer.data, byte(value>>8), byte(value))
+}
+
+func (writer *amqpWriter) uint32(value uint32) {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], value)
+	writer.data = append(writer.data, buf[:]...)
+}
+
+func (writer *amqpWriter) uint64(value uint64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], value)
+	writer.data = append(writer.data, buf[:]...)
+}
+
+func (writer *amqpWriter) shortString(value string) {
+	writer.uint8(uint8(len(value)))
+	writer.data = append(writer.data, value...)
+}
+
+func (writer *amqpWriter) longString(value string) {
+	writer.uint32(uint32(len(value)))
+	writer.data = append(writer.data, value...)
+}
+
+// table writes an empty field table.
+func (writer *amqpWriter) table() {
+	writer.uint32(0)
+}
@@ -0,0 +1,138 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/event"
+	"github.com/gathering/tech-online-backend/jobs"
+	log "github.com/sirupsen/logrus"
+)
+
+// Event bus drivers
+const (
+	EventBusDriverNATS = "nats"
+	EventBusDriverAMQP = "amqp"
+)
+
+const (
+	defaultEventBusPrefix = "techo.events"
+	eventBusAttempts      = 3
+	eventBusRetryDelay    = 5 * time.Second
+	eventBusTimeout       = 10 * time.Second
+)
+
+// busPublisher is a connection to a message broker.
+type busPublisher interface {
+	// publish publishes the message and waits for the broker to accept it.
+	publish(subject string, body []byte, ev event.Event) error
+	close()
+}
+
+// The publisher is shared and reconnected after errors
+var eventBusPublisher busPublisher
+var eventBusLock sync.Mutex
+
+func init() {
+	event.Subscribe("event-bus", publishToEventBus)
+	config.AddValidator(validateEventBusConfig)
+}
+
+// publishToEventBus queues the event for publishing, if it matches the filter.
+func publishToEventBus(ev event.Event) {
+	busConfig := config.Config.EventBus
+	if busConfig.Driver == "" || !eventMatchesFilter(ev, busConfig.EventTypes, busConfig.Tracks) {
+		return
+	}
+	jobs.Submit(jobs.Job{
+		Name:       "event-bus",
+		Fields:     log.Fields{"driver": busConfig.Driver, "event": ev.ID},
+		Attempts:   eventBusAttempts,
+		RetryDelay: eventBusRetryDelay,
+		Run: func() error {
+			return publishEvent(busConfig, ev)
+		},
+	})
+}
+
+// publishEvent publishes the event as JSON with the subject (NATS) or routing key (AMQP) "<prefix>.<event type>".
+func publishEvent(busConfig config.EventBusConfig, ev event.Event) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return jobs.Permanent(err)
+	}
+	prefix := busConfig.Prefix
+	if prefix == "" {
+		prefix = defaultEventBusPrefix
+	}
+	subject := prefix + "." + string(ev.Type)
+
+	eventBusLock.Lock()
+	defer eventBusLock.Unlock()
+	if eventBusPublisher == nil {
+		publisher, err := connectEventBus(busConfig)
+		if err != nil {
+			return err
+		}
+		eventBusPublisher = publisher
+	}
+	if err := eventBusPublisher.publish(subject, body, ev); err != nil {
+		// Reconnect on the next attempt
+		eventBusPublisher.close()
+		eventBusPublisher = nil
+		return err
+	}
+	return nil
+}
+
+func connectEventBus(busConfig config.EventBusConfig) (busPublisher, error) {
+	switch busConfig.Driver {
+	case EventBusDriverNATS:
+		return connectNATS(busConfig)
+	case EventBusDriverAMQP:
+		return connectAMQP(busConfig)
+	}
+	return nil, jobs.Permanent(fmt.Errorf("unknown event bus driver: %v", busConfig.Driver))
+}
+
+func validateEventBusConfig(candidate *config.MainConfig) error {
+	busConfig := candidate.EventBus
+	switch busConfig.Driver {
+	case "":
+		return nil
+	case EventBusDriverNATS, EventBusDriverAMQP:
+	default:
+		return fmt.Errorf("event bus: unknown driver: %v", busConfig.Driver)
+	}
+	if busConfig.Address == "" {
+		return fmt.Errorf("event bus: missing address")
+	}
+	if strings.ContainsAny(busConfig.Prefix, " \t\r\n*>") {
+		return fmt.Errorf("event bus: invalid prefix: %v", busConfig.Prefix)
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package notify
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/event"
+	"github.com/gathering/tech-online-backend/helper"
+	"github.com/google/uuid"
+)
+
+// fakeBroker accepts a single connection and runs the handler on it, returning the handler error when done.
+func fakeBroker(t *testing.T, handler func(conn net.Conn) error) (string, <-chan error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		done <- handler(conn)
+	}()
+	return listener.Addr().String(), done
+}
+
+func TestPublishEventNATS(t *testing.T) {
+	var gotConnect, gotPub, gotBody string
+	address, done := fakeBroker(t, func(conn net.Conn) error {
+		reader := bufio.NewReader(conn)
+		fmt.Fprintf(conn, "INFO {\"server_id\":\"test\"}\r\n")
+		gotConnect, _ = reader.ReadString('\n')
+		if line, _ := reader.ReadString('\n'); line != "PING\r\n" {
+			return fmt.Errorf("expected PING, got %q", line)
+		}
+		fmt.Fprintf(conn, "+OK\r\nPONG\r\n")
+		gotPub, _ = reader.ReadString('\n')
+		var size int
+		fmt.Sscanf(gotPub[strings.LastIndex(gotPub, " ")+1:], "%d", &size)
+		body := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, body); err != nil {
+			return err
+		}
+		gotBody = string(body[:size])
+		if line, _ := reader.ReadString('\n'); line != "PING\r\n" {
+			return fmt.Errorf("expected PING, got %q", line)
+		}
+		fmt.Fprintf(conn, "PONG\r\n")
+		return nil
+	})
+	defer closeEventBus()
+
+	ev := event.Event{ID: uuid.New(), Type: "timeslot.booked", TrackID: "net"}
+	err := publishEvent(config.EventBusConfig{Driver: EventBusDriverNATS, Address: address, Username: "techo", Password: "hunter2"}, ev)
+	helper.CheckEqual(t, err, nil)
+	helper.CheckEqual(t, <-done, nil)
+	helper.CheckEqual(t, strings.HasPrefix(gotConnect, "CONNECT {"), true)
+	helper.CheckEqual(t, strings.Contains(gotConnect, `"pass":"hunter2"`), true)
+	helper.CheckEqual(t, strings.HasPrefix(gotPub, "PUB techo.events.timeslot.booked "), true)
+	helper.CheckEqual(t, strings.Contains(gotBody, ev.ID.String()), true)
+}
+
+func TestPublishEventNATSError(t *testing.T) {
+	address, done := fakeBroker(t, func(conn net.Conn) error {
+		fmt.Fprintf(conn, "INFO {}\r\n-ERR 'Authorization Violation'\r\n")
+		return nil
+	})
+	defer closeEventBus()
+
+	err := publishEvent(config.EventBusConfig{Driver: EventBusDriverNATS, Address: address}, event.Event{Type: "test.passed"})
+	helper.CheckEqual(t, fmt.Sprint(err), "nats: Authorization Violation")
+	helper.CheckEqual(t, <-done, nil)
+}
+
+func TestPublishEventAMQP(t *testing.T) {
+	var gotResponse, gotExchange, gotRoutingKey, gotContentType string
+	var gotBody []byte
+	var gotBodyFrames int
+	address, done := fakeBroker(t, func(conn net.Conn) error {
+		// Reuse the client framing for the broker side
+		broker := &amqpPublisher{conn: conn, reader: bufio.NewReader(conn), frameMax: amqpDefaultFrameMax}
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(broker.reader, header); err != nil || !bytes.Equal(header, amqpProtocolHeader) {
+			return fmt.Errorf("bad protocol header %q: %v", header, err)
+		}
+		var start amqpWriter
+		start.uint8(0)
+		start.uint8(9)
+		start.table()
+		start.longString("PLAIN AMQPLAIN")
+		start.longString("en_US")
+		broker.writeMethod(0, amqpConnectionStart, start.data)
+		startOk, err := broker.expectMethod(0, amqpConnectionStartOk)
+		if err != nil {
+			return err
+		}
+		gotResponse = string(startOk)
+
+		// A small frame max to split the body
+		var tune amqpWriter
+		tune.uint16(2047)
+		tune.uint32(amqpMinFrameMax)
+		tune.uint16(60)
+		broker.writeMethod(0, amqpConnectionTune, tune.data)
+		if _, err := broker.expectMethod(0, amqpConnectionTuneOk); err != nil {
+			return err
+		}
+		if _, err := broker.expectMethod(0, amqpConnectionOpen); err != nil {
+			return err
+		}
+		broker.writeMethod(0, amqpConnectionOpenOk, []byte{0})
+		if _, err := broker.expectMethod(1, amqpChannelOpen); err != nil {
+			return err
+		}
+		broker.writeMethod(1, amqpChannelOpenOk, []byte{0, 0, 0, 0})
+		if _, err := broker.expectMethod(1, amqpConfirmSelect); err != nil {
+			return err
+		}
+		broker.writeMethod(1, amqpConfirmSelectOk, nil)
+
+		publish, err := broker.expectMethod(1, amqpBasicPublish)
+		if err != nil {
+			return err
+		}
+		exchangeLength := int(publish[2])
+		gotExchange = string(publish[3 : 3+exchangeLength])
+		gotRoutingKey = string(publish[4+exchangeLength : 4+exchangeLength+int(publish[3+exchangeLength])])
+		contentHeader, err := broker.readFrame()
+		if err != nil {
+			return err
+		}
+		size := binary.BigEndian.Uint64(contentHeader.payload[4:])
+		gotContentType = string(contentHeader.payload[15 : 15+int(contentHeader.payload[14])])
+		for uint64(len(gotBody)) < size {
+			frame, err := broker.readFrame()
+			if err != nil {
+				return err
+			}
+			gotBody = append(gotBody, frame.payload...)
+			gotBodyFrames++
+		}
+
+		// Heartbeats are ignored while waiting for the confirm
+		broker.writeFrame(amqpFrameHeartbeat, 0, nil)
+		var ack amqpWriter
+		ack.uint64(1)
+		ack.uint8(0)
+		broker.writeMethod(1, amqpBasicAck, ack.data)
+
+		if frame, err := broker.readFrame(); err != nil {
+			return err
+		} else if method, _ := frame.method(); method != amqpConnectionClose {
+			return fmt.Errorf("expected connection close, got %v", method)
+		}
+		return broker.writeMethod(0, amqpConnectionCloseOk, nil)
+	})
+
+	ev := event.Event{ID: uuid.New(), Type: "station.status_changed", TrackID: "server", Time: time.Now(), Data: strings.Repeat("x", 10000)}
+	err := publishEvent(config.EventBusConfig{Driver: EventBusDriverAMQP, Address: address, Prefix: "tg"}, ev)
+	helper.CheckEqual(t, err, nil)
+	closeEventBus()
+	helper.CheckEqual(t, <-done, nil)
+	helper.CheckEqual(t, strings.Contains(gotResponse, "PLAIN\x00\x00\x00\x0c\x00guest\x00guest"), true)
+	helper.CheckEqual(t, gotExchange, "amq.topic")
+	helper.CheckEqual(t, gotRoutingKey, "tg.station.status_changed")
+	helper.CheckEqual(t, gotContentType, "application/json")
+	helper.CheckEqual(t, bytes.Contains(gotBody, []byte(ev.ID.String())), true)
+	helper.CheckEqual(t, gotBodyFrames > 1, true)
+}
+
+func TestValidateEventBusConfig(t *testing.T) {
+	check := func(busConfig config.EventBusConfig) error {
+		return validateEventBusConfig(&config.MainConfig{EventBus: busConfig})
+	}
+	helper.CheckEqual(t, check(config.EventBusConfig{}), nil)
+	helper.CheckEqual(t, check(config.EventBusConfig{Driver: "amqp", Address: "localhost:5672"}), nil)
+	helper.CheckEqual(t, check(config.EventBusConfig{Driver: "kafka", Address: "localhost:9092"}) != nil, true)
+	helper.CheckEqual(t, check(config.EventBusConfig{Driver: "nats"}) != nil, true)
+	helper.CheckEqual(t, check(config.EventBusConfig{Driver: "nats", Address: "localhost:4222", Prefix: "techo.>"}) != nil, true)
+}
+
+// closeEventBus closes the shared publisher between tests.
+func closeEventBus() {
+	eventBusLock.Lock()
+	defer eventBusLock.Unlock()
+	if eventBusPublisher != nil {
+		eventBusPublisher.close()
+		eventBusPublisher = nil
+	}
+}
@@ -0,0 +1,202 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/event"
+	"github.com/gathering/tech-online-backend/jobs"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	crewAlertsDefaultBatch = 60 * time.Second
+	crewAlertsTimeout      = 10 * time.Second
+	crewAlertsMaxPending   = 100 // Alerts beyond this are only counted until the next batch
+	crewAlertsMaxLines     = 20  // Distinct alerts listed per message
+)
+
+// Event types alerted about if none are configured.
+var crewAlertsDefaultEventTypes = []string{"station.unhealthy", "station.provision_failed", "server.error_spike"}
+
+// crewAlertBatch collects alerts until they are sent.
+type crewAlertBatch struct {
+	lock    sync.Mutex
+	pending []event.Event
+	dropped int
+}
+
+var crewAlerts crewAlertBatch
+var crewAlertsStart sync.Once
+
+func init() {
+	event.Subscribe("crew-alerts", queueCrewAlert)
+}
+
+// queueCrewAlert adds matching events to the pending batch and starts the sender if not already running.
+func queueCrewAlert(ev event.Event) {
+	alertsConfig := config.Config.CrewAlerts
+	if alertsConfig.WebhookURL == "" || !crewAlertMatches(ev, alertsConfig) {
+		return
+	}
+
+	crewAlerts.add(ev)
+	crewAlertsStart.Do(func() {
+		go runCrewAlerts()
+	})
+}
+
+// crewAlertMatches checks the event against the configured types and tracks.
+// Events without a track (e.g. server errors) are never filtered by track.
+func crewAlertMatches(ev event.Event, alertsConfig config.CrewAlertsConfig) bool {
+	eventTypes := alertsConfig.EventTypes
+	if len(eventTypes) == 0 {
+		eventTypes = crewAlertsDefaultEventTypes
+	}
+	tracks := alertsConfig.Tracks
+	if ev.TrackID == "" {
+		tracks = nil
+	}
+	return eventMatchesFilter(ev, eventTypes, tracks)
+}
+
+func (batch *crewAlertBatch) add(ev event.Event) {
+	batch.lock.Lock()
+	defer batch.lock.Unlock()
+	if len(batch.pending) >= crewAlertsMaxPending {
+		batch.dropped++
+		return
+	}
+	batch.pending = append(batch.pending, ev)
+}
+
+// take removes and returns all pending alerts.
+func (batch *crewAlertBatch) take() ([]event.Event, int) {
+	batch.lock.Lock()
+	defer batch.lock.Unlock()
+	events, dropped := batch.pending, batch.dropped
+	batch.pending = nil
+	batch.dropped = 0
+	return events, dropped
+}
+
+// runCrewAlerts sends the pending alerts as one message per batch interval, so bursts don't flood the channel.
+func runCrewAlerts() {
+	client := http.Client{Timeout: crewAlertsTimeout}
+	for {
+		interval := crewAlertsDefaultBatch
+		if config.Config.CrewAlerts.BatchSeconds > 0 {
+			interval = time.Duration(config.Config.CrewAlerts.BatchSeconds) * time.Second
+		}
+		time.Sleep(interval)
+
+		events, dropped := crewAlerts.take()
+		if len(events) == 0 {
+			continue
+		}
+		text := buildCrewAlertText(events, dropped)
+		webhookURL := config.Config.CrewAlerts.WebhookURL
+		jobs.Submit(jobs.Job{
+			Name:   "crew-alerts",
+			Fields: log.Fields{"alerts": len(events) + dropped},
+			Run: func() error {
+				return postCrewAlert(&client, webhookURL, text)
+			},
+		})
+	}
+}
+
+// buildCrewAlertText formats a batch of alerts as Slack/Mattermost markdown, merging repeated alerts.
+func buildCrewAlertText(events []event.Event, dropped int) string {
+	type line struct {
+		text  string
+		count int
+	}
+	var lines []*line
+	lineIndex := make(map[string]*line)
+	for _, ev := range events {
+		text := fmt.Sprintf("*%v*", ev.Title)
+		if ev.TrackID != "" {
+			text = fmt.Sprintf("[%v] %v", ev.TrackID, text)
+		}
+		if ev.Message != "" {
+			text += ": " + ev.Message
+		}
+		if existing, ok := lineIndex[text]; ok {
+			existing.count++
+			continue
+		}
+		newLine := &line{text: text, count: 1}
+		lineIndex[text] = newLine
+		lines = append(lines, newLine)
+	}
+
+	total := len(events) + dropped
+	var builder strings.Builder
+	if total == 1 {
+		builder.WriteString("Tech:Online alert:\n")
+	} else {
+		fmt.Fprintf(&builder, "Tech:Online alerts (%v):\n", total)
+	}
+	hidden := dropped
+	for i, line := range lines {
+		if i >= crewAlertsMaxLines {
+			hidden += line.count
+			continue
+		}
+		builder.WriteString("• " + line.text)
+		if line.count > 1 {
+			fmt.Fprintf(&builder, " (x%v)", line.count)
+		}
+		builder.WriteString("\n")
+	}
+	if hidden > 0 {
+		fmt.Fprintf(&builder, "…and %v more\n", hidden)
+	}
+	return strings.TrimSuffix(builder.String(), "\n")
+}
+
+// postCrewAlert posts the text to an incoming webhook. Slack and Mattermost both accept this format.
+func postCrewAlert(client *http.Client, url string, text string) error {
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	response, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		responseBody, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("webhook returned status %v: %v", response.StatusCode, strings.TrimSpace(string(responseBody)))
+	}
+	return nil
+}
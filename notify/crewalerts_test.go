@@ -0,0 +1,50 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package notify
+
+import (
+	"testing"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/event"
+	"github.com/gathering/tech-online-backend/helper"
+)
+
+func TestBuildCrewAlertText(t *testing.T) {
+	events := []event.Event{
+		{Title: "Station unhealthy", TrackID: "net", Message: "Station 1 failed"},
+		{Title: "Server error spike", Message: "10 requests failed"},
+		{Title: "Station unhealthy", TrackID: "net", Message: "Station 1 failed"},
+	}
+	helper.CheckEqual(t, buildCrewAlertText(events, 2), "Tech:Online alerts (5):\n"+
+		"• [net] *Station unhealthy*: Station 1 failed (x2)\n"+
+		"• *Server error spike*: 10 requests failed\n"+
+		"…and 2 more")
+	helper.CheckEqual(t, buildCrewAlertText(events[1:2], 0), "Tech:Online alert:\n• *Server error spike*: 10 requests failed")
+}
+
+func TestCrewAlertMatches(t *testing.T) {
+	alertsConfig := config.CrewAlertsConfig{Tracks: []string{"net"}}
+	helper.CheckEqual(t, crewAlertMatches(event.Event{Type: "station.unhealthy", TrackID: "net"}, alertsConfig), true)
+	helper.CheckEqual(t, crewAlertMatches(event.Event{Type: "station.unhealthy", TrackID: "server"}, alertsConfig), false)
+	helper.CheckEqual(t, crewAlertMatches(event.Event{Type: "server.error_spike"}, alertsConfig), true)
+	helper.CheckEqual(t, crewAlertMatches(event.Event{Type: "test.failed", TrackID: "net"}, alertsConfig), false)
+}
@@ -0,0 +1,217 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/event"
+	"github.com/gathering/tech-online-backend/jobs"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	discordAPIURL        = "https://discord.com/api/v10"
+	discordTimeout       = 10 * time.Second
+	discordMaxRetryDelay = 30 * time.Second
+	discordMaxContent    = 4096 // Max embed description length
+)
+
+// Embed colors.
+const (
+	discordColorDefault = 0x5865f2
+	discordColorBad     = 0xed4245
+	discordColorGood    = 0x57f287
+)
+
+// DiscordMessage is a message to post to a channel.
+type DiscordMessage struct {
+	Content string         `json:"content,omitempty"`
+	Embeds  []DiscordEmbed `json:"embeds,omitempty"`
+}
+
+// DiscordEmbed is a rich message part.
+type DiscordEmbed struct {
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Color       int    `json:"color,omitempty"`
+	Timestamp   string `json:"timestamp,omitempty"`
+}
+
+func init() {
+	event.Subscribe("discord", sendDiscord)
+}
+
+// sendDiscord posts the event to the matching channels and DMs the affected users who linked their Discord ID.
+func sendDiscord(ev event.Event) {
+	discordConfig := config.Config.Discord
+	message := buildDiscordMessage(ev)
+	client := http.Client{Timeout: discordTimeout}
+
+	for _, channel := range discordConfig.Channels {
+		if !eventMatchesFilter(ev, channel.EventTypes, channel.Tracks) {
+			continue
+		}
+		webhookURL := channel.WebhookURL
+		jobs.Submit(jobs.Job{
+			Name:   "discord-channel",
+			Fields: log.Fields{"event": ev.ID},
+			Run: func() error {
+				return postDiscord(&client, webhookURL, "", message)
+			},
+		})
+	}
+
+	if discordConfig.BotToken == "" || len(discordConfig.DMEventTypes) == 0 || !eventMatchesFilter(ev, discordConfig.DMEventTypes, nil) {
+		return
+	}
+	for _, userID := range ev.UserIDs {
+		userID := userID
+		jobs.Submit(jobs.Job{
+			Name:   "discord-dm",
+			Fields: log.Fields{"user": userID, "event": ev.ID},
+			Run: func() error {
+				return sendDiscordDM(&client, discordConfig.BotToken, userID, message)
+			},
+		})
+	}
+}
+
+func sendDiscordDM(client *http.Client, botToken string, userID uuid.UUID, message DiscordMessage) error {
+	settings, err := LoadUserSettings(userID)
+	if err != nil {
+		return err
+	}
+	if settings.DiscordID == "" || settings.DiscordOptOut {
+		return nil
+	}
+
+	// Open (or get) the DM channel, then post to it
+	var channel struct {
+		ID string `json:"id"`
+	}
+	body, err := json.Marshal(map[string]string{"recipient_id": settings.DiscordID})
+	if err != nil {
+		return err
+	}
+	if err := discordRequest(client, discordAPIURL+"/users/@me/channels", botToken, body, &channel); err != nil {
+		return err
+	}
+	return postDiscord(client, fmt.Sprintf("%v/channels/%v/messages", discordAPIURL, channel.ID), botToken, message)
+}
+
+// postDiscord posts a message to a webhook URL, or to a channel using the bot token.
+func postDiscord(client *http.Client, url string, botToken string, message DiscordMessage) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return discordRequest(client, url, botToken, body, nil)
+}
+
+// discordRequest POSTs the JSON body, waiting and retrying once if rate limited.
+func discordRequest(client *http.Client, url string, botToken string, body []byte, response interface{}) error {
+	for attempt := 1; ; attempt++ {
+		request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Content-Type", "application/json")
+		if botToken != "" {
+			request.Header.Set("Authorization", "Bot "+botToken)
+		}
+		httpResponse, err := client.Do(request)
+		if err != nil {
+			return err
+		}
+		responseBody, err := ioutil.ReadAll(httpResponse.Body)
+		httpResponse.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		if httpResponse.StatusCode == http.StatusTooManyRequests && attempt == 1 {
+			var rateLimit struct {
+				RetryAfter float64 `json:"retry_after"`
+			}
+			json.Unmarshal(responseBody, &rateLimit)
+			delay := time.Duration(rateLimit.RetryAfter * float64(time.Second))
+			if delay > discordMaxRetryDelay {
+				delay = discordMaxRetryDelay
+			}
+			time.Sleep(delay)
+			continue
+		}
+		if httpResponse.StatusCode >= 300 {
+			return fmt.Errorf("discord responded with status: %v", httpResponse.Status)
+		}
+		if response != nil {
+			return json.Unmarshal(responseBody, response)
+		}
+		return nil
+	}
+}
+
+// buildDiscordMessage builds an embed for the event, colored by how good the news is.
+func buildDiscordMessage(ev event.Event) DiscordMessage {
+	color := discordColorDefault
+	eventType := string(ev.Type)
+	switch {
+	case strings.HasSuffix(eventType, ".failed"), strings.HasSuffix(eventType, ".unhealthy"):
+		color = discordColorBad
+	case strings.HasSuffix(eventType, ".passed"), strings.HasSuffix(eventType, ".healthy"), strings.HasSuffix(eventType, ".assigned"):
+		color = discordColorGood
+	}
+	description := ev.Message
+	if len(description) > discordMaxContent {
+		description = description[:discordMaxContent-3] + "..."
+	}
+	embed := DiscordEmbed{
+		Title:       ev.Title,
+		Description: description,
+		Color:       color,
+	}
+	if !ev.Time.IsZero() {
+		embed.Timestamp = ev.Time.Format(time.RFC3339)
+	}
+	return DiscordMessage{Embeds: []DiscordEmbed{embed}}
+}
+
+// isDiscordID checks if the value looks like a Discord snowflake ID.
+func isDiscordID(value string) bool {
+	if len(value) < 15 || len(value) > 21 {
+		return false
+	}
+	for _, char := range value {
+		if char < '0' || char > '9' {
+			return false
+		}
+	}
+	return true
+}
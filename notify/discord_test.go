@@ -0,0 +1,63 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package notify
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gathering/tech-online-backend/event"
+	"github.com/gathering/tech-online-backend/helper"
+)
+
+func TestBuildDiscordMessage(t *testing.T) {
+	message := buildDiscordMessage(event.Event{Type: "test.failed", Title: "Test failed", Message: "ping failed"})
+	helper.CheckEqual(t, len(message.Embeds), 1)
+	helper.CheckEqual(t, message.Embeds[0].Title, "Test failed")
+	helper.CheckEqual(t, message.Embeds[0].Description, "ping failed")
+	helper.CheckEqual(t, message.Embeds[0].Color, discordColorBad)
+	helper.CheckEqual(t, buildDiscordMessage(event.Event{Type: "station.assigned"}).Embeds[0].Color, discordColorGood)
+}
+
+func TestPostDiscordRateLimited(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"retry_after": 0.01}`))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	err := postDiscord(server.Client(), server.URL, "", DiscordMessage{Content: "hello"})
+	helper.CheckEqual(t, err, nil)
+	helper.CheckEqual(t, requests, 2)
+}
+
+func TestIsDiscordID(t *testing.T) {
+	helper.CheckEqual(t, isDiscordID("80351110224678912"), true)
+	helper.CheckEqual(t, isDiscordID("someone#1234"), false)
+	helper.CheckEqual(t, isDiscordID("123"), false)
+}
@@ -0,0 +1,345 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package notify
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/event"
+	"github.com/gathering/tech-online-backend/jobs"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultSMTPPort            = 587
+	defaultSMTPImplicitTLSPort = 465
+	smtpTimeout                = 30 * time.Second
+)
+
+// Built-in email templates, for the events users typically want by email.
+var defaultEmailTemplates = map[string]config.EmailTemplateConfig{
+	"timeslot.scheduled": {
+		Subject: "Your timeslot is scheduled",
+		Body:    "Hi {{.User.DisplayName}},\n\n{{.Event.Message}}\n",
+	},
+	"timeslot.upcoming": {
+		Subject: "{{.Event.Title}}",
+		Body:    "Hi {{.User.DisplayName}},\n\n{{.Event.Message}}\n",
+	},
+	"timeslot.ending": {
+		Subject: "{{.Event.Title}}",
+		Body:    "Hi {{.User.DisplayName}},\n\n{{.Event.Message}}\n",
+	},
+	"station.assigned": {
+		Subject: "Your station is ready",
+		Body:    "Hi {{.User.DisplayName}},\n\n{{.Event.Message}}\n",
+	},
+}
+
+// EmailTemplateData is what the email templates get.
+type EmailTemplateData struct {
+	Event      event.Event
+	User       *rest.User
+	SitePrefix string
+}
+
+// EmailLogEntry is a sent (or failed) email.
+type EmailLogEntry struct {
+	ID        *uuid.UUID `column:"id" json:"id"`
+	UserID    *uuid.UUID `column:"user" json:"user"`
+	Address   string     `column:"address" json:"address"`
+	EventID   *uuid.UUID `column:"event" json:"event"`
+	EventType event.Type `column:"event_type" json:"event_type"`
+	Subject   string     `column:"subject" json:"subject"`
+	Timestamp *time.Time `column:"timestamp" json:"timestamp"`
+	Success   bool       `column:"success" json:"success"`
+	Error     string     `column:"error" json:"error"` // If failed
+}
+
+// EmailLog is a list of sent emails.
+type EmailLog []*EmailLogEntry
+
+func init() {
+	rest.AddHandler("/email-log/", "^$", func() interface{} { return &EmailLog{} })
+	event.Subscribe("email", sendEmails)
+}
+
+// Get gets the sent emails, newest first. Use the "user" and "event-type" query args to filter.
+func (emailLog *EmailLog) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params, prep filtering
+	var whereArgs []interface{}
+	if userID, ok := request.QueryArgs["user"]; ok {
+		whereArgs = append(whereArgs, "user", "=", userID)
+	}
+	if eventType, ok := request.QueryArgs["event-type"]; ok {
+		whereArgs = append(whereArgs, "event_type", "=", eventType)
+	}
+
+	// Get
+	dbResult := db.SelectMany(emailLog, "email_log", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	sort.SliceStable(*emailLog, func(i, j int) bool {
+		return (*emailLog)[i].Timestamp.After(*(*emailLog)[j].Timestamp)
+	})
+	if request.ListLimit > 0 && len(*emailLog) > request.ListLimit {
+		*emailLog = (*emailLog)[:request.ListLimit]
+	}
+	return rest.Result{}
+}
+
+// sendEmails emails the event to the affected users, unless they opted out.
+func sendEmails(ev event.Event) {
+	emailConfig := config.Config.Email
+	if !emailConfig.Enabled || len(ev.UserIDs) == 0 || !emailEventMatches(emailConfig, ev) {
+		return
+	}
+	emailTemplate, ok := emailTemplateFor(emailConfig, ev.Type)
+	if !ok {
+		return
+	}
+
+	for _, userID := range ev.UserIDs {
+		userID := userID
+		jobs.Submit(jobs.Job{
+			Name:   "email",
+			Fields: log.Fields{"user": userID, "event": ev.ID},
+			Run: func() error {
+				return sendEventEmail(emailConfig, emailTemplate, ev, userID)
+			},
+		})
+	}
+}
+
+func sendEventEmail(emailConfig config.EmailConfig, emailTemplate config.EmailTemplateConfig, ev event.Event, userID uuid.UUID) error {
+	settings, err := LoadUserSettings(userID)
+	if err != nil {
+		return err
+	}
+	if settings.EmailOptOut {
+		return nil
+	}
+	var user rest.User
+	dbResult := db.Select(&user, "users", "id", "=", userID)
+	if dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	if !dbResult.IsSuccess() || user.EmailAddress == "" {
+		return nil
+	}
+
+	data := EmailTemplateData{Event: ev, User: &user, SitePrefix: config.Config.SitePrefix}
+	subject, body, err := renderEmail(emailTemplate, data)
+	if err != nil {
+		return jobs.Permanent(err)
+	}
+	message := buildEmailMessage(emailConfig.From, user.EmailAddress, subject, body, time.Now())
+	sendErr := sendSMTP(emailConfig, user.EmailAddress, message)
+
+	// Log it, also if it failed
+	id := uuid.New()
+	now := time.Now()
+	eventID := ev.ID
+	entry := EmailLogEntry{
+		ID:        &id,
+		UserID:    &userID,
+		Address:   user.EmailAddress,
+		EventID:   &eventID,
+		EventType: ev.Type,
+		Subject:   subject,
+		Timestamp: &now,
+		Success:   sendErr == nil,
+	}
+	if sendErr != nil {
+		entry.Error = sendErr.Error()
+	}
+	if dbResult := db.Insert("email_log", entry); dbResult.IsFailed() {
+		log.WithError(dbResult.Error).Warn("Failed to save email log entry")
+	}
+	return sendErr
+}
+
+func emailEventMatches(emailConfig config.EmailConfig, ev event.Event) bool {
+	if len(emailConfig.EventTypes) == 0 {
+		_, ok := defaultEmailTemplates[string(ev.Type)]
+		return ok
+	}
+	for _, pattern := range emailConfig.EventTypes {
+		if MatchEventType(pattern, ev.Type) {
+			return true
+		}
+	}
+	return false
+}
+
+// emailTemplateFor finds the configured or built-in template for the event type, falling back to the event title and message.
+func emailTemplateFor(emailConfig config.EmailConfig, eventType event.Type) (config.EmailTemplateConfig, bool) {
+	if emailTemplate, ok := emailConfig.Templates[string(eventType)]; ok {
+		return emailTemplate, true
+	}
+	if emailTemplate, ok := defaultEmailTemplates[string(eventType)]; ok {
+		return emailTemplate, true
+	}
+	return config.EmailTemplateConfig{
+		Subject: "{{.Event.Title}}",
+		Body:    "Hi {{.User.DisplayName}},\n\n{{.Event.Message}}\n",
+	}, true
+}
+
+// renderEmail renders the subject and body templates.
+func renderEmail(emailTemplate config.EmailTemplateConfig, data EmailTemplateData) (string, string, error) {
+	subjectTemplate, err := template.New("subject").Parse(emailTemplate.Subject)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid subject template: %v", err)
+	}
+	bodyTemplate, err := template.New("body").Parse(emailTemplate.Body)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid body template: %v", err)
+	}
+	var subject, body bytes.Buffer
+	if err := subjectTemplate.Execute(&subject, data); err != nil {
+		return "", "", err
+	}
+	if err := bodyTemplate.Execute(&body, data); err != nil {
+		return "", "", err
+	}
+	// Headers can't contain newlines
+	return strings.Join(strings.Fields(subject.String()), " "), body.String(), nil
+}
+
+// buildEmailMessage builds a plaintext UTF-8 email.
+func buildEmailMessage(from string, to string, subject string, body string, date time.Time) []byte {
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %v\r\n", from)
+	fmt.Fprintf(&message, "To: %v\r\n", to)
+	fmt.Fprintf(&message, "Subject: %v\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&message, "Date: %v\r\n", date.Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "Message-ID: <%v@%v>\r\n", uuid.New(), emailDomain(from))
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	message.WriteString("Content-Transfer-Encoding: quoted-printable\r\n")
+	message.WriteString("\r\n")
+	writer := quotedprintable.NewWriter(&message)
+	writer.Write([]byte(strings.ReplaceAll(body, "\n", "\r\n")))
+	writer.Close()
+	return message.Bytes()
+}
+
+func emailDomain(address string) string {
+	address = strings.TrimSuffix(strings.TrimSpace(address), ">")
+	if index := strings.LastIndex(address, "@"); index >= 0 {
+		return address[index+1:]
+	}
+	return "localhost"
+}
+
+// sendSMTP sends the message to a single recipient.
+func sendSMTP(emailConfig config.EmailConfig, to string, message []byte) error {
+	port := emailConfig.Port
+	if port == 0 {
+		port = defaultSMTPPort
+		if emailConfig.ImplicitTLS {
+			port = defaultSMTPImplicitTLSPort
+		}
+	}
+	address := net.JoinHostPort(emailConfig.Host, strconv.Itoa(port))
+	tlsConfig := &tls.Config{ServerName: emailConfig.Host}
+
+	var conn net.Conn
+	var err error
+	dialer := net.Dialer{Timeout: smtpTimeout}
+	if emailConfig.ImplicitTLS {
+		conn, err = tls.DialWithDialer(&dialer, "tcp", address, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+	client, err := smtp.NewClient(conn, emailConfig.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if !emailConfig.ImplicitTLS {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+		}
+	}
+	if emailConfig.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", emailConfig.Username, emailConfig.Password, emailConfig.Host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(bareAddress(emailConfig.From)); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(message); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// bareAddress extracts the address from e.g. "Tech:Online <noreply@example.net>".
+func bareAddress(address string) string {
+	if start := strings.LastIndex(address, "<"); start >= 0 {
+		if end := strings.LastIndex(address, ">"); end > start {
+			return address[start+1 : end]
+		}
+	}
+	return strings.TrimSpace(address)
+}
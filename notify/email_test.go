@@ -0,0 +1,63 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package notify
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/event"
+	"github.com/gathering/tech-online-backend/helper"
+	"github.com/gathering/tech-online-backend/rest"
+)
+
+func TestRenderEmail(t *testing.T) {
+	data := EmailTemplateData{
+		Event: event.Event{Type: "station.assigned", Title: "Your station is ready", Message: "You got station Net 1 (net1)."},
+		User:  &rest.User{DisplayName: "Ola"},
+	}
+	emailTemplate, ok := emailTemplateFor(config.EmailConfig{}, data.Event.Type)
+	helper.CheckEqual(t, ok, true)
+	subject, body, err := renderEmail(emailTemplate, data)
+	helper.CheckEqual(t, err, nil)
+	helper.CheckEqual(t, subject, "Your station is ready")
+	helper.CheckEqual(t, body, "Hi Ola,\n\nYou got station Net 1 (net1).\n")
+
+	_, _, err = renderEmail(config.EmailTemplateConfig{Subject: "{{.Nope"}, data)
+	helper.CheckEqual(t, err != nil, true)
+}
+
+func TestEmailEventMatches(t *testing.T) {
+	helper.CheckEqual(t, emailEventMatches(config.EmailConfig{}, event.Event{Type: "station.assigned"}), true)
+	helper.CheckEqual(t, emailEventMatches(config.EmailConfig{}, event.Event{Type: "test.failed"}), false)
+	helper.CheckEqual(t, emailEventMatches(config.EmailConfig{EventTypes: []string{"test.*"}}, event.Event{Type: "test.failed"}), true)
+}
+
+func TestBuildEmailMessage(t *testing.T) {
+	message := string(buildEmailMessage("Tech:Online <noreply@example.net>", "ola@example.net", "Blåbær", "Hi\n", time.Unix(0, 0)))
+	helper.CheckEqual(t, strings.Contains(message, "To: ola@example.net\r\n"), true)
+	helper.CheckEqual(t, strings.Contains(message, "Subject: =?utf-8?q?Bl=C3=A5b=C3=A6r?=\r\n"), true)
+	helper.CheckEqual(t, strings.Contains(message, "@example.net>\r\n"), true)
+	helper.CheckEqual(t, strings.HasSuffix(message, "\r\n\r\nHi\r\n"), true)
+	helper.CheckEqual(t, bareAddress("Tech:Online <noreply@example.net>"), "noreply@example.net")
+}
@@ -0,0 +1,138 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package notify
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/event"
+)
+
+// natsPublisher publishes to NATS using the text protocol, with a PING after each message to find out if it was accepted.
+type natsPublisher struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// natsConnectOptions is the CONNECT message.
+type natsConnectOptions struct {
+	Verbose  bool   `json:"verbose"`
+	Pedantic bool   `json:"pedantic"`
+	Name     string `json:"name"`
+	Lang     string `json:"lang"`
+	Version  string `json:"version"`
+	Protocol int    `json:"protocol"`
+	User     string `json:"user,omitempty"`
+	Pass     string `json:"pass,omitempty"`
+}
+
+func connectNATS(busConfig config.EventBusConfig) (busPublisher, error) {
+	conn, err := net.DialTimeout("tcp", busConfig.Address, eventBusTimeout)
+	if err != nil {
+		return nil, err
+	}
+	publisher := &natsPublisher{conn: conn, reader: bufio.NewReader(conn)}
+	conn.SetDeadline(time.Now().Add(eventBusTimeout))
+
+	// The server starts with INFO
+	line, err := publisher.readLine()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return nil, fmt.Errorf("nats: expected INFO, got %q", line)
+	}
+
+	options, err := json.Marshal(natsConnectOptions{
+		Name:     "techo-backend",
+		Lang:     "go",
+		Version:  config.Version,
+		Protocol: 1,
+		User:     busConfig.Username,
+		Pass:     busConfig.Password,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", options); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := publisher.waitPong(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return publisher, nil
+}
+
+func (publisher *natsPublisher) publish(subject string, body []byte, ev event.Event) error {
+	publisher.conn.SetDeadline(time.Now().Add(eventBusTimeout))
+	message := make([]byte, 0, len(subject)+len(body)+32)
+	message = append(message, fmt.Sprintf("PUB %v %v\r\n", subject, len(body))...)
+	message = append(message, body...)
+	message = append(message, "\r\nPING\r\n"...)
+	if _, err := publisher.conn.Write(message); err != nil {
+		return err
+	}
+	return publisher.waitPong()
+}
+
+func (publisher *natsPublisher) close() {
+	publisher.conn.Close()
+}
+
+// waitPong reads until PONG, answering server PINGs and failing on errors.
+func (publisher *natsPublisher) waitPong() error {
+	for {
+		line, err := publisher.readLine()
+		if err != nil {
+			return err
+		}
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := publisher.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("nats: %v", strings.Trim(strings.TrimPrefix(line, "-ERR"), " '"))
+		}
+		// Ignore "+OK" and new INFO
+	}
+}
+
+func (publisher *natsPublisher) readLine() (string, error) {
+	line, err := publisher.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,110 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package notify
+
+import (
+	"strings"
+
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+)
+
+// UserSettings is the per-user notification preferences. Users without saved settings get everything.
+type UserSettings struct {
+	UserID        *uuid.UUID `column:"user" json:"user"`
+	EmailOptOut   bool       `column:"email_opt_out" json:"email_opt_out"`     // Don't send any emails
+	DiscordID     string     `column:"discord_id" json:"discord_id"`           // Discord user ID (snowflake) for DMs, optional
+	DiscordOptOut bool       `column:"discord_opt_out" json:"discord_opt_out"` // Don't send any Discord DMs
+}
+
+func init() {
+	rest.AddHandler("/notification-settings/", "^$", func() interface{} { return &UserSettings{} })
+}
+
+// Get gets the settings for the current user, or for the user in the "user" query arg for operators/admins.
+func (settings *UserSettings) Get(request *rest.Request) rest.Result {
+	// Check perms
+	userID, result := settingsUserID(request)
+	if !result.IsOk() {
+		return result
+	}
+
+	// Get
+	loaded, err := LoadUserSettings(userID)
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	*settings = *loaded
+	return rest.Result{}
+}
+
+// Put saves the settings for the current user, or for the user in the "user" query arg for operators/admins.
+func (settings *UserSettings) Put(request *rest.Request) rest.Result {
+	// Check perms
+	userID, result := settingsUserID(request)
+	if !result.IsOk() {
+		return result
+	}
+
+	// Validate
+	if settings.UserID != nil && *settings.UserID != userID {
+		return rest.Result{Code: 400, Message: "mismatch between user and JSON user IDs"}
+	}
+	settings.UserID = &userID
+	settings.DiscordID = strings.TrimSpace(settings.DiscordID)
+	if settings.DiscordID != "" && !isDiscordID(settings.DiscordID) {
+		return rest.Result{Code: 400, Message: "invalid Discord ID, expected the numeric user ID"}
+	}
+
+	// Save
+	if dbResult := db.Delete("notification_settings", "user", "=", userID); dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if dbResult := db.Insert("notification_settings", settings); dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	return rest.Result{}
+}
+
+// LoadUserSettings gets the settings for the user, with defaults if never saved.
+func LoadUserSettings(userID uuid.UUID) (*UserSettings, error) {
+	settings := UserSettings{UserID: &userID}
+	dbResult := db.Select(&settings, "notification_settings", "user", "=", userID)
+	if dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	return &settings, nil
+}
+
+func settingsUserID(request *rest.Request) (uuid.UUID, rest.Result) {
+	if rawUserID, ok := request.QueryArgs["user"]; ok && (request.AccessToken.GetRole() == rest.RoleOperator || request.AccessToken.GetRole() == rest.RoleAdmin) {
+		userID, err := uuid.Parse(rawUserID)
+		if err != nil {
+			return uuid.Nil, rest.Result{Code: 400, Message: "invalid user ID"}
+		}
+		return userID, rest.Result{}
+	}
+	if request.AccessToken.OwnerUserID == nil {
+		return uuid.Nil, rest.UnauthorizedResult(request.AccessToken)
+	}
+	return *request.AccessToken.OwnerUserID, rest.Result{}
+}
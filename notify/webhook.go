@@ -0,0 +1,158 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+// Package notify delivers events to external services, e.g. webhooks.
+package notify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/event"
+	"github.com/gathering/tech-online-backend/jobs"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultWebhookTimeout = 10 * time.Second
+	webhookAttempts       = 3
+	webhookRetryDelay     = 5 * time.Second
+)
+
+// Webhook headers, in addition to the JSON content type.
+const (
+	HeaderEvent     = "X-Techo-Event"     // Event type
+	HeaderDelivery  = "X-Techo-Delivery"  // Event ID, the same for retries
+	HeaderSignature = "X-Techo-Signature" // "sha256=" and the hex HMAC-SHA256 of the body using the secret, if configured
+)
+
+func init() {
+	event.Subscribe("webhooks", sendWebhooks)
+}
+
+// sendWebhooks queues the event for all matching webhooks, retrying a few times on errors and 5XX responses.
+func sendWebhooks(ev event.Event) {
+	for _, webhook := range config.Config.Webhooks {
+		if !webhookMatches(webhook, ev) {
+			continue
+		}
+		webhook := webhook
+		jobs.Submit(jobs.Job{
+			Name:       "webhook",
+			Fields:     log.Fields{"url": webhook.URL, "event": ev.ID},
+			Attempts:   webhookAttempts,
+			RetryDelay: webhookRetryDelay,
+			Run: func() error {
+				return sendWebhook(webhook, ev)
+			},
+		})
+	}
+}
+
+// sendWebhook POSTs the event to the webhook.
+func sendWebhook(webhook config.WebhookConfig, ev event.Event) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	timeout := defaultWebhookTimeout
+	if webhook.TimeoutSeconds > 0 {
+		timeout = time.Duration(webhook.TimeoutSeconds) * time.Second
+	}
+	client := http.Client{Timeout: timeout}
+	return postWebhook(&client, webhook, ev, body)
+}
+
+func postWebhook(client *http.Client, webhook config.WebhookConfig, ev event.Event, body []byte) error {
+	request, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(HeaderEvent, string(ev.Type))
+	request.Header.Set(HeaderDelivery, ev.ID.String())
+	if webhook.Secret != "" {
+		request.Header.Set(HeaderSignature, Sign(webhook.Secret, body))
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 400 && response.StatusCode < 500 {
+		return jobs.Permanent(fmt.Errorf("webhook responded with status: %v", response.Status))
+	}
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status: %v", response.Status)
+	}
+	return nil
+}
+
+// Sign returns the signature header value for the webhook body, so receivers can verify it came from us.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func webhookMatches(webhook config.WebhookConfig, ev event.Event) bool {
+	return eventMatchesFilter(ev, webhook.EventTypes, webhook.Tracks)
+}
+
+// eventMatchesFilter checks if the event matches any of the event type patterns and tracks, where empty lists match everything.
+func eventMatchesFilter(ev event.Event, eventTypes []string, tracks []string) bool {
+	if len(tracks) > 0 {
+		found := false
+		for _, trackID := range tracks {
+			if trackID == ev.TrackID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(eventTypes) == 0 {
+		return true
+	}
+	for _, pattern := range eventTypes {
+		if MatchEventType(pattern, ev.Type) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchEventType checks if the event type matches the pattern, which is either the exact type or a prefix ending with "*".
+func MatchEventType(pattern string, eventType event.Type) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(string(eventType), strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == string(eventType)
+}
@@ -0,0 +1,65 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package notify
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/event"
+	"github.com/gathering/tech-online-backend/helper"
+	"github.com/google/uuid"
+)
+
+func TestMatchEventType(t *testing.T) {
+	helper.CheckEqual(t, MatchEventType("test.passed", "test.passed"), true)
+	helper.CheckEqual(t, MatchEventType("test.passed", "test.failed"), false)
+	helper.CheckEqual(t, MatchEventType("test.*", "test.failed"), true)
+	helper.CheckEqual(t, MatchEventType("test.*", "station.unhealthy"), false)
+	helper.CheckEqual(t, MatchEventType("*", "station.unhealthy"), true)
+}
+
+func TestWebhookMatches(t *testing.T) {
+	ev := event.Event{Type: "test.failed", TrackID: "net"}
+	helper.CheckEqual(t, webhookMatches(config.WebhookConfig{}, ev), true)
+	helper.CheckEqual(t, webhookMatches(config.WebhookConfig{Tracks: []string{"server"}}, ev), false)
+	helper.CheckEqual(t, webhookMatches(config.WebhookConfig{Tracks: []string{"net"}, EventTypes: []string{"test.*"}}, ev), true)
+	helper.CheckEqual(t, webhookMatches(config.WebhookConfig{EventTypes: []string{"station.*"}}, ev), false)
+}
+
+func TestSendWebhook(t *testing.T) {
+	var gotSignature, gotEvent string
+	var gotBody []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotSignature = r.Header.Get(HeaderSignature)
+		gotEvent = r.Header.Get(HeaderEvent)
+		gotBody, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	ev := event.Event{ID: uuid.New(), Type: "test.passed", Title: "Test passed"}
+	err := sendWebhook(config.WebhookConfig{URL: server.URL, Secret: "hunter2"}, ev)
+	helper.CheckEqual(t, err, nil)
+	helper.CheckEqual(t, gotEvent, "test.passed")
+	helper.CheckEqual(t, gotSignature, Sign("hunter2", gotBody))
+}
@@ -0,0 +1,204 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+// Package probe checks if hosts and services are reachable and behave as expected, e.g. for station health monitoring and task checks.
+package probe
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kind is the kind of probe.
+type Kind string
+
+const (
+	// KindICMP sends an ICMP echo request to the host, using the system ping command.
+	KindICMP Kind = "icmp"
+	// KindTCP opens a TCP connection to the host and port.
+	KindTCP Kind = "tcp"
+	// KindHTTP sends a GET request to the URL and expects a non-5XX status (and the expected content, if any).
+	KindHTTP Kind = "http"
+	// KindSSH runs a command on the host using the system ssh client with key authentication, and expects it to exit successfully (with the expected output, if any).
+	KindSSH Kind = "ssh"
+)
+
+// DefaultTimeout is the timeout if not specified.
+const DefaultTimeout = 5 * time.Second
+
+const (
+	maxBodySize   = 1 << 20 // HTTP response bodies are cut off after this when looking for the expected content
+	maxOutputSize = 1024    // Output included in results
+)
+
+// Target is something to probe.
+type Target struct {
+	Kind    Kind
+	Address string        // Host for ICMP, host:port for TCP and URL for HTTP
+	Timeout time.Duration // Defaults to DefaultTimeout
+	Expect  string        // Substring the HTTP response body or SSH command output must contain, optional
+
+	// SSH only
+	Port         int    // Defaults to 22
+	Username     string // Required
+	IdentityFile string // Private key file, optional
+	Command      string // Defaults to "true"
+}
+
+// Result is the result of a probe.
+type Result struct {
+	OK      bool
+	Latency time.Duration
+	Error   error  // Why it's not OK
+	Output  string // Start of the HTTP response body or SSH command output, if any
+}
+
+// Probe probes the target once.
+func Probe(target Target) Result {
+	timeout := target.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	start := time.Now()
+	var output string
+	var err error
+	switch target.Kind {
+	case KindICMP:
+		err = probeICMP(target.Address, timeout)
+	case KindTCP:
+		err = probeTCP(target.Address, timeout)
+	case KindHTTP:
+		output, err = probeHTTP(target.Address, timeout)
+	case KindSSH:
+		output, err = probeSSH(target, timeout)
+	default:
+		err = fmt.Errorf("unknown probe kind: %v", target.Kind)
+	}
+	latency := time.Since(start)
+	if err == nil && target.Expect != "" && !strings.Contains(output, target.Expect) {
+		err = fmt.Errorf("expected content not found: %q", target.Expect)
+	}
+
+	return Result{OK: err == nil, Latency: latency, Error: err, Output: truncateOutput(output)}
+}
+
+// ValidateKind checks if the kind is known.
+func ValidateKind(kind Kind) bool {
+	switch kind {
+	case KindICMP, KindTCP, KindHTTP, KindSSH:
+		return true
+	default:
+		return false
+	}
+}
+
+func probeTCP(address string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func probeHTTP(url string, timeout time.Duration) (string, error) {
+	client := http.Client{Timeout: timeout}
+	response, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 500 {
+		return "", fmt.Errorf("response contained 5XX status: %v", response.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, maxBodySize))
+	if err != nil {
+		return "", fmt.Errorf("failed to read response body: %v", err)
+	}
+	return string(body), nil
+}
+
+func probeSSH(target Target, timeout time.Duration) (string, error) {
+	if target.Username == "" {
+		return "", fmt.Errorf("missing SSH username")
+	}
+	port := target.Port
+	if port <= 0 {
+		port = 22
+	}
+	command := target.Command
+	if command == "" {
+		command = "true"
+	}
+
+	// Stations get reprovisioned all the time, so host keys can't be pinned
+	seconds := int(math.Ceil(timeout.Seconds()))
+	args := []string{
+		"-o", "BatchMode=yes",
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "LogLevel=ERROR",
+		"-o", fmt.Sprintf("ConnectTimeout=%v", seconds),
+		"-p", strconv.Itoa(port),
+	}
+	if target.IdentityFile != "" {
+		args = append(args, "-i", target.IdentityFile, "-o", "IdentitiesOnly=yes")
+	}
+	args = append(args, "-l", target.Username, "--", target.Address, command)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, "ssh", args...).CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return string(output), fmt.Errorf("SSH command timed out")
+	}
+	if err != nil {
+		return string(output), fmt.Errorf("SSH command failed: %v: %v", err, truncateOutput(strings.TrimSpace(string(output))))
+	}
+	return string(output), nil
+}
+
+func truncateOutput(output string) string {
+	if len(output) > maxOutputSize {
+		return output[:maxOutputSize]
+	}
+	return output
+}
+
+func probeICMP(host string, timeout time.Duration) error {
+	// Raw ICMP sockets need privileges the server usually doesn't have, so use the (setuid or capable) system ping
+	seconds := int(math.Ceil(timeout.Seconds()))
+	ctx, cancel := context.WithTimeout(context.Background(), timeout+time.Second)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, "ping", "-c", "1", "-W", strconv.Itoa(seconds), "--", host).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ping failed: %v: %v", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
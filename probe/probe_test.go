@@ -0,0 +1,81 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package probe_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gathering/tech-online-backend/helper"
+	"github.com/gathering/tech-online-backend/probe"
+)
+
+func TestProbeTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	result := probe.Probe(probe.Target{Kind: probe.KindTCP, Address: address, Timeout: time.Second})
+	helper.CheckEqual(t, result.OK, true)
+
+	listener.Close()
+	result = probe.Probe(probe.Target{Kind: probe.KindTCP, Address: address, Timeout: time.Second})
+	helper.CheckEqual(t, result.OK, false)
+}
+
+func TestProbeHTTP(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	result := probe.Probe(probe.Target{Kind: probe.KindHTTP, Address: server.URL, Timeout: time.Second})
+	helper.CheckEqual(t, result.OK, true)
+
+	status = http.StatusServiceUnavailable
+	result = probe.Probe(probe.Target{Kind: probe.KindHTTP, Address: server.URL, Timeout: time.Second})
+	helper.CheckEqual(t, result.OK, false)
+}
+
+func TestProbeHTTPExpect(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<h1>Welcome to nginx!</h1>"))
+	}))
+	defer server.Close()
+
+	result := probe.Probe(probe.Target{Kind: probe.KindHTTP, Address: server.URL, Timeout: time.Second, Expect: "Welcome to nginx"})
+	helper.CheckEqual(t, result.OK, true)
+
+	result = probe.Probe(probe.Target{Kind: probe.KindHTTP, Address: server.URL, Timeout: time.Second, Expect: "It works!"})
+	helper.CheckEqual(t, result.OK, false)
+	helper.CheckEqual(t, result.Output, "<h1>Welcome to nginx!</h1>")
+}
+
+func TestProbeUnknownKind(t *testing.T) {
+	result := probe.Probe(probe.Target{Kind: "carrier-pigeon", Address: "localhost"})
+	helper.CheckEqual(t, result.OK, false)
+	helper.CheckNotEqual(t, result.Error, nil)
+}
@@ -0,0 +1,142 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package provision
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// apiRequestTimeout bounds VM service requests, since creating blocks the request creating the station.
+const apiRequestTimeout = 30 * time.Second
+
+// apiProvisioner uses the external VM service API.
+type apiProvisioner struct {
+	trackConfig config.ServerTrackConfig
+}
+
+type apiCreateRequest struct {
+	Username string `json:"username"`
+	UID      string `json:"uid"`
+	TaskType string `json:"task_type"`
+}
+
+type apiCreateResponse struct {
+	ID              int    `json:"id"`
+	FQDN            string `json:"fqdn"`
+	Zone            string `json:"zone"`
+	Username        string `json:"orc_vm_username"`
+	Password        string `json:"orc_vm_password"`
+	IPv4Address     string `json:"public_ipv4"`
+	IPv6Address     string `json:"public_ipv6"`
+	SSHPort         int    `json:"ssh_port"`
+	VLANID          int    `json:"vlan_id"`
+	VLANIPv4Address string `json:"vlan_ip"`
+}
+
+func init() {
+	RegisterDriver("api", newAPIProvisioner)
+}
+
+func newAPIProvisioner(trackID string, trackConfig config.ServerTrackConfig) (Provisioner, error) {
+	if trackConfig.BaseURL == "" {
+		return nil, ErrNotConfigured
+	}
+	return &apiProvisioner{trackConfig: trackConfig}, nil
+}
+
+// Create creates a new instance using the VM service.
+func (provisioner *apiProvisioner) Create() (*Instance, error) {
+	serviceURL := provisioner.trackConfig.BaseURL + "/api/entry/new"
+	serviceRequestData := apiCreateRequest{
+		Username: "tech",
+		UID:      "techo",
+		TaskType: provisioner.trackConfig.TaskType,
+	}
+	requestJSON, requestJSONError := json.Marshal(serviceRequestData)
+	if requestJSONError != nil {
+		return nil, requestJSONError
+	}
+	serviceRequest, serviceRequestErr := http.NewRequest("POST", serviceURL, bytes.NewBuffer(requestJSON))
+	if serviceRequestErr != nil {
+		return nil, serviceRequestErr
+	}
+	serviceRequest.Header.Set("Content-Type", "application/json")
+	serviceResponseBody, serviceResponseErr := provisioner.do(serviceRequest)
+	if serviceResponseErr != nil {
+		return nil, serviceResponseErr
+	}
+	var responseData apiCreateResponse
+	if err := json.Unmarshal(serviceResponseBody, &responseData); err != nil {
+		return nil, err
+	}
+	log.Tracef("VM service created new instance: %v", responseData.ID)
+
+	return &Instance{
+		ID:              strconv.Itoa(responseData.ID),
+		State:           InstanceStatePending,
+		FQDN:            responseData.FQDN,
+		IPv4Address:     responseData.IPv4Address,
+		IPv6Address:     responseData.IPv6Address,
+		SSHPort:         responseData.SSHPort,
+		Username:        responseData.Username,
+		Password:        responseData.Password,
+		Zone:            responseData.Zone,
+		VLANID:          responseData.VLANID,
+		VLANIPv4Address: responseData.VLANIPv4Address,
+	}, nil
+}
+
+// Destroy destroys the instance using the VM service.
+func (provisioner *apiProvisioner) Destroy(instanceID string) error {
+	serviceURL := fmt.Sprintf("%v/api/entry/%v", provisioner.trackConfig.BaseURL, instanceID)
+	serviceRequest, serviceRequestErr := http.NewRequest("DELETE", serviceURL, nil)
+	if serviceRequestErr != nil {
+		return serviceRequestErr
+	}
+	if _, err := provisioner.do(serviceRequest); err != nil {
+		return err
+	}
+	log.Tracef("VM service destroyed instance: %v", instanceID)
+	return nil
+}
+
+func (provisioner *apiProvisioner) do(serviceRequest *http.Request) ([]byte, error) {
+	serviceRequest.SetBasicAuth(provisioner.trackConfig.AuthUsername, provisioner.trackConfig.AuthPassword)
+	serviceClient := &http.Client{Timeout: apiRequestTimeout}
+	serviceResponse, serviceResponseErr := serviceClient.Do(serviceRequest)
+	if serviceResponseErr != nil {
+		return nil, serviceResponseErr
+	}
+	defer serviceResponse.Body.Close()
+	if serviceResponse.StatusCode < 200 || serviceResponse.StatusCode > 299 {
+		return nil, fmt.Errorf("response contained non-2XX status: %v", serviceResponse.Status)
+	}
+	return ioutil.ReadAll(serviceResponse.Body)
+}
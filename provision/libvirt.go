@@ -0,0 +1,378 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package provision
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	log "github.com/sirupsen/logrus"
+)
+
+const libvirtCommandTimeout = 5 * time.Minute
+
+// libvirtProvisioner creates stations as libvirt domains by cloning a template domain, using virsh and virt-clone.
+// The instance ID is the domain name.
+type libvirtProvisioner struct {
+	trackID string
+	config  config.LibvirtConfig
+}
+
+// Cloning from the same template concurrently may give conflicting disk names
+var libvirtCloneLock sync.Mutex
+
+// libvirtCreation is the background part of creating a domain (cloning and starting).
+type libvirtCreation struct {
+	done     bool
+	err      error
+	finished chan struct{} // Closed when done
+}
+
+// Creations by connection URI and domain name, for Inspect
+var libvirtCreations = make(map[string]*libvirtCreation)
+var libvirtCreationsLock sync.Mutex
+
+func init() {
+	RegisterDriver("libvirt", newLibvirtProvisioner)
+}
+
+func newLibvirtProvisioner(trackID string, trackConfig config.ServerTrackConfig) (Provisioner, error) {
+	if trackConfig.Libvirt.TemplateDomain == "" {
+		return nil, ErrNotConfigured
+	}
+	provisioner := libvirtProvisioner{
+		trackID: trackID,
+		config:  trackConfig.Libvirt,
+	}
+	if provisioner.config.NamePrefix == "" {
+		provisioner.config.NamePrefix = fmt.Sprintf("techo-%v-", trackID)
+	}
+	if provisioner.config.SSHPort == 0 {
+		provisioner.config.SSHPort = 22
+	}
+	return &provisioner, nil
+}
+
+// Create clones the template to a new domain and starts it in the background, since cloning the disks may take minutes.
+// The instance is pending until then, and the addresses are typically not known until the domain has booted
+// and gotten a DHCP lease, see Inspect.
+func (provisioner *libvirtProvisioner) Create() (*Instance, error) {
+	name, err := newInstanceName(provisioner.config.NamePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	creation := &libvirtCreation{finished: make(chan struct{})}
+	libvirtCreationsLock.Lock()
+	libvirtCreations[provisioner.creationKey(name)] = creation
+	libvirtCreationsLock.Unlock()
+	go func() {
+		err := provisioner.cloneAndStart(name)
+		logger := log.WithFields(log.Fields{
+			"track":  provisioner.trackID,
+			"domain": name,
+		})
+		if err != nil {
+			logger.WithError(err).Error("Failed to create libvirt domain for station")
+		} else {
+			logger.Info("Created libvirt domain for station")
+		}
+		libvirtCreationsLock.Lock()
+		creation.done = true
+		creation.err = err
+		libvirtCreationsLock.Unlock()
+		close(creation.finished)
+	}()
+
+	return &Instance{
+		ID:       name,
+		State:    InstanceStatePending,
+		SSHPort:  provisioner.config.SSHPort,
+		Username: provisioner.config.Username,
+		Password: provisioner.config.Password,
+	}, nil
+}
+
+// Destroy stops and undefines the domain, including its storage.
+// Domains still being created are destroyed once the creation is done (cloning is bounded by the command timeout),
+// since the clone would be left behind otherwise.
+func (provisioner *libvirtProvisioner) Destroy(instanceID string) error {
+	if creation, ok := provisioner.creation(instanceID); ok && creation.finished != nil {
+		<-creation.finished
+	}
+	if _, err := provisioner.virsh("destroy", instanceID); err != nil && !isLibvirtNotRunning(err) && !isLibvirtNotFound(err) {
+		return err
+	}
+	if _, err := provisioner.virsh("undefine", instanceID, "--remove-all-storage", "--snapshots-metadata"); err != nil && !isLibvirtNotFound(err) {
+		return err
+	}
+	libvirtCreationsLock.Lock()
+	delete(libvirtCreations, provisioner.creationKey(instanceID))
+	libvirtCreationsLock.Unlock()
+	log.WithFields(log.Fields{
+		"track":  provisioner.trackID,
+		"domain": instanceID,
+	}).Info("Destroyed libvirt domain for station")
+	return nil
+}
+
+// Reset destroys the domain and clones it again from the template with the same name.
+func (provisioner *libvirtProvisioner) Reset(instanceID string) error {
+	if err := provisioner.Destroy(instanceID); err != nil {
+		return err
+	}
+	return provisioner.cloneAndStart(instanceID)
+}
+
+// Inspect gets the domain state and the addresses from the DHCP leases.
+func (provisioner *libvirtProvisioner) Inspect(instanceID string) (*Instance, error) {
+	instance := Instance{
+		ID:       instanceID,
+		SSHPort:  provisioner.config.SSHPort,
+		Username: provisioner.config.Username,
+		Password: provisioner.config.Password,
+	}
+
+	if creation, ok := provisioner.creation(instanceID); ok && !creation.done {
+		instance.State = InstanceStatePending
+		return &instance, nil
+	} else if ok && creation.err != nil {
+		instance.State = InstanceStateError
+		instance.Message = fmt.Sprintf("creation failed: %v", creation.err)
+		return &instance, nil
+	}
+
+	stateOutput, err := provisioner.virsh("domstate", "--reason", instanceID)
+	if isLibvirtNotFound(err) {
+		instance.State = InstanceStateDestroyed
+		return &instance, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	instance.State = parseLibvirtDomainState(stateOutput)
+	if instance.State != InstanceStateRunning {
+		return &instance, nil
+	}
+
+	addressOutput, err := provisioner.virsh("domifaddr", instanceID, "--source", "lease")
+	if err != nil {
+		return nil, err
+	}
+	instance.IPv4Address, instance.IPv6Address = parseLibvirtInterfaceAddresses(addressOutput)
+	return &instance, nil
+}
+
+// Suspend saves the domain state to disk and stops it, freeing its memory.
+func (provisioner *libvirtProvisioner) Suspend(instanceID string) error {
+	_, err := provisioner.virsh("managedsave", instanceID)
+	return err
+}
+
+// Resume starts the domain, restoring the saved state.
+func (provisioner *libvirtProvisioner) Resume(instanceID string) error {
+	_, err := provisioner.virsh("start", instanceID)
+	return err
+}
+
+// CreateSnapshot takes an internal snapshot of the domain, including the memory if running.
+func (provisioner *libvirtProvisioner) CreateSnapshot(instanceID string, name string) error {
+	_, err := provisioner.virsh("snapshot-create-as", instanceID, name)
+	return err
+}
+
+// RestoreSnapshot reverts the domain to the snapshot and makes sure it's running.
+func (provisioner *libvirtProvisioner) RestoreSnapshot(instanceID string, name string) error {
+	_, err := provisioner.virsh("snapshot-revert", instanceID, name, "--running")
+	return err
+}
+
+// DeleteSnapshot deletes the snapshot of the domain.
+func (provisioner *libvirtProvisioner) DeleteSnapshot(instanceID string, name string) error {
+	_, err := provisioner.virsh("snapshot-delete", instanceID, name)
+	return err
+}
+
+// Console gets the VNC address of the domain.
+func (provisioner *libvirtProvisioner) Console(instanceID string) (string, error) {
+	output, err := provisioner.virsh("domdisplay", "--type", "vnc", instanceID)
+	if err != nil {
+		return "", err
+	}
+	connectionHost := ""
+	if provisioner.config.URI != "" {
+		if uri, err := url.Parse(provisioner.config.URI); err == nil {
+			connectionHost = uri.Hostname()
+		}
+	}
+	return parseLibvirtVNCDisplay(output, connectionHost)
+}
+
+// InjectSSHKeys replaces the authorized keys of the configured user using the QEMU guest agent.
+func (provisioner *libvirtProvisioner) InjectSSHKeys(instanceID string, keys []string) error {
+	if provisioner.config.Username == "" {
+		return fmt.Errorf("no username configured for SSH keys")
+	}
+	keysFile, err := ioutil.TempFile("", "techo-ssh-keys-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(keysFile.Name())
+	if _, err := keysFile.WriteString(strings.Join(keys, "\n") + "\n"); err != nil {
+		keysFile.Close()
+		return err
+	}
+	if err := keysFile.Close(); err != nil {
+		return err
+	}
+	_, err = provisioner.virsh("set-user-sshkeys", instanceID, provisioner.config.Username, "--reset", "--file", keysFile.Name())
+	return err
+}
+
+func (provisioner *libvirtProvisioner) cloneAndStart(name string) error {
+	libvirtCloneLock.Lock()
+	_, err := provisioner.run("virt-clone", "--original", provisioner.config.TemplateDomain, "--name", name, "--auto-clone")
+	libvirtCloneLock.Unlock()
+	if err != nil {
+		return err
+	}
+	_, err = provisioner.virsh("start", name)
+	return err
+}
+
+// creation gets a copy of the background creation of the domain, if created since startup.
+func (provisioner *libvirtProvisioner) creation(name string) (libvirtCreation, bool) {
+	libvirtCreationsLock.Lock()
+	defer libvirtCreationsLock.Unlock()
+	creation, ok := libvirtCreations[provisioner.creationKey(name)]
+	if !ok {
+		return libvirtCreation{}, false
+	}
+	return *creation, true
+}
+
+func (provisioner *libvirtProvisioner) creationKey(name string) string {
+	return provisioner.config.URI + "/" + name
+}
+
+func (provisioner *libvirtProvisioner) virsh(args ...string) (string, error) {
+	return provisioner.run("virsh", args...)
+}
+
+// run runs virsh or virt-clone with the connection URI, returning stdout or an error containing stderr.
+func (provisioner *libvirtProvisioner) run(command string, args ...string) (string, error) {
+	if provisioner.config.URI != "" {
+		args = append([]string{"--connect", provisioner.config.URI}, args...)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), libvirtCommandTimeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%v %v failed: %v: %v", command, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+func isLibvirtNotFound(err error) bool {
+	return err != nil && (strings.Contains(err.Error(), "failed to get domain") || strings.Contains(err.Error(), "Domain not found"))
+}
+
+func isLibvirtNotRunning(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "domain is not running")
+}
+
+// parseLibvirtDomainState parses the output of "virsh domstate", optionally with the reason in parentheses.
+func parseLibvirtDomainState(output string) InstanceState {
+	state := strings.TrimSpace(output)
+	reason := ""
+	if index := strings.Index(state, " ("); index >= 0 {
+		reason = strings.TrimSuffix(state[index+2:], ")")
+		state = state[:index]
+	}
+	switch state {
+	case "running", "idle", "blocked":
+		return InstanceStateRunning
+	case "shut off":
+		if reason == "saved" {
+			return InstanceStateSuspended
+		}
+		return InstanceStateStopped
+	case "paused", "pmsuspended", "in shutdown":
+		return InstanceStateStopped
+	case "crashed":
+		return InstanceStateError
+	default:
+		return InstanceStateUnknown
+	}
+}
+
+// parseLibvirtInterfaceAddresses gets the first IPv4 and IPv6 address from the output of "virsh domifaddr".
+func parseLibvirtInterfaceAddresses(output string) (ipv4Address string, ipv6Address string) {
+	for _, line := range strings.Split(output, "\n") {
+		// Columns: name, MAC, protocol, address/prefix
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		ip, _, err := net.ParseCIDR(fields[3])
+		if err != nil {
+			continue
+		}
+		if fields[2] == "ipv4" && ipv4Address == "" {
+			ipv4Address = ip.String()
+		} else if fields[2] == "ipv6" && ipv6Address == "" && !ip.IsLinkLocalUnicast() {
+			ipv6Address = ip.String()
+		}
+	}
+	return ipv4Address, ipv6Address
+}
+
+// parseLibvirtVNCDisplay converts the output of "virsh domdisplay --type vnc" to a TCP address.
+// Displays listening on loopback are assumed to be reachable at the host of the connection URI, if remote.
+func parseLibvirtVNCDisplay(output string, connectionHost string) (string, error) {
+	display, err := url.Parse(strings.TrimSpace(output))
+	if err != nil || display.Scheme != "vnc" {
+		return "", fmt.Errorf("invalid VNC display: %v", strings.TrimSpace(output))
+	}
+	displayNumber, err := strconv.Atoi(display.Port())
+	if err != nil {
+		return "", fmt.Errorf("invalid VNC display: %v", strings.TrimSpace(output))
+	}
+	host := display.Hostname()
+	if ip := net.ParseIP(host); (host == "localhost" || (ip != nil && ip.IsLoopback())) && connectionHost != "" {
+		host = connectionHost
+	}
+	return net.JoinHostPort(host, strconv.Itoa(5900+displayNumber)), nil
+}
@@ -0,0 +1,112 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package provision
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/helper"
+)
+
+func TestParseLibvirtDomainState(t *testing.T) {
+	helper.CheckEqual(t, parseLibvirtDomainState("running\n\n"), InstanceStateRunning)
+	helper.CheckEqual(t, parseLibvirtDomainState("shut off\n"), InstanceStateStopped)
+	helper.CheckEqual(t, parseLibvirtDomainState("crashed"), InstanceStateError)
+	helper.CheckEqual(t, parseLibvirtDomainState("running (booted)\n"), InstanceStateRunning)
+	helper.CheckEqual(t, parseLibvirtDomainState("shut off (saved)\n"), InstanceStateSuspended)
+	helper.CheckEqual(t, parseLibvirtDomainState("shut off (destroyed)"), InstanceStateStopped)
+	helper.CheckEqual(t, parseLibvirtDomainState("something new"), InstanceStateUnknown)
+}
+
+func TestParseLibvirtInterfaceAddresses(t *testing.T) {
+	output := ` Name       MAC address          Protocol     Address
+-------------------------------------------------------------------------------
+ vnet0      52:54:00:b4:2c:1a    ipv6         fe80::5054:ff:feb4:2c1a/64
+ vnet0      52:54:00:b4:2c:1a    ipv4         192.168.122.57/24
+ vnet0      52:54:00:b4:2c:1a    ipv6         2001:db8::57/64
+ vnet1      52:54:00:b4:2c:1b    ipv4         10.0.0.5/24
+`
+	ipv4Address, ipv6Address := parseLibvirtInterfaceAddresses(output)
+	helper.CheckEqual(t, ipv4Address, "192.168.122.57")
+	helper.CheckEqual(t, ipv6Address, "2001:db8::57")
+
+	ipv4Address, ipv6Address = parseLibvirtInterfaceAddresses("")
+	helper.CheckEqual(t, ipv4Address, "")
+	helper.CheckEqual(t, ipv6Address, "")
+}
+
+func TestParseLibvirtVNCDisplay(t *testing.T) {
+	address, err := parseLibvirtVNCDisplay("vnc://127.0.0.1:3\n", "kvm1.example.net")
+	helper.CheckEqual(t, err, nil)
+	helper.CheckEqual(t, address, "kvm1.example.net:5903")
+
+	address, err = parseLibvirtVNCDisplay("vnc://10.0.0.2:0\n", "kvm1.example.net")
+	helper.CheckEqual(t, err, nil)
+	helper.CheckEqual(t, address, "10.0.0.2:5900")
+
+	address, err = parseLibvirtVNCDisplay("vnc://localhost:1", "")
+	helper.CheckEqual(t, err, nil)
+	helper.CheckEqual(t, address, "localhost:5901")
+
+	_, err = parseLibvirtVNCDisplay("spice://127.0.0.1:5930", "")
+	helper.CheckNotEqual(t, err, nil)
+}
+
+func TestLibvirtCreationState(t *testing.T) {
+	provisioner := libvirtProvisioner{trackID: "test", config: config.LibvirtConfig{URI: "qemu+ssh://test/system"}}
+	name := "techo-test-creating"
+	creation := &libvirtCreation{finished: make(chan struct{})}
+	libvirtCreationsLock.Lock()
+	libvirtCreations[provisioner.creationKey(name)] = creation
+	libvirtCreationsLock.Unlock()
+
+	// Pending while cloning, without running virsh
+	instance, err := provisioner.Inspect(name)
+	helper.CheckEqual(t, err, nil)
+	helper.CheckEqual(t, instance.State, InstanceStatePending)
+
+	// Destroying waits for the creation
+	destroyed := make(chan bool)
+	go func() {
+		provisioner.Destroy(name)
+		destroyed <- true
+	}()
+	select {
+	case <-destroyed:
+		t.Error("destroy didn't wait for the creation")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Failed creations are reported as errors
+	libvirtCreationsLock.Lock()
+	creation.done = true
+	creation.err = fmt.Errorf("virt-clone failed")
+	libvirtCreationsLock.Unlock()
+	instance, err = provisioner.Inspect(name)
+	helper.CheckEqual(t, err, nil)
+	helper.CheckEqual(t, instance.State, InstanceStateError)
+	helper.CheckEqual(t, instance.Message, "creation failed: virt-clone failed")
+	close(creation.finished)
+	<-destroyed
+}
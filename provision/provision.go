@@ -0,0 +1,210 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+// Package provision creates and destroys the instances (typically VMs) backing dynamic server track stations,
+// using a pluggable driver per track.
+package provision
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/gathering/tech-online-backend/config"
+)
+
+// InstanceState is the state of an instance, as reported by the driver.
+type InstanceState string
+
+const (
+	// InstanceStateUnknown means the driver can't tell.
+	InstanceStateUnknown InstanceState = "unknown"
+	// InstanceStatePending means the instance is being created or started.
+	InstanceStatePending InstanceState = "pending"
+	// InstanceStateRunning means the instance is up.
+	InstanceStateRunning InstanceState = "running"
+	// InstanceStateStopped means the instance exists but is not running.
+	InstanceStateStopped InstanceState = "stopped"
+	// InstanceStateSuspended means the instance state is saved to disk, freeing its memory, until resumed.
+	InstanceStateSuspended InstanceState = "suspended"
+	// InstanceStateError means the instance is broken.
+	InstanceStateError InstanceState = "error"
+	// InstanceStateDestroying means the instance is being destroyed.
+	InstanceStateDestroying InstanceState = "destroying"
+	// InstanceStateDestroyed means the instance no longer exists.
+	InstanceStateDestroyed InstanceState = "destroyed"
+)
+
+// DefaultDriver is the driver used if not specified in the track config.
+const DefaultDriver = "api"
+
+// ErrNotConfigured means the track has no (valid) provisioning config.
+var ErrNotConfigured = errors.New("track is not configured for dynamic stations")
+
+// ErrNotSupported means the driver doesn't support the operation.
+var ErrNotSupported = errors.New("operation not supported by the provisioning driver")
+
+// Instance is an instance backing a station.
+// Fields the driver doesn't know (yet) are left empty.
+type Instance struct {
+	ID              string // Driver-specific, required
+	State           InstanceState
+	FQDN            string
+	IPv4Address     string
+	IPv6Address     string
+	SSHPort         int
+	Username        string
+	Password        string
+	Zone            string
+	VLANID          int
+	VLANIPv4Address string
+	Message         string // Details about the state, e.g. why it failed
+}
+
+// Provisioner creates and destroys instances for a single track.
+type Provisioner interface {
+	// Create creates and starts a new instance. It may return before the instance is up.
+	Create() (*Instance, error)
+	// Destroy destroys the instance permanently. It may return before the instance is gone.
+	Destroy(instanceID string) error
+}
+
+// Network is the network allocated to a station from the IPAM pools. Fields not allocated are left empty.
+type Network struct {
+	VLANID     int
+	IPv4Prefix string
+	IPv6Prefix string
+}
+
+// NetworkCreator is a provisioner which can create instances on a network allocated by the backend.
+type NetworkCreator interface {
+	CreateOnNetwork(network Network) (*Instance, error)
+}
+
+// Resetter is a provisioner which can reset an instance to a clean state, keeping the instance ID.
+type Resetter interface {
+	Reset(instanceID string) error
+}
+
+// Inspector is a provisioner which can get the current state and addresses of an instance.
+type Inspector interface {
+	Inspect(instanceID string) (*Instance, error)
+}
+
+// PowerController is a provisioner which can control the power of an instance.
+type PowerController interface {
+	Start(instanceID string) error
+	Stop(instanceID string) error
+	Reboot(instanceID string) error
+}
+
+// Suspender is a provisioner which can suspend an instance to disk and resume it where it left off.
+type Suspender interface {
+	Suspend(instanceID string) error
+	Resume(instanceID string) error
+}
+
+// Snapshotter is a provisioner which can take named snapshots of an instance and roll back to them.
+// Restoring leaves the instance running.
+type Snapshotter interface {
+	CreateSnapshot(instanceID string, name string) error
+	RestoreSnapshot(instanceID string, name string) error
+	DeleteSnapshot(instanceID string, name string) error
+}
+
+// ConsoleProvider is a provisioner which can provide the TCP address of a console (e.g. VNC) for an instance.
+type ConsoleProvider interface {
+	Console(instanceID string) (string, error)
+}
+
+// KeyInjector is a provisioner which can replace the SSH authorized keys for the participant user of a running instance.
+type KeyInjector interface {
+	InjectSSHKeys(instanceID string, keys []string) error
+}
+
+// Factory creates a provisioner for a track from the track config.
+type Factory func(trackID string, trackConfig config.ServerTrackConfig) (Provisioner, error)
+
+var drivers = make(map[string]Factory)
+var driversLock sync.RWMutex
+
+func init() {
+	config.AddValidator(validateServerTracks)
+}
+
+// RegisterDriver makes a driver available by name. Should be called from init functions.
+func RegisterDriver(name string, factory Factory) {
+	driversLock.Lock()
+	defer driversLock.Unlock()
+	drivers[name] = factory
+}
+
+// Get gets the provisioner for the track, or ErrNotConfigured if the track has no provisioning config.
+func Get(trackID string) (Provisioner, error) {
+	trackConfig, ok := config.Config.ServerTracks[trackID]
+	if !ok {
+		return nil, ErrNotConfigured
+	}
+	driver := trackConfig.Driver
+	if driver == "" {
+		driver = DefaultDriver
+	}
+
+	driversLock.RLock()
+	factory, ok := drivers[driver]
+	driversLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown provisioning driver for track %v: %v", trackID, driver)
+	}
+	return factory(trackID, trackConfig)
+}
+
+// validateServerTracks checks that the server tracks of a reloaded config use known drivers.
+func validateServerTracks(candidate *config.MainConfig) error {
+	driversLock.RLock()
+	defer driversLock.RUnlock()
+	for trackID, trackConfig := range candidate.ServerTracks {
+		driver := trackConfig.Driver
+		if driver == "" {
+			driver = DefaultDriver
+		}
+		if _, ok := drivers[driver]; !ok {
+			return fmt.Errorf("unknown provisioning driver for track %v: %v", trackID, driver)
+		}
+	}
+	return nil
+}
+
+// IsConfigured checks if the track has a usable provisioner.
+func IsConfigured(trackID string) bool {
+	_, err := Get(trackID)
+	return err == nil
+}
+
+// newInstanceName makes a random instance name with the prefix, for drivers which name instances themselves.
+func newInstanceName(prefix string) (string, error) {
+	suffix := make([]byte, 3)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return prefix + hex.EncodeToString(suffix), nil
+}
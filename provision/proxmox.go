@@ -0,0 +1,475 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package provision
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultProxmoxCleanSnapshot = "techo-clean"
+	proxmoxRequestTimeout       = 30 * time.Second
+	proxmoxTaskTimeout          = 10 * time.Minute
+	proxmoxTaskPollInterval     = 2 * time.Second
+)
+
+// proxmoxProvisioner creates stations as Proxmox VE VMs cloned from a template VM.
+// The instance ID is the VM ID.
+type proxmoxProvisioner struct {
+	trackID string
+	config  config.ProxmoxConfig
+	client  *http.Client
+}
+
+// proxmoxCreation is the background part of creating a VM (waiting for the clone, snapshotting and starting).
+type proxmoxCreation struct {
+	done bool
+	err  error
+}
+
+// Creations by node and VM ID, kept across provisioners since they're created per request
+var proxmoxCreations = make(map[string]*proxmoxCreation)
+var proxmoxCreationsLock sync.Mutex
+
+type proxmoxTaskStatus struct {
+	Status     string `json:"status"`     // "running" or "stopped"
+	ExitStatus string `json:"exitstatus"` // "OK" if successful
+}
+
+type proxmoxVMStatus struct {
+	Status string `json:"status"` // "running" or "stopped"
+	Lock   string `json:"lock"`   // E.g. "clone" or "snapshot" if busy
+}
+
+type proxmoxAgentInterfaces struct {
+	Result []struct {
+		Name        string `json:"name"`
+		IPAddresses []struct {
+			Type    string `json:"ip-address-type"`
+			Address string `json:"ip-address"`
+		} `json:"ip-addresses"`
+	} `json:"result"`
+}
+
+func init() {
+	RegisterDriver("proxmox", newProxmoxProvisioner)
+}
+
+func newProxmoxProvisioner(trackID string, trackConfig config.ServerTrackConfig) (Provisioner, error) {
+	if trackConfig.Proxmox.URL == "" || trackConfig.Proxmox.Node == "" || trackConfig.Proxmox.TemplateVMID == 0 {
+		return nil, ErrNotConfigured
+	}
+	provisioner := proxmoxProvisioner{
+		trackID: trackID,
+		config:  trackConfig.Proxmox,
+		client: &http.Client{
+			Timeout: proxmoxRequestTimeout,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: trackConfig.Proxmox.InsecureSkipVerify},
+			},
+		},
+	}
+	provisioner.config.URL = strings.TrimSuffix(provisioner.config.URL, "/")
+	if provisioner.config.NamePrefix == "" {
+		provisioner.config.NamePrefix = fmt.Sprintf("techo-%v-", trackID)
+	}
+	if provisioner.config.CleanSnapshot == "" {
+		provisioner.config.CleanSnapshot = defaultProxmoxCleanSnapshot
+	}
+	if provisioner.config.SSHPort == 0 {
+		provisioner.config.SSHPort = 22
+	}
+	return &provisioner, nil
+}
+
+// Create starts cloning the template to a new VM. In the background it then waits for the clone,
+// takes the clean snapshot used for resetting and starts the VM.
+func (provisioner *proxmoxProvisioner) Create() (*Instance, error) {
+	var rawVMID json.Number
+	if err := provisioner.request("GET", "/cluster/nextid", nil, &rawVMID); err != nil {
+		return nil, err
+	}
+	vmID := rawVMID.String()
+
+	form := url.Values{}
+	form.Set("newid", vmID)
+	form.Set("name", provisioner.config.NamePrefix+vmID)
+	if provisioner.config.FullClone {
+		form.Set("full", "1")
+	}
+	if provisioner.config.Pool != "" {
+		form.Set("pool", provisioner.config.Pool)
+	}
+	var upid string
+	if err := provisioner.request("POST", fmt.Sprintf("%v/%v/clone", provisioner.vmsPath(), provisioner.config.TemplateVMID), form, &upid); err != nil {
+		return nil, err
+	}
+
+	creation := &proxmoxCreation{}
+	proxmoxCreationsLock.Lock()
+	proxmoxCreations[provisioner.creationKey(vmID)] = creation
+	proxmoxCreationsLock.Unlock()
+	go func() {
+		err := provisioner.finishCreate(vmID, upid)
+		logger := log.WithFields(log.Fields{
+			"track": provisioner.trackID,
+			"vmid":  vmID,
+		})
+		if err != nil {
+			logger.WithError(err).Error("Failed to create Proxmox VM for station")
+		} else {
+			logger.Info("Created Proxmox VM for station")
+		}
+		proxmoxCreationsLock.Lock()
+		creation.done = true
+		creation.err = err
+		proxmoxCreationsLock.Unlock()
+	}()
+
+	return &Instance{
+		ID:       vmID,
+		State:    InstanceStatePending,
+		SSHPort:  provisioner.config.SSHPort,
+		Username: provisioner.config.Username,
+		Password: provisioner.config.Password,
+	}, nil
+}
+
+func (provisioner *proxmoxProvisioner) finishCreate(vmID string, cloneUPID string) error {
+	if err := provisioner.waitForTask(cloneUPID); err != nil {
+		return err
+	}
+	form := url.Values{}
+	form.Set("snapname", provisioner.config.CleanSnapshot)
+	form.Set("description", "Clean state for resetting, created by Tech:Online")
+	var upid string
+	if err := provisioner.request("POST", provisioner.vmPath(vmID)+"/snapshot", form, &upid); err != nil {
+		return err
+	}
+	if err := provisioner.waitForTask(upid); err != nil {
+		return err
+	}
+	return provisioner.Start(vmID)
+}
+
+// Destroy stops and deletes the VM, including its disks.
+func (provisioner *proxmoxProvisioner) Destroy(instanceID string) error {
+	if err := provisioner.Stop(instanceID); err != nil {
+		if isProxmoxNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	form := url.Values{}
+	form.Set("purge", "1")
+	form.Set("destroy-unreferenced-disks", "1")
+	var upid string
+	if err := provisioner.request("DELETE", provisioner.vmPath(instanceID)+"?"+form.Encode(), nil, &upid); err != nil {
+		return err
+	}
+	if err := provisioner.waitForTask(upid); err != nil {
+		return err
+	}
+
+	proxmoxCreationsLock.Lock()
+	delete(proxmoxCreations, provisioner.creationKey(instanceID))
+	proxmoxCreationsLock.Unlock()
+	log.WithFields(log.Fields{
+		"track": provisioner.trackID,
+		"vmid":  instanceID,
+	}).Info("Destroyed Proxmox VM for station")
+	return nil
+}
+
+// Reset rolls the VM back to the clean snapshot and starts it.
+func (provisioner *proxmoxProvisioner) Reset(instanceID string) error {
+	if err := provisioner.rollback(instanceID, provisioner.config.CleanSnapshot); err != nil {
+		return err
+	}
+	return provisioner.Start(instanceID)
+}
+
+// Inspect gets the VM status and, if the QEMU guest agent is running, the addresses.
+func (provisioner *proxmoxProvisioner) Inspect(instanceID string) (*Instance, error) {
+	instance := Instance{
+		ID:       instanceID,
+		SSHPort:  provisioner.config.SSHPort,
+		Username: provisioner.config.Username,
+		Password: provisioner.config.Password,
+	}
+
+	proxmoxCreationsLock.Lock()
+	creation, creationExists := proxmoxCreations[provisioner.creationKey(instanceID)]
+	var creationCopy proxmoxCreation
+	if creationExists {
+		creationCopy = *creation
+	}
+	proxmoxCreationsLock.Unlock()
+	if creationExists && !creationCopy.done {
+		instance.State = InstanceStatePending
+		return &instance, nil
+	}
+	if creationExists && creationCopy.err != nil {
+		instance.State = InstanceStateError
+		instance.Message = fmt.Sprintf("creation failed: %v", creationCopy.err)
+		return &instance, nil
+	}
+
+	var status proxmoxVMStatus
+	if err := provisioner.request("GET", provisioner.vmPath(instanceID)+"/status/current", nil, &status); err != nil {
+		if isProxmoxNotFound(err) {
+			instance.State = InstanceStateDestroyed
+			return &instance, nil
+		}
+		return nil, err
+	}
+	instance.State = parseProxmoxVMStatus(status)
+	if instance.State != InstanceStateRunning {
+		return &instance, nil
+	}
+
+	// Fails until the guest agent is up, which is normal
+	var interfaces proxmoxAgentInterfaces
+	if err := provisioner.request("GET", provisioner.vmPath(instanceID)+"/agent/network-get-interfaces", nil, &interfaces); err == nil {
+		instance.IPv4Address, instance.IPv6Address = parseProxmoxAgentAddresses(interfaces)
+	}
+	return &instance, nil
+}
+
+// Start starts the VM.
+func (provisioner *proxmoxProvisioner) Start(instanceID string) error {
+	return provisioner.statusTask(instanceID, "start")
+}
+
+// Stop stops the VM immediately, like pulling the plug.
+func (provisioner *proxmoxProvisioner) Stop(instanceID string) error {
+	return provisioner.statusTask(instanceID, "stop")
+}
+
+// Reboot resets the VM immediately, like pressing the reset button.
+func (provisioner *proxmoxProvisioner) Reboot(instanceID string) error {
+	return provisioner.statusTask(instanceID, "reset")
+}
+
+// Suspend hibernates the VM to disk, freeing its memory.
+func (provisioner *proxmoxProvisioner) Suspend(instanceID string) error {
+	form := url.Values{}
+	form.Set("todisk", "1")
+	var upid string
+	if err := provisioner.request("POST", provisioner.vmPath(instanceID)+"/status/suspend", form, &upid); err != nil {
+		return err
+	}
+	return provisioner.waitForTask(upid)
+}
+
+// Resume starts the hibernated VM, which restores its state.
+func (provisioner *proxmoxProvisioner) Resume(instanceID string) error {
+	return provisioner.statusTask(instanceID, "start")
+}
+
+// CreateSnapshot takes a snapshot of the VM, including the memory if running.
+func (provisioner *proxmoxProvisioner) CreateSnapshot(instanceID string, name string) error {
+	form := url.Values{}
+	form.Set("snapname", name)
+	form.Set("vmstate", "1")
+	var upid string
+	if err := provisioner.request("POST", provisioner.vmPath(instanceID)+"/snapshot", form, &upid); err != nil {
+		return err
+	}
+	return provisioner.waitForTask(upid)
+}
+
+// RestoreSnapshot rolls the VM back to the snapshot and starts it, unless it was restored running.
+func (provisioner *proxmoxProvisioner) RestoreSnapshot(instanceID string, name string) error {
+	if err := provisioner.rollback(instanceID, name); err != nil {
+		return err
+	}
+	var status proxmoxVMStatus
+	if err := provisioner.request("GET", provisioner.vmPath(instanceID)+"/status/current", nil, &status); err != nil {
+		return err
+	}
+	if status.Status == "running" {
+		return nil
+	}
+	return provisioner.Start(instanceID)
+}
+
+// DeleteSnapshot deletes the snapshot of the VM.
+func (provisioner *proxmoxProvisioner) DeleteSnapshot(instanceID string, name string) error {
+	var upid string
+	path := fmt.Sprintf("%v/snapshot/%v", provisioner.vmPath(instanceID), url.PathEscape(name))
+	if err := provisioner.request("DELETE", path, nil, &upid); err != nil {
+		return err
+	}
+	return provisioner.waitForTask(upid)
+}
+
+// InjectSSHKeys replaces the authorized keys of the configured user using the QEMU guest agent.
+// The .ssh directory must already exist in the template.
+func (provisioner *proxmoxProvisioner) InjectSSHKeys(instanceID string, keys []string) error {
+	if provisioner.config.Username == "" {
+		return fmt.Errorf("no username configured for SSH keys")
+	}
+	form := url.Values{}
+	form.Set("file", fmt.Sprintf("/home/%v/.ssh/authorized_keys", provisioner.config.Username))
+	form.Set("content", strings.Join(keys, "\n")+"\n")
+	return provisioner.request("POST", provisioner.vmPath(instanceID)+"/agent/file-write", form, nil)
+}
+
+func (provisioner *proxmoxProvisioner) rollback(instanceID string, snapshot string) error {
+	var upid string
+	path := fmt.Sprintf("%v/snapshot/%v/rollback", provisioner.vmPath(instanceID), url.PathEscape(snapshot))
+	if err := provisioner.request("POST", path, url.Values{}, &upid); err != nil {
+		return err
+	}
+	return provisioner.waitForTask(upid)
+}
+
+func (provisioner *proxmoxProvisioner) statusTask(instanceID string, action string) error {
+	var upid string
+	if err := provisioner.request("POST", fmt.Sprintf("%v/status/%v", provisioner.vmPath(instanceID), action), url.Values{}, &upid); err != nil {
+		return err
+	}
+	return provisioner.waitForTask(upid)
+}
+
+// waitForTask polls the task until it's stopped, returning an error if it failed or timed out.
+func (provisioner *proxmoxProvisioner) waitForTask(upid string) error {
+	deadline := time.Now().Add(proxmoxTaskTimeout)
+	path := fmt.Sprintf("/nodes/%v/tasks/%v/status", url.PathEscape(provisioner.config.Node), url.PathEscape(upid))
+	for time.Now().Before(deadline) {
+		var status proxmoxTaskStatus
+		if err := provisioner.request("GET", path, nil, &status); err != nil {
+			return err
+		}
+		if status.Status == "stopped" {
+			if status.ExitStatus != "OK" {
+				return fmt.Errorf("proxmox task %v failed: %v", upid, status.ExitStatus)
+			}
+			return nil
+		}
+		time.Sleep(proxmoxTaskPollInterval)
+	}
+	return fmt.Errorf("timed out waiting for proxmox task %v", upid)
+}
+
+// request does an API request, decoding the "data" field of the response into result if not nil.
+func (provisioner *proxmoxProvisioner) request(method string, path string, form url.Values, result interface{}) error {
+	var body *strings.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	} else {
+		body = strings.NewReader("")
+	}
+	request, err := http.NewRequest(method, provisioner.config.URL+"/api2/json"+path, body)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", fmt.Sprintf("PVEAPIToken=%v=%v", provisioner.config.TokenID, provisioner.config.TokenSecret))
+	if form != nil {
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	response, err := provisioner.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	responseBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("proxmox API %v %v: %v: %v", method, path, response.Status, strings.TrimSpace(string(responseBody)))
+	}
+	if result == nil {
+		return nil
+	}
+	var wrapper struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(responseBody, &wrapper); err != nil {
+		return err
+	}
+	return json.Unmarshal(wrapper.Data, result)
+}
+
+func (provisioner *proxmoxProvisioner) vmsPath() string {
+	return fmt.Sprintf("/nodes/%v/qemu", url.PathEscape(provisioner.config.Node))
+}
+
+func (provisioner *proxmoxProvisioner) vmPath(instanceID string) string {
+	return fmt.Sprintf("%v/%v", provisioner.vmsPath(), url.PathEscape(instanceID))
+}
+
+func (provisioner *proxmoxProvisioner) creationKey(vmID string) string {
+	return provisioner.config.URL + "/" + provisioner.config.Node + "/" + vmID
+}
+
+func isProxmoxNotFound(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "does not exist")
+}
+
+// parseProxmoxVMStatus converts the current VM status, where a locked VM is busy with e.g. cloning or a snapshot.
+func parseProxmoxVMStatus(status proxmoxVMStatus) InstanceState {
+	switch {
+	case status.Lock == "suspended":
+		return InstanceStateSuspended
+	case status.Lock != "":
+		return InstanceStatePending
+	case status.Status == "running":
+		return InstanceStateRunning
+	case status.Status == "stopped":
+		return InstanceStateStopped
+	default:
+		return InstanceStateUnknown
+	}
+}
+
+// parseProxmoxAgentAddresses gets the first global IPv4 and IPv6 address reported by the guest agent.
+func parseProxmoxAgentAddresses(interfaces proxmoxAgentInterfaces) (ipv4Address string, ipv6Address string) {
+	for _, iface := range interfaces.Result {
+		for _, address := range iface.IPAddresses {
+			ip := net.ParseIP(address.Address)
+			if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+				continue
+			}
+			if address.Type == "ipv4" && ipv4Address == "" {
+				ipv4Address = ip.String()
+			} else if address.Type == "ipv6" && ipv6Address == "" {
+				ipv6Address = ip.String()
+			}
+		}
+	}
+	return ipv4Address, ipv6Address
+}
@@ -0,0 +1,57 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package provision
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/gathering/tech-online-backend/helper"
+)
+
+func TestParseProxmoxVMStatus(t *testing.T) {
+	helper.CheckEqual(t, parseProxmoxVMStatus(proxmoxVMStatus{Status: "running"}), InstanceStateRunning)
+	helper.CheckEqual(t, parseProxmoxVMStatus(proxmoxVMStatus{Status: "stopped"}), InstanceStateStopped)
+	helper.CheckEqual(t, parseProxmoxVMStatus(proxmoxVMStatus{Status: "stopped", Lock: "clone"}), InstanceStatePending)
+	helper.CheckEqual(t, parseProxmoxVMStatus(proxmoxVMStatus{Status: "stopped", Lock: "suspended"}), InstanceStateSuspended)
+	helper.CheckEqual(t, parseProxmoxVMStatus(proxmoxVMStatus{}), InstanceStateUnknown)
+}
+
+func TestParseProxmoxAgentAddresses(t *testing.T) {
+	data := []byte(`{"result": [
+		{"name": "lo", "ip-addresses": [
+			{"ip-address-type": "ipv4", "ip-address": "127.0.0.1", "prefix": 8},
+			{"ip-address-type": "ipv6", "ip-address": "::1", "prefix": 128}
+		]},
+		{"name": "eth0", "ip-addresses": [
+			{"ip-address-type": "ipv6", "ip-address": "fe80::1", "prefix": 64},
+			{"ip-address-type": "ipv4", "ip-address": "10.20.30.40", "prefix": 24},
+			{"ip-address-type": "ipv6", "ip-address": "2001:db8::40", "prefix": 64}
+		]}
+	]}`)
+	var interfaces proxmoxAgentInterfaces
+	if err := json.Unmarshal(data, &interfaces); err != nil {
+		t.Fatal(err)
+	}
+	ipv4Address, ipv6Address := parseProxmoxAgentAddresses(interfaces)
+	helper.CheckEqual(t, ipv4Address, "10.20.30.40")
+	helper.CheckEqual(t, ipv6Address, "2001:db8::40")
+}
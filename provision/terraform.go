@@ -0,0 +1,373 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package provision
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultTerraformBinary            = "terraform"
+	defaultTerraformWorkDirectory     = "terraform"
+	defaultTerraformMaxConcurrentRuns = 2
+	terraformCommandTimeout           = 30 * time.Minute
+)
+
+// terraformProvisioner applies a copy of a Terraform module per instance, in the background.
+// The instance ID is the name of the working directory, which is also passed to the module as "name".
+type terraformProvisioner struct {
+	trackID string
+	config  config.TerraformConfig
+}
+
+type terraformAction string
+
+const (
+	terraformActionApply   terraformAction = "apply"
+	terraformActionDestroy terraformAction = "destroy"
+	terraformActionReset   terraformAction = "reset"
+)
+
+// terraformRun is the last (or current) run for an instance.
+type terraformRun struct {
+	action   terraformAction
+	done     bool
+	err      error
+	instance *Instance // Outputs after a successful apply
+}
+
+// Runs by working directory, kept across provisioners since they're created per request
+var terraformRuns = make(map[string]*terraformRun)
+var terraformRunsLock sync.Mutex
+
+// Semaphores by track, limiting concurrent runs
+var terraformSemaphores = make(map[string]chan struct{})
+
+func init() {
+	RegisterDriver("terraform", newTerraformProvisioner)
+}
+
+func newTerraformProvisioner(trackID string, trackConfig config.ServerTrackConfig) (Provisioner, error) {
+	if trackConfig.Terraform.ModuleDirectory == "" {
+		return nil, ErrNotConfigured
+	}
+	provisioner := terraformProvisioner{
+		trackID: trackID,
+		config:  trackConfig.Terraform,
+	}
+	if provisioner.config.Binary == "" {
+		provisioner.config.Binary = defaultTerraformBinary
+	}
+	if provisioner.config.WorkDirectory == "" {
+		provisioner.config.WorkDirectory = defaultTerraformWorkDirectory
+	}
+	if provisioner.config.MaxConcurrentRuns <= 0 {
+		provisioner.config.MaxConcurrentRuns = defaultTerraformMaxConcurrentRuns
+	}
+	return &provisioner, nil
+}
+
+// Create prepares a working directory for the instance and applies it in the background.
+func (provisioner *terraformProvisioner) Create() (*Instance, error) {
+	return provisioner.create(nil)
+}
+
+// CreateOnNetwork creates an instance like Create, also passing the allocated network to the module as the
+// "vlan_id", "ipv4_prefix" and "ipv6_prefix" variables (if allocated).
+func (provisioner *terraformProvisioner) CreateOnNetwork(network Network) (*Instance, error) {
+	networkVariables := make(map[string]string)
+	if network.VLANID != 0 {
+		networkVariables["vlan_id"] = strconv.Itoa(network.VLANID)
+	}
+	if network.IPv4Prefix != "" {
+		networkVariables["ipv4_prefix"] = network.IPv4Prefix
+	}
+	if network.IPv6Prefix != "" {
+		networkVariables["ipv6_prefix"] = network.IPv6Prefix
+	}
+	return provisioner.create(networkVariables)
+}
+
+func (provisioner *terraformProvisioner) create(extraVariables map[string]string) (*Instance, error) {
+	name, err := newInstanceName(fmt.Sprintf("techo-%v-", provisioner.trackID))
+	if err != nil {
+		return nil, err
+	}
+	directory := provisioner.directory(name)
+	if err := copyTerraformModule(provisioner.config.ModuleDirectory, directory); err != nil {
+		return nil, err
+	}
+	variables := make(map[string]string)
+	for key, value := range provisioner.config.Variables {
+		variables[key] = value
+	}
+	for key, value := range extraVariables {
+		variables[key] = value
+	}
+	variables["name"] = name
+	variablesJSON, err := json.MarshalIndent(variables, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(directory, "terraform.tfvars.json"), variablesJSON, 0600); err != nil {
+		return nil, err
+	}
+
+	if err := provisioner.start(name, terraformActionApply); err != nil {
+		return nil, err
+	}
+	return &Instance{ID: name, State: InstanceStatePending}, nil
+}
+
+// Destroy destroys the instance in the background and removes the working directory when done.
+func (provisioner *terraformProvisioner) Destroy(instanceID string) error {
+	if _, err := os.Stat(provisioner.directory(instanceID)); os.IsNotExist(err) {
+		return nil
+	}
+	return provisioner.start(instanceID, terraformActionDestroy)
+}
+
+// Reset destroys and recreates the instance in the background.
+func (provisioner *terraformProvisioner) Reset(instanceID string) error {
+	if _, err := os.Stat(provisioner.directory(instanceID)); os.IsNotExist(err) {
+		return fmt.Errorf("instance does not exist: %v", instanceID)
+	}
+	return provisioner.start(instanceID, terraformActionReset)
+}
+
+// Inspect gets the state from the current or last run, or from the Terraform outputs if the backend was restarted since.
+func (provisioner *terraformProvisioner) Inspect(instanceID string) (*Instance, error) {
+	directory := provisioner.directory(instanceID)
+	if _, err := os.Stat(directory); os.IsNotExist(err) {
+		return &Instance{ID: instanceID, State: InstanceStateDestroyed}, nil
+	}
+
+	terraformRunsLock.Lock()
+	run, runExists := terraformRuns[directory]
+	var runCopy terraformRun
+	if runExists {
+		runCopy = *run
+	}
+	terraformRunsLock.Unlock()
+
+	if runExists {
+		switch {
+		case !runCopy.done && runCopy.action == terraformActionDestroy:
+			return &Instance{ID: instanceID, State: InstanceStateDestroying}, nil
+		case !runCopy.done:
+			return &Instance{ID: instanceID, State: InstanceStatePending}, nil
+		case runCopy.err != nil:
+			return &Instance{ID: instanceID, State: InstanceStateError, Message: fmt.Sprintf("terraform %v failed: %v", runCopy.action, runCopy.err)}, nil
+		case runCopy.instance != nil:
+			return runCopy.instance, nil
+		}
+	}
+
+	// Not run since startup, so check the outputs from the state
+	instance, err := provisioner.outputs(instanceID)
+	if err != nil {
+		return &Instance{ID: instanceID, State: InstanceStateUnknown, Message: err.Error()}, nil
+	}
+	return instance, nil
+}
+
+func (provisioner *terraformProvisioner) directory(instanceID string) string {
+	return filepath.Join(provisioner.config.WorkDirectory, provisioner.trackID, filepath.Base(instanceID))
+}
+
+// start starts a run for the instance in the background, unless one is already running.
+func (provisioner *terraformProvisioner) start(instanceID string, action terraformAction) error {
+	directory := provisioner.directory(instanceID)
+	terraformRunsLock.Lock()
+	if run, ok := terraformRuns[directory]; ok && !run.done {
+		terraformRunsLock.Unlock()
+		return fmt.Errorf("terraform %v already running for instance %v", run.action, instanceID)
+	}
+	run := &terraformRun{action: action}
+	terraformRuns[directory] = run
+	semaphore, ok := terraformSemaphores[provisioner.trackID]
+	if !ok {
+		semaphore = make(chan struct{}, provisioner.config.MaxConcurrentRuns)
+		terraformSemaphores[provisioner.trackID] = semaphore
+	}
+	terraformRunsLock.Unlock()
+
+	go func() {
+		semaphore <- struct{}{}
+		defer func() { <-semaphore }()
+
+		logger := log.WithFields(log.Fields{
+			"track":    provisioner.trackID,
+			"instance": instanceID,
+			"action":   action,
+		})
+		logger.Info("Starting Terraform run")
+		instance, err := provisioner.run(instanceID, action)
+		if err != nil {
+			logger.WithError(err).Error("Terraform run failed")
+		} else {
+			logger.Info("Terraform run finished")
+		}
+
+		terraformRunsLock.Lock()
+		defer terraformRunsLock.Unlock()
+		run.done = true
+		run.err = err
+		run.instance = instance
+		if err == nil && action == terraformActionDestroy {
+			delete(terraformRuns, directory)
+			if err := os.RemoveAll(directory); err != nil {
+				logger.WithError(err).Warn("Failed to remove Terraform working directory")
+			}
+		}
+	}()
+	return nil
+}
+
+// run runs the action synchronously, returning the outputs if applied.
+func (provisioner *terraformProvisioner) run(instanceID string, action terraformAction) (*Instance, error) {
+	if _, err := provisioner.terraform(instanceID, "init", "-input=false", "-no-color"); err != nil {
+		return nil, err
+	}
+	if action == terraformActionDestroy || action == terraformActionReset {
+		if _, err := provisioner.terraform(instanceID, "destroy", "-input=false", "-no-color", "-auto-approve"); err != nil {
+			return nil, err
+		}
+	}
+	if action == terraformActionDestroy {
+		return nil, nil
+	}
+	if _, err := provisioner.terraform(instanceID, "apply", "-input=false", "-no-color", "-auto-approve"); err != nil {
+		return nil, err
+	}
+	return provisioner.outputs(instanceID)
+}
+
+func (provisioner *terraformProvisioner) outputs(instanceID string) (*Instance, error) {
+	output, err := provisioner.terraform(instanceID, "output", "-json", "-no-color")
+	if err != nil {
+		return nil, err
+	}
+	return parseTerraformOutputs(instanceID, output)
+}
+
+// terraform runs a Terraform command in the instance working directory, returning stdout or an error containing stderr.
+func (provisioner *terraformProvisioner) terraform(instanceID string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), terraformCommandTimeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, provisioner.config.Binary, args...)
+	cmd.Dir = provisioner.directory(instanceID)
+	cmd.Env = append(os.Environ(), "TF_IN_AUTOMATION=1")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("terraform %v: %v: %v", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// parseTerraformOutputs parses the output of "terraform output -json" into a running instance.
+func parseTerraformOutputs(instanceID string, data []byte) (*Instance, error) {
+	var outputs map[string]struct {
+		Value interface{} `json:"value"`
+	}
+	if err := json.Unmarshal(data, &outputs); err != nil {
+		return nil, err
+	}
+	value := func(name string) string {
+		output, ok := outputs[name]
+		if !ok || output.Value == nil {
+			return ""
+		}
+		return fmt.Sprint(output.Value)
+	}
+
+	instance := Instance{
+		ID:          instanceID,
+		State:       InstanceStateRunning,
+		FQDN:        value("fqdn"),
+		IPv4Address: value("ipv4_address"),
+		IPv6Address: value("ipv6_address"),
+		Username:    value("username"),
+		Password:    value("password"),
+	}
+	if rawSSHPort := value("ssh_port"); rawSSHPort != "" {
+		sshPort, err := strconv.Atoi(rawSSHPort)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SSH port output: %v", rawSSHPort)
+		}
+		instance.SSHPort = sshPort
+	}
+	return &instance, nil
+}
+
+// copyTerraformModule copies the module files to a new working directory, skipping any local state.
+func copyTerraformModule(source string, destination string) error {
+	return filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relativePath, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == ".terraform" {
+			return filepath.SkipDir
+		}
+		if strings.HasPrefix(info.Name(), "terraform.tfstate") {
+			return nil
+		}
+		target := filepath.Join(destination, relativePath)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0700)
+		}
+
+		sourceFile, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer sourceFile.Close()
+		targetFile, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(targetFile, sourceFile); err != nil {
+			targetFile.Close()
+			return err
+		}
+		return targetFile.Close()
+	})
+}
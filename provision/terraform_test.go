@@ -0,0 +1,48 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package provision
+
+import (
+	"testing"
+
+	"github.com/gathering/tech-online-backend/helper"
+)
+
+func TestParseTerraformOutputs(t *testing.T) {
+	data := []byte(`{
+		"ipv4_address": {"sensitive": false, "type": "string", "value": "198.51.100.7"},
+		"password": {"sensitive": true, "type": "string", "value": "hunter2"},
+		"ssh_port": {"sensitive": false, "type": "number", "value": 2222}
+	}`)
+	instance, err := parseTerraformOutputs("techo-server-abcdef", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	helper.CheckEqual(t, instance.ID, "techo-server-abcdef")
+	helper.CheckEqual(t, instance.State, InstanceStateRunning)
+	helper.CheckEqual(t, instance.IPv4Address, "198.51.100.7")
+	helper.CheckEqual(t, instance.FQDN, "")
+	helper.CheckEqual(t, instance.Password, "hunter2")
+	helper.CheckEqual(t, instance.SSHPort, 2222)
+
+	_, err = parseTerraformOutputs("techo-server-abcdef", []byte(`{"ssh_port": {"value": "ssh"}}`))
+	helper.CheckNotEqual(t, err, nil)
+}
@@ -0,0 +1,130 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package qrcode
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/gathering/tech-online-backend/config"
+)
+
+const (
+	defaultSize = 300
+	minSize     = 32
+	maxSize     = 4096
+)
+
+// Options are the rendering options of a code, from query args.
+type Options struct {
+	Format string
+	Size   int
+	Level  Level
+}
+
+func init() {
+	config.AddValidator(validateConfig)
+}
+
+// ParseOptions parses the "format" ("png" or "svg"), "size" (pixels) and "level" query args, using the configured defaults for missing ones.
+func ParseOptions(args map[string]string) (Options, error) {
+	options := Options{
+		Format: FormatPNG,
+		Size:   config.Config.QRCodes.DefaultSize,
+	}
+	if options.Size <= 0 {
+		options.Size = defaultSize
+	}
+	if level, err := ParseLevel(config.Config.QRCodes.Level); err == nil {
+		options.Level = level
+	} else {
+		options.Level = LevelM
+	}
+
+	if format, ok := args["format"]; ok {
+		options.Format = strings.ToLower(format)
+		if ContentType(options.Format) == "" {
+			return options, fmt.Errorf("invalid format: %v", format)
+		}
+	}
+	if rawSize, ok := args["size"]; ok {
+		size, err := strconv.Atoi(rawSize)
+		if err != nil || size < minSize || size > maxSize {
+			return options, fmt.Errorf("size must be %v to %v pixels", minSize, maxSize)
+		}
+		options.Size = size
+	}
+	if rawLevel, ok := args["level"]; ok {
+		level, err := ParseLevel(rawLevel)
+		if err != nil {
+			return options, err
+		}
+		options.Level = level
+	}
+	return options, nil
+}
+
+// Render renders the text with the options.
+func (options Options) Render(text string) ([]byte, string, error) {
+	return Render(text, options.Format, options.Size, options.Level)
+}
+
+// Version gets a version of the code of the text with the options, for caching.
+func (options Options) Version(text string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%v\x00%v\x00%v\x00%v", text, options.Format, options.Size, options.Level)))
+	return hex.EncodeToString(sum[:16])
+}
+
+// FormatURL renders a configured URL template.
+func FormatURL(urlTemplate string, data interface{}) (string, error) {
+	parsed, err := template.New("url").Parse(urlTemplate)
+	if err != nil {
+		return "", err
+	}
+	var rendered bytes.Buffer
+	if err := parsed.Execute(&rendered, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(rendered.String()), nil
+}
+
+func validateConfig(candidate *config.MainConfig) error {
+	qrConfig := candidate.QRCodes
+	for name, urlTemplate := range map[string]string{"station_url": qrConfig.StationURL, "document_url": qrConfig.DocumentURL} {
+		if _, err := template.New(name).Parse(urlTemplate); err != nil {
+			return fmt.Errorf("qr_codes: invalid %v template: %v", name, err)
+		}
+	}
+	if qrConfig.DefaultSize != 0 && (qrConfig.DefaultSize < minSize || qrConfig.DefaultSize > maxSize) {
+		return fmt.Errorf("qr_codes: default_size must be %v to %v pixels", minSize, maxSize)
+	}
+	if qrConfig.Level != "" {
+		if _, err := ParseLevel(qrConfig.Level); err != nil {
+			return fmt.Errorf("qr_codes: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,539 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+// Package qrcode encodes QR codes (ISO/IEC 18004, byte mode) and renders them as PNG or SVG.
+package qrcode
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Level is the error correction level, which decides how much of the code may be damaged (or covered) and still be read.
+type Level int
+
+// Error correction levels, recovering about 7%, 15%, 25% and 30% of the codewords
+const (
+	LevelL Level = iota
+	LevelM
+	LevelQ
+	LevelH
+)
+
+const (
+	minVersion = 1
+	maxVersion = 40
+)
+
+// Penalty weights for choosing the mask
+const (
+	penaltyRun    = 3
+	penaltyBlock  = 3
+	penaltyFinder = 40
+	penaltyDark   = 10
+)
+
+// eccCodewordsPerBlock is the number of error correction codewords per block, by level and version (index 0 is unused).
+var eccCodewordsPerBlock = [4][41]int{
+	{-1, 7, 10, 15, 20, 26, 18, 20, 24, 30, 18, 20, 24, 26, 30, 22, 24, 28, 30, 28, 28, 28, 28, 30, 30, 26, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+	{-1, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26, 26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28},
+	{-1, 13, 22, 18, 26, 18, 24, 18, 22, 20, 24, 28, 26, 24, 20, 30, 24, 28, 28, 26, 30, 28, 30, 30, 30, 30, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+	{-1, 17, 28, 22, 16, 22, 28, 26, 26, 24, 28, 24, 28, 22, 24, 24, 30, 28, 28, 26, 28, 30, 24, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+}
+
+// eccBlocks is the number of error correction blocks, by level and version (index 0 is unused).
+var eccBlocks = [4][41]int{
+	{-1, 1, 1, 1, 1, 1, 2, 2, 2, 2, 4, 4, 4, 4, 4, 6, 6, 6, 6, 7, 8, 8, 9, 9, 10, 12, 12, 12, 13, 14, 15, 16, 17, 18, 19, 19, 20, 21, 22, 24, 25},
+	{-1, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16, 17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49},
+	{-1, 1, 1, 2, 2, 4, 4, 6, 6, 8, 8, 8, 10, 12, 16, 12, 17, 16, 18, 21, 20, 23, 23, 25, 27, 29, 34, 34, 35, 38, 40, 43, 45, 48, 51, 53, 56, 59, 62, 65, 68},
+	{-1, 1, 1, 2, 4, 4, 4, 5, 6, 8, 8, 11, 11, 16, 16, 18, 16, 19, 21, 25, 25, 25, 34, 30, 32, 35, 37, 40, 42, 45, 48, 51, 54, 57, 60, 63, 66, 70, 74, 77, 81},
+}
+
+// formatLevelBits are the level bits of the format information, which aren't in level order.
+var formatLevelBits = [4]int{1, 0, 3, 2}
+
+// Code is an encoded QR code.
+type Code struct {
+	Version  int
+	Level    Level
+	Size     int // Modules per side, without the quiet zone
+	modules  [][]bool
+	function [][]bool // Finder, timing, alignment, format and version modules, which aren't masked
+}
+
+// ParseLevel parses "L", "M", "Q" or "H" (case-insensitive).
+func ParseLevel(raw string) (Level, error) {
+	switch strings.ToUpper(raw) {
+	case "L":
+		return LevelL, nil
+	case "M":
+		return LevelM, nil
+	case "Q":
+		return LevelQ, nil
+	case "H":
+		return LevelH, nil
+	}
+	return 0, fmt.Errorf("invalid error correction level: %v", raw)
+}
+
+// Encode encodes the data in byte mode using the smallest version which fits.
+func Encode(data []byte, level Level) (*Code, error) {
+	if level < LevelL || level > LevelH {
+		return nil, fmt.Errorf("invalid error correction level: %v", level)
+	}
+	version := minVersion
+	for ; version <= maxVersion; version++ {
+		if byteCapacity(version, level) >= len(data) {
+			break
+		}
+	}
+	if version > maxVersion {
+		return nil, fmt.Errorf("data too long for a QR code: %v bytes", len(data))
+	}
+
+	// Segment, terminator and padding
+	var bits bitBuffer
+	bits.append(0x4, 4) // Byte mode
+	bits.append(len(data), charCountBits(version))
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+	capacity := dataCodewords(version, level) * 8
+	terminator := capacity - len(bits)
+	if terminator > 4 {
+		terminator = 4
+	}
+	bits.append(0, terminator)
+	bits.append(0, (8-len(bits)%8)%8)
+	for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+		bits.append(pad, 8)
+	}
+
+	code := newCode(version, level)
+	code.drawCodewords(code.addECCAndInterleave(bits.bytes()))
+
+	// Use the mask with the lowest penalty
+	bestMask, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		code.applyMask(mask)
+		code.drawFormatBits(mask)
+		if penalty := code.penalty(); bestPenalty < 0 || penalty < bestPenalty {
+			bestMask, bestPenalty = mask, penalty
+		}
+		code.applyMask(mask) // XOR again to undo
+	}
+	code.applyMask(bestMask)
+	code.drawFormatBits(bestMask)
+	return code, nil
+}
+
+// Dark checks if the module is dark. Coordinates outside the code (e.g. in the quiet zone) are light.
+func (code *Code) Dark(x int, y int) bool {
+	return x >= 0 && y >= 0 && x < code.Size && y < code.Size && code.modules[y][x]
+}
+
+// byteCapacity is the max number of bytes in a byte mode segment.
+func byteCapacity(version int, level Level) int {
+	return (dataCodewords(version, level)*8 - 4 - charCountBits(version)) / 8
+}
+
+// charCountBits is the length of the character count of byte mode segments.
+func charCountBits(version int) int {
+	if version <= 9 {
+		return 8
+	}
+	return 16
+}
+
+// rawDataModules is the number of modules available for data and error correction codewords, including remainder bits.
+func rawDataModules(version int) int {
+	result := (16*version+128)*version + 64
+	if version >= 2 {
+		alignments := version/7 + 2
+		result -= (25*alignments-10)*alignments - 55
+		if version >= 7 {
+			result -= 36
+		}
+	}
+	return result
+}
+
+// dataCodewords is the number of data codewords, excluding error correction.
+func dataCodewords(version int, level Level) int {
+	return rawDataModules(version)/8 - eccCodewordsPerBlock[level][version]*eccBlocks[level][version]
+}
+
+// alignmentPositions are the center coordinates of the alignment patterns, on both axes.
+func alignmentPositions(version int) []int {
+	if version == 1 {
+		return nil
+	}
+	alignments := version/7 + 2
+	step := (version*8 + alignments*3 + 5) / (alignments*4 - 4) * 2
+	positions := make([]int, alignments)
+	positions[0] = 6
+	for i, position := alignments-1, version*4+17-7; i >= 1; i, position = i-1, position-step {
+		positions[i] = position
+	}
+	return positions
+}
+
+// newCode creates a code with the function patterns drawn and the format modules reserved.
+func newCode(version int, level Level) *Code {
+	size := version*4 + 17
+	code := &Code{Version: version, Level: level, Size: size, modules: make([][]bool, size), function: make([][]bool, size)}
+	for y := range code.modules {
+		code.modules[y] = make([]bool, size)
+		code.function[y] = make([]bool, size)
+	}
+
+	// Timing patterns
+	for i := 0; i < size; i++ {
+		code.setFunction(6, i, i%2 == 0)
+		code.setFunction(i, 6, i%2 == 0)
+	}
+
+	// Finder patterns with separators
+	for _, center := range [][2]int{{3, 3}, {size - 4, 3}, {3, size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := center[0]+dx, center[1]+dy
+				if x >= 0 && y >= 0 && x < size && y < size {
+					distance := chebyshev(dx, dy)
+					code.setFunction(x, y, distance != 2 && distance != 4)
+				}
+			}
+		}
+	}
+
+	// Alignment patterns, except where the finder patterns are
+	positions := alignmentPositions(version)
+	last := len(positions) - 1
+	for i, cx := range positions {
+		for j, cy := range positions {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					code.setFunction(cx+dx, cy+dy, chebyshev(dx, dy) != 1)
+				}
+			}
+		}
+	}
+
+	code.drawFormatBits(0)
+
+	// Version information
+	if version >= 7 {
+		bits := versionBits(version)
+		for i := 0; i < 18; i++ {
+			dark := (bits>>i)&1 != 0
+			a, b := size-11+i%3, i/3
+			code.setFunction(a, b, dark)
+			code.setFunction(b, a, dark)
+		}
+	}
+	return code
+}
+
+// drawFormatBits draws both copies of the format information (level and mask) and the dark module.
+func (code *Code) drawFormatBits(mask int) {
+	bits := formatBits(code.Level, mask)
+	bit := func(i int) bool {
+		return (bits>>i)&1 != 0
+	}
+	for i := 0; i <= 5; i++ {
+		code.setFunction(8, i, bit(i))
+	}
+	code.setFunction(8, 7, bit(6))
+	code.setFunction(8, 8, bit(7))
+	code.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		code.setFunction(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		code.setFunction(code.Size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		code.setFunction(8, code.Size-15+i, bit(i))
+	}
+	code.setFunction(8, code.Size-8, true)
+}
+
+// formatBits returns the 15 format bits: The level and mask with BCH error correction, masked.
+func formatBits(level Level, mask int) int {
+	data := formatLevelBits[level]<<3 | mask
+	remainder := data
+	for i := 0; i < 10; i++ {
+		remainder = (remainder << 1) ^ ((remainder >> 9) * 0x537)
+	}
+	return (data<<10 | remainder) ^ 0x5412
+}
+
+// versionBits returns the 18 version information bits: The version with BCH error correction.
+func versionBits(version int) int {
+	remainder := version
+	for i := 0; i < 12; i++ {
+		remainder = (remainder << 1) ^ ((remainder >> 11) * 0x1F25)
+	}
+	return version<<12 | remainder
+}
+
+// addECCAndInterleave splits the data codewords into blocks, adds the error correction codewords and interleaves the blocks.
+func (code *Code) addECCAndInterleave(data []byte) []byte {
+	blocks := eccBlocks[code.Level][code.Version]
+	eccLength := eccCodewordsPerBlock[code.Level][code.Version]
+	rawCodewords := rawDataModules(code.Version) / 8
+	shortBlocks := blocks - rawCodewords%blocks
+	shortBlockLength := rawCodewords / blocks
+
+	divisor := reedSolomonDivisor(eccLength)
+	var allBlocks [][]byte
+	offset := 0
+	for i := 0; i < blocks; i++ {
+		length := shortBlockLength - eccLength
+		if i >= shortBlocks {
+			length++
+		}
+		block := append([]byte(nil), data[offset:offset+length]...)
+		offset += length
+		ecc := reedSolomonRemainder(block, divisor)
+		if i < shortBlocks {
+			block = append(block, 0) // Placeholder, skipped when interleaving
+		}
+		allBlocks = append(allBlocks, append(block, ecc...))
+	}
+
+	result := make([]byte, 0, rawCodewords)
+	for i := range allBlocks[0] {
+		for j, block := range allBlocks {
+			if i != shortBlockLength-eccLength || j >= shortBlocks {
+				result = append(result, block[i])
+			}
+		}
+	}
+	return result
+}
+
+// drawCodewords places the codewords in the two module wide columns, zigzagging up and down from the right.
+func (code *Code) drawCodewords(codewords []byte) {
+	i := 0
+	for right := code.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			// Skip the vertical timing pattern
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vertical := 0; vertical < code.Size; vertical++ {
+			for j := 0; j < 2; j++ {
+				x, y := right-j, vertical
+				if upward {
+					y = code.Size - 1 - vertical
+				}
+				if code.function[y][x] || i >= len(codewords)*8 {
+					continue
+				}
+				code.modules[y][x] = (codewords[i>>3]>>(7-i&7))&1 != 0
+				i++
+			}
+		}
+	}
+}
+
+// applyMask XORs the data modules with the mask pattern.
+func (code *Code) applyMask(mask int) {
+	for y := 0; y < code.Size; y++ {
+		for x := 0; x < code.Size; x++ {
+			if !code.function[y][x] && maskBit(mask, x, y) {
+				code.modules[y][x] = !code.modules[y][x]
+			}
+		}
+	}
+}
+
+func maskBit(mask int, x int, y int) bool {
+	switch mask {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	default:
+		return ((x+y)%2+x*y%3)%2 == 0
+	}
+}
+
+// penalty scores the modules for choosing the mask: Long runs, 2x2 blocks, finder-like patterns and dark/light imbalance.
+func (code *Code) penalty() int {
+	result := 0
+	size := code.Size
+	for _, transposed := range []bool{false, true} {
+		get := func(a int, b int) bool {
+			if transposed {
+				return code.modules[a][b]
+			}
+			return code.modules[b][a]
+		}
+		for line := 0; line < size; line++ {
+			run := 1
+			for i := 1; i <= size; i++ {
+				if i < size && get(i, line) == get(i-1, line) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					result += penaltyRun + run - 5
+				}
+				run = 1
+			}
+			// Dark-light-dark-dark-dark-light-dark with four light modules on either side
+			for i := 0; i+7 <= size; i++ {
+				if !(get(i, line) && !get(i+1, line) && get(i+2, line) && get(i+3, line) && get(i+4, line) && !get(i+5, line) && get(i+6, line)) {
+					continue
+				}
+				if lightRun(get, line, i-4, i, size) || lightRun(get, line, i+7, i+11, size) {
+					result += penaltyFinder
+				}
+			}
+		}
+	}
+
+	dark := 0
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			if code.modules[y][x] {
+				dark++
+			}
+			if x+1 < size && y+1 < size {
+				color := code.modules[y][x]
+				if code.modules[y][x+1] == color && code.modules[y+1][x] == color && code.modules[y+1][x+1] == color {
+					result += penaltyBlock
+				}
+			}
+		}
+	}
+	total := size * size
+	difference := dark*20 - total*10
+	if difference < 0 {
+		difference = -difference
+	}
+	result += ((difference+total-1)/total - 1) * penaltyDark
+	return result
+}
+
+// lightRun checks if the modules from start to end (exclusive) on the line are light, counting the outside as light.
+func lightRun(get func(int, int) bool, line int, start int, end int, size int) bool {
+	for i := start; i < end; i++ {
+		if i >= 0 && i < size && get(i, line) {
+			return false
+		}
+	}
+	return true
+}
+
+func (code *Code) setFunction(x int, y int, dark bool) {
+	code.modules[y][x] = dark
+	code.function[y][x] = true
+}
+
+func chebyshev(dx int, dy int) int {
+	if dx < 0 {
+		dx = -dx
+	}
+	if dy < 0 {
+		dy = -dy
+	}
+	if dx > dy {
+		return dx
+	}
+	return dy
+}
+
+// reedSolomonDivisor computes the generator polynomial of the degree, highest coefficient first and without the leading 1.
+func reedSolomonDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMultiply(root, 0x02)
+	}
+	return result
+}
+
+// reedSolomonRemainder computes the error correction codewords of the data.
+func reedSolomonRemainder(data []byte, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, coefficient := range divisor {
+			result[i] ^= gfMultiply(coefficient, factor)
+		}
+	}
+	return result
+}
+
+// gfMultiply multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func gfMultiply(x byte, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>uint(i))&1) * int(x)
+	}
+	return byte(z)
+}
+
+// bitBuffer is a sequence of bits.
+type bitBuffer []bool
+
+// append appends the lowest bits of the value, most significant first.
+func (buffer *bitBuffer) append(value int, length int) {
+	for i := length - 1; i >= 0; i-- {
+		*buffer = append(*buffer, (value>>uint(i))&1 != 0)
+	}
+}
+
+// bytes packs the bits, which must be a multiple of 8.
+func (buffer bitBuffer) bytes() []byte {
+	result := make([]byte, len(buffer)/8)
+	for i, bit := range buffer {
+		if bit {
+			result[i>>3] |= 1 << uint(7-i&7)
+		}
+	}
+	return result
+}
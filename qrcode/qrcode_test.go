@@ -0,0 +1,221 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package qrcode
+
+import (
+	"bytes"
+	"image/png"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReedSolomon(t *testing.T) {
+	// Version 1-M "01234567" from the example in ISO/IEC 18004 annex I
+	data := []byte{0x10, 0x20, 0x0C, 0x56, 0x61, 0x80, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11}
+	expected := []byte{0xA5, 0x24, 0xD4, 0xC1, 0xED, 0x36, 0xC7, 0x87, 0x2C, 0x55}
+	if ecc := reedSolomonRemainder(data, reedSolomonDivisor(10)); !bytes.Equal(ecc, expected) {
+		t.Errorf("ecc = %x, expected %x", ecc, expected)
+	}
+}
+
+func TestByteCapacity(t *testing.T) {
+	// From the capacity table of the standard
+	expected := map[int][4]int{
+		1:  {17, 14, 11, 7},
+		5:  {106, 84, 60, 44},
+		10: {271, 213, 151, 119},
+		20: {858, 666, 482, 382},
+		40: {2953, 2331, 1663, 1273},
+	}
+	for version, capacities := range expected {
+		for level, capacity := range capacities {
+			if got := byteCapacity(version, Level(level)); got != capacity {
+				t.Errorf("version %v level %v: capacity %v, expected %v", version, level, got, capacity)
+			}
+		}
+	}
+}
+
+func TestFormatAndVersionBits(t *testing.T) {
+	for level, expected := range []int{0x77C4, 0x5412, 0x355F, 0x1689} {
+		if bits := formatBits(Level(level), 0); bits != expected {
+			t.Errorf("format bits of level %v mask 0: %x, expected %x", level, bits, expected)
+		}
+	}
+	if bits := versionBits(7); bits != 0x07C94 {
+		t.Errorf("version bits of version 7: %x, expected 7c94", bits)
+	}
+	if positions := alignmentPositions(32); !reflect.DeepEqual(positions, []int{6, 34, 60, 86, 112, 138}) {
+		t.Errorf("alignment positions of version 32: %v", positions)
+	}
+}
+
+// decode reads the byte mode data back from the code, without error correction.
+func decode(t *testing.T, code *Code) string {
+	// Format information, first copy
+	bits := 0
+	for i := 0; i <= 5; i++ {
+		if code.Dark(8, i) {
+			bits |= 1 << i
+		}
+	}
+	for i, position := range [][2]int{{8, 7}, {8, 8}, {7, 8}} {
+		if code.Dark(position[0], position[1]) {
+			bits |= 1 << (6 + i)
+		}
+	}
+	for i := 9; i < 15; i++ {
+		if code.Dark(14-i, 8) {
+			bits |= 1 << i
+		}
+	}
+	bits ^= 0x5412
+	mask := (bits >> 10) & 7
+	if formatLevelBits[code.Level] != bits>>13 {
+		t.Fatalf("format level bits %v don't match level %v", bits>>13, code.Level)
+	}
+
+	// Codewords, unmasked
+	reference := newCode(code.Version, code.Level)
+	for y := 0; y < code.Size; y++ {
+		for x := 0; x < code.Size; x++ {
+			reference.modules[y][x] = code.modules[y][x]
+		}
+	}
+	reference.applyMask(mask)
+	var codewords []byte
+	var current, count int
+	for right := code.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vertical := 0; vertical < code.Size; vertical++ {
+			for j := 0; j < 2; j++ {
+				x, y := right-j, vertical
+				if (right+1)&2 == 0 {
+					y = code.Size - 1 - vertical
+				}
+				if reference.function[y][x] {
+					continue
+				}
+				current <<= 1
+				if reference.modules[y][x] {
+					current |= 1
+				}
+				if count++; count%8 == 0 {
+					codewords = append(codewords, byte(current))
+					current = 0
+				}
+			}
+		}
+	}
+
+	// Deinterleave the data codewords
+	blocks := eccBlocks[code.Level][code.Version]
+	eccLength := eccCodewordsPerBlock[code.Level][code.Version]
+	rawCodewords := rawDataModules(code.Version) / 8
+	shortBlocks := blocks - rawCodewords%blocks
+	shortDataLength := rawCodewords/blocks - eccLength
+	dataBlocks := make([][]byte, blocks)
+	index := 0
+	for i := 0; i <= shortDataLength; i++ {
+		for j := range dataBlocks {
+			if i < shortDataLength || j >= shortBlocks {
+				dataBlocks[j] = append(dataBlocks[j], codewords[index])
+				index++
+			}
+		}
+	}
+	data := bytes.Join(dataBlocks, nil)
+
+	// Byte mode segment
+	if data[0]>>4 != 0x4 {
+		t.Fatalf("mode %x, expected byte mode", data[0]>>4)
+	}
+	if charCountBits(code.Version) == 8 {
+		length := int(data[0]&0xF)<<4 | int(data[1]>>4)
+		var text []byte
+		for i := 0; i < length; i++ {
+			text = append(text, data[1+i]<<4|data[2+i]>>4)
+		}
+		return string(text)
+	}
+	length := int(data[0]&0xF)<<12 | int(data[1])<<4 | int(data[2]>>4)
+	var text []byte
+	for i := 0; i < length; i++ {
+		text = append(text, data[2+i]<<4|data[3+i]>>4)
+	}
+	return string(text)
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	tests := []struct {
+		text    string
+		level   Level
+		version int
+	}{
+		{"https://techo.example/", LevelM, 2},
+		{strings.Repeat("station ", 12), LevelQ, 8},
+		{strings.Repeat("https://techo.example/document/net/intro/", 10), LevelH, 22},
+		{strings.Repeat("x", 2953), LevelL, 40},
+	}
+	for _, test := range tests {
+		code, err := Encode([]byte(test.text), test.level)
+		if err != nil {
+			t.Fatalf("%v bytes: %v", len(test.text), err)
+		}
+		if code.Version != test.version || code.Size != test.version*4+17 {
+			t.Errorf("%v bytes: version %v, expected %v", len(test.text), code.Version, test.version)
+		}
+		if decoded := decode(t, code); decoded != test.text {
+			t.Errorf("%v bytes: decoded %q", len(test.text), decoded)
+		}
+	}
+	if _, err := Encode(make([]byte, 2954), LevelL); err == nil {
+		t.Errorf("too long data encoded")
+	}
+}
+
+func TestRender(t *testing.T) {
+	data, contentType, err := Render("https://techo.example/", FormatPNG, 200, LevelM)
+	if err != nil || contentType != "image/png" {
+		t.Fatalf("render failed: %v, %v", contentType, err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Version 2 is 25 modules, plus the quiet zone, at 6 pixels per module
+	if bounds := img.Bounds(); bounds.Dx() != 198 || bounds.Dy() != 198 {
+		t.Errorf("size %v, expected 198x198", bounds)
+	}
+	if r, _, _, _ := img.At(4*6, 4*6).RGBA(); r != 0 {
+		t.Errorf("top left finder module is not dark")
+	}
+
+	svg, contentType, err := Render("https://techo.example/", FormatSVG, 300, LevelM)
+	if err != nil || contentType != "image/svg+xml" || !bytes.Contains(svg, []byte(`viewBox="0 0 33 33"`)) {
+		t.Errorf("unexpected SVG: %v, %s", err, svg)
+	}
+	if _, _, err := Render("x", "gif", 100, LevelM); err == nil {
+		t.Errorf("invalid format rendered")
+	}
+}
@@ -0,0 +1,157 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package qrcode
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"strconv"
+	"sync"
+)
+
+// Image formats
+const (
+	FormatPNG = "png"
+	FormatSVG = "svg"
+)
+
+const (
+	// QuietZone is the light border around the code, in modules.
+	QuietZone = 4
+
+	maxCacheEntries = 1000
+)
+
+type cacheKey struct {
+	text   string
+	format string
+	size   int
+	level  Level
+}
+
+// cache contains rendered images, since the same codes are typically requested again (e.g. when reprinting).
+var cache = make(map[cacheKey][]byte)
+var cacheLock sync.Mutex
+
+// Render encodes the text and renders it in the format, returning the image and the content type.
+// Images are cached.
+func Render(text string, format string, size int, level Level) ([]byte, string, error) {
+	contentType := ContentType(format)
+	if contentType == "" {
+		return nil, "", fmt.Errorf("invalid format: %v", format)
+	}
+	key := cacheKey{text: text, format: format, size: size, level: level}
+	cacheLock.Lock()
+	data, ok := cache[key]
+	cacheLock.Unlock()
+	if ok {
+		return data, contentType, nil
+	}
+
+	code, err := Encode([]byte(text), level)
+	if err != nil {
+		return nil, "", err
+	}
+	if format == FormatSVG {
+		data = code.SVG(size)
+	} else if data, err = code.PNG(size); err != nil {
+		return nil, "", err
+	}
+
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	// Just start over if full, like the ETag cache
+	if len(cache) >= maxCacheEntries {
+		cache = make(map[cacheKey][]byte)
+	}
+	cache[key] = data
+	return data, contentType, nil
+}
+
+// ContentType returns the content type of the format, or empty if invalid.
+func ContentType(format string) string {
+	switch format {
+	case FormatPNG:
+		return "image/png"
+	case FormatSVG:
+		return "image/svg+xml"
+	}
+	return ""
+}
+
+// PNG renders the code with the quiet zone as a black and white PNG at most size pixels wide,
+// using a whole number of pixels (at least one) per module.
+func (code *Code) PNG(size int) ([]byte, error) {
+	modules := code.Size + 2*QuietZone
+	scale := size / modules
+	if scale < 1 {
+		scale = 1
+	}
+	img := image.NewPaletted(image.Rect(0, 0, modules*scale, modules*scale), color.Palette{color.White, color.Black})
+	for y := 0; y < code.Size; y++ {
+		for x := 0; x < code.Size; x++ {
+			if !code.Dark(x, y) {
+				continue
+			}
+			for py := (y + QuietZone) * scale; py < (y+QuietZone+1)*scale; py++ {
+				for px := (x + QuietZone) * scale; px < (x+QuietZone+1)*scale; px++ {
+					img.SetColorIndex(px, py, 1)
+				}
+			}
+		}
+	}
+	var buffer bytes.Buffer
+	if err := png.Encode(&buffer, img); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// SVG renders the code with the quiet zone as an SVG size pixels wide, with one path of the dark modules.
+func (code *Code) SVG(size int) []byte {
+	modules := strconv.Itoa(code.Size + 2*QuietZone)
+	var path bytes.Buffer
+	for y := 0; y < code.Size; y++ {
+		for x := 0; x < code.Size; x++ {
+			if !code.Dark(x, y) {
+				continue
+			}
+			// Merge the horizontal run
+			run := 1
+			for code.Dark(x+run, y) {
+				run++
+			}
+			fmt.Fprintf(&path, "M%v %vh%vv1h-%vz", x+QuietZone, y+QuietZone, run, run)
+			x += run - 1
+		}
+	}
+	var svg bytes.Buffer
+	fmt.Fprintf(&svg, `<?xml version="1.0" encoding="UTF-8"?>`+"\n")
+	fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" version="1.1" width="%v" height="%v" viewBox="0 0 %v %v" shape-rendering="crispEdges">`+"\n",
+		size, size, modules, modules)
+	fmt.Fprintf(&svg, `<rect width="100%%" height="100%%" fill="#ffffff"/>`+"\n")
+	fmt.Fprintf(&svg, `<path d="%v" fill="#000000"/>`+"\n", path.String())
+	fmt.Fprintf(&svg, "</svg>\n")
+	return svg.Bytes()
+}
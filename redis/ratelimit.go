@@ -0,0 +1,77 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package redis
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gathering/tech-online-backend/helper"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// rateLimitScript is a sliding window in a sorted set of event times (ms), like helper.RateLimiter.
+// It returns if allowed and else the ms until the next event would be allowed.
+const rateLimitScript = `
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+if redis.call('ZCARD', KEYS[1]) >= limit then
+	local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+	return {0, tonumber(oldest[2]) + window - now}
+end
+redis.call('ZADD', KEYS[1], now, ARGV[4])
+redis.call('PEXPIRE', KEYS[1], window)
+return {1, 0}
+`
+
+// rateLimitBackend keeps the events of a rate limiter in Redis.
+type rateLimitBackend struct {
+	name string
+}
+
+// NewRateLimiter creates a rate limiter shared between instances through Redis if configured, else in-memory.
+// The name separates the keys of different limiters.
+func NewRateLimiter(name string, limit int, window time.Duration) *helper.RateLimiter {
+	if !Enabled() {
+		return helper.NewRateLimiter(limit, window)
+	}
+	return helper.NewRateLimiterWithBackend(limit, window, rateLimitBackend{name: name})
+}
+
+func (backend rateLimitBackend) Allow(key string, limit int, window time.Duration) (bool, time.Duration, error) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	reply, err := Do("EVAL", rateLimitScript, 1, Key("ratelimit:"+backend.name+":"+key),
+		now, window.Milliseconds(), limit, fmt.Sprintf("%v-%v", now, uuid.New()))
+	if err != nil {
+		log.WithError(err).WithField("limiter", backend.name).Warn("Redis rate limiting failed, limiting in-process")
+		return false, 0, err
+	}
+	items, ok := reply.([]interface{})
+	if !ok || len(items) != 2 {
+		return false, 0, fmt.Errorf("redis: unexpected rate limit reply: %v", reply)
+	}
+	allowed, _ := items[0].(int64)
+	wait, _ := items[1].(int64)
+	return allowed == 1, time.Duration(wait) * time.Millisecond, nil
+}
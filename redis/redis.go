@@ -0,0 +1,276 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+// Package redis is a minimal Redis client (RESP2 over TCP) for state shared between backend instances.
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+)
+
+const (
+	defaultKeyPrefix = "techo:"
+	dialTimeout      = 5 * time.Second
+	commandTimeout   = 5 * time.Second
+	maxIdleConns     = 8
+	retryDelay       = 10 * time.Second // How long to skip Redis after a connection failure, so requests don't wait for timeouts
+)
+
+// ErrNil is returned for nil replies, e.g. getting a missing key.
+var ErrNil = errors.New("redis: nil reply")
+
+// ErrUnavailable is returned without trying while waiting to retry after a connection failure.
+var ErrUnavailable = errors.New("redis: unavailable")
+
+// Error is an error reply from the server.
+type Error string
+
+func (err Error) Error() string {
+	return string(err)
+}
+
+// conn is a connection with buffered reading.
+type conn struct {
+	netConn net.Conn
+	reader  *bufio.Reader
+}
+
+var idleConns []*conn
+var idleConnsLock sync.Mutex
+var unavailableUntil time.Time // Protected by idleConnsLock
+
+// Enabled checks if Redis is configured.
+func Enabled() bool {
+	return config.Config.Redis.Address != ""
+}
+
+// Key returns the key with the configured prefix.
+func Key(key string) string {
+	prefix := config.Config.Redis.KeyPrefix
+	if prefix == "" {
+		prefix = defaultKeyPrefix
+	}
+	return prefix + key
+}
+
+// Do sends the command and returns the reply: a string, int64, []interface{} or nil (with ErrNil).
+// Arguments are sent as strings (formatted with fmt if not strings or byte slices).
+func Do(args ...interface{}) (interface{}, error) {
+	c, err := getConn()
+	if err != nil {
+		if err != ErrUnavailable {
+			markUnavailable()
+		}
+		return nil, err
+	}
+	reply, err := c.do(args)
+	var replyErr Error
+	if err == nil || errors.Is(err, ErrNil) || errors.As(err, &replyErr) {
+		putConn(c)
+	} else {
+		c.netConn.Close()
+		markUnavailable()
+	}
+	return reply, err
+}
+
+// markUnavailable skips Redis for a while after a connection failure.
+func markUnavailable() {
+	idleConnsLock.Lock()
+	defer idleConnsLock.Unlock()
+	unavailableUntil = time.Now().Add(retryDelay)
+}
+
+// String converts a reply from Do to a string.
+func String(reply interface{}, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	switch reply := reply.(type) {
+	case string:
+		return reply, nil
+	case int64:
+		return strconv.FormatInt(reply, 10), nil
+	}
+	return "", fmt.Errorf("redis: unexpected reply type %T", reply)
+}
+
+// Int64 converts a reply from Do to an integer.
+func Int64(reply interface{}, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	switch reply := reply.(type) {
+	case int64:
+		return reply, nil
+	case string:
+		return strconv.ParseInt(reply, 10, 64)
+	}
+	return 0, fmt.Errorf("redis: unexpected reply type %T", reply)
+}
+
+// getConn gets an idle connection or connects, authenticating and selecting the database.
+func getConn() (*conn, error) {
+	idleConnsLock.Lock()
+	if time.Now().Before(unavailableUntil) {
+		idleConnsLock.Unlock()
+		return nil, ErrUnavailable
+	}
+	if len(idleConns) > 0 {
+		c := idleConns[len(idleConns)-1]
+		idleConns = idleConns[:len(idleConns)-1]
+		idleConnsLock.Unlock()
+		return c, nil
+	}
+	idleConnsLock.Unlock()
+
+	netConn, err := net.DialTimeout("tcp", config.Config.Redis.Address, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &conn{netConn: netConn, reader: bufio.NewReader(netConn)}
+	if config.Config.Redis.Password != "" {
+		if _, err := c.do([]interface{}{"AUTH", config.Config.Redis.Password}); err != nil {
+			netConn.Close()
+			return nil, fmt.Errorf("redis auth: %v", err)
+		}
+	}
+	if config.Config.Redis.DB != 0 {
+		if _, err := c.do([]interface{}{"SELECT", config.Config.Redis.DB}); err != nil {
+			netConn.Close()
+			return nil, fmt.Errorf("redis select: %v", err)
+		}
+	}
+	return c, nil
+}
+
+// putConn keeps the connection for reuse, or closes it if there are enough idle ones.
+func putConn(c *conn) {
+	idleConnsLock.Lock()
+	defer idleConnsLock.Unlock()
+	if len(idleConns) >= maxIdleConns {
+		c.netConn.Close()
+		return
+	}
+	idleConns = append(idleConns, c)
+}
+
+func (c *conn) do(args []interface{}) (interface{}, error) {
+	c.netConn.SetDeadline(time.Now().Add(commandTimeout))
+	if _, err := c.netConn.Write(encodeCommand(args)); err != nil {
+		return nil, err
+	}
+	return readReply(c.reader)
+}
+
+// encodeCommand encodes the command as an array of bulk strings.
+func encodeCommand(args []interface{}) []byte {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		var value string
+		switch arg := arg.(type) {
+		case string:
+			value = arg
+		case []byte:
+			value = string(arg)
+		default:
+			value = fmt.Sprint(arg)
+		}
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(value)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, value...)
+		buf = append(buf, '\r', '\n')
+	}
+	return buf
+}
+
+// readReply reads a reply. Error replies are returned as Error, and nil replies as ErrNil.
+func readReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := readLine(reader)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, Error(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid bulk length: %v", line)
+		}
+		if length < 0 {
+			return nil, ErrNil
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:length]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid array length: %v", line)
+		}
+		if count < 0 {
+			return nil, ErrNil
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			item, err := readReply(reader)
+			if err != nil && !errors.Is(err, ErrNil) {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type: %q", line[0])
+}
+
+func readLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("redis: malformed line")
+	}
+	return line[:len(line)-2], nil
+}
@@ -0,0 +1,164 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+)
+
+func TestEncodeCommand(t *testing.T) {
+	encoded := string(encodeCommand([]interface{}{"SET", "key", []byte("a b"), 42}))
+	expected := "*4\r\n$3\r\nSET\r\n$3\r\nkey\r\n$3\r\na b\r\n$2\r\n42\r\n"
+	if encoded != expected {
+		t.Errorf("encoded = %q, expected %q", encoded, expected)
+	}
+}
+
+func TestReadReply(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+		err      error
+	}{
+		{"+OK\r\n", "OK", nil},
+		{":-12\r\n", int64(-12), nil},
+		{"$5\r\nhe\r\nl\r\n", "he\r\nl", nil},
+		{"$-1\r\n", nil, ErrNil},
+		{"*3\r\n:1\r\n$-1\r\n+x\r\n", []interface{}{int64(1), nil, "x"}, nil},
+		{"-ERR wrong\r\n", nil, Error("ERR wrong")},
+	}
+	for _, test := range tests {
+		reply, err := readReply(bufio.NewReader(strings.NewReader(test.input)))
+		if err != test.err || !reflect.DeepEqual(reply, test.expected) {
+			t.Errorf("%q: got %#v, %v, expected %#v, %v", test.input, reply, err, test.expected, test.err)
+		}
+	}
+}
+
+// reset closes the idle connections and forgets connection failures.
+func reset() {
+	for _, c := range idleConns {
+		c.netConn.Close()
+	}
+	idleConns = nil
+	unavailableUntil = time.Time{}
+	config.Config.Redis = config.RedisConfig{}
+}
+
+// serveFake serves a fake Redis with AUTH, GET and SET, recording the commands.
+func serveFake(listener net.Listener, commands chan<- string) {
+	values := make(map[string]string)
+	for {
+		netConn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer netConn.Close()
+			reader := bufio.NewReader(netConn)
+			for {
+				reply, err := readReply(reader)
+				if err != nil {
+					return
+				}
+				var args []string
+				for _, arg := range reply.([]interface{}) {
+					args = append(args, arg.(string))
+				}
+				commands <- strings.Join(args, " ")
+				switch args[0] {
+				case "AUTH":
+					netConn.Write([]byte("+OK\r\n"))
+				case "SET":
+					values[args[1]] = args[2]
+					netConn.Write([]byte("+OK\r\n"))
+				case "GET":
+					if value, ok := values[args[1]]; ok {
+						netConn.Write(encodeCommand([]interface{}{value})[4:])
+					} else {
+						netConn.Write([]byte("$-1\r\n"))
+					}
+				default:
+					netConn.Write([]byte("-ERR unknown command\r\n"))
+				}
+			}
+		}()
+	}
+}
+
+func TestDo(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	commands := make(chan string, 100)
+	go serveFake(listener, commands)
+	defer reset()
+	config.Config.Redis = config.RedisConfig{Address: listener.Addr().String(), Password: "secret"}
+
+	if err := Set("a", "value", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := Get("a"); err != nil || value != "value" {
+		t.Errorf("get = %q, %v", value, err)
+	}
+	if _, err := Get("b"); err != ErrNil {
+		t.Errorf("get missing = %v, expected ErrNil", err)
+	}
+	var replyErr Error
+	if _, err := Do("NOPE"); !errors.As(err, &replyErr) {
+		t.Errorf("unknown command = %v, expected an error reply", err)
+	}
+
+	// One connection, authenticated once and reused after the error reply
+	expected := []string{"AUTH secret", "SET techo:a value PX 60000", "GET techo:a", "GET techo:b", "NOPE"}
+	for _, command := range expected {
+		if got := <-commands; got != command {
+			t.Errorf("command = %q, expected %q", got, command)
+		}
+	}
+}
+
+func TestUnavailable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	defer reset()
+	config.Config.Redis = config.RedisConfig{Address: address}
+
+	if _, err := Do("PING"); err == nil || err == ErrUnavailable {
+		t.Errorf("first failure = %v, expected a connection error", err)
+	}
+	if _, err := Do("PING"); err != ErrUnavailable {
+		t.Errorf("retry = %v, expected ErrUnavailable", err)
+	}
+}
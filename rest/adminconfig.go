@@ -0,0 +1,55 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"github.com/gathering/tech-online-backend/config"
+)
+
+// EffectiveConfig is the config the running instance has loaded, with secrets redacted.
+type EffectiveConfig struct {
+	Version string                 `json:"version"`
+	File    string                 `json:"file"`
+	Config  map[string]interface{} `json:"config"`
+}
+
+func init() {
+	AddHandler("/admin/config/", "^$", func() interface{} { return &EffectiveConfig{} })
+}
+
+// Get gets the loaded config, including reloaded sections.
+func (effectiveConfig *EffectiveConfig) Get(request *Request) Result {
+	// Check perms
+	role := request.AccessToken.GetRole()
+	if role != RoleOperator && role != RoleAdmin {
+		return UnauthorizedResult(request.AccessToken)
+	}
+
+	// Get
+	redacted, err := config.Redacted()
+	if err != nil {
+		return Result{Code: 500, Error: err}
+	}
+	effectiveConfig.Version = config.Version
+	effectiveConfig.File = config.File()
+	effectiveConfig.Config = redacted
+	return Result{}
+}
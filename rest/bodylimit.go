@@ -0,0 +1,64 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+
+	"github.com/gathering/tech-online-backend/config"
+)
+
+// defaultMaxBodyBytes is the max size of request bodies for handlers without a higher limit.
+const defaultMaxBodyBytes = 4 * 1024 * 1024
+
+// errBodyTooLarge is returned when reading a request body larger than the limit of the receiver.
+var errBodyTooLarge = errors.New("request body too large")
+
+var bodyLimits = make(map[reflect.Type]func() int64)
+var bodyLimitsLock sync.RWMutex
+
+// SetBodyLimit registers a body size limit for the handler type (by an item like the ones from its allocator),
+// for handlers taking uploads larger than the global limit. It's a function so it may follow config reloads.
+func SetBodyLimit(item interface{}, limit func() int64) {
+	bodyLimitsLock.Lock()
+	defer bodyLimitsLock.Unlock()
+	bodyLimits[reflect.TypeOf(item)] = limit
+}
+
+// getBodyLimit gets the body size limit for the receiver, or the global limit if none (or no receiver).
+func getBodyLimit(receiver *receiver) int64 {
+	globalLimit := config.Config.HTTPServer.MaxBodyBytes
+	if globalLimit <= 0 {
+		globalLimit = defaultMaxBodyBytes
+	}
+	if receiver == nil {
+		return globalLimit
+	}
+	bodyLimitsLock.RLock()
+	limit, ok := bodyLimits[reflect.TypeOf(receiver.allocator())]
+	bodyLimitsLock.RUnlock()
+	if ok && limit() > globalLimit {
+		return limit()
+	}
+	return globalLimit
+}
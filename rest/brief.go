@@ -0,0 +1,109 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Briefer may be implemented by list handler data with its own brief representation, for "?brief".
+// Other lists of structs are reduced to the fields tagged with `brief:"true"`, if any.
+type Briefer interface {
+	Brief() interface{}
+}
+
+// briefField is a field of a struct type to keep in brief representations.
+type briefField struct {
+	index []int
+	name  string // JSON name
+}
+
+// briefFieldCache caches the brief fields by struct type.
+var briefFieldCache sync.Map
+
+// briefData gets the brief representation of list handler data, or nil if it has none.
+func briefData(data interface{}) interface{} {
+	if briefer, ok := data.(Briefer); ok {
+		return briefer.Brief()
+	}
+
+	list := reflect.ValueOf(data)
+	for list.Kind() == reflect.Ptr && !list.IsNil() {
+		list = list.Elem()
+	}
+	if list.Kind() != reflect.Slice {
+		return nil
+	}
+	elementType := list.Type().Elem()
+	for elementType.Kind() == reflect.Ptr {
+		elementType = elementType.Elem()
+	}
+	if elementType.Kind() != reflect.Struct {
+		return nil
+	}
+	fields := briefFields(elementType)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	brief := make([]map[string]interface{}, 0, list.Len())
+	for i := 0; i < list.Len(); i++ {
+		element := list.Index(i)
+		for element.Kind() == reflect.Ptr && !element.IsNil() {
+			element = element.Elem()
+		}
+		if element.Kind() != reflect.Struct {
+			continue
+		}
+		briefElement := make(map[string]interface{}, len(fields))
+		for _, field := range fields {
+			briefElement[field.name] = element.FieldByIndex(field.index).Interface()
+		}
+		brief = append(brief, briefElement)
+	}
+	return brief
+}
+
+// briefFields gets the fields of the struct type tagged as brief, with their JSON names.
+func briefFields(structType reflect.Type) []briefField {
+	if cached, ok := briefFieldCache.Load(structType); ok {
+		return cached.([]briefField)
+	}
+	var fields []briefField
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if field.Tag.Get("brief") != "true" {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields = append(fields, briefField{index: field.Index, name: name})
+	}
+	briefFieldCache.Store(structType, fields)
+	return fields
+}
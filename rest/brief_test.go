@@ -0,0 +1,56 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package rest
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/gathering/tech-online-backend/helper"
+)
+
+type briefTestItem struct {
+	ID      string `json:"id" brief:"true"`
+	Name    string `json:"name,omitempty" brief:"true"`
+	Content string `json:"content"`
+}
+
+type briefTestItems []*briefTestItem
+
+type briefTestCustom []string
+
+func (custom *briefTestCustom) Brief() interface{} {
+	return len(*custom)
+}
+
+func TestBriefData(t *testing.T) {
+	items := briefTestItems{{ID: "a", Name: "A", Content: "long"}, nil, {ID: "b", Content: "longer"}}
+	data, err := json.Marshal(briefData(&items))
+	helper.CheckEqual(t, err, nil)
+	helper.CheckEqual(t, string(data), `[{"id":"a","name":"A"},{"id":"b","name":""}]`)
+
+	// Not lists or without brief fields
+	helper.CheckEqual(t, briefData(items[0]), nil)
+	helper.CheckEqual(t, briefData(&[]*Result{{Message: "x"}}), nil)
+	helper.CheckEqual(t, briefData(&[]string{"x"}), nil)
+
+	custom := briefTestCustom{"x", "y"}
+	helper.CheckEqual(t, briefData(&custom), 2)
+}
@@ -0,0 +1,40 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ConfirmDeleteHeader must be "true" for bulk deletes on collection endpoints, so a misspelled filter doesn't empty the table.
+const ConfirmDeleteHeader = "X-Confirm-Delete"
+
+// CheckBulkDelete checks that a bulk delete is filtered, by the where args for the DB layer, and confirmed by the header.
+func CheckBulkDelete(request *Request, whereArgs []interface{}) Result {
+	if len(whereArgs) == 0 {
+		return Result{Code: 400, Message: "bulk delete requires at least one filter"}
+	}
+	if !strings.EqualFold(request.Header.Get(ConfirmDeleteHeader), "true") {
+		return Result{Code: 428, Message: fmt.Sprintf("bulk delete must be confirmed with the %v header", ConfirmDeleteHeader)}
+	}
+	return Result{}
+}
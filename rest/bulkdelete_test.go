@@ -0,0 +1,41 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package rest
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gathering/tech-online-backend/helper"
+)
+
+func TestCheckBulkDelete(t *testing.T) {
+	request := &Request{Header: http.Header{}}
+	whereArgs := []interface{}{"track", "=", "net"}
+
+	helper.CheckEqual(t, CheckBulkDelete(request, nil).Code, 400)
+	helper.CheckEqual(t, CheckBulkDelete(request, whereArgs).Code, 428)
+	request.Header.Set(ConfirmDeleteHeader, "yes")
+	helper.CheckEqual(t, CheckBulkDelete(request, whereArgs).Code, 428)
+	request.Header.Set(ConfirmDeleteHeader, "true")
+	helper.CheckEqual(t, CheckBulkDelete(request, nil).Code, 400)
+	result := CheckBulkDelete(request, whereArgs)
+	helper.CheckEqual(t, result.IsOk(), true)
+}
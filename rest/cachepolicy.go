@@ -0,0 +1,78 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// CachePolicy is how responses from a handler type may be cached, by clients and proxies (Cache-Control) and by the ETag cache.
+// Handlers without a policy get DefaultCachePolicy.
+type CachePolicy struct {
+	MaxAge     time.Duration // How long clients may use the response without revalidating, 0 to always revalidate
+	Public     bool          // If shared caches may store it, only for responses which don't depend on the token at all
+	VaryByRole bool          // If the response depends on the role only, so the ETag cache is shared between tokens of the same role
+	NoStore    bool          // For live data which must not be stored anywhere, overrides the rest
+}
+
+// DefaultCachePolicy makes clients revalidate every time, using the ETag.
+var DefaultCachePolicy = CachePolicy{}
+
+var cachePolicies = make(map[reflect.Type]CachePolicy)
+var cachePoliciesLock sync.RWMutex
+
+// SetCachePolicy registers the cache policy for the handler type, by an item like the ones from its allocator.
+func SetCachePolicy(item interface{}, policy CachePolicy) {
+	cachePoliciesLock.Lock()
+	defer cachePoliciesLock.Unlock()
+	cachePolicies[reflect.TypeOf(item)] = policy
+}
+
+// getCachePolicy gets the cache policy for the receiver, or the default one if none (or no receiver).
+func getCachePolicy(receiver *receiver) CachePolicy {
+	if receiver == nil {
+		return DefaultCachePolicy
+	}
+	cachePoliciesLock.RLock()
+	defer cachePoliciesLock.RUnlock()
+	if policy, ok := cachePolicies[reflect.TypeOf(receiver.allocator())]; ok {
+		return policy
+	}
+	return DefaultCachePolicy
+}
+
+// header gets the Cache-Control header value for the policy.
+func (policy CachePolicy) header() string {
+	if policy.NoStore {
+		return "no-store"
+	}
+	scope := "private"
+	if policy.Public {
+		scope = "public"
+	}
+	if policy.MaxAge <= 0 {
+		return scope + ", no-cache"
+	}
+	return fmt.Sprintf("%v, max-age=%d", scope, int(policy.MaxAge.Seconds()))
+}
@@ -0,0 +1,88 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package rest
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gathering/tech-online-backend/helper"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+type cachePolicyTestItem struct{}
+
+func TestCachePolicyHeader(t *testing.T) {
+	helper.CheckEqual(t, CachePolicy{}.header(), "private, no-cache")
+	helper.CheckEqual(t, CachePolicy{MaxAge: time.Minute}.header(), "private, max-age=60")
+	helper.CheckEqual(t, CachePolicy{MaxAge: 5 * time.Minute, Public: true}.header(), "public, max-age=300")
+	helper.CheckEqual(t, CachePolicy{MaxAge: time.Minute, Public: true, NoStore: true}.header(), "no-store")
+}
+
+func TestCachePolicyRegistration(t *testing.T) {
+	policy := CachePolicy{MaxAge: time.Hour, Public: true}
+	SetCachePolicy(&cachePolicyTestItem{}, policy)
+	registered := receiver{allocator: func() interface{} { return &cachePolicyTestItem{} }}
+	unregistered := receiver{allocator: func() interface{} { return &struct{}{} }}
+	helper.CheckEqual(t, getCachePolicy(&registered), policy)
+	helper.CheckEqual(t, getCachePolicy(&unregistered), DefaultCachePolicy)
+	helper.CheckEqual(t, getCachePolicy(nil), DefaultCachePolicy)
+}
+
+func TestCachePolicyETagKey(t *testing.T) {
+	in := input{url: &url.URL{Path: "/api/tracks/", RawQuery: "type=net"}}
+	role := RoleParticipant
+	token1 := AccessTokenEntry{ID: uuid.New(), NonUserRole: &role}
+	token2 := AccessTokenEntry{ID: uuid.New(), NonUserRole: &role}
+
+	helper.CheckNotEqual(t, etagCacheKey(in, token1), etagCacheKey(in, token2))
+	in.cachePolicy = CachePolicy{VaryByRole: true}
+	helper.CheckEqual(t, etagCacheKey(in, token1), etagCacheKey(in, token2))
+	in.cachePolicy = CachePolicy{Public: true}
+	helper.CheckEqual(t, etagCacheKey(in, token1), etagCacheKey(in, AccessTokenEntry{}))
+}
+
+func TestCachePolicyResponse(t *testing.T) {
+	in := input{method: "GET", log: log.WithField("test", t.Name()), cachePolicy: CachePolicy{MaxAge: time.Minute, Public: true}}
+	handlerData := &struct{}{}
+
+	recorder := httptest.NewRecorder()
+	sendResponse(recorder, in, processOutput(in, Result{}, handlerData))
+	helper.CheckEqual(t, recorder.Header().Get("Cache-Control"), "public, max-age=60")
+	helper.CheckEqual(t, recorder.Header().Get("Vary"), "")
+
+	in.cachePolicy = CachePolicy{NoStore: true}
+	recorder = httptest.NewRecorder()
+	sendResponse(recorder, in, processOutput(in, Result{}, handlerData))
+	helper.CheckEqual(t, recorder.Header().Get("Cache-Control"), "no-store")
+	helper.CheckEqual(t, recorder.Header().Get("Vary"), "Authorization")
+
+	// Errors and writes aren't cached
+	recorder = httptest.NewRecorder()
+	sendResponse(recorder, in, processOutput(in, Result{Code: 404, Message: "not found"}, handlerData))
+	helper.CheckEqual(t, recorder.Header().Get("Cache-Control"), "")
+	in.method = "PUT"
+	recorder = httptest.NewRecorder()
+	sendResponse(recorder, in, processOutput(in, Result{}, handlerData))
+	helper.CheckEqual(t, recorder.Header().Get("Cache-Control"), "")
+}
@@ -0,0 +1,334 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/google/uuid"
+)
+
+const (
+	captureDefaultSize     = 100
+	captureMaxSize         = 1000
+	captureDefaultMaxBody  = 4096
+	captureDefaultDuration = 30 * time.Minute
+	captureRedacted        = "<redacted>"
+)
+
+// captureSecretKeys are JSON keys and query args whose values are redacted in captures.
+var captureSecretKeys = map[string]bool{
+	"key":           true,
+	"password":      true,
+	"secret":        true,
+	"token":         true,
+	"credentials":   true,
+	"code":          true,
+	"code-verifier": true,
+	"code_verifier": true,
+	"access_token":  true,
+	"flag":          true,
+}
+
+// CaptureSettings is the capture mode, which records full requests and responses for matching paths, for debugging.
+type CaptureSettings struct {
+	Enabled       bool                `json:"enabled"`
+	PathPattern   string              `json:"path_pattern"`        // Regex for the path (without the site prefix), e.g. "^/station/[^/]+/$"
+	Methods       []string            `json:"methods"`             // Methods to capture, all if empty
+	Size          int                 `json:"size"`                // Exchanges to keep, oldest dropped first, defaults to 100
+	MaxBodyBytes  int                 `json:"max_body_bytes"`      // Longer bodies are truncated, defaults to 4096
+	ExpiresTime   *time.Time          `json:"expires_time"`        // Capturing stops after this, defaults to 30 minutes after enabling
+	CapturedCount int                 `json:"captured_count"`      // Exchanges captured since enabling, read-only
+	Exchanges     []*CapturedExchange `json:"exchanges,omitempty"` // In the response, newest first
+}
+
+// CapturedExchange is a captured request and response, with secrets redacted.
+type CapturedExchange struct {
+	RequestID      uuid.UUID `json:"request_id"`
+	Time           time.Time `json:"time"`
+	DurationMillis int64     `json:"duration_millis"`
+	Method         string    `json:"method"`
+	Path           string    `json:"path"`
+	Query          string    `json:"query"`
+	Role           string    `json:"role"`
+	RequestType    string    `json:"request_content_type"`
+	RequestBody    string    `json:"request_body"`
+	ResponseCode   int       `json:"response_code"`
+	ResponseBody   string    `json:"response_body"`
+	Truncated      bool      `json:"truncated"` // If either body was truncated
+}
+
+// captureState is the active capture mode and its ring buffer.
+type captureState struct {
+	lock      sync.Mutex
+	settings  CaptureSettings
+	pattern   *regexp.Regexp
+	exchanges []*CapturedExchange // Ring buffer
+	next      int
+}
+
+var capture captureState
+
+func init() {
+	AddHandler("/debug/capture/", "^$", func() interface{} { return &CaptureSettings{} })
+}
+
+// Get gets the capture mode and the captured exchanges.
+func (settings *CaptureSettings) Get(request *Request) Result {
+	// Check perms
+	if request.AccessToken.GetRole() != RoleAdmin {
+		return UnauthorizedResult(request.AccessToken)
+	}
+
+	// Get
+	capture.lock.Lock()
+	defer capture.lock.Unlock()
+	*settings = capture.settings
+	settings.Enabled = capture.active(time.Now())
+	settings.Exchanges = make([]*CapturedExchange, 0, len(capture.exchanges))
+	for i := 1; i <= len(capture.exchanges); i++ {
+		index := (capture.next - i + len(capture.exchanges)) % len(capture.exchanges)
+		settings.Exchanges = append(settings.Exchanges, capture.exchanges[index])
+	}
+	return Result{}
+}
+
+// Put sets the capture mode, clearing the captured exchanges.
+func (settings *CaptureSettings) Put(request *Request) Result {
+	// Check perms
+	if request.AccessToken.GetRole() != RoleAdmin {
+		return UnauthorizedResult(request.AccessToken)
+	}
+
+	// Validate
+	var pattern *regexp.Regexp
+	if settings.Enabled {
+		var err error
+		if pattern, err = regexp.Compile(settings.PathPattern); err != nil || settings.PathPattern == "" {
+			return Result{Code: 400, Message: "invalid or missing path pattern"}
+		}
+	}
+	if settings.Size <= 0 {
+		settings.Size = captureDefaultSize
+	}
+	if settings.Size > captureMaxSize {
+		return Result{Code: 400, Message: fmt.Sprintf("size above max (%v)", captureMaxSize)}
+	}
+	if settings.MaxBodyBytes <= 0 {
+		settings.MaxBodyBytes = captureDefaultMaxBody
+	}
+	if settings.ExpiresTime == nil {
+		expires := time.Now().Add(captureDefaultDuration)
+		settings.ExpiresTime = &expires
+	}
+	for i, method := range settings.Methods {
+		settings.Methods[i] = strings.ToUpper(method)
+	}
+	settings.CapturedCount = 0
+	settings.Exchanges = nil
+
+	// Set
+	capture.lock.Lock()
+	defer capture.lock.Unlock()
+	capture.settings = *settings
+	capture.pattern = pattern
+	capture.exchanges = make([]*CapturedExchange, 0, settings.Size)
+	capture.next = 0
+	request.Log().WithFields(map[string]interface{}{
+		"enabled": settings.Enabled,
+		"pattern": settings.PathPattern,
+	}).Info("Request capture changed")
+	return Result{}
+}
+
+// Delete disables capturing and clears the captured exchanges.
+func (settings *CaptureSettings) Delete(request *Request) Result {
+	// Check perms
+	if request.AccessToken.GetRole() != RoleAdmin {
+		return UnauthorizedResult(request.AccessToken)
+	}
+
+	capture.lock.Lock()
+	defer capture.lock.Unlock()
+	capture.settings = CaptureSettings{}
+	capture.pattern = nil
+	capture.exchanges = nil
+	capture.next = 0
+	return Result{Code: 204}
+}
+
+// active checks if capturing is enabled and not expired. Must be called with the lock held.
+func (state *captureState) active(now time.Time) bool {
+	return state.settings.Enabled && state.pattern != nil && (state.settings.ExpiresTime == nil || now.Before(*state.settings.ExpiresTime))
+}
+
+// captureExchange records the request and response if they match the capture mode.
+func captureExchange(input input, code int, responseBody []byte, rawResponse bool) {
+	if input.url == nil {
+		// Failed before the input was processed
+		return
+	}
+	now := time.Now()
+	path := strings.TrimPrefix(input.url.Path, config.Config.SitePrefix)
+	if strings.HasPrefix(path, "/debug/capture/") {
+		return
+	}
+
+	capture.lock.Lock()
+	defer capture.lock.Unlock()
+	if !capture.active(now) || !capture.pattern.MatchString(path) {
+		return
+	}
+	if len(capture.settings.Methods) > 0 {
+		found := false
+		for _, method := range capture.settings.Methods {
+			found = found || method == input.method
+		}
+		if !found {
+			return
+		}
+	}
+
+	maxBody := capture.settings.MaxBodyBytes
+	requestBody, requestTruncated := captureBody(input.data, isRawContentType(input.contentType), maxBody)
+	responseBodyText, responseTruncated := captureBody(responseBody, rawResponse, maxBody)
+	exchange := &CapturedExchange{
+		RequestID:      input.requestID,
+		Time:           input.startTime,
+		DurationMillis: now.Sub(input.startTime).Milliseconds(),
+		Method:         input.method,
+		Path:           path,
+		Query:          redactQuery(input.query),
+		RequestType:    input.contentType,
+		RequestBody:    requestBody,
+		ResponseCode:   code,
+		ResponseBody:   responseBodyText,
+		Truncated:      requestTruncated || responseTruncated,
+	}
+	if role, ok := input.log.Data["role"]; ok {
+		exchange.Role = fmt.Sprint(role)
+	}
+
+	if len(capture.exchanges) < capture.settings.Size {
+		capture.exchanges = append(capture.exchanges, exchange)
+	} else {
+		capture.exchanges[capture.next] = exchange
+	}
+	capture.next = (capture.next + 1) % capture.settings.Size
+	capture.settings.CapturedCount++
+}
+
+// PruneCapturedExchanges drops the captured exchanges older than the time, or only counts them for dry runs.
+func PruneCapturedExchanges(before time.Time, dryRun bool) int {
+	capture.lock.Lock()
+	defer capture.lock.Unlock()
+	size := len(capture.exchanges)
+	if size == 0 {
+		return 0
+	}
+
+	// Oldest first, the ring buffer starts at the next index once full
+	start := 0
+	if size == capture.settings.Size {
+		start = capture.next
+	}
+	kept := make([]*CapturedExchange, 0, capture.settings.Size)
+	for i := 0; i < size; i++ {
+		exchange := capture.exchanges[(start+i)%size]
+		if !exchange.Time.Before(before) {
+			kept = append(kept, exchange)
+		}
+	}
+	pruned := size - len(kept)
+	if dryRun || pruned == 0 {
+		return pruned
+	}
+	capture.exchanges = kept
+	capture.next = len(kept) % capture.settings.Size
+	return pruned
+}
+
+// captureBody redacts secrets in JSON bodies and truncates the body. Raw (non-JSON) bodies are only described.
+func captureBody(body []byte, raw bool, maxBytes int) (string, bool) {
+	if len(body) == 0 {
+		return "", false
+	}
+	if raw {
+		return fmt.Sprintf("<%v bytes>", len(body)), false
+	}
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err == nil {
+		redactJSON(value)
+		var buffer bytes.Buffer
+		encoder := json.NewEncoder(&buffer)
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(value); err == nil {
+			body = bytes.TrimSuffix(buffer.Bytes(), []byte("\n"))
+		}
+	}
+	if len(body) > maxBytes {
+		return string(body[:maxBytes]), true
+	}
+	return string(body), false
+}
+
+// redactJSON replaces the values of secret keys within a generic JSON value.
+func redactJSON(value interface{}) {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		for key, child := range typed {
+			if captureSecretKeys[key] {
+				if child != nil && child != "" {
+					typed[key] = captureRedacted
+				}
+				continue
+			}
+			redactJSON(child)
+		}
+	case []interface{}:
+		for _, child := range typed {
+			redactJSON(child)
+		}
+	}
+}
+
+// redactQuery encodes the query args with secret values redacted.
+func redactQuery(query map[string][]string) string {
+	var parts []string
+	for key, values := range query {
+		for _, value := range values {
+			if captureSecretKeys[key] {
+				value = captureRedacted
+			}
+			parts = append(parts, key+"="+value)
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "&")
+}
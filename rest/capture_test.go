@@ -0,0 +1,88 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package rest
+
+import (
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/gathering/tech-online-backend/helper"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestCaptureExchange(t *testing.T) {
+	capture.settings = CaptureSettings{Enabled: true, PathPattern: "^/station/", Size: 2, MaxBodyBytes: 40}
+	capture.pattern = regexp.MustCompile(capture.settings.PathPattern)
+	capture.exchanges = nil
+	capture.next = 0
+	defer func() { capture = captureState{} }()
+
+	newInput := func(path string, body string) input {
+		return input{
+			url:       &url.URL{Path: path},
+			method:    "POST",
+			query:     map[string][]string{"access_token": {"abc"}, "track": {"net"}},
+			data:      []byte(body),
+			startTime: time.Now(),
+			log:       log.WithField("role", "runner"),
+		}
+	}
+	captureExchange(newInput("/timeslot/", `{}`), 200, nil, false)
+	helper.CheckEqual(t, len(capture.exchanges), 0)
+	captureExchange(newInput("/station/", `{"id":"1","credentials":"hunter2"}`), 201, []byte(`{"password":"x"}`), false)
+	helper.CheckEqual(t, len(capture.exchanges), 1)
+	exchange := capture.exchanges[0]
+	helper.CheckEqual(t, exchange.Query, "access_token=<redacted>&track=net")
+	helper.CheckEqual(t, exchange.RequestBody, `{"credentials":"<redacted>","id":"1"}`)
+	helper.CheckEqual(t, exchange.ResponseBody, `{"password":"<redacted>"}`)
+	helper.CheckEqual(t, exchange.Role, "runner")
+
+	// Truncation and ring buffer wraparound
+	captureExchange(newInput("/station/", `{"notes":"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}`), 200, nil, false)
+	helper.CheckEqual(t, capture.exchanges[1].Truncated, true)
+	helper.CheckEqual(t, len(capture.exchanges[1].RequestBody), 40)
+	captureExchange(newInput("/station/", ``), 204, []byte("binary"), true)
+	helper.CheckEqual(t, len(capture.exchanges), 2)
+	helper.CheckEqual(t, capture.exchanges[0].ResponseBody, "<6 bytes>")
+	helper.CheckEqual(t, capture.settings.CapturedCount, 3)
+}
+
+func TestPruneCapturedExchanges(t *testing.T) {
+	capture.settings = CaptureSettings{Enabled: true, Size: 3}
+	defer func() { capture = captureState{} }()
+	now := time.Now()
+	exchangeAt := func(minutes int) *CapturedExchange {
+		return &CapturedExchange{Time: now.Add(time.Duration(minutes) * time.Minute)}
+	}
+
+	// Wrapped around, the oldest (-30) is at the next index
+	capture.exchanges = []*CapturedExchange{exchangeAt(-10), exchangeAt(-5), exchangeAt(-30)}
+	capture.next = 2
+	helper.CheckEqual(t, PruneCapturedExchanges(now.Add(-7*time.Minute), true), 2)
+	helper.CheckEqual(t, len(capture.exchanges), 3)
+	helper.CheckEqual(t, PruneCapturedExchanges(now.Add(-7*time.Minute), false), 2)
+	helper.CheckEqual(t, len(capture.exchanges), 1)
+	helper.CheckEqual(t, capture.exchanges[0].Time, now.Add(-5*time.Minute))
+	helper.CheckEqual(t, capture.next, 1)
+	helper.CheckEqual(t, PruneCapturedExchanges(now, false), 1)
+	helper.CheckEqual(t, len(capture.exchanges), 0)
+}
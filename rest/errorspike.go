@@ -0,0 +1,85 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/event"
+)
+
+const (
+	defaultErrorSpikeThreshold = 10
+	defaultErrorSpikeWindow    = 60 * time.Second
+)
+
+// EventTypeServerErrorSpike is the event for when many requests fail with 5XX errors within a short time.
+const EventTypeServerErrorSpike event.Type = "server.error_spike"
+
+// errorSpikeDetector counts server errors within fixed windows and reports the first spike of each window.
+type errorSpikeDetector struct {
+	lock        sync.Mutex
+	windowStart time.Time
+	count       int
+	reported    bool
+}
+
+var serverErrors errorSpikeDetector
+
+// recordServerError counts a 5XX response and publishes an event if it makes a spike.
+func recordServerError() {
+	threshold := config.Config.CrewAlerts.ErrorSpikeThreshold
+	if threshold <= 0 {
+		threshold = defaultErrorSpikeThreshold
+	}
+	window := defaultErrorSpikeWindow
+	if config.Config.CrewAlerts.ErrorSpikeWindowSeconds > 0 {
+		window = time.Duration(config.Config.CrewAlerts.ErrorSpikeWindowSeconds) * time.Second
+	}
+
+	if count, spike := serverErrors.record(time.Now(), threshold, window); spike {
+		event.Publish(event.Event{
+			Type:    EventTypeServerErrorSpike,
+			Title:   "Server error spike",
+			Message: fmt.Sprintf("%v requests failed with server errors within %v.", count, window),
+		})
+	}
+}
+
+// record counts an error, returning the count in the current window and if it just reached the threshold.
+func (detector *errorSpikeDetector) record(now time.Time, threshold int, window time.Duration) (int, bool) {
+	detector.lock.Lock()
+	defer detector.lock.Unlock()
+	if now.Sub(detector.windowStart) >= window {
+		detector.windowStart = now
+		detector.count = 0
+		detector.reported = false
+	}
+	detector.count++
+	if detector.count >= threshold && !detector.reported {
+		detector.reported = true
+		return detector.count, true
+	}
+	return detector.count, false
+}
@@ -0,0 +1,124 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/redis"
+)
+
+const etagCacheMaxEntries = 10000
+
+// etagCacheTTL is how long ETags are kept in Redis, if configured.
+const etagCacheTTL = time.Hour
+
+type etagCacheEntry struct {
+	version string
+	etag    string
+}
+
+// etagCache contains the last ETag of versioned resources, keyed by the request (see etagCacheKey).
+var etagCache = make(map[string]etagCacheEntry)
+var etagCacheLock sync.Mutex
+
+// etagCacheKey gets the cache key for the request. Responses may depend on the token, so it's part of the key,
+// unless the cache policy says it only depends on the role or not at all.
+func etagCacheKey(input input, token AccessTokenEntry) string {
+	var tokenKey string
+	switch {
+	case input.cachePolicy.Public:
+		tokenKey = "public"
+	case input.cachePolicy.VaryByRole:
+		tokenKey = "role:" + string(token.GetRole())
+	default:
+		tokenKey = token.ID.String()
+	}
+	return strings.Join([]string{input.url.Path, input.url.RawQuery, tokenKey, strconv.FormatBool(input.pretty)}, "|")
+}
+
+// cachedETag gets the cached ETag for the request if the resource version is unchanged.
+// The cache is shared through Redis if configured, falling back to in-process if it fails.
+func cachedETag(key string, version string) string {
+	if redis.Enabled() {
+		if value, err := redis.Get(etagRedisKey(key)); err == nil {
+			// The ETag is hex, so it doesn't contain the separator
+			if parts := strings.SplitN(value, " ", 2); len(parts) == 2 && parts[1] == version {
+				return parts[0]
+			}
+			return ""
+		} else if err == redis.ErrNil {
+			return ""
+		}
+	}
+
+	etagCacheLock.Lock()
+	defer etagCacheLock.Unlock()
+	entry, ok := etagCache[key]
+	if !ok || entry.version != version {
+		return ""
+	}
+	return entry.etag
+}
+
+// storeETag caches the ETag of the resource version.
+func storeETag(key string, version string, etag string) {
+	if redis.Enabled() {
+		if err := redis.Set(etagRedisKey(key), etag+" "+version, etagCacheTTL); err == nil {
+			return
+		}
+	}
+
+	etagCacheLock.Lock()
+	defer etagCacheLock.Unlock()
+	// Just start over if full, the entries are cheap to recreate
+	if _, ok := etagCache[key]; !ok && len(etagCache) >= etagCacheMaxEntries {
+		etagCache = make(map[string]etagCacheEntry)
+	}
+	etagCache[key] = etagCacheEntry{version: version, etag: etag}
+}
+
+// etagRedisKey hashes the cache key, since it contains the whole query.
+func etagRedisKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return "etag:" + hex.EncodeToString(hash[:])
+}
+
+// etagMatches checks if the If-None-Match header value contains the ETag.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	if ifNoneMatch == "" || etag == "" {
+		return false
+	}
+	for _, value := range strings.Split(ifNoneMatch, ",") {
+		value = strings.TrimSpace(value)
+		value = strings.TrimPrefix(value, "W/")
+		value = strings.Trim(value, "\"")
+		if value == "*" || value == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package rest
+
+import (
+	"testing"
+
+	"github.com/gathering/tech-online-backend/helper"
+)
+
+func TestETagCache(t *testing.T) {
+	helper.CheckEqual(t, etagMatches("abc", "abc"), true)
+	helper.CheckEqual(t, etagMatches(`W/"xyz", "abc"`, "abc"), true)
+	helper.CheckEqual(t, etagMatches("*", "abc"), true)
+	helper.CheckEqual(t, etagMatches("abd", "abc"), false)
+	helper.CheckEqual(t, etagMatches("", "abc"), false)
+	helper.CheckEqual(t, etagMatches("abc", ""), false)
+
+	storeETag("/document/a/b/||false", "1", "abc")
+	helper.CheckEqual(t, cachedETag("/document/a/b/||false", "1"), "abc")
+	helper.CheckEqual(t, cachedETag("/document/a/b/||false", "2"), "")
+	helper.CheckEqual(t, cachedETag("/document/a/c/||false", "1"), "")
+}
@@ -0,0 +1,73 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"fmt"
+)
+
+// ItemError is the error of a single item of a collection write, by its index in the request.
+type ItemError struct {
+	Index   int    `json:"index"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// WriteItems validates all items of a collection write before writing any of them, then writes them one by one.
+// If any items are invalid, nothing is written and it responds with 400 and the item errors as details.
+// If writing some items fails, the rest are still written and it responds with 207 and the item errors as details.
+// Internal errors of items are logged and only shown to the client as internal server errors.
+// Warnings of written items are kept, prefixed by the item index.
+func WriteItems(request *Request, count int, validate func(index int) Result, write func(index int) Result) Result {
+	var itemErrors []ItemError
+	for i := 0; i < count; i++ {
+		if result := validate(i); !result.IsOk() {
+			itemErrors = append(itemErrors, newItemError(request, i, result))
+		}
+	}
+	if len(itemErrors) > 0 {
+		return Result{Code: 400, Message: fmt.Sprintf("%v of %v items invalid, none written", len(itemErrors), count), Details: itemErrors}
+	}
+
+	var warnings []string
+	for i := 0; i < count; i++ {
+		result := write(i)
+		if !result.IsOk() {
+			itemErrors = append(itemErrors, newItemError(request, i, result))
+			continue
+		}
+		for _, warning := range result.Warnings {
+			warnings = append(warnings, fmt.Sprintf("item %v: %v", i, warning))
+		}
+	}
+	if len(itemErrors) > 0 {
+		return Result{Code: 207, Message: fmt.Sprintf("%v of %v items failed, the rest were written", len(itemErrors), count), Details: itemErrors, Warnings: warnings}
+	}
+	return Result{Warnings: warnings}
+}
+
+func newItemError(request *Request, index int, result Result) ItemError {
+	if result.Error != nil {
+		request.Log().WithError(result.Error).WithField("item", index).Warn("internal server error for item")
+		return ItemError{Index: index, Code: 500, Message: "internal server error"}
+	}
+	return ItemError{Index: index, Code: result.Code, Message: result.Message}
+}
@@ -0,0 +1,64 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package rest
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/gathering/tech-online-backend/helper"
+)
+
+func TestWriteItems(t *testing.T) {
+	request := &Request{}
+	var written []int
+	write := func(i int) Result {
+		written = append(written, i)
+		if i == 1 {
+			return Result{Error: errors.New("db down")}
+		}
+		return Result{Warnings: []string{"missing sequence"}}
+	}
+
+	// Invalid items stop all writes
+	result := WriteItems(request, 3, func(i int) Result {
+		if i == 2 {
+			return Result{Code: 400, Message: "missing name"}
+		}
+		return Result{}
+	}, write)
+	helper.CheckEqual(t, result.Code, 400)
+	helper.CheckEqual(t, len(written), 0)
+	helper.CheckEqual(t, fmt.Sprint(result.Details), fmt.Sprint([]ItemError{{Index: 2, Code: 400, Message: "missing name"}}))
+
+	// Failed writes don't stop the rest and internal errors are hidden
+	result = WriteItems(request, 3, func(i int) Result { return Result{} }, write)
+	helper.CheckEqual(t, result.Code, 207)
+	helper.CheckEqual(t, fmt.Sprint(written), "[0 1 2]")
+	helper.CheckEqual(t, fmt.Sprint(result.Details), fmt.Sprint([]ItemError{{Index: 1, Code: 500, Message: "internal server error"}}))
+	helper.CheckEqual(t, fmt.Sprint(result.Warnings), "[item 0: missing sequence item 2: missing sequence]")
+
+	// All written
+	written = nil
+	result = WriteItems(request, 1, func(i int) Result { return Result{} }, write)
+	helper.CheckEqual(t, result.IsOk(), true)
+	helper.CheckEqual(t, result.Details, nil)
+}
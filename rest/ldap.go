@@ -0,0 +1,175 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/helper"
+	"github.com/gathering/tech-online-backend/ldap"
+	"github.com/gathering/tech-online-backend/redis"
+	"github.com/google/uuid"
+)
+
+// LDAPLoginData is the object for LDAP login requests.
+type LDAPLoginData struct {
+	Username string           `json:"username"`           // Required
+	Password string           `json:"password,omitempty"` // Required, removed from the response
+	User     User             `json:"user"`               // In the response
+	Token    AccessTokenEntry `json:"token"`              // In the response
+}
+
+const (
+	ldapLoginMaxAttempts   = 10
+	ldapLoginAttemptWindow = 15 * time.Minute
+)
+
+// ldapUserNamespace is the namespace of the (name-based) UUIDs of LDAP users, which don't come from Unicorn.
+var ldapUserNamespace = uuid.MustParse("5f0b6c1e-3f7a-4d2b-9a8e-6c1d2e4b7a90")
+
+var ldapLoginRateLimiter *helper.RateLimiter
+var ldapLoginRateLimiterLock sync.Mutex
+
+func init() {
+	AddHandler("/ldap/login/", "^$", func() interface{} { return &LDAPLoginData{} })
+	config.AddValidator(validateLDAPGroupRoles)
+}
+
+// Post attempts to login using LDAP.
+// The user is created or updated from the directory, including the role from the group mapping.
+func (response *LDAPLoginData) Post(request *Request) Result {
+	username, password := strings.TrimSpace(response.Username), response.Password
+	response.Password = ""
+
+	// Check params
+	if !ldap.Enabled() {
+		return Result{Code: 404, Message: "LDAP logins are not enabled"}
+	}
+	if username == "" || password == "" {
+		return Result{Code: 400, Message: "missing username or password"}
+	}
+	allowed, wait := getLDAPLoginRateLimiter().Allow(strings.ToLower(username))
+	if !allowed {
+		return Result{Code: 429, Message: fmt.Sprintf("too many attempts, try again in %v seconds", int(math.Ceil(wait.Seconds())))}
+	}
+
+	// Authenticate
+	entry, err := ldap.Authenticate(username, password)
+	if errors.Is(err, ldap.ErrInvalidCredentials) {
+		request.Log().WithField("username", username).Info("LDAP: Invalid credentials")
+		return Result{Code: 401, Message: "invalid username or password"}
+	}
+	if err != nil {
+		request.Log().WithError(err).Warn("LDAP: Authentication failed")
+		return Result{Code: 502, Message: "failed to contact the directory"}
+	}
+	role := ldapRole(config.Config.LDAP, entry.Attributes[ldap.AttributeMemberOf])
+	if role == RoleInvalid {
+		request.Log().WithField("username", username).Info("LDAP: User is not in any of the groups")
+		return Result{Code: 403, Message: "user is not allowed to log in"}
+	}
+
+	// Update user
+	id := uuid.NewSHA1(ldapUserNamespace, []byte(strings.ToLower(username)))
+	user := getUserByID(id)
+	if user == nil {
+		user = &User{ID: &id}
+	}
+	user.Username = username
+	user.DisplayName = entry.Get(ldap.AttributeDisplayName)
+	if user.DisplayName == "" {
+		user.DisplayName = entry.Get(ldap.AttributeCommonName)
+	}
+	if user.DisplayName == "" {
+		user.DisplayName = username
+	}
+	user.EmailAddress = entry.Get(ldap.AttributeMail)
+	user.Role = role
+	if exists, err := user.ExistsWithUsername(); err != nil {
+		return Result{Code: 500, Error: err}
+	} else if exists {
+		return Result{Code: 409, Message: "username belongs to another account"}
+	}
+	if err := user.save(); err != nil {
+		request.Log().WithError(err).Warn("LDAP: Failed to save new or updated user")
+		return Result{Code: 500}
+	}
+
+	// Create access token
+	token, tokenErr := createUserAccessToken(user)
+	if tokenErr != nil {
+		request.Log().WithError(tokenErr).Warn("LDAP: Failed to create new access token for user")
+		return Result{Code: 500}
+	}
+
+	response.Username = username
+	response.Token = *token
+	response.User = *user
+	return Result{}
+}
+
+// ldapRole returns the highest role mapped from the groups (DNs, case-insensitive), else the default role.
+func ldapRole(ldapConfig config.LDAPConfig, groups []string) Role {
+	ranks := map[Role]int{RoleParticipant: 1, RoleOperator: 2, RoleAdmin: 3}
+	role := Role(ldapConfig.DefaultRole)
+	for groupDN, groupRole := range ldapConfig.GroupRoles {
+		for _, group := range groups {
+			if strings.EqualFold(group, groupDN) && ranks[Role(groupRole)] > ranks[role] {
+				role = Role(groupRole)
+			}
+		}
+	}
+	return role
+}
+
+// getLDAPLoginRateLimiter gets the rate limiter for login attempts per username.
+func getLDAPLoginRateLimiter() *helper.RateLimiter {
+	ldapLoginRateLimiterLock.Lock()
+	defer ldapLoginRateLimiterLock.Unlock()
+	if ldapLoginRateLimiter == nil {
+		ldapLoginRateLimiter = redis.NewRateLimiter("ldap-login", ldapLoginMaxAttempts, ldapLoginAttemptWindow)
+	}
+	return ldapLoginRateLimiter
+}
+
+func validateLDAPGroupRoles(candidate *config.MainConfig) error {
+	if candidate.LDAP.DefaultRole != "" {
+		switch Role(candidate.LDAP.DefaultRole) {
+		case RoleParticipant, RoleOperator, RoleAdmin:
+		default:
+			return fmt.Errorf("ldap: invalid default role: %v", candidate.LDAP.DefaultRole)
+		}
+	}
+	for group, role := range candidate.LDAP.GroupRoles {
+		switch Role(role) {
+		case RoleParticipant, RoleOperator, RoleAdmin:
+		default:
+			return fmt.Errorf("ldap: group %v: invalid role: %v", group, role)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package rest
+
+import (
+	"testing"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/helper"
+)
+
+func TestLDAPRole(t *testing.T) {
+	ldapConfig := config.LDAPConfig{GroupRoles: map[string]string{
+		"cn=crew,dc=example":   "operator",
+		"cn=admins,dc=example": "admin",
+	}}
+	helper.CheckEqual(t, ldapRole(ldapConfig, []string{"CN=Crew,DC=example"}), RoleOperator)
+	helper.CheckEqual(t, ldapRole(ldapConfig, []string{"cn=crew,dc=example", "cn=admins,dc=example"}), RoleAdmin)
+	helper.CheckEqual(t, ldapRole(ldapConfig, []string{"cn=other,dc=example"}), RoleInvalid)
+	ldapConfig.DefaultRole = "participant"
+	helper.CheckEqual(t, ldapRole(ldapConfig, nil), RoleParticipant)
+	helper.CheckEqual(t, ldapRole(ldapConfig, []string{"cn=crew,dc=example"}), RoleOperator)
+}
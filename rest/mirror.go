@@ -0,0 +1,261 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	mirrorDefaultTimeout       = 10 * time.Second
+	mirrorDefaultMaxConcurrent = 10
+	mirrorMaxDiffs             = 10
+	mirrorMaxBodyBytes         = 10 << 20
+)
+
+// MirroredRequestHeader is set on replayed requests to the ID of the original request, so staging can tell them apart.
+const MirroredRequestHeader = "X-Mirrored-Request"
+
+// mirrorState contains the state derived from the mirror config.
+type mirrorState struct {
+	lock        sync.Mutex
+	patternText string
+	pattern     *regexp.Regexp
+	inFlight    int
+}
+
+var mirror mirrorState
+
+func init() {
+	config.AddValidator(validateMirrorConfig)
+}
+
+// validateMirrorConfig checks the mirror config section.
+func validateMirrorConfig(candidate *config.MainConfig) error {
+	mirrorConfig := candidate.Mirror
+	if mirrorConfig.BaseURL == "" {
+		return nil
+	}
+	if parsedURL, err := url.Parse(mirrorConfig.BaseURL); err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") {
+		return fmt.Errorf("mirror: invalid base URL: %v", mirrorConfig.BaseURL)
+	}
+	if mirrorConfig.SamplePercent < 0 || mirrorConfig.SamplePercent > 100 {
+		return fmt.Errorf("mirror: sample percent must be from 0 to 100")
+	}
+	if _, err := regexp.Compile(mirrorConfig.PathPattern); err != nil {
+		return fmt.Errorf("mirror: invalid path pattern: %v", err)
+	}
+	if mirrorConfig.TimeoutSeconds < 0 || mirrorConfig.MaxConcurrent < 0 {
+		return fmt.Errorf("mirror: negative limits")
+	}
+	return nil
+}
+
+// mirrorExchange replays the request against staging in the background if sampled, comparing the responses.
+// The response must be the full one, before replacing it with a 304 for matching ETags.
+func mirrorExchange(input input, code int, body []byte, rawResponse bool) {
+	mirrorConfig := config.Config.Mirror
+	// Unchanged resources (304) have no body to compare
+	if mirrorConfig.BaseURL == "" || input.url == nil || input.method != "GET" || code == 304 || rand.Float64()*100 >= mirrorConfig.SamplePercent {
+		return
+	}
+	path := strings.TrimPrefix(input.url.Path, config.Config.SitePrefix)
+	if !mirror.acquire(mirrorConfig, path) {
+		return
+	}
+
+	go func() {
+		defer mirror.release()
+		replayMirroredRequest(mirrorConfig, input, path, code, body, rawResponse)
+	}()
+}
+
+// acquire checks if the path should be mirrored and reserves a slot for the replay, skipping it if there are too many in flight.
+func (state *mirrorState) acquire(mirrorConfig config.MirrorConfig, path string) bool {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if state.pattern == nil || state.patternText != mirrorConfig.PathPattern {
+		pattern, err := regexp.Compile(mirrorConfig.PathPattern)
+		if err != nil {
+			return false
+		}
+		state.pattern = pattern
+		state.patternText = mirrorConfig.PathPattern
+	}
+	if !state.pattern.MatchString(path) {
+		return false
+	}
+	maxConcurrent := mirrorConfig.MaxConcurrent
+	if maxConcurrent <= 0 {
+		maxConcurrent = mirrorDefaultMaxConcurrent
+	}
+	if state.inFlight >= maxConcurrent {
+		return false
+	}
+	state.inFlight++
+	return true
+}
+
+// release frees the slot of a finished replay.
+func (state *mirrorState) release() {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	state.inFlight--
+}
+
+// replayMirroredRequest sends the request to staging and logs if the response differs.
+func replayMirroredRequest(mirrorConfig config.MirrorConfig, input input, path string, code int, body []byte, rawResponse bool) {
+	requestLog := input.log.WithField("mirror_url", mirrorConfig.BaseURL)
+	timeout := mirrorDefaultTimeout
+	if mirrorConfig.TimeoutSeconds > 0 {
+		timeout = time.Duration(mirrorConfig.TimeoutSeconds) * time.Second
+	}
+
+	mirrorURL := strings.TrimSuffix(mirrorConfig.BaseURL, "/") + path
+	if input.url.RawQuery != "" {
+		mirrorURL += "?" + input.url.RawQuery
+	}
+	httpRequest, err := http.NewRequest("GET", mirrorURL, nil)
+	if err != nil {
+		requestLog.WithError(err).Warn("Failed to create mirrored request")
+		return
+	}
+	httpRequest.Header.Set(MirroredRequestHeader, input.requestID.String())
+	if accept := input.header.Get("Accept"); accept != "" {
+		httpRequest.Header.Set("Accept", accept)
+	}
+	if authorization := input.header.Get("Authorization"); authorization != "" && mirrorConfig.ForwardAuthorization {
+		httpRequest.Header.Set("Authorization", authorization)
+	}
+
+	client := http.Client{Timeout: timeout}
+	startTime := time.Now()
+	response, err := client.Do(httpRequest)
+	if err != nil {
+		requestLog.WithError(err).Warn("Mirrored request failed")
+		return
+	}
+	defer response.Body.Close()
+	mirrorBody, err := io.ReadAll(io.LimitReader(response.Body, mirrorMaxBodyBytes))
+	if err != nil {
+		requestLog.WithError(err).Warn("Failed to read mirrored response")
+		return
+	}
+
+	diffs := diffMirroredResponse(code, body, response.StatusCode, mirrorBody, rawResponse, mirrorConfig.IgnoreFields)
+	fields := log.Fields{
+		"mirror_code":     response.StatusCode,
+		"code":            code,
+		"duration_millis": time.Since(startTime).Milliseconds(),
+	}
+	if len(diffs) == 0 {
+		requestLog.WithFields(fields).Debug("Mirrored response matches")
+		return
+	}
+	fields["diffs"] = diffs
+	requestLog.WithFields(fields).Warn("Mirrored response differs")
+}
+
+// diffMirroredResponse compares the responses, returning the differences (at most mirrorMaxDiffs). JSON bodies are
+// compared by value, skipping the ignored keys, and other bodies byte by byte.
+func diffMirroredResponse(code int, body []byte, mirrorCode int, mirrorBody []byte, rawResponse bool, ignoreFields []string) []string {
+	var diffs []string
+	if code != mirrorCode {
+		diffs = append(diffs, fmt.Sprintf("code: %v != %v", code, mirrorCode))
+	}
+	var value, mirrorValue interface{}
+	if rawResponse || json.Unmarshal(body, &value) != nil || json.Unmarshal(mirrorBody, &mirrorValue) != nil {
+		if !bytes.Equal(bytes.TrimSpace(body), bytes.TrimSpace(mirrorBody)) {
+			diffs = append(diffs, fmt.Sprintf("body: %v bytes != %v bytes", len(body), len(mirrorBody)))
+		}
+		return diffs
+	}
+	ignored := make(map[string]bool, len(ignoreFields))
+	for _, field := range ignoreFields {
+		ignored[field] = true
+	}
+	return diffJSON("$", value, mirrorValue, ignored, diffs)
+}
+
+// diffJSON appends the paths where the decoded JSON values differ, e.g. "$[2].name: \"a\" != \"b\"".
+func diffJSON(path string, value interface{}, mirrorValue interface{}, ignored map[string]bool, diffs []string) []string {
+	if len(diffs) >= mirrorMaxDiffs {
+		return diffs
+	}
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		mirrorTyped, ok := mirrorValue.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make(map[string]bool)
+		for key := range typed {
+			keys[key] = true
+		}
+		for key := range mirrorTyped {
+			keys[key] = true
+		}
+		sortedKeys := make([]string, 0, len(keys))
+		for key := range keys {
+			if !ignored[key] {
+				sortedKeys = append(sortedKeys, key)
+			}
+		}
+		sort.Strings(sortedKeys)
+		for _, key := range sortedKeys {
+			diffs = diffJSON(path+"."+key, typed[key], mirrorTyped[key], ignored, diffs)
+		}
+		return diffs
+	case []interface{}:
+		mirrorTyped, ok := mirrorValue.([]interface{})
+		if !ok {
+			break
+		}
+		if len(typed) != len(mirrorTyped) {
+			return append(diffs, fmt.Sprintf("%v: length %v != %v", path, len(typed), len(mirrorTyped)))
+		}
+		for i := range typed {
+			diffs = diffJSON(fmt.Sprintf("%v[%v]", path, i), typed[i], mirrorTyped[i], ignored, diffs)
+		}
+		return diffs
+	default:
+		if value == mirrorValue {
+			return diffs
+		}
+	}
+	encoded, _ := json.Marshal(value)
+	mirrorEncoded, _ := json.Marshal(mirrorValue)
+	return append(diffs, fmt.Sprintf("%v: %s != %s", path, encoded, mirrorEncoded))
+}
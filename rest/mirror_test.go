@@ -0,0 +1,87 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package rest
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/helper"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestDiffMirroredResponse(t *testing.T) {
+	check := func(code int, body string, mirrorCode int, mirrorBody string, raw bool, expected []string) {
+		t.Helper()
+		diffs := diffMirroredResponse(code, []byte(body), mirrorCode, []byte(mirrorBody), raw, []string{"last_change"})
+		helper.CheckEqual(t, fmt.Sprint(diffs), fmt.Sprint(expected))
+	}
+
+	check(200, `{"a":1,"b":[1,2]}`, 200, "{\"b\": [1, 2], \"a\": 1}\n", false, nil)
+	check(200, `[{"id":"x","last_change":"1"}]`, 200, `[{"id":"x","last_change":"2"}]`, false, nil)
+	check(200, `{"a":1}`, 404, `{"a":1}`, false, []string{"code: 200 != 404"})
+	check(200, `[{"name":"a","tags":["x"]}]`, 200, `[{"name":"b","tags":[]}]`, false, []string{`$[0].name: "a" != "b"`, "$[0].tags: length 1 != 0"})
+	check(200, `{"a":1}`, 200, `{"b":{"c":true}}`, false, []string{"$.a: 1 != null", `$.b: null != {"c":true}`})
+	check(200, "same", 200, "same", true, nil)
+	check(200, "one", 200, "other", true, []string{"body: 3 bytes != 5 bytes"})
+}
+
+func TestReplayMirroredRequest(t *testing.T) {
+	var gotPath, gotAuthorization, gotMirrored string
+	staging := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		gotPath = request.URL.RequestURI()
+		gotAuthorization = request.Header.Get("Authorization")
+		gotMirrored = request.Header.Get(MirroredRequestHeader)
+		fmt.Fprintln(writer, `{"id":1}`)
+	}))
+	defer staging.Close()
+
+	requestID := uuid.New()
+	in := input{
+		requestID: requestID,
+		url:       &url.URL{Path: "/api/tracks/", RawQuery: "type=net"},
+		header:    http.Header{"Authorization": []string{"Bearer secret"}},
+		log:       log.WithField("test", t.Name()),
+	}
+	mirrorConfig := config.MirrorConfig{BaseURL: staging.URL + "/api/"}
+	replayMirroredRequest(mirrorConfig, in, "/tracks/", 200, []byte(`{"id":1}`), false)
+	helper.CheckEqual(t, gotPath, "/api/tracks/?type=net")
+	helper.CheckEqual(t, gotAuthorization, "")
+	helper.CheckEqual(t, gotMirrored, requestID.String())
+
+	mirrorConfig.ForwardAuthorization = true
+	replayMirroredRequest(mirrorConfig, in, "/tracks/", 200, []byte(`{"id":1}`), false)
+	helper.CheckEqual(t, gotAuthorization, "Bearer secret")
+}
+
+func TestMirrorLimits(t *testing.T) {
+	var state mirrorState
+	mirrorConfig := config.MirrorConfig{PathPattern: "^/tracks/", MaxConcurrent: 1}
+	helper.CheckEqual(t, state.acquire(mirrorConfig, "/stations/"), false)
+	helper.CheckEqual(t, state.acquire(mirrorConfig, "/tracks/"), true)
+	helper.CheckEqual(t, state.acquire(mirrorConfig, "/tracks/"), false)
+	state.release()
+	helper.CheckEqual(t, state.acquire(mirrorConfig, "/tracks/"), true)
+}
@@ -22,15 +22,18 @@ package rest
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"regexp"
 
 	"github.com/gathering/tech-online-backend/config"
 	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/ldap"
 	"github.com/google/uuid"
-	log "github.com/sirupsen/logrus"
 	"golang.org/x/oauth2"
 )
 
@@ -45,11 +48,20 @@ type Oauth2LogoutData struct{}
 
 // Oauth2InfoData is the object for OAuth2 info requests.
 type Oauth2InfoData struct {
-	ClientID    string `json:"client_id"`
-	AuthURL     string `json:"auth_url"`
-	RedirectURL string `json:"redirect_url"`
+	ClientID            string `json:"client_id"`
+	AuthURL             string `json:"auth_url"`
+	RedirectURL         string `json:"redirect_url"`
+	PKCE                bool   `json:"pkce"`                            // If the client must use PKCE
+	CodeChallengeMethod string `json:"code_challenge_method,omitempty"` // PKCE code challenge method, if PKCE
+	LDAP                bool   `json:"ldap"`                            // If LDAP logins are enabled, as an alternative for crew
 }
 
+// pkceChallengeMethod is the only supported PKCE code challenge method (plain is not supported).
+const pkceChallengeMethod = "S256"
+
+// pkceVerifierPattern matches valid PKCE code verifiers (RFC 7636 section 4.1).
+var pkceVerifierPattern = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+
 type unicornProfile struct {
 	ID           uuid.UUID `json:"uuid"`
 	Username     string    `json:"username"`
@@ -68,6 +80,11 @@ func (response *Oauth2InfoData) Get(request *Request) Result {
 	response.ClientID = config.Config.OAuth2.ClientID
 	response.AuthURL = config.Config.OAuth2.AuthURL
 	response.RedirectURL = config.Config.OAuth2.RedirectURL
+	response.PKCE = config.Config.OAuth2.PKCE
+	if response.PKCE {
+		response.CodeChallengeMethod = pkceChallengeMethod
+	}
+	response.LDAP = ldap.Enabled()
 	return Result{}
 }
 
@@ -94,10 +111,26 @@ func (response *Oauth2LoginData) Post(request *Request) Result {
 		oauth2Config.RedirectURL = newRedirectURL.String()
 	}
 
+	// Check PKCE code verifier (and the challenge if the client provided it, to fail early)
+	var exchangeOptions []oauth2.AuthCodeOption
+	codeVerifier, codeVerifierFound := request.QueryArgs["code-verifier"]
+	if config.Config.OAuth2.PKCE && !codeVerifierFound {
+		return Result{Code: 400, Message: "No PKCE code verifier provided"}
+	}
+	if codeVerifierFound {
+		if !validatePKCEVerifier(codeVerifier) {
+			return Result{Code: 400, Message: "Invalid PKCE code verifier provided"}
+		}
+		if codeChallenge, codeChallengeFound := request.QueryArgs["code-challenge"]; codeChallengeFound && makePKCEChallenge(codeVerifier) != codeChallenge {
+			return Result{Code: 400, Message: "PKCE code verifier does not match the code challenge"}
+		}
+		exchangeOptions = append(exchangeOptions, oauth2.SetAuthURLParam("code_verifier", codeVerifier))
+	}
+
 	// Exchange code for token
-	oauth2Token, oauth2TokenExchangeErr := oauth2Config.Exchange(context.TODO(), oauth2Code)
+	oauth2Token, oauth2TokenExchangeErr := oauth2Config.Exchange(context.TODO(), oauth2Code, exchangeOptions...)
 	if oauth2TokenExchangeErr != nil {
-		log.WithError(oauth2TokenExchangeErr).Trace("OAuth2: Token exchange failed")
+		request.Log().WithError(oauth2TokenExchangeErr).Trace("OAuth2: Token exchange failed")
 		return Result{Code: 400, Message: "IdP didn't accept the provided code"}
 	}
 
@@ -110,22 +143,22 @@ func (response *Oauth2LoginData) Post(request *Request) Result {
 	client := &http.Client{}
 	httpResponse, httpResponseErr := client.Do(httpRequest)
 	if httpResponseErr != nil {
-		log.WithError(httpResponseErr).Warn("OAuth2: Failed to call profile endpoint")
+		request.Log().WithError(httpResponseErr).Warn("OAuth2: Failed to call profile endpoint")
 		return Result{Code: 500}
 	}
 	defer httpResponse.Body.Close()
 	if httpResponse.StatusCode < 200 || httpResponse.StatusCode > 299 {
-		log.Warnf("OAuth2: Failed to read Unicorn profile response data")
+		request.Log().Warnf("OAuth2: Failed to read Unicorn profile response data")
 		return Result{Code: 500}
 	}
 	responseBody, responseBodyErr := ioutil.ReadAll(httpResponse.Body)
 	if responseBodyErr != nil {
-		log.WithError(responseBodyErr).Warn("OAuth2: Failed to read Unicorn profile response data")
+		request.Log().WithError(responseBodyErr).Warn("OAuth2: Failed to read Unicorn profile response data")
 		return Result{Code: 500}
 	}
 	var profile *unicornProfile
 	if err := json.Unmarshal(responseBody, &profile); err != nil {
-		log.WithError(err).Warn("OAuth2: Failed to unmarshal Unicorn profile")
+		request.Log().WithError(err).Warn("OAuth2: Failed to unmarshal Unicorn profile")
 		return Result{Code: 500}
 	}
 
@@ -140,16 +173,16 @@ func (response *Oauth2LoginData) Post(request *Request) Result {
 	if user.Role == "" {
 		user.Role = RoleParticipant
 	}
-	log.Tracef("Got user: %v", user)
+	request.Log().Tracef("Got user: %v", user)
 	if err := user.save(); err != nil {
-		log.WithError(err).Warn("OAuth2: Failed to save new or updated user")
+		request.Log().WithError(err).Warn("OAuth2: Failed to save new or updated user")
 		return Result{Code: 500}
 	}
 
 	// Create access token
 	token, tokenErr := createUserAccessToken(user)
 	if tokenErr != nil {
-		log.WithError(tokenErr).Warn("OAuth2: Failed to create new access token for user")
+		request.Log().WithError(tokenErr).Warn("OAuth2: Failed to create new access token for user")
 		return Result{Code: 500}
 	}
 
@@ -164,7 +197,7 @@ func (response *Oauth2LogoutData) Post(request *Request) Result {
 	if request.AccessToken.OwnerUserID == nil {
 		dbResult := db.Delete("access_tokens", "id", "<=", request.AccessToken.ID)
 		if dbResult.IsFailed() {
-			log.WithError(dbResult.Error).Error("Failed to delete user access token on logout")
+			request.Log().WithError(dbResult.Error).Error("Failed to delete user access token on logout")
 		}
 		request.AccessToken = makeGuestAccessToken()
 	} else {
@@ -175,13 +208,31 @@ func (response *Oauth2LogoutData) Post(request *Request) Result {
 
 // makeOAuth2Config creates/loads the OAuth2 config from the main config.
 func makeOAuth2Config() oauth2.Config {
+	// Public (PKCE) clients without a secret must send the client ID in the body since there's nothing for basic auth
+	authStyle := oauth2.AuthStyleAutoDetect
+	if config.Config.OAuth2.ClientSecret == "" {
+		authStyle = oauth2.AuthStyleInParams
+	}
+
 	return oauth2.Config{
 		ClientID:     config.Config.OAuth2.ClientID,
 		ClientSecret: config.Config.OAuth2.ClientSecret,
 		Endpoint: oauth2.Endpoint{
-			TokenURL: config.Config.OAuth2.TokenURL,
+			TokenURL:  config.Config.OAuth2.TokenURL,
+			AuthStyle: authStyle,
 		},
 		RedirectURL: config.Config.OAuth2.RedirectURL,
 		// Scopes: []string{"all"},
 	}
 }
+
+// validatePKCEVerifier checks if the PKCE code verifier has a valid length and charset.
+func validatePKCEVerifier(verifier string) bool {
+	return pkceVerifierPattern.MatchString(verifier)
+}
+
+// makePKCEChallenge creates the S256 code challenge for a PKCE code verifier.
+func makePKCEChallenge(verifier string) string {
+	hash := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
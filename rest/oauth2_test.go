@@ -0,0 +1,43 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gathering/tech-online-backend/helper"
+)
+
+func TestMakePKCEChallenge(t *testing.T) {
+	// Example from RFC 7636 appendix B
+	challenge := makePKCEChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")
+	helper.CheckEqual(t, challenge, "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM")
+}
+
+func TestValidatePKCEVerifier(t *testing.T) {
+	helper.CheckEqual(t, validatePKCEVerifier("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"), true)
+	helper.CheckEqual(t, validatePKCEVerifier(strings.Repeat("a", 128)), true)
+	helper.CheckEqual(t, validatePKCEVerifier(strings.Repeat("a", 42)), false)
+	helper.CheckEqual(t, validatePKCEVerifier(strings.Repeat("a", 129)), false)
+	helper.CheckEqual(t, validatePKCEVerifier(strings.Repeat("a", 42)+"+"), false)
+	helper.CheckEqual(t, validatePKCEVerifier(""), false)
+}
@@ -0,0 +1,135 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// QueryFilterKind is the type of a filterable column, for parsing the filter values.
+type QueryFilterKind string
+
+const (
+	// QueryFilterString is for text columns.
+	QueryFilterString QueryFilterKind = "string"
+	// QueryFilterInt is for integer columns.
+	QueryFilterInt QueryFilterKind = "int"
+	// QueryFilterBool is for boolean columns.
+	QueryFilterBool QueryFilterKind = "bool"
+	// QueryFilterTime is for timestamp columns, with RFC 3339 times or dates (midnight UTC).
+	QueryFilterTime QueryFilterKind = "time"
+)
+
+// QueryFilterFields are the columns which may be filtered with query operators, with their kinds.
+type QueryFilterFields map[string]QueryFilterKind
+
+// QueryFilterable may be implemented by list handlers to allow filters with operators on some columns,
+// like "?sequence__gte=5&last_change__lt=2022-04-01". The filters are parsed before the handler is called
+// and given as where args in the request, to be added to the handler's own filters.
+type QueryFilterable interface {
+	QueryFilterFields() QueryFilterFields
+}
+
+// queryFilterOperators maps the query operator suffixes to DB operators.
+var queryFilterOperators = map[string]string{
+	"eq":       "=",
+	"ne":       "!=",
+	"lt":       "<",
+	"lte":      "<=",
+	"gt":       ">",
+	"gte":      ">=",
+	"contains": "ILIKE",
+	"null":     "IS",
+}
+
+// ParseQueryFilters parses the query args with operator suffixes ("<field>__<operator>") for the fields into where args for the DB layer.
+// Operators are "eq", "ne", "lt", "lte", "gt", "gte", "contains" (case-insensitive, strings only) and "null" ("true" or "false").
+// Query args without operator suffixes are left for the handler.
+func ParseQueryFilters(queryArgs map[string]string, fields QueryFilterFields) ([]interface{}, error) {
+	keys := make([]string, 0, len(queryArgs))
+	for key := range queryArgs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var whereArgs []interface{}
+	for _, key := range keys {
+		value := queryArgs[key]
+		separator := strings.LastIndex(key, "__")
+		if separator < 0 {
+			continue
+		}
+		field, operatorName := key[:separator], key[separator+2:]
+		kind, ok := fields[field]
+		if !ok {
+			return nil, fmt.Errorf("unknown filter field: %v", field)
+		}
+		operator, ok := queryFilterOperators[operatorName]
+		if !ok {
+			return nil, fmt.Errorf("unknown filter operator: %v", operatorName)
+		}
+
+		switch {
+		case operatorName == "null":
+			isNull, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for %v: %v", key, value)
+			}
+			if !isNull {
+				operator = "IS NOT"
+			}
+			whereArgs = append(whereArgs, field, operator, nil)
+		case operatorName == "contains":
+			if kind != QueryFilterString {
+				return nil, fmt.Errorf("contains is only for text fields: %v", field)
+			}
+			escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(value)
+			whereArgs = append(whereArgs, field, operator, "%"+escaped+"%")
+		default:
+			needle, err := parseQueryFilterValue(kind, value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for %v: %v", key, value)
+			}
+			whereArgs = append(whereArgs, field, operator, needle)
+		}
+	}
+	return whereArgs, nil
+}
+
+func parseQueryFilterValue(kind QueryFilterKind, value string) (interface{}, error) {
+	switch kind {
+	case QueryFilterInt:
+		return strconv.Atoi(value)
+	case QueryFilterBool:
+		return strconv.ParseBool(value)
+	case QueryFilterTime:
+		if t, err := time.Parse(time.RFC3339, value); err == nil {
+			return t, nil
+		}
+		return time.Parse("2006-01-02", value)
+	default:
+		return value, nil
+	}
+}
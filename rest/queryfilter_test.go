@@ -0,0 +1,71 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package rest
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gathering/tech-online-backend/helper"
+)
+
+func TestParseQueryFilters(t *testing.T) {
+	fields := QueryFilterFields{
+		"sequence":    QueryFilterInt,
+		"last_change": QueryFilterTime,
+		"name":        QueryFilterString,
+		"archived":    QueryFilterBool,
+	}
+
+	whereArgs, err := ParseQueryFilters(map[string]string{
+		"sequence__gte":    "5",
+		"last_change__lt":  "2022-04-01",
+		"name__contains":   "50%_off",
+		"archived__eq":     "false",
+		"sequence__null":   "false",
+		"family":           "ignored",
+		"unrelated_option": "",
+	}, fields)
+	helper.CheckEqual(t, err, nil)
+	helper.CheckEqual(t, fmt.Sprint(whereArgs), fmt.Sprint([]interface{}{
+		"archived", "=", false,
+		"last_change", "<", time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC),
+		"name", "ILIKE", `%50\%\_off%`,
+		"sequence", ">=", 5,
+		"sequence", "IS NOT", nil,
+	}))
+
+	whereArgs, err = ParseQueryFilters(map[string]string{"last_change__gt": "2022-04-01T12:00:00+02:00"}, fields)
+	helper.CheckEqual(t, err, nil)
+	helper.CheckEqual(t, whereArgs[2].(time.Time).Equal(time.Date(2022, 4, 1, 10, 0, 0, 0, time.UTC)), true)
+
+	for _, queryArgs := range []map[string]string{
+		{"secret__eq": "x"},
+		{"sequence__like": "5"},
+		{"sequence__gte": "five"},
+		{"sequence__contains": "5"},
+		{"sequence__null": "maybe"},
+		{"last_change__lt": "yesterday"},
+	} {
+		_, err := ParseQueryFilters(queryArgs, fields)
+		helper.CheckNotEqual(t, err, nil)
+	}
+}
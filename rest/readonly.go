@@ -0,0 +1,137 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/event"
+)
+
+const defaultReadOnlyMessage = "Tech:Online is in read-only mode for maintenance, please try again in a little while."
+
+// EventTypeReadOnlyChanged is the event for when read-only mode is enabled or disabled, e.g. for showing a banner.
+const EventTypeReadOnlyChanged event.Type = "server.read_only_changed"
+
+// readOnlyExemptPrefixes are handler prefixes which work in read-only mode, so admins can log in to disable it,
+// and read-only POST endpoints.
+var readOnlyExemptPrefixes = []string{"/oauth2/", "/ldap/", "/graphql/"}
+
+// ReadOnlyMode is the state of the read-only mode, where mutating requests from non-admins respond with 503.
+// It's set in the config and may be overridden through the API until the config is reloaded with a changed read-only mode.
+type ReadOnlyMode struct {
+	Enabled     bool       `json:"enabled"`
+	Message     string     `json:"message"`                // Shown to clients, the default message is used if empty
+	ChangedTime *time.Time `json:"changed_time,omitempty"` // When it was last changed through the API
+	ChangedBy   string     `json:"changed_by,omitempty"`   // Who last changed it through the API
+}
+
+var readOnlyOverride *ReadOnlyMode
+var readOnlyLock sync.Mutex
+
+func init() {
+	AddRequestFilter(readOnlyFilter)
+	AddHandler("/read-only/", "^$", func() interface{} { return &ReadOnlyMode{} })
+	config.OnReload(func(changed []string) {
+		if !config.ChangedSection(changed, "read_only") {
+			return
+		}
+		readOnlyLock.Lock()
+		readOnlyOverride = nil
+		readOnlyLock.Unlock()
+		publishReadOnlyChanged(currentReadOnlyMode())
+	})
+}
+
+// currentReadOnlyMode returns the API override if any, else the mode from the config.
+func currentReadOnlyMode() ReadOnlyMode {
+	readOnlyLock.Lock()
+	defer readOnlyLock.Unlock()
+	if readOnlyOverride != nil {
+		return *readOnlyOverride
+	}
+	return ReadOnlyMode{Enabled: config.Config.ReadOnly, Message: config.Config.ReadOnlyMessage}
+}
+
+// readOnlyFilter responds with 503 to mutating requests from non-admins in read-only mode.
+func readOnlyFilter(request *Request) Result {
+	if request.Method == "GET" || request.Method == "HEAD" || request.AccessToken.GetRole() == RoleAdmin {
+		return Result{}
+	}
+	for _, prefix := range readOnlyExemptPrefixes {
+		if strings.HasPrefix(request.PathPrefix, prefix) {
+			return Result{}
+		}
+	}
+	mode := currentReadOnlyMode()
+	if !mode.Enabled {
+		return Result{}
+	}
+	message := mode.Message
+	if message == "" {
+		message = defaultReadOnlyMessage
+	}
+	return Result{Code: 503, Message: message}
+}
+
+// publishReadOnlyChanged publishes the new mode for clients to show or hide a banner.
+func publishReadOnlyChanged(mode ReadOnlyMode) {
+	title := "Read-only mode disabled"
+	if mode.Enabled {
+		title = "Read-only mode enabled"
+	}
+	event.Publish(event.Event{
+		Type:    EventTypeReadOnlyChanged,
+		Title:   title,
+		Message: mode.Message,
+		Data:    mode,
+	})
+}
+
+// Get gets the current read-only mode, so clients can show a banner.
+func (mode *ReadOnlyMode) Get(request *Request) Result {
+	*mode = currentReadOnlyMode()
+	return Result{}
+}
+
+// Put enables or disables read-only mode until the next restart, or until the config is reloaded with a changed mode.
+func (mode *ReadOnlyMode) Put(request *Request) Result {
+	// Check perms
+	if request.AccessToken.GetRole() != RoleAdmin {
+		return UnauthorizedResult(request.AccessToken)
+	}
+
+	// Set
+	now := time.Now()
+	mode.ChangedTime = &now
+	mode.ChangedBy = request.AccessToken.GetName()
+	override := *mode
+	readOnlyLock.Lock()
+	readOnlyOverride = &override
+	readOnlyLock.Unlock()
+
+	request.Log().WithField("enabled", mode.Enabled).Info("Read-only mode changed through API")
+	publishReadOnlyChanged(override)
+	return Result{}
+}
@@ -0,0 +1,52 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package rest
+
+import (
+	"testing"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/helper"
+)
+
+func TestReadOnlyFilter(t *testing.T) {
+	adminRole := RoleAdmin
+	runnerRole := RoleRunner
+	admin := AccessTokenEntry{NonUserRole: &adminRole}
+	runner := AccessTokenEntry{NonUserRole: &runnerRole}
+	config.Config.ReadOnly = true
+	defer func() { config.Config.ReadOnly = false }()
+
+	result := readOnlyFilter(&Request{Method: "PUT", PathPrefix: "/station/", AccessToken: runner})
+	helper.CheckEqual(t, result.Code, 503)
+	helper.CheckEqual(t, result.Message, defaultReadOnlyMessage)
+	result = readOnlyFilter(&Request{Method: "GET", PathPrefix: "/station/", AccessToken: runner})
+	helper.CheckEqual(t, result.IsOk(), true)
+	result = readOnlyFilter(&Request{Method: "PUT", PathPrefix: "/station/", AccessToken: admin})
+	helper.CheckEqual(t, result.IsOk(), true)
+	result = readOnlyFilter(&Request{Method: "POST", PathPrefix: "/oauth2/", AccessToken: runner})
+	helper.CheckEqual(t, result.IsOk(), true)
+
+	// The API override wins over the config
+	readOnlyOverride = &ReadOnlyMode{Enabled: false}
+	defer func() { readOnlyOverride = nil }()
+	result = readOnlyFilter(&Request{Method: "DELETE", PathPrefix: "/station/", AccessToken: runner})
+	helper.CheckEqual(t, result.IsOk(), true)
+}
@@ -24,7 +24,8 @@ RESTful HTTP API with certain patterns implicitly enforced:
 - When working on the same urls, all Methods should use the exact same
 data structures. E.g.: What you PUT is the same as what you GET out
 again. No cheating.
-- ETag is computed for all responses.
+- ETag is computed for all responses, and cached for resources implementing
+Versioner so unchanged resources aren't loaded for conditional requests.
 - All responses are JSON-encoded, including error messages.
 
 See objects/thing.go for how to use this, but the essence is:
@@ -39,18 +40,25 @@ don't have to.
 package rest
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/errorreport"
+	"github.com/gathering/tech-online-backend/tenant"
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
 )
@@ -69,21 +77,33 @@ type receiverSet struct {
 var receiverSets map[string]*receiverSet
 
 type input struct {
-	requestID  uuid.UUID
-	url        *url.URL
-	pathPrefix string
-	pathSuffix string
-	method     string
-	data       []byte
-	query      map[string][]string
-	pretty     bool
+	requestID   uuid.UUID
+	startTime   time.Time
+	ctx         context.Context
+	log         *log.Entry // With the request fields, and the token role once known
+	url         *url.URL
+	pathPrefix  string
+	pathSuffix  string
+	method      string
+	contentType string
+	header      http.Header
+	origin      string // Origin header, for CORS
+	data        []byte
+	query       map[string][]string
+	pretty      bool
+	ifNoneMatch string
+	etagKey     string      // For the ETag cache, set once the token and receiver are known
+	cachePolicy CachePolicy // Of the receiver, for the caching headers and the ETag cache
 }
 
 type output struct {
 	code         int
 	data         interface{}
+	raw          *RawResponse
 	location     string
 	cachecontrol string
+	version      string   // From Versioner, for caching the ETag
+	warnings     []string // From the result, for the "Warning" headers
 }
 
 // AddHandler registeres an allocator/data structure with a url. The
@@ -109,6 +129,7 @@ func AddHandler(pathPrefix string, pathPattern string, allocator Allocator) erro
 	} else {
 		err := fmt.Errorf("invalid regexp pattern for path: %v", pathPattern)
 		log.WithError(err).Error("failed to compile path pattern for handler")
+		handlerErrors = append(handlerErrors, fmt.Sprintf("[%v][%v]: %v", pathPrefix, pathPattern, err))
 		return err
 	}
 
@@ -122,11 +143,12 @@ func AddHandler(pathPrefix string, pathPattern string, allocator Allocator) erro
 type Allocator func() interface{}
 
 // StartReceiver a net/http server and handle all requests registered. Never
-// returns.
-func StartReceiver() {
+// returns. The ready function (if any) is called with the address once listening.
+func StartReceiver(ready func(address net.Addr)) {
 	var server http.Server
+	configureServer(&server)
 	serveMux := http.NewServeMux()
-	server.Handler = serveMux
+	server.Handler = tenant.Handler(serveMux)
 	server.Addr = ":8080"
 	if config.Config.ListenAddress != "" {
 		server.Addr = config.Config.ListenAddress
@@ -145,64 +167,102 @@ func StartReceiver() {
 		}
 	}
 
+	listener, err := listen(server.Addr)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to listen")
+	}
 	log.WithFields(log.Fields{
 		"listen_address": server.Addr,
 		"path_prefix":    config.Config.SitePrefix,
 	}).Info("Server is listening")
-	log.Fatal(server.ListenAndServe())
+	if ready != nil {
+		ready(listener.Addr())
+	}
+	log.Fatal(server.Serve(listener))
 }
 
 func (set receiverSet) ServeHTTP(httpWriter http.ResponseWriter, httpRequest *http.Request) {
 	requestID := uuid.New()
-	log.WithFields(log.Fields{
-		"id":     requestID,
+	requestLog := log.WithFields(log.Fields{
+		"request_id": requestID,
+		"method":     httpRequest.Method,
+		"path":       httpRequest.URL.Path,
+	})
+	requestLog.WithFields(log.Fields{
 		"url":    httpRequest.URL,
-		"method": httpRequest.Method,
 		"client": httpRequest.RemoteAddr,
 	}).Infof("Request")
 
+	// Report panics instead of just dropping the connection
+	defer func() {
+		if r := recover(); r != nil {
+			requestLog.WithField("panic", r).Error("Request handler panicked")
+			errorreport.CapturePanic(r, logContext(requestLog))
+			sendResponse(httpWriter, input{requestID: requestID, log: requestLog}, output{code: 500, data: message("internal server error")})
+		}
+	}()
+
+	// Find matching receiver, first since it decides the body size limit
+	pathSuffix := requestPathSuffix(httpRequest, set.pathPrefix)
+	var foundReceiver *receiver
+	for _, receiver := range set.receivers {
+		if receiver.pathPattern.MatchString(pathSuffix) {
+			requestLog.WithFields(log.Fields{
+				"prefix":  set.pathPrefix,
+				"pattern": receiver.pathPattern.String(),
+			}).Trace("Found receiver")
+			foundReceiver = &receiver
+			break
+		}
+	}
+
 	// Process request content
-	input, err := processInput(httpRequest, set.pathPrefix, requestID)
+	input, err := processInput(httpWriter, httpRequest, set.pathPrefix, getBodyLimit(foundReceiver), requestID, requestLog)
+	if err == errBodyTooLarge {
+		requestLog.WithField("content_length", httpRequest.ContentLength).Warn("Request body too large")
+		sendResponse(httpWriter, input, output{code: 413, data: message("request body too large")})
+		return
+	}
 	if err != nil {
-		log.WithFields(log.Fields{
+		requestLog.WithFields(log.Fields{
 			"data": string(input.data),
 			"err":  err,
 		}).Warn("Failed to process request input")
 		return
 	}
 
-	// Purge expired access tokens
-	// Should happen as periodic task, but whatever, requests are pretty periodic and this is pretty quick
-	// TODO optimize
-	purgeExpiredAccessTokens()
-
 	// Load access token entry (if any valid) and user (if any associated)
-	token := getRequestAccessToken(httpRequest)
-
-	// Find matching receiver
-	var foundReceiver *receiver
-	for _, receiver := range set.receivers {
-		if receiver.pathPattern.MatchString(input.pathSuffix) {
-			log.WithFields(log.Fields{
-				"prefix":  set.pathPrefix,
-				"pattern": receiver.pathPattern.String(),
-			}).Trace("Found receiver")
-			foundReceiver = &receiver
-			break
+	token := getRequestAccessToken(httpRequest, requestLog)
+	input.log = requestLog.WithField("role", token.GetRole())
+	input.cachePolicy = getCachePolicy(foundReceiver)
+	input.etagKey = etagCacheKey(input, token)
+
+	// Let streaming endpoints take over upgrade requests
+	if foundReceiver != nil && isUpgradeRequest(httpRequest) {
+		if streamer, ok := foundReceiver.allocator().(Streamer); ok {
+			request := buildRequest(foundReceiver, input, token)
+			handler, result := streamer.Stream(&request)
+			if result.IsOk() && handler != nil {
+				handler.ServeHTTP(httpWriter, httpRequest)
+				return
+			}
+			sendResponse(httpWriter, input, processOutput(input, result, nil))
+			return
 		}
 	}
 
 	// Handle request at appropriate endpoints
-	result, data := handleRequest(foundReceiver, input, token)
+	result, data, version := handleRequest(foundReceiver, input, token)
 
 	// Process output
 	output := processOutput(input, result, data)
+	output.version = version
 
 	// Create response
 	sendResponse(httpWriter, input, output)
 }
 
-func getRequestAccessToken(httpRequest *http.Request) AccessTokenEntry {
+func getRequestAccessToken(httpRequest *http.Request, requestLog *log.Entry) AccessTokenEntry {
 	var token *AccessTokenEntry
 	authHeader, authHeaderFound := httpRequest.Header["Authorization"]
 	if authHeaderFound {
@@ -212,12 +272,18 @@ func getRequestAccessToken(httpRequest *http.Request) AccessTokenEntry {
 			token = loadAccessTokenByKey(tokenKey)
 		}
 	}
+	// Browsers can't set headers for WebSockets, so allow the token as a query arg for those
+	if token == nil && isUpgradeRequest(httpRequest) {
+		if tokenKey := httpRequest.URL.Query().Get("access_token"); tokenKey != "" {
+			token = loadAccessTokenByKey(tokenKey)
+		}
+	}
 	// Ignore illegal or malformed token, just give them a guest token instead of complaining
 	if token == nil {
 		guestToken := makeGuestAccessToken()
 		token = &guestToken
 	}
-	log.WithFields(log.Fields{
+	requestLog.WithFields(log.Fields{
 		"token":   token.ID,
 		"role":    token.GetRole(),
 		"comment": token.Comment,
@@ -229,27 +295,49 @@ func getRequestAccessToken(httpRequest *http.Request) AccessTokenEntry {
 // get is a badly named function in the context of HTTP since what it
 // really does is just read the body of a HTTP request. In my defence, it
 // used to do more. But what has it done for me lately?!
-func processInput(httpRequest *http.Request, pathPrefix string, requestID uuid.UUID) (input, error) {
+// Bodies larger than maxBodySize are rejected with errBodyTooLarge before
+// reading (if the length is known) or allocating more than the limit.
+func processInput(httpWriter http.ResponseWriter, httpRequest *http.Request, pathPrefix string, maxBodySize int64, requestID uuid.UUID, requestLog *log.Entry) (input, error) {
 	var input input
 	input.requestID = requestID
-	fullPath := httpRequest.URL.Path
-	// Make sure path always ends with "/"
-	if !strings.HasSuffix(fullPath, "/") {
-		fullPath += "/"
-	}
+	input.startTime = time.Now()
+	input.ctx = httpRequest.Context()
+	input.log = requestLog
 	input.url = httpRequest.URL
 	input.pathPrefix = pathPrefix
-	input.pathSuffix = fullPath[len(pathPrefix):]
+	input.pathSuffix = requestPathSuffix(httpRequest, pathPrefix)
 	input.query = httpRequest.URL.Query()
 	input.method = httpRequest.Method
+	input.contentType = httpRequest.Header.Get("Content-Type")
+	input.header = httpRequest.Header
+	input.origin = httpRequest.Header.Get("Origin")
 	input.pretty = len(httpRequest.URL.Query()["pretty"]) > 0
+	input.ifNoneMatch = httpRequest.Header.Get("If-None-Match")
 
 	// Process body
-	if httpRequest.ContentLength != 0 {
+	if httpRequest.ContentLength > maxBodySize {
+		return input, errBodyTooLarge
+	}
+	httpRequest.Body = http.MaxBytesReader(httpWriter, httpRequest.Body, maxBodySize)
+	if httpRequest.ContentLength < 0 {
+		// Unknown length, e.g. chunked
+		data, err := io.ReadAll(httpRequest.Body)
+		if err != nil && int64(len(data)) >= maxBodySize {
+			return input, errBodyTooLarge
+		}
+		if err != nil {
+			requestLog.WithFields(log.Fields{
+				"address": httpRequest.RemoteAddr,
+				"error":   err,
+			}).Error("Read error from client")
+			return input, fmt.Errorf("read failed: %v", err)
+		}
+		input.data = data
+	} else if httpRequest.ContentLength != 0 {
 		input.data = make([]byte, httpRequest.ContentLength)
 
 		if n, err := io.ReadFull(httpRequest.Body, input.data); err != nil {
-			log.WithFields(log.Fields{
+			requestLog.WithFields(log.Fields{
 				"address":  httpRequest.RemoteAddr,
 				"error":    err,
 				"numbytes": n,
@@ -261,10 +349,19 @@ func processInput(httpRequest *http.Request, pathPrefix string, requestID uuid.U
 	return input, nil
 }
 
+// requestPathSuffix gets the path after the prefix of the receiver set, always ending with "/".
+func requestPathSuffix(httpRequest *http.Request, pathPrefix string) string {
+	fullPath := httpRequest.URL.Path
+	if !strings.HasSuffix(fullPath, "/") {
+		fullPath += "/"
+	}
+	return fullPath[len(pathPrefix):]
+}
+
 // handle figures out what Method the input has, casts item to the correct
 // interface and calls the relevant function, if any, for that data. For
 // PUT and POST it also parses the input data.
-func handleRequest(receiver *receiver, input input, accessToken AccessTokenEntry) (result Result, data interface{}) {
+func handleRequest(receiver *receiver, input input, accessToken AccessTokenEntry) (result Result, data interface{}, version string) {
 	// No handler
 	if receiver == nil {
 		result.Code = 404
@@ -272,41 +369,24 @@ func handleRequest(receiver *receiver, input input, accessToken AccessTokenEntry
 		return
 	}
 
-	// Prepare request object
-	var request Request
-	request.ID = input.requestID
-	request.Method = input.method
-	request.AccessToken = accessToken
-	request.PathArgs = make(map[string]string)
-	argCaptures := receiver.pathPattern.FindStringSubmatch(input.pathSuffix)
-	argCaptureNames := receiver.pathPattern.SubexpNames()
-	for i := range argCaptures {
-		if i > 0 {
-			if argCaptureNames[i] != "" {
-				request.PathArgs[argCaptureNames[i]] = argCaptures[i]
-			}
-		}
-	}
-	request.QueryArgs = make(map[string]string)
-	for key, value := range input.query {
-		// Only use first arg for each key
-		if len(value) > 0 {
-			request.QueryArgs[key] = value[0]
-		} else {
-			request.QueryArgs[key] = ""
-		}
-	}
-	if value, exists := request.QueryArgs["limit"]; exists {
-		if i, err := strconv.Atoi(value); err == nil {
-			request.ListLimit = i
+	request := buildRequest(receiver, input, accessToken)
+	if input.method != "OPTIONS" {
+		if result = FilterRequest(&request); !result.IsOk() {
+			return
 		}
 	}
-	if _, exists := request.QueryArgs["brief"]; exists {
-		request.ListBrief = true
-	}
 
 	// Find handler and handle
 	item := receiver.allocator()
+	if filterable, ok := item.(QueryFilterable); ok && (input.method == "GET" || input.method == "HEAD" || input.method == "DELETE") {
+		filters, err := ParseQueryFilters(request.QueryArgs, filterable.QueryFilterFields())
+		if err != nil {
+			result.Code = 400
+			result.Message = err.Error()
+			return
+		}
+		request.Filters = filters
+	}
 	switch input.method {
 	case "OPTIONS":
 	case "HEAD":
@@ -325,12 +405,29 @@ func handleRequest(receiver *receiver, input input, accessToken AccessTokenEntry
 			result.Message = "method not allowed for endpoint"
 			return
 		}
+		// Skip loading unchanged resources if the client has the current ETag
+		if versioner, ok := item.(Versioner); ok {
+			var err error
+			if version, err = versioner.Version(&request); err != nil {
+				result.Error = err
+				return
+			}
+			if version != "" && etagMatches(input.ifNoneMatch, cachedETag(input.etagKey, version)) {
+				result.Code = 304
+				return
+			}
+		}
 		result = get.Get(&request)
 		data = get
+		if request.ListBrief && result.IsOk() {
+			if brief := briefData(get); brief != nil {
+				data = brief
+			}
+		}
 	case "POST":
-		if len(input.data) > 0 {
+		if len(input.data) > 0 && !isRawContentType(input.contentType) {
 			if err := json.Unmarshal(input.data, &item); err != nil {
-				log.WithError(err).Trace("Failed to unmarshal JSON for endpoint")
+				input.log.WithError(err).Trace("Failed to unmarshal JSON for endpoint")
 				result.Code = 400
 				result.Message = "malformed data for endpoint"
 				return
@@ -345,9 +442,9 @@ func handleRequest(receiver *receiver, input input, accessToken AccessTokenEntry
 		result = post.Post(&request)
 		data = post
 	case "PUT":
-		if len(input.data) > 0 {
+		if len(input.data) > 0 && !isRawContentType(input.contentType) {
 			if err := json.Unmarshal(input.data, &item); err != nil {
-				log.WithError(err).Trace("Failed to unmarshal JSON for endpoint")
+				input.log.WithError(err).Trace("Failed to unmarshal JSON for endpoint")
 				result.Code = 400
 				result.Message = "malformed data for endpoint"
 				return
@@ -377,9 +474,62 @@ func handleRequest(receiver *receiver, input input, accessToken AccessTokenEntry
 	return
 }
 
+// buildRequest prepares the request object for the handler.
+func buildRequest(receiver *receiver, input input, accessToken AccessTokenEntry) Request {
+	var request Request
+	request.ID = input.requestID
+	request.logEntry = input.log
+	request.ctx = input.ctx
+	request.Method = input.method
+	request.PathPrefix = input.pathPrefix
+	request.AccessToken = accessToken
+	request.PathArgs = make(map[string]string)
+	argCaptures := receiver.pathPattern.FindStringSubmatch(input.pathSuffix)
+	argCaptureNames := receiver.pathPattern.SubexpNames()
+	for i := range argCaptures {
+		if i > 0 {
+			if argCaptureNames[i] != "" {
+				request.PathArgs[argCaptureNames[i]] = argCaptures[i]
+			}
+		}
+	}
+	request.ContentType = input.contentType
+	request.Header = input.header
+	request.Body = input.data
+	request.QueryArgs = make(map[string]string)
+	for key, value := range input.query {
+		// Only use first arg for each key
+		if len(value) > 0 {
+			request.QueryArgs[key] = value[0]
+		} else {
+			request.QueryArgs[key] = ""
+		}
+	}
+	if value, exists := request.QueryArgs["limit"]; exists {
+		if i, err := strconv.Atoi(value); err == nil {
+			request.ListLimit = i
+		}
+	}
+	if _, exists := request.QueryArgs["brief"]; exists {
+		request.ListBrief = true
+	}
+	return request
+}
+
+// isUpgradeRequest checks if the client wants to switch protocols, e.g. to WebSocket.
+func isUpgradeRequest(httpRequest *http.Request) bool {
+	for _, value := range strings.Split(httpRequest.Header.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(value), "upgrade") {
+			return httpRequest.Header.Get("Upgrade") != ""
+		}
+	}
+	return false
+}
+
 func processOutput(input input, result Result, handlerData interface{}) (output output) {
 	if result.Error != nil {
-		log.WithError(result.Error).Warn("internal server error")
+		input.log.WithError(result.Error).Warn("internal server error")
+		errorreport.CaptureError(result.Error, logContext(input.log), db.ErrorQuery(result.Error))
 		result.Code = 500
 	}
 
@@ -396,17 +546,28 @@ func processOutput(input input, result Result, handlerData interface{}) (output
 		if output.code == 204 {
 			// No data allowed
 			output.data = nil
+		} else if output.code == 207 {
+			// Show report of the failed items
+			output.data = result
 		} else if handlerData == nil {
 			// Show report if no returned data
 			output.data = result
+		} else if raw, ok := handlerData.(RawResponder); ok {
+			// Show raw data
+			output.raw = raw.RawResponse()
 		} else {
 			// Show data
 			output.data = handlerData
 		}
+		// Caching
+		if output.code == 200 && (input.method == "GET" || input.method == "HEAD") {
+			output.cachecontrol = input.cachePolicy.header()
+		}
 		// Location
 		if output.code == 201 {
 			output.location = result.Location
 		}
+		output.warnings = result.Warnings
 	case output.code >= 300 && output.code <= 399:
 		// Hide data
 		output.data = result
@@ -423,6 +584,7 @@ func processOutput(input input, result Result, handlerData interface{}) (output
 	// OPTIONS and HEAD must never return data
 	if input.method == "OPTIONS" || input.method == "HEAD" {
 		output.data = nil
+		output.raw = nil
 	}
 
 	return
@@ -431,7 +593,7 @@ func processOutput(input input, result Result, handlerData interface{}) (output
 // answer replies to a HTTP request with the provided output, optionally
 // formatting the output prettily. It also calculates an ETag.
 func sendResponse(w http.ResponseWriter, input input, output output) {
-	log.WithFields(log.Fields{
+	input.log.WithFields(log.Fields{
 		"code":     output.code,
 		"location": output.location,
 	}).Trace("Request done")
@@ -440,7 +602,17 @@ func sendResponse(w http.ResponseWriter, input input, output output) {
 
 	// Content
 	body := make([]byte, 0)
-	if output.data != nil {
+	if output.raw != nil {
+		body = output.raw.Data
+		contentType := output.raw.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", contentType)
+		if output.raw.Filename != "" {
+			w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": output.raw.Filename}))
+		}
+	} else if output.data != nil {
 		var jsonErr error
 		if input.pretty {
 			body, jsonErr = json.MarshalIndent(output.data, "", "  ")
@@ -448,23 +620,61 @@ func sendResponse(w http.ResponseWriter, input input, output output) {
 			body, jsonErr = json.Marshal(output.data)
 		}
 		if jsonErr != nil {
-			log.WithError(jsonErr).Error("Failed to marshal response data to JSON")
+			input.log.WithError(jsonErr).Error("Failed to marshal response data to JSON")
 			code = 500
 			body = make([]byte, 0)
 		}
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	}
 
+	captureExchange(input, code, body, output.raw != nil)
+	mirrorExchange(input, code, body, output.raw != nil)
+
 	// CORS
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if allowedOrigin := corsAllowedOrigin(input.origin); allowedOrigin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", allowedOrigin)
+	}
+	if len(config.Config.CORSOrigins) > 0 {
+		w.Header().Add("Vary", "Origin")
+	}
 	w.Header().Set("Access-Control-Allow-Methods", "*")
 	w.Header().Set("Access-Control-Allow-Headers", "*")
 	w.Header().Set("Access-Control-Max-Age", "300") // 5 minutes
+	w.Header().Set("Access-Control-Expose-Headers", "Warning")
+
+	// Warnings, as miscellaneous persistent warnings (RFC 7234)
+	for _, warning := range output.warnings {
+		w.Header().Add("Warning", fmt.Sprintf("299 - %q", warning))
+	}
 
 	// Caching header
-	etagraw := sha256.Sum256(body)
-	etagstr := hex.EncodeToString(etagraw[:])
+	var etagstr string
+	if code == 304 {
+		etagstr = cachedETag(input.etagKey, output.version)
+		body = make([]byte, 0)
+	} else {
+		etagraw := sha256.Sum256(body)
+		etagstr = hex.EncodeToString(etagraw[:])
+		if code == 200 && input.method == "GET" {
+			if output.version != "" && !input.cachePolicy.NoStore {
+				storeETag(input.etagKey, output.version, etagstr)
+			}
+			if etagMatches(input.ifNoneMatch, etagstr) {
+				code = 304
+				body = make([]byte, 0)
+			}
+		}
+	}
 	w.Header().Set("ETag", etagstr)
+	if code == 304 {
+		output.cachecontrol = input.cachePolicy.header()
+	}
+	if output.cachecontrol != "" {
+		w.Header().Set("Cache-Control", output.cachecontrol)
+		if !input.cachePolicy.Public {
+			w.Header().Add("Vary", "Authorization")
+		}
+	}
 
 	// Redirect
 	if output.location != "" {
@@ -472,12 +682,42 @@ func sendResponse(w http.ResponseWriter, input input, output output) {
 	}
 
 	// Finalize head and add body
+	if code >= 500 {
+		recordServerError()
+	}
 	w.WriteHeader(code)
-	if code != 204 {
+	if code == 204 || code == 304 {
+		return
+	}
+	if output.raw != nil {
+		w.Write(body)
+	} else {
 		fmt.Fprintf(w, "%s\n", body)
 	}
 }
 
+// logContext gets the fields of a log entry as strings, as context for error reports.
+func logContext(entry *log.Entry) map[string]string {
+	context := make(map[string]string, len(entry.Data))
+	for key, value := range entry.Data {
+		context[key] = fmt.Sprint(value)
+	}
+	return context
+}
+
+// isRawContentType checks if a request body of the content type should be left for the handler to parse instead of being JSON-decoded.
+func isRawContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch mediaType {
+	case "application/octet-stream", "application/yaml", "application/x-yaml", "text/yaml", "text/csv":
+		return true
+	}
+	return strings.HasPrefix(mediaType, "multipart/")
+}
+
 // message is a convenience function
 func message(str string, v ...interface{}) (m struct {
 	Message string `json:"message"`
@@ -485,3 +725,21 @@ func message(str string, v ...interface{}) (m struct {
 	m.Message = fmt.Sprintf(str, v...)
 	return
 }
+
+// corsAllowedOrigin gets the allowed origin to respond with for the request origin, or empty if not allowed.
+// All origins are allowed if none are configured.
+func corsAllowedOrigin(origin string) string {
+	origins := config.Config.CORSOrigins
+	if len(origins) == 0 {
+		return "*"
+	}
+	for _, allowed := range origins {
+		if allowed == "*" {
+			return "*"
+		}
+		if origin != "" && strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
@@ -0,0 +1,79 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package rest
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gathering/tech-online-backend/helper"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestResponseWarnings(t *testing.T) {
+	in := input{method: "PUT", log: log.WithField("test", t.Name())}
+	handlerData := &struct{}{}
+
+	recorder := httptest.NewRecorder()
+	sendResponse(recorder, in, processOutput(in, Result{Warnings: []string{`missing "sequence"`, "station is unhealthy"}}, handlerData))
+	helper.CheckEqual(t, recorder.Code, 200)
+	warnings := recorder.Header().Values("Warning")
+	helper.CheckEqual(t, len(warnings), 2)
+	helper.CheckEqual(t, warnings[0], `299 - "missing \"sequence\""`)
+	helper.CheckEqual(t, warnings[1], `299 - "station is unhealthy"`)
+
+	// Errors show the warnings in the result only
+	recorder = httptest.NewRecorder()
+	sendResponse(recorder, in, processOutput(in, Result{Code: 400, Message: "invalid", Warnings: []string{"unused"}}, handlerData))
+	helper.CheckEqual(t, recorder.Code, 400)
+	helper.CheckEqual(t, recorder.Header().Get("Warning"), "")
+	helper.CheckEqual(t, recorder.Body.String(), `{"message":"invalid","warnings":["unused"]}`+"\n")
+}
+
+func TestBodyLimit(t *testing.T) {
+	requestLog := log.WithField("test", t.Name())
+
+	// Known length above the limit is rejected before reading
+	httpRequest := httptest.NewRequest("POST", "/test/", strings.NewReader("0123456789"))
+	_, err := processInput(httptest.NewRecorder(), httpRequest, "/test/", 5, uuid.New(), requestLog)
+	helper.CheckEqual(t, err, errBodyTooLarge)
+
+	// Unknown length (chunked) is cut off at the limit
+	httpRequest = httptest.NewRequest("POST", "/test/", strings.NewReader("0123456789"))
+	httpRequest.ContentLength = -1
+	_, err = processInput(httptest.NewRecorder(), httpRequest, "/test/", 5, uuid.New(), requestLog)
+	helper.CheckEqual(t, err, errBodyTooLarge)
+
+	// Within the limit
+	httpRequest = httptest.NewRequest("POST", "/test/", strings.NewReader("0123456789"))
+	httpRequest.ContentLength = -1
+	in, err := processInput(httptest.NewRecorder(), httpRequest, "/test/", 10, uuid.New(), requestLog)
+	helper.CheckEqual(t, err, nil)
+	helper.CheckEqual(t, string(in.data), "0123456789")
+	helper.CheckEqual(t, in.pathSuffix, "")
+
+	// Handlers may have higher limits than the global one
+	type upload struct{}
+	SetBodyLimit(&upload{}, func() int64 { return defaultMaxBodyBytes * 2 })
+	helper.CheckEqual(t, getBodyLimit(nil), int64(defaultMaxBodyBytes))
+	helper.CheckEqual(t, getBodyLimit(&receiver{allocator: func() interface{} { return &upload{} }}), int64(defaultMaxBodyBytes*2))
+}
@@ -0,0 +1,78 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"fmt"
+
+	"github.com/gathering/tech-online-backend/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// ConfigReloadRequest is a request to reload the reloadable config sections from the config file, like SIGHUP.
+type ConfigReloadRequest struct {
+	Changed []string `json:"changed"` // In the response, the sections which changed
+}
+
+func init() {
+	AddHandler("/config/", "^reload/$", func() interface{} { return &ConfigReloadRequest{} })
+	config.AddValidator(validateStaticAccessTokens)
+	config.OnReload(func(changed []string) {
+		if !config.ChangedSection(changed, "access_tokens") {
+			return
+		}
+		if err := UpdateStaticAccessTokens(); err != nil {
+			log.WithError(err).Error("Failed to update static access tokens after config reload")
+		}
+	})
+}
+
+// Post reloads the config, responding with the changed sections. Responds with 400 and the reason if the config is invalid.
+func (reloadRequest *ConfigReloadRequest) Post(request *Request) Result {
+	// Check perms
+	if request.AccessToken.GetRole() != RoleAdmin {
+		return UnauthorizedResult(request.AccessToken)
+	}
+
+	// Reload
+	changed, err := config.Reload()
+	if err != nil {
+		return Result{Code: 400, Message: fmt.Sprintf("failed to reload config: %v", err)}
+	}
+	reloadRequest.Changed = changed
+	request.Log().WithFields(log.Fields{
+		"changed": changed,
+		"actor":   request.AccessToken.GetName(),
+	}).Info("Config reloaded through API")
+	return Result{}
+}
+
+// validateStaticAccessTokens checks that the static tokens have non-user roles.
+func validateStaticAccessTokens(candidate *config.MainConfig) error {
+	for id, token := range candidate.AccessTokens {
+		switch Role(token.Role) {
+		case RoleGuest, RoleOperator, RoleAdmin, RoleTester, RoleRunner:
+		default:
+			return fmt.Errorf("access token %v: invalid role: %v", id, token.Role)
+		}
+	}
+	return nil
+}
@@ -20,27 +20,58 @@ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
 
 package rest
 
-import "github.com/google/uuid"
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
 
 // Request contains the last part of the URL (without the handler prefix), certain query args,
 // and a limit on how many elements to get.
 type Request struct {
 	ID          uuid.UUID
 	Method      string
+	PathPrefix  string // The handler prefix, e.g. "/station/"
 	AccessToken AccessTokenEntry
 	PathArgs    map[string]string
 	QueryArgs   map[string]string
-	ListLimit   int  // How many elements to return in listings (convenience)
-	ListBrief   bool // If only the most relevant fields should be included listings (convenience)
+	ContentType string        // Content type of the body
+	Header      http.Header   // Request headers, for handlers needing more than the token, e.g. signatures
+	Body        []byte        // Raw body, only JSON-decoded into the handler data if not a raw content type (see isRawContentType)
+	ListLimit   int           // How many elements to return in listings (convenience)
+	ListBrief   bool          // If only the most relevant fields should be included listings (convenience)
+	Filters     []interface{} // Where args for the DB layer from query args with operators, for handlers implementing QueryFilterable
+	logEntry    *log.Entry
+	ctx         context.Context
+}
+
+// Context returns the context of the HTTP request, which is canceled if the client goes away.
+func (request *Request) Context() context.Context {
+	if request.ctx == nil {
+		return context.Background()
+	}
+	return request.ctx
+}
+
+// Log returns a logger with the request ID, method, path and token role, for request-scoped log entries.
+func (request *Request) Log() *log.Entry {
+	if request.logEntry == nil {
+		return log.WithField("request_id", request.ID)
+	}
+	return request.logEntry
 }
 
 // Result is an update report on write-requests. The precise meaning might
 // vary, but the gist should be the same.
 type Result struct {
-	Message  string `json:"message,omitempty"` // Message for client
-	Code     int    `json:"-"`                 // HTTP status
-	Location string `json:"-"`                 // For location header if code 3xx
-	Error    error  `json:"-"`                 // Internal error, forces code 500, hidden from client to avoid leak
+	Message  string      `json:"message,omitempty"`  // Message for client
+	Details  interface{} `json:"details,omitempty"`  // Extra info for client, e.g. conflicting objects
+	Code     int         `json:"-"`                  // HTTP status
+	Location string      `json:"-"`                  // For location header if code 3xx
+	Error    error       `json:"-"`                  // Internal error, forces code 500, hidden from client to avoid leak
+	Warnings []string    `json:"warnings,omitempty"` // Notes for the client on success, e.g. about defaults, also sent as "Warning" headers
 }
 
 // IsOk checks if error free and either not set code or a non-error code.
@@ -48,12 +79,31 @@ func (result *Result) IsOk() bool {
 	return result.Error == nil && result.Code >= 0 && result.Code < 400
 }
 
+// RawResponse is response data which is sent as-is instead of being JSON-encoded, e.g. for file downloads.
+type RawResponse struct {
+	ContentType string // Defaults to "application/octet-stream"
+	Filename    string // If set, the client is asked to download it as a file with this name
+	Data        []byte
+}
+
+// RawResponder may be implemented by handler data which should be sent raw for successful requests.
+type RawResponder interface {
+	RawResponse() *RawResponse
+}
+
 // Getter implements Get method, which should fetch the object represented
 // by the element path.
 type Getter interface {
 	Get(request *Request) Result
 }
 
+// Versioner may be implemented by getters which can cheaply tell the version of the resource (e.g. its last change time)
+// without loading and serializing it. Unchanged resources are then responded to with 304 using a cached ETag,
+// without calling Get. The version must change whenever the response would, or be empty if unknown.
+type Versioner interface {
+	Version(request *Request) (string, error)
+}
+
 // Putter is an idempotent method that requires an absolute path. It should
 // (over-)write the object found at the element path.
 type Putter interface {
@@ -74,3 +124,32 @@ type Poster interface {
 type Deleter interface {
 	Delete(request *Request) Result
 }
+
+// Streamer is implemented by endpoints which take over the connection for upgrade requests, e.g. WebSockets.
+// Stream should check the request like a normal handler and return the HTTP handler to take over,
+// or a failed result to respond with instead.
+type Streamer interface {
+	Stream(request *Request) (http.Handler, Result)
+}
+
+// RequestFilter checks requests before they reach the handlers, e.g. to enforce global policies.
+// A failed result is responded with instead of calling the handler.
+type RequestFilter func(request *Request) Result
+
+var requestFilters []RequestFilter
+
+// AddRequestFilter registers a filter for all requests (except OPTIONS and upgrade requests). Filters run in order.
+// Register them during init, they're not safe to add concurrently with requests.
+func AddRequestFilter(filter RequestFilter) {
+	requestFilters = append(requestFilters, filter)
+}
+
+// FilterRequest runs the filters, returning the first failed result. Other APIs (e.g. gRPC) calling handlers directly should use it too.
+func FilterRequest(request *Request) Result {
+	for _, filter := range requestFilters {
+		if result := filter(request); !result.IsOk() {
+			return result
+		}
+	}
+	return Result{}
+}
@@ -0,0 +1,176 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gathering/tech-online-backend/db"
+)
+
+// captureNameRegex matches valid path arg names.
+var captureNameRegex = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// handlerErrors are problems found when registering handlers, e.g. patterns which didn't compile.
+var handlerErrors []string
+
+// SelfCheck checks the registered handlers, returning the problems found. It should be called before serving,
+// so mistakes fail at startup instead of as 500s for the first request.
+// Path patterns must compile, be anchored and have valid capture names, and the DB columns of handler data
+// must all exist in at least one table.
+func SelfCheck() ([]string, error) {
+	tables, err := loadTableColumns()
+	if err != nil {
+		return nil, err
+	}
+	problems := append([]string{}, handlerErrors...)
+	problems = append(problems, checkHandlerPatterns()...)
+	problems = append(problems, checkHandlerColumns(tables)...)
+	return problems, nil
+}
+
+// loadTableColumns gets the columns of all tables in the schema of the DB (see db.Schema).
+func loadTableColumns() (map[string]map[string]bool, error) {
+	rows, err := db.DB.Query("SELECT table_name, column_name FROM information_schema.columns WHERE table_schema = $1", db.Schema())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tables := make(map[string]map[string]bool)
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			return nil, err
+		}
+		if tables[table] == nil {
+			tables[table] = make(map[string]bool)
+		}
+		tables[table][column] = true
+	}
+	return tables, rows.Err()
+}
+
+// checkHandlerPatterns checks that the path patterns are anchored and have valid, unique capture names.
+func checkHandlerPatterns() []string {
+	var problems []string
+	forEachReceiver(func(prefix string, receiver receiver) {
+		pattern := receiver.pathPattern.String()
+		if !strings.HasPrefix(pattern, "^") || !strings.HasSuffix(pattern, "$") {
+			problems = append(problems, fmt.Sprintf("[%v][%v]: pattern is not anchored with ^ and $", prefix, pattern))
+		}
+		seen := make(map[string]bool)
+		for i, name := range receiver.pathPattern.SubexpNames() {
+			if i == 0 || name == "" {
+				continue
+			}
+			if !captureNameRegex.MatchString(name) {
+				problems = append(problems, fmt.Sprintf("[%v][%v]: invalid capture name %q", prefix, pattern, name))
+			}
+			if seen[name] {
+				problems = append(problems, fmt.Sprintf("[%v][%v]: duplicate capture name %q", prefix, pattern, name))
+			}
+			seen[name] = true
+		}
+	})
+	return problems
+}
+
+// checkHandlerColumns checks that the column tags of each handler data type all exist in some table.
+// Types without column tags (e.g. action requests) are skipped.
+func checkHandlerColumns(tables map[string]map[string]bool) []string {
+	var problems []string
+	checked := make(map[reflect.Type]bool)
+	forEachReceiver(func(prefix string, receiver receiver) {
+		dataType := dataStructType(reflect.TypeOf(receiver.allocator()))
+		if dataType == nil || checked[dataType] {
+			return
+		}
+		checked[dataType] = true
+		columns := columnTags(dataType)
+		if len(columns) == 0 {
+			return
+		}
+
+		// Find the table with the fewest missing columns
+		bestTable := ""
+		var bestMissing []string
+		for table, tableColumns := range tables {
+			var missing []string
+			for _, column := range columns {
+				if !tableColumns[column] {
+					missing = append(missing, column)
+				}
+			}
+			if bestTable == "" || len(missing) < len(bestMissing) || len(missing) == len(bestMissing) && table < bestTable {
+				bestTable = table
+				bestMissing = missing
+			}
+		}
+		if bestTable == "" {
+			problems = append(problems, fmt.Sprintf("[%v] %v: no tables in the DB", prefix, dataType))
+		} else if len(bestMissing) > 0 {
+			problems = append(problems, fmt.Sprintf("[%v] %v: no table has all columns, the closest table %v is missing %v",
+				prefix, dataType, bestTable, strings.Join(bestMissing, ", ")))
+		}
+	})
+	return problems
+}
+
+// forEachReceiver calls the function for all receivers, sorted by prefix for stable reports.
+func forEachReceiver(handle func(prefix string, receiver receiver)) {
+	prefixes := make([]string, 0, len(receiverSets))
+	for prefix := range receiverSets {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		for _, receiver := range receiverSets[prefix].receivers {
+			handle(prefix, receiver)
+		}
+	}
+}
+
+// dataStructType gets the struct type of handler data, through pointers and slices (for listings).
+func dataStructType(dataType reflect.Type) reflect.Type {
+	for dataType != nil && (dataType.Kind() == reflect.Ptr || dataType.Kind() == reflect.Slice) {
+		dataType = dataType.Elem()
+	}
+	if dataType == nil || dataType.Kind() != reflect.Struct {
+		return nil
+	}
+	return dataType
+}
+
+// columnTags gets the DB columns of a struct type, from the "column" tags.
+func columnTags(structType reflect.Type) []string {
+	var columns []string
+	for i := 0; i < structType.NumField(); i++ {
+		column := structType.Field(i).Tag.Get("column")
+		if column != "" && column != "-" {
+			columns = append(columns, column)
+		}
+	}
+	return columns
+}
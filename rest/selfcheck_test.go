@@ -0,0 +1,64 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package rest
+
+import (
+	"testing"
+
+	"github.com/gathering/tech-online-backend/helper"
+)
+
+type selfCheckThing struct {
+	ID    string `column:"id" json:"id"`
+	Name  string `column:"name" json:"name"`
+	Extra string `column:"-" json:"extra"`
+}
+
+type selfCheckThings []*selfCheckThing
+
+func TestCheckHandlerColumns(t *testing.T) {
+	savedSets := receiverSets
+	defer func() { receiverSets = savedSets }()
+	receiverSets = nil
+	AddHandler("/things/", "^$", func() interface{} { return &selfCheckThings{} })
+	AddHandler("/thing/", "^(?P<id>[^/]+)/$", func() interface{} { return &selfCheckThing{} })
+
+	tables := map[string]map[string]bool{
+		"things": {"id": true, "name": true, "other": true},
+	}
+	helper.CheckEqual(t, len(checkHandlerColumns(tables)), 0)
+
+	delete(tables["things"], "name")
+	problems := checkHandlerColumns(tables)
+	helper.CheckEqual(t, len(problems), 1) // Same type for both handlers
+	helper.CheckEqual(t, problems[0], "[/thing/] rest.selfCheckThing: no table has all columns, the closest table things is missing name")
+}
+
+func TestCheckHandlerPatterns(t *testing.T) {
+	savedSets := receiverSets
+	defer func() { receiverSets = savedSets }()
+	receiverSets = nil
+	AddHandler("/thing/", "^(?P<id>[^/]+)/$", func() interface{} { return &selfCheckThing{} })
+	helper.CheckEqual(t, len(checkHandlerPatterns()), 0)
+
+	AddHandler("/thing/", "(?P<ID>[^/]+)/$", func() interface{} { return &selfCheckThing{} })
+	AddHandler("/thing/", "^(?P<id>[^/]+)/(?P<id>[^/]+)/$", func() interface{} { return &selfCheckThing{} })
+	helper.CheckEqual(t, len(checkHandlerPatterns()), 3)
+}
@@ -0,0 +1,65 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rest
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+)
+
+// serverTimeout returns the configured timeout, the default if zero or none (zero) if negative.
+func serverTimeout(seconds int, defaultSeconds int) time.Duration {
+	if seconds == 0 {
+		seconds = defaultSeconds
+	}
+	if seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// configureServer sets the timeouts and limits of the server from the config.
+// Long-lived connections like websockets must clear the deadlines themselves.
+func configureServer(server *http.Server) {
+	serverConfig := config.Config.HTTPServer
+	server.ReadHeaderTimeout = serverTimeout(serverConfig.ReadHeaderTimeoutSeconds, 10)
+	server.ReadTimeout = serverTimeout(serverConfig.ReadTimeoutSeconds, 60)
+	server.WriteTimeout = serverTimeout(serverConfig.WriteTimeoutSeconds, 60)
+	server.IdleTimeout = serverTimeout(serverConfig.IdleTimeoutSeconds, 120)
+	server.MaxHeaderBytes = http.DefaultMaxHeaderBytes
+	if serverConfig.MaxHeaderBytes > 0 {
+		server.MaxHeaderBytes = serverConfig.MaxHeaderBytes
+	}
+	server.SetKeepAlivesEnabled(!serverConfig.DisableKeepAlives)
+}
+
+// listen listens on the TCP address with the configured TCP keep-alive interval.
+func listen(address string) (net.Listener, error) {
+	listenConfig := net.ListenConfig{KeepAlive: serverTimeout(config.Config.HTTPServer.TCPKeepAliveSeconds, 15)}
+	if listenConfig.KeepAlive == 0 {
+		listenConfig.KeepAlive = -1 // Disabled
+	}
+	return listenConfig.Listen(context.Background(), "tcp", address)
+}
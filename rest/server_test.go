@@ -0,0 +1,49 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package rest
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/helper"
+)
+
+func TestConfigureServer(t *testing.T) {
+	defer func() { config.Config.HTTPServer = config.HTTPServerConfig{} }()
+
+	var server http.Server
+	configureServer(&server)
+	helper.CheckEqual(t, server.ReadHeaderTimeout, 10*time.Second)
+	helper.CheckEqual(t, server.ReadTimeout, 60*time.Second)
+	helper.CheckEqual(t, server.WriteTimeout, 60*time.Second)
+	helper.CheckEqual(t, server.IdleTimeout, 120*time.Second)
+	helper.CheckEqual(t, server.MaxHeaderBytes, http.DefaultMaxHeaderBytes)
+
+	config.Config.HTTPServer = config.HTTPServerConfig{ReadTimeoutSeconds: 5, WriteTimeoutSeconds: -1, MaxHeaderBytes: 4096}
+	server = http.Server{}
+	configureServer(&server)
+	helper.CheckEqual(t, server.ReadHeaderTimeout, 10*time.Second)
+	helper.CheckEqual(t, server.ReadTimeout, 5*time.Second)
+	helper.CheckEqual(t, server.WriteTimeout, time.Duration(0))
+	helper.CheckEqual(t, server.MaxHeaderBytes, 4096)
+}
@@ -148,6 +148,74 @@ func createUserAccessToken(user *User) (*AccessTokenEntry, error) {
 	return &token, nil
 }
 
+// CreateNonUserAccessToken creates and saves a non-user access token with a generated ID and key, e.g. for test scripts.
+// Unlike static tokens, it's kept in the DB only and survives config changes until it expires or is revoked.
+func CreateNonUserAccessToken(role Role, comment string, lifetime time.Duration) (*AccessTokenEntry, error) {
+	switch role {
+	case RoleOperator, RoleAdmin, RoleTester, RoleRunner:
+	default:
+		return nil, fmt.Errorf("invalid non-user role: %v", role)
+	}
+	newKey, newKeyErr := generateAccessTokenKey()
+	if newKeyErr != nil {
+		return nil, newKeyErr
+	}
+
+	token := AccessTokenEntry{
+		ID:             uuid.New(),
+		Key:            newKey,
+		NonUserRole:    &role,
+		CreationTime:   time.Now(),
+		ExpirationTime: time.Now().Add(lifetime),
+		IsStatic:       false,
+		Comment:        comment,
+	}
+
+	if valRes := token.validateInternal(); valRes != "" {
+		return nil, fmt.Errorf("failed to validate access token: %v", valRes)
+	}
+
+	dbResult := db.Insert("access_tokens", token)
+	if dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+
+	return &token, nil
+}
+
+// ListAccessTokens gets all access tokens, with the keys hidden.
+func ListAccessTokens() (AccessTokenEntries, error) {
+	var tokens AccessTokenEntries
+	dbResult := db.SelectMany(&tokens, "access_tokens")
+	if dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	for _, token := range tokens {
+		token.Key = ""
+	}
+	return tokens, nil
+}
+
+// RevokeAccessToken deletes a non-static access token. Static tokens must be removed from the config instead.
+func RevokeAccessToken(id uuid.UUID) error {
+	var token AccessTokenEntry
+	dbResult := db.Select(&token, "access_tokens", "id", "=", id)
+	if dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	if !dbResult.IsSuccess() {
+		return fmt.Errorf("access token not found: %v", id)
+	}
+	if token.IsStatic {
+		return fmt.Errorf("access token is static, remove it from the config instead: %v", id)
+	}
+	dbResult = db.Delete("access_tokens", "id", "=", id)
+	if dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	return nil
+}
+
 // loadAccessTokenByKey returns a valid token for the provided key or nil if none exists.
 // If a token key header was specified but no valid token could be found for it,
 // the request should probably be denied.
@@ -188,6 +256,14 @@ func loadAccessTokenByKey(key string) *AccessTokenEntry {
 	return &token
 }
 
+// AccessTokenForKey returns the valid token for the key, or a guest token if there is none, for APIs besides REST (e.g. gRPC).
+func AccessTokenForKey(key string) AccessTokenEntry {
+	if token := loadAccessTokenByKey(key); token != nil {
+		return *token
+	}
+	return makeGuestAccessToken()
+}
+
 // makeGuestAccessToken creates an empty-ish guest access token, such that all requests (authenticated or not) have a role.
 func makeGuestAccessToken() AccessTokenEntry {
 	id, _ := uuid.FromBytes([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
@@ -205,13 +281,20 @@ func makeGuestAccessToken() AccessTokenEntry {
 	}
 }
 
-// purgeExpiredAccessTokens deletes all expired tokens. Should be called periodically.
-func purgeExpiredAccessTokens() {
-	now := time.Now()
-	dbResult := db.Delete("access_tokens", "expiration_time", "<=", now)
+// PurgeExpiredAccessTokens deletes the tokens which expired before the time, or only counts them for dry runs.
+// Expired tokens are never accepted, so this just cleans up. Should be called periodically.
+func PurgeExpiredAccessTokens(expiredBefore time.Time, dryRun bool) (int, error) {
+	if dryRun {
+		var count int
+		row := db.DB.QueryRow("SELECT COUNT(*) FROM access_tokens WHERE expiration_time <= $1 AND NOT static", expiredBefore)
+		err := row.Scan(&count)
+		return count, err
+	}
+	dbResult := db.Delete("access_tokens", "expiration_time", "<=", expiredBefore, "static", "=", false)
 	if dbResult.IsFailed() {
-		log.WithError(dbResult.Error).Error("Failed to purge old access tokens")
+		return 0, dbResult.Error
 	}
+	return dbResult.Affected, nil
 }
 
 // Generate a Base64-encoded token key using a secure amount of random bytes.
@@ -252,6 +335,19 @@ func (token *AccessTokenEntry) GetRole() Role {
 	return RoleInvalid
 }
 
+// GetName returns a human-readable name for the token owner, e.g. for authors in change logs.
+// Returns the username if user token or the comment (or ID if no comment) if non-user token.
+// Assumes the user is already loaded if user token.
+func (token *AccessTokenEntry) GetName() string {
+	if token.OwnerUser != nil {
+		return token.OwnerUser.Username
+	}
+	if token.Comment != "" {
+		return token.Comment
+	}
+	return token.ID.String()
+}
+
 // IsAuthenticated checks if the requestor is authenticated.
 func (token *AccessTokenEntry) IsAuthenticated() bool {
 	role := token.GetRole()
@@ -31,11 +31,14 @@ import (
 // information. This is retrieved from the frontend, so where it comes from
 // is somewhat irrelevant.
 type User struct {
-	ID           *uuid.UUID `column:"id" json:"id"`                       // Required, unique
-	Username     string     `column:"username" json:"username"`           // Required, unique
-	DisplayName  string     `column:"display_name" json:"display_name"`   // Required
-	EmailAddress string     `column:"email_address" json:"email_address"` // Required
-	Role         Role       `column:"role" json:"role"`                   // Required (valid)
+	ID           *uuid.UUID `column:"id" json:"id" brief:"true"`                     // Required, unique
+	Username     string     `column:"username" json:"username" brief:"true"`         // Required, unique
+	DisplayName  string     `column:"display_name" json:"display_name" brief:"true"` // Required
+	EmailAddress string     `column:"email_address" json:"email_address"`            // Required
+	Role         Role       `column:"role" json:"role" brief:"true"`                 // Required (valid)
+	SeatHall     string     `column:"seat_hall" json:"seat_hall"`                    // From the seating system, if seated
+	SeatRow      string     `column:"seat_row" json:"seat_row"`                      // See above
+	Seat         string     `column:"seat" json:"seat"`                              // See above
 }
 
 // Users is a list of users.
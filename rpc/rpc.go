@@ -0,0 +1,341 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+// Package rpc is a small gRPC server (HTTP/2 over TLS, or cleartext if no certificate is configured) for internal integrations
+// like checkers and provisioning agents, on a separate port from the REST API. Messages are encoded by hand with the protobuf helpers, see "techo.proto".
+package rpc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/errorreport"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const defaultMaxMessageBytes = 4 << 20
+
+// Code is a gRPC status code.
+type Code int
+
+// Status codes, see https://grpc.github.io/grpc/core/md_doc_statuscodes.html
+const (
+	CodeOK                 Code = 0
+	CodeCanceled           Code = 1
+	CodeUnknown            Code = 2
+	CodeInvalidArgument    Code = 3
+	CodeDeadlineExceeded   Code = 4
+	CodeNotFound           Code = 5
+	CodePermissionDenied   Code = 7
+	CodeResourceExhausted  Code = 8
+	CodeFailedPrecondition Code = 9
+	CodeUnimplemented      Code = 12
+	CodeInternal           Code = 13
+	CodeUnavailable        Code = 14
+	CodeUnauthenticated    Code = 16
+)
+
+// Status is an error with a status code for the client.
+type Status struct {
+	Code    Code
+	Message string
+}
+
+func (status *Status) Error() string {
+	return fmt.Sprintf("rpc status %v: %v", status.Code, status.Message)
+}
+
+// Errorf creates an error with a status code for the client.
+func Errorf(code Code, format string, args ...interface{}) error {
+	return &Status{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// ResultError converts a failed REST result to a status, e.g. when using the REST handlers.
+func ResultError(result rest.Result, token rest.AccessTokenEntry) error {
+	if result.Error != nil {
+		return result.Error
+	}
+	switch {
+	case result.IsOk():
+		return nil
+	case result.Code == 400:
+		return Errorf(CodeInvalidArgument, "%v", result.Message)
+	case result.Code == 401 || result.Code == 403:
+		if !token.IsAuthenticated() {
+			return Errorf(CodeUnauthenticated, "%v", result.Message)
+		}
+		return Errorf(CodePermissionDenied, "%v", result.Message)
+	case result.Code == 404:
+		return Errorf(CodeNotFound, "%v", result.Message)
+	case result.Code == 409:
+		return Errorf(CodeFailedPrecondition, "%v", result.Message)
+	case result.Code == 429:
+		return Errorf(CodeResourceExhausted, "%v", result.Message)
+	case result.Code == 503:
+		return Errorf(CodeUnavailable, "%v", result.Message)
+	}
+	return Errorf(CodeUnknown, "%v", result.Message)
+}
+
+// Call is an incoming call, with the access token from the "authorization" metadata ("Bearer <key>").
+type Call struct {
+	ID          uuid.UUID
+	Method      string
+	AccessToken rest.AccessTokenEntry
+	ctx         context.Context
+	logEntry    *log.Entry
+}
+
+// Context returns the context of the call, which is canceled if the client goes away or the deadline is exceeded.
+func (call *Call) Context() context.Context {
+	return call.ctx
+}
+
+// Log returns a logger with the call ID, method and token role.
+func (call *Call) Log() *log.Entry {
+	return call.logEntry
+}
+
+// UnaryHandler handles a call with one request message and one response message.
+type UnaryHandler func(call *Call, request []byte) (*Encoder, error)
+
+// StreamHandler handles a call with one request message and a stream of response messages, until it returns.
+type StreamHandler func(call *Call, request []byte, send func(message *Encoder) error) error
+
+type method struct {
+	unary  UnaryHandler
+	stream StreamHandler
+}
+
+var methods = make(map[string]method)
+
+// AddUnaryMethod registers a unary method, named like "/<package>.<service>/<method>".
+func AddUnaryMethod(name string, handler UnaryHandler) {
+	methods[name] = method{unary: handler}
+}
+
+// AddStreamMethod registers a server streaming method, named like "/<package>.<service>/<method>".
+func AddStreamMethod(name string, handler StreamHandler) {
+	methods[name] = method{stream: handler}
+}
+
+// Serve serves the registered methods on the configured address. Never returns.
+func Serve() {
+	listener, err := net.Listen("tcp", config.Config.GRPC.ListenAddress)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to listen for gRPC")
+	}
+	log.WithFields(log.Fields{
+		"listen_address": config.Config.GRPC.ListenAddress,
+		"tls":            config.Config.GRPC.CertFile != "",
+	}).Info("gRPC server is listening")
+	log.Fatal(serve(listener, config.Config.GRPC))
+}
+
+// serve serves the registered methods on the listener, using TLS if a certificate is configured and cleartext HTTP/2 (h2c) if not.
+func serve(listener net.Listener, grpcConfig config.GRPCConfig) error {
+	if (grpcConfig.CertFile == "") != (grpcConfig.KeyFile == "") {
+		return errors.New("cert_file and key_file must be set together")
+	}
+	server := http.Server{
+		Handler:           http.HandlerFunc(serveCall),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if grpcConfig.CertFile == "" {
+		server.Handler = h2c.NewHandler(server.Handler, &http2.Server{})
+		return server.Serve(listener)
+	}
+	if err := http2.ConfigureServer(&server, &http2.Server{}); err != nil {
+		return err
+	}
+	return server.ServeTLS(listener, grpcConfig.CertFile, grpcConfig.KeyFile)
+}
+
+func serveCall(httpWriter http.ResponseWriter, httpRequest *http.Request) {
+	call := Call{ID: uuid.New(), Method: httpRequest.URL.Path}
+	call.logEntry = log.WithFields(log.Fields{
+		"call_id": call.ID,
+		"method":  call.Method,
+	})
+	if httpRequest.Method != "POST" || !strings.HasPrefix(httpRequest.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(httpWriter, "gRPC only", http.StatusUnsupportedMediaType)
+		return
+	}
+	httpWriter.Header().Set("Content-Type", "application/grpc")
+	httpWriter.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+
+	// Authenticate
+	var tokenKey string
+	if fields := strings.Fields(httpRequest.Header.Get("Authorization")); len(fields) == 2 && strings.ToLower(fields[0]) == "bearer" {
+		tokenKey = fields[1]
+	}
+	call.AccessToken = rest.AccessTokenForKey(tokenKey)
+	call.logEntry = call.logEntry.WithField("role", call.AccessToken.GetRole())
+	call.logEntry.WithField("client", httpRequest.RemoteAddr).Info("Call")
+
+	call.ctx = httpRequest.Context()
+	if timeout, ok := parseTimeout(httpRequest.Header.Get("Grpc-Timeout")); ok {
+		var cancel context.CancelFunc
+		call.ctx, cancel = context.WithTimeout(call.ctx, timeout)
+		defer cancel()
+	}
+
+	err := handleCall(&call, httpWriter, httpRequest.Body)
+	writeStatus(&call, httpWriter, err)
+}
+
+func handleCall(call *Call, httpWriter http.ResponseWriter, body io.Reader) (err error) {
+	// Report panics as internal errors
+	defer func() {
+		if r := recover(); r != nil {
+			call.Log().WithField("panic", r).Error("Call handler panicked")
+			errorreport.CapturePanic(r, map[string]string{"call_id": call.ID.String(), "method": call.Method})
+			err = Errorf(CodeInternal, "internal server error")
+		}
+	}()
+
+	handler, ok := methods[call.Method]
+	if !ok {
+		return Errorf(CodeUnimplemented, "unknown method %v", call.Method)
+	}
+	request, err := readMessage(body)
+	if err != nil {
+		return err
+	}
+	if handler.unary != nil {
+		response, err := handler.unary(call, request)
+		if err != nil {
+			return err
+		}
+		return writeMessage(httpWriter, response)
+	}
+	return handler.stream(call, request, func(message *Encoder) error {
+		if err := call.ctx.Err(); err != nil {
+			return err
+		}
+		return writeMessage(httpWriter, message)
+	})
+}
+
+// readMessage reads the single request message, which is prefixed by the compression flag and the length.
+func readMessage(body io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(body, prefix[:]); err != nil {
+		return nil, Errorf(CodeInvalidArgument, "missing request message")
+	}
+	if prefix[0] != 0 {
+		return nil, Errorf(CodeUnimplemented, "compressed messages are not supported")
+	}
+	maxMessageBytes := config.Config.GRPC.MaxMessageBytes
+	if maxMessageBytes <= 0 {
+		maxMessageBytes = defaultMaxMessageBytes
+	}
+	length := binary.BigEndian.Uint32(prefix[1:])
+	if length > uint32(maxMessageBytes) {
+		return nil, Errorf(CodeResourceExhausted, "request message larger than %v bytes", maxMessageBytes)
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(body, message); err != nil {
+		return nil, Errorf(CodeInvalidArgument, "truncated request message")
+	}
+	return message, nil
+}
+
+func writeMessage(httpWriter http.ResponseWriter, message *Encoder) error {
+	data := message.Bytes()
+	frame := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(data)))
+	frame = append(frame, data...)
+	if _, err := httpWriter.Write(frame); err != nil {
+		return err
+	}
+	if flusher, ok := httpWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+// writeStatus sends the status as trailers. Other errors than statuses are internal.
+func writeStatus(call *Call, httpWriter http.ResponseWriter, err error) {
+	status := &Status{Code: CodeOK}
+	if err != nil {
+		var ok bool
+		if status, ok = err.(*Status); !ok {
+			switch {
+			case err == context.DeadlineExceeded:
+				status = &Status{Code: CodeDeadlineExceeded, Message: "deadline exceeded"}
+			case err == context.Canceled:
+				status = &Status{Code: CodeCanceled, Message: "canceled"}
+			default:
+				call.Log().WithError(err).Warn("internal server error")
+				errorreport.CaptureError(err, map[string]string{"call_id": call.ID.String(), "method": call.Method}, db.ErrorQuery(err))
+				status = &Status{Code: CodeInternal, Message: "internal server error"}
+			}
+		}
+	}
+	call.Log().WithField("code", status.Code).Info("Call done")
+	httpWriter.Header().Set("Grpc-Status", strconv.Itoa(int(status.Code)))
+	httpWriter.Header().Set("Grpc-Message", encodeStatusMessage(status.Message))
+}
+
+// encodeStatusMessage percent-encodes the message as required for the header.
+func encodeStatusMessage(message string) string {
+	var encoded strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			encoded.WriteByte(c)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", c)
+		}
+	}
+	return encoded.String()
+}
+
+// parseTimeout parses the "grpc-timeout" header, e.g. "100m" for 100 milliseconds.
+func parseTimeout(value string) (time.Duration, bool) {
+	if len(value) < 2 {
+		return 0, false
+	}
+	units := map[byte]time.Duration{'H': time.Hour, 'M': time.Minute, 'S': time.Second, 'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond}
+	unit, ok := units[value[len(value)-1]]
+	if !ok {
+		return 0, false
+	}
+	amount, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil || amount < 0 {
+		return 0, false
+	}
+	return time.Duration(amount) * unit, true
+}
@@ -0,0 +1,205 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package rpc
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/helper"
+	"golang.org/x/net/http2"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	var nested Encoder
+	nested.String(1, "inner")
+	var message Encoder
+	message.String(1, "hello")
+	message.String(2, "") // Left out
+	message.Int(3, -1)
+	message.Bool(4, true)
+	message.Double(5, 1.5)
+	message.RepeatedString(6, "")
+	message.Message(7, &nested)
+
+	var fields []Field
+	err := Decode(message.Bytes(), func(field Field) error {
+		fields = append(fields, field)
+		return nil
+	})
+	helper.CheckEqual(t, err, nil)
+	helper.CheckEqual(t, len(fields), 6)
+	helper.CheckEqual(t, fields[0].String(), "hello")
+	helper.CheckEqual(t, fields[1].Int(), int64(-1))
+	helper.CheckEqual(t, fields[2].Bool(), true)
+	helper.CheckEqual(t, fields[3].Double(), 1.5)
+	helper.CheckEqual(t, fields[4].Number, 6)
+	helper.CheckEqual(t, fields[4].String(), "")
+	err = Decode(fields[5].Message(), func(field Field) error {
+		helper.CheckEqual(t, field.String(), "inner")
+		return nil
+	})
+	helper.CheckEqual(t, err, nil)
+
+	// Truncated
+	err = Decode(message.Bytes()[:3], func(field Field) error { return nil })
+	helper.CheckEqual(t, err, errMalformedMessage)
+}
+
+func frame(message *Encoder) []byte {
+	data := make([]byte, 5)
+	binary.BigEndian.PutUint32(data[1:], uint32(len(message.Bytes())))
+	return append(data, message.Bytes()...)
+}
+
+func TestServeCall(t *testing.T) {
+	AddUnaryMethod("/test.v1.Echo/Echo", func(call *Call, request []byte) (*Encoder, error) {
+		var response Encoder
+		err := Decode(request, func(field Field) error {
+			if field.String() == "fail" {
+				return Errorf(CodeInvalidArgument, "failed: %v%%", 100)
+			}
+			response.String(1, field.String())
+			return nil
+		})
+		return &response, err
+	})
+	defer delete(methods, "/test.v1.Echo/Echo")
+
+	call := func(method string, value string) *http.Response {
+		var message Encoder
+		message.String(1, value)
+		httpRequest := httptest.NewRequest("POST", method, bytes.NewReader(frame(&message)))
+		httpRequest.Header.Set("Content-Type", "application/grpc")
+		recorder := httptest.NewRecorder()
+		serveCall(recorder, httpRequest)
+		return recorder.Result()
+	}
+
+	response := call("/test.v1.Echo/Echo", "hi")
+	body := new(bytes.Buffer)
+	body.ReadFrom(response.Body)
+	var expected Encoder
+	expected.String(1, "hi")
+	helper.CheckEqual(t, body.String(), string(frame(&expected)))
+	helper.CheckEqual(t, response.Trailer.Get("Grpc-Status"), "0")
+
+	response = call("/test.v1.Echo/Echo", "fail")
+	helper.CheckEqual(t, response.Trailer.Get("Grpc-Status"), "3")
+	helper.CheckEqual(t, response.Trailer.Get("Grpc-Message"), "failed: 100%25")
+
+	response = call("/test.v1.Echo/Missing", "hi")
+	helper.CheckEqual(t, response.Trailer.Get("Grpc-Status"), "12")
+}
+
+func TestParseTimeout(t *testing.T) {
+	timeout, ok := parseTimeout("100m")
+	helper.CheckEqual(t, ok, true)
+	helper.CheckEqual(t, timeout, 100*time.Millisecond)
+	_, ok = parseTimeout("5x")
+	helper.CheckEqual(t, ok, false)
+}
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 and its key, returning the paths and the certificate.
+func writeTestCertificate(t *testing.T) (string, string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	helper.CheckEqual(t, err, nil)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	helper.CheckEqual(t, err, nil)
+	cert, err := x509.ParseCertificate(certDER)
+	helper.CheckEqual(t, err, nil)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	helper.CheckEqual(t, err, nil)
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	helper.CheckEqual(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0600), nil)
+	helper.CheckEqual(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600), nil)
+	return certFile, keyFile, cert
+}
+
+func TestServeTLS(t *testing.T) {
+	AddUnaryMethod("/test.v1.Echo/Echo", func(call *Call, request []byte) (*Encoder, error) {
+		var response Encoder
+		response.Message(1, &Encoder{data: request})
+		return &response, nil
+	})
+	defer delete(methods, "/test.v1.Echo/Echo")
+
+	// Both are required
+	err := serve(nil, config.GRPCConfig{CertFile: "cert.pem"})
+	helper.CheckNotEqual(t, err, nil)
+
+	certFile, keyFile, cert := writeTestCertificate(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	helper.CheckEqual(t, err, nil)
+	defer listener.Close()
+	go serve(listener, config.GRPCConfig{CertFile: certFile, KeyFile: keyFile})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	client := http.Client{Transport: &http2.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	var message Encoder
+	message.String(1, "hi")
+	httpRequest, err := http.NewRequest("POST", "https://"+listener.Addr().String()+"/test.v1.Echo/Echo", bytes.NewReader(frame(&message)))
+	helper.CheckEqual(t, err, nil)
+	httpRequest.Header.Set("Content-Type", "application/grpc")
+	response, err := client.Do(httpRequest)
+	helper.CheckEqual(t, err, nil)
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	helper.CheckEqual(t, err, nil)
+	var expected Encoder
+	expected.Message(1, &message)
+	helper.CheckEqual(t, response.ProtoMajor, 2)
+	helper.CheckEqual(t, string(body), string(frame(&expected)))
+	helper.CheckEqual(t, response.Trailer.Get("Grpc-Status"), "0")
+
+	// Cleartext isn't accepted
+	plainResponse, err := http.Post("http://"+listener.Addr().String()+"/test.v1.Echo/Echo", "application/grpc", bytes.NewReader(frame(&message)))
+	if err == nil {
+		helper.CheckEqual(t, plainResponse.StatusCode, http.StatusBadRequest)
+		plainResponse.Body.Close()
+	}
+}
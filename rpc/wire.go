@@ -0,0 +1,194 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package rpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errMalformedMessage = errors.New("malformed protobuf message")
+
+// Encoder builds a protobuf message, leaving out default (zero) scalar values like proto3.
+type Encoder struct {
+	data []byte
+}
+
+func (encoder *Encoder) tag(number int, wireType int) {
+	encoder.data = appendUvarint(encoder.data, uint64(number)<<3|uint64(wireType))
+}
+
+func appendUvarint(data []byte, value uint64) []byte {
+	var varint [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(varint[:], value)
+	return append(data, varint[:n]...)
+}
+
+// Uint encodes a uint32/uint64 field.
+func (encoder *Encoder) Uint(number int, value uint64) {
+	if value == 0 {
+		return
+	}
+	encoder.tag(number, wireVarint)
+	encoder.data = appendUvarint(encoder.data, value)
+}
+
+// Int encodes an int32/int64 field.
+func (encoder *Encoder) Int(number int, value int64) {
+	encoder.Uint(number, uint64(value))
+}
+
+// Bool encodes a bool field.
+func (encoder *Encoder) Bool(number int, value bool) {
+	if value {
+		encoder.Uint(number, 1)
+	}
+}
+
+// Double encodes a double field.
+func (encoder *Encoder) Double(number int, value float64) {
+	if value == 0 {
+		return
+	}
+	encoder.tag(number, wireFixed64)
+	var fixed [8]byte
+	binary.LittleEndian.PutUint64(fixed[:], math.Float64bits(value))
+	encoder.data = append(encoder.data, fixed[:]...)
+}
+
+// String encodes a string field.
+func (encoder *Encoder) String(number int, value string) {
+	if value != "" {
+		encoder.RepeatedString(number, value)
+	}
+}
+
+// RepeatedString encodes an element of a repeated string field, which is kept even if empty.
+func (encoder *Encoder) RepeatedString(number int, value string) {
+	encoder.tag(number, wireBytes)
+	encoder.data = appendUvarint(encoder.data, uint64(len(value)))
+	encoder.data = append(encoder.data, value...)
+}
+
+// Message encodes an embedded message field, or an element of a repeated message field.
+func (encoder *Encoder) Message(number int, message *Encoder) {
+	encoder.tag(number, wireBytes)
+	encoder.data = appendUvarint(encoder.data, uint64(len(message.data)))
+	encoder.data = append(encoder.data, message.data...)
+}
+
+// Bytes returns the encoded message.
+func (encoder *Encoder) Bytes() []byte {
+	return encoder.data
+}
+
+// Field is a decoded field of a protobuf message. Repeated fields are decoded as one field per element.
+type Field struct {
+	Number int
+	value  uint64 // For varint and fixed fields
+	data   []byte // For length-delimited fields
+}
+
+// Uint returns the value of a uint32/uint64 field.
+func (field Field) Uint() uint64 {
+	return field.value
+}
+
+// Int returns the value of an int32/int64 field.
+func (field Field) Int() int64 {
+	return int64(field.value)
+}
+
+// Bool returns the value of a bool field.
+func (field Field) Bool() bool {
+	return field.value != 0
+}
+
+// Double returns the value of a double field.
+func (field Field) Double() float64 {
+	return math.Float64frombits(field.value)
+}
+
+// String returns the value of a string field.
+func (field Field) String() string {
+	return string(field.data)
+}
+
+// Message returns the data of an embedded message field, for decoding it.
+func (field Field) Message() []byte {
+	return field.data
+}
+
+// Decode calls the handler for each field of the message, in the order they were encoded.
+func Decode(data []byte, handle func(field Field) error) error {
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errMalformedMessage
+		}
+		data = data[n:]
+		field := Field{Number: int(tag >> 3)}
+		if field.Number <= 0 {
+			return errMalformedMessage
+		}
+		switch tag & 7 {
+		case wireVarint:
+			if field.value, n = binary.Uvarint(data); n <= 0 {
+				return errMalformedMessage
+			}
+			data = data[n:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return errMalformedMessage
+			}
+			field.value = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case wireFixed32:
+			if len(data) < 4 {
+				return errMalformedMessage
+			}
+			field.value = uint64(binary.LittleEndian.Uint32(data))
+			data = data[4:]
+		case wireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || length > uint64(len(data)-n) {
+				return errMalformedMessage
+			}
+			field.data = data[n : n+int(length)]
+			data = data[n+int(length):]
+		default:
+			return errMalformedMessage
+		}
+		if err := handle(field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,355 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package scheduler
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// Run triggers, prefixed to the trigger details.
+const (
+	TriggerCron   = "cron"
+	TriggerManual = "manual"
+)
+
+type action struct {
+	name string
+	run  func() error
+	lock *sync.Mutex // Held while running, so the same action never runs concurrently
+}
+
+type cronEntry struct {
+	name     string
+	action   string
+	schedule *CronSchedule
+	next     time.Time
+}
+
+var actions = make(map[string]*action)
+var actionsLock sync.RWMutex
+var cronEntries []*cronEntry
+var cronEntriesLock sync.RWMutex
+
+// Run is a run of an action triggered by a cron entry or manually. Periodic job runs are not recorded.
+type Run struct {
+	ID        *uuid.UUID `column:"id" json:"id"`
+	Action    string     `column:"action" json:"action"`
+	Trigger   string     `column:"trigger" json:"trigger"` // "cron:<entry>" or "manual:<actor>"
+	StartTime *time.Time `column:"start_time" json:"start_time"`
+	EndTime   *time.Time `column:"end_time" json:"end_time"` // Null if still running
+	Success   *bool      `column:"success" json:"success"`   // Null if still running
+	Error     string     `column:"error" json:"error"`
+}
+
+// Runs is a list of runs.
+type Runs []*Run
+
+// ActionStatus is the status of an action, including the cron entries triggering it.
+type ActionStatus struct {
+	Name            string            `json:"name"`
+	IntervalSeconds int               `json:"interval_seconds,omitempty"` // If it's also a periodic job
+	Running         bool              `json:"running"`
+	CronEntries     []CronEntryStatus `json:"cron_entries"`
+}
+
+// CronEntryStatus is the status of a cron entry.
+type CronEntryStatus struct {
+	Name     string     `json:"name"`
+	Schedule string     `json:"schedule"`
+	NextRun  *time.Time `json:"next_run"`
+}
+
+// ActionStatuses is a list of action statuses.
+type ActionStatuses []*ActionStatus
+
+// ActionRunRequest is a request to run an action now.
+type ActionRunRequest struct{}
+
+func init() {
+	rest.AddHandler("/scheduled-actions/", "^$", func() interface{} { return &ActionStatuses{} })
+	rest.AddHandler("/scheduled-action/", "^(?P<name>[^/]+)/run/$", func() interface{} { return &ActionRunRequest{} })
+	rest.AddHandler("/scheduled-runs/", "^$", func() interface{} { return &Runs{} })
+	rest.AddHandler("/scheduled-run/", "^(?P<id>[^/]+)/$", func() interface{} { return &Run{} })
+}
+
+// AddAction registers an action which is only run by cron entries or manually, e.g. heavy recomputations.
+// Periodic jobs are registered as actions too.
+// Actions should be registered from init functions.
+func AddAction(name string, run func() error) {
+	actionsLock.Lock()
+	defer actionsLock.Unlock()
+	if _, exists := actions[name]; exists {
+		log.WithField("action", name).Fatal("Duplicate scheduler action")
+	}
+	actions[name] = &action{name: name, run: run, lock: &sync.Mutex{}}
+}
+
+func getAction(name string) *action {
+	actionsLock.RLock()
+	defer actionsLock.RUnlock()
+	return actions[name]
+}
+
+// startCron starts the cron entries from the config, skipping invalid ones.
+func startCron() {
+	cronEntriesLock.Lock()
+	defer cronEntriesLock.Unlock()
+
+	for _, entryConfig := range config.Config.Cron {
+		logger := log.WithFields(log.Fields{
+			"entry":    entryConfig.Name,
+			"action":   entryConfig.Action,
+			"schedule": entryConfig.Schedule,
+		})
+		if getAction(entryConfig.Action) == nil {
+			logger.Error("Unknown action for cron entry, skipping")
+			continue
+		}
+		schedule, err := ParseCron(entryConfig.Schedule)
+		if err != nil {
+			logger.WithError(err).Error("Invalid schedule for cron entry, skipping")
+			continue
+		}
+		entry := &cronEntry{
+			name:     entryConfig.Name,
+			action:   entryConfig.Action,
+			schedule: schedule,
+			next:     schedule.Next(time.Now()),
+		}
+		if entry.next.IsZero() {
+			logger.Error("Schedule for cron entry never matches, skipping")
+			continue
+		}
+		cronEntries = append(cronEntries, entry)
+		logger.WithField("next", entry.next).Info("Starting cron entry")
+		go entry.loop()
+	}
+}
+
+func (entry *cronEntry) loop() {
+	for {
+		cronEntriesLock.RLock()
+		next := entry.next
+		cronEntriesLock.RUnlock()
+		time.Sleep(time.Until(next))
+
+		if _, err := StartRun(entry.action, fmt.Sprintf("%v:%v", TriggerCron, entry.name)); err != nil {
+			log.WithError(err).WithField("entry", entry.name).Warn("Failed to start cron entry run")
+		}
+
+		cronEntriesLock.Lock()
+		entry.next = entry.schedule.Next(time.Now())
+		cronEntriesLock.Unlock()
+		if entry.next.IsZero() {
+			return
+		}
+	}
+}
+
+// ErrAlreadyRunning is returned when trying to run an action which is already running.
+var ErrAlreadyRunning = fmt.Errorf("already running")
+
+// ErrUnknownAction is returned when trying to run an action which doesn't exist.
+var ErrUnknownAction = fmt.Errorf("unknown action")
+
+// StartRun starts running the action in the background and records the run.
+// Fails if the action is already running.
+func StartRun(name string, trigger string) (*Run, error) {
+	currentAction := getAction(name)
+	if currentAction == nil {
+		return nil, ErrUnknownAction
+	}
+	if !currentAction.lock.TryLock() {
+		return nil, ErrAlreadyRunning
+	}
+
+	id := uuid.New()
+	now := time.Now()
+	run := Run{
+		ID:        &id,
+		Action:    name,
+		Trigger:   trigger,
+		StartTime: &now,
+	}
+	if dbResult := db.Insert("scheduled_runs", run); dbResult.IsFailed() {
+		currentAction.lock.Unlock()
+		return nil, dbResult.Error
+	}
+
+	go func() {
+		defer currentAction.lock.Unlock()
+		logger := log.WithFields(log.Fields{
+			"action":  name,
+			"trigger": trigger,
+			"run":     id,
+		})
+		logger.Info("Running scheduled action")
+
+		err := safeRun(name, currentAction.run)
+		endTime := time.Now()
+		success := err == nil
+		errorString := ""
+		if err != nil {
+			errorString = err.Error()
+			logger.WithError(err).Warn("Scheduled action failed")
+		}
+		if _, dbErr := db.DB.Exec("UPDATE scheduled_runs SET end_time = $1, success = $2, error = $3 WHERE id = $4", endTime, success, errorString, id); dbErr != nil {
+			logger.WithError(dbErr).Warn("Failed to save scheduled action run")
+		}
+	}()
+	return &run, nil
+}
+
+// Get gets all actions with the cron entries triggering them.
+func (statuses *ActionStatuses) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	jobsLock.Lock()
+	intervals := make(map[string]time.Duration)
+	for _, currentJob := range jobs {
+		intervals[currentJob.name] = currentJob.interval
+	}
+	jobsLock.Unlock()
+
+	actionsLock.RLock()
+	for _, currentAction := range actions {
+		status := ActionStatus{
+			Name:            currentAction.name,
+			IntervalSeconds: int(intervals[currentAction.name] / time.Second),
+			CronEntries:     []CronEntryStatus{},
+		}
+		if currentAction.lock.TryLock() {
+			currentAction.lock.Unlock()
+		} else {
+			status.Running = true
+		}
+		*statuses = append(*statuses, &status)
+	}
+	actionsLock.RUnlock()
+
+	cronEntriesLock.RLock()
+	for _, entry := range cronEntries {
+		for _, status := range *statuses {
+			if status.Name == entry.action {
+				next := entry.next
+				status.CronEntries = append(status.CronEntries, CronEntryStatus{
+					Name:     entry.name,
+					Schedule: entry.schedule.String(),
+					NextRun:  &next,
+				})
+			}
+		}
+	}
+	cronEntriesLock.RUnlock()
+
+	sort.Slice(*statuses, func(i, j int) bool {
+		return (*statuses)[i].Name < (*statuses)[j].Name
+	})
+	return rest.Result{}
+}
+
+// Post runs the action now, redirecting to the run.
+func (runRequest *ActionRunRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Run
+	name := request.PathArgs["name"]
+	run, err := StartRun(name, fmt.Sprintf("%v:%v", TriggerManual, request.AccessToken.GetName()))
+	if err == ErrUnknownAction {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+	if err == ErrAlreadyRunning {
+		return rest.Result{Code: 409, Message: "already running"}
+	}
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	return rest.Result{Code: 201, Location: fmt.Sprintf("%v/scheduled-run/%v/", config.Config.SitePrefix, run.ID)}
+}
+
+// Get gets the run history, newest first.
+// Use the "action" query arg to limit to one action and "limit" to limit the number of runs.
+func (runs *Runs) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params, prep filtering
+	var whereArgs []interface{}
+	if name, ok := request.QueryArgs["action"]; ok {
+		whereArgs = append(whereArgs, "action", "=", name)
+	}
+	limit := 0
+	if rawLimit, ok := request.QueryArgs["limit"]; ok {
+		var err error
+		limit, err = strconv.Atoi(rawLimit)
+		if err != nil || limit < 0 {
+			return rest.Result{Code: 400, Message: "invalid limit"}
+		}
+	}
+
+	// Get
+	dbResult := db.SelectMany(runs, "scheduled_runs", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	sort.SliceStable(*runs, func(i, j int) bool {
+		return (*runs)[i].StartTime.After(*(*runs)[j].StartTime)
+	})
+	if limit > 0 && len(*runs) > limit {
+		*runs = (*runs)[:limit]
+	}
+	return rest.Result{}
+}
+
+// Get gets a single run.
+func (run *Run) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Get
+	dbResult := db.Select(run, "scheduled_runs", "id", "=", request.PathArgs["id"])
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+	return rest.Result{}
+}
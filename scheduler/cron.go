@@ -0,0 +1,203 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSchedule is a parsed cron expression with the standard five fields (minute, hour, day of month, month and day of week).
+// Fields support "*", values, ranges ("1-5"), steps ("*/15", "0-30/10") and lists ("1,15"). Months and days of week may be names ("jan", "mon").
+// The macros "@yearly", "@annually", "@monthly", "@weekly", "@daily", "@midnight" and "@hourly" are supported too.
+type CronSchedule struct {
+	expression  string
+	minutes     uint64
+	hours       uint64
+	daysOfMonth uint64
+	months      uint64
+	daysOfWeek  uint64
+	anyDOM      bool // Day of month is "*"
+	anyDOW      bool // Day of week is "*"
+}
+
+type cronField struct {
+	min   int
+	max   int
+	names []string // Optional names, indexed from min
+}
+
+var cronFields = []cronField{
+	{min: 0, max: 59},
+	{min: 0, max: 23},
+	{min: 1, max: 31},
+	{min: 1, max: 12, names: []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	{min: 0, max: 7, names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}}, // 7 is Sunday too
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// How far ahead to look for the next time before giving up, e.g. for "0 0 30 2 *"
+const cronSearchLimit = 5 * 366 * 24 * time.Hour
+
+// ParseCron parses a cron expression.
+func ParseCron(expression string) (*CronSchedule, error) {
+	fieldsString := strings.TrimSpace(expression)
+	if macro, ok := cronMacros[strings.ToLower(fieldsString)]; ok {
+		fieldsString = macro
+	}
+	fields := strings.Fields(fieldsString)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("expected %v fields in cron expression, got %v", len(cronFields), len(fields))
+	}
+
+	var bits [5]uint64
+	for i, field := range fields {
+		var err error
+		bits[i], err = parseCronField(field, cronFields[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron field %q: %v", field, err)
+		}
+	}
+
+	// Sunday may be 0 or 7
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+	return &CronSchedule{
+		expression:  expression,
+		minutes:     bits[0],
+		hours:       bits[1],
+		daysOfMonth: bits[2],
+		months:      bits[3],
+		daysOfWeek:  bits[4],
+		anyDOM:      fields[2] == "*",
+		anyDOW:      fields[4] == "*",
+	}, nil
+}
+
+func parseCronField(field string, spec cronField) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(field, ",") {
+		rangeString, step := item, 1
+		if slash := strings.Index(item, "/"); slash >= 0 {
+			var err error
+			rangeString = item[:slash]
+			step, err = strconv.Atoi(item[slash+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step: %v", item[slash+1:])
+			}
+		}
+
+		var start, end int
+		if rangeString == "*" {
+			start, end = spec.min, spec.max
+		} else if dash := strings.Index(rangeString, "-"); dash >= 0 {
+			var err error
+			if start, err = parseCronValue(rangeString[:dash], spec); err != nil {
+				return 0, err
+			}
+			if end, err = parseCronValue(rangeString[dash+1:], spec); err != nil {
+				return 0, err
+			}
+			if end < start {
+				return 0, fmt.Errorf("invalid range: %v", rangeString)
+			}
+		} else {
+			var err error
+			if start, err = parseCronValue(rangeString, spec); err != nil {
+				return 0, err
+			}
+			end = start
+			// "5/10" means from 5 to the end
+			if step > 1 {
+				end = spec.max
+			}
+		}
+
+		for value := start; value <= end; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+	return bits, nil
+}
+
+func parseCronValue(value string, spec cronField) (int, error) {
+	for i, name := range spec.names {
+		if strings.EqualFold(value, name) {
+			return spec.min + i, nil
+		}
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value: %v", value)
+	}
+	if number < spec.min || number > spec.max {
+		return 0, fmt.Errorf("value out of range [%v-%v]: %v", spec.min, spec.max, number)
+	}
+	return number, nil
+}
+
+// Next returns the first matching time after the specified time, or the zero time if it never matches.
+func (schedule *CronSchedule) Next(after time.Time) time.Time {
+	location := after.Location()
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := after.Add(cronSearchLimit)
+	for t.Before(limit) {
+		switch {
+		case schedule.months&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, location)
+		case !schedule.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, location)
+		case schedule.hours&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, location)
+		case schedule.minutes&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// matchesDay checks the day of month and day of week like cron does, i.e. either must match if both are restricted.
+func (schedule *CronSchedule) matchesDay(t time.Time) bool {
+	domMatch := schedule.daysOfMonth&(1<<uint(t.Day())) != 0
+	dowMatch := schedule.daysOfWeek&(1<<uint(t.Weekday())) != 0
+	if schedule.anyDOM || schedule.anyDOW {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// String returns the original expression.
+func (schedule *CronSchedule) String() string {
+	return schedule.expression
+}
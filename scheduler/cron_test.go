@@ -0,0 +1,62 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package scheduler_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gathering/tech-online-backend/helper"
+	"github.com/gathering/tech-online-backend/scheduler"
+)
+
+func checkCronNext(t *testing.T, expression string, after string, expected string) {
+	t.Helper()
+	schedule, err := scheduler.ParseCron(expression)
+	if err != nil {
+		t.Fatalf("failed to parse %q: %v", expression, err)
+	}
+	afterTime, _ := time.Parse(time.RFC3339, after)
+	next := schedule.Next(afterTime)
+	if expected == "" {
+		helper.CheckEqual(t, next.IsZero(), true)
+		return
+	}
+	helper.CheckEqual(t, next.Format(time.RFC3339), expected)
+}
+
+func TestCronNext(t *testing.T) {
+	checkCronNext(t, "*/15 * * * *", "2022-04-14T10:07:30Z", "2022-04-14T10:15:00Z")
+	checkCronNext(t, "0 * * * *", "2022-04-14T10:00:00Z", "2022-04-14T11:00:00Z")
+	checkCronNext(t, "@daily", "2022-04-14T10:07:00Z", "2022-04-15T00:00:00Z")
+	checkCronNext(t, "30 4 1,15 * *", "2022-04-14T10:07:00Z", "2022-04-15T04:30:00Z")
+	checkCronNext(t, "0 9-17/4 * * mon-fri", "2022-04-15T18:00:00Z", "2022-04-18T09:00:00Z")
+	checkCronNext(t, "0 0 * * 7", "2022-04-14T10:07:00Z", "2022-04-17T00:00:00Z")
+	checkCronNext(t, "0 0 1 jan *", "2022-04-14T10:07:00Z", "2023-01-01T00:00:00Z")
+	checkCronNext(t, "0 0 13 * fri", "2022-04-14T10:07:00Z", "2022-04-15T00:00:00Z")
+	checkCronNext(t, "0 0 30 2 *", "2022-04-14T10:07:00Z", "")
+}
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, expression := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "* * * foo *"} {
+		_, err := scheduler.ParseCron(expression)
+		helper.CheckNotEqual(t, err, nil)
+	}
+}
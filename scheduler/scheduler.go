@@ -0,0 +1,115 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+// Package scheduler runs periodic background jobs, like publishing scheduled documents,
+// and actions triggered by cron entries or manually.
+package scheduler
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/errorreport"
+	log "github.com/sirupsen/logrus"
+)
+
+type job struct {
+	name     string
+	interval time.Duration
+	run      func() error
+}
+
+var jobs []job
+var jobsLock sync.Mutex
+var started bool
+
+// AddJob registers a job to be run every interval once the scheduler is started.
+// Jobs added after starting are started immediately.
+// Jobs should be registered from init functions, errors are only logged.
+func AddJob(name string, interval time.Duration, run func() error) {
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+
+	newJob := job{name: name, interval: interval, run: run}
+	jobs = append(jobs, newJob)
+	AddAction(name, run)
+	if started {
+		go newJob.loop()
+	}
+}
+
+// Start starts running all registered jobs in the background.
+// Should be called after the database connection is set up.
+func Start() {
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+
+	if started {
+		return
+	}
+	started = true
+	startCron()
+	for _, currentJob := range jobs {
+		log.WithFields(log.Fields{
+			"job":      currentJob.name,
+			"interval": currentJob.interval,
+		}).Info("Starting scheduled job")
+		go currentJob.loop()
+	}
+}
+
+func (job job) loop() {
+	ticker := time.NewTicker(job.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		job.runOnce()
+	}
+}
+
+func (job job) runOnce() {
+	// Skip if it's already running, e.g. if triggered manually
+	lock := getAction(job.name).lock
+	if !lock.TryLock() {
+		log.WithField("job", job.name).Debug("Scheduled job is already running, skipping")
+		return
+	}
+	defer lock.Unlock()
+
+	log.WithField("job", job.name).Trace("Running scheduled job")
+	if err := safeRun(job.name, job.run); err != nil {
+		log.WithError(err).WithField("job", job.name).Warn("Scheduled job failed")
+	}
+}
+
+// safeRun runs the function, turning panics into errors so they don't kill the program.
+func safeRun(name string, run func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.WithFields(log.Fields{
+				"job":   name,
+				"panic": r,
+			}).Error("Scheduled job panicked")
+			errorreport.CapturePanic(r, map[string]string{"job": name})
+			err = fmt.Errorf("panicked: %v", r)
+		}
+	}()
+	return run()
+}
@@ -17,7 +17,10 @@ CREATE TABLE public.users (
     "username" text NOT NULL UNIQUE,
     "display_name" text NOT NULL,
     "email_address" text NOT NULL,
-    "role" text NOT NULL
+    "role" text NOT NULL,
+    "seat_hall" text NOT NULL DEFAULT '',
+    "seat_row" text NOT NULL DEFAULT '',
+    "seat" text NOT NULL DEFAULT ''
 );
 CREATE UNIQUE INDEX public_users_id_index ON public.users (id);
 CREATE UNIQUE INDEX public_users_username_index ON public.users (username);
@@ -50,15 +53,50 @@ CREATE TABLE public.documents (
     "content" text NOT NULL,
     "content_format" text NOT NULL,
     "last_change" timestamp with time zone NOT NULL,
+    "status" text NOT NULL DEFAULT 'published',
+    "publish_at" timestamp with time zone,
     UNIQUE (family, shortname)
 );
 CREATE UNIQUE INDEX public_documents_family_shortname_index ON public.documents (family, shortname);
 
+-- Document revisions table
+CREATE TABLE public.document_revisions (
+    "id" text NOT NULL UNIQUE,
+    "family" text NOT NULL,
+    "shortname" text NOT NULL,
+    "revision" integer NOT NULL,
+    "author" text NOT NULL,
+    "timestamp" timestamp with time zone NOT NULL,
+    "comment" text NOT NULL,
+    "sequence" integer,
+    "name" text NOT NULL,
+    "content" text NOT NULL,
+    "content_format" text NOT NULL,
+    UNIQUE (family, shortname, revision)
+);
+CREATE UNIQUE INDEX public_document_revisions_id_index ON public.document_revisions (id);
+
+-- Attachments table
+CREATE TABLE public.attachments (
+    "id" text NOT NULL UNIQUE,
+    "owner_type" text NOT NULL,
+    "owner_id" text NOT NULL,
+    "filename" text NOT NULL,
+    "content_type" text NOT NULL,
+    "size" bigint NOT NULL,
+    "checksum" text NOT NULL,
+    "uploader" text NOT NULL,
+    "timestamp" timestamp with time zone NOT NULL
+);
+CREATE UNIQUE INDEX public_attachments_id_index ON public.attachments (id);
+CREATE INDEX public_attachments_owner_index ON public.attachments (owner_type, owner_id);
+
 -- Tracks table
 CREATE TABLE public.tracks (
     "id" text NOT NULL UNIQUE,
     "type" text NOT NULL,
-    "name" text
+    "name" text,
+    "archived" boolean NOT NULL DEFAULT false
 );
 CREATE UNIQUE INDEX public_tracks_id_index ON public.tracks (id);
 
@@ -70,6 +108,7 @@ CREATE TABLE public.tasks (
     "name" text NOT NULL,
     "description" text NOT NULL,
     "sequence" int,
+    "points" int NOT NULL DEFAULT 0,
     UNIQUE (track, shortname)
 );
 CREATE UNIQUE INDEX public_tasks_id_index ON public.tasks (id);
@@ -85,10 +124,70 @@ CREATE TABLE public.stations (
     "credentials" text NOT NULL,
     "notes" text NOT NULL,
     "timeslot" text NOT NULL,
+    "address" text NOT NULL DEFAULT '',
+    "health" text NOT NULL DEFAULT 'unknown',
+    "last_health_check" timestamp with time zone,
+    "instance_id" text NOT NULL DEFAULT '',
+    "instance_state" text NOT NULL DEFAULT '',
+    "instance_message" text NOT NULL DEFAULT '',
+    "console_address" text NOT NULL DEFAULT '',
+    "maintenance" boolean NOT NULL DEFAULT false,
+    "maintenance_begin" timestamp with time zone,
+    "maintenance_end" timestamp with time zone,
+    "maintenance_notice" text NOT NULL DEFAULT '',
+    "gondul_switch" text NOT NULL DEFAULT '',
+    "switch_distro" text NOT NULL DEFAULT '',
+    "switch_port" text NOT NULL DEFAULT '',
+    "management_ipv4" text NOT NULL DEFAULT '',
+    "management_ipv6" text NOT NULL DEFAULT '',
+    "network_sync_time" timestamp with time zone,
+    "teardown_hold" timestamp with time zone,
+    "bmc_driver" text NOT NULL DEFAULT '',
+    "bmc_address" text NOT NULL DEFAULT '',
+    "bmc_credentials" text NOT NULL DEFAULT '',
+    "vlan_id" integer,
+    "ipv4_prefix" text NOT NULL DEFAULT '',
+    "ipv6_prefix" text NOT NULL DEFAULT '',
+    "dns_name" text NOT NULL DEFAULT '',
+    "dns_target" text NOT NULL DEFAULT '',
+    "seat_hall" text NOT NULL DEFAULT '',
+    "seat_row" text NOT NULL DEFAULT '',
+    "seat" text NOT NULL DEFAULT '',
+    "terminated_time" timestamp with time zone,
     UNIQUE (track, shortname)
 );
 CREATE UNIQUE INDEX public_stations_id_index ON public.stations (id);
 
+-- Registrations table
+CREATE TABLE public.registrations (
+    "id" text NOT NULL UNIQUE,
+    "user" text NOT NULL,
+    "track" text NOT NULL,
+    "status" text NOT NULL,
+    "queue_time" timestamp with time zone NOT NULL,
+    "timeslot" text,
+    "notes" text NOT NULL
+);
+CREATE UNIQUE INDEX public_registrations_id_index ON public.registrations (id);
+
+-- Teams table
+CREATE TABLE public.teams (
+    "id" text NOT NULL UNIQUE,
+    "track" text NOT NULL,
+    "name" text NOT NULL,
+    "invite_code" text NOT NULL UNIQUE,
+    UNIQUE (track, name)
+);
+CREATE UNIQUE INDEX public_teams_id_index ON public.teams (id);
+
+-- Team members table
+CREATE TABLE public.team_members (
+    "team" text NOT NULL,
+    "user" text NOT NULL,
+    "join_time" timestamp with time zone NOT NULL,
+    UNIQUE (team, "user")
+);
+
 -- Timeslots table
 CREATE TABLE public.timeslots (
     "id" text NOT NULL UNIQUE,
@@ -96,10 +195,52 @@ CREATE TABLE public.timeslots (
     "track" text NOT NULL,
     "begin_time" timestamp with time zone,
     "end_time" timestamp with time zone,
-    "notes" text NOT NULL
+    "notes" text NOT NULL,
+    "team" text,
+    "no_auto_assign" boolean NOT NULL DEFAULT false,
+    "category" text NOT NULL DEFAULT 'participant',
+    "state" text NOT NULL DEFAULT 'approved'
 );
 CREATE UNIQUE INDEX public_timeslots_id_index ON public.timeslots (id);
 
+-- Station assignments table
+CREATE TABLE public.station_assignments (
+    "id" text NOT NULL UNIQUE,
+    "timeslot" text NOT NULL,
+    "station" text NOT NULL,
+    "timestamp" timestamp with time zone NOT NULL,
+    "action" text NOT NULL,
+    "source" text NOT NULL,
+    "actor" text NOT NULL
+);
+CREATE UNIQUE INDEX public_station_assignments_id_index ON public.station_assignments (id);
+
+-- Queue entries table
+CREATE TABLE public.queue_entries (
+    "id" text NOT NULL UNIQUE,
+    "track" text NOT NULL,
+    "timeslot" text NOT NULL,
+    "status" text NOT NULL,
+    "queue_time" timestamp with time zone NOT NULL,
+    "assign_time" timestamp with time zone,
+    "station" text,
+    "priority" integer NOT NULL DEFAULT 0
+);
+CREATE UNIQUE INDEX public_queue_entries_id_index ON public.queue_entries (id);
+
+-- Notifications table
+CREATE TABLE public.notifications (
+    "id" text NOT NULL UNIQUE,
+    "user" text NOT NULL,
+    "timestamp" timestamp with time zone NOT NULL,
+    "type" text NOT NULL,
+    "title" text NOT NULL,
+    "message" text NOT NULL,
+    "read" boolean NOT NULL
+);
+CREATE UNIQUE INDEX public_notifications_id_index ON public.notifications (id);
+CREATE INDEX public_notifications_user_index ON public.notifications ("user");
+
 -- Tests table
 CREATE TABLE public.tests (
     "id" text NOT NULL UNIQUE,
@@ -117,3 +258,396 @@ CREATE TABLE public.tests (
     UNIQUE (track, task_shortname, shortname, station_shortname, timeslot)
 );
 CREATE UNIQUE INDEX public_tests_id_index ON public.tests (id);
+
+-- Station health checks table
+CREATE TABLE public.station_health_checks (
+    "id" text NOT NULL UNIQUE,
+    "station" text NOT NULL,
+    "timestamp" timestamp with time zone NOT NULL,
+    "healthy" boolean NOT NULL,
+    "latency_ms" integer NOT NULL,
+    "error" text NOT NULL
+);
+CREATE UNIQUE INDEX public_station_health_checks_id_index ON public.station_health_checks (id);
+CREATE INDEX public_station_health_checks_station_index ON public.station_health_checks (station, timestamp);
+
+-- Console sessions table
+CREATE TABLE public.console_sessions (
+    "id" text NOT NULL UNIQUE,
+    "station" text NOT NULL,
+    "timeslot" text NOT NULL,
+    "user" text,
+    "actor" text NOT NULL,
+    "address" text NOT NULL,
+    "start_time" timestamp with time zone NOT NULL,
+    "end_time" timestamp with time zone,
+    "bytes_in" bigint NOT NULL,
+    "bytes_out" bigint NOT NULL
+);
+CREATE UNIQUE INDEX public_console_sessions_id_index ON public.console_sessions (id);
+
+-- SSH keys table
+CREATE TABLE public.ssh_keys (
+    "id" text NOT NULL UNIQUE,
+    "user" text NOT NULL,
+    "name" text NOT NULL,
+    "key" text NOT NULL,
+    "fingerprint" text NOT NULL,
+    "timestamp" timestamp with time zone NOT NULL,
+    UNIQUE ("user", fingerprint)
+);
+CREATE UNIQUE INDEX public_ssh_keys_id_index ON public.ssh_keys (id);
+
+-- Task checks table
+CREATE TABLE public.task_checks (
+    "id" text NOT NULL UNIQUE,
+    "track" text NOT NULL,
+    "task_shortname" text NOT NULL,
+    "shortname" text NOT NULL,
+    "name" text NOT NULL,
+    "description" text NOT NULL,
+    "sequence" int,
+    "enabled" boolean NOT NULL,
+    "kind" text NOT NULL,
+    "port" int NOT NULL,
+    "path" text NOT NULL,
+    "command" text NOT NULL,
+    "username" text NOT NULL,
+    "expect" text NOT NULL,
+    "timeout_seconds" int NOT NULL,
+    "interval_seconds" int NOT NULL,
+    UNIQUE (track, task_shortname, shortname)
+);
+CREATE UNIQUE INDEX public_task_checks_id_index ON public.task_checks (id);
+
+-- Test history table, with status changes
+CREATE TABLE public.test_history (
+    "id" text NOT NULL UNIQUE,
+    "track" text NOT NULL,
+    "task_shortname" text NOT NULL,
+    "shortname" text NOT NULL,
+    "station_shortname" text NOT NULL,
+    "timeslot" text,
+    "name" text NOT NULL,
+    "timestamp" timestamp with time zone NOT NULL,
+    "status_success" boolean NOT NULL,
+    "status_description" text NOT NULL
+);
+CREATE UNIQUE INDEX public_test_history_id_index ON public.test_history (id);
+CREATE INDEX public_test_history_test_index ON public.test_history (track, station_shortname, task_shortname, shortname, timestamp);
+
+-- Scheduled action runs table
+CREATE TABLE public.scheduled_runs (
+    "id" text NOT NULL UNIQUE,
+    "action" text NOT NULL,
+    "trigger" text NOT NULL,
+    "start_time" timestamp with time zone NOT NULL,
+    "end_time" timestamp with time zone,
+    "success" boolean,
+    "error" text NOT NULL
+);
+CREATE UNIQUE INDEX public_scheduled_runs_id_index ON public.scheduled_runs (id);
+
+-- Hints table
+CREATE TABLE public.hints (
+    "id" text NOT NULL UNIQUE,
+    "track" text NOT NULL,
+    "task_shortname" text NOT NULL,
+    "sequence" int NOT NULL,
+    "content" text NOT NULL,
+    "penalty" int NOT NULL
+);
+CREATE UNIQUE INDEX public_hints_id_index ON public.hints (id);
+
+-- Hint unlocks table
+CREATE TABLE public.hint_unlocks (
+    "id" text NOT NULL UNIQUE,
+    "hint" text NOT NULL,
+    "timeslot" text NOT NULL,
+    "station" text NOT NULL,
+    "actor" text NOT NULL,
+    "timestamp" timestamp with time zone NOT NULL,
+    UNIQUE (hint, timeslot)
+);
+CREATE UNIQUE INDEX public_hint_unlocks_id_index ON public.hint_unlocks (id);
+
+-- Timeslot scores table
+CREATE TABLE public.timeslot_scores (
+    "timeslot" text NOT NULL UNIQUE,
+    "track" text NOT NULL,
+    "points" int NOT NULL,
+    "penalty" int NOT NULL,
+    "score" int NOT NULL,
+    "completed_tasks" int NOT NULL,
+    "hints_unlocked" int NOT NULL,
+    "timestamp" timestamp with time zone NOT NULL
+);
+CREATE UNIQUE INDEX public_timeslot_scores_timeslot_index ON public.timeslot_scores (timeslot);
+
+-- Task flags table
+CREATE TABLE public.task_flags (
+    "id" text NOT NULL UNIQUE,
+    "track" text NOT NULL,
+    "task_shortname" text NOT NULL,
+    "shortname" text NOT NULL,
+    "name" text NOT NULL,
+    "kind" text NOT NULL,
+    "case_sensitive" boolean NOT NULL,
+    "regex" text NOT NULL,
+    "salt" text NOT NULL,
+    "hash" text NOT NULL,
+    UNIQUE (track, task_shortname, shortname)
+);
+CREATE UNIQUE INDEX public_task_flags_id_index ON public.task_flags (id);
+
+-- Flag submissions table
+CREATE TABLE public.flag_submissions (
+    "id" text NOT NULL UNIQUE,
+    "track" text NOT NULL,
+    "task_shortname" text NOT NULL,
+    "station" text NOT NULL,
+    "timeslot" text NOT NULL,
+    "user" text,
+    "actor" text NOT NULL,
+    "timestamp" timestamp with time zone NOT NULL,
+    "correct" boolean NOT NULL,
+    "flag" text,
+    "answer_hash" text NOT NULL DEFAULT ''
+);
+CREATE UNIQUE INDEX public_flag_submissions_id_index ON public.flag_submissions (id);
+
+-- Task dependencies table
+CREATE TABLE public.task_dependencies (
+    "track" text NOT NULL,
+    "task_shortname" text NOT NULL,
+    "depends_on" text NOT NULL,
+    UNIQUE (track, task_shortname, depends_on)
+);
+
+-- Scoreboards table (freeze state per track)
+CREATE TABLE public.scoreboards (
+    "track" text NOT NULL UNIQUE,
+    "frozen" boolean NOT NULL,
+    "frozen_at" timestamp with time zone
+);
+
+-- Frozen scores table (snapshot of timeslot_scores when the scoreboard was frozen)
+CREATE TABLE public.frozen_scores (
+    "timeslot" text NOT NULL UNIQUE,
+    "track" text NOT NULL,
+    "points" int NOT NULL,
+    "penalty" int NOT NULL,
+    "score" int NOT NULL,
+    "completed_tasks" int NOT NULL,
+    "hints_unlocked" int NOT NULL,
+    "timestamp" timestamp with time zone NOT NULL
+);
+
+-- Notification settings table (per-user preferences)
+CREATE TABLE public.notification_settings (
+    "user" text NOT NULL UNIQUE,
+    "email_opt_out" boolean NOT NULL DEFAULT false,
+    "discord_id" text NOT NULL DEFAULT '',
+    "discord_opt_out" boolean NOT NULL DEFAULT false
+);
+
+-- Email log table
+CREATE TABLE public.email_log (
+    "id" text NOT NULL UNIQUE,
+    "user" text NOT NULL,
+    "address" text NOT NULL,
+    "event" text,
+    "event_type" text NOT NULL,
+    "subject" text NOT NULL,
+    "timestamp" timestamp with time zone NOT NULL,
+    "success" boolean NOT NULL,
+    "error" text NOT NULL
+);
+CREATE UNIQUE INDEX public_email_log_id_index ON public.email_log (id);
+
+-- Timeslot reminders table (sent reminders)
+CREATE TABLE public.timeslot_reminders (
+    "timeslot" text NOT NULL,
+    "kind" text NOT NULL,
+    "timestamp" timestamp with time zone NOT NULL,
+    UNIQUE (timeslot, kind)
+);
+
+-- Timeslot extensions table
+CREATE TABLE public.timeslot_extensions (
+    "id" text NOT NULL UNIQUE,
+    "timeslot" text NOT NULL,
+    "minutes" integer NOT NULL,
+    "reason" text NOT NULL,
+    "status" text NOT NULL,
+    "requested_by" text NOT NULL,
+    "request_time" timestamp with time zone NOT NULL,
+    "decided_by" text NOT NULL,
+    "decide_time" timestamp with time zone,
+    "comment" text NOT NULL
+);
+CREATE UNIQUE INDEX public_timeslot_extensions_id_index ON public.timeslot_extensions (id);
+
+-- Station notes table
+CREATE TABLE public.station_notes (
+    "id" text NOT NULL UNIQUE,
+    "station" text NOT NULL,
+    "timeslot" text NOT NULL,
+    "author" text NOT NULL,
+    "timestamp" timestamp with time zone NOT NULL,
+    "message" text NOT NULL
+);
+CREATE UNIQUE INDEX public_station_notes_id_index ON public.station_notes (id);
+
+-- Messages table
+CREATE TABLE public.messages (
+    "id" text NOT NULL UNIQUE,
+    "timeslot" text NOT NULL,
+    "station" text NOT NULL,
+    "author_user" text,
+    "author" text NOT NULL,
+    "from_staff" boolean NOT NULL,
+    "timestamp" timestamp with time zone NOT NULL,
+    "body" text NOT NULL,
+    "read_by_participants" boolean NOT NULL,
+    "read_by_staff" boolean NOT NULL
+);
+CREATE UNIQUE INDEX public_messages_id_index ON public.messages (id);
+
+-- Announcements table
+CREATE TABLE public.announcements (
+    "id" text NOT NULL UNIQUE,
+    "message" text NOT NULL,
+    "severity" text NOT NULL,
+    "audience" text NOT NULL,
+    "track" text NOT NULL,
+    "begin_time" timestamp with time zone,
+    "end_time" timestamp with time zone,
+    "author" text NOT NULL,
+    "created_time" timestamp with time zone NOT NULL,
+    "published" boolean NOT NULL
+);
+CREATE UNIQUE INDEX public_announcements_id_index ON public.announcements (id);
+
+-- Feedback table
+CREATE TABLE public.feedback (
+    "id" text NOT NULL UNIQUE,
+    "timeslot" text NOT NULL,
+    "track" text NOT NULL,
+    "task" text,
+    "user" text NOT NULL,
+    "rating" integer NOT NULL,
+    "comment" text NOT NULL,
+    "timestamp" timestamp with time zone NOT NULL
+);
+CREATE UNIQUE INDEX public_feedback_id_index ON public.feedback (id);
+
+-- Station snapshots table
+CREATE TABLE public.station_snapshots (
+    "id" text NOT NULL UNIQUE,
+    "station" text NOT NULL,
+    "timeslot" text NOT NULL,
+    "name" text NOT NULL,
+    "description" text NOT NULL,
+    "created_by" text NOT NULL,
+    "timestamp" timestamp with time zone NOT NULL
+);
+CREATE UNIQUE INDEX public_station_snapshots_id_index ON public.station_snapshots (id);
+
+-- Crew shifts table
+CREATE TABLE public.crew_shifts (
+    "id" text NOT NULL UNIQUE,
+    "track" text NOT NULL,
+    "begin_time" timestamp with time zone NOT NULL,
+    "end_time" timestamp with time zone NOT NULL,
+    "user" text,
+    "notes" text NOT NULL
+);
+CREATE UNIQUE INDEX public_crew_shifts_id_index ON public.crew_shifts (id);
+
+-- Shift swaps table
+CREATE TABLE public.shift_swaps (
+    "id" text NOT NULL UNIQUE,
+    "shift" text NOT NULL,
+    "wanted_shift" text NOT NULL,
+    "requested_by" text NOT NULL,
+    "target_user" text NOT NULL,
+    "status" text NOT NULL,
+    "request_time" timestamp with time zone NOT NULL,
+    "decide_time" timestamp with time zone
+);
+CREATE UNIQUE INDEX public_shift_swaps_id_index ON public.shift_swaps (id);
+
+-- BMC power actions table (audit log)
+CREATE TABLE public.bmc_power_actions (
+    "id" text NOT NULL UNIQUE,
+    "station" text NOT NULL,
+    "timeslot" text NOT NULL,
+    "action" text NOT NULL,
+    "actor" text NOT NULL,
+    "timestamp" timestamp with time zone NOT NULL,
+    "success" boolean NOT NULL,
+    "error" text NOT NULL
+);
+CREATE UNIQUE INDEX public_bmc_power_actions_id_index ON public.bmc_power_actions (id);
+
+-- Anomalies table (anti-cheat review queue)
+CREATE TABLE public.anomalies (
+    "id" text NOT NULL UNIQUE,
+    "track" text NOT NULL,
+    "kind" text NOT NULL,
+    "fingerprint" text NOT NULL,
+    "timeslot" text NOT NULL,
+    "task_shortname" text NOT NULL,
+    "details" text NOT NULL,
+    "detected_time" timestamp with time zone NOT NULL,
+    "status" text NOT NULL,
+    "review_note" text NOT NULL,
+    "reviewer" text NOT NULL,
+    "review_time" timestamp with time zone
+);
+CREATE UNIQUE INDEX public_anomalies_id_index ON public.anomalies (id);
+CREATE UNIQUE INDEX public_anomalies_finding_index ON public.anomalies (kind, fingerprint, timeslot);
+
+-- Schedule entries table (opening hours, briefings etc.)
+CREATE TABLE public.schedule_entries (
+    "id" text NOT NULL UNIQUE,
+    "track" text NOT NULL,
+    "kind" text NOT NULL,
+    "title" text NOT NULL,
+    "begin_time" timestamp with time zone NOT NULL,
+    "end_time" timestamp with time zone NOT NULL
+);
+CREATE UNIQUE INDEX public_schedule_entries_id_index ON public.schedule_entries (id);
+
+-- Station templates table
+CREATE TABLE public.station_templates (
+    "id" text NOT NULL UNIQUE,
+    "track" text NOT NULL,
+    "name" text NOT NULL,
+    "shortname_pattern" text NOT NULL,
+    "name_pattern" text NOT NULL,
+    "default_status" text NOT NULL,
+    "credentials_pattern" text NOT NULL,
+    "address_pattern" text NOT NULL,
+    "gondul_switch_pattern" text NOT NULL,
+    "allocate_network" boolean NOT NULL,
+    "bmc_driver" text NOT NULL,
+    "bmc_address_pattern" text NOT NULL,
+    "bmc_credentials" text NOT NULL,
+    "notes" text NOT NULL
+);
+CREATE UNIQUE INDEX public_station_templates_id_index ON public.station_templates (id);
+
+-- Retention reports table
+CREATE TABLE public.retention_reports (
+    "id" text NOT NULL UNIQUE,
+    "timestamp" timestamp with time zone NOT NULL,
+    "expired_tokens" integer NOT NULL,
+    "terminated_stations" integer NOT NULL,
+    "station_action" text NOT NULL,
+    "captured_requests" integer NOT NULL,
+    "orphaned_attachments" integer NOT NULL,
+    "errors" text NOT NULL
+);
+CREATE UNIQUE INDEX public_retention_reports_id_index ON public.retention_reports (id);
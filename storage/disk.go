@@ -0,0 +1,63 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// diskStorage stores files in a local directory.
+type diskStorage struct {
+	directory string
+}
+
+func (storage diskStorage) Save(key string, data []byte, contentType string) error {
+	if err := os.MkdirAll(storage.directory, 0750); err != nil {
+		return err
+	}
+	// Write to temp file first to avoid partial files
+	tempPath := storage.path(key) + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, storage.path(key))
+}
+
+func (storage diskStorage) Load(key string) ([]byte, error) {
+	data, err := os.ReadFile(storage.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (storage diskStorage) Remove(key string) error {
+	if err := os.Remove(storage.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (storage diskStorage) path(key string) string {
+	return filepath.Join(storage.directory, key)
+}
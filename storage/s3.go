@@ -0,0 +1,256 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+)
+
+const (
+	s3DefaultRegion   = "us-east-1"
+	s3Algorithm       = "AWS4-HMAC-SHA256"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3TimeFormat      = "20060102T150405Z"
+	s3MaxErrorBytes   = 4096
+)
+
+// s3Storage stores files as objects in an S3-compatible bucket, signing requests with AWS Signature Version 4.
+type s3Storage struct {
+	config     config.S3StorageConfig
+	httpClient *http.Client
+	now        func() time.Time // For tests
+}
+
+func newS3Storage(s3Config config.S3StorageConfig) *s3Storage {
+	if s3Config.Region == "" {
+		s3Config.Region = s3DefaultRegion
+	}
+	return &s3Storage{
+		config:     s3Config,
+		httpClient: &http.Client{Timeout: 60 * time.Second},
+		now:        time.Now,
+	}
+}
+
+func (storage *s3Storage) Save(key string, data []byte, contentType string) error {
+	header := http.Header{}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	_, err := storage.do("PUT", key, header, data)
+	return err
+}
+
+func (storage *s3Storage) Load(key string) ([]byte, error) {
+	return storage.do("GET", key, nil, nil)
+}
+
+func (storage *s3Storage) Remove(key string) error {
+	// Deleting missing objects succeeds in S3
+	_, err := storage.do("DELETE", key, nil, nil)
+	return err
+}
+
+// SignedURL returns a presigned GET URL, with the filename and content type as response overrides.
+func (storage *s3Storage) SignedURL(key string, filename string, contentType string, expiry time.Duration) (string, error) {
+	objectURL := storage.objectURL(key)
+	now := storage.now().UTC()
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", s3Algorithm)
+	query.Set("X-Amz-Credential", storage.config.AccessKeyID+"/"+storage.scope(now))
+	query.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	query.Set("X-Amz-Expires", fmt.Sprint(int(expiry.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+	if filename != "" {
+		query.Set("response-content-disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	}
+	if contentType != "" {
+		query.Set("response-content-type", contentType)
+	}
+	headers := map[string]string{"host": objectURL.Host}
+	signature := storage.signature(now, "GET", objectURL.EscapedPath(), query, headers, s3UnsignedPayload)
+	objectURL.RawQuery = s3CanonicalQuery(query) + "&X-Amz-Signature=" + signature
+	return objectURL.String(), nil
+}
+
+// do sends a signed request for the object, returning the body of successful responses.
+func (storage *s3Storage) do(method string, key string, header http.Header, body []byte) ([]byte, error) {
+	objectURL := storage.objectURL(key)
+	now := storage.now().UTC()
+	payloadHash := sha256.Sum256(body)
+	payloadHashHex := hex.EncodeToString(payloadHash[:])
+
+	request, err := http.NewRequest(method, objectURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	request.Header.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	request.Header.Set("X-Amz-Content-Sha256", payloadHashHex)
+	headers := map[string]string{
+		"host":                 objectURL.Host,
+		"x-amz-date":           now.Format(s3TimeFormat),
+		"x-amz-content-sha256": payloadHashHex,
+	}
+	if contentType := request.Header.Get("Content-Type"); contentType != "" {
+		headers["content-type"] = contentType
+	}
+	signature := storage.signature(now, method, objectURL.EscapedPath(), nil, headers, payloadHashHex)
+	request.Header.Set("Authorization", fmt.Sprintf("%v Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		s3Algorithm, storage.config.AccessKeyID, storage.scope(now), s3SignedHeaders(headers), signature))
+
+	response, err := storage.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound && method == "GET" {
+		return nil, ErrNotFound
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, s3MaxErrorBytes))
+		return nil, fmt.Errorf("s3 %v %v failed with status %v: %s", method, key, response.StatusCode, bytes.TrimSpace(message))
+	}
+	return io.ReadAll(response.Body)
+}
+
+// objectURL returns the URL of the object, with the bucket in the hostname or the path (path style).
+func (storage *s3Storage) objectURL(key string) *url.URL {
+	endpoint, err := url.Parse(strings.TrimSuffix(storage.config.Endpoint, "/"))
+	if err != nil {
+		endpoint = &url.URL{Scheme: "https", Host: storage.config.Endpoint}
+	}
+	objectKey := storage.config.Prefix + key
+	objectURL := *endpoint
+	if storage.config.PathStyle {
+		objectURL.Path = endpoint.Path + "/" + storage.config.Bucket + "/" + objectKey
+	} else {
+		objectURL.Host = storage.config.Bucket + "." + endpoint.Host
+		objectURL.Path = endpoint.Path + "/" + objectKey
+	}
+	objectURL.RawPath = s3EscapePath(objectURL.Path)
+	return &objectURL
+}
+
+func (storage *s3Storage) scope(now time.Time) string {
+	return fmt.Sprintf("%v/%v/s3/aws4_request", now.Format("20060102"), storage.config.Region)
+}
+
+// signature signs the canonical request (see the AWS Signature Version 4 docs).
+func (storage *s3Storage) signature(now time.Time, method string, escapedPath string, query url.Values, headers map[string]string, payloadHash string) string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	canonicalRequest := strings.Join([]string{
+		method,
+		escapedPath,
+		s3CanonicalQuery(query),
+		canonicalHeaders.String(),
+		s3SignedHeaders(headers),
+		payloadHash,
+	}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		now.Format(s3TimeFormat),
+		storage.scope(now),
+		hex.EncodeToString(canonicalRequestHash[:]),
+	}, "\n")
+
+	key := s3HMAC([]byte("AWS4"+storage.config.SecretAccessKey), now.Format("20060102"))
+	key = s3HMAC(key, storage.config.Region)
+	key = s3HMAC(key, "s3")
+	key = s3HMAC(key, "aws4_request")
+	return hex.EncodeToString(s3HMAC(key, stringToSign))
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func s3SignedHeaders(headers map[string]string) string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ";")
+}
+
+// s3CanonicalQuery encodes the query sorted by key, with AWS escaping (spaces as "%20").
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, s3Escape(key, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3EscapePath escapes each segment of the path, keeping the slashes.
+func s3EscapePath(path string) string {
+	return s3Escape(path, false)
+}
+
+// s3Escape percent-encodes everything except the unreserved characters (and slashes unless escapeSlash).
+func s3Escape(value string, escapeSlash bool) string {
+	var builder strings.Builder
+	for _, b := range []byte(value) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', b == '-', b == '_', b == '.', b == '~':
+			builder.WriteByte(b)
+		case b == '/' && !escapeSlash:
+			builder.WriteByte(b)
+		default:
+			fmt.Fprintf(&builder, "%%%02X", b)
+		}
+	}
+	return builder.String()
+}
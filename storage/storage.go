@@ -0,0 +1,89 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+// Package storage stores files (e.g. attachments) on local disk or in S3-compatible object storage.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+)
+
+// Drivers
+const (
+	DriverDisk = "disk"
+	DriverS3   = "s3"
+)
+
+// ErrNotFound is returned when loading a missing file.
+var ErrNotFound = errors.New("file not found")
+
+// Storage keeps files by key. Keys are generated (e.g. UUIDs), so they're safe as filenames and object keys.
+type Storage interface {
+	Save(key string, data []byte, contentType string) error
+	Load(key string) ([]byte, error)
+	Remove(key string) error // Removing missing files is not an error
+}
+
+// URLSigner may be implemented by storages which clients can download from directly.
+type URLSigner interface {
+	// SignedURL returns a URL for downloading the file until it expires, as the filename and content type.
+	SignedURL(key string, filename string, contentType string, expiry time.Duration) (string, error)
+}
+
+func init() {
+	config.AddValidator(validateConfig)
+}
+
+// Get returns the configured storage, using the directory with the disk driver.
+func Get(directory string) (Storage, error) {
+	switch config.Config.Storage.Driver {
+	case "", DriverDisk:
+		return diskStorage{directory: directory}, nil
+	case DriverS3:
+		return newS3Storage(config.Config.Storage.S3), nil
+	}
+	return nil, fmt.Errorf("unknown storage driver: %v", config.Config.Storage.Driver)
+}
+
+// SignedURLExpiry returns how long signed download URLs are valid, or 0 if they're disabled.
+func SignedURLExpiry() time.Duration {
+	if config.Config.Storage.SignedURLSeconds <= 0 {
+		return 0
+	}
+	return time.Duration(config.Config.Storage.SignedURLSeconds) * time.Second
+}
+
+func validateConfig(candidate *config.MainConfig) error {
+	switch candidate.Storage.Driver {
+	case "", DriverDisk:
+	case DriverS3:
+		s3Config := candidate.Storage.S3
+		if s3Config.Endpoint == "" || s3Config.Bucket == "" || s3Config.AccessKeyID == "" || s3Config.SecretAccessKey == "" {
+			return fmt.Errorf("storage: s3 requires endpoint, bucket, access_key_id and secret_access_key")
+		}
+	default:
+		return fmt.Errorf("storage: unknown driver: %v", candidate.Storage.Driver)
+	}
+	return nil
+}
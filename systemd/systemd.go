@@ -0,0 +1,97 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+// Package systemd implements the sd_notify protocol for readiness notification and the watchdog, for running as a
+// systemd service with "Type=notify" and "WatchdogSec=". Everything is a no-op when not started by systemd.
+package systemd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Notify sends a state like "READY=1" to systemd. Returns false if not running under systemd (no NOTIFY_SOCKET).
+func Notify(state string) (bool, error) {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return false, nil
+	}
+	// Abstract socket
+	if socketPath[0] == '@' {
+		socketPath = "\x00" + socketPath[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Ready tells systemd that the service has started, logging failures.
+func Ready() {
+	if sent, err := Notify("READY=1"); err != nil {
+		log.WithError(err).Warn("Failed to notify systemd about readiness")
+	} else if sent {
+		log.Info("Notified systemd about readiness")
+	}
+}
+
+// WatchdogInterval returns the watchdog timeout set by systemd for this process, or 0 if disabled.
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if rawPID := os.Getenv("WATCHDOG_PID"); rawPID != "" {
+		if pid, err := strconv.Atoi(rawPID); err != nil || pid != os.Getpid() {
+			return 0
+		}
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// RunWatchdog pings the systemd watchdog at half the timeout as long as the health check passes, so systemd restarts
+// the service if it gets stuck. The check gets the time it has to finish. Returns immediately if the watchdog is disabled.
+func RunWatchdog(check func(timeout time.Duration) error) {
+	interval := WatchdogInterval() / 2
+	if interval <= 0 {
+		return
+	}
+	log.WithField("interval", interval).Info("Starting systemd watchdog")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := check(interval); err != nil {
+			log.WithError(err).Error("Health check failed, not pinging the systemd watchdog")
+			continue
+		}
+		if _, err := Notify("WATCHDOG=1"); err != nil {
+			log.WithError(err).Warn("Failed to ping the systemd watchdog")
+		}
+	}
+}
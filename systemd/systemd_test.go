@@ -0,0 +1,63 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package systemd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gathering/tech-online-backend/helper"
+)
+
+func TestNotify(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	sent, err := Notify("READY=1")
+	helper.CheckEqual(t, sent, false)
+	helper.CheckEqual(t, err, nil)
+
+	socketPath := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", socketPath)
+	sent, err = Notify("READY=1")
+	helper.CheckEqual(t, sent, true)
+	helper.CheckEqual(t, err, nil)
+	buffer := make([]byte, 64)
+	n, _, err := conn.ReadFromUnix(buffer)
+	helper.CheckEqual(t, err, nil)
+	helper.CheckEqual(t, string(buffer[:n]), "READY=1")
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	helper.CheckEqual(t, WatchdogInterval(), 30*time.Second)
+	t.Setenv("WATCHDOG_PID", "1")
+	helper.CheckEqual(t, WatchdogInterval(), time.Duration(0))
+	t.Setenv("WATCHDOG_USEC", "")
+	helper.CheckEqual(t, WatchdogInterval(), time.Duration(0))
+}
@@ -0,0 +1,124 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+// Package tenant serves other events (tenants) from the same deployment. The main process proxies requests to the
+// worker process of the tenant they belong to, by hostname or path prefix, and keeps the workers running. Each worker is
+// this binary running with the tenant config (see config.SelectTenant), so the handlers and the DB layer don't need to
+// know about tenants, only which DB schema to use.
+package tenant
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/gathering/tech-online-backend/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// Resolve finds the tenant of the request by hostname or path prefix, returning the path for the tenant (without the prefix).
+// Returns nil (and the path unchanged) for requests to the main event.
+func Resolve(tenants []config.TenantConfig, host string, path string) (*config.TenantConfig, string) {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	for i, tenant := range tenants {
+		for _, hostname := range tenant.Hostnames {
+			if strings.EqualFold(hostname, host) {
+				return &tenants[i], path
+			}
+		}
+	}
+	for i, tenant := range tenants {
+		if tenant.PathPrefix == "" {
+			continue
+		}
+		if path == tenant.PathPrefix || strings.HasPrefix(path, tenant.PathPrefix+"/") {
+			tenantPath := strings.TrimPrefix(path, tenant.PathPrefix)
+			if tenantPath == "" {
+				tenantPath = "/"
+			}
+			return &tenants[i], tenantPath
+		}
+	}
+	return nil, path
+}
+
+// Handler wraps the handler of the main event, proxying requests for tenants to their workers.
+// Returns the handler unchanged if there are no tenants (e.g. in the workers).
+func Handler(main http.Handler) http.Handler {
+	tenants := config.Config.Tenants
+	if len(tenants) == 0 {
+		return main
+	}
+	proxies := make(map[string]*httputil.ReverseProxy, len(tenants))
+	for _, tenant := range tenants {
+		proxies[tenant.ID] = newProxy(tenant)
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		tenant, path := Resolve(tenants, request.Host, request.URL.Path)
+		if tenant == nil {
+			main.ServeHTTP(writer, request)
+			return
+		}
+		if path != request.URL.Path {
+			request.Header.Set("X-Forwarded-Prefix", tenant.PathPrefix)
+			request.URL.Path = path
+			request.URL.RawPath = ""
+		}
+		proxies[tenant.ID].ServeHTTP(writer, request)
+	})
+}
+
+// newProxy creates a reverse proxy to the worker of the tenant, which also handles WebSocket upgrades.
+func newProxy(tenant config.TenantConfig) *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: workerHost(tenant.ListenAddress)})
+	director := proxy.Director
+	proxy.Director = func(request *http.Request) {
+		originalHost := request.Host
+		director(request)
+		// Keep the original host for the worker, e.g. for links and CORS
+		request.Host = originalHost
+		request.Header.Set("X-Forwarded-Host", originalHost)
+	}
+	proxy.FlushInterval = -1 // For event streams
+	proxy.ErrorHandler = func(writer http.ResponseWriter, request *http.Request, err error) {
+		log.WithError(err).WithField("tenant", tenant.ID).Warn("Failed to proxy request to tenant worker")
+		writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+		writer.WriteHeader(502)
+		fmt.Fprintf(writer, "{\"message\":\"tenant %v unavailable\"}\n", tenant.ID)
+	}
+	return proxy
+}
+
+// workerHost gets the host to connect to for the listen address of a worker, using localhost if it listens on all addresses.
+func workerHost(listenAddress string) string {
+	host, port, err := net.SplitHostPort(listenAddress)
+	if err != nil {
+		return listenAddress
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
@@ -0,0 +1,87 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package tenant
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/helper"
+)
+
+func TestResolve(t *testing.T) {
+	tenants := []config.TenantConfig{
+		{ID: "partner", Hostnames: []string{"partner.example.net"}, PathPrefix: "/partner"},
+		{ID: "other", PathPrefix: "/other"},
+	}
+	check := func(host string, path string, expectedID string, expectedPath string) {
+		t.Helper()
+		tenant, tenantPath := Resolve(tenants, host, path)
+		id := ""
+		if tenant != nil {
+			id = tenant.ID
+		}
+		helper.CheckEqual(t, id, expectedID)
+		helper.CheckEqual(t, tenantPath, expectedPath)
+	}
+
+	check("techo.example.net", "/api/tracks/", "", "/api/tracks/")
+	check("Partner.Example.net:443", "/api/tracks/", "partner", "/api/tracks/")
+	check("techo.example.net", "/partner/api/tracks/", "partner", "/api/tracks/")
+	check("techo.example.net", "/partner", "partner", "/")
+	check("techo.example.net", "/partnership/", "", "/partnership/")
+	check("techo.example.net", "/other/api/", "other", "/api/")
+}
+
+func TestHandler(t *testing.T) {
+	worker := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		fmt.Fprintf(writer, "worker %v %v", request.URL.Path, request.Header.Get("X-Forwarded-Prefix"))
+	}))
+	defer worker.Close()
+	main := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		fmt.Fprintf(writer, "main %v", request.URL.Path)
+	})
+
+	oldTenants := config.Config.Tenants
+	defer func() { config.Config.Tenants = oldTenants }()
+	config.Config.Tenants = nil
+	helper.CheckEqual(t, fmt.Sprintf("%p", Handler(main)), fmt.Sprintf("%p", main))
+
+	config.Config.Tenants = []config.TenantConfig{{ID: "partner", PathPrefix: "/partner", ListenAddress: worker.Listener.Addr().String()}}
+	handler := Handler(main)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/api/tracks/", nil))
+	helper.CheckEqual(t, recorder.Body.String(), "main /api/tracks/")
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/partner/api/tracks/", nil))
+	helper.CheckEqual(t, recorder.Code, 200)
+	helper.CheckEqual(t, recorder.Body.String(), "worker /api/tracks/ /partner")
+}
+
+func TestWorkerHost(t *testing.T) {
+	helper.CheckEqual(t, workerHost(":8081"), "127.0.0.1:8081")
+	helper.CheckEqual(t, workerHost("0.0.0.0:8081"), "127.0.0.1:8081")
+	helper.CheckEqual(t, workerHost("10.0.0.2:8081"), "10.0.0.2:8081")
+}
@@ -0,0 +1,188 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package tenant
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	minRestartDelay = time.Second
+	maxRestartDelay = time.Minute
+	stopTimeout     = 40 * time.Second // A bit more than the drain timeout of the background jobs
+)
+
+// worker is a running worker process of a tenant.
+type worker struct {
+	tenantID string
+	cmd      *exec.Cmd
+	done     chan struct{}
+}
+
+var workers = make(map[string]*worker)
+var workersLock sync.Mutex
+var stopping bool
+
+// StartWorkers starts a worker process for each tenant, restarting them if they exit until StopWorkers is called.
+// The workers get the same config file, and the tenant to turn it into with the "-tenant" flag.
+func StartWorkers(configFile string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	for _, tenant := range config.Config.Tenants {
+		go superviseWorker(executable, configFile, tenant.ID)
+	}
+	return nil
+}
+
+// superviseWorker runs the worker of the tenant, restarting it with a backoff if it keeps exiting.
+func superviseWorker(executable string, configFile string, tenantID string) {
+	delay := minRestartDelay
+	for {
+		cmd := exec.Command(executable, "-config", configFile, "-tenant", tenantID, "serve")
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.Env = workerEnv()
+
+		workersLock.Lock()
+		if stopping {
+			workersLock.Unlock()
+			return
+		}
+		startTime := time.Now()
+		if err := cmd.Start(); err != nil {
+			workersLock.Unlock()
+			log.WithError(err).WithField("tenant", tenantID).Error("Failed to start tenant worker")
+		} else {
+			current := &worker{tenantID: tenantID, cmd: cmd, done: make(chan struct{})}
+			workers[tenantID] = current
+			workersLock.Unlock()
+			log.WithFields(log.Fields{
+				"tenant": tenantID,
+				"pid":    cmd.Process.Pid,
+			}).Info("Started tenant worker")
+
+			err := cmd.Wait()
+			close(current.done)
+			workersLock.Lock()
+			delete(workers, tenantID)
+			wasStopped := stopping
+			workersLock.Unlock()
+			if wasStopped {
+				return
+			}
+			log.WithError(err).WithField("tenant", tenantID).Error("Tenant worker exited")
+			// Start over with the backoff if it ran for a while
+			if time.Since(startTime) > maxRestartDelay {
+				delay = minRestartDelay
+			}
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+		if delay > maxRestartDelay {
+			delay = maxRestartDelay
+		}
+	}
+}
+
+// workerEnv gets the environment for workers, without the systemd variables, since only the main process talks to systemd.
+func workerEnv() []string {
+	var env []string
+	for _, variable := range os.Environ() {
+		if strings.HasPrefix(variable, "NOTIFY_SOCKET=") || strings.HasPrefix(variable, "WATCHDOG_") {
+			continue
+		}
+		env = append(env, variable)
+	}
+	return env
+}
+
+// StopWorkers asks the workers to shut down (like the main process, with SIGTERM) and waits for them to exit.
+func StopWorkers() {
+	workersLock.Lock()
+	stopping = true
+	running := make([]*worker, 0, len(workers))
+	for _, current := range workers {
+		running = append(running, current)
+	}
+	workersLock.Unlock()
+
+	for _, current := range running {
+		if err := current.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+			log.WithError(err).WithField("tenant", current.tenantID).Warn("Failed to signal tenant worker")
+		}
+	}
+	timeout := time.After(stopTimeout)
+	for _, current := range running {
+		select {
+		case <-current.done:
+		case <-timeout:
+			log.WithField("tenant", current.tenantID).Warn("Tenant worker didn't stop in time, killing it")
+			current.cmd.Process.Kill()
+		}
+	}
+}
+
+// WatchParent exits the worker if the main process is gone, e.g. if it was killed without stopping the workers.
+func WatchParent() {
+	parent := os.Getppid()
+	for range time.Tick(5 * time.Second) {
+		if os.Getppid() != parent {
+			log.Error("Main process is gone, exiting tenant worker")
+			os.Exit(1)
+		}
+	}
+}
+
+// logHook adds the tenant ID to all log entries of a worker, since they're mixed with the ones from the main process.
+type logHook struct {
+	tenantID string
+}
+
+// Levels returns all levels.
+func (hook logHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire adds the tenant field.
+func (hook logHook) Fire(entry *log.Entry) error {
+	entry.Data["tenant"] = hook.tenantID
+	return nil
+}
+
+// SetupWorker prepares running as the worker of the configured tenant, if any.
+func SetupWorker() {
+	if config.Config.TenantID == "" {
+		return
+	}
+	log.AddHook(logHook{tenantID: config.Config.TenantID})
+	go WatchParent()
+}
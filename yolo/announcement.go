@@ -0,0 +1,438 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/event"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/gathering/tech-online-backend/scheduler"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const announcementSchedulerInterval = 30 * time.Second
+
+// Event types for announcements, with the announcement as data.
+// Announcements for everyone or participants are streamed to all logged in users.
+const (
+	EventTypeAnnouncementPublished event.Type = "announcement.published" // The announcement became active
+	EventTypeAnnouncementUpdated   event.Type = "announcement.updated"   // An active announcement was changed
+)
+
+// Announcement severities.
+const (
+	AnnouncementSeverityInfo     = "info"
+	AnnouncementSeverityWarning  = "warning"
+	AnnouncementSeverityCritical = "critical"
+)
+
+// Announcement audiences.
+const (
+	AnnouncementAudienceAll            = "all"             // Everyone, including anonymous users
+	AnnouncementAudienceParticipants   = "participants"    // Logged in users
+	AnnouncementAudienceStaff          = "staff"           // Operators/admins
+	AnnouncementAudienceActiveStations = "active_stations" // Participants of the timeslots assigned to stations in the track, e.g. for broadcasts
+)
+
+// Announcement is a message (e.g. "the net track starts 30 min late") shown as a banner between the begin and end time.
+type Announcement struct {
+	ID          *uuid.UUID `column:"id" json:"id" brief:"true"`                 // Generated
+	Message     string     `column:"message" json:"message"`                    // Required
+	Severity    string     `column:"severity" json:"severity" brief:"true"`     // Optional, defaults to info
+	Audience    string     `column:"audience" json:"audience"`                  // Optional, defaults to all
+	TrackID     string     `column:"track" json:"track" brief:"true"`           // Optional, for all tracks if empty
+	BeginTime   *time.Time `column:"begin_time" json:"begin_time" brief:"true"` // Optional, active immediately if unset
+	EndTime     *time.Time `column:"end_time" json:"end_time" brief:"true"`     // Optional, active until deleted if unset
+	Author      string     `column:"author" json:"author"`                      // Generated
+	CreatedTime *time.Time `column:"created_time" json:"created_time"`          // Generated
+	Published   bool       `column:"published" json:"published"`                // Generated, if the published event was sent
+}
+
+// Announcements is a list of announcements.
+type Announcements []*Announcement
+
+// ActiveAnnouncements is a list of currently active announcements visible to the requester.
+type ActiveAnnouncements []*Announcement
+
+func init() {
+	rest.AddHandler("/announcements/", "^$", func() interface{} { return &Announcements{} })
+	rest.AddHandler("/announcements/", "^active/$", func() interface{} { return &ActiveAnnouncements{} })
+	rest.AddHandler("/announcement/", "^(?:(?P<id>[^/]+)/)?$", func() interface{} { return &Announcement{} })
+	scheduler.AddJob("publish-announcements", announcementSchedulerInterval, publishDueAnnouncements)
+	registerPersonalData(personalDataTable{table: "announcements", actorColumns: []string{"author"}, erasure: personalDataAnonymize})
+}
+
+// Get gets all announcements, including inactive ones, newest first.
+func (announcements *Announcements) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params, prep filtering
+	var whereArgs []interface{}
+	if trackID, ok := request.QueryArgs["track"]; ok {
+		whereArgs = append(whereArgs, "track", "=", trackID)
+	}
+
+	// Get
+	dbResult := db.SelectMany(announcements, "announcements", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	sort.SliceStable(*announcements, func(i, j int) bool {
+		return (*announcements)[i].CreatedTime.After(*(*announcements)[j].CreatedTime)
+	})
+	if request.ListLimit > 0 && len(*announcements) > request.ListLimit {
+		*announcements = (*announcements)[:request.ListLimit]
+	}
+	return rest.Result{}
+}
+
+// Get gets the currently active announcements for the requester's audience, most severe first.
+func (announcements *ActiveAnnouncements) Get(request *rest.Request) rest.Result {
+	// Get
+	var allAnnouncements Announcements
+	dbResult := db.SelectMany(&allAnnouncements, "announcements")
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+
+	// Filter
+	trackID, hasTrackID := request.QueryArgs["track"]
+	now := time.Now()
+	var stationTracks map[string]bool
+	*announcements = make(ActiveAnnouncements, 0)
+	for _, announcement := range allAnnouncements {
+		if !announcement.isActive(now) {
+			continue
+		}
+		if announcement.Audience == AnnouncementAudienceActiveStations && !isStaff(request.AccessToken) && request.AccessToken.OwnerUserID != nil {
+			// Only looked up if needed, since most requests don't have any
+			if stationTracks == nil {
+				var err error
+				stationTracks, err = activeStationTracks(request.AccessToken.OwnerUserID.String())
+				if err != nil {
+					return rest.Result{Code: 500, Error: err}
+				}
+			}
+			if !stationTracks[announcement.TrackID] {
+				continue
+			}
+		} else if !announcement.isVisibleTo(request.AccessToken) {
+			continue
+		}
+		if hasTrackID && announcement.TrackID != "" && announcement.TrackID != trackID {
+			continue
+		}
+		*announcements = append(*announcements, announcement)
+	}
+	sort.SliceStable(*announcements, func(i, j int) bool {
+		a, b := (*announcements)[i], (*announcements)[j]
+		if a.severityRank() != b.severityRank() {
+			return a.severityRank() > b.severityRank()
+		}
+		return a.CreatedTime.After(*b.CreatedTime)
+	})
+	return rest.Result{}
+}
+
+// Get gets a single announcement.
+func (announcement *Announcement) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+
+	// Get
+	dbResult := db.Select(announcement, "announcements", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+	return rest.Result{}
+}
+
+// Post creates an announcement, published immediately if already active.
+func (announcement *Announcement) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Prepare and validate
+	newID := uuid.New()
+	now := time.Now()
+	announcement.ID = &newID
+	announcement.Author = request.AccessToken.GetName()
+	announcement.CreatedTime = &now
+	announcement.Published = false
+	if result := announcement.validate(); !result.IsOk() {
+		return result
+	}
+
+	// Create
+	dbResult := db.Insert("announcements", announcement)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	request.Log().WithFields(log.Fields{
+		"announcement": announcement.ID,
+		"actor":        announcement.Author,
+	}).Info("Announcement created")
+	if announcement.isActive(now) {
+		if err := announcement.publish(EventTypeAnnouncementPublished); err != nil {
+			return rest.Result{Code: 500, Error: err}
+		}
+	}
+
+	return rest.Result{Code: 201, Location: fmt.Sprintf("%v/announcement/%v/", config.Config.SitePrefix, announcement.ID)}
+}
+
+// Put updates an announcement.
+// Active announcements are republished as updated, rescheduled ones are published again when they become active.
+func (announcement *Announcement) Put(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+	var oldAnnouncement Announcement
+	oldDBResult := db.Select(&oldAnnouncement, "announcements", "id", "=", id)
+	if oldDBResult.IsFailed() {
+		return rest.Result{Code: 500, Error: oldDBResult.Error}
+	}
+	if !oldDBResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+
+	// Validate
+	if announcement.ID != nil && (*announcement.ID).String() != id {
+		return rest.Result{Code: 400, Message: "mismatch between URL and JSON IDs"}
+	}
+	announcement.ID = oldAnnouncement.ID
+	announcement.Author = oldAnnouncement.Author
+	announcement.CreatedTime = oldAnnouncement.CreatedTime
+	announcement.Published = oldAnnouncement.Published
+	if result := announcement.validate(); !result.IsOk() {
+		return result
+	}
+
+	// Update
+	now := time.Now()
+	active := announcement.isActive(now)
+	if !active {
+		announcement.Published = false
+	}
+	dbResult := db.Update("announcements", announcement, "id", "=", announcement.ID)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if active {
+		eventType := EventTypeAnnouncementUpdated
+		if !announcement.Published {
+			eventType = EventTypeAnnouncementPublished
+		}
+		if err := announcement.publish(eventType); err != nil {
+			return rest.Result{Code: 500, Error: err}
+		}
+	}
+	return rest.Result{}
+}
+
+// Delete deletes an announcement.
+func (announcement *Announcement) Delete(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+
+	// Delete
+	dbResult := db.Delete("announcements", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if dbResult.Affected == 0 {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+	request.Log().WithFields(log.Fields{
+		"announcement": id,
+		"actor":        request.AccessToken.GetName(),
+	}).Info("Announcement deleted")
+	return rest.Result{}
+}
+
+func (announcement *Announcement) validate() rest.Result {
+	announcement.Message = strings.TrimSpace(announcement.Message)
+	if announcement.Message == "" {
+		return rest.Result{Code: 400, Message: "missing message"}
+	}
+	if announcement.Severity == "" {
+		announcement.Severity = AnnouncementSeverityInfo
+	}
+	switch announcement.Severity {
+	case AnnouncementSeverityInfo, AnnouncementSeverityWarning, AnnouncementSeverityCritical:
+	default:
+		return rest.Result{Code: 400, Message: "invalid severity"}
+	}
+	if announcement.Audience == "" {
+		announcement.Audience = AnnouncementAudienceAll
+	}
+	switch announcement.Audience {
+	case AnnouncementAudienceAll, AnnouncementAudienceParticipants, AnnouncementAudienceStaff, AnnouncementAudienceActiveStations:
+	default:
+		return rest.Result{Code: 400, Message: "invalid audience"}
+	}
+	if announcement.Audience == AnnouncementAudienceActiveStations && announcement.TrackID == "" {
+		return rest.Result{Code: 400, Message: "missing track for the active stations audience"}
+	}
+	if announcement.TrackID != "" {
+		var track Track
+		trackDBResult := db.Select(&track, "tracks", "id", "=", announcement.TrackID)
+		if trackDBResult.IsFailed() {
+			return rest.Result{Code: 500, Error: trackDBResult.Error}
+		}
+		if !trackDBResult.IsSuccess() {
+			return rest.Result{Code: 400, Message: "referenced track does not exist"}
+		}
+	}
+	if announcement.BeginTime != nil && announcement.EndTime != nil && !announcement.EndTime.After(*announcement.BeginTime) {
+		return rest.Result{Code: 400, Message: "end time must be after begin time"}
+	}
+	return rest.Result{}
+}
+
+// isActive checks if the announcement should be shown at the time.
+func (announcement *Announcement) isActive(now time.Time) bool {
+	if announcement.BeginTime != nil && now.Before(*announcement.BeginTime) {
+		return false
+	}
+	if announcement.EndTime != nil && !now.Before(*announcement.EndTime) {
+		return false
+	}
+	return true
+}
+
+// isVisibleTo checks if the token is in the audience of the announcement.
+// Participants with stations are not checked for the active stations audience, as it requires looking up the stations.
+func (announcement *Announcement) isVisibleTo(token rest.AccessTokenEntry) bool {
+	switch announcement.Audience {
+	case AnnouncementAudienceAll:
+		return true
+	case AnnouncementAudienceParticipants:
+		return token.OwnerUserID != nil || isStaff(token)
+	case AnnouncementAudienceStaff, AnnouncementAudienceActiveStations:
+		return isStaff(token)
+	}
+	return false
+}
+
+func (announcement *Announcement) severityRank() int {
+	switch announcement.Severity {
+	case AnnouncementSeverityCritical:
+		return 2
+	case AnnouncementSeverityWarning:
+		return 1
+	}
+	return 0
+}
+
+// publish publishes the announcement event and marks the announcement as published.
+// Announcements for active stations are addressed to the participants currently assigned to stations in the track.
+func (announcement *Announcement) publish(eventType event.Type) error {
+	var userIDs []uuid.UUID
+	if announcement.Audience == AnnouncementAudienceActiveStations {
+		var err error
+		userIDs, err = activeStationParticipantIDs(announcement.TrackID)
+		if err != nil {
+			return err
+		}
+	}
+	if !announcement.Published {
+		announcement.Published = true
+		dbResult := db.Update("announcements", announcement, "id", "=", announcement.ID)
+		if dbResult.IsFailed() {
+			return dbResult.Error
+		}
+	}
+	event.Publish(event.Event{
+		Type:    eventType,
+		TrackID: announcement.TrackID,
+		Title:   "Announcement",
+		Message: announcement.Message,
+		Data:    announcement,
+		UserIDs: userIDs,
+	})
+	return nil
+}
+
+// publishDueAnnouncements publishes scheduled announcements which became active.
+func publishDueAnnouncements() error {
+	var announcements Announcements
+	dbResult := db.SelectMany(&announcements, "announcements", "published", "=", false)
+	if dbResult.IsFailed() {
+		return dbResult.Error
+	}
+
+	now := time.Now()
+	for _, announcement := range announcements {
+		if !announcement.isActive(now) {
+			continue
+		}
+		if err := announcement.publish(EventTypeAnnouncementPublished); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isPublicAnnouncementEvent checks if the event is an announcement for everyone or participants,
+// which is streamed to all logged in users and not only those addressed.
+func isPublicAnnouncementEvent(ev event.Event) bool {
+	announcement, ok := ev.Data.(*Announcement)
+	return ok && (announcement.Audience == AnnouncementAudienceAll || announcement.Audience == AnnouncementAudienceParticipants)
+}
@@ -0,0 +1,388 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/event"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/gathering/tech-online-backend/scheduler"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	anomalyDetectionInterval    = 5 * time.Minute
+	defaultMinCompletionSeconds = 60
+)
+
+// EventTypeAnomaliesDetected is the event for new suspicious submissions in the review queue, sent to operators/admins.
+const EventTypeAnomaliesDetected event.Type = "anomalies.detected"
+
+// AnomalyKind is the kind of suspicious pattern.
+type AnomalyKind string
+
+const (
+	// AnomalyKindIdenticalAnswers means the same wrong flag answer was submitted from multiple timeslots (teams).
+	AnomalyKindIdenticalAnswers AnomalyKind = "identical_answers"
+	// AnomalyKindFastCompletion means a task was completed impossibly soon after the timeslot began.
+	AnomalyKindFastCompletion AnomalyKind = "fast_completion"
+	// AnomalyKindPassWithoutActivity means the tests of a task were passing when first reported, without ever failing in the timeslot.
+	AnomalyKindPassWithoutActivity AnomalyKind = "pass_without_activity"
+)
+
+// AnomalyStatus is the review status of an anomaly.
+type AnomalyStatus string
+
+const (
+	// AnomalyStatusOpen means it's waiting for review.
+	AnomalyStatusOpen AnomalyStatus = "open"
+	// AnomalyStatusDismissed means it was reviewed and found innocent.
+	AnomalyStatusDismissed AnomalyStatus = "dismissed"
+	// AnomalyStatusConfirmed means it was reviewed and found to be cheating.
+	AnomalyStatusConfirmed AnomalyStatus = "confirmed"
+)
+
+// Anomaly is a suspicious pattern found for a timeslot, for the anti-cheat crew to review.
+// Findings involving multiple timeslots get one anomaly per timeslot, with the same fingerprint.
+type Anomaly struct {
+	ID            *uuid.UUID    `column:"id" json:"id"`
+	TrackID       string        `column:"track" json:"track"`
+	Kind          AnomalyKind   `column:"kind" json:"kind"`
+	Fingerprint   string        `column:"fingerprint" json:"fingerprint"` // Identifies the finding, for grouping and to avoid duplicates
+	TimeslotID    string        `column:"timeslot" json:"timeslot"`
+	TaskShortname string        `column:"task_shortname" json:"task_shortname"`
+	Details       string        `column:"details" json:"details"`
+	DetectedTime  *time.Time    `column:"detected_time" json:"detected_time"`
+	Status        AnomalyStatus `column:"status" json:"status"`           // Set by reviewers
+	ReviewNote    string        `column:"review_note" json:"review_note"` // Set by reviewers
+	Reviewer      string        `column:"reviewer" json:"reviewer"`       // Generated
+	ReviewTime    *time.Time    `column:"review_time" json:"review_time"` // Generated
+}
+
+// Anomalies is a list of anomalies.
+type Anomalies []*Anomaly
+
+// anomalyFinding is an anomaly found by a detector, before being saved.
+type anomalyFinding struct {
+	kind          AnomalyKind
+	fingerprint   string
+	timeslotID    string
+	taskShortname string
+	details       string
+}
+
+func init() {
+	rest.AddHandler("/anomalies/", "^$", func() interface{} { return &Anomalies{} })
+	rest.AddHandler("/anomaly/", "^(?P<id>[^/]+)/$", func() interface{} { return &Anomaly{} })
+	scheduler.AddJob("detect-anomalies", anomalyDetectionInterval, detectAllAnomalies)
+	registerPersonalData(personalDataTable{table: "anomalies", actorColumns: []string{"reviewer"}, erasure: personalDataAnonymize})
+}
+
+// Get gets the review queue, open anomalies first and newest first within each status,
+// optionally filtered by track, kind, status and timeslot.
+func (anomalies *Anomalies) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if !isStaff(request.AccessToken) {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params, prep filtering
+	var whereArgs []interface{}
+	for _, arg := range []struct{ name, column string }{{"track", "track"}, {"kind", "kind"}, {"status", "status"}, {"timeslot", "timeslot"}} {
+		if value, ok := request.QueryArgs[arg.name]; ok {
+			whereArgs = append(whereArgs, arg.column, "=", value)
+		}
+	}
+
+	// Get
+	*anomalies = make(Anomalies, 0)
+	dbResult := db.SelectMany(anomalies, "anomalies", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	sort.SliceStable(*anomalies, func(i, j int) bool {
+		a, b := (*anomalies)[i], (*anomalies)[j]
+		if (a.Status == AnomalyStatusOpen) != (b.Status == AnomalyStatusOpen) {
+			return a.Status == AnomalyStatusOpen
+		}
+		return a.DetectedTime.After(*b.DetectedTime)
+	})
+	if request.ListLimit > 0 && len(*anomalies) > request.ListLimit {
+		*anomalies = (*anomalies)[:request.ListLimit]
+	}
+	return rest.Result{}
+}
+
+// Get gets a single anomaly.
+func (anomaly *Anomaly) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if !isStaff(request.AccessToken) {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Get
+	return anomaly.load(request)
+}
+
+// Put reviews the anomaly, setting the status and review note. Other fields are kept.
+func (anomaly *Anomaly) Put(request *rest.Request) rest.Result {
+	// Check perms
+	if !isStaff(request.AccessToken) {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Validate
+	switch anomaly.Status {
+	case AnomalyStatusOpen, AnomalyStatusDismissed, AnomalyStatusConfirmed:
+	default:
+		return rest.Result{Code: 400, Message: "missing or invalid status"}
+	}
+
+	// Update
+	status, reviewNote := anomaly.Status, anomaly.ReviewNote
+	if result := anomaly.load(request); !result.IsOk() {
+		return result
+	}
+	now := time.Now()
+	anomaly.Status = status
+	anomaly.ReviewNote = reviewNote
+	anomaly.Reviewer = request.AccessToken.GetName()
+	anomaly.ReviewTime = &now
+	dbResult := db.Update("anomalies", anomaly, "id", "=", anomaly.ID)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	request.Log().WithFields(log.Fields{
+		"anomaly": anomaly.ID,
+		"status":  anomaly.Status,
+		"actor":   anomaly.Reviewer,
+	}).Info("Anomaly reviewed")
+	return rest.Result{}
+}
+
+func (anomaly *Anomaly) load(request *rest.Request) rest.Result {
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+	dbResult := db.Select(anomaly, "anomalies", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+	return rest.Result{}
+}
+
+// detectAllAnomalies runs the detectors for all tracks, adding new findings to the review queue.
+func detectAllAnomalies() error {
+	var tracks Tracks
+	if dbResult := db.SelectMany(&tracks, "tracks"); dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	for _, track := range tracks {
+		if err := detectTrackAnomalies(track.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func detectTrackAnomalies(trackID string) error {
+	var findings []*anomalyFinding
+	identicalFindings, err := detectIdenticalAnswers(trackID)
+	if err != nil {
+		return err
+	}
+	findings = append(findings, identicalFindings...)
+	completionFindings, err := detectSuspiciousCompletions(trackID)
+	if err != nil {
+		return err
+	}
+	findings = append(findings, completionFindings...)
+
+	// Save new findings, already known ones are ignored
+	newCount := 0
+	now := time.Now()
+	for _, finding := range findings {
+		result, err := db.DB.Exec("INSERT INTO anomalies (id, track, kind, fingerprint, timeslot, task_shortname, details, detected_time, status, review_note, reviewer, review_time) "+
+			"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, '', '', NULL) ON CONFLICT (kind, fingerprint, timeslot) DO NOTHING",
+			uuid.New().String(), trackID, finding.kind, finding.fingerprint, finding.timeslotID, finding.taskShortname, finding.details, now, AnomalyStatusOpen)
+		if err != nil {
+			return err
+		}
+		if affected, err := result.RowsAffected(); err != nil {
+			return err
+		} else if affected > 0 {
+			newCount++
+		}
+	}
+	if newCount > 0 {
+		log.WithFields(log.Fields{
+			"track": trackID,
+			"count": newCount,
+		}).Info("Detected anomalies")
+		publishStaffEvent(EventTypeAnomaliesDetected, trackID, "Suspicious submissions detected",
+			fmt.Sprintf("%v new suspicious submission patterns in track %v need review.", newCount, trackID), nil)
+	}
+	return nil
+}
+
+// detectIdenticalAnswers finds wrong flag answers submitted from multiple timeslots.
+// Correct answers are expected to be identical, but sharing the same wrong guess suggests collaboration.
+func detectIdenticalAnswers(trackID string) ([]*anomalyFinding, error) {
+	var submissions FlagSubmissions
+	dbResult := db.SelectMany(&submissions, "flag_submissions", "track", "=", trackID, "correct", "=", false, "answer_hash", "!=", "")
+	if dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	type answerKey struct{ task, hash string }
+	timeslotsByAnswer := make(map[answerKey]map[string]bool)
+	for _, submission := range submissions {
+		key := answerKey{submission.TaskShortname, submission.AnswerHash}
+		if timeslotsByAnswer[key] == nil {
+			timeslotsByAnswer[key] = make(map[string]bool)
+		}
+		timeslotsByAnswer[key][submission.TimeslotID] = true
+	}
+
+	var findings []*anomalyFinding
+	for key, timeslotIDs := range timeslotsByAnswer {
+		if len(timeslotIDs) < 2 {
+			continue
+		}
+		for timeslotID := range timeslotIDs {
+			findings = append(findings, &anomalyFinding{
+				kind:          AnomalyKindIdenticalAnswers,
+				fingerprint:   fmt.Sprintf("%v/%v", key.task, key.hash),
+				timeslotID:    timeslotID,
+				taskShortname: key.task,
+				details:       fmt.Sprintf("The same wrong answer for task %v was submitted from %v timeslots.", key.task, len(timeslotIDs)),
+			})
+		}
+	}
+	return findings, nil
+}
+
+// detectSuspiciousCompletions finds tasks completed too soon after the timeslot began, and tasks which were passing
+// when first reported without failing first. Tasks with flags are skipped for the latter, since flags only report passes.
+func detectSuspiciousCompletions(trackID string) ([]*anomalyFinding, error) {
+	minCompletionSeconds := config.Config.Tracks[trackID].Anomalies.MinCompletionSeconds
+	if minCompletionSeconds == 0 {
+		minCompletionSeconds = defaultMinCompletionSeconds
+	}
+
+	// Get everything
+	var timeslots Timeslots
+	if dbResult := db.SelectMany(&timeslots, "timeslots", "track", "=", trackID); dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	var history TestHistory
+	if dbResult := db.SelectMany(&history, "test_history", "track", "=", trackID, "timeslot", "!=", ""); dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	var flags TaskFlags
+	if dbResult := db.SelectMany(&flags, "task_flags", "track", "=", trackID); dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	flagTasks := make(map[string]bool)
+	for _, flag := range flags {
+		flagTasks[flag.TaskShortname] = true
+	}
+	beginTimes := make(map[string]*time.Time)
+	for _, timeslot := range timeslots {
+		beginTimes[timeslot.ID.String()] = timeslot.BeginTime
+	}
+
+	// Group by timeslot and task, oldest first
+	type timeslotTask struct{ timeslot, task string }
+	grouped := make(map[timeslotTask][]*TestHistoryEntry)
+	for _, entry := range history {
+		key := timeslotTask{entry.TimeslotID, entry.TaskShortname}
+		grouped[key] = append(grouped[key], entry)
+	}
+
+	var findings []*anomalyFinding
+	for key, entries := range grouped {
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].Timestamp.Before(*entries[j].Timestamp)
+		})
+		passTime, everFailed := firstHistoryPass(entries)
+		if passTime == nil {
+			continue
+		}
+		beginTime := beginTimes[key.timeslot]
+		if minCompletionSeconds > 0 && beginTime != nil && !passTime.Before(*beginTime) && passTime.Sub(*beginTime) < time.Duration(minCompletionSeconds)*time.Second {
+			findings = append(findings, &anomalyFinding{
+				kind:          AnomalyKindFastCompletion,
+				fingerprint:   key.task,
+				timeslotID:    key.timeslot,
+				taskShortname: key.task,
+				details:       fmt.Sprintf("Task %v was completed %v seconds after the timeslot began.", key.task, int(passTime.Sub(*beginTime).Seconds())),
+			})
+		}
+		if !everFailed && !flagTasks[key.task] {
+			findings = append(findings, &anomalyFinding{
+				kind:          AnomalyKindPassWithoutActivity,
+				fingerprint:   key.task,
+				timeslotID:    key.timeslot,
+				taskShortname: key.task,
+				details:       fmt.Sprintf("The tests of task %v were passing when first reported, without failing first.", key.task),
+			})
+		}
+	}
+	return findings, nil
+}
+
+// firstHistoryPass finds when all the tests of a task seen in the (sorted) history were first passing at the same time,
+// and if any of them failed before that.
+func firstHistoryPass(entries []*TestHistoryEntry) (*time.Time, bool) {
+	statuses := make(map[string]bool)
+	for _, entry := range entries {
+		statuses[entry.Shortname] = false
+	}
+	everFailed := false
+	for _, entry := range entries {
+		statuses[entry.Shortname] = entry.StatusSuccess
+		if !entry.StatusSuccess {
+			everFailed = true
+			continue
+		}
+		allPassed := true
+		for _, passed := range statuses {
+			if !passed {
+				allPassed = false
+				break
+			}
+		}
+		if allPassed {
+			return entry.Timestamp, everFailed
+		}
+	}
+	return nil, everFailed
+}
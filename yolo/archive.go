@@ -0,0 +1,328 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	content "github.com/gathering/tech-online-backend/doc"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+)
+
+// archiveTrackedTables maps handler prefixes with an ID path arg to the table with the track of the object.
+var archiveTrackedTables = map[string]string{
+	"/station/":      "stations",
+	"/timeslot/":     "timeslots",
+	"/team/":         "teams",
+	"/task/":         "tasks",
+	"/hint/":         "hints",
+	"/task-flag/":    "task_flags",
+	"/task-check/":   "task_checks",
+	"/test/":         "tests",
+	"/registration/": "registrations",
+	"/queue-entry/":  "queue_entries",
+	"/feedback/":     "feedback",
+	"/shift/":        "crew_shifts",
+	"/anomaly/":      "anomalies",
+}
+
+// archiveExemptPrefixes are handler prefixes which don't change event data, so they work when archived.
+var archiveExemptPrefixes = []string{"/oauth2/", "/ldap/", "/document-preview/", "/graphql/"}
+
+// ArchiveSnapshot is a static snapshot of the public results of the event, for the website.
+type ArchiveSnapshot struct {
+	GeneratedTime *time.Time          `json:"generated_time"`
+	Tracks        []*ArchiveTrack     `json:"tracks"`
+	Documents     []*content.Document `json:"documents"` // Published only
+}
+
+// ArchiveTrack is a track in the archive snapshot.
+type ArchiveTrack struct {
+	ID           string          `json:"id"`
+	Type         TrackType       `json:"type"`
+	Name         string          `json:"name"`
+	Archived     bool            `json:"archived"`
+	Participants int             `json:"participants"` // Timeslots which have begun
+	Tasks        []*ArchiveTask  `json:"tasks"`
+	Scores       []*ArchiveScore `json:"scores"` // Highest first
+}
+
+// ArchiveTask is a task in the archive snapshot.
+type ArchiveTask struct {
+	Shortname   string `json:"shortname"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Points      int    `json:"points"`
+}
+
+// ArchiveScore is a final score in the archive snapshot, without usernames.
+type ArchiveScore struct {
+	Rank           int    `json:"rank"` // Equal scores share the rank
+	DisplayName    string `json:"display_name"`
+	Team           string `json:"team"`
+	Score          int    `json:"score"`
+	CompletedTasks int    `json:"completed_tasks"`
+}
+
+func init() {
+	rest.AddRequestFilter(archiveFilter)
+	rest.AddHandler("/archive/", "^snapshot/$", func() interface{} { return &ArchiveSnapshot{} })
+}
+
+// Get builds the snapshot, optionally limited to the "track" query arg.
+// It's public once the event (or the track) is archived, since it only contains what's shown publicly anyway.
+func (snapshot *ArchiveSnapshot) Get(request *rest.Request) rest.Result {
+	// Check params
+	trackID, trackFiltered := request.QueryArgs["track"]
+
+	// Get tracks
+	var tracks Tracks
+	var whereArgs []interface{}
+	if trackFiltered {
+		whereArgs = append(whereArgs, "id", "=", trackID)
+	}
+	if dbResult := db.SelectMany(&tracks, "tracks", whereArgs...); dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if trackFiltered && len(tracks) == 0 {
+		return rest.Result{Code: 404, Message: "track not found"}
+	}
+
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin && !config.Config.Archived {
+		for _, track := range tracks {
+			if !trackFiltered || !track.Archived {
+				return rest.Result{Code: 403, Message: "not archived yet"}
+			}
+		}
+	}
+
+	// Build
+	now := time.Now()
+	snapshot.GeneratedTime = &now
+	snapshot.Tracks = make([]*ArchiveTrack, 0, len(tracks))
+	for _, track := range tracks {
+		archiveTrack, err := buildArchiveTrack(track)
+		if err != nil {
+			return rest.Result{Code: 500, Error: err}
+		}
+		snapshot.Tracks = append(snapshot.Tracks, archiveTrack)
+	}
+	sort.SliceStable(snapshot.Tracks, func(i, j int) bool {
+		return snapshot.Tracks[i].ID < snapshot.Tracks[j].ID
+	})
+	var documents content.Documents
+	if dbResult := db.SelectMany(&documents, "documents", "status", "=", content.DocumentStatusPublished); dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	snapshot.Documents = documents
+	if snapshot.Documents == nil {
+		snapshot.Documents = make([]*content.Document, 0)
+	}
+	return rest.Result{}
+}
+
+func buildArchiveTrack(track *Track) (*ArchiveTrack, error) {
+	archiveTrack := ArchiveTrack{
+		ID:       track.ID,
+		Type:     track.Type,
+		Name:     track.Name,
+		Archived: track.Archived,
+		Tasks:    make([]*ArchiveTask, 0),
+		Scores:   make([]*ArchiveScore, 0),
+	}
+
+	// Tasks
+	var tasks Tasks
+	if dbResult := db.SelectMany(&tasks, "tasks", "track", "=", track.ID); dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	sort.SliceStable(tasks, func(i, j int) bool {
+		a, b := tasks[i], tasks[j]
+		if (a.Sequence == nil) != (b.Sequence == nil) {
+			return a.Sequence != nil
+		}
+		if a.Sequence != nil && *a.Sequence != *b.Sequence {
+			return *a.Sequence < *b.Sequence
+		}
+		return a.Shortname < b.Shortname
+	})
+	for _, task := range tasks {
+		archiveTrack.Tasks = append(archiveTrack.Tasks, &ArchiveTask{
+			Shortname:   task.Shortname,
+			Name:        task.Name,
+			Description: task.Description,
+			Points:      task.Points,
+		})
+	}
+
+	// Participants
+	var timeslots Timeslots
+	if dbResult := db.SelectMany(&timeslots, "timeslots", "track", "=", track.ID); dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	timeslotMap := make(map[uuid.UUID]*Timeslot, len(timeslots))
+	for _, timeslot := range timeslots {
+		timeslotMap[*timeslot.ID] = timeslot
+		if timeslot.BeginTime != nil && timeslot.BeginTime.Before(time.Now()) {
+			archiveTrack.Participants++
+		}
+	}
+
+	// Scores
+	var scores TimeslotScores
+	if dbResult := db.SelectMany(&scores, "timeslot_scores", "track", "=", track.ID); dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	sortScores(scores)
+	for i, score := range scores {
+		rank := i + 1
+		if i > 0 && scores[i-1].Score == score.Score {
+			rank = archiveTrack.Scores[i-1].Rank
+		}
+		archiveScore := ArchiveScore{
+			Rank:           rank,
+			Score:          score.Score,
+			CompletedTasks: score.CompletedTasks,
+		}
+		if timeslot, ok := timeslotMap[*score.TimeslotID]; ok {
+			if timeslot.UserID != nil {
+				var user rest.User
+				if dbResult := db.Select(&user, "users", "id", "=", timeslot.UserID); dbResult.IsFailed() {
+					return nil, dbResult.Error
+				}
+				archiveScore.DisplayName = user.DisplayName
+			}
+			if timeslot.TeamID != nil {
+				var team Team
+				if dbResult := db.Select(&team, "teams", "id", "=", timeslot.TeamID); dbResult.IsFailed() {
+					return nil, dbResult.Error
+				}
+				archiveScore.Team = team.Name
+			}
+		}
+		archiveTrack.Scores = append(archiveTrack.Scores, &archiveScore)
+	}
+	return &archiveTrack, nil
+}
+
+// archiveFilter rejects changes from non-admins when the event or the track of the request is archived.
+func archiveFilter(request *rest.Request) rest.Result {
+	if request.Method != "POST" && request.Method != "PUT" && request.Method != "DELETE" {
+		return rest.Result{}
+	}
+	if request.AccessToken.GetRole() == rest.RoleAdmin {
+		return rest.Result{}
+	}
+	for _, prefix := range archiveExemptPrefixes {
+		if request.PathPrefix == prefix {
+			return rest.Result{}
+		}
+	}
+	if config.Config.Archived {
+		return rest.Result{Code: 409, Message: "the event is archived and read-only"}
+	}
+
+	trackID, err := requestTrackID(request)
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	if trackID == "" {
+		return rest.Result{}
+	}
+	var track Track
+	dbResult := db.Select(&track, "tracks", "id", "=", trackID)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if dbResult.IsSuccess() && track.Archived {
+		return rest.Result{Code: 409, Message: fmt.Sprintf("track %v is archived and read-only", trackID)}
+	}
+	return rest.Result{}
+}
+
+// requestTrackID finds the track the request is about, from the path/query args, the body or the object in the path.
+// It's empty if unknown.
+func requestTrackID(request *rest.Request) (string, error) {
+	if trackID := request.PathArgs["track_id"]; trackID != "" {
+		return trackID, nil
+	}
+	if trackID := request.QueryArgs["track"]; trackID != "" {
+		return trackID, nil
+	}
+	id := request.PathArgs["id"]
+	if request.PathPrefix == "/track/" && id != "" {
+		return id, nil
+	}
+	if request.PathPrefix == "/hooks/test-result/" {
+		return config.Config.Checkers[request.Header.Get(HookHeaderChecker)].TrackID, nil
+	}
+	if table, ok := archiveTrackedTables[request.PathPrefix]; ok && id != "" {
+		if trackID, err := selectTrackID(table, id); err != nil || trackID != "" {
+			return trackID, err
+		}
+	}
+
+	// Bodies referencing other objects
+	var body struct {
+		TrackID    string `json:"track"`
+		TimeslotID string `json:"timeslot"`
+		StationID  string `json:"station"`
+	}
+	if len(request.Body) == 0 || !strings.HasPrefix(strings.TrimSpace(string(request.Body)), "{") {
+		return "", nil
+	}
+	if err := json.Unmarshal(request.Body, &body); err != nil {
+		// Let the handler complain about it
+		return "", nil
+	}
+	switch {
+	case body.TrackID != "":
+		return body.TrackID, nil
+	case body.TimeslotID != "":
+		return selectTrackID("timeslots", body.TimeslotID)
+	case body.StationID != "":
+		return selectTrackID("stations", body.StationID)
+	}
+	return "", nil
+}
+
+func selectTrackID(table string, id string) (string, error) {
+	var trackID string
+	rows, err := db.DB.Query(fmt.Sprintf("SELECT track FROM %v WHERE id = $1", table), id)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	if rows.Next() {
+		if err := rows.Scan(&trackID); err != nil {
+			return "", err
+		}
+	}
+	return trackID, rows.Err()
+}
@@ -0,0 +1,404 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/event"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/gathering/tech-online-backend/scheduler"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const autoAssignInterval = 30 * time.Second
+
+// EventTypeStationAssigned is the event for when a station gets assigned to a timeslot.
+const EventTypeStationAssigned event.Type = "station.assigned"
+
+// StationAssignmentAction is what happened in an assignment.
+type StationAssignmentAction string
+
+const (
+	// StationAssignmentActionAssign means the station was bound to the timeslot.
+	StationAssignmentActionAssign StationAssignmentAction = "assign"
+	// StationAssignmentActionUnassign means the station was unbound from the timeslot.
+	StationAssignmentActionUnassign StationAssignmentAction = "unassign"
+)
+
+// StationAssignmentSource is what made an assignment.
+type StationAssignmentSource string
+
+const (
+	// StationAssignmentSourceAuto means the assignment engine did it.
+	StationAssignmentSourceAuto StationAssignmentSource = "auto"
+	// StationAssignmentSourceManual means an operator/admin did it.
+	StationAssignmentSourceManual StationAssignmentSource = "manual"
+)
+
+// StationAssignment is a historical record of a station getting assigned to or unassigned from a timeslot.
+type StationAssignment struct {
+	ID         *uuid.UUID              `column:"id" json:"id"`
+	TimeslotID *uuid.UUID              `column:"timeslot" json:"timeslot"`
+	StationID  *uuid.UUID              `column:"station" json:"station"`
+	Timestamp  *time.Time              `column:"timestamp" json:"timestamp"`
+	Action     StationAssignmentAction `column:"action" json:"action"`
+	Source     StationAssignmentSource `column:"source" json:"source"`
+	Actor      string                  `column:"actor" json:"actor"` // Name of the user/token for manual assignments
+}
+
+// StationAssignments is a list of station assignments.
+type StationAssignments []*StationAssignment
+
+// TimeslotAssignStationRequest is a request to assign a specific or any available station to the timeslot, replacing the current one.
+type TimeslotAssignStationRequest struct{}
+
+// TimeslotUnassignStationRequest is a request to unbind the station from the timeslot and stop automatic assignment for it.
+type TimeslotUnassignStationRequest struct{}
+
+func init() {
+	rest.AddHandler("/station-assignments/", "^$", func() interface{} { return &StationAssignments{} })
+	rest.AddHandler("/timeslot/", "^(?P<id>[^/]+)/assign-station/$", func() interface{} { return &TimeslotAssignStationRequest{} })
+	rest.AddHandler("/timeslot/", "^(?P<id>[^/]+)/unassign-station/$", func() interface{} { return &TimeslotUnassignStationRequest{} })
+	scheduler.AddJob("auto-assign-stations", autoAssignInterval, autoAssignStations)
+}
+
+// Get gets the assignment history, newest first.
+func (assignments *StationAssignments) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params, prep filtering
+	var whereArgs []interface{}
+	if timeslotID, ok := request.QueryArgs["timeslot"]; ok {
+		whereArgs = append(whereArgs, "timeslot", "=", timeslotID)
+	}
+	if stationID, ok := request.QueryArgs["station"]; ok {
+		whereArgs = append(whereArgs, "station", "=", stationID)
+	}
+
+	// Get
+	dbResult := db.SelectMany(assignments, "station_assignments", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	sort.SliceStable(*assignments, func(i, j int) bool {
+		return (*assignments)[i].Timestamp.After(*(*assignments)[j].Timestamp)
+	})
+	return rest.Result{}
+}
+
+// Post assigns the station from the "station" query arg, or any available one, to the timeslot.
+// Any currently assigned station is unassigned first, keeping its status.
+// The timeslot times are not changed, so this works for planned timeslots too. Only approved (or active) timeslots may get stations.
+func (assignRequest *TimeslotAssignStationRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Get timeslot and track
+	var timeslot Timeslot
+	var track Track
+	if result := loadTimeslotAndTrack(request, &timeslot, &track); !result.IsOk() {
+		return result
+	}
+	if result := timeslot.checkMayBegin(); !result.IsOk() {
+		return result
+	}
+
+	// Get the wanted station, if any
+	var wantedStation *Station
+	if stationID, ok := request.QueryArgs["station"]; ok {
+		wantedStation = &Station{}
+		dbResult := db.Select(wantedStation, "stations", "id", "=", stationID)
+		if dbResult.IsFailed() {
+			return rest.Result{Code: 500, Error: dbResult.Error}
+		}
+		if !dbResult.IsSuccess() {
+			return rest.Result{Code: 404, Message: "station not found"}
+		}
+		switch {
+		case wantedStation.TrackID != timeslot.TrackID:
+			return rest.Result{Code: 400, Message: "station is for another track"}
+		case wantedStation.Status == StationStatusTerminated:
+			return rest.Result{Code: 409, Message: "station is terminated"}
+		case wantedStation.isUnderMaintenance(time.Now()):
+			return rest.Result{Code: 409, Message: "station is under maintenance"}
+		case wantedStation.isSuspended():
+			return rest.Result{Code: 409, Message: "station is suspended"}
+		case wantedStation.TimeslotID != "" && wantedStation.TimeslotID != timeslot.ID.String():
+			return rest.Result{Code: 409, Message: "station is assigned to another timeslot"}
+		}
+	}
+
+	// Unassign current station
+	actor := request.AccessToken.GetName()
+	if result := timeslot.unassignStations(actor); !result.IsOk() {
+		return result
+	}
+
+	// Assign
+	var station *Station
+	if wantedStation != nil {
+		wantedStation.TimeslotID = timeslot.ID.String()
+		if result := wantedStation.createOrUpdate(); !result.IsOk() {
+			return result
+		}
+		station = wantedStation
+	} else {
+		var result rest.Result
+		if station, result = timeslot.assignStation(&track, true); !result.IsOk() {
+			return result
+		}
+	}
+	if err := saveStationAssignment(&timeslot, station, StationAssignmentActionAssign, StationAssignmentSourceManual, actor); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	// Activate it if it has begun, else the scheduler does it at the begin time
+	if timeslot.State == TimeslotStateApproved && (timeslot.BeginTime == nil || !timeslot.BeginTime.After(time.Now())) {
+		if result := timeslot.transition(TimeslotStateActive, actor); !result.IsOk() {
+			return result
+		}
+	}
+	timeslot.publishEvent(EventTypeStationAssigned, "Your station is ready",
+		fmt.Sprintf("You got station %v (%v).", station.Name, station.Shortname), station.ID)
+
+	// Allow auto-assignment again
+	if timeslot.NoAutoAssign {
+		timeslot.NoAutoAssign = false
+		if result := timeslot.createOrUpdate(); !result.IsOk() {
+			return result
+		}
+	}
+
+	return rest.Result{Code: 303, Location: fmt.Sprintf("%v/station/%v/", config.Config.SitePrefix, station.ID)}
+}
+
+// Post unassigns the station from the timeslot, keeping the station status as-is.
+// The timeslot won't get automatically assigned a new station until one is assigned manually.
+func (unassignRequest *TimeslotUnassignStationRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Get timeslot
+	var timeslot Timeslot
+	var track Track
+	if result := loadTimeslotAndTrack(request, &timeslot, &track); !result.IsOk() {
+		return result
+	}
+
+	// Unassign and stop auto-assignment
+	if result := timeslot.unassignStations(request.AccessToken.GetName()); !result.IsOk() {
+		return result
+	}
+	timeslot.NoAutoAssign = true
+	return timeslot.createOrUpdate()
+}
+
+func loadTimeslotAndTrack(request *rest.Request, timeslot *Timeslot, track *Track) rest.Result {
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+	timeslotDBResult := db.Select(timeslot, "timeslots", "id", "=", id)
+	if timeslotDBResult.IsFailed() {
+		return rest.Result{Code: 500, Error: timeslotDBResult.Error}
+	}
+	if !timeslotDBResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+	trackDBResult := db.Select(track, "tracks", "id", "=", timeslot.TrackID)
+	if trackDBResult.IsFailed() {
+		return rest.Result{Code: 500, Error: trackDBResult.Error}
+	}
+	if !trackDBResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "track not found"}
+	}
+	return rest.Result{}
+}
+
+// unassignStations unbinds all stations from the timeslot (normally max one), recording it.
+func (timeslot *Timeslot) unassignStations(actor string) rest.Result {
+	var stations Stations
+	dbResult := db.SelectMany(&stations, "stations", "timeslot", "=", timeslot.ID.String())
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	for _, station := range stations {
+		station.TimeslotID = ""
+		if result := station.createOrUpdate(); !result.IsOk() {
+			return result
+		}
+		if err := saveStationAssignment(timeslot, station, StationAssignmentActionUnassign, StationAssignmentSourceManual, actor); err != nil {
+			return rest.Result{Code: 500, Error: err}
+		}
+	}
+	return rest.Result{}
+}
+
+// autoAssignStations assigns stations to all current timeslots without one, for tracks with auto-assignment enabled.
+func autoAssignStations() error {
+	// Failures are logged and the rest of the tracks are still assigned
+	failures := 0
+	for trackID, trackConfig := range config.Config.Tracks {
+		if !trackConfig.AutoAssign {
+			continue
+		}
+		if err := autoAssignTrackStations(trackID); err != nil {
+			log.WithError(err).WithField("track", trackID).Warn("Failed to auto-assign stations")
+			failures++
+		}
+	}
+	if failures > 0 {
+		return fmt.Errorf("%v tracks failed", failures)
+	}
+	return nil
+}
+
+func autoAssignTrackStations(trackID string) error {
+	var track Track
+	trackDBResult := db.Select(&track, "tracks", "id", "=", trackID)
+	if trackDBResult.IsFailed() {
+		return trackDBResult.Error
+	}
+	if !trackDBResult.IsSuccess() {
+		return nil
+	}
+
+	// Find current timeslots, highest priority and earliest first
+	now := time.Now()
+	var timeslots Timeslots
+	dbResult := db.SelectMany(&timeslots, "timeslots",
+		"track", "=", trackID,
+		"begin_time", "<=", now,
+		"end_time", ">", now,
+		"no_auto_assign", "=", false,
+		"state", "IN", []string{string(TimeslotStateApproved), string(TimeslotStateActive)},
+	)
+	if dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	sort.SliceStable(timeslots, func(i, j int) bool {
+		if timeslots[i].priority() != timeslots[j].priority() {
+			return timeslots[i].priority() > timeslots[j].priority()
+		}
+		return timeslots[i].BeginTime.Before(*timeslots[j].BeginTime)
+	})
+
+	// Share the lock with the queue, since both hand out stations
+	queuePromotionLock.Lock()
+	defer queuePromotionLock.Unlock()
+
+	// Failures are logged and the rest of the timeslots are still assigned
+	failures := 0
+	for _, timeslot := range timeslots {
+		noStations, err := autoAssignTimeslot(&track, timeslot)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"track":    trackID,
+				"timeslot": timeslot.ID,
+			}).Warn("Failed to auto-assign station to timeslot")
+			failures++
+			continue
+		}
+		if noStations {
+			log.WithField("track", trackID).Debug("No available stations for auto-assignment")
+			break
+		}
+	}
+	if failures > 0 {
+		return fmt.Errorf("%v timeslots failed", failures)
+	}
+	return nil
+}
+
+// autoAssignTimeslot assigns a station to the timeslot if it has none and its category has capacity.
+// Returns true if there are no available stations left.
+func autoAssignTimeslot(track *Track, timeslot *Timeslot) (bool, error) {
+	if hasStation, err := timeslot.isActiveWithStation(); err != nil {
+		return false, err
+	} else if hasStation {
+		return false, nil
+	}
+	if result := timeslot.checkCategoryCapacity(); result.Code == 409 {
+		return false, nil
+	} else if !result.IsOk() {
+		return false, resultError(result)
+	}
+
+	station, result := timeslot.assignStation(track, true)
+	if result.Code == 404 {
+		return true, nil
+	}
+	if !result.IsOk() {
+		if result.Error != nil {
+			return false, result.Error
+		}
+		return false, fmt.Errorf("failed to assign station to timeslot %v: %v", timeslot.ID, result.Message)
+	}
+
+	if err := saveStationAssignment(timeslot, station, StationAssignmentActionAssign, StationAssignmentSourceAuto, ""); err != nil {
+		return false, err
+	}
+	if timeslot.State == TimeslotStateApproved {
+		if result := timeslot.transition(TimeslotStateActive, "auto-assignment"); !result.IsOk() {
+			return false, resultError(result)
+		}
+	}
+	log.WithFields(log.Fields{
+		"track":    track.ID,
+		"timeslot": timeslot.ID,
+		"station":  station.ID,
+	}).Info("Automatically assigned station to timeslot")
+	timeslot.publishEvent(EventTypeStationAssigned, "Your station is ready",
+		fmt.Sprintf("You got station %v (%v).", station.Name, station.Shortname), station.ID)
+	return false, nil
+}
+
+func saveStationAssignment(timeslot *Timeslot, station *Station, action StationAssignmentAction, source StationAssignmentSource, actor string) error {
+	id := uuid.New()
+	now := time.Now()
+	assignment := StationAssignment{
+		ID:         &id,
+		TimeslotID: timeslot.ID,
+		StationID:  station.ID,
+		Timestamp:  &now,
+		Action:     action,
+		Source:     source,
+		Actor:      actor,
+	}
+	dbResult := db.Insert("station_assignments", assignment)
+	if dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	station.queueDNSSync()
+	return nil
+}
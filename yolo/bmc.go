@@ -0,0 +1,273 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/bmc"
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/helper"
+	"github.com/gathering/tech-online-backend/redis"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultBMCMaxActionsPerStation = 2
+	defaultBMCMaxActions           = 10
+	defaultBMCActionWindow         = 5 * time.Minute
+	bmcGlobalRateLimitKey          = "*"
+)
+
+// StationBMCPower is the power state of a physical station, as reported by its BMC.
+type StationBMCPower struct {
+	StationID *uuid.UUID     `json:"station"`
+	Driver    bmc.Driver     `json:"driver"`
+	State     bmc.PowerState `json:"state"`
+}
+
+// BMCPowerAction is an audit log entry for a power action on a physical station through its BMC.
+type BMCPowerAction struct {
+	ID         *uuid.UUID `column:"id" json:"id"`
+	StationID  *uuid.UUID `column:"station" json:"station"`
+	TimeslotID string     `column:"timeslot" json:"timeslot"` // Assigned to the station at the time, if any
+	Action     bmc.Action `column:"action" json:"action"`
+	Actor      string     `column:"actor" json:"actor"`
+	Timestamp  *time.Time `column:"timestamp" json:"timestamp"`
+	Success    bool       `column:"success" json:"success"`
+	Error      string     `column:"error" json:"error"` // If failed
+}
+
+// BMCPowerActions is a list of BMC power actions.
+type BMCPowerActions []*BMCPowerAction
+
+// bmcRateLimiter limits power actions both per station and in total, to avoid accidental mass reboots.
+var bmcRateLimiter *helper.RateLimiter
+var bmcGlobalRateLimiter *helper.RateLimiter
+var bmcRateLimiterLock sync.Mutex
+
+func init() {
+	rest.AddHandler("/station/", "^(?P<id>[^/]+)/bmc-power/$", func() interface{} { return &StationBMCPower{} })
+	rest.AddHandler("/bmc-power-actions/", "^$", func() interface{} { return &BMCPowerActions{} })
+	registerPersonalData(personalDataTable{table: "bmc_power_actions", actorColumns: []string{"actor"}, erasure: personalDataAnonymize})
+	config.OnReload(func(changed []string) {
+		if config.ChangedSection(changed, "bmc") {
+			bmcRateLimiterLock.Lock()
+			bmcRateLimiter = nil
+			bmcGlobalRateLimiter = nil
+			bmcRateLimiterLock.Unlock()
+		}
+	})
+}
+
+// Get gets the power state of the station from its BMC.
+func (power *StationBMCPower) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if !isStaff(request.AccessToken) {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Get station and BMC
+	var station Station
+	controller, result := loadBMCStation(request, &station)
+	if !result.IsOk() {
+		return result
+	}
+
+	// Get
+	state, err := controller.PowerState()
+	if err != nil {
+		return rest.Result{Code: 502, Message: fmt.Sprintf("failed to get power state from BMC: %v", err)}
+	}
+	power.StationID = station.ID
+	power.Driver = station.BMCDriver
+	power.State = state
+	return rest.Result{}
+}
+
+// Post runs a power action ("action" query arg: "on", "off", "soft", "reset" or "cycle") on the station through its BMC.
+// Actions are rate limited per station and in total, and logged for auditing whether they succeed or not.
+func (power *StationBMCPower) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if !isStaff(request.AccessToken) {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	action := bmc.Action(request.QueryArgs["action"])
+	if !bmc.IsValidAction(action) {
+		return rest.Result{Code: 400, Message: "missing or invalid action"}
+	}
+	var station Station
+	controller, result := loadBMCStation(request, &station)
+	if !result.IsOk() {
+		return result
+	}
+
+	// Rate limit
+	stationLimiter, globalLimiter := getBMCRateLimiters()
+	if allowed, wait := globalLimiter.Allow(bmcGlobalRateLimitKey); !allowed {
+		return rest.Result{Code: 429, Message: fmt.Sprintf("too many power actions across stations, try again in %v seconds", int(math.Ceil(wait.Seconds())))}
+	}
+	if allowed, wait := stationLimiter.Allow(station.ID.String()); !allowed {
+		return rest.Result{Code: 429, Message: fmt.Sprintf("too many power actions for the station, try again in %v seconds", int(math.Ceil(wait.Seconds())))}
+	}
+
+	// Run action
+	actionErr := controller.Power(action)
+
+	// Log it
+	newID := uuid.New()
+	now := time.Now()
+	auditEntry := BMCPowerAction{
+		ID:         &newID,
+		StationID:  station.ID,
+		TimeslotID: station.TimeslotID,
+		Action:     action,
+		Actor:      request.AccessToken.GetName(),
+		Timestamp:  &now,
+		Success:    actionErr == nil,
+	}
+	if actionErr != nil {
+		auditEntry.Error = actionErr.Error()
+	}
+	if dbResult := db.Insert("bmc_power_actions", &auditEntry); dbResult.IsFailed() {
+		request.Log().WithError(dbResult.Error).WithField("station", station.ID).Error("Failed to save BMC power action")
+	}
+	logEntry := request.Log().WithFields(log.Fields{
+		"station": station.ID,
+		"action":  action,
+		"actor":   request.AccessToken.GetName(),
+	})
+	if actionErr != nil {
+		logEntry.WithError(actionErr).Warn("Station BMC power action failed")
+		station.publishProvisionFailed(fmt.Sprintf("power %v", action), actionErr)
+		return rest.Result{Code: 502, Message: fmt.Sprintf("BMC power action failed: %v", actionErr)}
+	}
+	logEntry.Info("Station BMC power action")
+
+	return rest.Result{Code: 303, Location: fmt.Sprintf("%v/station/%v/bmc-power/", config.Config.SitePrefix, station.ID)}
+}
+
+// Get gets the BMC power action audit log, newest first, optionally filtered by station ("station").
+func (actions *BMCPowerActions) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if !isStaff(request.AccessToken) {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Get
+	var whereArgs []interface{}
+	if stationID, ok := request.QueryArgs["station"]; ok {
+		whereArgs = append(whereArgs, "station", "=", stationID)
+	}
+	*actions = make(BMCPowerActions, 0)
+	dbResult := db.SelectMany(actions, "bmc_power_actions", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	sort.SliceStable(*actions, func(i, j int) bool {
+		return (*actions)[i].Timestamp.After(*(*actions)[j].Timestamp)
+	})
+	if request.ListLimit > 0 && len(*actions) > request.ListLimit {
+		*actions = (*actions)[:request.ListLimit]
+	}
+	return rest.Result{}
+}
+
+// loadBMCStation loads the station from the "id" path arg, plus a controller for its BMC.
+func loadBMCStation(request *rest.Request, station *Station) (bmc.Controller, rest.Result) {
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return nil, rest.Result{Code: 400, Message: "missing ID"}
+	}
+	dbResult := db.Select(station, "stations", "id", "=", id)
+	if dbResult.IsFailed() {
+		return nil, rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		return nil, rest.Result{Code: 404, Message: "not found"}
+	}
+	if station.BMCDriver == "" {
+		return nil, rest.Result{Code: 400, Message: "station has no BMC"}
+	}
+	credentials, credentialsExist := config.Config.BMC.Credentials[station.BMCCredentials]
+	if station.BMCCredentials != "" && !credentialsExist {
+		return nil, rest.Result{Code: 500, Message: fmt.Sprintf("BMC credentials %q are not configured", station.BMCCredentials)}
+	}
+	controller, err := bmc.New(station.BMCDriver, station.BMCAddress, bmc.Credentials{
+		Username:    credentials.Username,
+		Password:    credentials.Password,
+		InsecureTLS: credentials.InsecureTLS,
+	})
+	if err != nil {
+		return nil, rest.Result{Code: 500, Error: err}
+	}
+	return controller, rest.Result{}
+}
+
+// validateBMC validates the BMC fields of the station, if it has a BMC.
+func (station *Station) validateBMC() rest.Result {
+	switch station.BMCDriver {
+	case "":
+		return rest.Result{}
+	case bmc.DriverIPMI, bmc.DriverRedfish:
+	default:
+		return rest.Result{Code: 400, Message: "invalid BMC driver"}
+	}
+	if station.BMCAddress == "" {
+		return rest.Result{Code: 400, Message: "missing BMC address"}
+	}
+	if _, ok := config.Config.BMC.Credentials[station.BMCCredentials]; station.BMCCredentials != "" && !ok {
+		return rest.Result{Code: 400, Message: "referenced BMC credentials are not configured"}
+	}
+	return rest.Result{}
+}
+
+// getBMCRateLimiters gets the per-station and global rate limiters, creating them from the config if new or reset by a config reload.
+func getBMCRateLimiters() (*helper.RateLimiter, *helper.RateLimiter) {
+	bmcRateLimiterLock.Lock()
+	defer bmcRateLimiterLock.Unlock()
+	if bmcRateLimiter == nil {
+		maxActionsPerStation := defaultBMCMaxActionsPerStation
+		if config.Config.BMC.MaxActionsPerStation > 0 {
+			maxActionsPerStation = config.Config.BMC.MaxActionsPerStation
+		}
+		maxActions := defaultBMCMaxActions
+		if config.Config.BMC.MaxActions > 0 {
+			maxActions = config.Config.BMC.MaxActions
+		}
+		window := defaultBMCActionWindow
+		if config.Config.BMC.WindowSeconds > 0 {
+			window = time.Duration(config.Config.BMC.WindowSeconds) * time.Second
+		}
+		bmcRateLimiter = redis.NewRateLimiter("bmc-station", maxActionsPerStation, window)
+		bmcGlobalRateLimiter = redis.NewRateLimiter("bmc", maxActions, window)
+	}
+	return bmcRateLimiter, bmcGlobalRateLimiter
+}
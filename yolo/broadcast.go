@@ -0,0 +1,179 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"time"
+
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultBroadcastMinutes = 10
+	maxBroadcastMinutes     = 24 * 60
+)
+
+// TrackBroadcastRequest is a message from the operators to the participants at all active stations of a track,
+// e.g. "checker maintenance for 5 minutes, ignore failing tests".
+// It's saved as an announcement for the active stations audience, shown as a banner until it expires.
+type TrackBroadcastRequest struct {
+	Message      string        `json:"message"`      // Required
+	Severity     string        `json:"severity"`     // Optional, defaults to info
+	Minutes      int           `json:"minutes"`      // Optional, how long to show the banner, defaults to 10
+	Announcement *Announcement `json:"announcement"` // Response only
+}
+
+func init() {
+	rest.AddHandler("/track/", "^(?P<track_id>[^/]+)/broadcast/$", func() interface{} { return &TrackBroadcastRequest{} })
+}
+
+// Post broadcasts the message to the participants at the active stations of the track.
+func (broadcastRequest *TrackBroadcastRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if !isStaff(request.AccessToken) {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	trackID, trackIDExists := request.PathArgs["track_id"]
+	if !trackIDExists || trackID == "" {
+		return rest.Result{Code: 400, Message: "missing track ID"}
+	}
+	if broadcastRequest.Minutes == 0 {
+		broadcastRequest.Minutes = defaultBroadcastMinutes
+	}
+	if broadcastRequest.Minutes < 0 || broadcastRequest.Minutes > maxBroadcastMinutes {
+		return rest.Result{Code: 400, Message: "invalid minutes"}
+	}
+	var track Track
+	trackDBResult := db.Select(&track, "tracks", "id", "=", trackID)
+	if trackDBResult.IsFailed() {
+		return rest.Result{Code: 500, Error: trackDBResult.Error}
+	}
+	if !trackDBResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "track not found"}
+	}
+
+	// Prepare and validate
+	newID := uuid.New()
+	now := time.Now()
+	endTime := now.Add(time.Duration(broadcastRequest.Minutes) * time.Minute)
+	announcement := Announcement{
+		ID:          &newID,
+		Message:     broadcastRequest.Message,
+		Severity:    broadcastRequest.Severity,
+		Audience:    AnnouncementAudienceActiveStations,
+		TrackID:     trackID,
+		EndTime:     &endTime,
+		Author:      request.AccessToken.GetName(),
+		CreatedTime: &now,
+	}
+	if result := announcement.validate(); !result.IsOk() {
+		return result
+	}
+
+	// Create and publish
+	if dbResult := db.Insert("announcements", announcement); dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if err := announcement.publish(EventTypeAnnouncementPublished); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	request.Log().WithFields(log.Fields{
+		"announcement": announcement.ID,
+		"track":        trackID,
+		"actor":        announcement.Author,
+	}).Info("Message broadcast to active stations")
+
+	broadcastRequest.Announcement = &announcement
+	return rest.Result{}
+}
+
+// activeStationParticipantIDs gets the participants of the timeslots assigned to the non-terminated stations of the track.
+func activeStationParticipantIDs(trackID string) ([]uuid.UUID, error) {
+	var stations Stations
+	dbResult := db.SelectMany(&stations, "stations",
+		"track", "=", trackID,
+		"timeslot", "!=", "",
+		"status", "!=", StationStatusTerminated,
+	)
+	if dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	if len(stations) == 0 {
+		return nil, nil
+	}
+	timeslotIDs := make([]string, 0, len(stations))
+	for _, station := range stations {
+		timeslotIDs = append(timeslotIDs, station.TimeslotID)
+	}
+	var timeslots Timeslots
+	if dbResult := db.SelectMany(&timeslots, "timeslots", "id", "IN", timeslotIDs); dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+
+	var userIDs []uuid.UUID
+	seen := make(map[uuid.UUID]bool)
+	for _, timeslot := range timeslots {
+		participantIDs, err := timeslot.participantIDs()
+		if err != nil {
+			return nil, err
+		}
+		for _, userID := range participantIDs {
+			if !seen[userID] {
+				seen[userID] = true
+				userIDs = append(userIDs, userID)
+			}
+		}
+	}
+	return userIDs, nil
+}
+
+// activeStationTracks gets the tracks where the user (or one of the user's teams) has a timeslot assigned to a non-terminated station.
+func activeStationTracks(userID string) (map[string]bool, error) {
+	stationTracks := make(map[string]bool)
+	timeslots, err := loadUserTimeslots(userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(timeslots) == 0 {
+		return stationTracks, nil
+	}
+	timeslotIDs := make([]string, 0, len(timeslots))
+	for _, timeslot := range timeslots {
+		timeslotIDs = append(timeslotIDs, timeslot.ID.String())
+	}
+	var stations Stations
+	dbResult := db.SelectMany(&stations, "stations",
+		"timeslot", "IN", timeslotIDs,
+		"status", "!=", StationStatusTerminated,
+	)
+	if dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	for _, station := range stations {
+		stationTracks[station.TrackID] = true
+	}
+	return stationTracks, nil
+}
@@ -0,0 +1,851 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gathering/tech-online-backend/db"
+	content "github.com/gathering/tech-online-backend/doc"
+	"github.com/gathering/tech-online-backend/probe"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v3"
+)
+
+// TrackBundleVersion is the current version of the track bundle format. Bundles with newer versions are rejected.
+const TrackBundleVersion = 1
+
+// Track bundle formats.
+const (
+	TrackBundleFormatJSON = "json"
+	TrackBundleFormatYAML = "yaml"
+)
+
+// TrackBundle is a complete track definition which can be exported and imported elsewhere, e.g. to develop tracks in git.
+// IDs are left out since they differ between instances, everything is matched by shortnames instead.
+type TrackBundle struct {
+	Version        int                   `json:"version"`
+	ExportedAt     *time.Time            `json:"exported_at,omitempty"`
+	Track          TrackBundleTrack      `json:"track"`
+	Tasks          []TrackBundleTask     `json:"tasks"`
+	Hints          []TrackBundleHint     `json:"hints,omitempty"`
+	Checks         []TrackBundleCheck    `json:"checks,omitempty"`
+	Flags          []TrackBundleFlag     `json:"flags,omitempty"`
+	DocumentFamily *TrackBundleFamily    `json:"document_family,omitempty"`
+	Documents      []TrackBundleDocument `json:"documents,omitempty"`
+}
+
+// TrackBundleTrack is the track of a bundle.
+type TrackBundleTrack struct {
+	ID   string    `json:"id"`
+	Type TrackType `json:"type"`
+	Name string    `json:"name"`
+}
+
+// TrackBundleTask is a task in a bundle.
+type TrackBundleTask struct {
+	Shortname   string   `json:"shortname"`
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Sequence    *int     `json:"sequence,omitempty"`
+	Points      int      `json:"points,omitempty"`
+	DependsOn   []string `json:"depends_on,omitempty"`
+}
+
+// TrackBundleHint is a hint in a bundle, matched by task and sequence.
+type TrackBundleHint struct {
+	Task     string `json:"task"`
+	Sequence int    `json:"sequence"`
+	Content  string `json:"content"`
+	Penalty  int    `json:"penalty,omitempty"`
+}
+
+// TrackBundleCheck is a test runner check in a bundle.
+type TrackBundleCheck struct {
+	Task            string     `json:"task"`
+	Shortname       string     `json:"shortname"`
+	Name            string     `json:"name"`
+	Description     string     `json:"description,omitempty"`
+	Sequence        *int       `json:"sequence,omitempty"`
+	Enabled         bool       `json:"enabled"`
+	Kind            probe.Kind `json:"kind"`
+	Port            int        `json:"port,omitempty"`
+	Path            string     `json:"path,omitempty"`
+	Command         string     `json:"command,omitempty"`
+	Username        string     `json:"username,omitempty"`
+	Expect          string     `json:"expect,omitempty"`
+	TimeoutSeconds  int        `json:"timeout_seconds,omitempty"`
+	IntervalSeconds int        `json:"interval_seconds,omitempty"`
+}
+
+// TrackBundleFlag is a task flag in a bundle.
+// Hash flags may be written with the plaintext flag, which is hashed when imported, while exports contain the salt and hash.
+type TrackBundleFlag struct {
+	Task          string       `json:"task"`
+	Shortname     string       `json:"shortname"`
+	Name          string       `json:"name"`
+	Kind          TaskFlagKind `json:"kind"`
+	CaseSensitive bool         `json:"case_sensitive,omitempty"`
+	Flag          string       `json:"flag,omitempty"`
+	Regex         string       `json:"regex,omitempty"`
+	Salt          string       `json:"salt,omitempty"`
+	Hash          string       `json:"hash,omitempty"`
+}
+
+// TrackBundleFamily is the document family of a bundle.
+type TrackBundleFamily struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// TrackBundleDocument is a document in the document family of a bundle.
+type TrackBundleDocument struct {
+	Shortname     string                 `json:"shortname"`
+	Name          string                 `json:"name"`
+	Content       string                 `json:"content"`
+	ContentFormat string                 `json:"content_format,omitempty"`
+	Sequence      *int                   `json:"sequence,omitempty"`
+	Status        content.DocumentStatus `json:"status,omitempty"`
+	PublishAt     *time.Time             `json:"publish_at,omitempty"`
+}
+
+// TrackBundleImportSummary tells what an import changed.
+type TrackBundleImportSummary struct {
+	TrackID          string `json:"track_id"`
+	TasksImported    int    `json:"tasks_imported"`
+	HintsImported    int    `json:"hints_imported"`
+	ChecksImported   int    `json:"checks_imported"`
+	FlagsImported    int    `json:"flags_imported"`
+	DocumentsChanged int    `json:"documents_changed"`
+	Pruned           int    `json:"pruned"` // Tasks, hints, checks and flags not in the bundle, if pruning
+}
+
+// TrackBundleExport is the download of a track bundle.
+type TrackBundleExport struct {
+	raw *rest.RawResponse
+}
+
+// TrackBundleImportRequest imports a track bundle from the body, as JSON or YAML depending on the content type.
+type TrackBundleImportRequest struct {
+	TrackBundleImportSummary
+}
+
+func init() {
+	rest.AddHandler("/track/", "^(?P<id>[^/]+)/bundle/$", func() interface{} { return &TrackBundleExport{} })
+	rest.AddHandler("/tracks/", "^import-bundle/$", func() interface{} { return &TrackBundleImportRequest{} })
+}
+
+// Get exports the track as a bundle.
+// Use the "format" query arg for "yaml" (default) or "json" and the "family" query arg for the document family to include (defaults to the track ID, if it exists).
+func (export *TrackBundleExport) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	trackID, trackIDExists := request.PathArgs["id"]
+	if !trackIDExists || trackID == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+	format := request.QueryArgs["format"]
+	if format == "" {
+		format = TrackBundleFormatYAML
+	}
+	if format != TrackBundleFormatYAML && format != TrackBundleFormatJSON {
+		return rest.Result{Code: 400, Message: "invalid format"}
+	}
+	familyID, familyIDExists := request.QueryArgs["family"]
+	if !familyIDExists {
+		familyID = trackID
+	}
+
+	// Get
+	bundle, err := ExportTrackBundle(trackID, familyID)
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	if bundle == nil {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+	data, err := bundle.Marshal(format)
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	export.raw = &rest.RawResponse{
+		ContentType: trackBundleContentType(format),
+		Filename:    fmt.Sprintf("%v.%v", trackID, format),
+		Data:        data,
+	}
+	return rest.Result{}
+}
+
+// RawResponse returns the bundle file.
+func (export *TrackBundleExport) RawResponse() *rest.RawResponse {
+	return export.raw
+}
+
+// Post imports the bundle and returns a summary.
+// Set the "prune" query arg to "true" to delete tasks, hints, checks and flags of the track which are not in the bundle.
+func (importRequest *TrackBundleImportRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	format := TrackBundleFormatJSON
+	if mediaType, _, err := mime.ParseMediaType(request.ContentType); err == nil && strings.HasSuffix(mediaType, "yaml") {
+		format = TrackBundleFormatYAML
+	}
+	bundle, err := UnmarshalTrackBundle(request.Body, format)
+	if err != nil {
+		return rest.Result{Code: 400, Message: fmt.Sprintf("malformed bundle: %v", err)}
+	}
+
+	// Import
+	summary, result := bundle.Import(request.QueryArgs["prune"] == "true", request.AccessToken.GetName())
+	if !result.IsOk() {
+		return result
+	}
+	importRequest.TrackBundleImportSummary = summary
+	return rest.Result{}
+}
+
+// ExportTrackBundle builds a bundle for the track, including the documents of the family (optional).
+// The bundle is nil if the track doesn't exist.
+func ExportTrackBundle(trackID string, familyID string) (*TrackBundle, error) {
+	var track Track
+	trackDBResult := db.Select(&track, "tracks", "id", "=", trackID)
+	if trackDBResult.IsFailed() {
+		return nil, trackDBResult.Error
+	}
+	if !trackDBResult.IsSuccess() {
+		return nil, nil
+	}
+
+	now := time.Now()
+	bundle := TrackBundle{
+		Version:    TrackBundleVersion,
+		ExportedAt: &now,
+		Track:      TrackBundleTrack{ID: track.ID, Type: track.Type, Name: track.Name},
+		Tasks:      make([]TrackBundleTask, 0),
+	}
+
+	// Tasks
+	var tasks Tasks
+	if dbResult := db.SelectMany(&tasks, "tasks", "track", "=", trackID); dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	dependencyMap, err := loadTaskDependencies(context.Background(), trackID)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(tasks, func(i, j int) bool {
+		if (tasks[i].Sequence == nil) != (tasks[j].Sequence == nil) {
+			return tasks[i].Sequence != nil
+		}
+		if tasks[i].Sequence != nil && *tasks[i].Sequence != *tasks[j].Sequence {
+			return *tasks[i].Sequence < *tasks[j].Sequence
+		}
+		return tasks[i].Shortname < tasks[j].Shortname
+	})
+	for _, task := range tasks {
+		bundle.Tasks = append(bundle.Tasks, TrackBundleTask{
+			Shortname:   task.Shortname,
+			Name:        task.Name,
+			Description: task.Description,
+			Sequence:    task.Sequence,
+			Points:      task.Points,
+			DependsOn:   dependencyMap[task.Shortname],
+		})
+	}
+
+	// Hints
+	var hints Hints
+	if dbResult := db.SelectMany(&hints, "hints", "track", "=", trackID); dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	hints.sort()
+	for _, hint := range hints {
+		bundle.Hints = append(bundle.Hints, TrackBundleHint{
+			Task:     hint.TaskShortname,
+			Sequence: hint.Sequence,
+			Content:  hint.Content,
+			Penalty:  hint.Penalty,
+		})
+	}
+
+	// Checks
+	var checks TaskChecks
+	if dbResult := db.SelectMany(&checks, "task_checks", "track", "=", trackID); dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	sort.SliceStable(checks, func(i, j int) bool {
+		if checks[i].TaskShortname != checks[j].TaskShortname {
+			return checks[i].TaskShortname < checks[j].TaskShortname
+		}
+		return checks[i].Shortname < checks[j].Shortname
+	})
+	for _, check := range checks {
+		bundle.Checks = append(bundle.Checks, TrackBundleCheck{
+			Task:            check.TaskShortname,
+			Shortname:       check.Shortname,
+			Name:            check.Name,
+			Description:     check.Description,
+			Sequence:        check.Sequence,
+			Enabled:         check.Enabled,
+			Kind:            check.Kind,
+			Port:            check.Port,
+			Path:            check.Path,
+			Command:         check.Command,
+			Username:        check.Username,
+			Expect:          check.Expect,
+			TimeoutSeconds:  check.TimeoutSeconds,
+			IntervalSeconds: check.IntervalSeconds,
+		})
+	}
+
+	// Flags
+	var flags TaskFlags
+	if dbResult := db.SelectMany(&flags, "task_flags", "track", "=", trackID); dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	sort.SliceStable(flags, func(i, j int) bool {
+		if flags[i].TaskShortname != flags[j].TaskShortname {
+			return flags[i].TaskShortname < flags[j].TaskShortname
+		}
+		return flags[i].Shortname < flags[j].Shortname
+	})
+	for _, flag := range flags {
+		bundle.Flags = append(bundle.Flags, TrackBundleFlag{
+			Task:          flag.TaskShortname,
+			Shortname:     flag.Shortname,
+			Name:          flag.Name,
+			Kind:          flag.Kind,
+			CaseSensitive: flag.CaseSensitive,
+			Regex:         flag.Regex,
+			Salt:          flag.Salt,
+			Hash:          flag.Hash,
+		})
+	}
+
+	// Documents
+	if familyID != "" {
+		family, documents, err := content.LoadFamily(familyID)
+		if err != nil {
+			return nil, err
+		}
+		if family != nil {
+			bundle.DocumentFamily = &TrackBundleFamily{ID: family.ID, Name: family.Name}
+			for _, document := range documents {
+				bundle.Documents = append(bundle.Documents, TrackBundleDocument{
+					Shortname:     document.Shortname,
+					Name:          document.Name,
+					Content:       document.Content,
+					ContentFormat: document.ContentFormat,
+					Sequence:      document.Sequence,
+					Status:        document.Status,
+					PublishAt:     document.PublishAt,
+				})
+			}
+		}
+	}
+
+	return &bundle, nil
+}
+
+// Marshal encodes the bundle as JSON or YAML.
+// YAML uses the same keys as JSON, by converting the JSON document (which is valid YAML) to block style.
+func (bundle *TrackBundle) Marshal(format string) ([]byte, error) {
+	jsonData, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case TrackBundleFormatJSON:
+		return append(jsonData, '\n'), nil
+	case TrackBundleFormatYAML:
+		var node yaml.Node
+		if err := yaml.Unmarshal(jsonData, &node); err != nil {
+			return nil, err
+		}
+		resetYAMLStyle(&node)
+		var buffer bytes.Buffer
+		encoder := yaml.NewEncoder(&buffer)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(&node); err != nil {
+			return nil, err
+		}
+		if err := encoder.Close(); err != nil {
+			return nil, err
+		}
+		return buffer.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unknown bundle format: %v", format)
+	}
+}
+
+// UnmarshalTrackBundle decodes a JSON or YAML bundle.
+func UnmarshalTrackBundle(data []byte, format string) (*TrackBundle, error) {
+	jsonData := data
+	switch format {
+	case TrackBundleFormatJSON:
+	case TrackBundleFormatYAML:
+		var document interface{}
+		if err := yaml.Unmarshal(data, &document); err != nil {
+			return nil, err
+		}
+		var err error
+		if jsonData, err = json.Marshal(document); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown bundle format: %v", format)
+	}
+
+	var bundle TrackBundle
+	decoder := json.NewDecoder(bytes.NewReader(jsonData))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&bundle); err != nil {
+		return nil, err
+	}
+	return &bundle, nil
+}
+
+// TrackBundleFormatFromFilename guesses the bundle format from the file extension, defaulting to YAML.
+func TrackBundleFormatFromFilename(filename string) string {
+	if strings.HasSuffix(strings.ToLower(filename), ".json") {
+		return TrackBundleFormatJSON
+	}
+	return TrackBundleFormatYAML
+}
+
+// validate checks the bundle itself, before touching the database.
+func (bundle *TrackBundle) validate() rest.Result {
+	switch {
+	case bundle.Version <= 0:
+		return rest.Result{Code: 400, Message: "missing version"}
+	case bundle.Version > TrackBundleVersion:
+		return rest.Result{Code: 400, Message: fmt.Sprintf("unsupported version %v, max is %v", bundle.Version, TrackBundleVersion)}
+	}
+	track := Track{ID: bundle.Track.ID, Type: bundle.Track.Type, Name: bundle.Track.Name}
+	if result := track.validate(); !result.IsOk() {
+		return rest.Result{Code: result.Code, Message: "track: " + result.Message}
+	}
+
+	dependencyMap := make(map[string][]string)
+	for _, task := range bundle.Tasks {
+		switch {
+		case task.Shortname == "":
+			return rest.Result{Code: 400, Message: "task: missing shortname"}
+		case task.Name == "":
+			return rest.Result{Code: 400, Message: fmt.Sprintf("task %v: missing name", task.Shortname)}
+		}
+		if _, ok := dependencyMap[task.Shortname]; ok {
+			return rest.Result{Code: 400, Message: fmt.Sprintf("task %v: duplicate shortname", task.Shortname)}
+		}
+		dependencyMap[task.Shortname] = task.DependsOn
+	}
+	for _, task := range bundle.Tasks {
+		seen := make(map[string]bool)
+		for _, dependsOn := range task.DependsOn {
+			if _, ok := dependencyMap[dependsOn]; !ok || dependsOn == task.Shortname || seen[dependsOn] {
+				return rest.Result{Code: 400, Message: fmt.Sprintf("task %v: invalid dependency %v", task.Shortname, dependsOn)}
+			}
+			seen[dependsOn] = true
+		}
+		if hasDependencyCycle(dependencyMap, task.Shortname) {
+			return rest.Result{Code: 400, Message: fmt.Sprintf("task %v: dependencies form a cycle", task.Shortname)}
+		}
+	}
+
+	hintKeys := make(map[string]bool)
+	for _, hint := range bundle.Hints {
+		key := fmt.Sprintf("%v/%v", hint.Task, hint.Sequence)
+		if hintKeys[key] {
+			return rest.Result{Code: 400, Message: fmt.Sprintf("hint %v: duplicate sequence", key)}
+		}
+		hintKeys[key] = true
+		if _, ok := dependencyMap[hint.Task]; !ok {
+			return rest.Result{Code: 400, Message: fmt.Sprintf("hint %v: unknown task", key)}
+		}
+	}
+	checkKeys := make(map[string]bool)
+	for _, check := range bundle.Checks {
+		key := check.Task + "/" + check.Shortname
+		if checkKeys[key] {
+			return rest.Result{Code: 400, Message: fmt.Sprintf("check %v: duplicate shortname", key)}
+		}
+		checkKeys[key] = true
+		if _, ok := dependencyMap[check.Task]; !ok {
+			return rest.Result{Code: 400, Message: fmt.Sprintf("check %v: unknown task", key)}
+		}
+	}
+	flagKeys := make(map[string]bool)
+	for _, flag := range bundle.Flags {
+		key := flag.Task + "/" + flag.Shortname
+		if flagKeys[key] {
+			return rest.Result{Code: 400, Message: fmt.Sprintf("flag %v: duplicate shortname", key)}
+		}
+		flagKeys[key] = true
+		if _, ok := dependencyMap[flag.Task]; !ok {
+			return rest.Result{Code: 400, Message: fmt.Sprintf("flag %v: unknown task", key)}
+		}
+	}
+	if len(bundle.Documents) > 0 && bundle.DocumentFamily == nil {
+		return rest.Result{Code: 400, Message: "documents without document family"}
+	}
+	return rest.Result{}
+}
+
+// Import creates or updates the track and everything in the bundle, matching existing entries by shortname.
+// If pruning, tasks, hints, checks and flags of the track which are not in the bundle are deleted.
+// Every entry is validated before anything is changed, and pruning only happens once everything else is imported,
+// so a failed import never deletes anything. Entries imported before a failure stay updated, and importing again is safe.
+func (bundle *TrackBundle) Import(prune bool, author string) (TrackBundleImportSummary, rest.Result) {
+	summary := TrackBundleImportSummary{TrackID: bundle.Track.ID}
+	if result := bundle.validate(); !result.IsOk() {
+		return summary, result
+	}
+	trackID := bundle.Track.ID
+
+	// Load existing entries
+	var track Track
+	if dbResult := db.Select(&track, "tracks", "id", "=", trackID); dbResult.IsFailed() {
+		return summary, rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	var existingTasks Tasks
+	if dbResult := db.SelectMany(&existingTasks, "tasks", "track", "=", trackID); dbResult.IsFailed() {
+		return summary, rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	existingTaskMap := make(map[string]*Task)
+	for _, task := range existingTasks {
+		existingTaskMap[task.Shortname] = task
+	}
+	var existingHints Hints
+	if dbResult := db.SelectMany(&existingHints, "hints", "track", "=", trackID); dbResult.IsFailed() {
+		return summary, rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	existingHintMap := make(map[string]*Hint)
+	for _, hint := range existingHints {
+		existingHintMap[fmt.Sprintf("%v/%v", hint.TaskShortname, hint.Sequence)] = hint
+	}
+	var existingChecks TaskChecks
+	if dbResult := db.SelectMany(&existingChecks, "task_checks", "track", "=", trackID); dbResult.IsFailed() {
+		return summary, rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	existingCheckMap := make(map[string]*TaskCheck)
+	for _, check := range existingChecks {
+		existingCheckMap[check.TaskShortname+"/"+check.Shortname] = check
+	}
+	var existingFlags TaskFlags
+	if dbResult := db.SelectMany(&existingFlags, "task_flags", "track", "=", trackID); dbResult.IsFailed() {
+		return summary, rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	existingFlagMap := make(map[string]*TaskFlag)
+	for _, flag := range existingFlags {
+		existingFlagMap[flag.TaskShortname+"/"+flag.Shortname] = flag
+	}
+
+	// Prepare and validate the entries before changing anything
+	tasks := make(Tasks, 0, len(bundle.Tasks))
+	for _, bundleTask := range bundle.Tasks {
+		task := Task{
+			TrackID:     trackID,
+			Shortname:   bundleTask.Shortname,
+			Name:        bundleTask.Name,
+			Description: bundleTask.Description,
+			Sequence:    bundleTask.Sequence,
+			Points:      bundleTask.Points,
+		}
+		if existing, ok := existingTaskMap[task.Shortname]; ok {
+			task.ID = existing.ID
+		} else {
+			newID := uuid.New()
+			task.ID = &newID
+		}
+		tasks = append(tasks, &task)
+	}
+	hints := make(Hints, 0, len(bundle.Hints))
+	for _, bundleHint := range bundle.Hints {
+		key := fmt.Sprintf("%v/%v", bundleHint.Task, bundleHint.Sequence)
+		hint := Hint{
+			TrackID:       trackID,
+			TaskShortname: bundleHint.Task,
+			Sequence:      bundleHint.Sequence,
+			Content:       bundleHint.Content,
+			Penalty:       bundleHint.Penalty,
+		}
+		if existing, ok := existingHintMap[key]; ok {
+			hint.ID = existing.ID
+		} else {
+			newID := uuid.New()
+			hint.ID = &newID
+		}
+		if result := hint.validateFields(); !result.IsOk() {
+			return summary, bundleEntryResult("hint "+key, result)
+		}
+		hints = append(hints, &hint)
+	}
+	checks := make(TaskChecks, 0, len(bundle.Checks))
+	for _, bundleCheck := range bundle.Checks {
+		key := bundleCheck.Task + "/" + bundleCheck.Shortname
+		check := TaskCheck{
+			TrackID:         trackID,
+			TaskShortname:   bundleCheck.Task,
+			Shortname:       bundleCheck.Shortname,
+			Name:            bundleCheck.Name,
+			Description:     bundleCheck.Description,
+			Sequence:        bundleCheck.Sequence,
+			Enabled:         bundleCheck.Enabled,
+			Kind:            bundleCheck.Kind,
+			Port:            bundleCheck.Port,
+			Path:            bundleCheck.Path,
+			Command:         bundleCheck.Command,
+			Username:        bundleCheck.Username,
+			Expect:          bundleCheck.Expect,
+			TimeoutSeconds:  bundleCheck.TimeoutSeconds,
+			IntervalSeconds: bundleCheck.IntervalSeconds,
+		}
+		if existing, ok := existingCheckMap[key]; ok {
+			check.ID = existing.ID
+		} else {
+			newID := uuid.New()
+			check.ID = &newID
+		}
+		if result := check.validateFields(); !result.IsOk() {
+			return summary, bundleEntryResult("check "+key, result)
+		}
+		checks = append(checks, &check)
+	}
+	flags := make(TaskFlags, 0, len(bundle.Flags))
+	for _, bundleFlag := range bundle.Flags {
+		key := bundleFlag.Task + "/" + bundleFlag.Shortname
+		flag := TaskFlag{
+			TrackID:       trackID,
+			TaskShortname: bundleFlag.Task,
+			Shortname:     bundleFlag.Shortname,
+			Name:          bundleFlag.Name,
+			Kind:          bundleFlag.Kind,
+			CaseSensitive: bundleFlag.CaseSensitive,
+			Flag:          bundleFlag.Flag,
+			Regex:         bundleFlag.Regex,
+			Salt:          bundleFlag.Salt,
+			Hash:          bundleFlag.Hash,
+		}
+		if existing, ok := existingFlagMap[key]; ok {
+			flag.ID = existing.ID
+		} else {
+			newID := uuid.New()
+			flag.ID = &newID
+		}
+		if err := flag.prepare(); err != nil {
+			return summary, rest.Result{Code: 500, Error: err}
+		}
+		if result := flag.validateFields(); !result.IsOk() {
+			return summary, bundleEntryResult("flag "+key, result)
+		}
+		flags = append(flags, &flag)
+	}
+
+	// Track, keeping the archive flag
+	track.ID = trackID
+	track.Type = bundle.Track.Type
+	track.Name = bundle.Track.Name
+	if result := track.createOrUpdate(); !result.IsOk() {
+		return summary, result
+	}
+
+	// Tasks, then dependencies since they may reference tasks later in the bundle
+	bundleTasks := make(map[string]bool)
+	for _, task := range tasks {
+		bundleTasks[task.Shortname] = true
+		if result := task.createOrUpdate(); !result.IsOk() {
+			return summary, bundleEntryResult("task "+task.Shortname, result)
+		}
+		summary.TasksImported++
+	}
+	for _, bundleTask := range bundle.Tasks {
+		task := Task{TrackID: trackID, Shortname: bundleTask.Shortname, DependsOn: bundleTask.DependsOn}
+		if err := task.saveDependencies(); err != nil {
+			return summary, rest.Result{Code: 500, Error: err}
+		}
+	}
+
+	// Hints
+	bundleHints := make(map[string]bool)
+	for _, hint := range hints {
+		key := fmt.Sprintf("%v/%v", hint.TaskShortname, hint.Sequence)
+		bundleHints[key] = true
+		if result := hint.validate(); !result.IsOk() {
+			return summary, bundleEntryResult("hint "+key, result)
+		}
+		var dbResult db.Result
+		if _, exists := existingHintMap[key]; exists {
+			dbResult = db.Update("hints", hint, "id", "=", hint.ID)
+		} else {
+			dbResult = db.Insert("hints", hint)
+		}
+		if dbResult.IsFailed() {
+			return summary, rest.Result{Code: 500, Error: dbResult.Error}
+		}
+		summary.HintsImported++
+	}
+
+	// Checks
+	bundleChecks := make(map[string]bool)
+	for _, check := range checks {
+		key := check.TaskShortname + "/" + check.Shortname
+		bundleChecks[key] = true
+		if result := check.validate(); !result.IsOk() {
+			return summary, bundleEntryResult("check "+key, result)
+		}
+		var dbResult db.Result
+		if _, exists := existingCheckMap[key]; exists {
+			dbResult = db.Update("task_checks", check, "id", "=", check.ID)
+		} else {
+			dbResult = db.Insert("task_checks", check)
+		}
+		if dbResult.IsFailed() {
+			return summary, rest.Result{Code: 500, Error: dbResult.Error}
+		}
+		summary.ChecksImported++
+	}
+
+	// Flags
+	bundleFlags := make(map[string]bool)
+	for _, flag := range flags {
+		key := flag.TaskShortname + "/" + flag.Shortname
+		bundleFlags[key] = true
+		if result := flag.validate(); !result.IsOk() {
+			return summary, bundleEntryResult("flag "+key, result)
+		}
+		var dbResult db.Result
+		if _, exists := existingFlagMap[key]; exists {
+			dbResult = db.Update("task_flags", flag, "id", "=", flag.ID)
+		} else {
+			dbResult = db.Insert("task_flags", flag)
+		}
+		if dbResult.IsFailed() {
+			return summary, rest.Result{Code: 500, Error: dbResult.Error}
+		}
+		summary.FlagsImported++
+	}
+
+	// Documents
+	if bundle.DocumentFamily != nil {
+		family := content.DocumentFamily{ID: bundle.DocumentFamily.ID, Name: bundle.DocumentFamily.Name}
+		var documents content.Documents
+		for _, bundleDocument := range bundle.Documents {
+			documents = append(documents, &content.Document{
+				Shortname:     bundleDocument.Shortname,
+				Name:          bundleDocument.Name,
+				Content:       bundleDocument.Content,
+				ContentFormat: bundleDocument.ContentFormat,
+				Sequence:      bundleDocument.Sequence,
+				Status:        bundleDocument.Status,
+				PublishAt:     bundleDocument.PublishAt,
+			})
+		}
+		changed, err := content.ImportFamily(&family, documents, author)
+		summary.DocumentsChanged = changed
+		if err != nil {
+			return summary, rest.Result{Code: 400, Message: fmt.Sprintf("documents: %v", err)}
+		}
+	}
+
+	// Prune only once everything else is imported
+	if !prune {
+		return summary, rest.Result{}
+	}
+	for _, task := range existingTasks {
+		if bundleTasks[task.Shortname] {
+			continue
+		}
+		if err := task.delete(); err != nil {
+			return summary, rest.Result{Code: 500, Error: err}
+		}
+		summary.Pruned++
+	}
+	for key, hint := range existingHintMap {
+		if bundleHints[key] {
+			continue
+		}
+		if dbResult := db.Delete("hints", "id", "=", hint.ID); dbResult.IsFailed() {
+			return summary, rest.Result{Code: 500, Error: dbResult.Error}
+		}
+		if dbResult := db.Delete("hint_unlocks", "hint", "=", hint.ID); dbResult.IsFailed() {
+			return summary, rest.Result{Code: 500, Error: dbResult.Error}
+		}
+		summary.Pruned++
+	}
+	for key, check := range existingCheckMap {
+		if bundleChecks[key] {
+			continue
+		}
+		if dbResult := db.Delete("task_checks", "id", "=", check.ID); dbResult.IsFailed() {
+			return summary, rest.Result{Code: 500, Error: dbResult.Error}
+		}
+		summary.Pruned++
+	}
+	for key, flag := range existingFlagMap {
+		if bundleFlags[key] {
+			continue
+		}
+		if dbResult := db.Delete("task_flags", "id", "=", flag.ID); dbResult.IsFailed() {
+			return summary, rest.Result{Code: 500, Error: dbResult.Error}
+		}
+		summary.Pruned++
+	}
+	return summary, rest.Result{}
+}
+
+// bundleEntryResult prefixes the message of a failed result with the bundle entry.
+func bundleEntryResult(entry string, result rest.Result) rest.Result {
+	if result.Message != "" {
+		result.Message = entry + ": " + result.Message
+	}
+	return result
+}
+
+func trackBundleContentType(format string) string {
+	if format == TrackBundleFormatJSON {
+		return "application/json"
+	}
+	return "application/yaml"
+}
+
+// resetYAMLStyle makes the node and its children use the default (block) style.
+func resetYAMLStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		resetYAMLStyle(child)
+	}
+}
@@ -0,0 +1,216 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+)
+
+const (
+	defaultCapacityForecastHours = 24
+	maxCapacityForecastHours     = 24 * 14
+	capacityForecastBucket       = 30 * time.Minute
+)
+
+// TrackCapacityForecast predicts when a track runs out of stations, from the scheduled timeslots, queue and waitlist.
+type TrackCapacityForecast struct {
+	TrackID        string                    `json:"track"`
+	Timestamp      *time.Time                `json:"timestamp"`       // When it was computed
+	Until          *time.Time                `json:"until"`           // End of the forecast
+	Stations       int                       `json:"stations"`        // Usable stations now (not terminated, under maintenance or suspended)
+	Capacity       int                       `json:"capacity"`        // Max concurrent timeslots, the usable stations or the soft instance limit for dynamic tracks
+	HardCapacity   int                       `json:"hard_capacity"`   // The hard instance limit for dynamic tracks, else the same as the capacity
+	Queued         int                       `json:"queued"`          // Timeslots waiting for a station now
+	Waitlisted     int                       `json:"waitlisted"`      // Registrations on the waitlist, not yet scheduled
+	Unscheduled    int                       `json:"unscheduled"`     // Timeslots without begin/end time, not yet scheduled
+	Peak           int                       `json:"peak"`            // Max concurrent demand within the forecast
+	PeakTime       *time.Time                `json:"peak_time"`       // Beginning of the first bucket with the peak
+	ShortageTime   *time.Time                `json:"shortage_time"`   // Beginning of the first bucket where demand exceeds capacity, null if none
+	ShortageAmount int                       `json:"shortage_amount"` // Missing stations at the peak, zero if none
+	Buckets        []*CapacityForecastBucket `json:"buckets"`         // Demand per 30 minutes
+}
+
+// CapacityForecastBucket is the demand within a part of the forecast.
+type CapacityForecastBucket struct {
+	BeginTime *time.Time `json:"begin_time"`
+	EndTime   *time.Time `json:"end_time"`
+	Demand    int        `json:"demand"`   // Max concurrent scheduled timeslots, plus the queue for the current bucket
+	Shortage  int        `json:"shortage"` // Demand exceeding the capacity
+}
+
+func init() {
+	rest.AddHandler("/stats/", "^capacity/(?P<track_id>[^/]+)/$", func() interface{} { return &TrackCapacityForecast{} })
+}
+
+// Get computes the capacity forecast for the track, for the next 24 hours or the "hours" query arg.
+func (forecast *TrackCapacityForecast) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if !isStaff(request.AccessToken) {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	trackID, trackIDExists := request.PathArgs["track_id"]
+	if !trackIDExists || trackID == "" {
+		return rest.Result{Code: 400, Message: "missing track ID"}
+	}
+	var track Track
+	trackDBResult := db.Select(&track, "tracks", "id", "=", trackID)
+	if trackDBResult.IsFailed() {
+		return rest.Result{Code: 500, Error: trackDBResult.Error}
+	}
+	if !trackDBResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "track not found"}
+	}
+	hours := defaultCapacityForecastHours
+	if rawHours, ok := request.QueryArgs["hours"]; ok {
+		parsedHours, err := strconv.Atoi(rawHours)
+		if err != nil || parsedHours <= 0 || parsedHours > maxCapacityForecastHours {
+			return rest.Result{Code: 400, Message: "invalid hours"}
+		}
+		hours = parsedHours
+	}
+
+	// Get
+	now := time.Now()
+	var stations Stations
+	if dbResult := db.SelectMany(&stations, "stations", "track", "=", track.ID); dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	var timeslots Timeslots
+	if dbResult := db.SelectMany(&timeslots, "timeslots", "track", "=", track.ID); dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	var queued int
+	if err := db.DB.QueryRow("SELECT COUNT(*) FROM queue_entries WHERE track = $1 AND status = $2", track.ID, QueueEntryStatusWaiting).Scan(&queued); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	var waitlisted int
+	if err := db.DB.QueryRow("SELECT COUNT(*) FROM registrations WHERE track = $1 AND status = $2", track.ID, RegistrationStatusWaitlisted).Scan(&waitlisted); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+
+	// Compute
+	forecast.TrackID = track.ID
+	forecast.Timestamp = &now
+	for _, station := range stations {
+		if station.Status != StationStatusTerminated && !station.isUnderMaintenance(now) && !station.isSuspended() {
+			forecast.Stations++
+		}
+	}
+	forecast.Capacity = forecast.Stations
+	forecast.HardCapacity = forecast.Stations
+	if softLimit, hardLimit, ok := track.behavior().instanceLimits(track.ID); ok {
+		forecast.Capacity = softLimit
+		forecast.HardCapacity = hardLimit
+	}
+	forecast.Queued = queued
+	forecast.Waitlisted = waitlisted
+	for _, timeslot := range timeslots {
+		if timeslot.BeginTime == nil {
+			forecast.Unscheduled++
+		}
+	}
+	until := now.Add(time.Duration(hours) * time.Hour)
+	forecast.Until = &until
+	forecast.Buckets = forecastCapacityBuckets(timeslots, queued, forecast.Capacity, now, until, capacityForecastBucket)
+	for _, bucket := range forecast.Buckets {
+		if bucket.Demand > forecast.Peak {
+			forecast.Peak = bucket.Demand
+			forecast.PeakTime = bucket.BeginTime
+		}
+		if bucket.Shortage > 0 && forecast.ShortageTime == nil {
+			forecast.ShortageTime = bucket.BeginTime
+		}
+	}
+	if forecast.Peak > forecast.Capacity {
+		forecast.ShortageAmount = forecast.Peak - forecast.Capacity
+	}
+	return rest.Result{}
+}
+
+// forecastCapacityBuckets splits the time into buckets with the max concurrent scheduled timeslots within each.
+// The queue counts as demand in the first bucket, since it's waiting for stations now.
+func forecastCapacityBuckets(timeslots Timeslots, queued int, capacity int, begin time.Time, end time.Time, bucketSize time.Duration) []*CapacityForecastBucket {
+	buckets := make([]*CapacityForecastBucket, 0)
+	for bucketBegin := begin; bucketBegin.Before(end); bucketBegin = bucketBegin.Add(bucketSize) {
+		bucketBeginCopy := bucketBegin
+		bucketEnd := bucketBegin.Add(bucketSize)
+		if bucketEnd.After(end) {
+			bucketEnd = end
+		}
+		bucket := CapacityForecastBucket{
+			BeginTime: &bucketBeginCopy,
+			EndTime:   &bucketEnd,
+			Demand:    maxConcurrentTimeslots(timeslots, bucketBeginCopy, bucketEnd),
+		}
+		if len(buckets) == 0 {
+			bucket.Demand += queued
+		}
+		if bucket.Demand > capacity {
+			bucket.Shortage = bucket.Demand - capacity
+		}
+		buckets = append(buckets, &bucket)
+	}
+	return buckets
+}
+
+// maxConcurrentTimeslots finds the max number of scheduled timeslots overlapping at any time within the interval.
+func maxConcurrentTimeslots(timeslots Timeslots, begin time.Time, end time.Time) int {
+	type change struct {
+		time  time.Time
+		delta int
+	}
+	var changes []change
+	for _, timeslot := range timeslots {
+		if timeslot.BeginTime == nil || timeslot.EndTime == nil {
+			continue
+		}
+		if !timeslot.BeginTime.Before(end) || !timeslot.EndTime.After(begin) {
+			continue
+		}
+		changeBegin := *timeslot.BeginTime
+		if changeBegin.Before(begin) {
+			changeBegin = begin
+		}
+		changes = append(changes, change{changeBegin, 1}, change{*timeslot.EndTime, -1})
+	}
+	// Ends before begins at the same time, since back-to-back timeslots may share a station
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].time.Equal(changes[j].time) {
+			return changes[i].delta < changes[j].delta
+		}
+		return changes[i].time.Before(changes[j].time)
+	})
+	current, peak := 0, 0
+	for _, c := range changes {
+		current += c.delta
+		if current > peak {
+			peak = current
+		}
+	}
+	return peak
+}
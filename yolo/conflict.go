@@ -0,0 +1,231 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// TimeslotConflictReason is why two timeslots conflict.
+type TimeslotConflictReason string
+
+const (
+	// TimeslotConflictReasonUser means a participant (user or team member) is in both timeslots.
+	TimeslotConflictReasonUser TimeslotConflictReason = "user"
+	// TimeslotConflictReasonStation means both timeslots use the same station.
+	TimeslotConflictReasonStation TimeslotConflictReason = "station"
+)
+
+// TimeslotConflict is another timeslot overlapping in time with the one being saved.
+type TimeslotConflict struct {
+	TimeslotID *uuid.UUID             `json:"timeslot"`
+	TrackID    string                 `json:"track"`
+	BeginTime  *time.Time             `json:"begin_time"`
+	EndTime    *time.Time             `json:"end_time"`
+	Reason     TimeslotConflictReason `json:"reason"`
+}
+
+// checkConflicts returns a 409 result listing the conflicting timeslots, if any.
+// Timeslots without begin and end times never conflict.
+func (timeslot *Timeslot) checkConflicts() rest.Result {
+	conflicts, err := timeslot.findConflicts()
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	if len(conflicts) == 0 {
+		return rest.Result{}
+	}
+	first := conflicts[0]
+	return rest.Result{
+		Code: 409,
+		Message: fmt.Sprintf("overlaps with timeslot %v (%v to %v) using the same %v",
+			first.TimeslotID, first.BeginTime.Format(time.RFC3339), first.EndTime.Format(time.RFC3339), first.Reason),
+		Details: conflicts,
+	}
+}
+
+// findConflicts finds other unfinished timeslots overlapping in time which share a participant or the station.
+// The participants and stations of the overlapping timeslots are loaded in batches.
+func (timeslot *Timeslot) findConflicts() ([]TimeslotConflict, error) {
+	if timeslot.BeginTime == nil || timeslot.EndTime == nil {
+		return nil, nil
+	}
+
+	var overlapping Timeslots
+	dbResult := db.SelectMany(&overlapping, "timeslots",
+		"id", "!=", timeslot.ID,
+		"begin_time", "<", timeslot.EndTime,
+		"end_time", ">", timeslot.BeginTime,
+		"state", "IN", unfinishedTimeslotStates,
+	)
+	if dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	if len(overlapping) == 0 {
+		return nil, nil
+	}
+
+	participantIDs, err := timeslot.participantIDs()
+	if err != nil {
+		return nil, err
+	}
+	participants := make(map[uuid.UUID]bool)
+	for _, participantID := range participantIDs {
+		participants[participantID] = true
+	}
+	stationID, err := timeslot.stationID()
+	if err != nil {
+		return nil, err
+	}
+	teamMemberIDs, err := loadTeamMemberIDs(overlapping)
+	if err != nil {
+		return nil, err
+	}
+	var otherStationIDs map[string]string
+	if stationID != "" {
+		if otherStationIDs, err = loadTimeslotStationIDs(overlapping); err != nil {
+			return nil, err
+		}
+	}
+
+	conflicts := make([]TimeslotConflict, 0)
+	for _, other := range overlapping {
+		conflict := TimeslotConflict{
+			TimeslotID: other.ID,
+			TrackID:    other.TrackID,
+			BeginTime:  other.BeginTime,
+			EndTime:    other.EndTime,
+		}
+
+		otherParticipantIDs := make([]uuid.UUID, 0)
+		if other.UserID != nil {
+			otherParticipantIDs = append(otherParticipantIDs, *other.UserID)
+		}
+		if other.TeamID != nil {
+			otherParticipantIDs = append(otherParticipantIDs, teamMemberIDs[*other.TeamID]...)
+		}
+		for _, participantID := range otherParticipantIDs {
+			if participants[participantID] {
+				conflict.Reason = TimeslotConflictReasonUser
+				break
+			}
+		}
+		if conflict.Reason == "" && stationID != "" && otherStationIDs[other.ID.String()] == stationID {
+			conflict.Reason = TimeslotConflictReasonStation
+		}
+
+		if conflict.Reason != "" {
+			conflicts = append(conflicts, conflict)
+		}
+	}
+	return conflicts, nil
+}
+
+// loadTeamMemberIDs gets the members of the teams of the timeslots, by team.
+func loadTeamMemberIDs(timeslots Timeslots) (map[uuid.UUID][]uuid.UUID, error) {
+	teamIDs := make([]string, 0)
+	for _, timeslot := range timeslots {
+		if timeslot.TeamID != nil {
+			teamIDs = append(teamIDs, timeslot.TeamID.String())
+		}
+	}
+	memberIDs := make(map[uuid.UUID][]uuid.UUID)
+	if len(teamIDs) == 0 {
+		return memberIDs, nil
+	}
+	var members TeamMembers
+	dbResult := db.SelectMany(&members, "team_members", "team", "IN", teamIDs)
+	if dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	for _, member := range members {
+		memberIDs[*member.TeamID] = append(memberIDs[*member.TeamID], *member.UserID)
+	}
+	return memberIDs, nil
+}
+
+// loadTimeslotStationIDs gets the stations of the timeslots like stationID, by timeslot ID.
+func loadTimeslotStationIDs(timeslots Timeslots) (map[string]string, error) {
+	timeslotIDs := make([]string, 0, len(timeslots))
+	for _, timeslot := range timeslots {
+		timeslotIDs = append(timeslotIDs, timeslot.ID.String())
+	}
+	stationIDs := make(map[string]string)
+
+	// Last assigned first, so the currently bound ones replace them
+	assignmentRows, err := db.DB.Query("SELECT DISTINCT ON (timeslot) timeslot, station FROM station_assignments WHERE timeslot = ANY($1) AND action = $2 ORDER BY timeslot, timestamp DESC",
+		pq.Array(timeslotIDs), StationAssignmentActionAssign)
+	if err != nil {
+		return nil, err
+	}
+	defer assignmentRows.Close()
+	for assignmentRows.Next() {
+		var timeslotID, stationID string
+		if err := assignmentRows.Scan(&timeslotID, &stationID); err != nil {
+			return nil, err
+		}
+		stationIDs[timeslotID] = stationID
+	}
+	if err := assignmentRows.Err(); err != nil {
+		return nil, err
+	}
+
+	stationRows, err := db.DB.Query("SELECT timeslot, id FROM stations WHERE timeslot = ANY($1)", pq.Array(timeslotIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer stationRows.Close()
+	for stationRows.Next() {
+		var timeslotID, stationID string
+		if err := stationRows.Scan(&timeslotID, &stationID); err != nil {
+			return nil, err
+		}
+		stationIDs[timeslotID] = stationID
+	}
+	return stationIDs, stationRows.Err()
+}
+
+// stationID returns the station currently bound to the timeslot, or else the last one assigned to it, or empty if none.
+func (timeslot *Timeslot) stationID() (string, error) {
+	var stationID string
+	row := db.DB.QueryRow("SELECT id FROM stations WHERE timeslot = $1", timeslot.ID.String())
+	err := row.Scan(&stationID)
+	if err == nil {
+		return stationID, nil
+	} else if err != sql.ErrNoRows {
+		return "", err
+	}
+
+	row = db.DB.QueryRow("SELECT station FROM station_assignments WHERE timeslot = $1 AND action = $2 ORDER BY timestamp DESC LIMIT 1",
+		timeslot.ID.String(), StationAssignmentActionAssign)
+	err = row.Scan(&stationID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return stationID, err
+}
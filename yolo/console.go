@@ -0,0 +1,384 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/provision"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	defaultConsoleRecordingDirectory = "console-recordings"
+	defaultConsoleMaxDuration        = 4 * time.Hour
+	consoleDialTimeout               = 10 * time.Second
+	consoleBufferSize                = 32 * 1024
+)
+
+// Directions in console recordings.
+const (
+	consoleDirectionClient  byte = 'c' // From the client to the station
+	consoleDirectionStation byte = 's' // From the station to the client
+)
+
+// ConsoleSession is a (finished or ongoing) console proxy session for a station.
+type ConsoleSession struct {
+	ID         *uuid.UUID `column:"id" json:"id"`
+	StationID  *uuid.UUID `column:"station" json:"station"`
+	TimeslotID string     `column:"timeslot" json:"timeslot"` // Timeslot assigned to the station at the time, if any
+	UserID     *uuid.UUID `column:"user" json:"user"`         // User who connected, if a user token
+	Actor      string     `column:"actor" json:"actor"`       // Name of the user/token who connected
+	Address    string     `column:"address" json:"address"`   // Console address which was proxied to
+	StartTime  *time.Time `column:"start_time" json:"start_time"`
+	EndTime    *time.Time `column:"end_time" json:"end_time"`   // Null while ongoing
+	BytesIn    int64      `column:"bytes_in" json:"bytes_in"`   // From the client
+	BytesOut   int64      `column:"bytes_out" json:"bytes_out"` // To the client
+}
+
+// ConsoleSessions is a list of console sessions.
+type ConsoleSessions []*ConsoleSession
+
+// ConsoleSessionRecording is the recording of a console session, for downloading.
+type ConsoleSessionRecording struct {
+	session ConsoleSession
+	data    []byte
+}
+
+// StationConsoleRequest is a WebSocket request to connect to the console of a station.
+type StationConsoleRequest struct{}
+
+// consoleRecorder writes both directions of a session to a file, see the API docs for the format.
+type consoleRecorder struct {
+	file *os.File
+	lock sync.Mutex
+}
+
+func init() {
+	rest.AddHandler("/station/", "^(?P<id>[^/]+)/console/$", func() interface{} { return &StationConsoleRequest{} })
+	rest.AddHandler("/console-sessions/", "^$", func() interface{} { return &ConsoleSessions{} })
+	rest.AddHandler("/console-session/", "^(?P<id>[^/]+)/recording/$", func() interface{} { return &ConsoleSessionRecording{} })
+}
+
+// Stream checks that the token may use the console of the station and returns the WebSocket proxy for it.
+// The session is recorded and fails if it can't be.
+func (consoleRequest *StationConsoleRequest) Stream(request *rest.Request) (http.Handler, rest.Result) {
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return nil, rest.Result{Code: 400, Message: "missing ID"}
+	}
+	var station Station
+	stationDBResult := db.Select(&station, "stations", "id", "=", id)
+	if stationDBResult.IsFailed() {
+		return nil, rest.Result{Code: 500, Error: stationDBResult.Error}
+	}
+	if !stationDBResult.IsSuccess() {
+		return nil, rest.Result{Code: 404, Message: "not found"}
+	}
+
+	// Check perms
+	if result := station.checkParticipantPerms(request.AccessToken); !result.IsOk() {
+		return nil, result
+	}
+
+	// Find console
+	address, result := station.consoleAddress()
+	if !result.IsOk() {
+		return nil, result
+	}
+
+	// Start session and recording
+	sessionID := uuid.New()
+	now := time.Now()
+	session := ConsoleSession{
+		ID:         &sessionID,
+		StationID:  station.ID,
+		TimeslotID: station.TimeslotID,
+		UserID:     request.AccessToken.OwnerUserID,
+		Actor:      request.AccessToken.GetName(),
+		Address:    address,
+		StartTime:  &now,
+	}
+	recorder, err := newConsoleRecorder(sessionID)
+	if err != nil {
+		return nil, rest.Result{Code: 500, Error: err}
+	}
+	if dbResult := db.Insert("console_sessions", session); dbResult.IsFailed() {
+		recorder.close()
+		return nil, rest.Result{Code: 500, Error: dbResult.Error}
+	}
+
+	server := websocket.Server{
+		Handshake: consoleHandshake,
+		Handler: func(conn *websocket.Conn) {
+			// Sessions are long-lived, unlike the requests the server timeouts are meant for
+			conn.SetDeadline(time.Time{})
+			session.proxy(conn, recorder)
+		},
+	}
+	return http.HandlerFunc(func(httpWriter http.ResponseWriter, httpRequest *http.Request) {
+		defer session.finish(recorder)
+		server.ServeHTTP(httpWriter, httpRequest)
+	}), rest.Result{}
+}
+
+// Get gets the console sessions, newest first.
+func (sessions *ConsoleSessions) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params, prep filtering
+	var whereArgs []interface{}
+	if stationID, ok := request.QueryArgs["station"]; ok {
+		whereArgs = append(whereArgs, "station", "=", stationID)
+	}
+	if timeslotID, ok := request.QueryArgs["timeslot"]; ok {
+		whereArgs = append(whereArgs, "timeslot", "=", timeslotID)
+	}
+	if userID, ok := request.QueryArgs["user"]; ok {
+		whereArgs = append(whereArgs, "user", "=", userID)
+	}
+
+	// Get
+	dbResult := db.SelectMany(sessions, "console_sessions", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	sort.SliceStable(*sessions, func(i, j int) bool {
+		return (*sessions)[i].StartTime.After(*(*sessions)[j].StartTime)
+	})
+	return rest.Result{}
+}
+
+// Get gets the recording of a console session.
+func (recording *ConsoleSessionRecording) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+
+	// Get
+	dbResult := db.Select(&recording.session, "console_sessions", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+	data, err := os.ReadFile(consoleRecordingPath(*recording.session.ID))
+	if os.IsNotExist(err) {
+		return rest.Result{Code: 404, Message: "recording not found"}
+	}
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	recording.data = data
+	return rest.Result{}
+}
+
+// RawResponse returns the recording for downloading.
+func (recording *ConsoleSessionRecording) RawResponse() *rest.RawResponse {
+	return &rest.RawResponse{
+		Filename: fmt.Sprintf("console-%v.rec", recording.session.ID),
+		Data:     recording.data,
+	}
+}
+
+// consoleAddress gets the TCP address of the console, either set on the station or from the provisioner.
+func (station *Station) consoleAddress() (string, rest.Result) {
+	if station.ConsoleAddress != "" {
+		return station.ConsoleAddress, rest.Result{}
+	}
+	if station.Status == StationStatusTerminated {
+		return "", rest.Result{Code: 400, Message: "station is terminated"}
+	}
+	provisioner, err := provision.Get(station.TrackID)
+	if err == provision.ErrNotConfigured {
+		return "", rest.Result{Code: 400, Message: "station has no console"}
+	}
+	if err != nil {
+		return "", rest.Result{Code: 500, Error: err}
+	}
+	consoleProvider, ok := provisioner.(provision.ConsoleProvider)
+	if !ok {
+		return "", rest.Result{Code: 400, Message: "station has no console"}
+	}
+	address, err := consoleProvider.Console(station.instanceID())
+	if err != nil {
+		return "", rest.Result{Code: 500, Error: err}
+	}
+	return address, rest.Result{}
+}
+
+// consoleHandshake accepts any origin, since the token is checked, and picks the "binary" subprotocol if offered (for websockify clients like noVNC).
+func consoleHandshake(wsConfig *websocket.Config, httpRequest *http.Request) error {
+	protocols := wsConfig.Protocol
+	wsConfig.Protocol = nil
+	for _, protocol := range protocols {
+		if protocol == "binary" {
+			wsConfig.Protocol = []string{protocol}
+		}
+	}
+	return nil
+}
+
+// proxy copies data both ways between the WebSocket and the console until either side closes or the max duration is reached.
+func (session *ConsoleSession) proxy(wsConn *websocket.Conn, recorder *consoleRecorder) {
+	wsConn.PayloadType = websocket.BinaryFrame
+	logger := log.WithFields(log.Fields{
+		"session": session.ID,
+		"station": session.StationID,
+		"actor":   session.Actor,
+	})
+
+	consoleConn, err := net.DialTimeout("tcp", session.Address, consoleDialTimeout)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to connect to station console")
+		websocket.Message.Send(wsConn, fmt.Sprintf("failed to connect to console: %v", err))
+		return
+	}
+	defer consoleConn.Close()
+	logger.Info("Console session started")
+
+	maxDuration := defaultConsoleMaxDuration
+	if config.Config.Consoles.MaxDurationSeconds > 0 {
+		maxDuration = time.Duration(config.Config.Consoles.MaxDurationSeconds) * time.Second
+	}
+	deadline := time.Now().Add(maxDuration)
+	wsConn.SetDeadline(deadline)
+	consoleConn.SetDeadline(deadline)
+
+	// Closing both ends stops the other copier
+	var waitGroup sync.WaitGroup
+	waitGroup.Add(2)
+	go func() {
+		defer waitGroup.Done()
+		session.BytesIn = recorder.copy(consoleConn, wsConn, consoleDirectionClient)
+		consoleConn.Close()
+		wsConn.Close()
+	}()
+	go func() {
+		defer waitGroup.Done()
+		session.BytesOut = recorder.copy(wsConn, consoleConn, consoleDirectionStation)
+		consoleConn.Close()
+		wsConn.Close()
+	}()
+	waitGroup.Wait()
+	logger.Info("Console session ended")
+}
+
+// finish closes the recording and saves the end of the session.
+func (session *ConsoleSession) finish(recorder *consoleRecorder) {
+	recorder.close()
+	now := time.Now()
+	session.EndTime = &now
+	if dbResult := db.Update("console_sessions", session, "id", "=", session.ID); dbResult.IsFailed() {
+		log.WithError(dbResult.Error).WithField("session", session.ID).Warn("Failed to save end of console session")
+	}
+}
+
+func consoleRecordingPath(sessionID uuid.UUID) string {
+	directory := config.Config.Consoles.RecordingDirectory
+	if directory == "" {
+		directory = defaultConsoleRecordingDirectory
+	}
+	return filepath.Join(directory, sessionID.String()+".rec")
+}
+
+func newConsoleRecorder(sessionID uuid.UUID) (*consoleRecorder, error) {
+	path := consoleRecordingPath(sessionID)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &consoleRecorder{file: file}, nil
+}
+
+// copy copies from src to dst until either fails, recording everything, and returns the number of bytes copied.
+func (recorder *consoleRecorder) copy(dst io.Writer, src io.Reader, direction byte) int64 {
+	var total int64
+	buffer := make([]byte, consoleBufferSize)
+	for {
+		n, readErr := src.Read(buffer)
+		if n > 0 {
+			recorder.record(direction, buffer[:n])
+			if _, err := dst.Write(buffer[:n]); err != nil {
+				return total
+			}
+			total += int64(n)
+		}
+		if readErr != nil {
+			return total
+		}
+	}
+}
+
+// record writes a record of the data, prefixed by the time (Unix nanoseconds, 8 bytes), direction (1 byte) and length (4 bytes).
+func (recorder *consoleRecorder) record(direction byte, data []byte) {
+	header := make([]byte, 13)
+	binary.BigEndian.PutUint64(header[0:8], uint64(time.Now().UnixNano()))
+	header[8] = direction
+	binary.BigEndian.PutUint32(header[9:13], uint32(len(data)))
+
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	if _, err := recorder.file.Write(header); err != nil {
+		log.WithError(err).Warn("Failed to write console recording")
+		return
+	}
+	if _, err := recorder.file.Write(data); err != nil {
+		log.WithError(err).Warn("Failed to write console recording")
+	}
+}
+
+func (recorder *consoleRecorder) close() {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	if err := recorder.file.Close(); err != nil {
+		log.WithError(err).Warn("Failed to close console recording")
+	}
+}
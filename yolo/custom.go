@@ -21,28 +21,35 @@ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
 package yolo
 
 import (
+	"context"
 	"database/sql"
+	"time"
 
+	"github.com/gathering/tech-online-backend/config"
 	"github.com/gathering/tech-online-backend/db"
 	"github.com/gathering/tech-online-backend/rest"
 	"github.com/google/uuid"
+	"golang.org/x/sync/errgroup"
 )
 
 // TrackStations consists of all stations for a track.
 type TrackStations struct {
-	ID       string    `json:"id"`
-	Type     TrackType `json:"type"`
-	Name     string    `json:"name"`
-	Stations Stations  `json:"stations"`
+	ID       string          `json:"id"`
+	Type     TrackType       `json:"type"`
+	Name     string          `json:"name"`
+	OnDuty   OnDutyOperators `json:"on_duty"` // Operators currently on shift for the track
+	Stations Stations        `json:"stations"`
 }
 
 // StationTasksTests consists of all tasks and tests for a track and station.
 type StationTasksTests struct {
-	ID               string                   `json:"id"`
-	Type             TrackType                `json:"type"`
-	Name             string                   `json:"name"`
-	StationShortname string                   `json:"station_shortname"`
-	Tasks            []*stationTasksTestsTask `json:"tasks"`
+	ID               string                    `json:"id"`
+	Type             TrackType                 `json:"type"`
+	Name             string                    `json:"name"`
+	StationShortname string                    `json:"station_shortname"`
+	Maintenance      *StationMaintenanceNotice `json:"maintenance,omitempty"` // If the station is under maintenance
+	OnDuty           OnDutyOperators           `json:"on_duty"`               // Operators to ping for help
+	Tasks            []*stationTasksTestsTask  `json:"tasks"`
 }
 
 type stationTasksTestsTask struct {
@@ -51,6 +58,9 @@ type stationTasksTestsTask struct {
 	Name        string     `json:"name"`
 	Description string     `json:"description"`
 	Sequence    *int       `json:"sequence"`
+	Points      int        `json:"points"`
+	DependsOn   []string   `json:"depends_on"`
+	Locked      bool       `json:"locked,omitempty"` // If the dependencies are not passed yet, on tracks with task unlocking
 	Tests       []Test     `json:"tests"`
 }
 
@@ -59,6 +69,23 @@ func init() {
 	rest.AddHandler("/custom/station-tasks-tests/", "^(?P<track_id>[^/]+)/(?P<station_shortname>[^/]+)/$", func() interface{} { return &StationTasksTests{} })
 }
 
+// queryTimeout returns the timeout for each of the concurrent queries of the aggregate endpoints.
+func queryTimeout() time.Duration {
+	if config.Config.QueryTimeoutSeconds > 0 {
+		return time.Duration(config.Config.QueryTimeoutSeconds) * time.Second
+	}
+	return 10 * time.Second
+}
+
+// withQueryTimeout wraps a query for an errgroup, giving it its own context with the query timeout.
+func withQueryTimeout(ctx context.Context, query func(ctx context.Context) error) func() error {
+	return func() error {
+		queryCtx, cancel := context.WithTimeout(ctx, queryTimeout())
+		defer cancel()
+		return query(queryCtx)
+	}
+}
+
 // Get creates a a big mess of data consisting of a track and all non-terminated stations for it.
 func (trackAndStations *TrackStations) Get(request *rest.Request) rest.Result {
 	trackID, trackIDExists := request.PathArgs["track_id"]
@@ -66,31 +93,55 @@ func (trackAndStations *TrackStations) Get(request *rest.Request) rest.Result {
 		return rest.Result{Code: 400, Message: "missing track ID"}
 	}
 
-	// Scan track
+	// The queries are independent, so run them concurrently
+	now := time.Now()
 	var track Track
-	trackRow := db.DB.QueryRow("SELECT id,type,name FROM tracks WHERE id = $1", trackID)
-	trackErr := trackRow.Scan(&track.ID, &track.Type, &track.Name)
-	if trackErr == sql.ErrNoRows {
+	trackFound := true
+	group, groupCtx := errgroup.WithContext(request.Context())
+
+	// Scan track
+	group.Go(withQueryTimeout(groupCtx, func(ctx context.Context) error {
+		trackRow := db.DB.QueryRowContext(ctx, "SELECT id,type,name FROM tracks WHERE id = $1", trackID)
+		trackErr := trackRow.Scan(&track.ID, &track.Type, &track.Name)
+		if trackErr == sql.ErrNoRows {
+			trackFound = false
+			return nil
+		}
+		return trackErr
+	}))
+
+	// Scan stations
+	group.Go(withQueryTimeout(groupCtx, func(ctx context.Context) error {
+		return db.SelectManyContext(ctx, &trackAndStations.Stations, "stations",
+			"track", "=", trackID,
+			"status", "!=", StationStatusTerminated,
+		).Error
+	}))
+
+	// Scan on-duty operators
+	group.Go(withQueryTimeout(groupCtx, func(ctx context.Context) error {
+		onDuty, onDutyErr := findOnDutyOperators(ctx, trackID, true, now)
+		trackAndStations.OnDuty = onDuty
+		return onDutyErr
+	}))
+
+	if err := group.Wait(); err != nil {
+		return rest.Result{Error: err}
+	}
+	if !trackFound {
+		*trackAndStations = TrackStations{}
 		return rest.Result{}
-	} else if trackErr != nil {
-		return rest.Result{Error: trackErr}
 	}
 	trackAndStations.ID = track.ID
 	trackAndStations.Type = track.Type
 	trackAndStations.Name = track.Name
 
-	// Scan stations
-	dbResult := db.SelectMany(&trackAndStations.Stations, "stations",
-		"track", "=", track.ID,
-		"status", "!=", StationStatusTerminated,
-	)
-	if dbResult.IsFailed() {
-		return rest.Result{Error: dbResult.Error}
-	}
-
 	// Hide station credentials
 	for _, station := range trackAndStations.Stations {
 		station.Credentials = ""
+		station.BMCAddress = ""
+		station.BMCCredentials = ""
+		station.UnderMaintenance = station.isUnderMaintenance(now)
 	}
 
 	return rest.Result{}
@@ -107,53 +158,97 @@ func (t4 *StationTasksTests) Get(request *rest.Request) rest.Result {
 		return rest.Result{Code: 400, Message: "missing station shortname"}
 	}
 
-	// Scan track
+	// The queries are independent, so run them concurrently
 	var track Track
-	trackRow := db.DB.QueryRow("SELECT id,type,name FROM tracks WHERE id = $1", trackID)
-	trackErr := trackRow.Scan(&track.ID, &track.Type, &track.Name)
-	if trackErr == sql.ErrNoRows {
-		return rest.Result{}
-	}
-	if trackErr != nil {
-		return rest.Result{Error: trackErr}
-	}
-
-	// Scan tasks
+	trackFound := false
 	tasks := make([]Task, 0)
-	tasksRows, tasksQueryErr := db.DB.Query("SELECT id,track,shortname,name,description,sequence FROM tasks WHERE track = $1 ORDER BY sequence ASC", trackID)
-	if tasksQueryErr != nil {
-		return rest.Result{Error: tasksQueryErr}
-	}
-	defer func() {
-		tasksRows.Close()
-	}()
-	for tasksRows.Next() {
-		var task Task
-		rowErr := tasksRows.Scan(&task.ID, &task.TrackID, &task.Shortname, &task.Name, &task.Description, &task.Sequence)
-		if rowErr != nil {
-			return rest.Result{Error: rowErr}
+	tests := make([]Test, 0)
+	var station Station
+	stationFound := false
+	var onDuty OnDutyOperators
+	var dependencyMap map[string][]string
+	group, groupCtx := errgroup.WithContext(request.Context())
+
+	// Scan track and tasks (joined, the task columns are null if the track has no tasks)
+	group.Go(withQueryTimeout(groupCtx, func(ctx context.Context) error {
+		tasksRows, tasksQueryErr := db.DB.QueryContext(ctx, "SELECT tracks.id,tracks.type,tracks.name,"+
+			"tasks.id,COALESCE(tasks.shortname,''),COALESCE(tasks.name,''),COALESCE(tasks.description,''),tasks.sequence,COALESCE(tasks.points,0) "+
+			"FROM tracks LEFT JOIN tasks ON tasks.track = tracks.id WHERE tracks.id = $1 ORDER BY tasks.sequence ASC", trackID)
+		if tasksQueryErr != nil {
+			return tasksQueryErr
 		}
-		tasks = append(tasks, task)
-	}
+		defer func() {
+			tasksRows.Close()
+		}()
+		for tasksRows.Next() {
+			var task Task
+			rowErr := tasksRows.Scan(&track.ID, &track.Type, &track.Name, &task.ID, &task.Shortname, &task.Name, &task.Description, &task.Sequence, &task.Points)
+			if rowErr != nil {
+				return rowErr
+			}
+			trackFound = true
+			if task.ID != nil {
+				task.TrackID = track.ID
+				tasks = append(tasks, task)
+			}
+		}
+		return tasksRows.Err()
+	}))
 
 	// Scan tests
-	tests := make([]Test, 0)
-	testsRows, testsQueryErr := db.DB.Query("SELECT id,track,task_shortname,shortname,station_shortname,timeslot,name,description,sequence,timestamp,status_success,status_description FROM tests WHERE track = $1 AND station_shortname = $2 AND timeslot = '' ORDER BY sequence ASC",
-		trackID, stationShortname)
-	if testsQueryErr != nil {
-		return rest.Result{Error: testsQueryErr}
-	}
-	defer func() {
-		testsRows.Close()
-	}()
-	for testsRows.Next() {
-		var test Test
-		rowErr := testsRows.Scan(&test.ID, &test.TrackID, &test.TaskShortname, &test.Shortname, &test.StationShortname, &test.TimeslotID, &test.Name, &test.Description, &test.Sequence, &test.Timestamp, &test.StatusSuccess, &test.StatusDescription)
-		if rowErr != nil {
-			return rest.Result{Error: rowErr}
+	group.Go(withQueryTimeout(groupCtx, func(ctx context.Context) error {
+		testsRows, testsQueryErr := db.DB.QueryContext(ctx, "SELECT id,track,task_shortname,shortname,station_shortname,timeslot,name,description,sequence,timestamp,status_success,status_description FROM tests WHERE track = $1 AND station_shortname = $2 AND timeslot = '' ORDER BY sequence ASC",
+			trackID, stationShortname)
+		if testsQueryErr != nil {
+			return testsQueryErr
 		}
-		tests = append(tests, test)
+		defer func() {
+			testsRows.Close()
+		}()
+		for testsRows.Next() {
+			var test Test
+			rowErr := testsRows.Scan(&test.ID, &test.TrackID, &test.TaskShortname, &test.Shortname, &test.StationShortname, &test.TimeslotID, &test.Name, &test.Description, &test.Sequence, &test.Timestamp, &test.StatusSuccess, &test.StatusDescription)
+			if rowErr != nil {
+				return rowErr
+			}
+			tests = append(tests, test)
+		}
+		return testsRows.Err()
+	}))
+
+	// Scan station, for maintenance
+	group.Go(withQueryTimeout(groupCtx, func(ctx context.Context) error {
+		stationDBResult := db.SelectContext(ctx, &station, "stations", "track", "=", trackID, "shortname", "=", stationShortname)
+		stationFound = stationDBResult.IsSuccess()
+		return stationDBResult.Error
+	}))
+
+	// Scan on-duty operators
+	group.Go(withQueryTimeout(groupCtx, func(ctx context.Context) error {
+		var onDutyErr error
+		onDuty, onDutyErr = findOnDutyOperators(ctx, trackID, true, time.Now())
+		return onDutyErr
+	}))
+
+	// Scan dependencies
+	group.Go(withQueryTimeout(groupCtx, func(ctx context.Context) error {
+		var dependenciesErr error
+		dependencyMap, dependenciesErr = loadTaskDependencies(ctx, trackID)
+		return dependenciesErr
+	}))
+
+	if err := group.Wait(); err != nil {
+		return rest.Result{Error: err}
+	}
+	if !trackFound {
+		return rest.Result{}
 	}
+	if stationFound {
+		t4.Maintenance = station.maintenanceNotice(time.Now())
+	}
+	t4.OnDuty = onDuty
+	unlockingMode := taskUnlockingMode(trackID, request.AccessToken)
+	completion := taskCompletion(tests)
 
 	// Build it
 	t4.ID = track.ID
@@ -163,12 +258,26 @@ func (t4 *StationTasksTests) Get(request *rest.Request) rest.Result {
 	t4.Tasks = make([]*stationTasksTestsTask, 0)
 	t4TaskMap := make(map[string]*stationTasksTestsTask)
 	for _, task := range tasks {
+		dependsOn := dependencyMap[task.Shortname]
+		if dependsOn == nil {
+			dependsOn = make([]string, 0)
+		}
+		locked := unlockingMode != TaskUnlockingNone && !isTaskUnlocked(dependsOn, completion)
+		if locked && unlockingMode == TaskUnlockingHide {
+			continue
+		}
 		var t4Task stationTasksTestsTask
 		t4Task.ID = task.ID
 		t4Task.Shortname = task.Shortname
 		t4Task.Name = task.Name
 		t4Task.Description = task.Description
 		t4Task.Sequence = task.Sequence
+		t4Task.Points = task.Points
+		t4Task.DependsOn = dependsOn
+		if locked {
+			t4Task.Locked = true
+			t4Task.Description = ""
+		}
 		t4Task.Tests = make([]Test, 0)
 		t4.Tasks = append(t4.Tasks, &t4Task)
 		t4TaskMap[task.Shortname] = &t4Task
@@ -0,0 +1,515 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/gathering/tech-online-backend/scheduler"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	demoSchedulerInterval            = 10 * time.Second
+	demoPrefix                       = "demo-"
+	defaultDemoTracks                = 2
+	defaultDemoStationsPerTrack      = 8
+	defaultDemoTasksPerTrack         = 5
+	defaultDemoTestsPerTask          = 3
+	defaultDemoUsers                 = 40
+	defaultDemoTimeslotMinutes       = 20
+	defaultDemoSimulationIntervalSec = 30
+	maxDemoCount                     = 500
+	demoQueueLength                  = 2    // Waiting timeslots to keep booked per track
+	demoFlakiness                    = 0.03 // Chance of a solved test failing in a simulation round
+	demoCleaningChance               = 0.5  // Chance of a dirty station getting cleaned in a simulation round
+)
+
+var demoTrackNames = []string{"Switching", "Routing", "Firewalls", "Wireless", "Monitoring", "Automation"}
+
+var demoTaskNames = []string{
+	"Set the hostname", "Configure the management VLAN", "Set up the uplink trunk", "Enable SSH with keys only",
+	"Configure NTP", "Set up DHCP snooping", "Configure OSPF", "Announce the default route",
+	"Harden the management plane", "Set up syslog", "Configure IPv6 router advertisements", "Add port security",
+}
+
+var demoTestNames = []string{"Configured", "Reachable", "Persists after reboot", "Verified by neighbor", "Logged"}
+
+var demoFirstNames = []string{"Ada", "Bjørn", "Camilla", "Dag", "Eirik", "Frida", "Gunnar", "Hedda", "Ingrid", "Jonas", "Kari", "Lars", "Maja", "Nils", "Oda", "Per", "Sigrid", "Tor", "Ulrik", "Vilde"}
+
+var demoLastNames = []string{"Andersen", "Berg", "Dahl", "Eriksen", "Hansen", "Haugen", "Johansen", "Larsen", "Lie", "Moen", "Nilsen", "Olsen", "Pedersen", "Solberg", "Strand"}
+
+// demoTrackTables are the tables with rows of the demo tracks, deleted when resetting.
+var demoTrackTables = []string{
+	"tests", "test_history", "timeslot_scores", "frozen_scores", "scoreboards", "queue_entries", "registrations", "timeslots",
+	"task_dependencies", "task_flags", "flag_submissions", "task_checks", "hints", "tasks", "stations", "anomalies", "feedback",
+	"announcements", "crew_shifts", "schedule_entries", "station_templates", "teams",
+}
+
+// demoUserTables are the tables with rows of the demo users, deleted when resetting.
+var demoUserTables = []string{"team_members", "notifications", "notification_settings", "ssh_keys", "console_sessions", "email_log"}
+
+// DemoStatus is the state of the demo event, so clients may show that the data is not real.
+type DemoStatus struct {
+	Enabled         bool       `json:"enabled"`
+	Tracks          int        `json:"tracks"`
+	Stations        int        `json:"stations"`
+	Users           int        `json:"users"`
+	ActiveTimeslots int        `json:"active_timeslots"`
+	LastSimulation  *time.Time `json:"last_simulation"`
+}
+
+var lastDemoSimulation time.Time
+var lastDemoSimulationLock sync.Mutex
+
+func init() {
+	rest.AddHandler("/demo/", "^$", func() interface{} { return &DemoStatus{} })
+	scheduler.AddJob("simulate-demo", demoSchedulerInterval, simulateDemo)
+	config.AddValidator(validateDemoConfig)
+}
+
+// Get gets the state of the demo event.
+func (status *DemoStatus) Get(request *rest.Request) rest.Result {
+	// Get
+	if err := status.load(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	return rest.Result{}
+}
+
+// Post populates the demo event.
+func (status *DemoStatus) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Create
+	if result := PopulateDemo(); !result.IsOk() {
+		return result
+	}
+	request.Log().Info("Populated demo event")
+	if err := status.load(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	return rest.Result{Code: 201}
+}
+
+// Delete deletes the demo event, so it may be populated again.
+func (status *DemoStatus) Delete(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Delete
+	if result := ResetDemo(); !result.IsOk() {
+		return result
+	}
+	request.Log().Info("Reset demo event")
+	return rest.Result{Code: 204}
+}
+
+func (status *DemoStatus) load() error {
+	status.Enabled = config.Config.Demo.Enabled
+	demoPattern := demoPrefix + "%"
+	for _, count := range []struct {
+		target *int
+		query  string
+	}{
+		{&status.Tracks, "SELECT COUNT(*) FROM tracks WHERE id LIKE $1"},
+		{&status.Stations, "SELECT COUNT(*) FROM stations WHERE track LIKE $1"},
+		{&status.Users, "SELECT COUNT(*) FROM users WHERE username LIKE $1"},
+		{&status.ActiveTimeslots, "SELECT COUNT(*) FROM timeslots WHERE track LIKE $1 AND begin_time IS NOT NULL AND end_time > NOW()"},
+	} {
+		if err := db.DB.QueryRow(count.query, demoPattern).Scan(count.target); err != nil {
+			return err
+		}
+	}
+	lastDemoSimulationLock.Lock()
+	if !lastDemoSimulation.IsZero() {
+		lastSimulation := lastDemoSimulation
+		status.LastSimulation = &lastSimulation
+	}
+	lastDemoSimulationLock.Unlock()
+	return nil
+}
+
+// PopulateDemo generates the demo event with tracks, tasks, stations and users, named with the "demo-" prefix.
+// It's refused unless demo mode is enabled, if the event is already populated or if the database contains other tracks,
+// to keep the demo event apart from real events.
+func PopulateDemo() rest.Result {
+	demoConfig := config.Config.Demo
+	if !demoConfig.Enabled {
+		return rest.Result{Code: 400, Message: "demo mode is not enabled"}
+	}
+	var demoTrackCount, otherTrackCount int
+	row := db.DB.QueryRow("SELECT COUNT(*) FILTER (WHERE id LIKE $1), COUNT(*) FILTER (WHERE id NOT LIKE $1) FROM tracks", demoPrefix+"%")
+	if err := row.Scan(&demoTrackCount, &otherTrackCount); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	if otherTrackCount > 0 {
+		return rest.Result{Code: 409, Message: "the database contains non-demo tracks, use a separate database for demo mode"}
+	}
+	if demoTrackCount > 0 {
+		return rest.Result{Code: 409, Message: "the demo event is already populated, reset it first"}
+	}
+
+	seed := demoConfig.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	random := rand.New(rand.NewSource(seed))
+	trackCount := demoCount(demoConfig.Tracks, defaultDemoTracks)
+	stationCount := demoCount(demoConfig.StationsPerTrack, defaultDemoStationsPerTrack)
+	taskCount := demoCount(demoConfig.TasksPerTrack, defaultDemoTasksPerTrack)
+	userCount := demoCount(demoConfig.Users, defaultDemoUsers)
+
+	for trackNumber := 1; trackNumber <= trackCount; trackNumber++ {
+		track := Track{
+			ID:   fmt.Sprintf("%v%v", demoPrefix, trackNumber),
+			Type: trackTypeNet,
+			Name: fmt.Sprintf("Demo: %v", demoTrackNames[(trackNumber-1)%len(demoTrackNames)]),
+		}
+		if trackNumber > len(demoTrackNames) {
+			track.Name = fmt.Sprintf("%v %v", track.Name, (trackNumber-1)/len(demoTrackNames)+1)
+		}
+		if result := track.create(); !result.IsOk() {
+			return result
+		}
+
+		taskNames := random.Perm(len(demoTaskNames))
+		for taskNumber := 1; taskNumber <= taskCount; taskNumber++ {
+			taskID := uuid.Must(uuid.NewRandomFromReader(random))
+			sequence := taskNumber
+			name := demoTaskNames[taskNames[(taskNumber-1)%len(taskNames)]]
+			task := Task{
+				ID:          &taskID,
+				TrackID:     track.ID,
+				Shortname:   fmt.Sprintf("task%v", taskNumber),
+				Name:        name,
+				Description: fmt.Sprintf("%v on the station. This is a generated demo task.", name),
+				Sequence:    &sequence,
+				Points:      10 * (1 + random.Intn(5)),
+			}
+			if result := task.create(); !result.IsOk() {
+				return result
+			}
+		}
+
+		for stationNumber := 1; stationNumber <= stationCount; stationNumber++ {
+			stationID := uuid.Must(uuid.NewRandomFromReader(random))
+			station := Station{
+				ID:            &stationID,
+				TrackID:       track.ID,
+				Shortname:     fmt.Sprintf("s%02d", stationNumber),
+				Name:          fmt.Sprintf("Demo station %v", stationNumber),
+				DefaultStatus: StationStatusReady,
+				Status:        StationStatusReady,
+				Credentials:   fmt.Sprintf("ssh demo@s%02d.demo.invalid, password %06d (not a real host)", stationNumber, random.Intn(1000000)),
+				Notes:         "Generated demo station without a real host.",
+				Health:        StationHealthHealthy,
+			}
+			if result := station.create(); !result.IsOk() {
+				return result
+			}
+		}
+	}
+
+	for userNumber := 1; userNumber <= userCount; userNumber++ {
+		userID := uuid.Must(uuid.NewRandomFromReader(random))
+		username := fmt.Sprintf("%vuser%03d", demoPrefix, userNumber)
+		user := rest.User{
+			ID:           &userID,
+			Username:     username,
+			DisplayName:  fmt.Sprintf("%v %v", demoFirstNames[random.Intn(len(demoFirstNames))], demoLastNames[random.Intn(len(demoLastNames))]),
+			EmailAddress: fmt.Sprintf("%v@demo.invalid", username),
+			Role:         rest.RoleParticipant,
+		}
+		if dbResult := db.Insert("users", &user); dbResult.IsFailed() {
+			return rest.Result{Code: 500, Error: dbResult.Error}
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"seed":   seed,
+		"tracks": trackCount,
+		"users":  userCount,
+	}).Info("Populated demo event")
+	return rest.Result{}
+}
+
+// ResetDemo deletes the demo tracks and users with everything belonging to them.
+// It's refused unless demo mode is enabled.
+func ResetDemo() rest.Result {
+	if !config.Config.Demo.Enabled {
+		return rest.Result{Code: 400, Message: "demo mode is not enabled"}
+	}
+	demoPattern := demoPrefix + "%"
+	for _, table := range demoTrackTables {
+		if _, err := db.DB.Exec(fmt.Sprintf("DELETE FROM %v WHERE track LIKE $1", table), demoPattern); err != nil {
+			return rest.Result{Code: 500, Error: err}
+		}
+	}
+	for _, table := range demoUserTables {
+		if _, err := db.DB.Exec(fmt.Sprintf("DELETE FROM %v WHERE \"user\" IN (SELECT id FROM users WHERE username LIKE $1)", table), demoPattern); err != nil {
+			return rest.Result{Code: 500, Error: err}
+		}
+	}
+	if _, err := db.DB.Exec("DELETE FROM access_tokens WHERE owner_user IN (SELECT id FROM users WHERE username LIKE $1)", demoPattern); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	if _, err := db.DB.Exec("DELETE FROM users WHERE username LIKE $1", demoPattern); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	if _, err := db.DB.Exec("DELETE FROM tracks WHERE id LIKE $1", demoPattern); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	lastDemoSimulationLock.Lock()
+	lastDemoSimulation = time.Time{}
+	lastDemoSimulationLock.Unlock()
+	return rest.Result{}
+}
+
+// simulateDemo makes the simulated participants progress through the demo tracks, if demo mode is enabled.
+// Timeslots are booked for idle demo users, begun when a station is ready and finished after a while,
+// and the tests of assigned stations gradually pass, with some flakiness.
+// Dirty stations are cleaned after a while, like crew would do.
+func simulateDemo() error {
+	demoConfig := config.Config.Demo
+	if !demoConfig.Enabled {
+		return nil
+	}
+	now := time.Now()
+	interval := time.Duration(demoCount(demoConfig.SimulationIntervalSeconds, defaultDemoSimulationIntervalSec)) * time.Second
+	lastDemoSimulationLock.Lock()
+	if now.Sub(lastDemoSimulation) < interval {
+		lastDemoSimulationLock.Unlock()
+		return nil
+	}
+	lastDemoSimulation = now
+	lastDemoSimulationLock.Unlock()
+
+	var tracks Tracks
+	dbResult := db.SelectMany(&tracks, "tracks", "id", "LIKE", demoPrefix+"%")
+	if dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	random := rand.New(rand.NewSource(now.UnixNano()))
+	for _, track := range tracks {
+		if err := simulateDemoTrack(track, now, random); err != nil {
+			return fmt.Errorf("track %v: %w", track.ID, err)
+		}
+	}
+	return nil
+}
+
+func simulateDemoTrack(track *Track, now time.Time, random *rand.Rand) error {
+	demoConfig := config.Config.Demo
+	var tasks Tasks
+	if dbResult := db.SelectMany(&tasks, "tasks", "track", "=", track.ID); dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	sort.SliceStable(tasks, func(i, j int) bool {
+		return demoTaskSequence(tasks[i]) < demoTaskSequence(tasks[j])
+	})
+	testsPerTask := demoCount(demoConfig.TestsPerTask, defaultDemoTestsPerTask)
+	timeslotDuration := time.Duration(demoCount(demoConfig.TimeslotMinutes, defaultDemoTimeslotMinutes)) * time.Minute
+
+	var stations Stations
+	if dbResult := db.SelectMany(&stations, "stations", "track", "=", track.ID); dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	for _, station := range stations {
+		// Clean dirty stations
+		if station.TimeslotID == "" {
+			if station.Status == StationStatusDirty && random.Float64() < demoCleaningChance {
+				station.Status = StationStatusReady
+				if result := station.createOrUpdate(); !result.IsOk() {
+					return resultError(result)
+				}
+				station.publishStatusTransition(StationStatusDirty)
+			}
+			continue
+		}
+
+		var timeslot Timeslot
+		dbResult := db.Select(&timeslot, "timeslots", "id", "=", station.TimeslotID)
+		if dbResult.IsFailed() {
+			return dbResult.Error
+		}
+		if !dbResult.IsSuccess() || timeslot.BeginTime == nil {
+			continue
+		}
+
+		// Finish timeslots which have run their course
+		elapsed := now.Sub(*timeslot.BeginTime)
+		if elapsed > timeslotDuration {
+			if result := timeslot.finish(track, station, now); !result.IsOk() {
+				return resultError(result)
+			}
+			continue
+		}
+
+		// Report the tests, with the solved ones in task order, the better participants solving all before the end
+		skill := demoSkill(timeslot.ID.String())
+		solved := int(elapsed.Seconds() / timeslotDuration.Seconds() * skill * float64(len(tasks)*testsPerTask))
+		index := 0
+		for _, task := range tasks {
+			for testNumber := 1; testNumber <= testsPerTask; testNumber++ {
+				success := index < solved && random.Float64() >= demoFlakiness
+				index++
+				description := "Not solved yet"
+				if success {
+					description = "OK"
+				}
+				testID := uuid.New()
+				timestamp := now
+				sequence := testNumber
+				test := Test{
+					ID:                &testID,
+					TrackID:           track.ID,
+					TaskShortname:     task.Shortname,
+					Shortname:         fmt.Sprintf("test%v", testNumber),
+					StationShortname:  station.Shortname,
+					Name:              demoTestNames[(testNumber-1)%len(demoTestNames)],
+					Sequence:          &sequence,
+					Timestamp:         &timestamp,
+					StatusSuccess:     &success,
+					StatusDescription: description,
+				}
+				if result := test.save(); !result.IsOk() {
+					return resultError(result)
+				}
+			}
+		}
+	}
+
+	// Begin waiting timeslots while stations are ready
+	var timeslots Timeslots
+	if dbResult := db.SelectMany(&timeslots, "timeslots", "track", "=", track.ID, "begin_time", "IS", nil); dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	waiting := len(timeslots)
+	for _, timeslot := range timeslots {
+		if _, result := timeslot.begin(track, true); !result.IsOk() {
+			if result.Code == 404 {
+				break
+			}
+			return resultError(result)
+		}
+		waiting--
+	}
+
+	// Keep some idle demo users in the queue
+	if waiting >= demoQueueLength {
+		return nil
+	}
+	rows, err := db.DB.Query("SELECT id FROM users WHERE username LIKE $1 AND id NOT IN (SELECT \"user\" FROM timeslots WHERE end_time IS NULL OR end_time >= $2) ORDER BY random() LIMIT $3",
+		demoPrefix+"%", now, demoQueueLength-waiting)
+	if err != nil {
+		return err
+	}
+	var userIDs []uuid.UUID
+	for rows.Next() {
+		var userID uuid.UUID
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for i := range userIDs {
+		timeslotID := uuid.New()
+		timeslot := Timeslot{
+			ID:       &timeslotID,
+			UserID:   &userIDs[i],
+			TrackID:  track.ID,
+			Notes:    "Simulated demo participant",
+			Category: TimeslotCategoryParticipant,
+		}
+		if result := timeslot.create(); !result.IsOk() {
+			return resultError(result)
+		}
+		timeslot.publishBooked()
+	}
+	return nil
+}
+
+// demoSkill gives the simulated participant of the timeslot a skill factor from 0.6 to 1.4, 1 being average.
+func demoSkill(timeslotID string) float64 {
+	hash := fnv.New32a()
+	hash.Write([]byte(timeslotID))
+	return 0.6 + float64(hash.Sum32()%81)/100
+}
+
+func demoTaskSequence(task *Task) int {
+	if task.Sequence == nil {
+		return 0
+	}
+	return *task.Sequence
+}
+
+// demoCount returns the configured count, or the default if not positive. Counts are capped.
+func demoCount(value int, defaultValue int) int {
+	if value <= 0 {
+		return defaultValue
+	}
+	if value > maxDemoCount {
+		return maxDemoCount
+	}
+	return value
+}
+
+// resultError converts a failed result to an error.
+func resultError(result rest.Result) error {
+	if result.Error != nil {
+		return result.Error
+	}
+	return fmt.Errorf("%v", result.Message)
+}
+
+// validateDemoConfig refuses demo mode together with email and Discord notifications, since the demo users are not real.
+func validateDemoConfig(candidate *config.MainConfig) error {
+	if !candidate.Demo.Enabled {
+		return nil
+	}
+	if candidate.Email.Enabled {
+		return fmt.Errorf("demo: email notifications must be disabled in demo mode")
+	}
+	if candidate.Discord.BotToken != "" || len(candidate.Discord.Channels) > 0 {
+		return fmt.Errorf("demo: Discord notifications must be disabled in demo mode")
+	}
+	return nil
+}
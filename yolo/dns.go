@@ -0,0 +1,228 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/dns"
+	"github.com/gathering/tech-online-backend/jobs"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/gathering/tech-online-backend/scheduler"
+	log "github.com/sirupsen/logrus"
+)
+
+const dnsSyncInterval = 1 * time.Minute
+
+// stationDNSLock serializes DNS updates, so the stored records match what was sent last.
+var stationDNSLock sync.Mutex
+
+// StationHostnameData is the data available to the per-track hostname templates, as DNS labels.
+type StationHostnameData struct {
+	Track       string
+	Station     string // Shortname
+	Team        string // Empty if not in a team
+	User        string // Username of the timeslot owner
+	Participant string // Team if any, else user
+}
+
+func init() {
+	scheduler.AddJob("sync-station-dns", dnsSyncInterval, syncAllStationDNS)
+}
+
+// syncAllStationDNS makes the DNS records match the current station assignments and addresses,
+// e.g. for dynamic stations getting their address after being assigned.
+func syncAllStationDNS() error {
+	updater, err := dns.New(config.Config.DNS)
+	if err == dns.ErrNotConfigured {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var stations Stations
+	dbResult := db.SelectMany(&stations, "stations")
+	if dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	for _, station := range stations {
+		if station.Status == StationStatusTerminated && station.DNSName == "" {
+			continue
+		}
+		if err := station.syncDNS(updater); err != nil {
+			log.WithError(err).WithField("station", station.ID).Warn("Failed to sync station DNS records")
+		}
+	}
+	return nil
+}
+
+// queueDNSSync updates the DNS records of the station in the background, after it was assigned, unassigned or terminated.
+func (station *Station) queueDNSSync() {
+	if config.Config.DNS.Driver == "" || station.ID == nil {
+		return
+	}
+	stationID := *station.ID
+	jobs.Submit(jobs.Job{
+		Name:   "station-dns",
+		Fields: log.Fields{"station": stationID},
+		Run: func() error {
+			updater, err := dns.New(config.Config.DNS)
+			if err != nil {
+				return jobs.Permanent(err)
+			}
+			var current Station
+			dbResult := db.Select(&current, "stations", "id", "=", stationID)
+			if dbResult.IsFailed() {
+				return dbResult.Error
+			}
+			if !dbResult.IsSuccess() {
+				return nil
+			}
+			return current.syncDNS(updater)
+		},
+	})
+}
+
+// syncDNS sets or deletes the record for the station, if it differs from what it should be.
+func (station *Station) syncDNS(updater dns.Updater) error {
+	stationDNSLock.Lock()
+	defer stationDNSLock.Unlock()
+
+	name, target, err := station.wantedDNSRecord()
+	if err != nil {
+		return err
+	}
+	if name == station.DNSName && target == station.DNSTarget {
+		return nil
+	}
+
+	// Remove the old name first, in case the team or station changed
+	if station.DNSName != "" && station.DNSName != name {
+		if err := updater.DeleteRecords(station.DNSName); err != nil {
+			return err
+		}
+	}
+	if name != "" {
+		recordType, value := dns.RecordFor(target)
+		if err := updater.SetRecord(name, recordType, value); err != nil {
+			return err
+		}
+	}
+	if _, err := db.DB.Exec("UPDATE stations SET dns_name = $1, dns_target = $2 WHERE id = $3", name, target, station.ID.String()); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"station":  station.ID,
+		"previous": station.DNSName,
+		"name":     name,
+		"target":   target,
+	}).Info("Synced station DNS records")
+	station.DNSName = name
+	station.DNSTarget = target
+	return nil
+}
+
+// wantedDNSRecord gets the hostname and target the station should have, which is none unless assigned and with a known address.
+func (station *Station) wantedDNSRecord() (string, string, error) {
+	hostnameTemplate := config.Config.Tracks[station.TrackID].DNSHostname
+	if hostnameTemplate == "" || station.Status == StationStatusTerminated || station.TimeslotID == "" || station.Address == "" {
+		return "", "", nil
+	}
+
+	// Build template data
+	data := StationHostnameData{
+		Track:   dns.Label(station.TrackID),
+		Station: dns.Label(station.Shortname),
+	}
+	var timeslot Timeslot
+	timeslotDBResult := db.Select(&timeslot, "timeslots", "id", "=", station.TimeslotID)
+	if timeslotDBResult.IsFailed() {
+		return "", "", timeslotDBResult.Error
+	}
+	if !timeslotDBResult.IsSuccess() {
+		return "", "", nil
+	}
+	if timeslot.UserID != nil {
+		var user rest.User
+		userDBResult := db.Select(&user, "users", "id", "=", timeslot.UserID)
+		if userDBResult.IsFailed() {
+			return "", "", userDBResult.Error
+		}
+		data.User = dns.Label(user.Username)
+	}
+	if timeslot.TeamID != nil {
+		var team Team
+		teamDBResult := db.Select(&team, "teams", "id", "=", timeslot.TeamID)
+		if teamDBResult.IsFailed() {
+			return "", "", teamDBResult.Error
+		}
+		data.Team = dns.Label(team.Name)
+	}
+	data.Participant = data.Team
+	if data.Participant == "" {
+		data.Participant = data.User
+	}
+
+	// Render
+	name, err := renderStationHostname(hostnameTemplate, data)
+	if err != nil {
+		return "", "", err
+	}
+	if !isValidStationHostname(name, config.Config.DNS.Zone) {
+		log.WithFields(log.Fields{
+			"station":  station.ID,
+			"hostname": name,
+		}).Warn("Station hostname is invalid or outside the DNS zone, skipping record")
+		return "", "", nil
+	}
+	return name, station.Address, nil
+}
+
+func renderStationHostname(hostnameTemplate string, data StationHostnameData) (string, error) {
+	parsed, err := template.New("hostname").Parse(hostnameTemplate)
+	if err != nil {
+		return "", err
+	}
+	var rendered bytes.Buffer
+	if err := parsed.Execute(&rendered, data); err != nil {
+		return "", err
+	}
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(rendered.String()), ".")), nil
+}
+
+// isValidStationHostname checks that the name is within the zone and has no empty labels, e.g. from a missing team.
+func isValidStationHostname(name string, zone string) bool {
+	if !dns.InZone(name, zone) {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" {
+			return false
+		}
+	}
+	return true
+}
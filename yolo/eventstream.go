@@ -0,0 +1,114 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package yolo
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gathering/tech-online-backend/event"
+	"github.com/gathering/tech-online-backend/notify"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+	"golang.org/x/net/websocket"
+)
+
+const eventStreamBufferSize = 100
+
+// EventStreamRequest is a request to stream events over a WebSocket.
+type EventStreamRequest struct{}
+
+func init() {
+	rest.AddHandler("/events/", "^$", func() interface{} { return &EventStreamRequest{} })
+}
+
+// Stream streams events as JSON text messages until the client disconnects.
+// Operators/admins get all events, other users only get events addressed to them and announcements.
+// Use the "types" query arg to filter by comma separated event types, with "*" suffix wildcards.
+func (streamRequest *EventStreamRequest) Stream(request *rest.Request) (http.Handler, rest.Result) {
+	// Check perms
+	allEvents := request.AccessToken.GetRole() == rest.RoleOperator || request.AccessToken.GetRole() == rest.RoleAdmin
+	if !allEvents && request.AccessToken.OwnerUserID == nil {
+		return nil, rest.UnauthorizedResult(request.AccessToken)
+	}
+	var userID uuid.UUID
+	if request.AccessToken.OwnerUserID != nil {
+		userID = *request.AccessToken.OwnerUserID
+	}
+
+	// Check params
+	var typePatterns []string
+	if rawTypes, ok := request.QueryArgs["types"]; ok && rawTypes != "" {
+		typePatterns = strings.Split(rawTypes, ",")
+	}
+
+	server := websocket.Server{
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(conn *websocket.Conn) {
+			// Streams are long-lived, unlike the requests the server timeouts are meant for
+			conn.SetDeadline(time.Time{})
+			events, stop := event.Listen(eventStreamBufferSize)
+			defer stop()
+
+			// Clients aren't expected to send anything, but reading notices when they leave
+			go func() {
+				io.Copy(ioutil.Discard, conn)
+				stop()
+			}()
+
+			for ev := range events {
+				if !allEvents && !eventHasUser(ev, userID) && !isPublicAnnouncementEvent(ev) {
+					continue
+				}
+				if !eventMatchesTypes(ev, typePatterns) {
+					continue
+				}
+				if err := websocket.JSON.Send(conn, ev); err != nil {
+					return
+				}
+			}
+		},
+	}
+	return server, rest.Result{}
+}
+
+func eventHasUser(ev event.Event, userID uuid.UUID) bool {
+	for _, eventUserID := range ev.UserIDs {
+		if eventUserID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+func eventMatchesTypes(ev event.Event, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if notify.MatchEventType(strings.TrimSpace(pattern), ev.Type) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,410 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/event"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	maxExtensionMinutes = 60
+	maxScheduleShifts   = 100 // Following timeslots which may be pushed back by one extension
+)
+
+// Event types for timeslot extensions.
+const (
+	EventTypeExtensionRequested event.Type = "timeslot.extension_requested" // Sent to operators/admins
+	EventTypeTimeslotExtended   event.Type = "timeslot.extended"            // Sent to the participants, also for the timeslots pushed back
+	EventTypeExtensionDenied    event.Type = "timeslot.extension_denied"    // Sent to the participants
+)
+
+// TimeslotExtensionStatus is the status of an extension request.
+type TimeslotExtensionStatus string
+
+const (
+	// TimeslotExtensionStatusPending means the request awaits an operator/admin.
+	TimeslotExtensionStatusPending TimeslotExtensionStatus = "pending"
+	// TimeslotExtensionStatusApproved means the timeslot was extended.
+	TimeslotExtensionStatusApproved TimeslotExtensionStatus = "approved"
+	// TimeslotExtensionStatusDenied means an operator/admin denied the request.
+	TimeslotExtensionStatusDenied TimeslotExtensionStatus = "denied"
+)
+
+// TimeslotExtension is a participant's request for more time in a timeslot.
+type TimeslotExtension struct {
+	ID          *uuid.UUID              `column:"id" json:"id"`                     // Generated
+	TimeslotID  *uuid.UUID              `column:"timeslot" json:"timeslot"`         // Required
+	Minutes     int                     `column:"minutes" json:"minutes"`           // Required
+	Reason      string                  `column:"reason" json:"reason"`             // Optional
+	Status      TimeslotExtensionStatus `column:"status" json:"status"`             // Generated
+	RequestedBy string                  `column:"requested_by" json:"requested_by"` // Generated, name of the user
+	RequestTime *time.Time              `column:"request_time" json:"request_time"` // Generated
+	DecidedBy   string                  `column:"decided_by" json:"decided_by"`     // Generated, name of the operator/admin
+	DecideTime  *time.Time              `column:"decide_time" json:"decide_time"`   // Generated
+	Comment     string                  `column:"comment" json:"comment"`           // From the operator/admin
+}
+
+// TimeslotExtensions is a list of extension requests.
+type TimeslotExtensions []*TimeslotExtension
+
+// TimeslotExtensionApproveRequest is a request to approve an extension, pushing back the following schedule as needed.
+// The response contains the approved extension and the pushed back timeslots.
+type TimeslotExtensionApproveRequest struct {
+	Comment   string             `json:"comment"`
+	Extension *TimeslotExtension `json:"extension"` // Response only
+	Shifted   Timeslots          `json:"shifted"`   // Response only
+}
+
+// TimeslotExtensionDenyRequest is a request to deny an extension.
+type TimeslotExtensionDenyRequest struct {
+	Comment string `json:"comment"`
+}
+
+func init() {
+	rest.AddHandler("/timeslot-extensions/", "^$", func() interface{} { return &TimeslotExtensions{} })
+	rest.AddHandler("/timeslot-extension/", "^(?:(?P<id>[^/]+)/)?$", func() interface{} { return &TimeslotExtension{} })
+	rest.AddHandler("/timeslot-extension/", "^(?P<id>[^/]+)/approve/$", func() interface{} { return &TimeslotExtensionApproveRequest{} })
+	rest.AddHandler("/timeslot-extension/", "^(?P<id>[^/]+)/deny/$", func() interface{} { return &TimeslotExtensionDenyRequest{} })
+}
+
+// Get gets extension requests, newest first.
+// Participants must specify a timeslot they participate in.
+func (extensions *TimeslotExtensions) Get(request *rest.Request) rest.Result {
+	// Check params and perms
+	var whereArgs []interface{}
+	timeslotID, timeslotIDExists := request.QueryArgs["timeslot"]
+	if timeslotIDExists {
+		whereArgs = append(whereArgs, "timeslot", "=", timeslotID)
+	}
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		if !timeslotIDExists {
+			return rest.UnauthorizedResult(request.AccessToken)
+		}
+		var timeslot Timeslot
+		dbResult := db.Select(&timeslot, "timeslots", "id", "=", timeslotID)
+		if dbResult.IsFailed() {
+			return rest.Result{Code: 500, Error: dbResult.Error}
+		}
+		if !dbResult.IsSuccess() {
+			return rest.UnauthorizedResult(request.AccessToken)
+		}
+		if result := timeslot.checkParticipantPerms(request.AccessToken); !result.IsOk() {
+			return result
+		}
+	}
+	if status, ok := request.QueryArgs["status"]; ok {
+		whereArgs = append(whereArgs, "status", "=", status)
+	}
+
+	// Get
+	dbResult := db.SelectMany(extensions, "timeslot_extensions", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	sort.SliceStable(*extensions, func(i, j int) bool {
+		return (*extensions)[i].RequestTime.After(*(*extensions)[j].RequestTime)
+	})
+	return rest.Result{}
+}
+
+// Get gets a single extension request.
+func (extension *TimeslotExtension) Get(request *rest.Request) rest.Result {
+	// Get
+	var timeslot Timeslot
+	if result := extension.loadFromRequest(request, &timeslot); !result.IsOk() {
+		return result
+	}
+
+	// Check perms
+	return timeslot.checkParticipantPerms(request.AccessToken)
+}
+
+// Post requests an extension for a running or upcoming timeslot.
+func (extension *TimeslotExtension) Post(request *rest.Request) rest.Result {
+	// Check params
+	if extension.TimeslotID == nil {
+		return rest.Result{Code: 400, Message: "missing timeslot ID"}
+	}
+	if extension.Minutes <= 0 || extension.Minutes > maxExtensionMinutes {
+		return rest.Result{Code: 400, Message: fmt.Sprintf("minutes must be between 1 and %v", maxExtensionMinutes)}
+	}
+
+	// Get timeslot
+	var timeslot Timeslot
+	timeslotDBResult := db.Select(&timeslot, "timeslots", "id", "=", extension.TimeslotID)
+	if timeslotDBResult.IsFailed() {
+		return rest.Result{Code: 500, Error: timeslotDBResult.Error}
+	}
+	if !timeslotDBResult.IsSuccess() {
+		return rest.Result{Code: 400, Message: "referenced timeslot does not exist"}
+	}
+
+	// Check perms
+	if result := timeslot.checkParticipantPerms(request.AccessToken); !result.IsOk() {
+		return result
+	}
+
+	// Validate
+	if timeslot.BeginTime == nil || timeslot.EndTime == nil {
+		return rest.Result{Code: 400, Message: "timeslot is not scheduled"}
+	}
+	if !timeslot.EndTime.After(time.Now()) {
+		return rest.Result{Code: 409, Message: "timeslot has already ended"}
+	}
+	var pendingCount int
+	row := db.DB.QueryRow("SELECT COUNT(*) FROM timeslot_extensions WHERE timeslot = $1 AND status = $2", timeslot.ID, TimeslotExtensionStatusPending)
+	if err := row.Scan(&pendingCount); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	if pendingCount > 0 {
+		return rest.Result{Code: 409, Message: "timeslot already has a pending extension request"}
+	}
+
+	// Create
+	newID := uuid.New()
+	now := time.Now()
+	extension.ID = &newID
+	extension.Status = TimeslotExtensionStatusPending
+	extension.RequestedBy = request.AccessToken.GetName()
+	extension.RequestTime = &now
+	extension.DecidedBy = ""
+	extension.DecideTime = nil
+	extension.Comment = ""
+	dbResult := db.Insert("timeslot_extensions", extension)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	publishStaffEvent(EventTypeExtensionRequested, timeslot.TrackID, "Timeslot extension requested",
+		fmt.Sprintf("%v requested %v more minutes for timeslot %v: %v", extension.RequestedBy, extension.Minutes, timeslot.ID, extension.Reason), extension)
+
+	return rest.Result{Code: 201, Location: fmt.Sprintf("%v/timeslot-extension/%v/", config.Config.SitePrefix, extension.ID)}
+}
+
+// Post approves an extension, extending the timeslot and pushing back the following timeslots sharing participants or the station.
+// Responds with 409 and the conflicts if the schedule can't be adjusted, e.g. if a following timeslot has already begun.
+func (approveRequest *TimeslotExtensionApproveRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Get
+	var extension TimeslotExtension
+	var timeslot Timeslot
+	if result := extension.loadFromRequest(request, &timeslot); !result.IsOk() {
+		return result
+	}
+	if extension.Status != TimeslotExtensionStatusPending {
+		return rest.Result{Code: 409, Message: fmt.Sprintf("cannot approve %v extension", extension.Status)}
+	}
+	if timeslot.BeginTime == nil || timeslot.EndTime == nil {
+		return rest.Result{Code: 409, Message: "timeslot is not scheduled"}
+	}
+	if !timeslot.EndTime.After(time.Now()) {
+		return rest.Result{Code: 409, Message: "timeslot has already ended"}
+	}
+
+	// Extend and adjust the schedule
+	newEnd := timeslot.EndTime.Add(time.Duration(extension.Minutes) * time.Minute)
+	shifted, result := timeslot.extendSchedule(newEnd)
+	if !result.IsOk() {
+		return result
+	}
+
+	// Save decision
+	if result := extension.decide(TimeslotExtensionStatusApproved, request.AccessToken.GetName(), approveRequest.Comment); !result.IsOk() {
+		return result
+	}
+
+	// Notify
+	timeslot.EndTime = &newEnd
+	if err := timeslot.clearReminders(ReminderKindEnding); err != nil {
+		request.Log().WithError(err).WithField("timeslot", timeslot.ID).Warn("Failed to clear ending reminder of extended timeslot")
+	}
+	timeslot.publishEvent(EventTypeTimeslotExtended, "Timeslot extended",
+		fmt.Sprintf("Your timeslot was extended by %v minutes and now ends at %v.", extension.Minutes, displayTime(newEnd).Format("15:04")), &extension)
+	for _, other := range shifted {
+		other.publishScheduled()
+	}
+	request.Log().WithFields(log.Fields{
+		"timeslot": timeslot.ID,
+		"minutes":  extension.Minutes,
+		"shifted":  len(shifted),
+		"actor":    request.AccessToken.GetName(),
+	}).Info("Timeslot extended")
+
+	approveRequest.Extension = &extension
+	approveRequest.Shifted = shifted
+	if approveRequest.Shifted == nil {
+		approveRequest.Shifted = make(Timeslots, 0)
+	}
+	return rest.Result{}
+}
+
+// Post denies an extension.
+func (denyRequest *TimeslotExtensionDenyRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Get
+	var extension TimeslotExtension
+	var timeslot Timeslot
+	if result := extension.loadFromRequest(request, &timeslot); !result.IsOk() {
+		return result
+	}
+	if extension.Status != TimeslotExtensionStatusPending {
+		return rest.Result{Code: 409, Message: fmt.Sprintf("cannot deny %v extension", extension.Status)}
+	}
+
+	// Save decision and notify
+	if result := extension.decide(TimeslotExtensionStatusDenied, request.AccessToken.GetName(), denyRequest.Comment); !result.IsOk() {
+		return result
+	}
+	message := "Your request for more time was denied."
+	if denyRequest.Comment != "" {
+		message += " " + denyRequest.Comment
+	}
+	timeslot.publishEvent(EventTypeExtensionDenied, "Timeslot extension denied", message, &extension)
+	return rest.Result{Code: 303, Location: fmt.Sprintf("%v/timeslot-extension/%v/", config.Config.SitePrefix, extension.ID)}
+}
+
+// loadFromRequest loads the extension from the "id" path arg, plus its timeslot.
+func (extension *TimeslotExtension) loadFromRequest(request *rest.Request, timeslot *Timeslot) rest.Result {
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+	dbResult := db.Select(extension, "timeslot_extensions", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+	timeslotDBResult := db.Select(timeslot, "timeslots", "id", "=", extension.TimeslotID)
+	if timeslotDBResult.IsFailed() {
+		return rest.Result{Code: 500, Error: timeslotDBResult.Error}
+	}
+	if !timeslotDBResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "timeslot not found"}
+	}
+	return rest.Result{}
+}
+
+func (extension *TimeslotExtension) decide(status TimeslotExtensionStatus, actor string, comment string) rest.Result {
+	now := time.Now()
+	extension.Status = status
+	extension.DecidedBy = actor
+	extension.DecideTime = &now
+	extension.Comment = comment
+	dbResult := db.Update("timeslot_extensions", extension, "id", "=", extension.ID)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	return rest.Result{}
+}
+
+// extendSchedule moves the end of the timeslot and pushes back the following timeslots sharing participants or the station, cascading.
+// Timeslots keep their durations. Changes are saved as they go so later conflict checks see them, and reverted if a
+// conflicting timeslot can't be moved (because it began before the extended timeslot or has already begun).
+// Returns the pushed back timeslots.
+func (timeslot *Timeslot) extendSchedule(newEnd time.Time) (Timeslots, rest.Result) {
+	now := time.Now()
+	originalBegin := *timeslot.BeginTime
+	var originals Timeslots
+	revert := func() {
+		for i := len(originals) - 1; i >= 0; i-- {
+			if result := originals[i].createOrUpdate(); !result.IsOk() {
+				log.WithError(result.Error).WithField("timeslot", originals[i].ID).Error("Failed to revert timeslot after failed schedule adjustment")
+			}
+		}
+	}
+	save := func(changed *Timeslot, original Timeslot) rest.Result {
+		originals = append(originals, &original)
+		if result := changed.createOrUpdate(); !result.IsOk() {
+			revert()
+			return result
+		}
+		return rest.Result{}
+	}
+
+	extended := *timeslot
+	extended.EndTime = &newEnd
+	if result := save(&extended, *timeslot); !result.IsOk() {
+		return nil, result
+	}
+
+	var shifted Timeslots
+	queue := Timeslots{&extended}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		conflicts, err := current.findConflicts()
+		if err != nil {
+			revert()
+			return nil, rest.Result{Code: 500, Error: err}
+		}
+		for _, conflict := range conflicts {
+			if *conflict.TimeslotID == *timeslot.ID || conflict.BeginTime.Before(originalBegin) || !conflict.BeginTime.After(now) {
+				revert()
+				return nil, rest.Result{
+					Code:    409,
+					Message: fmt.Sprintf("cannot push back timeslot %v (%v) which conflicts with the extension", conflict.TimeslotID, conflict.Reason),
+					Details: conflicts,
+				}
+			}
+			if len(shifted) >= maxScheduleShifts {
+				revert()
+				return nil, rest.Result{Code: 409, Message: "too many following timeslots would need to be pushed back"}
+			}
+
+			var other Timeslot
+			dbResult := db.Select(&other, "timeslots", "id", "=", conflict.TimeslotID)
+			if dbResult.IsFailed() {
+				revert()
+				return nil, rest.Result{Code: 500, Error: dbResult.Error}
+			}
+			original := other
+			delay := current.EndTime.Sub(*other.BeginTime)
+			newBegin := other.BeginTime.Add(delay)
+			newOtherEnd := other.EndTime.Add(delay)
+			other.BeginTime = &newBegin
+			other.EndTime = &newOtherEnd
+			if result := save(&other, original); !result.IsOk() {
+				return nil, result
+			}
+			shifted = append(shifted, &other)
+			queue = append(queue, &other)
+		}
+	}
+	return shifted, rest.Result{}
+}
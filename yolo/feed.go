@@ -0,0 +1,239 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	content "github.com/gathering/tech-online-backend/doc"
+	"github.com/gathering/tech-online-backend/rest"
+)
+
+// Feed is an Atom feed of announcements and document changes, newest first.
+type Feed struct {
+	raw *rest.RawResponse
+}
+
+// atomFeed is the XML of an Atom feed (RFC 4287).
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomEntry struct {
+	ID         string         `xml:"id"`
+	Title      string         `xml:"title"`
+	Updated    string         `xml:"updated"`
+	Published  string         `xml:"published,omitempty"`
+	Author     *atomAuthor    `xml:"author,omitempty"`
+	Links      []atomLink     `xml:"link"`
+	Categories []atomCategory `xml:"category"`
+	Content    atomContent    `xml:"content"`
+	updated    time.Time
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+func init() {
+	rest.AddHandler("/feed/", "^$", func() interface{} { return &Feed{} })
+}
+
+func feedMaxEntries() int {
+	if config.Config.Feed.MaxEntries > 0 {
+		return config.Config.Feed.MaxEntries
+	}
+	return 50
+}
+
+// feedURL returns the absolute URL of the API path if the public URL is configured, else relative.
+func feedURL(path string) string {
+	return strings.TrimSuffix(config.Config.PublicURL, "/") + config.Config.SitePrefix + path
+}
+
+// Get gets the feed of the published announcements visible to the requester and the published documents.
+// Documents may be limited to the "family" query arg and announcements to the "track" query arg (and global ones).
+func (feed *Feed) Get(request *rest.Request) rest.Result {
+	// Check params, prep filtering
+	familyID, hasFamilyID := request.QueryArgs["family"]
+	trackID, hasTrackID := request.QueryArgs["track"]
+	documentWhereArgs := []interface{}{"status", "=", content.DocumentStatusPublished}
+	if hasFamilyID {
+		documentWhereArgs = append(documentWhereArgs, "family", "=", familyID)
+	}
+
+	// Get
+	var announcements Announcements
+	if dbResult := db.SelectMany(&announcements, "announcements", "published", "=", true); dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	var documents content.Documents
+	if dbResult := db.SelectMany(&documents, "documents", documentWhereArgs...); dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	var families content.DocumentFamilies
+	if dbResult := db.SelectMany(&families, "document_families"); dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	familyNames := make(map[string]string, len(families))
+	for _, family := range families {
+		familyNames[family.ID] = family.Name
+	}
+
+	// Build entries
+	var entries []atomEntry
+	for _, announcement := range announcements {
+		if !announcement.isVisibleTo(request.AccessToken) {
+			continue
+		}
+		if hasTrackID && announcement.TrackID != "" && announcement.TrackID != trackID {
+			continue
+		}
+		updated := *announcement.CreatedTime
+		if announcement.BeginTime != nil && announcement.BeginTime.After(updated) {
+			updated = *announcement.BeginTime
+		}
+		entry := atomEntry{
+			ID:         fmt.Sprintf("urn:uuid:%v", announcement.ID),
+			Title:      announcementFeedTitle(announcement),
+			Updated:    updated.UTC().Format(time.RFC3339),
+			Published:  updated.UTC().Format(time.RFC3339),
+			Links:      []atomLink{{Rel: "alternate", Href: feedURL("/announcements/active/")}},
+			Categories: []atomCategory{{Term: "announcement"}, {Term: announcement.Severity}},
+			Content:    atomContent{Type: "text", Text: announcement.Message},
+			updated:    updated,
+		}
+		if announcement.Author != "" {
+			entry.Author = &atomAuthor{Name: announcement.Author}
+		}
+		if announcement.TrackID != "" {
+			entry.Categories = append(entry.Categories, atomCategory{Term: "track:" + announcement.TrackID})
+		}
+		entries = append(entries, entry)
+	}
+	for _, document := range documents {
+		if document.LastChange == nil {
+			continue
+		}
+		path := fmt.Sprintf("/document/%v/%v/", url.PathEscape(document.FamilyID), url.PathEscape(document.Shortname))
+		title := document.Name
+		if title == "" {
+			title = document.Shortname
+		}
+		if familyName := familyNames[document.FamilyID]; familyName != "" {
+			title = fmt.Sprintf("%v: %v", familyName, title)
+		}
+		entries = append(entries, atomEntry{
+			ID:         feedURL(path),
+			Title:      title,
+			Updated:    document.LastChange.UTC().Format(time.RFC3339),
+			Links:      []atomLink{{Rel: "alternate", Href: feedURL(path)}},
+			Categories: []atomCategory{{Term: "document"}, {Term: "family:" + document.FamilyID}},
+			Content:    atomContent{Type: "text", Text: document.Content},
+			updated:    *document.LastChange,
+		})
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].updated.After(entries[j].updated)
+	})
+	if limit := feedMaxEntries(); len(entries) > limit {
+		entries = entries[:limit]
+	}
+	if request.ListLimit > 0 && len(entries) > request.ListLimit {
+		entries = entries[:request.ListLimit]
+	}
+
+	// Render
+	title := config.Config.Feed.Title
+	if title == "" {
+		title = "Tech:Online"
+	}
+	selfURL := feedURL("/feed/")
+	if len(request.QueryArgs) > 0 {
+		query := url.Values{}
+		for key, value := range request.QueryArgs {
+			query.Set(key, value)
+		}
+		selfURL += "?" + query.Encode()
+	}
+	updated := time.Unix(0, 0)
+	if len(entries) > 0 {
+		updated = entries[0].updated
+	}
+	data, err := xml.MarshalIndent(atomFeed{
+		ID:      selfURL,
+		Title:   title,
+		Updated: updated.UTC().Format(time.RFC3339),
+		Links:   []atomLink{{Rel: "self", Href: selfURL}},
+		Entries: entries,
+	}, "", "  ")
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	feed.raw = &rest.RawResponse{
+		ContentType: "application/atom+xml; charset=utf-8",
+		Data:        append([]byte(xml.Header), data...),
+	}
+	return rest.Result{}
+}
+
+// RawResponse returns the feed.
+func (feed *Feed) RawResponse() *rest.RawResponse {
+	return feed.raw
+}
+
+// announcementFeedTitle returns the first line of the message, shortened, with the severity unless info.
+func announcementFeedTitle(announcement *Announcement) string {
+	title := strings.SplitN(announcement.Message, "\n", 2)[0]
+	if runes := []rune(title); len(runes) > 80 {
+		title = string(runes[:79]) + "…"
+	}
+	if announcement.Severity != AnnouncementSeverityInfo {
+		title = fmt.Sprintf("[%v] %v", strings.ToUpper(announcement.Severity), title)
+	}
+	return title
+}
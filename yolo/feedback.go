@@ -0,0 +1,347 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+)
+
+const (
+	minFeedbackRating      = 1
+	maxFeedbackRating      = 5
+	maxFeedbackCommentSize = 4000
+)
+
+// Feedback is a participant's rating and comment for a track or task, given during or after their timeslot.
+type Feedback struct {
+	ID         *uuid.UUID `column:"id" json:"id"`               // Generated
+	TimeslotID *uuid.UUID `column:"timeslot" json:"timeslot"`   // Required
+	TrackID    string     `column:"track" json:"track"`         // Generated, from the timeslot
+	TaskID     *uuid.UUID `column:"task" json:"task"`           // Optional, feedback for the whole track if unset
+	UserID     *uuid.UUID `column:"user" json:"user"`           // Generated
+	Rating     int        `column:"rating" json:"rating"`       // Required, 1-5
+	Comment    string     `column:"comment" json:"comment"`     // Optional
+	Timestamp  *time.Time `column:"timestamp" json:"timestamp"` // Generated, when given or last changed
+}
+
+// Feedbacks is a list of feedback.
+type Feedbacks []*Feedback
+
+// FeedbackSummary is the anonymized feedback for a track or task, without users or timeslots.
+type FeedbackSummary struct {
+	TaskID        *uuid.UUID  `json:"task"` // Empty for the whole track
+	TaskShortname string      `json:"task_shortname,omitempty"`
+	Count         int         `json:"count"`
+	AverageRating float64     `json:"average_rating"`
+	Ratings       map[int]int `json:"ratings"`  // Count per rating
+	Comments      []string    `json:"comments"` // Sorted, so they can't be linked to timeslots by order
+}
+
+// TrackFeedbackSummary is the anonymized feedback for a track and its tasks.
+type TrackFeedbackSummary struct {
+	TrackID string             `json:"track"`
+	Track   *FeedbackSummary   `json:"track_feedback"`
+	Tasks   []*FeedbackSummary `json:"tasks"`
+}
+
+func init() {
+	rest.AddHandler("/feedbacks/", "^$", func() interface{} { return &Feedbacks{} })
+	rest.AddHandler("/feedback/", "^(?:(?P<id>[^/]+)/)?$", func() interface{} { return &Feedback{} })
+	rest.AddHandler("/feedback-summary/", "^(?P<track_id>[^/]+)/$", func() interface{} { return &TrackFeedbackSummary{} })
+	registerPersonalData(personalDataTable{table: "feedback", userColumn: "user", scrubColumns: []string{"comment"}, erasure: personalDataAnonymize})
+}
+
+// Get gets the requester's own feedback, or all feedback for admins.
+func (feedbacks *Feedbacks) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin && request.AccessToken.OwnerUserID == nil {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params, prep filtering
+	var whereArgs []interface{}
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		whereArgs = append(whereArgs, "user", "=", request.AccessToken.OwnerUserID)
+	}
+	if timeslotID, ok := request.QueryArgs["timeslot"]; ok {
+		whereArgs = append(whereArgs, "timeslot", "=", timeslotID)
+	}
+	if trackID, ok := request.QueryArgs["track"]; ok {
+		whereArgs = append(whereArgs, "track", "=", trackID)
+	}
+
+	// Get
+	dbResult := db.SelectMany(feedbacks, "feedback", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	sort.SliceStable(*feedbacks, func(i, j int) bool {
+		return (*feedbacks)[i].Timestamp.After(*(*feedbacks)[j].Timestamp)
+	})
+	return rest.Result{}
+}
+
+// Get gets a single feedback.
+func (feedback *Feedback) Get(request *rest.Request) rest.Result {
+	return feedback.load(request)
+}
+
+// Post gives feedback for a track or task, once per participant and timeslot.
+func (feedback *Feedback) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.OwnerUserID == nil {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Validate
+	if feedback.TimeslotID == nil {
+		return rest.Result{Code: 400, Message: "missing timeslot ID"}
+	}
+	feedback.UserID = request.AccessToken.OwnerUserID
+	if result := feedback.validate(); !result.IsOk() {
+		return result
+	}
+	var existing Feedbacks
+	existingArgs := []interface{}{"timeslot", "=", feedback.TimeslotID, "user", "=", feedback.UserID}
+	if dbResult := db.SelectMany(&existing, "feedback", existingArgs...); dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	for _, other := range existing {
+		if uuidPointersEqual(other.TaskID, feedback.TaskID) {
+			return rest.Result{Code: 409, Message: "feedback already given, change it instead", Details: map[string]interface{}{"id": other.ID}}
+		}
+	}
+
+	// Create
+	newID := uuid.New()
+	now := time.Now()
+	feedback.ID = &newID
+	feedback.Timestamp = &now
+	dbResult := db.Insert("feedback", feedback)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	return rest.Result{Code: 201, Location: fmt.Sprintf("%v/feedback/%v/", config.Config.SitePrefix, feedback.ID)}
+}
+
+// Put changes the rating and comment of the requester's feedback.
+func (feedback *Feedback) Put(request *rest.Request) rest.Result {
+	// Check params and perms
+	rating, comment := feedback.Rating, feedback.Comment
+	if result := feedback.load(request); !result.IsOk() {
+		return result
+	}
+	if feedback.UserID == nil || request.AccessToken.OwnerUserID == nil || *feedback.UserID != *request.AccessToken.OwnerUserID {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Validate
+	feedback.Rating = rating
+	feedback.Comment = comment
+	if result := feedback.validate(); !result.IsOk() {
+		return result
+	}
+
+	// Update
+	now := time.Now()
+	feedback.Timestamp = &now
+	dbResult := db.Update("feedback", feedback, "id", "=", feedback.ID)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	return rest.Result{}
+}
+
+// Delete deletes feedback, by the participant who gave it or an admin.
+func (feedback *Feedback) Delete(request *rest.Request) rest.Result {
+	// Check params and perms
+	if result := feedback.load(request); !result.IsOk() {
+		return result
+	}
+
+	// Delete
+	dbResult := db.Delete("feedback", "id", "=", feedback.ID)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	return rest.Result{}
+}
+
+// Get gets the anonymized feedback for a track and its tasks.
+func (summary *TrackFeedbackSummary) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if !isStaff(request.AccessToken) {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	trackID, trackIDExists := request.PathArgs["track_id"]
+	if !trackIDExists || trackID == "" {
+		return rest.Result{Code: 400, Message: "missing track ID"}
+	}
+	var track Track
+	trackDBResult := db.Select(&track, "tracks", "id", "=", trackID)
+	if trackDBResult.IsFailed() {
+		return rest.Result{Code: 500, Error: trackDBResult.Error}
+	}
+	if !trackDBResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "track not found"}
+	}
+
+	// Get
+	var feedbacks Feedbacks
+	if dbResult := db.SelectMany(&feedbacks, "feedback", "track", "=", track.ID); dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	var tasks Tasks
+	if dbResult := db.SelectMany(&tasks, "tasks", "track", "=", track.ID); dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+
+	// Summarize
+	summary.TrackID = track.ID
+	summary.Track = summarizeFeedback(nil, "", feedbacks)
+	summary.Tasks = make([]*FeedbackSummary, 0)
+	sort.SliceStable(tasks, func(i, j int) bool {
+		return tasks[i].Shortname < tasks[j].Shortname
+	})
+	for _, task := range tasks {
+		var taskFeedbacks Feedbacks
+		for _, feedback := range feedbacks {
+			if uuidPointersEqual(feedback.TaskID, task.ID) {
+				taskFeedbacks = append(taskFeedbacks, feedback)
+			}
+		}
+		summary.Tasks = append(summary.Tasks, summarizeFeedback(task.ID, task.Shortname, taskFeedbacks))
+	}
+	return rest.Result{}
+}
+
+// load loads the feedback from the path ID, if given by the requester or the requester is an admin.
+func (feedback *Feedback) load(request *rest.Request) rest.Result {
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+	dbResult := db.Select(feedback, "feedback", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		if request.AccessToken.GetRole() == rest.RoleAdmin {
+			return rest.Result{Code: 404, Message: "not found"}
+		}
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+	if request.AccessToken.GetRole() == rest.RoleAdmin {
+		return rest.Result{}
+	}
+	if feedback.UserID == nil || request.AccessToken.OwnerUserID == nil || *feedback.UserID != *request.AccessToken.OwnerUserID {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+	return rest.Result{}
+}
+
+// validate checks the rating and comment, and that the user participates in the timeslot which has begun.
+func (feedback *Feedback) validate() rest.Result {
+	if feedback.Rating < minFeedbackRating || feedback.Rating > maxFeedbackRating {
+		return rest.Result{Code: 400, Message: fmt.Sprintf("rating must be between %v and %v", minFeedbackRating, maxFeedbackRating)}
+	}
+	feedback.Comment = strings.TrimSpace(feedback.Comment)
+	if len(feedback.Comment) > maxFeedbackCommentSize {
+		return rest.Result{Code: 400, Message: fmt.Sprintf("comment is longer than %v characters", maxFeedbackCommentSize)}
+	}
+
+	var timeslot Timeslot
+	timeslotDBResult := db.Select(&timeslot, "timeslots", "id", "=", feedback.TimeslotID)
+	if timeslotDBResult.IsFailed() {
+		return rest.Result{Code: 500, Error: timeslotDBResult.Error}
+	}
+	if !timeslotDBResult.IsSuccess() {
+		return rest.Result{Code: 400, Message: "referenced timeslot does not exist"}
+	}
+	if isParticipant, err := timeslot.isParticipant(feedback.UserID); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	} else if !isParticipant {
+		return rest.Result{Code: 403, Message: "not a participant of the timeslot"}
+	}
+	if timeslot.BeginTime == nil || time.Now().Before(*timeslot.BeginTime) {
+		return rest.Result{Code: 409, Message: "feedback is open once the timeslot has begun"}
+	}
+	feedback.TrackID = timeslot.TrackID
+
+	if feedback.TaskID != nil {
+		var task Task
+		taskDBResult := db.Select(&task, "tasks", "id", "=", feedback.TaskID)
+		if taskDBResult.IsFailed() {
+			return rest.Result{Code: 500, Error: taskDBResult.Error}
+		}
+		if !taskDBResult.IsSuccess() || task.TrackID != timeslot.TrackID {
+			return rest.Result{Code: 400, Message: "referenced task does not exist in the track"}
+		}
+	}
+	return rest.Result{}
+}
+
+// summarizeFeedback aggregates the feedback for the track (no task) or task.
+func summarizeFeedback(taskID *uuid.UUID, taskShortname string, feedbacks Feedbacks) *FeedbackSummary {
+	summary := FeedbackSummary{
+		TaskID:        taskID,
+		TaskShortname: taskShortname,
+		Ratings:       make(map[int]int),
+		Comments:      make([]string, 0),
+	}
+	for rating := minFeedbackRating; rating <= maxFeedbackRating; rating++ {
+		summary.Ratings[rating] = 0
+	}
+	ratingSum := 0
+	for _, feedback := range feedbacks {
+		if !uuidPointersEqual(feedback.TaskID, taskID) {
+			continue
+		}
+		summary.Count++
+		summary.Ratings[feedback.Rating]++
+		ratingSum += feedback.Rating
+		if feedback.Comment != "" {
+			summary.Comments = append(summary.Comments, feedback.Comment)
+		}
+	}
+	if summary.Count > 0 {
+		summary.AverageRating = float64(ratingSum) / float64(summary.Count)
+	}
+	sort.Strings(summary.Comments)
+	return &summary
+}
+
+func uuidPointersEqual(a *uuid.UUID, b *uuid.UUID) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
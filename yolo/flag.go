@@ -0,0 +1,579 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package yolo
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/helper"
+	"github.com/gathering/tech-online-backend/redis"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// TaskFlagKind is how submitted answers are checked against a flag.
+type TaskFlagKind string
+
+const (
+	// TaskFlagKindHash compares the (salted) hash of the answer to the hash of the flag, so the flag is never stored.
+	TaskFlagKindHash TaskFlagKind = "hash"
+	// TaskFlagKindRegex matches the whole answer against a regular expression.
+	TaskFlagKindRegex TaskFlagKind = "regex"
+)
+
+const (
+	defaultFlagMaxAttempts   = 10
+	defaultFlagAttemptWindow = time.Minute
+	flagSaltSize             = 16
+)
+
+// TaskFlag is an accepted answer for a CTF-style task. A correct submission creates a passing test with the flag shortname and name.
+type TaskFlag struct {
+	ID            *uuid.UUID   `column:"id" json:"id"`                         // Generated, required, unique
+	TrackID       string       `column:"track" json:"track"`                   // Required
+	TaskShortname string       `column:"task_shortname" json:"task_shortname"` // Required
+	Shortname     string       `column:"shortname" json:"shortname"`           // Required, shortname of the resulting test, unique together with track and task
+	Name          string       `column:"name" json:"name"`                     // Required, name of the resulting test
+	Kind          TaskFlagKind `column:"kind" json:"kind"`                     // Required
+	CaseSensitive bool         `column:"case_sensitive" json:"case_sensitive"`
+	Flag          string       `column:"-" json:"flag,omitempty"`     // Write-only, required for new hash flags, keeps the old hash if empty when updating
+	Regex         string       `column:"regex" json:"regex"`          // Required for regex flags
+	Salt          string       `column:"salt" json:"-"`               // Generated for hash flags
+	Hash          string       `column:"hash" json:"-"`               // Generated for hash flags, hex SHA-256 of the salt and the flag
+	HasFlag       bool         `column:"-" json:"has_flag,omitempty"` // If a hash flag has a hash, in responses
+}
+
+// TaskFlags is a list of task flags.
+type TaskFlags []*TaskFlag
+
+// FlagSubmission is an attempt to answer a task, without the answer itself.
+type FlagSubmission struct {
+	ID            *uuid.UUID `column:"id" json:"id"`
+	TrackID       string     `column:"track" json:"track"`
+	TaskShortname string     `column:"task_shortname" json:"task_shortname"`
+	StationID     *uuid.UUID `column:"station" json:"station"`
+	TimeslotID    string     `column:"timeslot" json:"timeslot"`
+	UserID        *uuid.UUID `column:"user" json:"user"`
+	Actor         string     `column:"actor" json:"actor"`
+	Timestamp     *time.Time `column:"timestamp" json:"timestamp"`
+	Correct       bool       `column:"correct" json:"correct"`
+	FlagID        *uuid.UUID `column:"flag" json:"flag"`               // Matching flag, if correct
+	AnswerHash    string     `column:"answer_hash" json:"answer_hash"` // Hash of the answer, to find identical answers across teams
+}
+
+// FlagSubmissions is a list of flag submissions.
+type FlagSubmissions []*FlagSubmission
+
+// StationFlagSubmitRequest is a request to submit an answer for a task for the timeslot assigned to the station.
+type StationFlagSubmitRequest struct {
+	TaskShortname string `json:"task_shortname"` // Required
+	Answer        string `json:"answer"`         // Required, surrounding whitespace is ignored
+	Correct       bool   `json:"correct"`        // In the response
+}
+
+var flagRateLimiter *helper.RateLimiter
+var flagRateLimiterLock sync.Mutex
+
+func init() {
+	rest.AddHandler("/task-flags/", "^$", func() interface{} { return &TaskFlags{} })
+	rest.AddHandler("/task-flag/", "^(?:(?P<id>[^/]+)/)?$", func() interface{} { return &TaskFlag{} })
+	rest.AddHandler("/flag-submissions/", "^$", func() interface{} { return &FlagSubmissions{} })
+	rest.AddHandler("/station/", "^(?P<id>[^/]+)/submit-flag/$", func() interface{} { return &StationFlagSubmitRequest{} })
+	config.OnReload(func(changed []string) {
+		if config.ChangedSection(changed, "flags") {
+			flagRateLimiterLock.Lock()
+			flagRateLimiter = nil
+			flagRateLimiterLock.Unlock()
+		}
+	})
+}
+
+// Get gets multiple task flags, without the hashes.
+func (flags *TaskFlags) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params, prep filtering
+	var whereArgs []interface{}
+	if trackID, ok := request.QueryArgs["track"]; ok {
+		whereArgs = append(whereArgs, "track", "=", trackID)
+	}
+	if taskShortname, ok := request.QueryArgs["task-shortname"]; ok {
+		whereArgs = append(whereArgs, "task_shortname", "=", taskShortname)
+	}
+
+	// Get
+	dbResult := db.SelectMany(flags, "task_flags", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	for _, flag := range *flags {
+		flag.HasFlag = flag.Hash != ""
+	}
+	return rest.Result{}
+}
+
+// Get gets a single task flag, without the hash.
+func (flag *TaskFlag) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+
+	// Get
+	dbResult := db.Select(flag, "task_flags", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+	flag.HasFlag = flag.Hash != ""
+	return rest.Result{}
+}
+
+// Post creates a new task flag.
+func (flag *TaskFlag) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Prepare and validate
+	if flag.ID == nil {
+		newID := uuid.New()
+		flag.ID = &newID
+	}
+	if err := flag.prepare(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	if result := flag.validate(); !result.IsOk() {
+		return result
+	}
+	if exists, err := flag.exists(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	} else if exists {
+		return rest.Result{Code: 409, Message: "duplicate"}
+	}
+
+	// Create and redirect
+	dbResult := db.Insert("task_flags", flag)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	return rest.Result{Code: 201, Location: fmt.Sprintf("%v/task-flag/%v/", config.Config.SitePrefix, flag.ID)}
+}
+
+// Put updates a task flag. The old flag hash is kept if no new flag is specified.
+func (flag *TaskFlag) Put(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	rawID, rawIDExists := request.PathArgs["id"]
+	if !rawIDExists || rawID == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+	id, uuidError := uuid.Parse(rawID)
+	if uuidError != nil {
+		return rest.Result{Code: 400, Message: "invalid ID"}
+	}
+	if flag.ID != nil && *flag.ID != id {
+		return rest.Result{Code: 400, Message: "mismatch between URL and JSON IDs"}
+	}
+	flag.ID = &id
+
+	// Get old hash
+	var oldFlag TaskFlag
+	dbResult := db.Select(&oldFlag, "task_flags", "id", "=", flag.ID)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+	if flag.Flag == "" && oldFlag.CaseSensitive == flag.CaseSensitive {
+		flag.Salt = oldFlag.Salt
+		flag.Hash = oldFlag.Hash
+	}
+
+	// Validate
+	if err := flag.prepare(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	if result := flag.validate(); !result.IsOk() {
+		return result
+	}
+
+	// Update
+	updateDBResult := db.Update("task_flags", flag, "id", "=", flag.ID)
+	if updateDBResult.IsFailed() {
+		return rest.Result{Code: 500, Error: updateDBResult.Error}
+	}
+	return rest.Result{}
+}
+
+// Delete deletes a task flag. Tests from earlier correct submissions are kept.
+func (flag *TaskFlag) Delete(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	rawID, rawIDExists := request.PathArgs["id"]
+	if !rawIDExists || rawID == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+	id, uuidError := uuid.Parse(rawID)
+	if uuidError != nil {
+		return rest.Result{Code: 400, Message: "invalid ID"}
+	}
+
+	// Check if it exists
+	flag.ID = &id
+	exists, err := flag.exists()
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	if !exists {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+
+	// Delete it
+	dbResult := db.Delete("task_flags", "id", "=", flag.ID)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	return rest.Result{}
+}
+
+// Get gets the submission history, newest first.
+// Use the "station", "timeslot" and "task-shortname" query args to filter.
+func (submissions *FlagSubmissions) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params, prep filtering
+	var whereArgs []interface{}
+	if stationID, ok := request.QueryArgs["station"]; ok {
+		whereArgs = append(whereArgs, "station", "=", stationID)
+	}
+	if timeslotID, ok := request.QueryArgs["timeslot"]; ok {
+		whereArgs = append(whereArgs, "timeslot", "=", timeslotID)
+	}
+	if taskShortname, ok := request.QueryArgs["task-shortname"]; ok {
+		whereArgs = append(whereArgs, "task_shortname", "=", taskShortname)
+	}
+
+	// Get
+	dbResult := db.SelectMany(submissions, "flag_submissions", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	sort.SliceStable(*submissions, func(i, j int) bool {
+		return (*submissions)[i].Timestamp.After(*(*submissions)[j].Timestamp)
+	})
+	if request.ListLimit > 0 && len(*submissions) > request.ListLimit {
+		*submissions = (*submissions)[:request.ListLimit]
+	}
+	return rest.Result{}
+}
+
+// Post checks the answer against the flags of the task and records the attempt.
+// A correct answer creates a passing test for the station.
+// Attempts are rate limited per timeslot and task.
+func (submitRequest *StationFlagSubmitRequest) Post(request *rest.Request) rest.Result {
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+	answer := strings.TrimSpace(submitRequest.Answer)
+	switch {
+	case submitRequest.TaskShortname == "":
+		return rest.Result{Code: 400, Message: "missing task shortname"}
+	case answer == "":
+		return rest.Result{Code: 400, Message: "missing answer"}
+	}
+	var station Station
+	stationDBResult := db.Select(&station, "stations", "id", "=", id)
+	if stationDBResult.IsFailed() {
+		return rest.Result{Code: 500, Error: stationDBResult.Error}
+	}
+	if !stationDBResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+
+	// Check perms
+	if result := station.checkParticipantPerms(request.AccessToken); !result.IsOk() {
+		return result
+	}
+	if station.TimeslotID == "" {
+		return rest.Result{Code: 400, Message: "station is not assigned to a timeslot"}
+	}
+
+	// Rate limit
+	allowed, wait := getFlagRateLimiter().Allow(station.TimeslotID + "/" + submitRequest.TaskShortname)
+	if !allowed {
+		return rest.Result{Code: 429, Message: fmt.Sprintf("too many attempts, try again in %v seconds", int(math.Ceil(wait.Seconds())))}
+	}
+
+	// Check
+	var flags TaskFlags
+	flagsDBResult := db.SelectMany(&flags, "task_flags", "track", "=", station.TrackID, "task_shortname", "=", submitRequest.TaskShortname)
+	if flagsDBResult.IsFailed() {
+		return rest.Result{Code: 500, Error: flagsDBResult.Error}
+	}
+	if len(flags) == 0 {
+		return rest.Result{Code: 404, Message: "task has no flags"}
+	}
+	var matchingFlag *TaskFlag
+	for _, flag := range flags {
+		if flag.matches(answer) {
+			matchingFlag = flag
+			break
+		}
+	}
+
+	// Record
+	submissionID := uuid.New()
+	now := time.Now()
+	submission := FlagSubmission{
+		ID:            &submissionID,
+		TrackID:       station.TrackID,
+		TaskShortname: submitRequest.TaskShortname,
+		StationID:     station.ID,
+		TimeslotID:    station.TimeslotID,
+		UserID:        request.AccessToken.OwnerUserID,
+		Actor:         request.AccessToken.GetName(),
+		Timestamp:     &now,
+		Correct:       matchingFlag != nil,
+		AnswerHash:    hashSubmittedAnswer(station.TrackID, submitRequest.TaskShortname, answer),
+	}
+	if matchingFlag != nil {
+		submission.FlagID = matchingFlag.ID
+	}
+	if dbResult := db.Insert("flag_submissions", submission); dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	request.Log().WithFields(log.Fields{
+		"station": station.ID,
+		"task":    submitRequest.TaskShortname,
+		"actor":   submission.Actor,
+		"correct": submission.Correct,
+	}).Info("Flag submitted")
+
+	// Pass
+	submitRequest.Answer = ""
+	submitRequest.Correct = submission.Correct
+	if matchingFlag == nil {
+		return rest.Result{}
+	}
+	testID := uuid.New()
+	success := true
+	test := Test{
+		ID:                &testID,
+		TrackID:           station.TrackID,
+		TaskShortname:     submitRequest.TaskShortname,
+		Shortname:         matchingFlag.Shortname,
+		StationShortname:  station.Shortname,
+		Name:              matchingFlag.Name,
+		Timestamp:         &now,
+		StatusSuccess:     &success,
+		StatusDescription: fmt.Sprintf("Correct answer submitted by %v", submission.Actor),
+	}
+	return test.save()
+}
+
+// hashSubmittedAnswer hashes the answer for comparing submissions, without storing the answer itself.
+func hashSubmittedAnswer(trackID string, taskShortname string, answer string) string {
+	hash := sha256.Sum256([]byte(trackID + "/" + taskShortname + "/" + answer))
+	return hex.EncodeToString(hash[:])
+}
+
+// getFlagRateLimiter gets the rate limiter, creating it from the config if new or reset by a config reload.
+func getFlagRateLimiter() *helper.RateLimiter {
+	flagRateLimiterLock.Lock()
+	defer flagRateLimiterLock.Unlock()
+	if flagRateLimiter == nil {
+		maxAttempts := defaultFlagMaxAttempts
+		if config.Config.Flags.MaxAttempts > 0 {
+			maxAttempts = config.Config.Flags.MaxAttempts
+		}
+		window := defaultFlagAttemptWindow
+		if config.Config.Flags.WindowSeconds > 0 {
+			window = time.Duration(config.Config.Flags.WindowSeconds) * time.Second
+		}
+		flagRateLimiter = redis.NewRateLimiter("flags", maxAttempts, window)
+	}
+	return flagRateLimiter
+}
+
+// prepare hashes the flag, if a new one was specified.
+func (flag *TaskFlag) prepare() error {
+	if flag.Kind != TaskFlagKindHash || flag.Flag == "" {
+		return nil
+	}
+	salt := make([]byte, flagSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	flag.Salt = hex.EncodeToString(salt)
+	flag.Hash = flag.hashAnswer(strings.TrimSpace(flag.Flag))
+	flag.Flag = ""
+	return nil
+}
+
+func (flag *TaskFlag) hashAnswer(answer string) string {
+	if !flag.CaseSensitive {
+		answer = strings.ToLower(answer)
+	}
+	sum := sha256.Sum256([]byte(flag.Salt + answer))
+	return hex.EncodeToString(sum[:])
+}
+
+// matches checks if the (trimmed) answer is accepted by the flag.
+func (flag *TaskFlag) matches(answer string) bool {
+	switch flag.Kind {
+	case TaskFlagKindHash:
+		if flag.Hash == "" {
+			return false
+		}
+		return subtle.ConstantTimeCompare([]byte(flag.hashAnswer(answer)), []byte(flag.Hash)) == 1
+	case TaskFlagKindRegex:
+		re, err := flag.compileRegex()
+		if err != nil {
+			log.WithError(err).WithField("flag", flag.ID).Warn("Invalid flag regex")
+			return false
+		}
+		return re.MatchString(answer)
+	default:
+		return false
+	}
+}
+
+func (flag *TaskFlag) compileRegex() (*regexp.Regexp, error) {
+	pattern := "^(?:" + flag.Regex + ")$"
+	if !flag.CaseSensitive {
+		pattern = "(?i)" + pattern
+	}
+	return regexp.Compile(pattern)
+}
+
+func (flag *TaskFlag) exists() (bool, error) {
+	var count int
+	row := db.DB.QueryRow("SELECT COUNT(*) FROM task_flags WHERE id = $1", flag.ID)
+	rowErr := row.Scan(&count)
+	if rowErr != nil {
+		return false, rowErr
+	}
+	return count > 0, nil
+}
+
+func (flag *TaskFlag) existsShortnameWithDifferentID() (bool, error) {
+	var count int
+	row := db.DB.QueryRow("SELECT COUNT(*) FROM task_flags WHERE track = $1 AND task_shortname = $2 AND shortname = $3 AND id != $4",
+		flag.TrackID, flag.TaskShortname, flag.Shortname, flag.ID)
+	rowErr := row.Scan(&count)
+	if rowErr != nil {
+		return false, rowErr
+	}
+	return count > 0, nil
+}
+
+// validateFields checks the fields of the flag, without looking anything up.
+func (flag *TaskFlag) validateFields() rest.Result {
+	switch {
+	case flag.ID == nil:
+		return rest.Result{Code: 400, Message: "missing ID"}
+	case flag.TrackID == "":
+		return rest.Result{Code: 400, Message: "missing track ID"}
+	case flag.TaskShortname == "":
+		return rest.Result{Code: 400, Message: "missing task shortname"}
+	case flag.Shortname == "":
+		return rest.Result{Code: 400, Message: "missing shortname"}
+	case flag.Name == "":
+		return rest.Result{Code: 400, Message: "missing name"}
+	}
+	switch flag.Kind {
+	case TaskFlagKindHash:
+		if flag.Hash == "" {
+			return rest.Result{Code: 400, Message: "missing flag"}
+		}
+		flag.Regex = ""
+	case TaskFlagKindRegex:
+		if flag.Regex == "" {
+			return rest.Result{Code: 400, Message: "missing regex"}
+		}
+		if _, err := flag.compileRegex(); err != nil {
+			return rest.Result{Code: 400, Message: fmt.Sprintf("invalid regex: %v", err)}
+		}
+		flag.Salt = ""
+		flag.Hash = ""
+	default:
+		return rest.Result{Code: 400, Message: "invalid kind"}
+	}
+	return rest.Result{}
+}
+
+func (flag *TaskFlag) validate() rest.Result {
+	if result := flag.validateFields(); !result.IsOk() {
+		return result
+	}
+
+	task := Task{TrackID: flag.TrackID, Shortname: flag.TaskShortname}
+	if exists, err := task.existsShortname(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	} else if !exists {
+		return rest.Result{Code: 400, Message: "referenced task does not exist"}
+	}
+	if exists, err := flag.existsShortnameWithDifferentID(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	} else if exists {
+		return rest.Result{Code: 409, Message: "shortname is already used with a different flag for the task"}
+	}
+	return rest.Result{}
+}
@@ -0,0 +1,332 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// personalDataErasure is what happens to the matching rows of a table when a user is erased.
+type personalDataErasure int
+
+const (
+	// personalDataDelete deletes the rows.
+	personalDataDelete personalDataErasure = iota
+	// personalDataAnonymize keeps the rows (e.g. competition results) linked to the anonymized user,
+	// replacing names in actor columns and clearing free-text columns.
+	personalDataAnonymize
+)
+
+// personalDataTable describes where a table stores data about users, for exports and erasure.
+// Rows match if the user column contains the user ID or an actor column contains the username.
+type personalDataTable struct {
+	table         string
+	userColumn    string   // Column with the user ID, if any
+	actorColumns  []string // Columns with the username of the user who did something, if any
+	scrubColumns  []string // Free-text columns cleared when anonymizing
+	secretColumns []string // Columns left out of exports, e.g. token keys
+	erasure       personalDataErasure
+	eraseFiles    func(userID uuid.UUID) error // Optional, removes files belonging to the user before the rows are erased
+}
+
+// personalDataTables is the registry of tables with personal data, excluding the users table itself.
+// Features storing personal data in new tables must register them using registerPersonalData.
+var personalDataTables []personalDataTable
+
+// PersonalDataExport is an archive of all personal data about a user.
+type PersonalDataExport struct {
+	raw *rest.RawResponse
+}
+
+// PersonalDataEraseRequest is a request to erase the personal data of a user, anonymizing what's kept.
+// The username must be repeated as confirmation.
+type PersonalDataEraseRequest struct {
+	ConfirmUsername string `json:"confirm_username"`
+	Anonymized      string `json:"anonymized"` // Response only, the new username
+}
+
+func init() {
+	rest.AddHandler("/user/", "^(?P<id>[^/]+)/personal-data/$", func() interface{} { return &PersonalDataExport{} })
+	rest.AddHandler("/user/", "^(?P<id>[^/]+)/erase/$", func() interface{} { return &PersonalDataEraseRequest{} })
+
+	registerPersonalData(personalDataTable{table: "access_tokens", userColumn: "owner_user", secretColumns: []string{"key"}, erasure: personalDataDelete})
+	registerPersonalData(personalDataTable{table: "registrations", userColumn: "user", scrubColumns: []string{"notes"}, erasure: personalDataAnonymize})
+	registerPersonalData(personalDataTable{table: "team_members", userColumn: "user", erasure: personalDataAnonymize})
+	registerPersonalData(personalDataTable{table: "timeslots", userColumn: "user", scrubColumns: []string{"notes"}, erasure: personalDataAnonymize})
+	registerPersonalData(personalDataTable{table: "timeslot_extensions", actorColumns: []string{"requested_by", "decided_by"}, erasure: personalDataAnonymize})
+	registerPersonalData(personalDataTable{table: "station_assignments", actorColumns: []string{"actor"}, erasure: personalDataAnonymize})
+	registerPersonalData(personalDataTable{table: "notifications", userColumn: "user", erasure: personalDataDelete})
+	registerPersonalData(personalDataTable{table: "notification_settings", userColumn: "user", erasure: personalDataDelete})
+	registerPersonalData(personalDataTable{table: "email_log", userColumn: "user", erasure: personalDataDelete})
+	registerPersonalData(personalDataTable{table: "console_sessions", userColumn: "user", actorColumns: []string{"actor"}, erasure: personalDataAnonymize, eraseFiles: eraseConsoleRecordings})
+	registerPersonalData(personalDataTable{table: "ssh_keys", userColumn: "user", erasure: personalDataDelete})
+	registerPersonalData(personalDataTable{table: "hint_unlocks", actorColumns: []string{"actor"}, erasure: personalDataAnonymize})
+	registerPersonalData(personalDataTable{table: "flag_submissions", userColumn: "user", actorColumns: []string{"actor"}, erasure: personalDataAnonymize})
+	registerPersonalData(personalDataTable{table: "document_revisions", actorColumns: []string{"author"}, erasure: personalDataAnonymize})
+	registerPersonalData(personalDataTable{table: "attachments", actorColumns: []string{"uploader"}, erasure: personalDataAnonymize})
+}
+
+// registerPersonalData adds a table to the personal data registry.
+func registerPersonalData(table personalDataTable) {
+	personalDataTables = append(personalDataTables, table)
+}
+
+// Get builds a zip archive with a JSON file per table with personal data about the user.
+func (export *PersonalDataExport) Get(request *rest.Request) rest.Result {
+	// Check params and perms
+	var user rest.User
+	if result := loadPersonalDataUser(request, &user); !result.IsOk() {
+		return result
+	}
+
+	// Build
+	data, err := buildPersonalDataArchive(&user)
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	export.raw = &rest.RawResponse{
+		ContentType: "application/zip",
+		Filename:    fmt.Sprintf("personal-data-%v.zip", user.Username),
+		Data:        data,
+	}
+	return rest.Result{}
+}
+
+// RawResponse returns the archive.
+func (export *PersonalDataExport) RawResponse() *rest.RawResponse {
+	return export.raw
+}
+
+// Post erases the personal data of the user.
+// Data without value for others is deleted, the rest (e.g. timeslots and scores) is kept but linked to the anonymized user.
+func (eraseRequest *PersonalDataEraseRequest) Post(request *rest.Request) rest.Result {
+	// Check params and perms
+	var user rest.User
+	if result := loadPersonalDataUser(request, &user); !result.IsOk() {
+		return result
+	}
+	if eraseRequest.ConfirmUsername != user.Username {
+		return rest.Result{Code: 400, Message: "confirm_username does not match the username"}
+	}
+
+	// Erase
+	anonymized, err := erasePersonalData(&user)
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	request.Log().WithFields(log.Fields{
+		"user":  user.ID,
+		"actor": request.AccessToken.GetName(),
+	}).Info("Erased personal data of user")
+
+	eraseRequest.ConfirmUsername = ""
+	eraseRequest.Anonymized = anonymized
+	return rest.Result{}
+}
+
+// loadPersonalDataUser loads the user from the "id" path arg, if the token is the user or an admin.
+func loadPersonalDataUser(request *rest.Request, user *rest.User) rest.Result {
+	rawID, rawIDExists := request.PathArgs["id"]
+	if !rawIDExists || rawID == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+	id, idErr := uuid.Parse(rawID)
+	if idErr != nil {
+		return rest.Result{Code: 400, Message: "invalid ID"}
+	}
+	isSelf := request.AccessToken.OwnerUserID != nil && *request.AccessToken.OwnerUserID == id
+	if !isSelf && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	dbResult := db.Select(user, "users", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+	return rest.Result{}
+}
+
+// where builds the condition matching the user's rows, with the args.
+func (table *personalDataTable) where(user *rest.User) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	if table.userColumn != "" {
+		args = append(args, user.ID.String())
+		conditions = append(conditions, fmt.Sprintf("\"%v\" = $%v", table.userColumn, len(args)))
+	}
+	for _, column := range table.actorColumns {
+		args = append(args, user.Username)
+		conditions = append(conditions, fmt.Sprintf("\"%v\" = $%v", column, len(args)))
+	}
+	return strings.Join(conditions, " OR "), args
+}
+
+// buildPersonalDataArchive writes the user and all matching rows of the registered tables as JSON.
+func buildPersonalDataArchive(user *rest.User) ([]byte, error) {
+	var buffer bytes.Buffer
+	archive := zip.NewWriter(&buffer)
+	now := time.Now()
+	addFile := func(name string, data []byte) error {
+		writer, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: now})
+		if err != nil {
+			return err
+		}
+		_, err = writer.Write(data)
+		return err
+	}
+
+	userData, err := json.MarshalIndent(user, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := addFile("user.json", userData); err != nil {
+		return nil, err
+	}
+
+	for _, table := range personalDataTables {
+		selection := "row_to_json(t)::jsonb"
+		for _, column := range table.secretColumns {
+			selection += fmt.Sprintf(" - '%v'", column)
+		}
+		where, args := table.where(user)
+		rows, err := db.DB.Query(fmt.Sprintf("SELECT %v FROM %v t WHERE %v", selection, table.table, where), args...)
+		if err != nil {
+			return nil, err
+		}
+		tableRows := make([]json.RawMessage, 0)
+		for rows.Next() {
+			var row []byte
+			if err := rows.Scan(&row); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			tableRows = append(tableRows, json.RawMessage(row))
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		if len(tableRows) == 0 {
+			continue
+		}
+		tableData, err := json.MarshalIndent(tableRows, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		if err := addFile(table.table+".json", tableData); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// erasePersonalData deletes or anonymizes all personal data about the user in one transaction, returning the new username.
+// The user is kept with an anonymous name so kept rows still reference an existing user.
+func erasePersonalData(user *rest.User) (string, error) {
+	for _, table := range personalDataTables {
+		if table.eraseFiles != nil {
+			if err := table.eraseFiles(*user.ID); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	anonymized := "deleted-" + user.ID.String()
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	for _, table := range personalDataTables {
+		if err := table.erase(tx, user, anonymized); err != nil {
+			tx.Rollback()
+			return "", fmt.Errorf("failed to erase personal data from %v: %w", table.table, err)
+		}
+	}
+	if _, err := tx.Exec("UPDATE users SET username = $1, display_name = $2, email_address = '', seat_hall = '', seat_row = '', seat = '' WHERE id = $3", anonymized, "Deleted user", user.ID.String()); err != nil {
+		tx.Rollback()
+		return "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return anonymized, nil
+}
+
+// erase deletes or anonymizes the user's rows.
+func (table *personalDataTable) erase(tx *sql.Tx, user *rest.User, anonymized string) error {
+	if table.erasure == personalDataDelete {
+		where, args := table.where(user)
+		_, err := tx.Exec(fmt.Sprintf("DELETE FROM %v WHERE %v", table.table, where), args...)
+		return err
+	}
+
+	if table.userColumn != "" && len(table.scrubColumns) > 0 {
+		var assignments []string
+		for _, column := range table.scrubColumns {
+			assignments = append(assignments, fmt.Sprintf("\"%v\" = ''", column))
+		}
+		statement := fmt.Sprintf("UPDATE %v SET %v WHERE \"%v\" = $1", table.table, strings.Join(assignments, ", "), table.userColumn)
+		if _, err := tx.Exec(statement, user.ID.String()); err != nil {
+			return err
+		}
+	}
+	for _, column := range table.actorColumns {
+		statement := fmt.Sprintf("UPDATE %v SET \"%v\" = $1 WHERE \"%v\" = $2", table.table, column, column)
+		if _, err := tx.Exec(statement, anonymized, user.Username); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eraseConsoleRecordings deletes the recordings of the user's console sessions, since they may contain anything typed.
+func eraseConsoleRecordings(userID uuid.UUID) error {
+	var sessions ConsoleSessions
+	dbResult := db.SelectMany(&sessions, "console_sessions", "user", "=", userID)
+	if dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	for _, session := range sessions {
+		if err := os.Remove(consoleRecordingPath(*session.ID)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
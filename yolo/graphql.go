@@ -0,0 +1,333 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	content "github.com/gathering/tech-online-backend/doc"
+	"github.com/gathering/tech-online-backend/graphql"
+	"github.com/gathering/tech-online-backend/rest"
+)
+
+// GraphQLQuery is a read-only GraphQL query over tracks, stations, tasks, tests, documents and timeslots.
+// The query fields are cleared in the response, which has the data or the errors.
+type GraphQLQuery struct {
+	Query         string                 `json:"query,omitempty"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+	Data          interface{}            `json:"data,omitempty"`
+	Errors        []*graphql.Error       `json:"errors,omitempty"`
+}
+
+// graphQLRelation resolves a field of the parents through a REST list getter, with one request for all the parents.
+// The keys link the children to the parents, and keys shared by all the parents are used as filters (if the filter arg is set).
+type graphQLRelation struct {
+	list       func() rest.Getter
+	parentKeys func(parent interface{}) []string
+	childKeys  func(child interface{}) []string
+	filterArgs []string // REST query args for the keys, empty if the getter has no filter for the key
+	single     bool     // The first matching child instead of a list
+}
+
+type graphQLRequestKey struct{}
+
+var graphQLSchema = makeGraphQLSchema()
+
+func init() {
+	rest.AddHandler("/graphql/", "^$", func() interface{} { return &GraphQLQuery{} })
+}
+
+// Get runs a query from the "query", "operationName" and "variables" (JSON) query args.
+func (query *GraphQLQuery) Get(request *rest.Request) rest.Result {
+	query.Query = request.QueryArgs["query"]
+	query.OperationName = request.QueryArgs["operationName"]
+	if rawVariables, ok := request.QueryArgs["variables"]; ok && rawVariables != "" {
+		if err := json.Unmarshal([]byte(rawVariables), &query.Variables); err != nil {
+			return rest.Result{Code: 400, Message: "malformed variables"}
+		}
+	}
+	return query.execute(request)
+}
+
+// Post runs a query from the body.
+func (query *GraphQLQuery) Post(request *rest.Request) rest.Result {
+	return query.execute(request)
+}
+
+func (query *GraphQLQuery) execute(request *rest.Request) rest.Result {
+	// Check params
+	if query.Query == "" {
+		return rest.Result{Code: 400, Message: "missing query"}
+	}
+
+	// Run, using the REST getters to get the same permissions
+	ctx := context.WithValue(request.Context(), graphQLRequestKey{}, request)
+	response, err := graphql.Execute(ctx, graphQLSchema, query.Query, query.OperationName, query.Variables)
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	*query = GraphQLQuery{Data: response.Data, Errors: response.Errors}
+	return rest.Result{}
+}
+
+func makeGraphQLSchema() *graphql.Schema {
+	track := graphql.NewObject("Track", Track{})
+	station := graphql.NewObject("Station", Station{})
+	task := graphql.NewObject("Task", Task{})
+	test := graphql.NewObject("Test", Test{})
+	timeslot := graphql.NewObject("Timeslot", Timeslot{})
+	document := graphql.NewObject("Document", content.Document{})
+
+	trackByID := graphQLRelation{
+		list:       func() rest.Getter { return &Tracks{} },
+		childKeys:  func(child interface{}) []string { return []string{child.(*Track).ID} },
+		filterArgs: []string{""},
+		single:     true,
+	}
+
+	// Track
+	track.Fields["stations"] = &graphql.Field{Type: station, Args: []string{"status", "health"}, Resolve: graphQLRelation{
+		list:       func() rest.Getter { return &Stations{} },
+		parentKeys: func(parent interface{}) []string { return []string{parent.(*Track).ID} },
+		childKeys:  func(child interface{}) []string { return []string{child.(*Station).TrackID} },
+		filterArgs: []string{"track"},
+	}.resolve}
+	track.Fields["tasks"] = &graphql.Field{Type: task, Resolve: graphQLRelation{
+		list:       func() rest.Getter { return &Tasks{} },
+		parentKeys: func(parent interface{}) []string { return []string{parent.(*Track).ID} },
+		childKeys:  func(child interface{}) []string { return []string{child.(*Task).TrackID} },
+		filterArgs: []string{"track"},
+	}.resolve}
+	track.Fields["timeslots"] = &graphql.Field{Type: timeslot, Args: []string{"user", "team", "category", "not_ended", "assigned_station", "not_assigned_station"}, Resolve: graphQLRelation{
+		list:       func() rest.Getter { return &Timeslots{} },
+		parentKeys: func(parent interface{}) []string { return []string{parent.(*Track).ID} },
+		childKeys:  func(child interface{}) []string { return []string{child.(*Timeslot).TrackID} },
+		filterArgs: []string{"track"},
+	}.resolve}
+
+	// Station
+	stationTrack := trackByID
+	stationTrack.parentKeys = func(parent interface{}) []string { return []string{parent.(*Station).TrackID} }
+	station.Fields["track"] = &graphql.Field{Type: track, Resolve: stationTrack.resolve}
+	station.Fields["tests"] = &graphql.Field{Type: test, Args: []string{"task_shortname", "timeslot", "latest"}, Resolve: graphQLRelation{
+		list: func() rest.Getter { return &Tests{} },
+		parentKeys: func(parent interface{}) []string {
+			return []string{parent.(*Station).TrackID, parent.(*Station).Shortname}
+		},
+		childKeys: func(child interface{}) []string {
+			return []string{child.(*Test).TrackID, child.(*Test).StationShortname}
+		},
+		filterArgs: []string{"track", "station_shortname"},
+	}.resolve}
+
+	// Task
+	taskTrack := trackByID
+	taskTrack.parentKeys = func(parent interface{}) []string { return []string{parent.(*Task).TrackID} }
+	task.Fields["track"] = &graphql.Field{Type: track, Resolve: taskTrack.resolve}
+	task.Fields["tests"] = &graphql.Field{Type: test, Args: []string{"station_shortname", "timeslot", "latest"}, Resolve: graphQLRelation{
+		list:       func() rest.Getter { return &Tests{} },
+		parentKeys: func(parent interface{}) []string { return []string{parent.(*Task).TrackID, parent.(*Task).Shortname} },
+		childKeys:  func(child interface{}) []string { return []string{child.(*Test).TrackID, child.(*Test).TaskShortname} },
+		filterArgs: []string{"track", "task_shortname"},
+	}.resolve}
+
+	// Test
+	testTrack := trackByID
+	testTrack.parentKeys = func(parent interface{}) []string { return []string{parent.(*Test).TrackID} }
+	test.Fields["track"] = &graphql.Field{Type: track, Resolve: testTrack.resolve}
+	test.Fields["task"] = &graphql.Field{Type: task, Resolve: graphQLRelation{
+		list: func() rest.Getter { return &Tasks{} },
+		parentKeys: func(parent interface{}) []string {
+			return []string{parent.(*Test).TrackID, parent.(*Test).TaskShortname}
+		},
+		childKeys:  func(child interface{}) []string { return []string{child.(*Task).TrackID, child.(*Task).Shortname} },
+		filterArgs: []string{"track", "shortname"},
+		single:     true,
+	}.resolve}
+	test.Fields["station"] = &graphql.Field{Type: station, Resolve: graphQLRelation{
+		list: func() rest.Getter { return &Stations{} },
+		parentKeys: func(parent interface{}) []string {
+			return []string{parent.(*Test).TrackID, parent.(*Test).StationShortname}
+		},
+		childKeys: func(child interface{}) []string {
+			return []string{child.(*Station).TrackID, child.(*Station).Shortname}
+		},
+		filterArgs: []string{"track", "shortname"},
+		single:     true,
+	}.resolve}
+
+	// Timeslot
+	timeslotTrack := trackByID
+	timeslotTrack.parentKeys = func(parent interface{}) []string { return []string{parent.(*Timeslot).TrackID} }
+	timeslot.Fields["track"] = &graphql.Field{Type: track, Resolve: timeslotTrack.resolve}
+	timeslot.Fields["stations"] = &graphql.Field{Type: station, Resolve: graphQLRelation{
+		list:       func() rest.Getter { return &Stations{} },
+		parentKeys: func(parent interface{}) []string { return []string{parent.(*Timeslot).ID.String()} },
+		childKeys:  func(child interface{}) []string { return []string{child.(*Station).TimeslotID} },
+		filterArgs: []string{"timeslot"},
+	}.resolve}
+
+	query := &graphql.Object{Name: "Query", Fields: map[string]*graphql.Field{
+		"tracks":    {Type: track, Args: []string{"type"}, Resolve: graphQLRootList(func() rest.Getter { return &Tracks{} })},
+		"track":     {Type: track, Args: []string{"id"}, Resolve: graphQLRootSingle(func() rest.Getter { return &Track{} }, map[string]string{"id": "id"})},
+		"stations":  {Type: station, Args: []string{"track", "shortname", "status", "health", "default_status", "timeslot"}, Resolve: graphQLRootList(func() rest.Getter { return &Stations{} })},
+		"station":   {Type: station, Args: []string{"id"}, Resolve: graphQLRootSingle(func() rest.Getter { return &Station{} }, map[string]string{"id": "id"})},
+		"tasks":     {Type: task, Args: []string{"track", "shortname", "station_shortname"}, Resolve: graphQLRootList(func() rest.Getter { return &Tasks{} })},
+		"task":      {Type: task, Args: []string{"id"}, Resolve: graphQLRootSingle(func() rest.Getter { return &Task{} }, map[string]string{"id": "id"})},
+		"tests":     {Type: test, Args: []string{"track", "task_shortname", "shortname", "station_shortname", "timeslot", "latest"}, Resolve: graphQLRootList(func() rest.Getter { return &Tests{} })},
+		"test":      {Type: test, Args: []string{"id"}, Resolve: graphQLRootSingle(func() rest.Getter { return &Test{} }, map[string]string{"id": "id"})},
+		"timeslots": {Type: timeslot, Args: []string{"user", "team", "track", "category", "not_ended", "assigned_station", "not_assigned_station"}, Resolve: graphQLRootList(func() rest.Getter { return &Timeslots{} })},
+		"timeslot":  {Type: timeslot, Args: []string{"id"}, Resolve: graphQLRootSingle(func() rest.Getter { return &Timeslot{} }, map[string]string{"id": "id"})},
+		"documents": {Type: document, Args: []string{"family", "shortname", "status"}, Resolve: graphQLRootList(func() rest.Getter { return &content.Documents{} })},
+		"document":  {Type: document, Args: []string{"family", "shortname"}, Resolve: graphQLRootSingle(func() rest.Getter { return &content.Document{} }, map[string]string{"family": "family_id", "shortname": "shortname"})},
+	}}
+	return &graphql.Schema{Query: query}
+}
+
+// graphQLRootList resolves a root list field through the REST getter.
+func graphQLRootList(list func() rest.Getter) graphql.Resolver {
+	return func(ctx context.Context, parents []interface{}, args graphql.Args) ([]interface{}, error) {
+		children, err := graphQLGetList(ctx, list(), args)
+		return []interface{}{children}, err
+	}
+}
+
+// graphQLRootSingle resolves a root object field through the REST getter, with the (required) arguments as path args.
+// Missing objects are null.
+func graphQLRootSingle(item func() rest.Getter, pathArgs map[string]string) graphql.Resolver {
+	return func(ctx context.Context, parents []interface{}, args graphql.Args) ([]interface{}, error) {
+		request := *ctx.Value(graphQLRequestKey{}).(*rest.Request)
+		request.PathArgs = make(map[string]string)
+		request.QueryArgs = make(map[string]string)
+		for argName, pathArg := range pathArgs {
+			value, ok := args.String(argName)
+			if !ok {
+				return nil, graphql.Errorf("missing argument %q", argName)
+			}
+			request.PathArgs[pathArg] = value
+		}
+		getter := item()
+		result := getter.Get(&request)
+		if result.Code == 404 {
+			return []interface{}{nil}, nil
+		}
+		if err := graphQLResultError(result); err != nil {
+			return nil, err
+		}
+		return []interface{}{getter}, nil
+	}
+}
+
+func (relation graphQLRelation) resolve(ctx context.Context, parents []interface{}, args graphql.Args) ([]interface{}, error) {
+	// Filter by the keys shared by all the parents
+	filteredArgs := make(graphql.Args, len(args)+len(relation.filterArgs))
+	for name, value := range args {
+		filteredArgs[name] = value
+	}
+	parentKeys := make([][]string, len(parents))
+	for i, parent := range parents {
+		parentKeys[i] = relation.parentKeys(parent)
+	}
+	for j, filterArg := range relation.filterArgs {
+		if filterArg == "" || len(parents) == 0 {
+			continue
+		}
+		shared := true
+		for _, keys := range parentKeys {
+			if keys[j] != parentKeys[0][j] {
+				shared = false
+				break
+			}
+		}
+		if shared {
+			filteredArgs[filterArg] = parentKeys[0][j]
+		}
+	}
+
+	// Get all the children at once and group them by parent
+	children, err := graphQLGetList(ctx, relation.list(), filteredArgs)
+	if err != nil {
+		return nil, err
+	}
+	groups := make(map[string][]interface{})
+	for _, child := range children {
+		key := strings.Join(relation.childKeys(child), "\x00")
+		groups[key] = append(groups[key], child)
+	}
+	values := make([]interface{}, len(parents))
+	for i, keys := range parentKeys {
+		group := groups[strings.Join(keys, "\x00")]
+		if relation.single {
+			if len(group) > 0 {
+				values[i] = group[0]
+			}
+			continue
+		}
+		if group == nil {
+			group = make([]interface{}, 0)
+		}
+		values[i] = group
+	}
+	return values, nil
+}
+
+// graphQLGetList gets a list through the REST getter, with the arguments as query args (e.g. "not_ended" as "not-ended").
+func graphQLGetList(ctx context.Context, list rest.Getter, args graphql.Args) ([]interface{}, error) {
+	request := *ctx.Value(graphQLRequestKey{}).(*rest.Request)
+	request.PathArgs = make(map[string]string)
+	request.QueryArgs = make(map[string]string)
+	for name, value := range args {
+		queryArg := strings.ReplaceAll(name, "_", "-")
+		if flag, ok := value.(bool); ok {
+			// Flag query args only need to be present
+			if flag {
+				request.QueryArgs[queryArg] = ""
+			}
+			continue
+		}
+		request.QueryArgs[queryArg] = fmt.Sprint(value)
+	}
+	if err := graphQLResultError(list.Get(&request)); err != nil {
+		return nil, err
+	}
+	elements := reflect.ValueOf(list).Elem()
+	children := make([]interface{}, elements.Len())
+	for i := range children {
+		children[i] = elements.Index(i).Interface()
+	}
+	return children, nil
+}
+
+// graphQLResultError returns internal errors as they are and other failures as errors for the client.
+func graphQLResultError(result rest.Result) error {
+	if result.Error != nil {
+		return result.Error
+	}
+	if !result.IsOk() {
+		return graphql.Errorf("%v", result.Message)
+	}
+	return nil
+}
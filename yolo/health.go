@@ -0,0 +1,416 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/event"
+	"github.com/gathering/tech-online-backend/probe"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/gathering/tech-online-backend/scheduler"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// StationHealth is the health of a station, as seen by the health checker.
+type StationHealth string
+
+const (
+	// StationHealthUnknown means the station has not been checked (yet), e.g. if health checks are not configured for the track.
+	StationHealthUnknown StationHealth = "unknown"
+	// StationHealthHealthy means the last check succeeded.
+	StationHealthHealthy StationHealth = "healthy"
+	// StationHealthUnhealthy means the last checks failed too many times in a row.
+	StationHealthUnhealthy StationHealth = "unhealthy"
+)
+
+// Event types for station health changes, sent to operators/admins.
+const (
+	EventTypeStationUnhealthy event.Type = "station.unhealthy"
+	EventTypeStationHealthy   event.Type = "station.healthy"
+)
+
+const (
+	healthCheckSchedulerInterval  = 10 * time.Second
+	defaultHealthCheckInterval    = 60 * time.Second
+	defaultHealthCheckTimeout     = 5 * time.Second
+	defaultHealthFailureThreshold = 3
+	maxConcurrentHealthProbes     = 20
+	healthCheckRetention          = 7 * 24 * time.Hour
+)
+
+// StationHealthCheck is the result of a single health check of a station.
+type StationHealthCheck struct {
+	ID        *uuid.UUID `column:"id" json:"id"`
+	StationID *uuid.UUID `column:"station" json:"station"`
+	Timestamp *time.Time `column:"timestamp" json:"timestamp"`
+	Healthy   bool       `column:"healthy" json:"healthy"`
+	LatencyMS int        `column:"latency_ms" json:"latency_ms"`
+	Error     string     `column:"error" json:"error"` // Why it failed, if it failed
+}
+
+// StationHealthChecks is a list of station health checks.
+type StationHealthChecks []*StationHealthCheck
+
+// Consecutive failures per station and last check time per track, only used by the health checker job.
+// Entries of deleted tracks and of deleted or terminated stations are pruned with the history.
+var healthFailureCounts = make(map[uuid.UUID]int)
+var lastTrackHealthChecks = make(map[string]time.Time)
+var healthCheckStateLock sync.Mutex
+
+func init() {
+	rest.AddHandler("/station-health-checks/", "^$", func() interface{} { return &StationHealthChecks{} })
+	scheduler.AddJob("check-station-health", healthCheckSchedulerInterval, checkAllStationHealth)
+}
+
+// Get gets the health check history, newest first.
+// Use the "station" query arg to limit to one station and "limit" to limit the number of checks.
+func (checks *StationHealthChecks) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params, prep filtering
+	var whereArgs []interface{}
+	if stationID, ok := request.QueryArgs["station"]; ok {
+		whereArgs = append(whereArgs, "station", "=", stationID)
+	}
+	limit := 0
+	if rawLimit, ok := request.QueryArgs["limit"]; ok {
+		var err error
+		limit, err = strconv.Atoi(rawLimit)
+		if err != nil || limit < 0 {
+			return rest.Result{Code: 400, Message: "invalid limit"}
+		}
+	}
+
+	// Get
+	dbResult := db.SelectMany(checks, "station_health_checks", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	sort.SliceStable(*checks, func(i, j int) bool {
+		return (*checks)[i].Timestamp.After(*(*checks)[j].Timestamp)
+	})
+	if limit > 0 && len(*checks) > limit {
+		*checks = (*checks)[:limit]
+	}
+	return rest.Result{}
+}
+
+func validateStationHealth(health StationHealth) bool {
+	switch health {
+	case StationHealthUnknown:
+		fallthrough
+	case StationHealthHealthy:
+		fallthrough
+	case StationHealthUnhealthy:
+		return true
+	default:
+		return false
+	}
+}
+
+// checkAllStationHealth checks the stations of all tracks with health checks (configured or by the track type) and due.
+func checkAllStationHealth() error {
+	var tracks Tracks
+	trackDBResult := db.SelectMany(&tracks, "tracks")
+	if trackDBResult.IsFailed() {
+		return trackDBResult.Error
+	}
+
+	// Failures are logged and the rest of the tracks are still checked
+	now := time.Now()
+	failures := 0
+	trackIDs := make(map[string]bool)
+	for _, track := range tracks {
+		trackID := track.ID
+		trackIDs[trackID] = true
+		checkConfig := track.behavior().healthCheck(trackID)
+		if checkConfig.Kind == "" {
+			continue
+		}
+		interval := defaultHealthCheckInterval
+		if checkConfig.IntervalSeconds > 0 {
+			interval = time.Duration(checkConfig.IntervalSeconds) * time.Second
+		}
+		healthCheckStateLock.Lock()
+		due := now.Sub(lastTrackHealthChecks[trackID]) >= interval
+		if due {
+			lastTrackHealthChecks[trackID] = now
+		}
+		healthCheckStateLock.Unlock()
+		if !due {
+			continue
+		}
+
+		if err := checkTrackStationHealth(trackID, checkConfig); err != nil {
+			log.WithError(err).WithField("track", trackID).Warn("Failed to check station health")
+			failures++
+		}
+	}
+
+	// Prune old history and the state of tracks and stations which are gone
+	dbResult := db.Delete("station_health_checks", "timestamp", "<", now.Add(-healthCheckRetention))
+	if dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	if err := pruneHealthCheckState(trackIDs); err != nil {
+		return err
+	}
+	if failures > 0 {
+		return fmt.Errorf("%v tracks failed", failures)
+	}
+	return nil
+}
+
+// pruneHealthCheckState drops the last check times of tracks not in the set and the failure counts of stations
+// which are deleted or terminated.
+func pruneHealthCheckState(trackIDs map[string]bool) error {
+	rows, err := db.DB.Query("SELECT id FROM stations WHERE status != $1", StationStatusTerminated)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	stationIDs := make(map[uuid.UUID]bool)
+	for rows.Next() {
+		var stationID uuid.UUID
+		if err := rows.Scan(&stationID); err != nil {
+			return err
+		}
+		stationIDs[stationID] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	healthCheckStateLock.Lock()
+	defer healthCheckStateLock.Unlock()
+	for trackID := range lastTrackHealthChecks {
+		if !trackIDs[trackID] {
+			delete(lastTrackHealthChecks, trackID)
+		}
+	}
+	for stationID := range healthFailureCounts {
+		if !stationIDs[stationID] {
+			delete(healthFailureCounts, stationID)
+		}
+	}
+	return nil
+}
+
+func checkTrackStationHealth(trackID string, checkConfig config.HealthCheckConfig) error {
+	kind := probe.Kind(checkConfig.Kind)
+	if !probe.ValidateKind(kind) || kind == probe.KindSSH {
+		return fmt.Errorf("invalid health check kind for track %v: %v", trackID, checkConfig.Kind)
+	}
+
+	var stations Stations
+	dbResult := db.SelectMany(&stations, "stations", "track", "=", trackID)
+	if dbResult.IsFailed() {
+		return dbResult.Error
+	}
+
+	// Probe concurrently, but not too many at once
+	var waitGroup sync.WaitGroup
+	semaphore := make(chan struct{}, maxConcurrentHealthProbes)
+	for _, station := range stations {
+		// Stations which are gone or not up yet are expected to be dark
+		if station.Address == "" || station.Status == StationStatusTerminated || station.Status == StationStatusProvisioning {
+			continue
+		}
+		waitGroup.Add(1)
+		semaphore <- struct{}{}
+		go func(station *Station) {
+			defer waitGroup.Done()
+			defer func() { <-semaphore }()
+			target := healthCheckTarget(kind, station.Address, checkConfig)
+			result := probe.Probe(target)
+			if err := station.saveHealthCheck(result, checkConfig); err != nil {
+				log.WithError(err).WithField("station", station.ID).Warn("Failed to save station health check")
+			}
+		}(station)
+	}
+	waitGroup.Wait()
+	return nil
+}
+
+func healthCheckTarget(kind probe.Kind, address string, checkConfig config.HealthCheckConfig) probe.Target {
+	target := probe.Target{
+		Kind:    kind,
+		Timeout: defaultHealthCheckTimeout,
+	}
+	if checkConfig.TimeoutSeconds > 0 {
+		target.Timeout = time.Duration(checkConfig.TimeoutSeconds) * time.Second
+	}
+
+	target.Address = probeAddress(kind, address, checkConfig.Port, checkConfig.Path)
+	return target
+}
+
+// probeAddress gets the probe target address for the station address, i.e. host:port for TCP and the URL for HTTP.
+func probeAddress(kind probe.Kind, address string, port int, path string) string {
+	switch kind {
+	case probe.KindTCP:
+		return net.JoinHostPort(address, strconv.Itoa(port))
+	case probe.KindHTTP:
+		host := address
+		if port > 0 {
+			host = net.JoinHostPort(address, strconv.Itoa(port))
+		} else if net.ParseIP(address) != nil && net.ParseIP(address).To4() == nil {
+			host = "[" + address + "]"
+		}
+		if path == "" {
+			path = "/"
+		}
+		return fmt.Sprintf("http://%v%v", host, path)
+	default:
+		return address
+	}
+}
+
+// saveHealthCheck saves the probe result to the history and updates the station health,
+// alerting operators/admins if a station with a timeslot changes between healthy and unhealthy.
+func (station *Station) saveHealthCheck(result probe.Result, checkConfig config.HealthCheckConfig) error {
+	id := uuid.New()
+	now := time.Now()
+	check := StationHealthCheck{
+		ID:        &id,
+		StationID: station.ID,
+		Timestamp: &now,
+		Healthy:   result.OK,
+		LatencyMS: int(result.Latency / time.Millisecond),
+	}
+	if result.Error != nil {
+		check.Error = result.Error.Error()
+	}
+	if dbResult := db.Insert("station_health_checks", check); dbResult.IsFailed() {
+		return dbResult.Error
+	}
+
+	// Only go unhealthy after enough failures in a row
+	threshold := defaultHealthFailureThreshold
+	if checkConfig.FailureThreshold > 0 {
+		threshold = checkConfig.FailureThreshold
+	}
+	healthCheckStateLock.Lock()
+	if result.OK {
+		healthFailureCounts[*station.ID] = 0
+	} else {
+		healthFailureCounts[*station.ID]++
+	}
+	failures := healthFailureCounts[*station.ID]
+	healthCheckStateLock.Unlock()
+
+	newHealth := station.Health
+	if result.OK {
+		newHealth = StationHealthHealthy
+	} else if failures >= threshold {
+		newHealth = StationHealthUnhealthy
+	}
+
+	// Only update the health fields, the rest of the station may have changed since it was loaded
+	if _, err := db.DB.Exec("UPDATE stations SET health = $1, last_health_check = $2 WHERE id = $3", newHealth, now, station.ID); err != nil {
+		return err
+	}
+
+	previousHealth := station.Health
+	station.Health = newHealth
+	station.LastHealthCheck = &now
+	if newHealth == previousHealth {
+		return nil
+	}
+	log.WithFields(log.Fields{
+		"station": station.ID,
+		"track":   station.TrackID,
+		"health":  newHealth,
+		"error":   check.Error,
+	}).Info("Station health changed")
+
+	// Only alert for stations in use by participants, not under maintenance and not suspended
+	if station.TimeslotID == "" || station.isUnderMaintenance(now) || station.isSuspended() {
+		return nil
+	}
+	if newHealth == StationHealthUnhealthy {
+		message := fmt.Sprintf("Station %v (%v) on track %v is assigned to timeslot %v and failed %v health checks in a row: %v",
+			station.Name, station.Shortname, station.TrackID, station.TimeslotID, failures, check.Error)
+		if location := station.describeLocation(); location != "" {
+			message += fmt.Sprintf(" (%v)", location)
+		}
+		station.publishStaffEvent(EventTypeStationUnhealthy, fmt.Sprintf("Station %v went dark", station.Shortname), message)
+	} else if previousHealth == StationHealthUnhealthy && newHealth == StationHealthHealthy {
+		station.publishStaffEvent(EventTypeStationHealthy, fmt.Sprintf("Station %v is back", station.Shortname),
+			fmt.Sprintf("Station %v (%v) on track %v is healthy again.", station.Name, station.Shortname, station.TrackID))
+	}
+	return nil
+}
+
+func (station *Station) publishStaffEvent(eventType event.Type, title string, message string) {
+	publishStaffEvent(eventType, station.TrackID, title, message, station.ID)
+}
+
+// publishStaffEvent publishes an event to all operators and admins.
+func publishStaffEvent(eventType event.Type, trackID string, title string, message string, data interface{}) {
+	userIDs, err := staffUserIDs()
+	if err != nil {
+		log.WithError(err).Warn("Failed to get operators/admins for staff event")
+	}
+	event.Publish(event.Event{
+		Type:    eventType,
+		TrackID: trackID,
+		UserIDs: userIDs,
+		Title:   title,
+		Message: message,
+		Data:    data,
+	})
+}
+
+// staffUserIDs gets the IDs of all operator and admin users.
+func staffUserIDs() ([]uuid.UUID, error) {
+	rows, err := db.DB.Query("SELECT id FROM users WHERE role = $1 OR role = $2", rest.RoleOperator, rest.RoleAdmin)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var userIDs []uuid.UUID
+	for rows.Next() {
+		var rawID string
+		if err := rows.Scan(&rawID); err != nil {
+			return nil, err
+		}
+		userID, err := uuid.Parse(rawID)
+		if err != nil {
+			continue
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, rows.Err()
+}
@@ -0,0 +1,395 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package yolo
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+)
+
+// Hint is a hint for a task, which participants may unlock in order at the cost of the penalty.
+type Hint struct {
+	ID            *uuid.UUID `column:"id" json:"id"`                         // Generated, required, unique
+	TrackID       string     `column:"track" json:"track"`                   // Required
+	TaskShortname string     `column:"task_shortname" json:"task_shortname"` // Required
+	Sequence      int        `column:"sequence" json:"sequence"`             // Unlock order within the task
+	Content       string     `column:"content" json:"content"`               // Hidden for participants until unlocked
+	Penalty       int        `column:"penalty" json:"penalty"`               // Points subtracted from the score when unlocked, optional
+	Unlocked      bool       `column:"-" json:"unlocked"`                    // If unlocked for the station timeslot, only set when listing for a station
+}
+
+// Hints is a list of hints.
+type Hints []*Hint
+
+// HintUnlock is a hint unlocked for a timeslot.
+type HintUnlock struct {
+	ID         *uuid.UUID `column:"id" json:"id"`
+	HintID     *uuid.UUID `column:"hint" json:"hint"`
+	TimeslotID *uuid.UUID `column:"timeslot" json:"timeslot"`
+	StationID  *uuid.UUID `column:"station" json:"station"`
+	Actor      string     `column:"actor" json:"actor"`
+	Timestamp  *time.Time `column:"timestamp" json:"timestamp"`
+}
+
+// HintUnlocks is a list of hint unlocks.
+type HintUnlocks []*HintUnlock
+
+// StationHintUnlockRequest is a request to unlock the next hint of a task for the timeslot currently assigned to the station.
+type StationHintUnlockRequest struct {
+	TaskShortname string `json:"task_shortname"` // Required
+	Hint          *Hint  `json:"hint"`           // The unlocked hint, in the response
+}
+
+func init() {
+	rest.AddHandler("/hints/", "^$", func() interface{} { return &Hints{} })
+	rest.AddHandler("/hint/", "^(?:(?P<id>[^/]+)/)?$", func() interface{} { return &Hint{} })
+	rest.AddHandler("/station/", "^(?P<id>[^/]+)/unlock-hint/$", func() interface{} { return &StationHintUnlockRequest{} })
+}
+
+// Get gets hints, ordered by task and sequence.
+// Only operators/admins see the content of all hints. If the "station" query arg is set,
+// participants of the station timeslot see the content of hints unlocked for it.
+func (hints *Hints) Get(request *rest.Request) rest.Result {
+	// Check params, prep filtering
+	var whereArgs []interface{}
+	if trackID, ok := request.QueryArgs["track"]; ok {
+		whereArgs = append(whereArgs, "track", "=", trackID)
+	}
+	if taskShortname, ok := request.QueryArgs["task-shortname"]; ok {
+		whereArgs = append(whereArgs, "task_shortname", "=", taskShortname)
+	}
+
+	// Get
+	dbResult := db.SelectMany(hints, "hints", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	hints.sort()
+
+	// Mark unlocked, if for a station
+	unlockedIDs := make(map[uuid.UUID]bool)
+	if stationID, ok := request.QueryArgs["station"]; ok {
+		var station Station
+		stationDBResult := db.Select(&station, "stations", "id", "=", stationID)
+		if stationDBResult.IsFailed() {
+			return rest.Result{Code: 500, Error: stationDBResult.Error}
+		}
+		if !stationDBResult.IsSuccess() {
+			return rest.Result{Code: 404, Message: "station not found"}
+		}
+		if station.TimeslotID != "" {
+			if result := station.checkParticipantPerms(request.AccessToken); !result.IsOk() {
+				return result
+			}
+			var err error
+			unlockedIDs, err = unlockedHintIDs(station.TimeslotID)
+			if err != nil {
+				return rest.Result{Code: 500, Error: err}
+			}
+		}
+	}
+
+	// Hide locked content
+	isStaff := request.AccessToken.GetRole() == rest.RoleOperator || request.AccessToken.GetRole() == rest.RoleAdmin
+	for _, hint := range *hints {
+		hint.Unlocked = unlockedIDs[*hint.ID]
+		if !isStaff && !hint.Unlocked {
+			hint.Content = ""
+		}
+	}
+	return rest.Result{}
+}
+
+// Get gets a single hint.
+func (hint *Hint) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+
+	// Get
+	dbResult := db.Select(hint, "hints", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+	return rest.Result{}
+}
+
+// Post creates a new hint.
+func (hint *Hint) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Prepare and validate
+	if hint.ID == nil {
+		newID := uuid.New()
+		hint.ID = &newID
+	}
+	if result := hint.validate(); !result.IsOk() {
+		return result
+	}
+	if exists, err := hint.exists(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	} else if exists {
+		return rest.Result{Code: 409, Message: "duplicate"}
+	}
+
+	// Create and redirect
+	dbResult := db.Insert("hints", hint)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	return rest.Result{Code: 201, Location: fmt.Sprintf("%v/hint/%v/", config.Config.SitePrefix, hint.ID)}
+}
+
+// Put updates a hint. Scores are not recomputed until the next change or the "recompute-scores" action.
+func (hint *Hint) Put(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	rawID, rawIDExists := request.PathArgs["id"]
+	if !rawIDExists || rawID == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+	id, uuidError := uuid.Parse(rawID)
+	if uuidError != nil {
+		return rest.Result{Code: 400, Message: "invalid ID"}
+	}
+
+	// Validate
+	if hint.ID != nil && *hint.ID != id {
+		return rest.Result{Code: 400, Message: "mismatch between URL and JSON IDs"}
+	}
+	hint.ID = &id
+	if result := hint.validate(); !result.IsOk() {
+		return result
+	}
+	if exists, err := hint.exists(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	} else if !exists {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+
+	// Update
+	dbResult := db.Update("hints", hint, "id", "=", hint.ID)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	return rest.Result{}
+}
+
+// Delete deletes a hint, including unlocks of it.
+func (hint *Hint) Delete(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	rawID, rawIDExists := request.PathArgs["id"]
+	if !rawIDExists || rawID == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+	id, uuidError := uuid.Parse(rawID)
+	if uuidError != nil {
+		return rest.Result{Code: 400, Message: "invalid ID"}
+	}
+
+	// Check if it exists
+	hint.ID = &id
+	exists, err := hint.exists()
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	if !exists {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+
+	// Delete it
+	dbResult := db.Delete("hints", "id", "=", hint.ID)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	unlocksDBResult := db.Delete("hint_unlocks", "hint", "=", hint.ID)
+	if unlocksDBResult.IsFailed() {
+		return rest.Result{Code: 500, Error: unlocksDBResult.Error}
+	}
+	return rest.Result{}
+}
+
+// Post unlocks the next locked hint of the task for the timeslot assigned to the station and returns it.
+func (unlockRequest *StationHintUnlockRequest) Post(request *rest.Request) rest.Result {
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+	if unlockRequest.TaskShortname == "" {
+		return rest.Result{Code: 400, Message: "missing task shortname"}
+	}
+	var station Station
+	stationDBResult := db.Select(&station, "stations", "id", "=", id)
+	if stationDBResult.IsFailed() {
+		return rest.Result{Code: 500, Error: stationDBResult.Error}
+	}
+	if !stationDBResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+
+	// Check perms
+	if result := station.checkParticipantPerms(request.AccessToken); !result.IsOk() {
+		return result
+	}
+	if station.TimeslotID == "" {
+		return rest.Result{Code: 400, Message: "station is not assigned to a timeslot"}
+	}
+	timeslotID, err := uuid.Parse(station.TimeslotID)
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+
+	// Find the next locked hint
+	var hints Hints
+	hintsDBResult := db.SelectMany(&hints, "hints", "track", "=", station.TrackID, "task_shortname", "=", unlockRequest.TaskShortname)
+	if hintsDBResult.IsFailed() {
+		return rest.Result{Code: 500, Error: hintsDBResult.Error}
+	}
+	hints.sort()
+	unlockedIDs, err := unlockedHintIDs(station.TimeslotID)
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	var nextHint *Hint
+	for _, hint := range hints {
+		if !unlockedIDs[*hint.ID] {
+			nextHint = hint
+			break
+		}
+	}
+	if nextHint == nil {
+		return rest.Result{Code: 404, Message: "no more hints"}
+	}
+
+	// Unlock
+	unlockID := uuid.New()
+	now := time.Now()
+	unlock := HintUnlock{
+		ID:         &unlockID,
+		HintID:     nextHint.ID,
+		TimeslotID: &timeslotID,
+		StationID:  station.ID,
+		Actor:      request.AccessToken.GetName(),
+		Timestamp:  &now,
+	}
+	if dbResult := db.Insert("hint_unlocks", unlock); dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if err := saveTimeslotScore(station.TimeslotID); err != nil {
+		request.Log().WithError(err).WithField("timeslot", station.TimeslotID).Warn("Failed to update score after unlocking hint")
+	}
+
+	nextHint.Unlocked = true
+	unlockRequest.Hint = nextHint
+	return rest.Result{}
+}
+
+func (hints *Hints) sort() {
+	sort.SliceStable(*hints, func(i, j int) bool {
+		if (*hints)[i].TaskShortname != (*hints)[j].TaskShortname {
+			return (*hints)[i].TaskShortname < (*hints)[j].TaskShortname
+		}
+		return (*hints)[i].Sequence < (*hints)[j].Sequence
+	})
+}
+
+// unlockedHintIDs gets the IDs of the hints unlocked for the timeslot.
+func unlockedHintIDs(timeslotID string) (map[uuid.UUID]bool, error) {
+	var unlocks HintUnlocks
+	dbResult := db.SelectMany(&unlocks, "hint_unlocks", "timeslot", "=", timeslotID)
+	if dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	unlockedIDs := make(map[uuid.UUID]bool)
+	for _, unlock := range unlocks {
+		unlockedIDs[*unlock.HintID] = true
+	}
+	return unlockedIDs, nil
+}
+
+func (hint *Hint) exists() (bool, error) {
+	var count int
+	row := db.DB.QueryRow("SELECT COUNT(*) FROM hints WHERE id = $1", hint.ID)
+	rowErr := row.Scan(&count)
+	if rowErr != nil {
+		return false, rowErr
+	}
+	return count > 0, nil
+}
+
+// validateFields checks the fields of the hint, without looking anything up.
+func (hint *Hint) validateFields() rest.Result {
+	switch {
+	case hint.ID == nil:
+		return rest.Result{Code: 400, Message: "missing ID"}
+	case hint.TrackID == "":
+		return rest.Result{Code: 400, Message: "missing track ID"}
+	case hint.TaskShortname == "":
+		return rest.Result{Code: 400, Message: "missing task shortname"}
+	case hint.Content == "":
+		return rest.Result{Code: 400, Message: "missing content"}
+	case hint.Penalty < 0:
+		return rest.Result{Code: 400, Message: "invalid penalty"}
+	}
+	return rest.Result{}
+}
+
+func (hint *Hint) validate() rest.Result {
+	if result := hint.validateFields(); !result.IsOk() {
+		return result
+	}
+
+	task := Task{TrackID: hint.TrackID, Shortname: hint.TaskShortname}
+	if exists, err := task.existsShortname(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	} else if !exists {
+		return rest.Result{Code: 400, Message: "referenced task does not exist"}
+	}
+	return rest.Result{}
+}
@@ -0,0 +1,170 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/notify"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// Headers of the test result hook
+const (
+	HookHeaderChecker   = "X-Techo-Checker"      // Checker ID (key in the checkers config section)
+	HookHeaderSignature = notify.HeaderSignature // "sha256=" and the hex HMAC-SHA256 of the body using the checker secret
+)
+
+// hookMaxClockSkew is how far the payload timestamp may be from now, to limit replays of captured payloads.
+const hookMaxClockSkew = 5 * time.Minute
+
+// Test result statuses of the test result hook
+const (
+	HookTestStatusPassed = "passed"
+	HookTestStatusFailed = "failed"
+)
+
+// TestResultHook receives test results from external checkers, signed with their secret instead of using access tokens.
+type TestResultHook struct {
+	TestID *uuid.UUID `json:"test"` // The saved test
+}
+
+// testResultHookPayload is the body of the test result hook.
+type testResultHookPayload struct {
+	Timestamp   *time.Time `json:"timestamp"`   // Required, when the payload was sent
+	Check       string     `json:"check"`       // Required, mapped to the task
+	Station     string     `json:"station"`     // Required, mapped to the station
+	Test        string     `json:"test"`        // Required, the test shortname
+	Name        string     `json:"name"`        // Defaults to the test shortname
+	Description string     `json:"description"` // Optional
+	Sequence    *int       `json:"sequence"`    // Optional
+	Status      string     `json:"status"`      // Required, "passed" or "failed"
+	Message     string     `json:"message"`     // Optional, the status description
+}
+
+func init() {
+	rest.AddHandler("/hooks/test-result/", "^$", func() interface{} { return &TestResultHook{} })
+}
+
+// Post verifies the signature of the payload, maps it to a test and saves it like posting a test.
+func (hook *TestResultHook) Post(request *rest.Request) rest.Result {
+	// Check perms
+	checkerID := request.Header.Get(HookHeaderChecker)
+	checker, ok := config.Config.Checkers[checkerID]
+	if !ok || checker.Secret == "" {
+		return rest.Result{Code: 401, Message: "unknown checker"}
+	}
+	if !hmac.Equal([]byte(notify.Sign(checker.Secret, request.Body)), []byte(request.Header.Get(HookHeaderSignature))) {
+		return rest.Result{Code: 401, Message: "invalid signature"}
+	}
+
+	// Check params
+	var payload testResultHookPayload
+	decoder := json.NewDecoder(bytes.NewReader(request.Body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&payload); err != nil {
+		return rest.Result{Code: 400, Message: fmt.Sprintf("invalid payload: %v", err)}
+	}
+	if result := payload.validate(); !result.IsOk() {
+		return result
+	}
+	test, result := payload.toTest(checker)
+	if !result.IsOk() {
+		return result
+	}
+
+	// Save
+	newID := uuid.New()
+	now := time.Now()
+	test.ID = &newID
+	test.Timestamp = &now
+	if result := test.validate(); !result.IsOk() {
+		return result
+	}
+	if result := test.save(); !result.IsOk() {
+		return result
+	}
+	request.Log().WithFields(log.Fields{
+		"checker": checkerID,
+		"test":    test.ID,
+		"station": test.StationShortname,
+	}).Debug("Test result received from checker")
+	hook.TestID = test.ID
+	return rest.Result{Code: 201, Location: fmt.Sprintf("%v/test/%v", config.Config.SitePrefix, test.ID)}
+}
+
+func (payload *testResultHookPayload) validate() rest.Result {
+	switch {
+	case payload.Timestamp == nil:
+		return rest.Result{Code: 400, Message: "missing timestamp"}
+	case payload.Check == "":
+		return rest.Result{Code: 400, Message: "missing check"}
+	case payload.Station == "":
+		return rest.Result{Code: 400, Message: "missing station"}
+	case payload.Test == "":
+		return rest.Result{Code: 400, Message: "missing test"}
+	case payload.Status != HookTestStatusPassed && payload.Status != HookTestStatusFailed:
+		return rest.Result{Code: 400, Message: "status must be passed or failed"}
+	}
+	if skew := time.Since(*payload.Timestamp); skew > hookMaxClockSkew || skew < -hookMaxClockSkew {
+		return rest.Result{Code: 400, Message: "timestamp too far from current time"}
+	}
+	return rest.Result{}
+}
+
+// toTest maps the payload to a test using the mapping rules of the checker.
+func (payload *testResultHookPayload) toTest(checker config.CheckerConfig) (*Test, rest.Result) {
+	taskShortname := payload.Check
+	if len(checker.Tasks) > 0 {
+		var ok bool
+		if taskShortname, ok = checker.Tasks[payload.Check]; !ok {
+			return nil, rest.Result{Code: 422, Message: "check not mapped to a task"}
+		}
+	}
+	stationShortname := payload.Station
+	if mapped, ok := checker.Stations[payload.Station]; ok {
+		stationShortname = mapped
+	}
+	name := strings.TrimSpace(payload.Name)
+	if name == "" {
+		name = payload.Test
+	}
+	success := payload.Status == HookTestStatusPassed
+	return &Test{
+		TrackID:           checker.TrackID,
+		TaskShortname:     taskShortname,
+		Shortname:         payload.Test,
+		StationShortname:  stationShortname,
+		Name:              name,
+		Description:       payload.Description,
+		Sequence:          payload.Sequence,
+		StatusSuccess:     &success,
+		StatusDescription: payload.Message,
+	}, rest.Result{}
+}
@@ -0,0 +1,299 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+)
+
+const icalTimeFormat = "20060102T150405Z"
+
+// TimeslotsCalendar is an iCalendar feed of the scheduled timeslots of a user (including team timeslots) or a track.
+type TimeslotsCalendar struct {
+	raw *rest.RawResponse
+}
+
+// TimeslotsCalendarLink is a signed URL of a timeslots feed, for subscribing from calendar apps which can't send tokens.
+type TimeslotsCalendarLink struct {
+	URL string `json:"url"`
+}
+
+func init() {
+	rest.AddHandler("/timeslots/", "^ical/$", func() interface{} { return &TimeslotsCalendar{} })
+	rest.AddHandler("/timeslots/", "^ical/link/$", func() interface{} { return &TimeslotsCalendarLink{} })
+}
+
+// calendarFeedSubject returns what the feed is for from the "user" or "track" query arg, e.g. "user:<id>".
+func calendarFeedSubject(request *rest.Request) (string, rest.Result) {
+	userID, hasUser := request.QueryArgs["user"]
+	trackID, hasTrack := request.QueryArgs["track"]
+	switch {
+	case hasUser == hasTrack:
+		return "", rest.Result{Code: 400, Message: "exactly one of user and track is required"}
+	case hasUser:
+		if _, err := uuid.Parse(userID); err != nil {
+			return "", rest.Result{Code: 400, Message: "invalid user ID"}
+		}
+		return "user:" + userID, rest.Result{}
+	}
+	return "track:" + trackID, rest.Result{}
+}
+
+// canAccessCalendarFeed checks if the token may get the feed: operators/admins may get all feeds, users only their own.
+func canAccessCalendarFeed(token rest.AccessTokenEntry, subject string) bool {
+	if token.GetRole() == rest.RoleOperator || token.GetRole() == rest.RoleAdmin {
+		return true
+	}
+	return token.OwnerUserID != nil && subject == "user:"+token.OwnerUserID.String()
+}
+
+// signCalendarFeed returns the signature of the feed subject, or nothing if signing isn't configured.
+func signCalendarFeed(subject string) string {
+	if config.Config.Calendar.Secret == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(config.Config.Calendar.Secret))
+	mac.Write([]byte(subject))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Get gets the feed, for the "user" or "track" query arg. Calendar apps authenticate with the "sig" query arg from the link.
+func (calendar *TimeslotsCalendar) Get(request *rest.Request) rest.Result {
+	// Check params
+	subject, result := calendarFeedSubject(request)
+	if !result.IsOk() {
+		return result
+	}
+
+	// Check perms
+	signature := signCalendarFeed(subject)
+	signed := signature != "" && hmac.Equal([]byte(signature), []byte(request.QueryArgs["sig"]))
+	if !signed && !canAccessCalendarFeed(request.AccessToken, subject) {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Get
+	var timeslots Timeslots
+	var name string
+	if trackID, ok := request.QueryArgs["track"]; ok {
+		var track Track
+		dbResult := db.Select(&track, "tracks", "id", "=", trackID)
+		if dbResult.IsFailed() {
+			return rest.Result{Code: 500, Error: dbResult.Error}
+		}
+		if !dbResult.IsSuccess() {
+			return rest.Result{Code: 404, Message: "track not found"}
+		}
+		if dbResult := db.SelectMany(&timeslots, "timeslots", "track", "=", trackID); dbResult.IsFailed() {
+			return rest.Result{Code: 500, Error: dbResult.Error}
+		}
+		name = fmt.Sprintf("Tech:Online %v", track.Name)
+	} else {
+		var err error
+		if timeslots, err = loadUserTimeslots(request.QueryArgs["user"]); err != nil {
+			return rest.Result{Code: 500, Error: err}
+		}
+		name = "Tech:Online"
+	}
+	_, isTrackFeed := request.QueryArgs["track"]
+	data, err := renderTimeslotsCalendar(name, timeslots, isTrackFeed)
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	calendar.raw = &rest.RawResponse{
+		ContentType: "text/calendar; charset=utf-8",
+		Data:        data,
+	}
+	return rest.Result{}
+}
+
+// RawResponse returns the feed.
+func (calendar *TimeslotsCalendar) RawResponse() *rest.RawResponse {
+	return calendar.raw
+}
+
+// Get gets the signed URL of the feed for the "user" or "track" query arg, the own user if none.
+func (link *TimeslotsCalendarLink) Get(request *rest.Request) rest.Result {
+	// Check params
+	_, hasUser := request.QueryArgs["user"]
+	_, hasTrack := request.QueryArgs["track"]
+	if !hasUser && !hasTrack && request.AccessToken.OwnerUserID != nil {
+		request.QueryArgs["user"] = request.AccessToken.OwnerUserID.String()
+	}
+	subject, result := calendarFeedSubject(request)
+	if !result.IsOk() {
+		return result
+	}
+
+	// Check perms
+	if !canAccessCalendarFeed(request.AccessToken, subject) {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+	signature := signCalendarFeed(subject)
+	if signature == "" {
+		return rest.Result{Code: 503, Message: "calendar feeds are not configured"}
+	}
+
+	// Get
+	kind := strings.SplitN(subject, ":", 2)
+	query := url.Values{kind[0]: {kind[1]}, "sig": {signature}}
+	link.URL = fmt.Sprintf("%v%v/timeslots/ical/?%v", strings.TrimSuffix(config.Config.PublicURL, "/"), config.Config.SitePrefix, query.Encode())
+	return rest.Result{}
+}
+
+// loadUserTimeslots gets the timeslots of the user, including the timeslots of the user's teams.
+func loadUserTimeslots(userID string) (Timeslots, error) {
+	var timeslots Timeslots
+	if dbResult := db.SelectMany(&timeslots, "timeslots", "user", "=", userID); dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	var memberships TeamMembers
+	if dbResult := db.SelectMany(&memberships, "team_members", "user", "=", userID); dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	if len(memberships) == 0 {
+		return timeslots, nil
+	}
+	teamIDs := make([]string, 0, len(memberships))
+	for _, membership := range memberships {
+		teamIDs = append(teamIDs, membership.TeamID.String())
+	}
+	var teamTimeslots Timeslots
+	if dbResult := db.SelectMany(&teamTimeslots, "timeslots", "team", "IN", teamIDs); dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	seen := make(map[uuid.UUID]bool, len(timeslots))
+	for _, timeslot := range timeslots {
+		seen[*timeslot.ID] = true
+	}
+	for _, timeslot := range teamTimeslots {
+		if !seen[*timeslot.ID] {
+			timeslots = append(timeslots, timeslot)
+		}
+	}
+	return timeslots, nil
+}
+
+// renderTimeslotsCalendar renders the scheduled timeslots (with begin and end times) as an iCalendar, with the participant names for track feeds.
+func renderTimeslotsCalendar(name string, timeslots Timeslots, withParticipants bool) ([]byte, error) {
+	// Look up the names in batches
+	var tracks Tracks
+	if dbResult := db.SelectMany(&tracks, "tracks"); dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	trackNames := make(map[string]string, len(tracks))
+	for _, track := range tracks {
+		trackNames[track.ID] = track.Name
+	}
+	userNames := make(map[uuid.UUID]string)
+	if withParticipants {
+		userIDs := make([]string, 0, len(timeslots))
+		for _, timeslot := range timeslots {
+			if timeslot.UserID != nil {
+				userIDs = append(userIDs, timeslot.UserID.String())
+			}
+		}
+		if len(userIDs) > 0 {
+			var users []*rest.User
+			if dbResult := db.SelectMany(&users, "users", "id", "IN", userIDs); dbResult.IsFailed() {
+				return nil, dbResult.Error
+			}
+			for _, user := range users {
+				userNames[*user.ID] = user.DisplayName
+			}
+		}
+	}
+
+	var builder strings.Builder
+	writeICalLine(&builder, "BEGIN:VCALENDAR")
+	writeICalLine(&builder, "VERSION:2.0")
+	writeICalLine(&builder, "PRODID:-//The Gathering//Tech:Online//EN")
+	writeICalLine(&builder, "CALSCALE:GREGORIAN")
+	writeICalLine(&builder, "X-WR-CALNAME:"+escapeICalText(name))
+	now := time.Now().UTC().Format(icalTimeFormat)
+	for _, timeslot := range timeslots {
+		if timeslot.BeginTime == nil || timeslot.EndTime == nil {
+			continue
+		}
+		summary := trackNames[timeslot.TrackID]
+		if summary == "" {
+			summary = timeslot.TrackID
+		}
+		if userName := userNames[uuidValue(timeslot.UserID)]; userName != "" {
+			summary = fmt.Sprintf("%v: %v", summary, userName)
+		}
+		writeICalLine(&builder, "BEGIN:VEVENT")
+		writeICalLine(&builder, fmt.Sprintf("UID:%v@tech-online", timeslot.ID))
+		writeICalLine(&builder, "DTSTAMP:"+now)
+		writeICalLine(&builder, "DTSTART:"+timeslot.BeginTime.UTC().Format(icalTimeFormat))
+		writeICalLine(&builder, "DTEND:"+timeslot.EndTime.UTC().Format(icalTimeFormat))
+		writeICalLine(&builder, "SUMMARY:"+escapeICalText(summary))
+		if timeslot.Notes != "" {
+			writeICalLine(&builder, "DESCRIPTION:"+escapeICalText(timeslot.Notes))
+		}
+		if timeslot.Category != "" {
+			writeICalLine(&builder, "CATEGORIES:"+escapeICalText(string(timeslot.Category)))
+		}
+		writeICalLine(&builder, "END:VEVENT")
+	}
+	writeICalLine(&builder, "END:VCALENDAR")
+	return []byte(builder.String()), nil
+}
+
+func uuidValue(id *uuid.UUID) uuid.UUID {
+	if id == nil {
+		return uuid.Nil
+	}
+	return *id
+}
+
+// escapeICalText escapes a text value.
+func escapeICalText(text string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`, "\r", `\n`).Replace(text)
+}
+
+// writeICalLine writes a content line, folded to at most 75 octets per line (without splitting UTF-8 characters).
+func writeICalLine(builder *strings.Builder, line string) {
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		builder.WriteString(line[:cut])
+		builder.WriteString("\r\n ")
+		line = line[cut:]
+		limit = 74 // The leading space counts
+	}
+	builder.WriteString(line)
+	builder.WriteString("\r\n")
+}
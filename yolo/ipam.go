@@ -0,0 +1,343 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	content "github.com/gathering/tech-online-backend/doc"
+	"github.com/gathering/tech-online-backend/ipam"
+	"github.com/gathering/tech-online-backend/provision"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultIPv4PrefixLength = 29
+	defaultIPv6PrefixLength = 64
+)
+
+// stationNetworkLock serializes allocating networks and saving the stations, so allocations stay unique.
+var stationNetworkLock sync.Mutex
+
+// StationNetworkAllocateRequest is a request to allocate the VLAN and prefixes a station is missing from the IPAM pools of its track.
+type StationNetworkAllocateRequest struct{}
+
+// StationTemplateData is the station data documents may use when rendered for a station, e.g. to show its addressing plan.
+type StationTemplateData struct {
+	ID          string
+	TrackID     string
+	Shortname   string
+	Name        string
+	VLANID      int // Zero if not allocated
+	IPv4Prefix  string
+	IPv4Gateway string // First host address in the prefix
+	IPv6Prefix  string
+	IPv6Gateway string // See above
+}
+
+// usedNetworks is what's allocated to other stations.
+type usedNetworks struct {
+	vlanIDs  map[int]bool
+	prefixes []netip.Prefix
+}
+
+func init() {
+	rest.AddHandler("/station/", "^(?P<id>[^/]+)/allocate-network/$", func() interface{} { return &StationNetworkAllocateRequest{} })
+	content.RegisterTemplateData("Station", stationTemplateData)
+	content.RegisterTemplateSample("Station", stationTemplateSample)
+}
+
+// Post allocates the missing VLAN and prefixes for the station.
+func (allocateRequest *StationNetworkAllocateRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+
+	// Allocate and save
+	stationNetworkLock.Lock()
+	defer stationNetworkLock.Unlock()
+	var station Station
+	dbResult := db.Select(&station, "stations", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+	if station.Status == StationStatusTerminated {
+		return rest.Result{Code: 400, Message: "station is terminated"}
+	}
+	if err := station.allocateNetwork(); err != nil {
+		return station.networkAllocationFailedResult(err)
+	}
+	updateDBResult := db.Update("stations", &station, "id", "=", station.ID)
+	if updateDBResult.IsFailed() {
+		return rest.Result{Code: 500, Error: updateDBResult.Error}
+	}
+	request.Log().WithFields(log.Fields{
+		"station": station.ID,
+		"vlan":    station.VLANID,
+		"ipv4":    station.IPv4Prefix,
+		"ipv6":    station.IPv6Prefix,
+		"actor":   request.AccessToken.GetName(),
+	}).Info("Station network allocated")
+
+	return rest.Result{Code: 303, Location: fmt.Sprintf("%v/station/%v/", config.Config.SitePrefix, station.ID)}
+}
+
+// allocateNetwork allocates the VLAN ID and prefixes the station is missing, for the pools configured for its track.
+// The caller must hold stationNetworkLock until the station is saved.
+func (station *Station) allocateNetwork() error {
+	ipamConfig := config.Config.Tracks[station.TrackID].IPAM
+	needsVLAN := station.VLANID == nil && ipamConfig.VLANMin > 0
+	needsIPv4 := station.IPv4Prefix == "" && ipamConfig.IPv4Pool != ""
+	needsIPv6 := station.IPv6Prefix == "" && ipamConfig.IPv6Pool != ""
+	if !needsVLAN && !needsIPv4 && !needsIPv6 {
+		return nil
+	}
+
+	used, err := loadUsedNetworks(station)
+	if err != nil {
+		return err
+	}
+	if needsVLAN {
+		vlanID, err := ipam.NextFreeVLAN(ipamConfig.VLANMin, ipamConfig.VLANMax, used.vlanIDs)
+		if err != nil {
+			return fmt.Errorf("VLAN: %w", err)
+		}
+		station.VLANID = &vlanID
+	}
+	if needsIPv4 {
+		prefix, err := allocatePrefix(ipamConfig.IPv4Pool, ipamConfig.IPv4PrefixLength, defaultIPv4PrefixLength, used.prefixes)
+		if err != nil {
+			return fmt.Errorf("IPv4 prefix: %w", err)
+		}
+		station.IPv4Prefix = prefix
+	}
+	if needsIPv6 {
+		prefix, err := allocatePrefix(ipamConfig.IPv6Pool, ipamConfig.IPv6PrefixLength, defaultIPv6PrefixLength, used.prefixes)
+		if err != nil {
+			return fmt.Errorf("IPv6 prefix: %w", err)
+		}
+		station.IPv6Prefix = prefix
+	}
+	return nil
+}
+
+// releaseNetwork clears the allocated VLAN and prefixes, so other stations may get them.
+func (station *Station) releaseNetwork() {
+	station.VLANID = nil
+	station.IPv4Prefix = ""
+	station.IPv6Prefix = ""
+}
+
+func (station *Station) hasNetwork() bool {
+	return station.VLANID != nil || station.IPv4Prefix != "" || station.IPv6Prefix != ""
+}
+
+// network gets the allocated network for provisioners.
+func (station *Station) network() provision.Network {
+	network := provision.Network{
+		IPv4Prefix: station.IPv4Prefix,
+		IPv6Prefix: station.IPv6Prefix,
+	}
+	if station.VLANID != nil {
+		network.VLANID = *station.VLANID
+	}
+	return network
+}
+
+// validateNetwork validates the (manually set) VLAN and prefixes and checks that they're not used by other stations.
+func (station *Station) validateNetwork() rest.Result {
+	if !station.hasNetwork() {
+		return rest.Result{}
+	}
+	if station.VLANID != nil && (*station.VLANID < 1 || *station.VLANID > 4094) {
+		return rest.Result{Code: 400, Message: "invalid VLAN ID"}
+	}
+	var prefixes []netip.Prefix
+	for _, rawPrefix := range []string{station.IPv4Prefix, station.IPv6Prefix} {
+		if rawPrefix == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(rawPrefix)
+		if err != nil || prefix != prefix.Masked() {
+			return rest.Result{Code: 400, Message: fmt.Sprintf("invalid prefix %v", rawPrefix)}
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	if station.IPv4Prefix != "" && !prefixes[0].Addr().Is4() {
+		return rest.Result{Code: 400, Message: "IPv4 prefix is not IPv4"}
+	}
+	if station.IPv6Prefix != "" && !prefixes[len(prefixes)-1].Addr().Is6() {
+		return rest.Result{Code: 400, Message: "IPv6 prefix is not IPv6"}
+	}
+	if station.Status == StationStatusTerminated {
+		return rest.Result{}
+	}
+
+	used, err := loadUsedNetworks(station)
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	if station.VLANID != nil && used.vlanIDs[*station.VLANID] {
+		return rest.Result{Code: 409, Message: "VLAN ID is used by another station"}
+	}
+	for _, prefix := range prefixes {
+		for _, usedPrefix := range used.prefixes {
+			if prefix.Overlaps(usedPrefix) {
+				return rest.Result{Code: 409, Message: fmt.Sprintf("prefix %v overlaps one used by another station", prefix)}
+			}
+		}
+	}
+	return rest.Result{}
+}
+
+func (station *Station) networkAllocationFailedResult(err error) rest.Result {
+	publishStaffEvent(EventTypeStationProvisionFailed, station.TrackID, "Station network allocation failed",
+		fmt.Sprintf("Failed to allocate a network for a station in track %v: %v", station.TrackID, err), nil)
+	return rest.Result{Code: 500, Error: fmt.Errorf("failed to allocate network: %w", err)}
+}
+
+// loadUsedNetworks gets the VLANs and prefixes of all non-terminated stations except the specified one.
+func loadUsedNetworks(except *Station) (*usedNetworks, error) {
+	// Terminated stations keep their network until the instance is destroyed
+	rows, err := db.DB.Query("SELECT vlan_id, ipv4_prefix, ipv6_prefix FROM stations WHERE id != $1 AND (status != $2 OR instance_state = ANY($3))",
+		except.ID, StationStatusTerminated, pq.Array([]string{string(provision.InstanceStateDestroying), string(provision.InstanceStateError)}))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	used := usedNetworks{vlanIDs: make(map[int]bool)}
+	for rows.Next() {
+		var vlanID *int
+		var rawPrefixes [2]string
+		if err := rows.Scan(&vlanID, &rawPrefixes[0], &rawPrefixes[1]); err != nil {
+			return nil, err
+		}
+		if vlanID != nil {
+			used.vlanIDs[*vlanID] = true
+		}
+		for _, rawPrefix := range rawPrefixes {
+			if prefix, err := netip.ParsePrefix(rawPrefix); err == nil {
+				used.prefixes = append(used.prefixes, prefix)
+			}
+		}
+	}
+	return &used, rows.Err()
+}
+
+func allocatePrefix(rawPool string, length int, defaultLength int, used []netip.Prefix) (string, error) {
+	pool, err := netip.ParsePrefix(rawPool)
+	if err != nil {
+		return "", err
+	}
+	if length <= 0 {
+		length = defaultLength
+	}
+	prefix, err := ipam.NextFreePrefix(pool, length, used)
+	if err != nil {
+		return "", err
+	}
+	return prefix.String(), nil
+}
+
+// stationTemplateData provides the station from the "station" query arg for rendering documents, if the requester may see it.
+func stationTemplateData(request *rest.Request) (interface{}, rest.Result) {
+	stationID, ok := request.QueryArgs["station"]
+	if !ok {
+		return nil, rest.Result{}
+	}
+	var station Station
+	dbResult := db.Select(&station, "stations", "id", "=", stationID)
+	if dbResult.IsFailed() {
+		return nil, rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		return nil, rest.Result{Code: 404, Message: "station not found"}
+	}
+	if result := station.checkParticipantPerms(request.AccessToken); !result.IsOk() {
+		return nil, result
+	}
+
+	data := StationTemplateData{
+		ID:         station.ID.String(),
+		TrackID:    station.TrackID,
+		Shortname:  station.Shortname,
+		Name:       station.Name,
+		IPv4Prefix: station.IPv4Prefix,
+		IPv6Prefix: station.IPv6Prefix,
+	}
+	if station.VLANID != nil {
+		data.VLANID = *station.VLANID
+	}
+	if prefix, err := netip.ParsePrefix(station.IPv4Prefix); err == nil {
+		data.IPv4Gateway = ipam.FirstHost(prefix).String()
+	}
+	if prefix, err := netip.ParsePrefix(station.IPv6Prefix); err == nil {
+		data.IPv6Gateway = ipam.FirstHost(prefix).String()
+	}
+	return data, rest.Result{}
+}
+
+// stationTemplateSample provides a made up station for previewing documents, using the IPAM pools of the "track" query arg if any.
+func stationTemplateSample(request *rest.Request) (interface{}, rest.Result) {
+	trackID := request.QueryArgs["track"]
+	data := StationTemplateData{
+		ID:          "00000000-0000-0000-0000-000000000000",
+		TrackID:     trackID,
+		Shortname:   "1",
+		Name:        "Sample station",
+		VLANID:      100,
+		IPv4Prefix:  "192.0.2.0/29",
+		IPv4Gateway: "192.0.2.1",
+		IPv6Prefix:  "2001:db8::/64",
+		IPv6Gateway: "2001:db8::1",
+	}
+	ipamConfig := config.Config.Tracks[trackID].IPAM
+	if ipamConfig.VLANMin > 0 {
+		data.VLANID = ipamConfig.VLANMin
+	}
+	if rawPrefix, err := allocatePrefix(ipamConfig.IPv4Pool, ipamConfig.IPv4PrefixLength, defaultIPv4PrefixLength, nil); err == nil {
+		prefix := netip.MustParsePrefix(rawPrefix)
+		data.IPv4Prefix = rawPrefix
+		data.IPv4Gateway = ipam.FirstHost(prefix).String()
+	}
+	if rawPrefix, err := allocatePrefix(ipamConfig.IPv6Pool, ipamConfig.IPv6PrefixLength, defaultIPv6PrefixLength, nil); err == nil {
+		prefix := netip.MustParsePrefix(rawPrefix)
+		data.IPv6Prefix = rawPrefix
+		data.IPv6Gateway = ipam.FirstHost(prefix).String()
+	}
+	return data, rest.Result{}
+}
@@ -0,0 +1,126 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	log "github.com/sirupsen/logrus"
+)
+
+// StationMaintenanceRequest is a request to set the maintenance flag, window and notice of a station.
+type StationMaintenanceRequest struct {
+	Maintenance bool       `json:"maintenance"`
+	Begin       *time.Time `json:"begin"`
+	End         *time.Time `json:"end"`
+	Notice      string     `json:"notice"`
+}
+
+// StationMaintenanceNotice is shown to participants while a station is under maintenance.
+type StationMaintenanceNotice struct {
+	Notice string     `json:"notice"`
+	End    *time.Time `json:"end"` // If scheduled
+}
+
+func init() {
+	rest.AddHandler("/station/", "^(?P<id>[^/]+)/maintenance/$", func() interface{} { return &StationMaintenanceRequest{} })
+}
+
+// Put sets the maintenance flag, window and notice of a station, leaving the rest of it unchanged.
+func (maintenanceRequest *StationMaintenanceRequest) Put(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+
+	// Get station
+	var station Station
+	dbResult := db.Select(&station, "stations", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+
+	// Validate
+	if maintenanceRequest.Begin != nil && maintenanceRequest.End != nil && !maintenanceRequest.End.After(*maintenanceRequest.Begin) {
+		return rest.Result{Code: 400, Message: "maintenance end must be after maintenance begin"}
+	}
+
+	// Update only the maintenance fields
+	_, err := db.DB.Exec("UPDATE stations SET maintenance = $1, maintenance_begin = $2, maintenance_end = $3, maintenance_notice = $4 WHERE id = $5",
+		maintenanceRequest.Maintenance, maintenanceRequest.Begin, maintenanceRequest.End, maintenanceRequest.Notice, station.ID)
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	request.Log().WithFields(log.Fields{
+		"station":     station.ID,
+		"maintenance": maintenanceRequest.Maintenance,
+		"begin":       maintenanceRequest.Begin,
+		"end":         maintenanceRequest.End,
+		"actor":       request.AccessToken.GetName(),
+	}).Info("Station maintenance changed")
+	return rest.Result{Code: 303, Location: fmt.Sprintf("%v/station/%v/", config.Config.SitePrefix, station.ID)}
+}
+
+// isUnderMaintenance checks if the station is flagged for maintenance or within its maintenance window.
+// Stations under maintenance are not assigned, and get no health alerts or task checks.
+func (station *Station) isUnderMaintenance(now time.Time) bool {
+	if station.Maintenance {
+		return true
+	}
+	if station.MaintenanceBegin == nil && station.MaintenanceEnd == nil {
+		return false
+	}
+	if station.MaintenanceBegin != nil && now.Before(*station.MaintenanceBegin) {
+		return false
+	}
+	if station.MaintenanceEnd != nil && !now.Before(*station.MaintenanceEnd) {
+		return false
+	}
+	return true
+}
+
+// maintenanceNotice returns the notice to show participants, or nil if not under maintenance.
+func (station *Station) maintenanceNotice(now time.Time) *StationMaintenanceNotice {
+	if !station.isUnderMaintenance(now) {
+		return nil
+	}
+	notice := StationMaintenanceNotice{Notice: station.MaintenanceNotice}
+	if !station.Maintenance {
+		notice.End = station.MaintenanceEnd
+	}
+	if notice.Notice == "" {
+		notice.Notice = "This station is under maintenance."
+	}
+	return &notice
+}
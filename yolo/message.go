@@ -0,0 +1,325 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/event"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const maxMessageLength = 4000
+
+// EventTypeMessageCreated is the event for new messages, sent to the participants and operators/admins.
+const EventTypeMessageCreated event.Type = "message.created" // Data is the message
+
+// Message is a message in the help thread of a timeslot, between its participants and the operators.
+type Message struct {
+	ID                 *uuid.UUID `column:"id" json:"id"`                                     // Generated
+	TimeslotID         *uuid.UUID `column:"timeslot" json:"timeslot"`                         // Required
+	StationID          string     `column:"station" json:"station"`                           // Generated, the station assigned at the time, if any
+	AuthorUserID       *uuid.UUID `column:"author_user" json:"author_user"`                   // Generated, if a user
+	Author             string     `column:"author" json:"author"`                             // Generated, name of the user/token
+	FromStaff          bool       `column:"from_staff" json:"from_staff"`                     // Generated, if sent by an operator/admin
+	Timestamp          *time.Time `column:"timestamp" json:"timestamp"`                       // Generated
+	Body               string     `column:"body" json:"body"`                                 // Required
+	ReadByParticipants bool       `column:"read_by_participants" json:"read_by_participants"` // Generated
+	ReadByStaff        bool       `column:"read_by_staff" json:"read_by_staff"`               // Generated
+}
+
+// Messages is a list of messages.
+type Messages []*Message
+
+// MessageThread summarizes the messages of a timeslot.
+type MessageThread struct {
+	TimeslotID  *uuid.UUID `json:"timeslot"`
+	TrackID     string     `json:"track"`
+	StationID   string     `json:"station"` // Of the latest message
+	Messages    int        `json:"messages"`
+	Unread      int        `json:"unread"` // Unread by the requester's side (participants or staff)
+	LastMessage *Message   `json:"last_message"`
+}
+
+// MessageThreads is a list of message threads.
+type MessageThreads []*MessageThread
+
+// MessageThreadReadRequest is a request to mark all messages of a timeslot as read by the requester's side.
+type MessageThreadReadRequest struct{}
+
+func init() {
+	rest.AddHandler("/messages/", "^$", func() interface{} { return &Messages{} })
+	rest.AddHandler("/message/", "^(?:(?P<id>[^/]+)/)?$", func() interface{} { return &Message{} })
+	rest.AddHandler("/message-threads/", "^$", func() interface{} { return &MessageThreads{} })
+	rest.AddHandler("/message-thread/", "^(?P<timeslot_id>[^/]+)/read/$", func() interface{} { return &MessageThreadReadRequest{} })
+	registerPersonalData(personalDataTable{table: "messages", userColumn: "author_user", actorColumns: []string{"author"}, scrubColumns: []string{"body"}, erasure: personalDataAnonymize})
+}
+
+// Get gets the messages of a timeslot (the "timeslot" query arg), oldest first.
+func (messages *Messages) Get(request *rest.Request) rest.Result {
+	// Check params and perms
+	timeslotID, timeslotIDExists := request.QueryArgs["timeslot"]
+	if !timeslotIDExists || timeslotID == "" {
+		return rest.Result{Code: 400, Message: "missing timeslot ID"}
+	}
+	var timeslot Timeslot
+	if result := loadMessageTimeslot(request.AccessToken, timeslotID, &timeslot); !result.IsOk() {
+		return result
+	}
+
+	// Get
+	dbResult := db.SelectMany(messages, "messages", "timeslot", "=", timeslot.ID)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	sort.SliceStable(*messages, func(i, j int) bool {
+		return (*messages)[i].Timestamp.Before(*(*messages)[j].Timestamp)
+	})
+	return rest.Result{}
+}
+
+// Get gets a single message.
+func (message *Message) Get(request *rest.Request) rest.Result {
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+
+	// Get
+	dbResult := db.Select(message, "messages", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+
+	// Check perms
+	var timeslot Timeslot
+	return loadMessageTimeslot(request.AccessToken, message.TimeslotID.String(), &timeslot)
+}
+
+// Post sends a message to the thread of a timeslot.
+func (message *Message) Post(request *rest.Request) rest.Result {
+	// Check params and perms
+	if message.TimeslotID == nil {
+		return rest.Result{Code: 400, Message: "missing timeslot ID"}
+	}
+	var timeslot Timeslot
+	if result := loadMessageTimeslot(request.AccessToken, message.TimeslotID.String(), &timeslot); !result.IsOk() {
+		return result
+	}
+
+	// Validate
+	message.Body = strings.TrimSpace(message.Body)
+	if message.Body == "" {
+		return rest.Result{Code: 400, Message: "missing body"}
+	}
+	if len(message.Body) > maxMessageLength {
+		return rest.Result{Code: 400, Message: fmt.Sprintf("body is longer than %v characters", maxMessageLength)}
+	}
+
+	// Create
+	stationID, err := timeslot.stationID()
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	newID := uuid.New()
+	now := time.Now()
+	message.ID = &newID
+	message.StationID = stationID
+	message.AuthorUserID = request.AccessToken.OwnerUserID
+	message.Author = request.AccessToken.GetName()
+	message.FromStaff = isStaff(request.AccessToken)
+	message.Timestamp = &now
+	message.ReadByParticipants = !message.FromStaff
+	message.ReadByStaff = message.FromStaff
+	dbResult := db.Insert("messages", message)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	message.publish(&timeslot)
+
+	return rest.Result{Code: 201, Location: fmt.Sprintf("%v/message/%v/", config.Config.SitePrefix, message.ID)}
+}
+
+// Get gets the message threads with unread counts, newest activity first.
+// Operators/admins get all threads (optionally for the "track" query arg), participants get threads for their timeslots.
+func (threads *MessageThreads) Get(request *rest.Request) rest.Result {
+	// Check perms and find timeslots
+	staff := isStaff(request.AccessToken)
+	var timeslots Timeslots
+	if staff {
+		var whereArgs []interface{}
+		if trackID, ok := request.QueryArgs["track"]; ok {
+			whereArgs = append(whereArgs, "track", "=", trackID)
+		}
+		if dbResult := db.SelectMany(&timeslots, "timeslots", whereArgs...); dbResult.IsFailed() {
+			return rest.Result{Code: 500, Error: dbResult.Error}
+		}
+	} else {
+		if request.AccessToken.OwnerUserID == nil {
+			return rest.UnauthorizedResult(request.AccessToken)
+		}
+		var allTimeslots Timeslots
+		if dbResult := db.SelectMany(&allTimeslots, "timeslots"); dbResult.IsFailed() {
+			return rest.Result{Code: 500, Error: dbResult.Error}
+		}
+		for _, timeslot := range allTimeslots {
+			if isParticipant, err := timeslot.isParticipant(request.AccessToken.OwnerUserID); err != nil {
+				return rest.Result{Code: 500, Error: err}
+			} else if isParticipant {
+				timeslots = append(timeslots, timeslot)
+			}
+		}
+	}
+	timeslotMap := make(map[uuid.UUID]*Timeslot)
+	for _, timeslot := range timeslots {
+		timeslotMap[*timeslot.ID] = timeslot
+	}
+
+	// Summarize messages per timeslot
+	var messages Messages
+	if dbResult := db.SelectMany(&messages, "messages"); dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	_, unreadOnly := request.QueryArgs["unread"]
+	threadMap := make(map[uuid.UUID]*MessageThread)
+	*threads = make(MessageThreads, 0)
+	for _, message := range messages {
+		timeslot, ok := timeslotMap[*message.TimeslotID]
+		if !ok {
+			continue
+		}
+		thread, ok := threadMap[*timeslot.ID]
+		if !ok {
+			thread = &MessageThread{TimeslotID: timeslot.ID, TrackID: timeslot.TrackID}
+			threadMap[*timeslot.ID] = thread
+			*threads = append(*threads, thread)
+		}
+		thread.Messages++
+		if (staff && !message.ReadByStaff) || (!staff && !message.ReadByParticipants) {
+			thread.Unread++
+		}
+		if thread.LastMessage == nil || message.Timestamp.After(*thread.LastMessage.Timestamp) {
+			thread.LastMessage = message
+			thread.StationID = message.StationID
+		}
+	}
+	if unreadOnly {
+		unreadThreads := make(MessageThreads, 0)
+		for _, thread := range *threads {
+			if thread.Unread > 0 {
+				unreadThreads = append(unreadThreads, thread)
+			}
+		}
+		*threads = unreadThreads
+	}
+	sort.SliceStable(*threads, func(i, j int) bool {
+		return (*threads)[i].LastMessage.Timestamp.After(*(*threads)[j].LastMessage.Timestamp)
+	})
+	return rest.Result{}
+}
+
+// Post marks the messages of the timeslot as read for the requester's side.
+func (readRequest *MessageThreadReadRequest) Post(request *rest.Request) rest.Result {
+	// Check params and perms
+	timeslotID, timeslotIDExists := request.PathArgs["timeslot_id"]
+	if !timeslotIDExists || timeslotID == "" {
+		return rest.Result{Code: 400, Message: "missing timeslot ID"}
+	}
+	var timeslot Timeslot
+	if result := loadMessageTimeslot(request.AccessToken, timeslotID, &timeslot); !result.IsOk() {
+		return result
+	}
+
+	// Update
+	column := "read_by_participants"
+	if isStaff(request.AccessToken) {
+		column = "read_by_staff"
+	}
+	if _, err := db.DB.Exec(fmt.Sprintf("UPDATE messages SET %v = true WHERE timeslot = $1", column), timeslot.ID.String()); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	return rest.Result{}
+}
+
+// loadMessageTimeslot loads the timeslot, if the token is a participant of it or an operator/admin.
+func loadMessageTimeslot(token rest.AccessTokenEntry, timeslotID string, timeslot *Timeslot) rest.Result {
+	dbResult := db.Select(timeslot, "timeslots", "id", "=", timeslotID)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		if isStaff(token) {
+			return rest.Result{Code: 404, Message: "timeslot not found"}
+		}
+		return rest.UnauthorizedResult(token)
+	}
+	return timeslot.checkParticipantPerms(token)
+}
+
+// publish sends the message to the other participants and operators/admins, e.g. for WebSocket delivery through the event stream.
+func (message *Message) publish(timeslot *Timeslot) {
+	userIDs, err := timeslot.participantIDs()
+	if err != nil {
+		log.WithError(err).WithField("timeslot", timeslot.ID).Warn("Failed to find timeslot participants for message")
+	}
+	staffIDs, err := staffUserIDs()
+	if err != nil {
+		log.WithError(err).Warn("Failed to get operators/admins for message")
+	}
+	userIDs = append(userIDs, staffIDs...)
+
+	// Don't notify the author
+	recipients := make([]uuid.UUID, 0, len(userIDs))
+	for _, userID := range userIDs {
+		if message.AuthorUserID == nil || userID != *message.AuthorUserID {
+			recipients = append(recipients, userID)
+		}
+	}
+
+	title := "New message from the crew"
+	if !message.FromStaff {
+		title = fmt.Sprintf("New message from %v", message.Author)
+	}
+	event.Publish(event.Event{
+		Type:    EventTypeMessageCreated,
+		TrackID: timeslot.TrackID,
+		UserIDs: recipients,
+		Title:   title,
+		Message: message.Body,
+		Data:    message,
+	})
+}
+
+// isStaff checks if the token is an operator or admin.
+func isStaff(token rest.AccessTokenEntry) bool {
+	return token.GetRole() == rest.RoleOperator || token.GetRole() == rest.RoleAdmin
+}
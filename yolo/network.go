@@ -0,0 +1,191 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/gondul"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/gathering/tech-online-backend/scheduler"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	networkSyncSchedulerInterval = time.Minute
+	defaultNetworkSyncInterval   = 5 * time.Minute
+)
+
+var lastNetworkSync time.Time
+var lastNetworkSyncLock sync.Mutex
+
+// TrackNetworkSyncRequest is a request to sync the network data of the stations of a net track from Gondul now.
+type TrackNetworkSyncRequest struct {
+	Synced  int      `json:"synced"`  // Response only, stations found in Gondul
+	Missing []string `json:"missing"` // Response only, shortnames of stations not found in Gondul
+}
+
+func init() {
+	rest.AddHandler("/track/", "^(?P<track_id>[^/]+)/sync-network/$", func() interface{} { return &TrackNetworkSyncRequest{} })
+	scheduler.AddJob("sync-gondul", networkSyncSchedulerInterval, syncDueNetworkData)
+}
+
+// Post syncs the network data of the track's stations from Gondul.
+func (syncRequest *TrackNetworkSyncRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	trackID, trackIDExists := request.PathArgs["track_id"]
+	if !trackIDExists || trackID == "" {
+		return rest.Result{Code: 400, Message: "missing track ID"}
+	}
+	if config.Config.Gondul.BaseURL == "" {
+		return rest.Result{Code: 400, Message: "gondul is not configured"}
+	}
+	var track Track
+	dbResult := db.Select(&track, "tracks", "id", "=", trackID)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "track not found"}
+	}
+	if !track.behavior().NetworkData {
+		return rest.Result{Code: 400, Message: "only net tracks have network data"}
+	}
+
+	// Sync
+	switches, err := gondulClient().Switches()
+	if err != nil {
+		return rest.Result{Code: 502, Message: "failed to get switches from gondul: " + err.Error()}
+	}
+	synced, missing, err := syncTrackNetworkData(track.ID, switches, time.Now())
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	syncRequest.Synced = synced
+	syncRequest.Missing = missing
+	return rest.Result{}
+}
+
+func gondulClient() *gondul.Client {
+	gondulConfig := config.Config.Gondul
+	return &gondul.Client{
+		BaseURL:  gondulConfig.BaseURL,
+		Username: gondulConfig.Username,
+		Password: gondulConfig.Password,
+	}
+}
+
+// syncDueNetworkData syncs all configured net tracks if Gondul is configured and the sync interval has passed.
+func syncDueNetworkData() error {
+	gondulConfig := config.Config.Gondul
+	if gondulConfig.BaseURL == "" {
+		return nil
+	}
+	interval := defaultNetworkSyncInterval
+	if gondulConfig.SyncIntervalSeconds > 0 {
+		interval = time.Duration(gondulConfig.SyncIntervalSeconds) * time.Second
+	}
+	now := time.Now()
+	lastNetworkSyncLock.Lock()
+	if now.Sub(lastNetworkSync) < interval {
+		lastNetworkSyncLock.Unlock()
+		return nil
+	}
+	lastNetworkSync = now
+	lastNetworkSyncLock.Unlock()
+
+	// Find tracks
+	trackIDs := gondulConfig.Tracks
+	if len(trackIDs) == 0 {
+		var tracks Tracks
+		dbResult := db.SelectMany(&tracks, "tracks")
+		if dbResult.IsFailed() {
+			return dbResult.Error
+		}
+		for _, track := range tracks {
+			if track.behavior().NetworkData {
+				trackIDs = append(trackIDs, track.ID)
+			}
+		}
+	}
+	if len(trackIDs) == 0 {
+		return nil
+	}
+
+	// Sync
+	switches, err := gondulClient().Switches()
+	if err != nil {
+		return err
+	}
+	for _, trackID := range trackIDs {
+		synced, missing, err := syncTrackNetworkData(trackID, switches, now)
+		if err != nil {
+			return err
+		}
+		log.WithFields(log.Fields{
+			"track":   trackID,
+			"synced":  synced,
+			"missing": len(missing),
+		}).Debug("Synced station network data from Gondul")
+	}
+	return nil
+}
+
+// syncTrackNetworkData updates the network fields of the track's non-terminated stations from the Gondul switches.
+// Stations not found in Gondul keep their previous data.
+func syncTrackNetworkData(trackID string, switches map[string]*gondul.Switch, now time.Time) (int, []string, error) {
+	var stations Stations
+	dbResult := db.SelectMany(&stations, "stations", "track", "=", trackID, "status", "!=", StationStatusTerminated)
+	if dbResult.IsFailed() {
+		return 0, nil, dbResult.Error
+	}
+
+	synced := 0
+	missing := make([]string, 0)
+	for _, station := range stations {
+		switchName := station.GondulSwitch
+		if switchName == "" {
+			switchName = station.Shortname
+		}
+		gondulSwitch, ok := switches[switchName]
+		if !ok {
+			missing = append(missing, station.Shortname)
+			continue
+		}
+
+		// Only update the network fields, the rest of the station may have changed since it was loaded
+		_, err := db.DB.Exec("UPDATE stations SET switch_distro = $1, switch_port = $2, management_ipv4 = $3, management_ipv6 = $4, network_sync_time = $5 WHERE id = $6",
+			gondulSwitch.Distro, gondulSwitch.DistroPort, gondulSwitch.ManagementIPv4, gondulSwitch.ManagementIPv6, now, station.ID)
+		if err != nil {
+			return synced, missing, err
+		}
+		synced++
+	}
+	return synced, missing, nil
+}
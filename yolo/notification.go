@@ -0,0 +1,174 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"sort"
+	"time"
+
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/event"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/gathering/tech-online-backend/scheduler"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// Read notifications older than this are deleted by the cleanup action.
+const readNotificationRetention = 30 * 24 * time.Hour
+
+// Notification is an in-app message for a user, created from events affecting the user.
+type Notification struct {
+	ID        *uuid.UUID `column:"id" json:"id"`               // Generated, required, unique
+	UserID    *uuid.UUID `column:"user" json:"user"`           // Required
+	Timestamp *time.Time `column:"timestamp" json:"timestamp"` // Required
+	Type      event.Type `column:"type" json:"type"`           // Event type
+	Title     string     `column:"title" json:"title"`
+	Message   string     `column:"message" json:"message"`
+	Read      bool       `column:"read" json:"read"`
+}
+
+// Notifications is a list of notifications.
+type Notifications []*Notification
+
+// NotificationReadRequest is a request to mark a notification as read.
+type NotificationReadRequest struct{}
+
+func init() {
+	rest.AddHandler("/notifications/", "^$", func() interface{} { return &Notifications{} })
+	rest.AddHandler("/notification/", "^(?P<id>[^/]+)/$", func() interface{} { return &Notification{} })
+	rest.AddHandler("/notification/", "^(?P<id>[^/]+)/read/$", func() interface{} { return &NotificationReadRequest{} })
+	event.Subscribe("notifications", saveEventNotifications)
+	scheduler.AddAction("cleanup-notifications", cleanupNotifications)
+}
+
+// Get gets the notifications for the current user, newest first.
+// Operators/admins may get them for other users using the "user" query arg.
+func (notifications *Notifications) Get(request *rest.Request) rest.Result {
+	// Check params and perms
+	var whereArgs []interface{}
+	if userID, ok := request.QueryArgs["user"]; ok && (request.AccessToken.GetRole() == rest.RoleOperator || request.AccessToken.GetRole() == rest.RoleAdmin) {
+		whereArgs = append(whereArgs, "user", "=", userID)
+	} else if request.AccessToken.OwnerUserID != nil {
+		whereArgs = append(whereArgs, "user", "=", request.AccessToken.OwnerUserID)
+	} else {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+	if _, ok := request.QueryArgs["unread"]; ok {
+		whereArgs = append(whereArgs, "read", "=", false)
+	}
+
+	// Get
+	dbResult := db.SelectMany(notifications, "notifications", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	sort.SliceStable(*notifications, func(i, j int) bool {
+		return (*notifications)[i].Timestamp.After(*(*notifications)[j].Timestamp)
+	})
+	if request.ListLimit > 0 && len(*notifications) > request.ListLimit {
+		*notifications = (*notifications)[:request.ListLimit]
+	}
+	return rest.Result{}
+}
+
+// Get gets a single notification.
+func (notification *Notification) Get(request *rest.Request) rest.Result {
+	return notification.loadForRequest(request)
+}
+
+// Delete deletes a notification.
+func (notification *Notification) Delete(request *rest.Request) rest.Result {
+	if result := notification.loadForRequest(request); !result.IsOk() {
+		return result
+	}
+	dbResult := db.Delete("notifications", "id", "=", notification.ID)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	return rest.Result{}
+}
+
+// Post marks the notification as read.
+func (readRequest *NotificationReadRequest) Post(request *rest.Request) rest.Result {
+	var notification Notification
+	if result := notification.loadForRequest(request); !result.IsOk() {
+		return result
+	}
+	notification.Read = true
+	dbResult := db.Update("notifications", &notification, "id", "=", notification.ID)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	return rest.Result{}
+}
+
+// loadForRequest loads the notification from the path ID, if owned by the current user or if operator/admin.
+func (notification *Notification) loadForRequest(request *rest.Request) rest.Result {
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+
+	// Get
+	dbResult := db.Select(notification, "notifications", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		if request.AccessToken.OwnerUserID == nil || *request.AccessToken.OwnerUserID != *notification.UserID {
+			return rest.UnauthorizedResult(request.AccessToken)
+		}
+	}
+	return rest.Result{}
+}
+
+// saveEventNotifications stores a notification for each user affected by the event.
+func saveEventNotifications(e event.Event) {
+	for _, userID := range e.UserIDs {
+		id := uuid.New()
+		userID := userID
+		timestamp := e.Time
+		notification := Notification{
+			ID:        &id,
+			UserID:    &userID,
+			Timestamp: &timestamp,
+			Type:      e.Type,
+			Title:     e.Title,
+			Message:   e.Message,
+		}
+		if dbResult := db.Insert("notifications", notification); dbResult.IsFailed() {
+			log.WithError(dbResult.Error).WithField("user", userID).Warn("Failed to save notification")
+		}
+	}
+}
+
+// cleanupNotifications deletes old read notifications.
+func cleanupNotifications() error {
+	_, err := db.DB.Exec("DELETE FROM notifications WHERE read = true AND timestamp < $1", time.Now().Add(-readNotificationRetention))
+	return err
+}
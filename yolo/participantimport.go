@@ -0,0 +1,577 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// participantImportTimeLayout is accepted for times in addition to RFC 3339, in local time.
+const participantImportTimeLayout = "2006-01-02 15:04"
+
+// ParticipantImportReport tells what a participant import changed, or would change if a dry run.
+type ParticipantImportReport struct {
+	DryRun          bool                         `json:"dry_run"`
+	Rows            int                          `json:"rows"`
+	UsersCreated    int                          `json:"users_created"`
+	UsersUpdated    int                          `json:"users_updated"`
+	TeamsCreated    int                          `json:"teams_created"`
+	MembersAdded    int                          `json:"members_added"`
+	TimeslotsBooked int                          `json:"timeslots_booked"`
+	Conflicts       []*ParticipantImportConflict `json:"conflicts"` // Rows which were skipped
+}
+
+// ParticipantImportConflict is a row which was skipped, with the reason.
+type ParticipantImportConflict struct {
+	Line     int    `json:"line"` // In the file, the header is line 1
+	Username string `json:"username"`
+	Message  string `json:"message"`
+}
+
+// ParticipantImportRequest imports participants from a CSV body (see ImportParticipants).
+type ParticipantImportRequest struct {
+	ParticipantImportReport
+}
+
+// participantImportUserStatus tells how a row changes its user.
+type participantImportUserStatus int
+
+const (
+	participantImportUserUnchanged participantImportUserStatus = iota
+	participantImportUserCreated
+	participantImportUserUpdated
+)
+
+// participantImportRow is a parsed row.
+type participantImportRow struct {
+	line        int
+	userID      *uuid.UUID
+	username    string
+	displayName string
+	email       string
+	trackID     string
+	teamName    string
+	beginTime   *time.Time
+	endTime     *time.Time
+}
+
+// participantImporter keeps what earlier rows created or would create, so dry runs see the same state as imports.
+type participantImporter struct {
+	dryRun    bool
+	author    string
+	report    *ParticipantImportReport
+	users     map[uuid.UUID]*rest.User
+	usernames map[string]uuid.UUID
+	teams     map[string]*Team     // By track and name
+	timeslots map[string]*Timeslot // Booked by earlier rows, by track and team or user ID
+	lines     map[string]int       // Where the timeslots were booked, by the same key
+	tracks    map[string]bool      // If the track exists
+}
+
+func init() {
+	rest.AddHandler("/participants/import/", "^$", func() interface{} { return &ParticipantImportRequest{} })
+}
+
+// Post imports participants from the CSV body and returns a report. Set the "dry-run" query arg to "true" to only get the report.
+func (importRequest *ParticipantImportRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Import
+	report, result := ImportParticipants(request.Body, request.QueryArgs["dry-run"] == "true", request.AccessToken.GetName())
+	if !result.IsOk() {
+		return result
+	}
+	importRequest.ParticipantImportReport = *report
+	return rest.Result{}
+}
+
+// ImportParticipants imports participants from a CSV export of the signup system, with a header row naming the columns.
+// Each row is a user ("username" and "user_id", "display_name" and "email") which is created or updated, optionally joining or creating
+// the team named "team" in the track "track" and booking a timeslot in it from "begin_time" to "end_time" (for the team, if any).
+// New users need the user ID from Unicorn. Other columns are ignored.
+// Rows which conflict with existing data or earlier rows are skipped and reported, also for dry runs, which change nothing.
+// Importing the same file again changes nothing.
+func ImportParticipants(data []byte, dryRun bool, author string) (*ParticipantImportReport, rest.Result) {
+	rows, conflicts, err := parseParticipantCSV(data)
+	if err != nil {
+		return nil, rest.Result{Code: 400, Message: fmt.Sprintf("malformed CSV: %v", err)}
+	}
+	importer := participantImporter{
+		dryRun:    dryRun,
+		author:    author,
+		report:    &ParticipantImportReport{DryRun: dryRun, Rows: len(rows) + len(conflicts), Conflicts: append(make([]*ParticipantImportConflict, 0), conflicts...)},
+		users:     make(map[uuid.UUID]*rest.User),
+		usernames: make(map[string]uuid.UUID),
+		teams:     make(map[string]*Team),
+		timeslots: make(map[string]*Timeslot),
+		lines:     make(map[string]int),
+		tracks:    make(map[string]bool),
+	}
+	for _, row := range rows {
+		conflict, err := importer.importRow(row)
+		if err != nil {
+			return nil, rest.Result{Code: 500, Error: err}
+		}
+		if conflict != "" {
+			importer.report.Conflicts = append(importer.report.Conflicts, &ParticipantImportConflict{Line: row.line, Username: row.username, Message: conflict})
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"rows":      importer.report.Rows,
+		"users":     importer.report.UsersCreated + importer.report.UsersUpdated,
+		"teams":     importer.report.TeamsCreated,
+		"members":   importer.report.MembersAdded,
+		"timeslots": importer.report.TimeslotsBooked,
+		"conflicts": len(importer.report.Conflicts),
+		"dry_run":   dryRun,
+		"actor":     author,
+	}).Info("Imported participants")
+	return importer.report, rest.Result{}
+}
+
+// importRow checks the user, team membership and timeslot of the row and then applies them, or returns a conflict and changes nothing.
+func (importer *participantImporter) importRow(row *participantImportRow) (string, error) {
+	// Check track
+	if row.trackID != "" {
+		exists, ok := importer.tracks[row.trackID]
+		if !ok {
+			var err error
+			if exists, err = (&Track{ID: row.trackID}).exists(); err != nil {
+				return "", err
+			}
+			importer.tracks[row.trackID] = exists
+		}
+		if !exists {
+			return fmt.Sprintf("track %v does not exist", row.trackID), nil
+		}
+	}
+
+	// Check user
+	user, userStatus, conflict, err := importer.checkUser(row)
+	if conflict != "" || err != nil {
+		return conflict, err
+	}
+
+	// Check team
+	var team *Team
+	newTeam, newMember := false, false
+	if row.teamName != "" {
+		if team, err = importer.loadTeam(row.trackID, row.teamName); err != nil {
+			return "", err
+		}
+		if team == nil {
+			newID := uuid.New()
+			team = &Team{ID: &newID, TrackID: row.trackID, Name: row.teamName, MemberIDs: []uuid.UUID{}}
+			newTeam = true
+		}
+		if !team.hasMember(*user.ID) {
+			if conflict, err := importer.checkNewMember(team, *user.ID); conflict != "" || err != nil {
+				return conflict, err
+			}
+			newMember = true
+		}
+	}
+
+	// Check timeslot
+	var timeslot *Timeslot
+	if row.beginTime != nil {
+		if timeslot, conflict, err = importer.checkTimeslot(row, user, team); conflict != "" || err != nil {
+			return conflict, err
+		}
+	}
+
+	// Apply
+	if userStatus != participantImportUserUnchanged {
+		if !importer.dryRun {
+			if dbResult := db.Upsert("users", user, "id", "=", user.ID); dbResult.IsFailed() {
+				return "", dbResult.Error
+			}
+		}
+		if userStatus == participantImportUserCreated {
+			importer.report.UsersCreated++
+		} else {
+			importer.report.UsersUpdated++
+		}
+	}
+	importer.cacheUser(user)
+	if newTeam {
+		inviteCode, err := generateInviteCode()
+		if err != nil {
+			return "", err
+		}
+		team.InviteCode = inviteCode
+		if !importer.dryRun {
+			if dbResult := db.Insert("teams", team); dbResult.IsFailed() {
+				return "", dbResult.Error
+			}
+		}
+		importer.teams[row.trackID+"/"+row.teamName] = team
+		importer.report.TeamsCreated++
+	}
+	if newMember {
+		if !importer.dryRun {
+			if err := team.addMember(*user.ID); err != nil {
+				return "", err
+			}
+		}
+		team.MemberIDs = append(team.MemberIDs, *user.ID)
+		importer.report.MembersAdded++
+	}
+	if timeslot != nil {
+		if !importer.dryRun {
+			if result := timeslot.create(); !result.IsOk() {
+				if result.Error != nil {
+					return "", result.Error
+				}
+				return result.Message, nil
+			}
+			timeslot.publishBooked()
+			timeslot.publishScheduled()
+		}
+		importer.timeslots[timeslotKey(timeslot)] = timeslot
+		importer.lines[timeslotKey(timeslot)] = row.line
+		importer.report.TimeslotsBooked++
+	}
+	return "", nil
+}
+
+// checkUser finds the user by ID (if given) or username and returns it with the changes from the row.
+// Unknown users are only created if the ID is given.
+func (importer *participantImporter) checkUser(row *participantImportRow) (*rest.User, participantImportUserStatus, string, error) {
+	var existing *rest.User
+	var err error
+	if row.userID != nil {
+		existing, err = importer.loadUser(*row.userID)
+	} else {
+		existing, err = importer.loadUserByUsername(row.username)
+	}
+	if err != nil {
+		return nil, participantImportUserUnchanged, "", err
+	}
+	if existing == nil && row.userID == nil {
+		return nil, participantImportUserUnchanged, "unknown user, the user ID is required to create it", nil
+	}
+
+	user := rest.User{ID: row.userID, Role: rest.RoleParticipant, DisplayName: row.username}
+	if existing != nil {
+		user = *existing
+	}
+	user.Username = row.username
+	if row.displayName != "" {
+		user.DisplayName = row.displayName
+	}
+	if row.email != "" {
+		user.EmailAddress = row.email
+	}
+
+	if existing == nil || user.Username != existing.Username {
+		other, err := importer.loadUserByUsername(user.Username)
+		if err != nil {
+			return nil, participantImportUserUnchanged, "", err
+		}
+		if other != nil && *other.ID != *user.ID {
+			return nil, participantImportUserUnchanged, fmt.Sprintf("username belongs to another user (%v)", other.ID), nil
+		}
+	}
+	switch {
+	case existing == nil:
+		return &user, participantImportUserCreated, "", nil
+	case user.Username != existing.Username || user.DisplayName != existing.DisplayName || user.EmailAddress != existing.EmailAddress:
+		return &user, participantImportUserUpdated, "", nil
+	}
+	return &user, participantImportUserUnchanged, "", nil
+}
+
+// checkNewMember checks if the user may join the (possibly new) team, like validateNewMember but including the changes of earlier rows.
+func (importer *participantImporter) checkNewMember(team *Team, userID uuid.UUID) (string, error) {
+	if maxSize := config.Config.Tracks[team.TrackID].MaxTeamSize; maxSize > 0 && len(team.MemberIDs) >= maxSize {
+		return fmt.Sprintf("team %v is full", team.Name), nil
+	}
+	for _, other := range importer.teams {
+		if other.TrackID == team.TrackID && other != team && other.hasMember(userID) {
+			return fmt.Sprintf("user is already in team %v for this track", other.Name), nil
+		}
+	}
+	var teamName string
+	row := db.DB.QueryRow("SELECT teams.name FROM team_members INNER JOIN teams ON teams.id = team_members.team WHERE teams.track = $1 AND team_members.\"user\" = $2", team.TrackID, userID)
+	if err := row.Scan(&teamName); err == nil {
+		return fmt.Sprintf("user is already in team %v for this track", teamName), nil
+	} else if err != sql.ErrNoRows {
+		return "", err
+	}
+	return "", nil
+}
+
+// checkTimeslot returns the timeslot to book for the user or team, or nil if it's already booked with the same times.
+func (importer *participantImporter) checkTimeslot(row *participantImportRow, user *rest.User, team *Team) (*Timeslot, string, error) {
+	timeslot := &Timeslot{UserID: user.ID, TrackID: row.trackID, BeginTime: row.beginTime, EndTime: row.endTime}
+	column, ownerID := "user", *user.ID
+	if team != nil {
+		timeslot.TeamID = team.ID
+		column, ownerID = "team", *team.ID
+	}
+	key := timeslotKey(timeslot)
+	sameTimes := func(other *Timeslot) bool {
+		return other.BeginTime != nil && other.EndTime != nil && other.BeginTime.Equal(*row.beginTime) && other.EndTime.Equal(*row.endTime)
+	}
+
+	// Booked by an earlier row, e.g. for another member of the team
+	if booked, ok := importer.timeslots[key]; ok {
+		if sameTimes(booked) {
+			return nil, "", nil
+		}
+		return nil, fmt.Sprintf("another timeslot for the %v was booked on line %v", column, importer.lines[key]), nil
+	}
+
+	// Booked before
+	var existing Timeslots
+	if dbResult := db.SelectMany(&existing, "timeslots", "track", "=", row.trackID, column, "=", ownerID); dbResult.IsFailed() {
+		return nil, "", dbResult.Error
+	}
+	for _, other := range existing {
+		if sameTimes(other) {
+			return nil, "", nil
+		}
+	}
+
+	newID := uuid.New()
+	timeslot.ID = &newID
+	if result := timeslot.validateCategory(); !result.IsOk() {
+		return nil, result.Message, nil
+	}
+	if has, err := timeslot.userHasAnotherUnfinishedTimeslot(); err != nil {
+		return nil, "", err
+	} else if has {
+		return nil, "user already has a timeslot for this track", nil
+	}
+	if team != nil {
+		if has, err := timeslot.teamHasAnotherUnfinishedTimeslot(); err != nil {
+			return nil, "", err
+		} else if has {
+			return nil, "team already has a timeslot for this track", nil
+		}
+	}
+	if result := timeslot.checkConflicts(); !result.IsOk() {
+		if result.Error != nil {
+			return nil, "", result.Error
+		}
+		return nil, result.Message, nil
+	}
+	return timeslot, "", nil
+}
+
+// loadUser gets a user by ID, from earlier rows or the DB. Nil if not found.
+func (importer *participantImporter) loadUser(id uuid.UUID) (*rest.User, error) {
+	if user, ok := importer.users[id]; ok {
+		return user, nil
+	}
+	var user rest.User
+	dbResult := db.Select(&user, "users", "id", "=", id)
+	if dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	if !dbResult.IsSuccess() {
+		return nil, nil
+	}
+	importer.cacheUser(&user)
+	return &user, nil
+}
+
+// loadUserByUsername gets a user by username, from earlier rows or the DB. Nil if not found.
+func (importer *participantImporter) loadUserByUsername(username string) (*rest.User, error) {
+	if id, ok := importer.usernames[username]; ok {
+		return importer.users[id], nil
+	}
+	var user rest.User
+	dbResult := db.Select(&user, "users", "username", "=", username)
+	if dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	if !dbResult.IsSuccess() {
+		return nil, nil
+	}
+	if _, ok := importer.users[*user.ID]; ok {
+		// Renamed by an earlier row
+		return nil, nil
+	}
+	importer.cacheUser(&user)
+	return &user, nil
+}
+
+// cacheUser remembers the current state of the user, for later rows.
+func (importer *participantImporter) cacheUser(user *rest.User) {
+	if previous, ok := importer.users[*user.ID]; ok && previous.Username != user.Username {
+		delete(importer.usernames, previous.Username)
+	}
+	importer.users[*user.ID] = user
+	importer.usernames[user.Username] = *user.ID
+}
+
+// loadTeam gets a team by track and name, from earlier rows or the DB. Nil if not found.
+func (importer *participantImporter) loadTeam(trackID string, name string) (*Team, error) {
+	key := trackID + "/" + name
+	if team, ok := importer.teams[key]; ok {
+		return team, nil
+	}
+	var team Team
+	dbResult := db.Select(&team, "teams", "track", "=", trackID, "name", "=", name)
+	if dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	if !dbResult.IsSuccess() {
+		return nil, nil
+	}
+	if err := team.loadMembers(); err != nil {
+		return nil, err
+	}
+	importer.teams[key] = &team
+	return &team, nil
+}
+
+// parseParticipantCSV parses the rows, returning rows with invalid values as conflicts.
+// Columns are matched by the header, case-insensitive and with spaces or dashes as underscores. Semicolons may be used as separators.
+func parseParticipantCSV(data []byte) ([]*participantImportRow, []*ParticipantImportConflict, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")) // Byte order mark from spreadsheets
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	if firstLine := strings.SplitN(string(data), "\n", 2)[0]; strings.Contains(firstLine, ";") && !strings.Contains(firstLine, ",") {
+		reader.Comma = ';'
+	}
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, err
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		name = strings.NewReplacer(" ", "_", "-", "_").Replace(strings.ToLower(strings.TrimSpace(name)))
+		columns[name] = i
+	}
+	if _, ok := columns["username"]; !ok {
+		return nil, nil, fmt.Errorf("missing username column")
+	}
+
+	var rows []*participantImportRow
+	var conflicts []*ParticipantImportConflict
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		value := func(column string) string {
+			if i, ok := columns[column]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		row := &participantImportRow{
+			line:        line,
+			username:    value("username"),
+			displayName: value("display_name"),
+			email:       value("email"),
+			trackID:     value("track"),
+			teamName:    value("team"),
+		}
+		if row.username == "" && value("user_id") == "" && row.trackID == "" {
+			// Empty line
+			continue
+		}
+		if problem := row.parse(value("user_id"), value("begin_time"), value("end_time")); problem != "" {
+			conflicts = append(conflicts, &ParticipantImportConflict{Line: line, Username: row.username, Message: problem})
+			continue
+		}
+		rows = append(rows, row)
+	}
+	return rows, conflicts, nil
+}
+
+// parse parses and validates the values of the row which aren't plain strings, returning a problem if invalid.
+func (row *participantImportRow) parse(rawUserID string, rawBeginTime string, rawEndTime string) string {
+	if row.username == "" {
+		return "missing username"
+	}
+	if rawUserID != "" {
+		userID, err := uuid.Parse(rawUserID)
+		if err != nil {
+			return fmt.Sprintf("invalid user ID: %v", rawUserID)
+		}
+		row.userID = &userID
+	}
+	if (row.teamName != "" || rawBeginTime != "") && row.trackID == "" {
+		return "missing track for the team or timeslot"
+	}
+	if (rawBeginTime == "") != (rawEndTime == "") {
+		return "only begin or end time set"
+	}
+	if rawBeginTime == "" {
+		return ""
+	}
+	var ok bool
+	if row.beginTime, ok = parseParticipantImportTime(rawBeginTime); !ok {
+		return fmt.Sprintf("invalid begin time: %v", rawBeginTime)
+	}
+	if row.endTime, ok = parseParticipantImportTime(rawEndTime); !ok {
+		return fmt.Sprintf("invalid end time: %v", rawEndTime)
+	}
+	if !row.endTime.After(*row.beginTime) {
+		return "the timeslot must end after it begins"
+	}
+	return ""
+}
+
+// parseParticipantImportTime parses an RFC 3339 time or a local time without seconds.
+func parseParticipantImportTime(raw string) (*time.Time, bool) {
+	parsed, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		if parsed, err = time.ParseInLocation(participantImportTimeLayout, raw, time.Local); err != nil {
+			return nil, false
+		}
+	}
+	return &parsed, true
+}
+
+// timeslotKey identifies the owner of the timeslot in the track, the team or else the user.
+func timeslotKey(timeslot *Timeslot) string {
+	if timeslot.TeamID != nil {
+		return timeslot.TrackID + "/" + timeslot.TeamID.String()
+	}
+	return timeslot.TrackID + "/" + timeslot.UserID.String()
+}
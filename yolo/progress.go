@@ -0,0 +1,242 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"context"
+	"time"
+
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+	"golang.org/x/sync/errgroup"
+)
+
+// MyProgress is the progress of the user's team or own timeslot in a track, for the station currently assigned to it.
+// It's everything the participant view needs in one request.
+type MyProgress struct {
+	TrackID          string         `json:"track"`
+	TimeslotID       *uuid.UUID     `json:"timeslot"`
+	State            TimeslotState  `json:"state"`
+	StationID        *uuid.UUID     `json:"station"`
+	StationShortname string         `json:"station_shortname"`
+	BeginTime        *time.Time     `json:"begin_time"`
+	EndTime          *time.Time     `json:"end_time"`
+	RemainingSeconds *int64         `json:"remaining_seconds"` // Until the end time, zero once ended, null without an end time
+	Points           int            `json:"points"`            // From completed tasks
+	Penalty          int            `json:"penalty"`           // From unlocked hints
+	Score            int            `json:"score"`             // Points minus penalty
+	CompletedTasks   int            `json:"completed_tasks"`
+	TotalTasks       int            `json:"total_tasks"`
+	Tasks            []*myTaskState `json:"tasks"`
+}
+
+type myTaskState struct {
+	Shortname      string   `json:"shortname"`
+	Name           string   `json:"name"`
+	Description    string   `json:"description"`
+	Sequence       *int     `json:"sequence"`
+	Points         int      `json:"points"`        // Awarded when completed
+	EarnedPoints   int      `json:"earned_points"` // Points if completed
+	Penalty        int      `json:"penalty"`       // From the unlocked hints of the task
+	DependsOn      []string `json:"depends_on"`
+	Locked         bool     `json:"locked,omitempty"` // If the dependencies are not passed yet, on tracks with task unlocking
+	Completed      bool     `json:"completed"`        // If the task has tests and all pass
+	PassedTests    int      `json:"passed_tests"`
+	FailedTests    int      `json:"failed_tests"`
+	TotalTests     int      `json:"total_tests"`
+	Tests          []Test   `json:"tests"`
+	Hints          Hints    `json:"hints"`           // Only the unlocked hints, with content
+	HintsRemaining int      `json:"hints_remaining"` // Locked hints which may still be unlocked
+}
+
+func init() {
+	rest.AddHandler("/custom/my-progress/", "^(?P<track_id>[^/]+)/$", func() interface{} { return &MyProgress{} })
+	rest.SetCachePolicy(&MyProgress{}, rest.CachePolicy{NoStore: true})
+}
+
+// Get finds the station assigned to a timeslot of the user (or the user's teams) in the track and
+// rolls up the tests, points and hints of the timeslot per task, using the same rules as the score.
+func (progress *MyProgress) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.OwnerUserID == nil {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	trackID, trackIDExists := request.PathArgs["track_id"]
+	if !trackIDExists || trackID == "" {
+		return rest.Result{Code: 400, Message: "missing track ID"}
+	}
+
+	// Find the timeslot with a station
+	userTimeslots, err := loadUserTimeslots(request.AccessToken.OwnerUserID.String())
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	trackTimeslots := make(map[string]*Timeslot)
+	timeslotIDs := make([]string, 0)
+	for _, timeslot := range userTimeslots {
+		if timeslot.TrackID == trackID {
+			trackTimeslots[timeslot.ID.String()] = timeslot
+			timeslotIDs = append(timeslotIDs, timeslot.ID.String())
+		}
+	}
+	if len(timeslotIDs) == 0 {
+		return rest.Result{Code: 404, Message: "no timeslot in the track"}
+	}
+	var station Station
+	stationDBResult := db.Select(&station, "stations",
+		"track", "=", trackID,
+		"timeslot", "IN", timeslotIDs,
+		"status", "!=", StationStatusTerminated,
+	)
+	if stationDBResult.IsFailed() {
+		return rest.Result{Code: 500, Error: stationDBResult.Error}
+	}
+	if !stationDBResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "no station assigned to a timeslot in the track"}
+	}
+	timeslot := trackTimeslots[station.TimeslotID]
+
+	// The queries are independent, so run them concurrently
+	var tasks Tasks
+	var tests Tests
+	var hints Hints
+	var unlockedIDs map[uuid.UUID]bool
+	var dependencyMap map[string][]string
+	group, groupCtx := errgroup.WithContext(request.Context())
+	group.Go(withQueryTimeout(groupCtx, func(ctx context.Context) error {
+		return db.SelectManyContext(ctx, &tasks, "tasks", "track", "=", trackID).Error
+	}))
+	group.Go(withQueryTimeout(groupCtx, func(ctx context.Context) error {
+		return db.SelectManyContext(ctx, &tests, "tests", "track", "=", trackID, "timeslot", "=", timeslot.ID.String()).Error
+	}))
+	group.Go(withQueryTimeout(groupCtx, func(ctx context.Context) error {
+		return db.SelectManyContext(ctx, &hints, "hints", "track", "=", trackID).Error
+	}))
+	group.Go(withQueryTimeout(groupCtx, func(ctx context.Context) error {
+		var unlockedErr error
+		unlockedIDs, unlockedErr = unlockedHintIDs(timeslot.ID.String())
+		return unlockedErr
+	}))
+	group.Go(withQueryTimeout(groupCtx, func(ctx context.Context) error {
+		var dependenciesErr error
+		dependencyMap, dependenciesErr = loadTaskDependencies(ctx, trackID)
+		return dependenciesErr
+	}))
+	if err := group.Wait(); err != nil {
+		return rest.Result{Error: err}
+	}
+
+	// Timeslot and station
+	now := time.Now()
+	progress.TrackID = trackID
+	progress.TimeslotID = timeslot.ID
+	progress.State = timeslot.State
+	progress.StationID = station.ID
+	progress.StationShortname = station.Shortname
+	progress.BeginTime = timeslot.BeginTime
+	progress.EndTime = timeslot.EndTime
+	if timeslot.EndTime != nil {
+		// Not using durations, they saturate for the far future end times of stations assigned without a schedule
+		remaining := timeslot.EndTime.Unix() - now.Unix()
+		if remaining < 0 {
+			remaining = 0
+		}
+		progress.RemainingSeconds = &remaining
+	}
+
+	// Roll up the tasks
+	tasks.sortBySequence()
+	hints.sort()
+	plainTests := make([]Test, 0, len(tests))
+	for _, test := range tests {
+		plainTests = append(plainTests, *test)
+	}
+	completion := taskCompletion(plainTests)
+	unlockingMode := taskUnlockingMode(trackID, request.AccessToken)
+	progress.Tasks = make([]*myTaskState, 0, len(tasks))
+	for _, task := range tasks {
+		taskState := myTaskState{
+			Shortname:   task.Shortname,
+			Name:        task.Name,
+			Description: task.Description,
+			Sequence:    task.Sequence,
+			Points:      task.Points,
+			DependsOn:   dependencyMap[task.Shortname],
+			Completed:   completion[task.Shortname],
+			Tests:       make([]Test, 0),
+			Hints:       make(Hints, 0),
+		}
+		if taskState.DependsOn == nil {
+			taskState.DependsOn = make([]string, 0)
+		}
+		for _, test := range plainTests {
+			if test.TaskShortname != task.Shortname {
+				continue
+			}
+			taskState.TotalTests++
+			if test.StatusSuccess != nil && *test.StatusSuccess {
+				taskState.PassedTests++
+			} else if test.StatusSuccess != nil {
+				taskState.FailedTests++
+			}
+			taskState.Tests = append(taskState.Tests, test)
+		}
+		if taskState.Completed {
+			taskState.EarnedPoints = task.Points
+		}
+		for _, hint := range hints {
+			if hint.TaskShortname != task.Shortname {
+				continue
+			}
+			if unlockedIDs[*hint.ID] {
+				hint.Unlocked = true
+				taskState.Penalty += hint.Penalty
+				taskState.Hints = append(taskState.Hints, hint)
+			} else {
+				taskState.HintsRemaining++
+			}
+		}
+
+		// Totals include hidden tasks, to match the score
+		progress.TotalTasks++
+		progress.Points += taskState.EarnedPoints
+		progress.Penalty += taskState.Penalty
+		if taskState.Completed {
+			progress.CompletedTasks++
+		}
+
+		locked := unlockingMode != TaskUnlockingNone && !isTaskUnlocked(taskState.DependsOn, completion)
+		if locked && unlockingMode == TaskUnlockingHide {
+			continue
+		}
+		if locked {
+			taskState.Locked = true
+			taskState.Description = ""
+		}
+		progress.Tasks = append(progress.Tasks, &taskState)
+	}
+	progress.Score = progress.Points - progress.Penalty
+
+	return rest.Result{}
+}
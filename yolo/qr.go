@@ -0,0 +1,128 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/qrcode"
+	"github.com/gathering/tech-online-backend/rest"
+)
+
+// StationQRCode is a QR code of the configured station URL, for printed table cards.
+type StationQRCode struct {
+	raw *rest.RawResponse
+}
+
+// StationQRCodeData is the template data of the station URL.
+type StationQRCodeData struct {
+	ID        string
+	Track     string
+	Shortname string
+	Name      string
+}
+
+func init() {
+	rest.AddHandler("/station/", "^(?P<id>[^/]+)/qr/$", func() interface{} { return &StationQRCode{} })
+}
+
+// Get renders the code as PNG or SVG, see qrcode.ParseOptions for the query args.
+// The "download" query arg makes clients save it as a file.
+func (code *StationQRCode) Get(request *rest.Request) rest.Result {
+	// Check perms
+	role := request.AccessToken.GetRole()
+	if role != rest.RoleOperator && role != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	if config.Config.QRCodes.StationURL == "" {
+		return rest.Result{Code: 404, Message: "station QR codes not configured"}
+	}
+	options, err := qrcode.ParseOptions(request.QueryArgs)
+	if err != nil {
+		return rest.Result{Code: 400, Message: err.Error()}
+	}
+
+	// Get
+	var station Station
+	text, result := stationQRCodeText(&station, request.PathArgs["id"])
+	if !result.IsOk() {
+		return result
+	}
+	data, contentType, err := options.Render(text)
+	if err != nil {
+		return rest.Result{Code: 400, Message: err.Error()}
+	}
+	code.raw = &rest.RawResponse{
+		ContentType: contentType,
+		Data:        data,
+	}
+	if _, ok := request.QueryArgs["download"]; ok {
+		code.raw.Filename = fmt.Sprintf("%v-%v.%v", station.TrackID, station.Shortname, options.Format)
+	}
+	return rest.Result{}
+}
+
+// Version gets a version of the code, which changes with the URL and options, for caching.
+func (code *StationQRCode) Version(request *rest.Request) (string, error) {
+	options, err := qrcode.ParseOptions(request.QueryArgs)
+	if err != nil || config.Config.QRCodes.StationURL == "" {
+		return "", nil
+	}
+	var station Station
+	text, result := stationQRCodeText(&station, request.PathArgs["id"])
+	if result.Error != nil {
+		return "", result.Error
+	}
+	if !result.IsOk() {
+		return "", nil
+	}
+	return options.Version(text), nil
+}
+
+// RawResponse returns the code.
+func (code *StationQRCode) RawResponse() *rest.RawResponse {
+	return code.raw
+}
+
+// stationQRCodeText loads the station and renders its URL.
+func stationQRCodeText(station *Station, id string) (string, rest.Result) {
+	dbResult := db.Select(station, "stations", "id", "=", id)
+	if dbResult.IsFailed() {
+		return "", rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		return "", rest.Result{Code: 404, Message: "not found"}
+	}
+	text, err := qrcode.FormatURL(config.Config.QRCodes.StationURL, StationQRCodeData{
+		ID:        station.ID.String(),
+		Track:     station.TrackID,
+		Shortname: station.Shortname,
+		Name:      station.Name,
+	})
+	if err != nil {
+		return "", rest.Result{Code: 500, Error: err}
+	}
+	return text, rest.Result{}
+}
@@ -0,0 +1,503 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/event"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/gathering/tech-online-backend/scheduler"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const queuePromotionInterval = 30 * time.Second
+
+// QueueEntryStatus is the status of a queue entry.
+type QueueEntryStatus string
+
+const (
+	// QueueEntryStatusWaiting means the timeslot is waiting for a station.
+	QueueEntryStatusWaiting QueueEntryStatus = "waiting"
+	// QueueEntryStatusAssigned means the timeslot got a station and has begun.
+	QueueEntryStatusAssigned QueueEntryStatus = "assigned"
+	// QueueEntryStatusCancelled means the entry was cancelled before getting a station.
+	QueueEntryStatusCancelled QueueEntryStatus = "cancelled"
+)
+
+// Event types for the queue.
+const (
+	EventTypeQueueAssigned  event.Type = "queue.assigned"
+	EventTypeQueueCancelled event.Type = "queue.cancelled"
+)
+
+// QueueEntry is a timeslot waiting for a station to become available.
+type QueueEntry struct {
+	ID         *uuid.UUID       `column:"id" json:"id"`                   // Generated, required, unique
+	TrackID    string           `column:"track" json:"track"`             // Generated from timeslot
+	TimeslotID *uuid.UUID       `column:"timeslot" json:"timeslot"`       // Required
+	Status     QueueEntryStatus `column:"status" json:"status"`           // Generated
+	QueueTime  *time.Time       `column:"queue_time" json:"queue_time"`   // Generated, decides the order
+	AssignTime *time.Time       `column:"assign_time" json:"assign_time"` // Generated when assigned
+	StationID  *uuid.UUID       `column:"station" json:"station"`         // Generated when assigned
+	Priority   int              `column:"priority" json:"priority"`       // Generated from the timeslot category, higher goes first
+	Position   int              `column:"-" json:"position,omitempty"`    // Position in the queue while waiting, starting at 1
+}
+
+// QueueEntries is a list of queue entries.
+type QueueEntries []*QueueEntry
+
+// TimeslotQueueRequest is a request to begin the timeslot now if a station is available, or else to queue it.
+type TimeslotQueueRequest struct{}
+
+// QueueEntryCancelRequest is a request to leave the queue.
+type QueueEntryCancelRequest struct{}
+
+// queuePromotionLock prevents concurrent promotions from assigning the same station twice.
+var queuePromotionLock sync.Mutex
+
+func init() {
+	rest.AddHandler("/queue/", "^$", func() interface{} { return &QueueEntries{} })
+	rest.AddHandler("/queue-entry/", "^(?P<id>[^/]+)/$", func() interface{} { return &QueueEntry{} })
+	rest.AddHandler("/queue-entry/", "^(?P<id>[^/]+)/cancel/$", func() interface{} { return &QueueEntryCancelRequest{} })
+	rest.AddHandler("/timeslot/", "^(?P<id>[^/]+)/queue/$", func() interface{} { return &TimeslotQueueRequest{} })
+	scheduler.AddJob("promote-queue", queuePromotionInterval, promoteAllQueues)
+}
+
+// Get gets the waiting queue entries, in queue order.
+// Participants only get their own, but with the position.
+func (entries *QueueEntries) Get(request *rest.Request) rest.Result {
+	// Check params, prep filtering
+	whereArgs := []interface{}{"status", "=", QueueEntryStatusWaiting}
+	if trackID, ok := request.QueryArgs["track"]; ok {
+		whereArgs = append(whereArgs, "track", "=", trackID)
+	}
+
+	// Get
+	var allEntries QueueEntries
+	dbResult := db.SelectMany(&allEntries, "queue_entries", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	sortQueueEntries(allEntries)
+	setQueuePositions(allEntries)
+
+	// Hide other's entries unless operator/admin
+	visibleEntries, err := visibleQueueEntries(allEntries, request.AccessToken)
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	*entries = append(*entries, visibleEntries...)
+	return rest.Result{}
+}
+
+// Get gets a single queue entry.
+func (entry *QueueEntry) Get(request *rest.Request) rest.Result {
+	if result := entry.loadFromRequest(request); !result.IsOk() {
+		return result
+	}
+	if result := entry.checkPerms(request.AccessToken); !result.IsOk() {
+		return result
+	}
+	if entry.Status == QueueEntryStatusWaiting {
+		var waiting QueueEntries
+		dbResult := db.SelectMany(&waiting, "queue_entries", "track", "=", entry.TrackID, "status", "=", QueueEntryStatusWaiting)
+		if dbResult.IsFailed() {
+			return rest.Result{Code: 500, Error: dbResult.Error}
+		}
+		sortQueueEntries(waiting)
+		setQueuePositions(waiting)
+		for _, other := range waiting {
+			if *other.ID == *entry.ID {
+				entry.Position = other.Position
+			}
+		}
+	}
+	return rest.Result{}
+}
+
+// Post cancels a waiting queue entry.
+func (cancelRequest *QueueEntryCancelRequest) Post(request *rest.Request) rest.Result {
+	var entry QueueEntry
+	if result := entry.loadFromRequest(request); !result.IsOk() {
+		return result
+	}
+	if result := entry.checkPerms(request.AccessToken); !result.IsOk() {
+		return result
+	}
+	if entry.Status != QueueEntryStatusWaiting {
+		return rest.Result{Code: 409, Message: "queue entry is not waiting"}
+	}
+
+	entry.Status = QueueEntryStatusCancelled
+	dbResult := db.Update("queue_entries", &entry, "id", "=", entry.ID)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+
+	// Tell the participants if someone else cancelled it
+	if request.AccessToken.GetRole() == rest.RoleOperator || request.AccessToken.GetRole() == rest.RoleAdmin {
+		var timeslot Timeslot
+		if dbResult := db.Select(&timeslot, "timeslots", "id", "=", entry.TimeslotID); dbResult.IsSuccess() {
+			timeslot.publishEvent(EventTypeQueueCancelled, "Removed from queue", "You have been removed from the queue by an operator.", entry)
+		}
+	}
+
+	// Let the next in line move up
+	if err := promoteQueue(entry.TrackID); err != nil {
+		request.Log().WithError(err).WithField("track", entry.TrackID).Warn("Failed to promote queue after removing entry")
+	}
+	return rest.Result{}
+}
+
+// Post begins the timeslot now if a station is available and nobody is waiting, or else adds it to the queue.
+// Redirects to the station if begun, or responds with 201 and the location of the queue entry if queued.
+func (queueRequest *TimeslotQueueRequest) Post(request *rest.Request) rest.Result {
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+
+	// Get timeslot and track
+	var timeslot Timeslot
+	timeslotDBResult := db.Select(&timeslot, "timeslots", "id", "=", id)
+	if timeslotDBResult.IsFailed() {
+		return rest.Result{Code: 500, Error: timeslotDBResult.Error}
+	}
+	if !timeslotDBResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+	var track Track
+	trackDBResult := db.Select(&track, "tracks", "id", "=", timeslot.TrackID)
+	if trackDBResult.IsFailed() {
+		return rest.Result{Code: 500, Error: trackDBResult.Error}
+	}
+	if !trackDBResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "track not found"}
+	}
+
+	// Check perms
+	if result := timeslot.checkParticipantPerms(request.AccessToken); !result.IsOk() {
+		return result
+	}
+
+	// Validate
+	if result := timeslot.checkMayBegin(); !result.IsOk() {
+		return result
+	}
+	if hasStation, err := timeslot.isActiveWithStation(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	} else if hasStation {
+		return rest.Result{Code: 409, Message: "timeslot already has a station"}
+	}
+	if timeslot.EndTime != nil && timeslot.EndTime.Before(time.Now()) {
+		return rest.Result{Code: 409, Message: "timeslot has ended"}
+	}
+	waitingDBResult := db.Exists("queue_entries", "timeslot", "=", timeslot.ID, "status", "=", QueueEntryStatusWaiting)
+	if waitingDBResult.IsFailed() {
+		return rest.Result{Code: 500, Error: waitingDBResult.Error}
+	}
+	if waitingDBResult.IsSuccess() {
+		return rest.Result{Code: 409, Message: "timeslot is already queued"}
+	}
+
+	queuePromotionLock.Lock()
+	defer queuePromotionLock.Unlock()
+
+	// Begin now if nobody else with the same or higher priority is waiting
+	priority := timeslot.priority()
+	othersDBResult := db.Exists("queue_entries", "track", "=", track.ID, "status", "=", QueueEntryStatusWaiting, "priority", ">=", priority)
+	if othersDBResult.IsFailed() {
+		return rest.Result{Code: 500, Error: othersDBResult.Error}
+	}
+	if !othersDBResult.IsSuccess() {
+		station, result := timeslot.begin(&track, false)
+		if result.IsOk() {
+			return rest.Result{Code: 303, Location: fmt.Sprintf("%v/station/%v/", config.Config.SitePrefix, station.ID)}
+		}
+		if result.Code != 404 && result.Code != 409 {
+			return result
+		}
+	}
+
+	// Queue it
+	entryID := uuid.New()
+	now := time.Now()
+	entry := QueueEntry{
+		ID:         &entryID,
+		TrackID:    track.ID,
+		TimeslotID: timeslot.ID,
+		Status:     QueueEntryStatusWaiting,
+		QueueTime:  &now,
+		Priority:   priority,
+	}
+	dbResult := db.Insert("queue_entries", entry)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	return rest.Result{Code: 201, Location: fmt.Sprintf("%v/queue-entry/%v/", config.Config.SitePrefix, entry.ID)}
+}
+
+func (entry *QueueEntry) loadFromRequest(request *rest.Request) rest.Result {
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+	dbResult := db.Select(entry, "queue_entries", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+	return rest.Result{}
+}
+
+// checkPerms returns an error result unless the token is an operator/admin or a participant of the entry's timeslot.
+func (entry *QueueEntry) checkPerms(token rest.AccessTokenEntry) rest.Result {
+	if token.GetRole() == rest.RoleOperator || token.GetRole() == rest.RoleAdmin {
+		return rest.Result{}
+	}
+	var timeslot Timeslot
+	dbResult := db.Select(&timeslot, "timeslots", "id", "=", entry.TimeslotID)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		return rest.UnauthorizedResult(token)
+	}
+	return timeslot.checkParticipantPerms(token)
+}
+
+// visibleQueueEntries filters the entries to the ones the token may see, like checkPerms,
+// but with the timeslots and team memberships looked up in batches instead of per entry.
+func visibleQueueEntries(entries QueueEntries, token rest.AccessTokenEntry) (QueueEntries, error) {
+	if token.GetRole() == rest.RoleOperator || token.GetRole() == rest.RoleAdmin {
+		return entries, nil
+	}
+	visibleEntries := make(QueueEntries, 0)
+	if token.OwnerUserID == nil || len(entries) == 0 {
+		return visibleEntries, nil
+	}
+
+	timeslotIDs := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		timeslotIDs = append(timeslotIDs, entry.TimeslotID.String())
+	}
+	var timeslots Timeslots
+	if dbResult := db.SelectMany(&timeslots, "timeslots", "id", "IN", timeslotIDs); dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	var memberships TeamMembers
+	if dbResult := db.SelectMany(&memberships, "team_members", "user", "=", token.OwnerUserID); dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	teamIDs := make(map[uuid.UUID]bool, len(memberships))
+	for _, membership := range memberships {
+		teamIDs[*membership.TeamID] = true
+	}
+	ownTimeslots := make(map[uuid.UUID]bool)
+	for _, timeslot := range timeslots {
+		if (timeslot.UserID != nil && *timeslot.UserID == *token.OwnerUserID) || (timeslot.TeamID != nil && teamIDs[*timeslot.TeamID]) {
+			ownTimeslots[*timeslot.ID] = true
+		}
+	}
+
+	for _, entry := range entries {
+		if ownTimeslots[*entry.TimeslotID] {
+			visibleEntries = append(visibleEntries, entry)
+		}
+	}
+	return visibleEntries, nil
+}
+
+// promoteAllQueues promotes the queues for all tracks with waiting entries.
+// Stations may become ready without anything in the queue noticing, so this runs periodically.
+func promoteAllQueues() error {
+	rows, err := db.DB.Query("SELECT DISTINCT track FROM queue_entries WHERE status = $1", QueueEntryStatusWaiting)
+	if err != nil {
+		return err
+	}
+	var trackIDs []string
+	for rows.Next() {
+		var trackID string
+		if err := rows.Scan(&trackID); err != nil {
+			rows.Close()
+			return err
+		}
+		trackIDs = append(trackIDs, trackID)
+	}
+	rows.Close()
+
+	// Failures are logged and the rest of the tracks are still promoted
+	failures := 0
+	for _, trackID := range trackIDs {
+		if err := promoteQueue(trackID); err != nil {
+			log.WithError(err).WithField("track", trackID).Warn("Failed to promote queue")
+			failures++
+		}
+	}
+	if failures > 0 {
+		return fmt.Errorf("%v tracks failed", failures)
+	}
+	return nil
+}
+
+// promoteQueue begins waiting timeslots from the front of the queue while there are stations available,
+// and notifies the participants. Failing entries are logged and skipped, so they don't block the rest of the queue.
+func promoteQueue(trackID string) error {
+	queuePromotionLock.Lock()
+	defer queuePromotionLock.Unlock()
+
+	var track Track
+	trackDBResult := db.Select(&track, "tracks", "id", "=", trackID)
+	if trackDBResult.IsFailed() {
+		return trackDBResult.Error
+	}
+	if !trackDBResult.IsSuccess() {
+		return fmt.Errorf("track not found: %v", trackID)
+	}
+
+	var waiting QueueEntries
+	dbResult := db.SelectMany(&waiting, "queue_entries", "track", "=", trackID, "status", "=", QueueEntryStatusWaiting)
+	if dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	sortQueueEntries(waiting)
+
+	failures := 0
+	for _, entry := range waiting {
+		entryLog := log.WithFields(log.Fields{
+			"track":       trackID,
+			"queue_entry": entry.ID,
+			"timeslot":    entry.TimeslotID,
+		})
+		var timeslot Timeslot
+		timeslotDBResult := db.Select(&timeslot, "timeslots", "id", "=", entry.TimeslotID)
+		if timeslotDBResult.IsFailed() {
+			entryLog.WithError(timeslotDBResult.Error).Warn("Failed to get timeslot of queue entry")
+			failures++
+			continue
+		}
+		if !timeslotDBResult.IsSuccess() || !timeslot.isUnfinished() {
+			// Timeslot deleted, cancelled or otherwise done, drop the entry
+			entry.Status = QueueEntryStatusCancelled
+			if dbResult := db.Update("queue_entries", entry, "id", "=", entry.ID); dbResult.IsFailed() {
+				entryLog.WithError(dbResult.Error).Warn("Failed to drop queue entry")
+				failures++
+			}
+			continue
+		}
+
+		station, result := timeslot.begin(&track, false)
+		if result.Code == 404 {
+			// No more stations for now
+			break
+		}
+		if result.Code == 409 {
+			// Category is full, let others through
+			continue
+		}
+		if !result.IsOk() {
+			entryLog.WithError(result.Error).WithField("message", result.Message).Warn("Failed to begin timeslot from queue")
+			failures++
+			continue
+		}
+
+		now := time.Now()
+		entry.Status = QueueEntryStatusAssigned
+		entry.AssignTime = &now
+		entry.StationID = station.ID
+		if dbResult := db.Update("queue_entries", entry, "id", "=", entry.ID); dbResult.IsFailed() {
+			entryLog.WithError(dbResult.Error).WithField("station", station.ID).Warn("Failed to mark queue entry as assigned")
+			failures++
+			continue
+		}
+		entryLog.WithField("station", station.ID).Info("Promoted timeslot from queue")
+		timeslot.publishEvent(EventTypeQueueAssigned, "Your station is ready",
+			fmt.Sprintf("You got station %v (%v) and your timeslot has begun.", station.Name, station.Shortname), entry)
+	}
+	if failures > 0 {
+		return fmt.Errorf("%v queue entries failed", failures)
+	}
+	return nil
+}
+
+// publishEvent publishes an event to all participants of the timeslot (the user and any team members).
+func (timeslot *Timeslot) publishEvent(eventType event.Type, title string, message string, data interface{}) {
+	userIDs, err := timeslot.participantIDs()
+	if err != nil {
+		log.WithError(err).WithField("timeslot", timeslot.ID).Warn("Failed to find timeslot participants for event")
+		return
+	}
+	event.Publish(event.Event{
+		Type:    eventType,
+		TrackID: timeslot.TrackID,
+		UserIDs: userIDs,
+		Title:   title,
+		Message: message,
+		Data:    data,
+	})
+}
+
+// participantIDs returns the user and any team members of the timeslot.
+func (timeslot *Timeslot) participantIDs() ([]uuid.UUID, error) {
+	var userIDs []uuid.UUID
+	if timeslot.UserID != nil {
+		userIDs = append(userIDs, *timeslot.UserID)
+	}
+	if timeslot.TeamID != nil {
+		team := Team{ID: timeslot.TeamID}
+		if err := team.loadMembers(); err != nil {
+			return nil, err
+		}
+		for _, memberID := range team.MemberIDs {
+			if timeslot.UserID == nil || memberID != *timeslot.UserID {
+				userIDs = append(userIDs, memberID)
+			}
+		}
+	}
+	return userIDs, nil
+}
+
+// sortQueueEntries sorts entries by priority, highest first, then by queue time, earliest first.
+func sortQueueEntries(entries QueueEntries) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Priority != entries[j].Priority {
+			return entries[i].Priority > entries[j].Priority
+		}
+		return entries[i].QueueTime.Before(*entries[j].QueueTime)
+	})
+}
+
+// setQueuePositions sets the positions for sorted waiting entries.
+func setQueuePositions(entries QueueEntries) {
+	for i, entry := range entries {
+		entry.Position = i + 1
+	}
+}
@@ -0,0 +1,482 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+)
+
+// RegistrationStatus is the status of a track registration.
+type RegistrationStatus string
+
+const (
+	// RegistrationStatusPending means the registration is within capacity, but awaits approval by an operator/admin.
+	RegistrationStatusPending RegistrationStatus = "pending"
+	// RegistrationStatusApproved means the user may participate and has got a timeslot.
+	RegistrationStatusApproved RegistrationStatus = "approved"
+	// RegistrationStatusWaitlisted means the track is full and the registration is queued.
+	RegistrationStatusWaitlisted RegistrationStatus = "waitlisted"
+	// RegistrationStatusRejected means an operator/admin rejected the registration.
+	RegistrationStatusRejected RegistrationStatus = "rejected"
+	// RegistrationStatusCancelled means the user or an operator/admin cancelled the registration.
+	RegistrationStatusCancelled RegistrationStatus = "cancelled"
+)
+
+// Registration is a user's sign-up for a track.
+// Approved registrations get a timeslot, which is used for the rest of the participation.
+type Registration struct {
+	ID         *uuid.UUID         `column:"id" json:"id"`                 // Generated, required, unique
+	UserID     *uuid.UUID         `column:"user" json:"user"`             // Required, the current user for participants
+	TrackID    string             `column:"track" json:"track"`           // Required
+	Status     RegistrationStatus `column:"status" json:"status"`         // Generated
+	QueueTime  *time.Time         `column:"queue_time" json:"queue_time"` // Generated, decides the waitlist order (earliest first)
+	TimeslotID *uuid.UUID         `column:"timeslot" json:"timeslot"`     // Generated when approved
+	Notes      string             `column:"notes" json:"notes"`           // Optional
+}
+
+// Registrations is a list of registrations.
+type Registrations []*Registration
+
+// RegistrationCancelRequest is a request to cancel a registration.
+type RegistrationCancelRequest struct{}
+
+// RegistrationApproveRequest is a request to approve a pending or waitlisted registration.
+type RegistrationApproveRequest struct{}
+
+// RegistrationRejectRequest is a request to reject a registration.
+type RegistrationRejectRequest struct{}
+
+// RegistrationBumpRequest is a request to move a waitlisted registration to the front of the waitlist.
+type RegistrationBumpRequest struct{}
+
+func init() {
+	rest.AddHandler("/registrations/", "^$", func() interface{} { return &Registrations{} })
+	rest.AddHandler("/registration/", "^(?:(?P<id>[^/]+)/)?$", func() interface{} { return &Registration{} })
+	rest.AddHandler("/registration/", "^(?P<id>[^/]+)/cancel/$", func() interface{} { return &RegistrationCancelRequest{} })
+	rest.AddHandler("/registration/", "^(?P<id>[^/]+)/approve/$", func() interface{} { return &RegistrationApproveRequest{} })
+	rest.AddHandler("/registration/", "^(?P<id>[^/]+)/reject/$", func() interface{} { return &RegistrationRejectRequest{} })
+	rest.AddHandler("/registration/", "^(?P<id>[^/]+)/bump/$", func() interface{} { return &RegistrationBumpRequest{} })
+}
+
+// Get gets multiple registrations, in queue order.
+// Participants only get their own.
+func (registrations *Registrations) Get(request *rest.Request) rest.Result {
+	// Check params, prep filtering
+	var whereArgs []interface{}
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		if request.AccessToken.OwnerUserID == nil {
+			return rest.UnauthorizedResult(request.AccessToken)
+		}
+		whereArgs = append(whereArgs, "user", "=", request.AccessToken.OwnerUserID)
+	} else if userID, ok := request.QueryArgs["user"]; ok {
+		whereArgs = append(whereArgs, "user", "=", userID)
+	}
+	if trackID, ok := request.QueryArgs["track"]; ok {
+		whereArgs = append(whereArgs, "track", "=", trackID)
+	}
+	if status, ok := request.QueryArgs["status"]; ok {
+		whereArgs = append(whereArgs, "status", "=", status)
+	}
+
+	// Get
+	dbResult := db.SelectMany(registrations, "registrations", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	sortRegistrations(*registrations)
+	return rest.Result{}
+}
+
+// Get gets a single registration.
+func (registration *Registration) Get(request *rest.Request) rest.Result {
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+
+	// Get and check perms
+	if result := registration.load(id); !result.IsOk() {
+		return result
+	}
+	return registration.checkOwnerPerms(request.AccessToken)
+}
+
+// Post registers a user for a track.
+// The registration gets pending/approved if the track has capacity left, else it's waitlisted.
+// Participants may only register themselves.
+func (registration *Registration) Post(request *rest.Request) rest.Result {
+	// Check perms
+	isPrivileged := request.AccessToken.GetRole() == rest.RoleOperator || request.AccessToken.GetRole() == rest.RoleAdmin
+	if !isPrivileged {
+		if request.AccessToken.OwnerUserID == nil {
+			return rest.UnauthorizedResult(request.AccessToken)
+		}
+		registration.UserID = request.AccessToken.OwnerUserID
+		registration.Notes = ""
+	}
+
+	// Overwrite stuff
+	if registration.ID == nil {
+		newID := uuid.New()
+		registration.ID = &newID
+	}
+	now := time.Now()
+	registration.QueueTime = &now
+	registration.TimeslotID = nil
+
+	// Validate
+	if result := registration.validate(); !result.IsOk() {
+		return result
+	}
+	if has, err := registration.userHasAnotherActiveRegistration(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	} else if has {
+		return rest.Result{Code: 409, Message: "user is already registered for this track"}
+	}
+
+	// Decide status
+	hasCapacity, capacityErr := trackHasRegistrationCapacity(registration.TrackID)
+	if capacityErr != nil {
+		return rest.Result{Code: 500, Error: capacityErr}
+	}
+	registration.Status = RegistrationStatusWaitlisted
+	if hasCapacity {
+		registration.Status = RegistrationStatusPending
+	}
+
+	// Create, approve if no approval needed and redirect
+	if exists, err := registration.exists(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	} else if exists {
+		return rest.Result{Code: 409, Message: "duplicate"}
+	}
+	dbResult := db.Insert("registrations", registration)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if registration.Status == RegistrationStatusPending && !config.Config.Tracks[registration.TrackID].RequireApproval {
+		if result := registration.approve(); !result.IsOk() {
+			return result
+		}
+	}
+	return rest.Result{Code: 201, Location: fmt.Sprintf("%v/registration/%v/", config.Config.SitePrefix, registration.ID)}
+}
+
+// Delete deletes a registration, without affecting any timeslot.
+func (registration *Registration) Delete(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+
+	// Check if it exists
+	if result := registration.load(id); !result.IsOk() {
+		return result
+	}
+
+	// Delete it and fill the free spot
+	dbResult := db.Delete("registrations", "id", "=", registration.ID)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	return promoteWaitlistedRegistrations(registration.TrackID)
+}
+
+// Post cancels the registration and promotes the next in the waitlist, if any.
+// Any timeslot is left as-is.
+func (cancelRequest *RegistrationCancelRequest) Post(request *rest.Request) rest.Result {
+	var registration Registration
+	if result := registration.loadFromRequest(request); !result.IsOk() {
+		return result
+	}
+	if result := registration.checkOwnerPerms(request.AccessToken); !result.IsOk() {
+		return result
+	}
+	if registration.Status == RegistrationStatusCancelled || registration.Status == RegistrationStatusRejected {
+		return rest.Result{Code: 409, Message: fmt.Sprintf("registration is already %v", registration.Status)}
+	}
+
+	registration.Status = RegistrationStatusCancelled
+	if result := registration.update(); !result.IsOk() {
+		return result
+	}
+	return promoteWaitlistedRegistrations(registration.TrackID)
+}
+
+// Post approves a pending or waitlisted registration, ignoring the track capacity.
+func (approveRequest *RegistrationApproveRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	var registration Registration
+	if result := registration.loadFromRequest(request); !result.IsOk() {
+		return result
+	}
+	if registration.Status != RegistrationStatusPending && registration.Status != RegistrationStatusWaitlisted {
+		return rest.Result{Code: 409, Message: fmt.Sprintf("cannot approve %v registration", registration.Status)}
+	}
+	return registration.approve()
+}
+
+// Post rejects a registration and promotes the next in the waitlist, if any.
+func (rejectRequest *RegistrationRejectRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	var registration Registration
+	if result := registration.loadFromRequest(request); !result.IsOk() {
+		return result
+	}
+	if registration.Status != RegistrationStatusPending && registration.Status != RegistrationStatusWaitlisted {
+		return rest.Result{Code: 409, Message: fmt.Sprintf("cannot reject %v registration", registration.Status)}
+	}
+
+	registration.Status = RegistrationStatusRejected
+	if result := registration.update(); !result.IsOk() {
+		return result
+	}
+	return promoteWaitlistedRegistrations(registration.TrackID)
+}
+
+// Post moves a waitlisted registration to the front of the waitlist.
+func (bumpRequest *RegistrationBumpRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	var registration Registration
+	if result := registration.loadFromRequest(request); !result.IsOk() {
+		return result
+	}
+	if registration.Status != RegistrationStatusWaitlisted {
+		return rest.Result{Code: 409, Message: "registration is not waitlisted"}
+	}
+
+	// Queue it just before the current first one
+	var firstQueueTime *time.Time
+	row := db.DB.QueryRow("SELECT MIN(queue_time) FROM registrations WHERE track = $1 AND status = $2", registration.TrackID, RegistrationStatusWaitlisted)
+	if err := row.Scan(&firstQueueTime); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	if firstQueueTime != nil && !firstQueueTime.After(*registration.QueueTime) {
+		newQueueTime := firstQueueTime.Add(-time.Millisecond)
+		registration.QueueTime = &newQueueTime
+	}
+	return registration.update()
+}
+
+func (registration *Registration) loadFromRequest(request *rest.Request) rest.Result {
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+	return registration.load(id)
+}
+
+func (registration *Registration) load(id string) rest.Result {
+	dbResult := db.Select(registration, "registrations", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+	return rest.Result{}
+}
+
+func (registration *Registration) update() rest.Result {
+	dbResult := db.Update("registrations", registration, "id", "=", registration.ID)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	return rest.Result{}
+}
+
+// checkOwnerPerms returns an error result unless the token is an operator/admin or the registered user.
+func (registration *Registration) checkOwnerPerms(token rest.AccessTokenEntry) rest.Result {
+	if token.GetRole() == rest.RoleOperator || token.GetRole() == rest.RoleAdmin {
+		return rest.Result{}
+	}
+	if token.OwnerUserID == nil || registration.UserID == nil || *token.OwnerUserID != *registration.UserID {
+		return rest.UnauthorizedResult(token)
+	}
+	return rest.Result{}
+}
+
+// approve approves the registration and creates a timeslot for it, reusing (and approving) any unfinished timeslot the user has for the track.
+func (registration *Registration) approve() rest.Result {
+	var timeslots Timeslots
+	dbResult := db.SelectMany(&timeslots, "timeslots", "user", "=", registration.UserID, "track", "=", registration.TrackID)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	now := time.Now()
+	for _, timeslot := range timeslots {
+		if !timeslot.isUnfinished() || (timeslot.EndTime != nil && !timeslot.EndTime.After(now)) {
+			continue
+		}
+		if timeslot.State == TimeslotStateRequested {
+			if result := timeslot.transition(TimeslotStateApproved, "registration"); !result.IsOk() {
+				return result
+			}
+		}
+		registration.TimeslotID = timeslot.ID
+		break
+	}
+	if registration.TimeslotID == nil {
+		timeslotID := uuid.New()
+		timeslot := Timeslot{
+			ID:      &timeslotID,
+			UserID:  registration.UserID,
+			TrackID: registration.TrackID,
+		}
+		if result := timeslot.validate(); !result.IsOk() {
+			return result
+		}
+		if result := timeslot.create(); !result.IsOk() {
+			return result
+		}
+		registration.TimeslotID = timeslot.ID
+	}
+
+	registration.Status = RegistrationStatusApproved
+	return registration.update()
+}
+
+func (registration *Registration) exists() (bool, error) {
+	var count int
+	row := db.DB.QueryRow("SELECT COUNT(*) FROM registrations WHERE id = $1", registration.ID)
+	rowErr := row.Scan(&count)
+	if rowErr != nil {
+		return false, rowErr
+	}
+	return count > 0, nil
+}
+
+// userHasAnotherActiveRegistration checks if the user has another pending, approved or waitlisted registration for the track.
+func (registration *Registration) userHasAnotherActiveRegistration() (bool, error) {
+	var count int
+	row := db.DB.QueryRow("SELECT COUNT(*) FROM registrations WHERE id != $1 AND track = $2 AND \"user\" = $3 AND status IN ($4, $5, $6)",
+		registration.ID, registration.TrackID, registration.UserID,
+		RegistrationStatusPending, RegistrationStatusApproved, RegistrationStatusWaitlisted)
+	rowErr := row.Scan(&count)
+	if rowErr != nil {
+		return false, rowErr
+	}
+	return count > 0, nil
+}
+
+func (registration *Registration) validate() rest.Result {
+	switch {
+	case registration.ID == nil:
+		return rest.Result{Code: 400, Message: "missing ID"}
+	case registration.UserID == nil:
+		return rest.Result{Code: 400, Message: "missing user ID"}
+	case registration.TrackID == "":
+		return rest.Result{Code: 400, Message: "missing track ID"}
+	}
+
+	user := rest.User{ID: registration.UserID}
+	if exists, err := user.ExistsWithID(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	} else if !exists {
+		return rest.Result{Code: 400, Message: "referenced user does not exist"}
+	}
+	track := Track{ID: registration.TrackID}
+	if exists, err := track.exists(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	} else if !exists {
+		return rest.Result{Code: 400, Message: "referenced track does not exist"}
+	}
+
+	return rest.Result{}
+}
+
+// trackHasRegistrationCapacity checks if the track has room for another pending/approved registration.
+func trackHasRegistrationCapacity(trackID string) (bool, error) {
+	capacity := config.Config.Tracks[trackID].Capacity
+	if capacity <= 0 {
+		return true, nil
+	}
+	var count int
+	row := db.DB.QueryRow("SELECT COUNT(*) FROM registrations WHERE track = $1 AND status IN ($2, $3)", trackID, RegistrationStatusPending, RegistrationStatusApproved)
+	if err := row.Scan(&count); err != nil {
+		return false, err
+	}
+	return count < capacity, nil
+}
+
+// promoteWaitlistedRegistrations moves registrations from the front of the waitlist while the track has capacity.
+func promoteWaitlistedRegistrations(trackID string) rest.Result {
+	var waitlisted Registrations
+	dbResult := db.SelectMany(&waitlisted, "registrations", "track", "=", trackID, "status", "=", RegistrationStatusWaitlisted)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	sortRegistrations(waitlisted)
+
+	for _, registration := range waitlisted {
+		if hasCapacity, err := trackHasRegistrationCapacity(trackID); err != nil {
+			return rest.Result{Code: 500, Error: err}
+		} else if !hasCapacity {
+			break
+		}
+		if config.Config.Tracks[trackID].RequireApproval {
+			registration.Status = RegistrationStatusPending
+			if result := registration.update(); !result.IsOk() {
+				return result
+			}
+		} else if result := registration.approve(); !result.IsOk() {
+			return result
+		}
+	}
+	return rest.Result{}
+}
+
+// sortRegistrations sorts registrations by queue time, earliest first.
+func sortRegistrations(registrations Registrations) {
+	sort.SliceStable(registrations, func(i, j int) bool {
+		a, b := registrations[i].QueueTime, registrations[j].QueueTime
+		if a == nil || b == nil {
+			return a != nil
+		}
+		return a.Before(*b)
+	})
+}
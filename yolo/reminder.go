@@ -0,0 +1,233 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/event"
+	"github.com/gathering/tech-online-backend/scheduler"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	reminderInterval             = 1 * time.Minute
+	defaultUpcomingReminderLead  = 15 * time.Minute
+	defaultEndingReminderLead    = 10 * time.Minute
+	reminderTimeFormat           = "2006-01-02 15:04 MST"
+	defaultUpcomingReminderTitle = "Your timeslot begins soon"
+	defaultUpcomingReminderText  = "Your timeslot for track {{.Track}} begins in {{.Minutes}} minutes, at {{.BeginTime}}."
+	defaultEndingReminderTitle   = "Your timeslot ends soon"
+	defaultEndingReminderText    = "Your timeslot for track {{.Track}} ends in {{.Minutes}} minutes, at {{.EndTime}}."
+)
+
+// Event types for timeslot scheduling, sent to the participants of the timeslot.
+const (
+	EventTypeTimeslotScheduled event.Type = "timeslot.scheduled" // The begin time was set or changed
+	EventTypeTimeslotUpcoming  event.Type = "timeslot.upcoming"  // The timeslot begins soon
+	EventTypeTimeslotEnding    event.Type = "timeslot.ending"    // The timeslot ends soon
+)
+
+// Reminder kinds.
+const (
+	ReminderKindUpcoming = "upcoming"
+	ReminderKindEnding   = "ending"
+)
+
+// TimeslotReminder records that a reminder was sent for a timeslot, so it's only sent once.
+type TimeslotReminder struct {
+	TimeslotID *uuid.UUID `column:"timeslot" json:"timeslot"`
+	Kind       string     `column:"kind" json:"kind"`
+	Timestamp  *time.Time `column:"timestamp" json:"timestamp"`
+}
+
+// TimeslotReminders is a list of timeslot reminders.
+type TimeslotReminders []*TimeslotReminder
+
+// ReminderTemplateData is what the reminder templates get.
+type ReminderTemplateData struct {
+	Track     string
+	TrackName string
+	BeginTime string
+	EndTime   string
+	Minutes   int
+}
+
+func init() {
+	scheduler.AddJob("remind-timeslots", reminderInterval, remindTimeslots)
+}
+
+// publishScheduled tells the participants when the timeslot begins.
+// Reminders are sent again for the new time.
+func (timeslot *Timeslot) publishScheduled() {
+	if err := timeslot.clearReminders(ReminderKindUpcoming, ReminderKindEnding); err != nil {
+		log.WithError(err).WithField("timeslot", timeslot.ID).Warn("Failed to clear reminders of rescheduled timeslot")
+	}
+	timeslot.publishEvent(EventTypeTimeslotScheduled, "Your timeslot is scheduled",
+		fmt.Sprintf("Your timeslot for track %v begins at %v.", timeslot.TrackID, displayTime(*timeslot.BeginTime).Format(reminderTimeFormat)), timeslot)
+}
+
+// remindTimeslots notifies the participants of timeslots beginning or ending soon, once per timeslot and kind.
+// The lead times and texts are configured per track.
+func remindTimeslots() error {
+	now := time.Now()
+	var timeslots Timeslots
+	dbResult := db.SelectMany(&timeslots, "timeslots", "end_time", ">", now, "state", "IN", []string{string(TimeslotStateApproved), string(TimeslotStateActive)})
+	if dbResult.IsFailed() {
+		return dbResult.Error
+	}
+
+	tracks := make(map[string]*Track)
+	for _, timeslot := range timeslots {
+		if timeslot.BeginTime == nil {
+			continue
+		}
+		remindersConfig := config.Config.Tracks[timeslot.TrackID].Reminders
+		var kind string
+		var remindTime time.Time
+		var templateConfig config.ReminderTemplateConfig
+		var defaultTitle, defaultText string
+		var eventType event.Type
+		if now.Before(*timeslot.BeginTime) {
+			lead := reminderLead(remindersConfig.UpcomingLeadSeconds, defaultUpcomingReminderLead)
+			if lead < 0 || timeslot.BeginTime.After(now.Add(lead)) {
+				continue
+			}
+			kind, remindTime, eventType = ReminderKindUpcoming, *timeslot.BeginTime, EventTypeTimeslotUpcoming
+			templateConfig, defaultTitle, defaultText = remindersConfig.Upcoming, defaultUpcomingReminderTitle, defaultUpcomingReminderText
+		} else {
+			lead := reminderLead(remindersConfig.EndingLeadSeconds, defaultEndingReminderLead)
+			if lead < 0 || timeslot.EndTime.After(now.Add(lead)) {
+				continue
+			}
+			kind, remindTime, eventType = ReminderKindEnding, *timeslot.EndTime, EventTypeTimeslotEnding
+			templateConfig, defaultTitle, defaultText = remindersConfig.Ending, defaultEndingReminderTitle, defaultEndingReminderText
+		}
+
+		if sent, err := timeslot.hasReminder(kind); err != nil {
+			return err
+		} else if sent {
+			continue
+		}
+		if _, ok := tracks[timeslot.TrackID]; !ok {
+			var track Track
+			if trackDBResult := db.Select(&track, "tracks", "id", "=", timeslot.TrackID); trackDBResult.IsFailed() {
+				return trackDBResult.Error
+			}
+			tracks[timeslot.TrackID] = &track
+		}
+		data := ReminderTemplateData{
+			Track:     timeslot.TrackID,
+			TrackName: tracks[timeslot.TrackID].Name,
+			BeginTime: displayTime(*timeslot.BeginTime).Format(reminderTimeFormat),
+			EndTime:   displayTime(*timeslot.EndTime).Format(reminderTimeFormat),
+			Minutes:   int(remindTime.Sub(now).Round(time.Minute).Minutes()),
+		}
+		title, text := renderReminder(templateConfig, defaultTitle, defaultText, data, timeslot.TrackID)
+
+		if err := timeslot.saveReminder(kind); err != nil {
+			return err
+		}
+		timeslot.publishEvent(eventType, title, text, timeslot)
+		log.WithFields(log.Fields{
+			"timeslot": timeslot.ID,
+			"kind":     kind,
+		}).Debug("Sent timeslot reminder")
+	}
+	return nil
+}
+
+// reminderLead gets the configured lead time, or the default if unset. Negative means disabled.
+func reminderLead(seconds int, defaultLead time.Duration) time.Duration {
+	if seconds == 0 {
+		return defaultLead
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// renderReminder renders the configured templates, falling back to the built-in ones if unset or invalid.
+func renderReminder(templateConfig config.ReminderTemplateConfig, defaultTitle string, defaultText string, data ReminderTemplateData, trackID string) (string, string) {
+	titleTemplate := templateConfig.Title
+	if titleTemplate == "" {
+		titleTemplate = defaultTitle
+	}
+	textTemplate := templateConfig.Message
+	if textTemplate == "" {
+		textTemplate = defaultText
+	}
+	title, err := renderReminderTemplate(titleTemplate, data)
+	if err != nil {
+		log.WithError(err).WithField("track", trackID).Warn("Invalid reminder title template, using the built-in one")
+		title, _ = renderReminderTemplate(defaultTitle, data)
+	}
+	text, err := renderReminderTemplate(textTemplate, data)
+	if err != nil {
+		log.WithError(err).WithField("track", trackID).Warn("Invalid reminder message template, using the built-in one")
+		text, _ = renderReminderTemplate(defaultText, data)
+	}
+	return title, text
+}
+
+func renderReminderTemplate(text string, data ReminderTemplateData) (string, error) {
+	parsed, err := template.New("reminder").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var result bytes.Buffer
+	if err := parsed.Execute(&result, data); err != nil {
+		return "", err
+	}
+	return result.String(), nil
+}
+
+func (timeslot *Timeslot) hasReminder(kind string) (bool, error) {
+	var count int
+	row := db.DB.QueryRow("SELECT COUNT(*) FROM timeslot_reminders WHERE timeslot = $1 AND kind = $2", timeslot.ID, kind)
+	if err := row.Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (timeslot *Timeslot) saveReminder(kind string) error {
+	now := time.Now()
+	reminder := TimeslotReminder{TimeslotID: timeslot.ID, Kind: kind, Timestamp: &now}
+	if dbResult := db.Insert("timeslot_reminders", reminder); dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	return nil
+}
+
+// clearReminders forgets sent reminders, so they are sent again, e.g. when the timeslot is rescheduled.
+func (timeslot *Timeslot) clearReminders(kinds ...string) error {
+	for _, kind := range kinds {
+		if dbResult := db.Delete("timeslot_reminders", "timeslot", "=", timeslot.ID, "kind", "=", kind); dbResult.IsFailed() {
+			return dbResult.Error
+		}
+	}
+	return nil
+}
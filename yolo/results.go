@@ -0,0 +1,441 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+)
+
+// ResultsExport is a ZIP archive with the final results as CSV and JSON, for post-event reports.
+type ResultsExport struct {
+	raw *rest.RawResponse
+}
+
+// ResultScore is a row of the score results.
+type ResultScore struct {
+	Rank           int    `json:"rank"` // Within the track, equal scores share the rank
+	TimeslotID     string `json:"timeslot"`
+	TrackID        string `json:"track"`
+	Username       string `json:"username"`
+	DisplayName    string `json:"display_name"`
+	Team           string `json:"team"`
+	Score          int    `json:"score"`
+	Points         int    `json:"points"`
+	Penalty        int    `json:"penalty"`
+	CompletedTasks int    `json:"completed_tasks"`
+	HintsUnlocked  int    `json:"hints_unlocked"`
+}
+
+// ResultTestRow is a row of the test pass matrix, with the status of each test ("<task>/<test>") for the timeslot.
+type ResultTestRow struct {
+	TimeslotID string          `json:"timeslot"`
+	TrackID    string          `json:"track"`
+	Username   string          `json:"username"`
+	Team       string          `json:"team"`
+	Station    string          `json:"station"` // Shortname of the station of the latest test
+	Tests      map[string]bool `json:"tests"`
+}
+
+// ResultTimeslot is a row of the timeslot usage results.
+type ResultTimeslot struct {
+	TimeslotID      string     `json:"timeslot"`
+	TrackID         string     `json:"track"`
+	Username        string     `json:"username"`
+	DisplayName     string     `json:"display_name"`
+	Team            string     `json:"team"`
+	BeginTime       *time.Time `json:"begin_time"`
+	EndTime         *time.Time `json:"end_time"`
+	Stations        []string   `json:"stations"`         // Shortnames of the stations assigned to it
+	AssignedSeconds int        `json:"assigned_seconds"` // Total time with an assigned station
+	Tests           int        `json:"tests"`
+	PassedTests     int        `json:"passed_tests"`
+}
+
+func init() {
+	rest.AddHandler("/results/", "^export/$", func() interface{} { return &ResultsExport{} })
+}
+
+// Get builds the results archive. Use the "track" query arg to limit to one track.
+func (export *ResultsExport) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	trackID := request.QueryArgs["track"]
+
+	// Build
+	data, err := buildResultsArchive(trackID, time.Now())
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	filename := "results.zip"
+	if trackID != "" {
+		filename = fmt.Sprintf("results-%v.zip", trackID)
+	}
+	export.raw = &rest.RawResponse{
+		ContentType: "application/zip",
+		Filename:    filename,
+		Data:        data,
+	}
+	return rest.Result{}
+}
+
+// RawResponse returns the archive.
+func (export *ResultsExport) RawResponse() *rest.RawResponse {
+	return export.raw
+}
+
+// buildResultsArchive loads everything for the track (or all tracks if empty) and writes the archive.
+func buildResultsArchive(trackID string, now time.Time) ([]byte, error) {
+	var trackWhereArgs []interface{}
+	if trackID != "" {
+		trackWhereArgs = append(trackWhereArgs, "track", "=", trackID)
+	}
+
+	// Load
+	var timeslots Timeslots
+	if dbResult := db.SelectMany(&timeslots, "timeslots", trackWhereArgs...); dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	var scores TimeslotScores
+	if dbResult := db.SelectMany(&scores, "timeslot_scores", trackWhereArgs...); dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	var tests Tests
+	if dbResult := db.SelectMany(&tests, "tests", append(trackWhereArgs, "timeslot", "!=", "")...); dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	var assignments StationAssignments
+	if dbResult := db.SelectMany(&assignments, "station_assignments"); dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	var stations Stations
+	if dbResult := db.SelectMany(&stations, "stations", trackWhereArgs...); dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	var users rest.Users
+	if dbResult := db.SelectMany(&users, "users"); dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	var teams Teams
+	if dbResult := db.SelectMany(&teams, "teams", trackWhereArgs...); dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+
+	// Lookups
+	timeslotMap := make(map[string]*Timeslot)
+	for _, timeslot := range timeslots {
+		timeslotMap[timeslot.ID.String()] = timeslot
+	}
+	userMap := make(map[uuid.UUID]*rest.User)
+	for _, user := range users {
+		userMap[*user.ID] = user
+	}
+	teamNames := make(map[uuid.UUID]string)
+	for _, team := range teams {
+		teamNames[*team.ID] = team.Name
+	}
+	stationShortnames := make(map[uuid.UUID]string)
+	for _, station := range stations {
+		stationShortnames[*station.ID] = station.Shortname
+	}
+	describe := func(timeslotID string) (username string, displayName string, team string) {
+		timeslot, ok := timeslotMap[timeslotID]
+		if !ok {
+			return "", "", ""
+		}
+		if timeslot.UserID != nil {
+			if user, ok := userMap[*timeslot.UserID]; ok {
+				username = user.Username
+				displayName = user.DisplayName
+			}
+		}
+		if timeslot.TeamID != nil {
+			team = teamNames[*timeslot.TeamID]
+		}
+		return
+	}
+
+	// Scores, ranked within each track
+	sort.SliceStable(scores, func(i, j int) bool {
+		if scores[i].TrackID != scores[j].TrackID {
+			return scores[i].TrackID < scores[j].TrackID
+		}
+		return scores[i].Score > scores[j].Score
+	})
+	resultScores := make([]ResultScore, 0, len(scores))
+	trackIndex := 0
+	for i, score := range scores {
+		rank := 1
+		if i > 0 && scores[i-1].TrackID == score.TrackID {
+			trackIndex++
+			rank = resultScores[i-1].Rank
+			if scores[i-1].Score != score.Score {
+				rank = trackIndex + 1
+			}
+		} else {
+			trackIndex = 0
+		}
+		username, displayName, team := describe(score.TimeslotID.String())
+		resultScores = append(resultScores, ResultScore{
+			Rank:           rank,
+			TimeslotID:     score.TimeslotID.String(),
+			TrackID:        score.TrackID,
+			Username:       username,
+			DisplayName:    displayName,
+			Team:           team,
+			Score:          score.Score,
+			Points:         score.Points,
+			Penalty:        score.Penalty,
+			CompletedTasks: score.CompletedTasks,
+			HintsUnlocked:  score.HintsUnlocked,
+		})
+	}
+
+	// Test pass matrix
+	testRowMap := make(map[string]*ResultTestRow)
+	var testRows []*ResultTestRow
+	testKeySet := make(map[string]bool)
+	latestTests := make(map[string]*Test)
+	testCounts := make(map[string]int)
+	passedCounts := make(map[string]int)
+	for _, test := range tests {
+		row, ok := testRowMap[test.TimeslotID]
+		if !ok {
+			username, _, team := describe(test.TimeslotID)
+			row = &ResultTestRow{
+				TimeslotID: test.TimeslotID,
+				TrackID:    test.TrackID,
+				Username:   username,
+				Team:       team,
+				Tests:      make(map[string]bool),
+			}
+			testRowMap[test.TimeslotID] = row
+			testRows = append(testRows, row)
+		}
+		key := test.TaskShortname + "/" + test.Shortname
+		testKeySet[key] = true
+		passed := test.StatusSuccess != nil && *test.StatusSuccess
+		row.Tests[key] = passed
+		testCounts[test.TimeslotID]++
+		if passed {
+			passedCounts[test.TimeslotID]++
+		}
+		if latest, ok := latestTests[test.TimeslotID]; !ok || (test.Timestamp != nil && latest.Timestamp != nil && test.Timestamp.After(*latest.Timestamp)) {
+			latestTests[test.TimeslotID] = test
+			row.Station = test.StationShortname
+		}
+	}
+	sort.SliceStable(testRows, func(i, j int) bool {
+		if testRows[i].TrackID != testRows[j].TrackID {
+			return testRows[i].TrackID < testRows[j].TrackID
+		}
+		return testRows[i].Username < testRows[j].Username
+	})
+	testKeys := make([]string, 0, len(testKeySet))
+	for key := range testKeySet {
+		testKeys = append(testKeys, key)
+	}
+	sort.Strings(testKeys)
+
+	// Timeslot usage, from the assignment history
+	sort.SliceStable(assignments, func(i, j int) bool {
+		return assignments[i].Timestamp.Before(*assignments[j].Timestamp)
+	})
+	assignedSince := make(map[string]*time.Time)
+	assignedDurations := make(map[string]time.Duration)
+	assignedStations := make(map[string][]string)
+	for _, assignment := range assignments {
+		if assignment.TimeslotID == nil {
+			continue
+		}
+		timeslotID := assignment.TimeslotID.String()
+		if _, ok := timeslotMap[timeslotID]; !ok {
+			continue
+		}
+		switch assignment.Action {
+		case StationAssignmentActionAssign:
+			if since := assignedSince[timeslotID]; since != nil {
+				assignedDurations[timeslotID] += assignment.Timestamp.Sub(*since)
+			}
+			assignedSince[timeslotID] = assignment.Timestamp
+			if assignment.StationID != nil {
+				shortname := stationShortnames[*assignment.StationID]
+				if shortname == "" {
+					shortname = assignment.StationID.String()
+				}
+				assignedStations[timeslotID] = appendUnique(assignedStations[timeslotID], shortname)
+			}
+		case StationAssignmentActionUnassign:
+			if since := assignedSince[timeslotID]; since != nil {
+				assignedDurations[timeslotID] += assignment.Timestamp.Sub(*since)
+				assignedSince[timeslotID] = nil
+			}
+		}
+	}
+	resultTimeslots := make([]ResultTimeslot, 0, len(timeslots))
+	for _, timeslot := range timeslots {
+		timeslotID := timeslot.ID.String()
+		if since := assignedSince[timeslotID]; since != nil {
+			end := now
+			if timeslot.EndTime != nil && timeslot.EndTime.Before(now) {
+				end = *timeslot.EndTime
+			}
+			if end.After(*since) {
+				assignedDurations[timeslotID] += end.Sub(*since)
+			}
+		}
+		username, displayName, team := describe(timeslotID)
+		stationList := assignedStations[timeslotID]
+		if stationList == nil {
+			stationList = make([]string, 0)
+		}
+		resultTimeslots = append(resultTimeslots, ResultTimeslot{
+			TimeslotID:      timeslotID,
+			TrackID:         timeslot.TrackID,
+			Username:        username,
+			DisplayName:     displayName,
+			Team:            team,
+			BeginTime:       timeslot.BeginTime,
+			EndTime:         timeslot.EndTime,
+			Stations:        stationList,
+			AssignedSeconds: int(assignedDurations[timeslotID].Seconds()),
+			Tests:           testCounts[timeslotID],
+			PassedTests:     passedCounts[timeslotID],
+		})
+	}
+	sort.SliceStable(resultTimeslots, func(i, j int) bool {
+		if resultTimeslots[i].TrackID != resultTimeslots[j].TrackID {
+			return resultTimeslots[i].TrackID < resultTimeslots[j].TrackID
+		}
+		return timeBefore(resultTimeslots[i].BeginTime, resultTimeslots[j].BeginTime)
+	})
+
+	// CSV tables
+	scoreTable := [][]string{{"rank", "track", "timeslot", "username", "display_name", "team", "score", "points", "penalty", "completed_tasks", "hints_unlocked"}}
+	for _, score := range resultScores {
+		scoreTable = append(scoreTable, []string{
+			strconv.Itoa(score.Rank), score.TrackID, score.TimeslotID, score.Username, score.DisplayName, score.Team,
+			strconv.Itoa(score.Score), strconv.Itoa(score.Points), strconv.Itoa(score.Penalty),
+			strconv.Itoa(score.CompletedTasks), strconv.Itoa(score.HintsUnlocked),
+		})
+	}
+	testTable := [][]string{append([]string{"track", "timeslot", "username", "team", "station"}, testKeys...)}
+	for _, row := range testRows {
+		record := []string{row.TrackID, row.TimeslotID, row.Username, row.Team, row.Station}
+		for _, key := range testKeys {
+			passed, ok := row.Tests[key]
+			switch {
+			case !ok:
+				record = append(record, "")
+			case passed:
+				record = append(record, "pass")
+			default:
+				record = append(record, "fail")
+			}
+		}
+		testTable = append(testTable, record)
+	}
+	timeslotTable := [][]string{{"track", "timeslot", "username", "display_name", "team", "begin_time", "end_time", "stations", "assigned_seconds", "tests", "passed_tests"}}
+	for _, timeslot := range resultTimeslots {
+		timeslotTable = append(timeslotTable, []string{
+			timeslot.TrackID, timeslot.TimeslotID, timeslot.Username, timeslot.DisplayName, timeslot.Team,
+			formatResultTime(timeslot.BeginTime), formatResultTime(timeslot.EndTime), strings.Join(timeslot.Stations, " "),
+			strconv.Itoa(timeslot.AssignedSeconds), strconv.Itoa(timeslot.Tests), strconv.Itoa(timeslot.PassedTests),
+		})
+	}
+	if testRows == nil {
+		testRows = make([]*ResultTestRow, 0)
+	}
+
+	// Archive
+	var buffer bytes.Buffer
+	archive := zip.NewWriter(&buffer)
+	files := []struct {
+		name  string
+		table [][]string
+		data  interface{}
+	}{
+		{"scores", scoreTable, resultScores},
+		{"tests", testTable, testRows},
+		{"timeslots", timeslotTable, resultTimeslots},
+	}
+	for _, file := range files {
+		csvWriter, err := archive.CreateHeader(&zip.FileHeader{Name: file.name + ".csv", Method: zip.Deflate, Modified: now})
+		if err != nil {
+			return nil, err
+		}
+		if err := csv.NewWriter(csvWriter).WriteAll(file.table); err != nil {
+			return nil, err
+		}
+		jsonWriter, err := archive.CreateHeader(&zip.FileHeader{Name: file.name + ".json", Method: zip.Deflate, Modified: now})
+		if err != nil {
+			return nil, err
+		}
+		encoder := json.NewEncoder(jsonWriter)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(file.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func appendUnique(values []string, value string) []string {
+	for _, existing := range values {
+		if existing == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
+
+// timeBefore compares optional times, with missing times last.
+func timeBefore(a *time.Time, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a != nil
+	}
+	return a.Before(*b)
+}
+
+func formatResultTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
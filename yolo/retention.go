@@ -0,0 +1,249 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/attachment"
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/gathering/tech-online-backend/scheduler"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	retentionInterval                = time.Hour
+	defaultRetentionCaptureHours     = 24
+	defaultRetentionReportDays       = 30
+	retentionStationActionDelete     = "delete"
+	retentionStationActionAnonymize  = "anonymize"
+	retentionAnonymizedStationNotice = "Anonymized by retention"
+)
+
+// RetentionReport is what a cleanup run removed (or would remove, for previews).
+type RetentionReport struct {
+	ID                  *uuid.UUID `column:"id" json:"id"`
+	Timestamp           *time.Time `column:"timestamp" json:"timestamp"`
+	DryRun              bool       `column:"-" json:"dry_run"`
+	ExpiredTokens       int        `column:"expired_tokens" json:"expired_tokens"`             // Deleted access tokens
+	TerminatedStations  int        `column:"terminated_stations" json:"terminated_stations"`   // Deleted or anonymized stations
+	StationAction       string     `column:"station_action" json:"station_action"`             // "delete" or "anonymize"
+	CapturedRequests    int        `column:"captured_requests" json:"captured_requests"`       // Dropped request captures
+	OrphanedAttachments int        `column:"orphaned_attachments" json:"orphaned_attachments"` // Deleted attachments without owners
+	Errors              string     `column:"errors" json:"errors"`                             // Failed parts, the other parts still run
+}
+
+// RetentionReports is a list of cleanup reports.
+type RetentionReports []*RetentionReport
+
+// RetentionPreview is a dry run of the cleanup, reporting what would be cleaned now.
+type RetentionPreview RetentionReport
+
+// retentionLock keeps manual and scheduled runs apart, so the counts are right.
+var retentionLock sync.Mutex
+
+func init() {
+	rest.AddHandler("/retention/", "^reports/$", func() interface{} { return &RetentionReports{} })
+	rest.AddHandler("/retention/", "^preview/$", func() interface{} { return &RetentionPreview{} })
+	scheduler.AddJob("apply-retention", retentionInterval, applyRetention)
+	config.AddValidator(validateRetentionConfig)
+}
+
+// Get gets the reports of the cleanup runs, newest first.
+func (reports *RetentionReports) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Get
+	*reports = make(RetentionReports, 0)
+	dbResult := db.SelectMany(reports, "retention_reports")
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	sort.SliceStable(*reports, func(i, j int) bool {
+		return (*reports)[i].Timestamp.After(*(*reports)[j].Timestamp)
+	})
+	if request.ListLimit > 0 && len(*reports) > request.ListLimit {
+		*reports = (*reports)[:request.ListLimit]
+	}
+	return rest.Result{}
+}
+
+// Get reports what a cleanup would remove now, without changing anything.
+func (preview *RetentionPreview) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Get
+	*preview = RetentionPreview(*runRetention(time.Now(), true))
+	return rest.Result{}
+}
+
+// applyRetention cleans up stale data and saves the report if anything was cleaned or failed.
+func applyRetention() error {
+	now := time.Now()
+	report := runRetention(now, false)
+
+	reportDays := config.Config.Retention.ReportDays
+	if reportDays <= 0 {
+		reportDays = defaultRetentionReportDays
+	}
+	if dbResult := db.Delete("retention_reports", "timestamp", "<", now.AddDate(0, 0, -reportDays)); dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	if report.ExpiredTokens == 0 && report.TerminatedStations == 0 && report.CapturedRequests == 0 && report.OrphanedAttachments == 0 && report.Errors == "" {
+		return nil
+	}
+	if dbResult := db.Insert("retention_reports", report); dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	log.WithFields(log.Fields{
+		"expired_tokens":       report.ExpiredTokens,
+		"terminated_stations":  report.TerminatedStations,
+		"captured_requests":    report.CapturedRequests,
+		"orphaned_attachments": report.OrphanedAttachments,
+	}).Info("Cleaned up stale data")
+	if report.Errors != "" {
+		return fmt.Errorf("retention: %v", report.Errors)
+	}
+	return nil
+}
+
+// runRetention cleans up each kind of stale data, continuing with the rest if one fails.
+func runRetention(now time.Time, dryRun bool) *RetentionReport {
+	retentionLock.Lock()
+	defer retentionLock.Unlock()
+	retentionConfig := config.Config.Retention
+	id := uuid.New()
+	report := &RetentionReport{
+		ID:        &id,
+		Timestamp: &now,
+		DryRun:    dryRun,
+	}
+	var errors []string
+
+	if retentionConfig.ExpiredTokenDays >= 0 {
+		count, err := rest.PurgeExpiredAccessTokens(now.AddDate(0, 0, -retentionConfig.ExpiredTokenDays), dryRun)
+		report.ExpiredTokens = count
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("expired tokens: %v", err))
+		}
+	}
+	if retentionConfig.TerminatedStationDays > 0 {
+		report.StationAction = retentionConfig.TerminatedStationAction
+		if report.StationAction == "" {
+			report.StationAction = retentionStationActionDelete
+		}
+		count, err := cleanUpTerminatedStations(now.AddDate(0, 0, -retentionConfig.TerminatedStationDays), report.StationAction, dryRun)
+		report.TerminatedStations = count
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("terminated stations: %v", err))
+		}
+	}
+	if retentionConfig.CaptureHours >= 0 {
+		captureHours := retentionConfig.CaptureHours
+		if captureHours == 0 {
+			captureHours = defaultRetentionCaptureHours
+		}
+		report.CapturedRequests = rest.PruneCapturedExchanges(now.Add(-time.Duration(captureHours)*time.Hour), dryRun)
+	}
+	if retentionConfig.OrphanedAttachments {
+		count, err := attachment.DeleteOrphans(dryRun)
+		report.OrphanedAttachments = count
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("orphaned attachments: %v", err))
+		}
+	}
+	report.Errors = strings.Join(errors, "; ")
+	return report
+}
+
+// cleanUpTerminatedStations deletes or anonymizes the stations terminated before the time.
+// Stations terminated before the terminated time was recorded get it set now, so they're cleaned up later.
+func cleanUpTerminatedStations(terminatedBefore time.Time, action string, dryRun bool) (int, error) {
+	if !dryRun {
+		if _, err := db.DB.Exec("UPDATE stations SET terminated_time = NOW() WHERE status = $1 AND terminated_time IS NULL", StationStatusTerminated); err != nil {
+			return 0, err
+		}
+	}
+	var stations Stations
+	dbResult := db.SelectMany(&stations, "stations", "status", "=", StationStatusTerminated, "terminated_time", "<", terminatedBefore)
+	if dbResult.IsFailed() {
+		return 0, dbResult.Error
+	}
+
+	count := 0
+	for _, station := range stations {
+		if action == retentionStationActionAnonymize && !station.anonymize() {
+			continue
+		}
+		count++
+		if dryRun {
+			continue
+		}
+		if action == retentionStationActionAnonymize {
+			dbResult = db.Update("stations", station, "id", "=", station.ID)
+		} else {
+			dbResult = db.Delete("stations", "id", "=", station.ID)
+		}
+		if dbResult.IsFailed() {
+			return count - 1, dbResult.Error
+		}
+	}
+	return count, nil
+}
+
+// anonymize clears the credentials, notes and addresses of the station, returning false if already anonymized.
+func (station *Station) anonymize() bool {
+	changed := false
+	for _, field := range []*string{
+		&station.Credentials, &station.Notes, &station.Address, &station.ConsoleAddress, &station.BMCAddress, &station.BMCCredentials,
+		&station.ManagementIPv4, &station.ManagementIPv6, &station.DNSName, &station.DNSTarget, &station.InstanceMessage,
+	} {
+		if *field != "" {
+			*field = ""
+			changed = true
+		}
+	}
+	if changed {
+		station.MaintenanceNotice = retentionAnonymizedStationNotice
+	}
+	return changed
+}
+
+func validateRetentionConfig(candidate *config.MainConfig) error {
+	switch candidate.Retention.TerminatedStationAction {
+	case "", retentionStationActionDelete, retentionStationActionAnonymize:
+		return nil
+	}
+	return fmt.Errorf("retention: invalid terminated_station_action: %v", candidate.Retention.TerminatedStationAction)
+}
@@ -0,0 +1,242 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/gathering/tech-online-backend/event"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/gathering/tech-online-backend/rpc"
+)
+
+// Test statuses of submitted results (TestStatus in techo.proto)
+const (
+	rpcTestStatusPassed = 1
+	rpcTestStatusFailed = 2
+)
+
+func init() {
+	rpc.AddUnaryMethod("/techo.v1.Tests/SubmitResult", rpcSubmitTestResult)
+	rpc.AddStreamMethod("/techo.v1.Stations/StreamEvents", rpcStreamStationEvents)
+	rpc.AddUnaryMethod("/techo.v1.Tracks/GetTrack", rpcGetTrack)
+}
+
+// rpcRequest makes a REST request for the call, for using the REST handlers with the same permissions and filters.
+func rpcRequest(call *rpc.Call, method string, pathPrefix string) rest.Request {
+	return rest.Request{
+		ID:          call.ID,
+		Method:      method,
+		PathPrefix:  pathPrefix,
+		AccessToken: call.AccessToken,
+		PathArgs:    make(map[string]string),
+		QueryArgs:   make(map[string]string),
+	}
+}
+
+// rpcSubmitTestResult saves a test result, like posting a test.
+func rpcSubmitTestResult(call *rpc.Call, message []byte) (*rpc.Encoder, error) {
+	test, err := decodeRPCTestResult(message)
+	if err != nil {
+		return nil, err
+	}
+
+	request := rpcRequest(call, "POST", "/test/")
+	request.QueryArgs["track"] = test.TrackID
+	if result := rest.FilterRequest(&request); !result.IsOk() {
+		return nil, rpc.ResultError(result, call.AccessToken)
+	}
+	if result := test.Post(&request); !result.IsOk() {
+		return nil, rpc.ResultError(result, call.AccessToken)
+	}
+	var response rpc.Encoder
+	response.String(1, test.ID.String())
+	return &response, nil
+}
+
+// decodeRPCTestResult decodes a TestResult message.
+func decodeRPCTestResult(message []byte) (Test, error) {
+	var test Test
+	var status uint64
+	err := rpc.Decode(message, func(field rpc.Field) error {
+		switch field.Number {
+		case 1:
+			test.TrackID = field.String()
+		case 2:
+			test.TaskShortname = field.String()
+		case 3:
+			test.Shortname = field.String()
+		case 4:
+			test.StationShortname = field.String()
+		case 5:
+			test.Name = field.String()
+		case 6:
+			test.Description = field.String()
+		case 7:
+			sequence := int(field.Int())
+			test.Sequence = &sequence
+		case 8:
+			status = field.Uint()
+		case 9:
+			test.StatusDescription = field.String()
+		}
+		return nil
+	})
+	if err != nil {
+		return test, rpc.Errorf(rpc.CodeInvalidArgument, "%v", err)
+	}
+	switch status {
+	case rpcTestStatusPassed, rpcTestStatusFailed:
+		success := status == rpcTestStatusPassed
+		test.StatusSuccess = &success
+	default:
+		return test, rpc.Errorf(rpc.CodeInvalidArgument, "missing status")
+	}
+	return test, nil
+}
+
+// rpcStreamStationEvents streams station events (or other event types, with "*" suffix wildcards) until the client goes away.
+func rpcStreamStationEvents(call *rpc.Call, message []byte, send func(message *rpc.Encoder) error) error {
+	// Check perms
+	role := call.AccessToken.GetRole()
+	if role != rest.RoleOperator && role != rest.RoleAdmin && role != rest.RoleTester && role != rest.RoleRunner {
+		return rpc.ResultError(rest.UnauthorizedResult(call.AccessToken), call.AccessToken)
+	}
+
+	// Check params
+	var trackID string
+	var typePatterns []string
+	err := rpc.Decode(message, func(field rpc.Field) error {
+		switch field.Number {
+		case 1:
+			trackID = field.String()
+		case 2:
+			typePatterns = append(typePatterns, field.String())
+		}
+		return nil
+	})
+	if err != nil {
+		return rpc.Errorf(rpc.CodeInvalidArgument, "%v", err)
+	}
+	if len(typePatterns) == 0 {
+		typePatterns = []string{"station.*"}
+	}
+
+	events, stop := event.Listen(eventStreamBufferSize)
+	defer stop()
+	for {
+		select {
+		case <-call.Context().Done():
+			return nil
+		case ev, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if trackID != "" && ev.TrackID != trackID || !eventMatchesTypes(ev, typePatterns) {
+				continue
+			}
+			if err := send(rpcEvent(ev)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func rpcEvent(ev event.Event) *rpc.Encoder {
+	var message rpc.Encoder
+	message.String(1, ev.ID.String())
+	message.String(2, string(ev.Type))
+	message.String(3, ev.Time.Format(time.RFC3339Nano))
+	message.String(4, ev.TrackID)
+	message.String(5, ev.Title)
+	message.String(6, ev.Message)
+	if ev.Data != nil {
+		if data, err := json.Marshal(ev.Data); err == nil {
+			message.String(7, string(data))
+		}
+	}
+	return &message
+}
+
+// rpcGetTrack gets a track with its tasks, locked or hidden for the station (optional) like when listing tasks.
+func rpcGetTrack(call *rpc.Call, message []byte) (*rpc.Encoder, error) {
+	var trackID, stationShortname string
+	err := rpc.Decode(message, func(field rpc.Field) error {
+		switch field.Number {
+		case 1:
+			trackID = field.String()
+		case 2:
+			stationShortname = field.String()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, rpc.Errorf(rpc.CodeInvalidArgument, "%v", err)
+	}
+
+	// Get
+	var track Track
+	trackRequest := rpcRequest(call, "GET", "/track/")
+	trackRequest.PathArgs["id"] = trackID
+	if result := track.Get(&trackRequest); !result.IsOk() {
+		return nil, rpc.ResultError(result, call.AccessToken)
+	}
+	var tasks Tasks
+	tasksRequest := rpcRequest(call, "GET", "/tasks/")
+	tasksRequest.QueryArgs["track"] = trackID
+	if stationShortname != "" {
+		tasksRequest.QueryArgs["station-shortname"] = stationShortname
+	}
+	if result := tasks.Get(&tasksRequest); !result.IsOk() {
+		return nil, rpc.ResultError(result, call.AccessToken)
+	}
+	sort.SliceStable(tasks, func(i, j int) bool {
+		return tasks[i].Sequence != nil && (tasks[j].Sequence == nil || *tasks[i].Sequence < *tasks[j].Sequence)
+	})
+
+	return rpcTrack(track, tasks), nil
+}
+
+// rpcTrack encodes a Track message with the tasks.
+func rpcTrack(track Track, tasks Tasks) *rpc.Encoder {
+	var message rpc.Encoder
+	message.String(1, track.ID)
+	message.String(2, string(track.Type))
+	message.String(3, track.Name)
+	for _, task := range tasks {
+		var taskMessage rpc.Encoder
+		taskMessage.String(1, task.Shortname)
+		taskMessage.String(2, task.Name)
+		taskMessage.String(3, task.Description)
+		if task.Sequence != nil {
+			taskMessage.Int(4, int64(*task.Sequence))
+		}
+		taskMessage.Int(5, int64(task.Points))
+		for _, dependsOn := range task.DependsOn {
+			taskMessage.RepeatedString(6, dependsOn)
+		}
+		taskMessage.Bool(7, task.Locked)
+		message.Message(4, &taskMessage)
+	}
+	return &message
+}
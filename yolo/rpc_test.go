@@ -0,0 +1,200 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gathering/tech-online-backend/event"
+	"github.com/gathering/tech-online-backend/helper"
+	"github.com/gathering/tech-online-backend/rpc"
+	"github.com/google/uuid"
+)
+
+// protoField is a field declared in techo.proto.
+type protoField struct {
+	Name     string
+	Type     string
+	Number   int
+	Repeated bool
+}
+
+var (
+	protoCommentRegexp = regexp.MustCompile(`//.*`)
+	protoBlockRegexp   = regexp.MustCompile(`(message|enum)\s+(\w+)\s*\{([^}]*)\}`)
+	protoFieldRegexp   = regexp.MustCompile(`(repeated\s+)?(\w+)\s+(\w+)\s*=\s*(\d+)\s*;`)
+)
+
+// loadProtoMessages parses the messages of techo.proto, with enum fields given the "enum" type.
+func loadProtoMessages(t *testing.T) map[string][]protoField {
+	data, err := ioutil.ReadFile("../rpc/techo.proto")
+	helper.CheckEqual(t, err, nil)
+	source := protoCommentRegexp.ReplaceAllString(string(data), "")
+	enums := make(map[string]bool)
+	for _, block := range protoBlockRegexp.FindAllStringSubmatch(source, -1) {
+		if block[1] == "enum" {
+			enums[block[2]] = true
+		}
+	}
+	messages := make(map[string][]protoField)
+	for _, block := range protoBlockRegexp.FindAllStringSubmatch(source, -1) {
+		if block[1] != "message" {
+			continue
+		}
+		var fields []protoField
+		for _, match := range protoFieldRegexp.FindAllStringSubmatch(block[3], -1) {
+			number, _ := strconv.Atoi(match[4])
+			field := protoField{Name: match[3], Type: match[2], Number: number, Repeated: match[1] != ""}
+			if enums[field.Type] {
+				field.Type = "enum"
+			}
+			fields = append(fields, field)
+		}
+		sort.Slice(fields, func(i, j int) bool { return fields[i].Number < fields[j].Number })
+		messages[block[2]] = fields
+	}
+	return messages
+}
+
+// encodeProto encodes the values (by field name) as the message declared in techo.proto, in field number order.
+// Repeated fields take slices and message fields take values by field name themselves.
+func encodeProto(t *testing.T, messages map[string][]protoField, messageName string, values map[string]interface{}) *rpc.Encoder {
+	fields, ok := messages[messageName]
+	if !ok {
+		t.Fatalf("message %v not in techo.proto", messageName)
+	}
+	var message rpc.Encoder
+	known := make(map[string]bool)
+	for _, field := range fields {
+		known[field.Name] = true
+		value, ok := values[field.Name]
+		if !ok {
+			continue
+		}
+		elements := []interface{}{value}
+		if field.Repeated {
+			elements = value.([]interface{})
+		}
+		for _, element := range elements {
+			switch field.Type {
+			case "string":
+				if field.Repeated {
+					message.RepeatedString(field.Number, element.(string))
+				} else {
+					message.String(field.Number, element.(string))
+				}
+			case "int32", "int64":
+				message.Int(field.Number, int64(element.(int)))
+			case "bool":
+				message.Bool(field.Number, element.(bool))
+			case "enum":
+				message.Uint(field.Number, uint64(element.(int)))
+			default:
+				message.Message(field.Number, encodeProto(t, messages, field.Type, element.(map[string]interface{})))
+			}
+		}
+	}
+	for name := range values {
+		if !known[name] {
+			t.Errorf("field %v not in message %v in techo.proto", name, messageName)
+		}
+	}
+	return &message
+}
+
+func TestRPCTestResultMatchesProto(t *testing.T) {
+	messages := loadProtoMessages(t)
+	message := encodeProto(t, messages, "TestResult", map[string]interface{}{
+		"track":              "net",
+		"task_shortname":     "task-1",
+		"shortname":          "test-1",
+		"station_shortname":  "station-1",
+		"name":               "Ping",
+		"description":        "Pings the gateway",
+		"sequence":           3,
+		"status":             rpcTestStatusFailed,
+		"status_description": "No reply",
+	})
+	test, err := decodeRPCTestResult(message.Bytes())
+	helper.CheckEqual(t, err, nil)
+	helper.CheckEqual(t, test.TrackID, "net")
+	helper.CheckEqual(t, test.TaskShortname, "task-1")
+	helper.CheckEqual(t, test.Shortname, "test-1")
+	helper.CheckEqual(t, test.StationShortname, "station-1")
+	helper.CheckEqual(t, test.Name, "Ping")
+	helper.CheckEqual(t, test.Description, "Pings the gateway")
+	helper.CheckEqual(t, *test.Sequence, 3)
+	helper.CheckEqual(t, *test.StatusSuccess, false)
+	helper.CheckEqual(t, test.StatusDescription, "No reply")
+
+	// The status is required
+	message = encodeProto(t, messages, "TestResult", map[string]interface{}{"track": "net"})
+	_, err = decodeRPCTestResult(message.Bytes())
+	helper.CheckNotEqual(t, err, nil)
+}
+
+func TestRPCEventMatchesProto(t *testing.T) {
+	messages := loadProtoMessages(t)
+	ev := event.Event{
+		ID:      uuid.New(),
+		Type:    "station.status_changed",
+		Time:    time.Date(2022, 4, 1, 12, 0, 0, 0, time.UTC),
+		TrackID: "net",
+		Title:   "Station changed",
+		Message: "Station 1 is ready",
+		Data:    map[string]string{"status": "ready"},
+	}
+	expected := encodeProto(t, messages, "Event", map[string]interface{}{
+		"id":        ev.ID.String(),
+		"type":      "station.status_changed",
+		"time":      "2022-04-01T12:00:00Z",
+		"track":     "net",
+		"title":     "Station changed",
+		"message":   "Station 1 is ready",
+		"data_json": `{"status":"ready"}`,
+	})
+	helper.CheckEqual(t, string(rpcEvent(ev).Bytes()), string(expected.Bytes()))
+}
+
+func TestRPCTrackMatchesProto(t *testing.T) {
+	messages := loadProtoMessages(t)
+	sequence := 2
+	track := Track{ID: "net", Type: "net", Name: "Networking"}
+	tasks := Tasks{
+		{Shortname: "task-1", Name: "Cabling", Description: "Connect it", Points: 10},
+		{Shortname: "task-2", Name: "Routing", Sequence: &sequence, DependsOn: []string{"task-1", ""}, Locked: true},
+	}
+	expected := encodeProto(t, messages, "Track", map[string]interface{}{
+		"id":   "net",
+		"type": "net",
+		"name": "Networking",
+		"tasks": []interface{}{
+			map[string]interface{}{"shortname": "task-1", "name": "Cabling", "description": "Connect it", "points": 10},
+			map[string]interface{}{"shortname": "task-2", "name": "Routing", "sequence": 2, "depends_on": []interface{}{"task-1", ""}, "locked": true},
+		},
+	})
+	helper.CheckEqual(t, string(rpcTrack(track, tasks).Bytes()), string(expected.Bytes()))
+}
@@ -0,0 +1,332 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	_ "time/tzdata" // Embedded, the runtime image has no zoneinfo
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// Schedule entry kinds.
+const (
+	ScheduleKindOpen     = "open"     // Opening hours of the track (or all tracks)
+	ScheduleKindBriefing = "briefing" // Briefing of the participants
+	ScheduleKindOther    = "other"
+)
+
+// ScheduleEntry is a time window of the event schedule, stored in UTC.
+type ScheduleEntry struct {
+	ID        *uuid.UUID `column:"id" json:"id"`                 // Generated
+	TrackID   string     `column:"track" json:"track"`           // Optional, for all tracks if empty
+	Kind      string     `column:"kind" json:"kind"`             // Required
+	Title     string     `column:"title" json:"title"`           // Optional, shown instead of the kind
+	BeginTime *time.Time `column:"begin_time" json:"begin_time"` // Required
+	EndTime   *time.Time `column:"end_time" json:"end_time"`     // Required
+}
+
+// ScheduleEntries is a list of schedule entries.
+type ScheduleEntries []*ScheduleEntry
+
+// Schedule is the event schedule with the timezone to display it in, for the frontend.
+type Schedule struct {
+	Timezone   string          `json:"timezone"`    // IANA name, e.g. "Europe/Oslo"
+	UTCOffset  string          `json:"utc_offset"`  // Current offset of the timezone, e.g. "+02:00"
+	Entries    ScheduleEntries `json:"entries"`     // Oldest first
+	OpenTracks []string        `json:"open_tracks"` // Tracks which are open now
+}
+
+var displayLocationCache struct {
+	sync.Mutex
+	name     string
+	location *time.Location
+}
+
+func init() {
+	rest.AddHandler("/schedule/", "^$", func() interface{} { return &Schedule{} })
+	rest.AddHandler("/schedule-entry/", "^(?:(?P<id>[^/]+)/)?$", func() interface{} { return &ScheduleEntry{} })
+	config.AddValidator(validateScheduleConfig)
+}
+
+// Get gets the schedule, optionally only for the "track" query arg (including entries for all tracks).
+func (schedule *Schedule) Get(request *rest.Request) rest.Result {
+	// Get
+	trackID, hasTrackID := request.QueryArgs["track"]
+	entries, err := loadScheduleEntries()
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	tracks := make(Tracks, 0)
+	trackDBResult := db.SelectMany(&tracks, "tracks")
+	if trackDBResult.IsFailed() {
+		return rest.Result{Code: 500, Error: trackDBResult.Error}
+	}
+
+	now := time.Now()
+	location := displayLocation()
+	schedule.Timezone = location.String()
+	schedule.UTCOffset = now.In(location).Format("-07:00")
+	schedule.Entries = make(ScheduleEntries, 0)
+	for _, entry := range entries {
+		if hasTrackID && entry.TrackID != "" && entry.TrackID != trackID {
+			continue
+		}
+		schedule.Entries = append(schedule.Entries, entry)
+	}
+	schedule.OpenTracks = make([]string, 0)
+	for _, track := range tracks {
+		if hasTrackID && track.ID != trackID {
+			continue
+		}
+		if entries.isTrackOpen(track.ID, now) {
+			schedule.OpenTracks = append(schedule.OpenTracks, track.ID)
+		}
+	}
+	sort.Strings(schedule.OpenTracks)
+	return rest.Result{}
+}
+
+// Get gets a single schedule entry.
+func (entry *ScheduleEntry) Get(request *rest.Request) rest.Result {
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+
+	// Get
+	dbResult := db.Select(entry, "schedule_entries", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+	entry.toUTC()
+	return rest.Result{}
+}
+
+// Post creates a schedule entry.
+func (entry *ScheduleEntry) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Prepare and validate
+	newID := uuid.New()
+	entry.ID = &newID
+	if result := entry.validate(); !result.IsOk() {
+		return result
+	}
+
+	// Create
+	dbResult := db.Insert("schedule_entries", entry)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	request.Log().WithFields(log.Fields{
+		"schedule_entry": entry.ID,
+		"actor":          request.AccessToken.GetName(),
+	}).Info("Schedule entry created")
+	return rest.Result{Code: 201, Location: fmt.Sprintf("%v/schedule-entry/%v/", config.Config.SitePrefix, entry.ID)}
+}
+
+// Put updates a schedule entry.
+func (entry *ScheduleEntry) Put(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+	if entry.ID != nil && (*entry.ID).String() != id {
+		return rest.Result{Code: 400, Message: "mismatch between URL and JSON IDs"}
+	}
+	var oldEntry ScheduleEntry
+	oldDBResult := db.Select(&oldEntry, "schedule_entries", "id", "=", id)
+	if oldDBResult.IsFailed() {
+		return rest.Result{Code: 500, Error: oldDBResult.Error}
+	}
+	if !oldDBResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+
+	// Validate
+	entry.ID = oldEntry.ID
+	if result := entry.validate(); !result.IsOk() {
+		return result
+	}
+
+	// Update
+	dbResult := db.Update("schedule_entries", entry, "id", "=", entry.ID)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	return rest.Result{}
+}
+
+// Delete deletes a schedule entry.
+func (entry *ScheduleEntry) Delete(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+
+	// Delete
+	dbResult := db.Delete("schedule_entries", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if dbResult.Affected == 0 {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+	request.Log().WithFields(log.Fields{
+		"schedule_entry": id,
+		"actor":          request.AccessToken.GetName(),
+	}).Info("Schedule entry deleted")
+	return rest.Result{}
+}
+
+func (entry *ScheduleEntry) validate() rest.Result {
+	entry.Title = strings.TrimSpace(entry.Title)
+	switch entry.Kind {
+	case ScheduleKindOpen, ScheduleKindBriefing, ScheduleKindOther:
+	default:
+		return rest.Result{Code: 400, Message: "invalid kind"}
+	}
+	if entry.BeginTime == nil || entry.EndTime == nil {
+		return rest.Result{Code: 400, Message: "missing begin or end time"}
+	}
+	if !entry.EndTime.After(*entry.BeginTime) {
+		return rest.Result{Code: 400, Message: "end time must be after begin time"}
+	}
+	if entry.TrackID != "" {
+		var track Track
+		trackDBResult := db.Select(&track, "tracks", "id", "=", entry.TrackID)
+		if trackDBResult.IsFailed() {
+			return rest.Result{Code: 500, Error: trackDBResult.Error}
+		}
+		if !trackDBResult.IsSuccess() {
+			return rest.Result{Code: 400, Message: "referenced track does not exist"}
+		}
+	}
+	entry.toUTC()
+	return rest.Result{}
+}
+
+// toUTC normalizes the times, which may have been given with any offset.
+func (entry *ScheduleEntry) toUTC() {
+	if entry.BeginTime != nil {
+		beginTime := entry.BeginTime.UTC()
+		entry.BeginTime = &beginTime
+	}
+	if entry.EndTime != nil {
+		endTime := entry.EndTime.UTC()
+		entry.EndTime = &endTime
+	}
+}
+
+// loadScheduleEntries gets all schedule entries, oldest first.
+func loadScheduleEntries() (ScheduleEntries, error) {
+	entries := make(ScheduleEntries, 0)
+	dbResult := db.SelectMany(&entries, "schedule_entries")
+	if dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	for _, entry := range entries {
+		entry.toUTC()
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].BeginTime.Before(*entries[j].BeginTime)
+	})
+	return entries, nil
+}
+
+// isTrackOpen checks if the time is within the opening hours of the track (or all tracks).
+// Tracks without any opening hours are always open.
+func (entries ScheduleEntries) isTrackOpen(trackID string, now time.Time) bool {
+	hasOpeningHours := false
+	for _, entry := range entries {
+		if entry.Kind != ScheduleKindOpen || (entry.TrackID != "" && entry.TrackID != trackID) {
+			continue
+		}
+		hasOpeningHours = true
+		if !now.Before(*entry.BeginTime) && now.Before(*entry.EndTime) {
+			return true
+		}
+	}
+	return !hasOpeningHours
+}
+
+// displayLocation gets the configured display timezone, the local timezone if not configured or invalid.
+func displayLocation() *time.Location {
+	name := config.Config.Schedule.Timezone
+	if name == "" {
+		return time.Local
+	}
+	displayLocationCache.Lock()
+	defer displayLocationCache.Unlock()
+	if displayLocationCache.name != name || displayLocationCache.location == nil {
+		location, err := time.LoadLocation(name)
+		if err != nil {
+			log.WithError(err).WithField("timezone", name).Warn("Invalid schedule timezone, using the local timezone")
+			location = time.Local
+		}
+		displayLocationCache.name = name
+		displayLocationCache.location = location
+	}
+	return displayLocationCache.location
+}
+
+// displayTime converts the time to the display timezone, for notifications.
+func displayTime(t time.Time) time.Time {
+	return t.In(displayLocation())
+}
+
+func validateScheduleConfig(candidate *config.MainConfig) error {
+	if candidate.Schedule.Timezone == "" {
+		return nil
+	}
+	if _, err := time.LoadLocation(candidate.Schedule.Timezone); err != nil {
+		return fmt.Errorf("schedule: invalid timezone: %v", candidate.Schedule.Timezone)
+	}
+	return nil
+}
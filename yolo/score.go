@@ -0,0 +1,258 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package yolo
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/event"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/gathering/tech-online-backend/scheduler"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// TimeslotScore is the score of a timeslot: the points of the completed tasks minus the penalties of the unlocked hints.
+// A task is completed when it has tests for the timeslot and they all pass.
+// Scores are saved when tests are saved or hints are unlocked, and may be recomputed using the "recompute-scores" action.
+type TimeslotScore struct {
+	TimeslotID     *uuid.UUID   `column:"timeslot" json:"timeslot"`
+	TrackID        string       `column:"track" json:"track"`
+	Points         int          `column:"points" json:"points"`   // From completed tasks
+	Penalty        int          `column:"penalty" json:"penalty"` // From unlocked hints
+	Score          int          `column:"score" json:"score"`     // Points minus penalty
+	CompletedTasks int          `column:"completed_tasks" json:"completed_tasks"`
+	HintsUnlocked  int          `column:"hints_unlocked" json:"hints_unlocked"`
+	Timestamp      *time.Time   `column:"timestamp" json:"timestamp"` // When it was computed
+	Tasks          []*TaskScore `column:"-" json:"tasks,omitempty"`   // Breakdown, only for single timeslots
+}
+
+// TimeslotScores is a list of timeslot scores.
+type TimeslotScores []*TimeslotScore
+
+// TaskScore is the score for a single task within a timeslot.
+type TaskScore struct {
+	TaskShortname string `json:"task_shortname"`
+	Name          string `json:"name"`
+	Completed     bool   `json:"completed"`
+	Points        int    `json:"points"` // Task points if completed
+	Penalty       int    `json:"penalty"`
+	HintsUnlocked int    `json:"hints_unlocked"`
+	Score         int    `json:"score"`
+}
+
+// TimeslotScoreRequest is a request for the current score of a timeslot, with the task breakdown.
+type TimeslotScoreRequest struct {
+	TimeslotScore
+}
+
+func init() {
+	rest.AddHandler("/scores/", "^$", func() interface{} { return &TimeslotScores{} })
+	rest.AddHandler("/timeslot/", "^(?P<id>[^/]+)/score/$", func() interface{} { return &TimeslotScoreRequest{} })
+	scheduler.AddAction("recompute-scores", recomputeAllScores)
+}
+
+// Get gets the saved scores, highest first. Use the "track" query arg to limit to one track.
+// Frozen scoreboards show the frozen scores, except for operators/admins.
+func (scores *TimeslotScores) Get(request *rest.Request) rest.Result {
+	// Check params, prep filtering
+	var whereArgs []interface{}
+	trackID, trackIDExists := request.QueryArgs["track"]
+	if trackIDExists {
+		whereArgs = append(whereArgs, "track", "=", trackID)
+	}
+
+	// Get
+	dbResult := db.SelectMany(scores, "timeslot_scores", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !canSeeLiveScores(request.AccessToken) {
+		if err := scores.applyFrozenScores(trackID); err != nil {
+			return rest.Result{Code: 500, Error: err}
+		}
+	}
+	sortScores(*scores)
+	if request.ListLimit > 0 && len(*scores) > request.ListLimit {
+		*scores = (*scores)[:request.ListLimit]
+	}
+	return rest.Result{}
+}
+
+// Get computes the current score of the timeslot with the task breakdown.
+func (scoreRequest *TimeslotScoreRequest) Get(request *rest.Request) rest.Result {
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+	var timeslot Timeslot
+	dbResult := db.Select(&timeslot, "timeslots", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+
+	// Check perms
+	if result := timeslot.checkParticipantPerms(request.AccessToken); !result.IsOk() {
+		return result
+	}
+
+	// Compute
+	score, err := timeslot.computeScore()
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	scoreRequest.TimeslotScore = *score
+	return rest.Result{}
+}
+
+// computeScore computes the score of the timeslot from its tests and unlocked hints.
+func (timeslot *Timeslot) computeScore() (*TimeslotScore, error) {
+	var tasks Tasks
+	if dbResult := db.SelectMany(&tasks, "tasks", "track", "=", timeslot.TrackID); dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	var tests Tests
+	if dbResult := db.SelectMany(&tests, "tests", "track", "=", timeslot.TrackID, "timeslot", "=", timeslot.ID.String()); dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	var hints Hints
+	if dbResult := db.SelectMany(&hints, "hints", "track", "=", timeslot.TrackID); dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	unlockedIDs, err := unlockedHintIDs(timeslot.ID.String())
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	score := TimeslotScore{
+		TimeslotID: timeslot.ID,
+		TrackID:    timeslot.TrackID,
+		Timestamp:  &now,
+		Tasks:      make([]*TaskScore, 0),
+	}
+	tasks.sortBySequence()
+	for _, task := range tasks {
+		taskScore := TaskScore{
+			TaskShortname: task.Shortname,
+			Name:          task.Name,
+		}
+
+		testCount, passedCount := 0, 0
+		for _, test := range tests {
+			if test.TaskShortname != task.Shortname {
+				continue
+			}
+			testCount++
+			if test.StatusSuccess != nil && *test.StatusSuccess {
+				passedCount++
+			}
+		}
+		taskScore.Completed = testCount > 0 && passedCount == testCount
+		if taskScore.Completed {
+			taskScore.Points = task.Points
+		}
+
+		for _, hint := range hints {
+			if hint.TaskShortname == task.Shortname && unlockedIDs[*hint.ID] {
+				taskScore.HintsUnlocked++
+				taskScore.Penalty += hint.Penalty
+			}
+		}
+		taskScore.Score = taskScore.Points - taskScore.Penalty
+
+		score.Tasks = append(score.Tasks, &taskScore)
+		score.Points += taskScore.Points
+		score.Penalty += taskScore.Penalty
+		score.HintsUnlocked += taskScore.HintsUnlocked
+		if taskScore.Completed {
+			score.CompletedTasks++
+		}
+	}
+	score.Score = score.Points - score.Penalty
+	return &score, nil
+}
+
+// saveTimeslotScore computes and saves the score of the timeslot.
+func saveTimeslotScore(timeslotID string) error {
+	var timeslot Timeslot
+	dbResult := db.Select(&timeslot, "timeslots", "id", "=", timeslotID)
+	if dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	if !dbResult.IsSuccess() {
+		return nil
+	}
+	return timeslot.saveScore()
+}
+
+func (timeslot *Timeslot) saveScore() error {
+	score, err := timeslot.computeScore()
+	if err != nil {
+		return err
+	}
+	var previous TimeslotScore
+	previousDBResult := db.Select(&previous, "timeslot_scores", "timeslot", "=", timeslot.ID)
+	if previousDBResult.IsFailed() {
+		return previousDBResult.Error
+	}
+	if dbResult := db.Delete("timeslot_scores", "timeslot", "=", timeslot.ID); dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	if dbResult := db.Insert("timeslot_scores", score); dbResult.IsFailed() {
+		return dbResult.Error
+	}
+
+	// Notify the scoreboard if anything changed
+	if previousDBResult.IsSuccess() && previous.Score == score.Score && previous.Points == score.Points && previous.Penalty == score.Penalty {
+		return nil
+	}
+	delta := ScoreDelta{Score: score, PreviousScore: previous.Score, Delta: score.Score - previous.Score}
+	event.Publish(event.Event{
+		Type:    EventTypeScoreUpdated,
+		TrackID: timeslot.TrackID,
+		Title:   "Score updated",
+		Message: fmt.Sprintf("The score changed from %v to %v.", previous.Score, score.Score),
+		Data:    delta,
+	})
+	return nil
+}
+
+// recomputeAllScores recomputes the scores of all timeslots, e.g. after changing task points or hint penalties.
+func recomputeAllScores() error {
+	var timeslots Timeslots
+	dbResult := db.SelectMany(&timeslots, "timeslots")
+	if dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	for _, timeslot := range timeslots {
+		if err := timeslot.saveScore(); err != nil {
+			return err
+		}
+	}
+	log.WithField("timeslots", len(timeslots)).Info("Recomputed scores")
+	return nil
+}
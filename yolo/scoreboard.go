@@ -0,0 +1,380 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/event"
+	"github.com/gathering/tech-online-backend/rest"
+	"golang.org/x/net/websocket"
+)
+
+// Event types for the scoreboard, which are streamed to scoreboard clients.
+const (
+	EventTypeScoreUpdated     event.Type = "score.updated"     // Data is a ScoreDelta
+	EventTypeScoreboardFrozen event.Type = "scoreboard.frozen" // Data is the scoreboard
+	EventTypeScoreboardThawed event.Type = "scoreboard.thawed" // Data is the scoreboard
+)
+
+// Scoreboard message types.
+const (
+	ScoreboardMessageSnapshot = "snapshot"
+	ScoreboardMessageDelta    = "delta"
+	ScoreboardMessageFrozen   = "frozen"
+	ScoreboardMessageThawed   = "thawed"
+)
+
+const scoreboardStreamBufferSize = 100
+
+// Scoreboard is the ranked scores of a track.
+// When frozen, everyone except operators/admins get the scores as they were when it was frozen, e.g. during the last hour of a competition.
+type Scoreboard struct {
+	TrackID  string         `column:"track" json:"track"`
+	Frozen   bool           `column:"frozen" json:"frozen"`
+	FrozenAt *time.Time     `column:"frozen_at" json:"frozen_at"`
+	Scores   TimeslotScores `column:"-" json:"scores"` // Highest first
+}
+
+// ScoreDelta is a change of a timeslot score.
+type ScoreDelta struct {
+	Score         *TimeslotScore `json:"score"`
+	PreviousScore int            `json:"previous_score"`
+	Delta         int            `json:"delta"`
+}
+
+// ScoreboardMessage is sent to scoreboard stream clients.
+type ScoreboardMessage struct {
+	Type       string      `json:"type"`
+	Scoreboard *Scoreboard `json:"scoreboard,omitempty"` // For snapshots, freezing and thawing
+	Delta      *ScoreDelta `json:"delta,omitempty"`      // For deltas
+}
+
+// ScoreboardStreamRequest is a request to stream the scoreboard of a track over a WebSocket.
+type ScoreboardStreamRequest struct{}
+
+// ScoreboardFreezeRequest freezes the scoreboard of a track.
+type ScoreboardFreezeRequest struct {
+	Scoreboard
+}
+
+// ScoreboardThawRequest thaws the scoreboard of a track.
+type ScoreboardThawRequest struct {
+	Scoreboard
+}
+
+func init() {
+	rest.AddHandler("/scoreboard/", "^(?P<track_id>[^/]+)/$", func() interface{} { return &Scoreboard{} })
+	rest.SetCachePolicy(&Scoreboard{}, rest.CachePolicy{NoStore: true})
+	rest.AddHandler("/scoreboard/", "^(?P<track_id>[^/]+)/stream/$", func() interface{} { return &ScoreboardStreamRequest{} })
+	rest.AddHandler("/scoreboard/", "^(?P<track_id>[^/]+)/freeze/$", func() interface{} { return &ScoreboardFreezeRequest{} })
+	rest.AddHandler("/scoreboard/", "^(?P<track_id>[^/]+)/thaw/$", func() interface{} { return &ScoreboardThawRequest{} })
+}
+
+// Get gets the scoreboard of a track, frozen unless operator/admin.
+func (scoreboard *Scoreboard) Get(request *rest.Request) rest.Result {
+	trackID := request.PathArgs["track_id"]
+	track := Track{ID: trackID}
+	if exists, err := track.exists(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	} else if !exists {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+
+	loaded, err := loadScoreboard(trackID, canSeeLiveScores(request.AccessToken))
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	*scoreboard = *loaded
+	if request.ListLimit > 0 && len(scoreboard.Scores) > request.ListLimit {
+		scoreboard.Scores = scoreboard.Scores[:request.ListLimit]
+	}
+	return rest.Result{}
+}
+
+// Stream sends a snapshot of the scoreboard followed by deltas as JSON text messages, until the client disconnects.
+// While frozen, deltas are only sent to operators/admins and a new snapshot is sent to everyone when thawed.
+func (streamRequest *ScoreboardStreamRequest) Stream(request *rest.Request) (http.Handler, rest.Result) {
+	// Check params
+	trackID := request.PathArgs["track_id"]
+	track := Track{ID: trackID}
+	if exists, err := track.exists(); err != nil {
+		return nil, rest.Result{Code: 500, Error: err}
+	} else if !exists {
+		return nil, rest.Result{Code: 404, Message: "not found"}
+	}
+	live := canSeeLiveScores(request.AccessToken)
+
+	server := websocket.Server{
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(conn *websocket.Conn) {
+			// Listen before loading the snapshot to avoid missing changes in between
+			events, stop := event.Listen(scoreboardStreamBufferSize)
+			defer stop()
+
+			go func() {
+				io.Copy(ioutil.Discard, conn)
+				stop()
+			}()
+
+			scoreboard, err := loadScoreboard(trackID, live)
+			if err != nil {
+				return
+			}
+			frozen := scoreboard.Frozen
+			if err := websocket.JSON.Send(conn, ScoreboardMessage{Type: ScoreboardMessageSnapshot, Scoreboard: scoreboard}); err != nil {
+				return
+			}
+
+			for ev := range events {
+				if ev.TrackID != trackID {
+					continue
+				}
+				var message ScoreboardMessage
+				switch ev.Type {
+				case EventTypeScoreUpdated:
+					delta, ok := ev.Data.(ScoreDelta)
+					if !ok || (frozen && !live) {
+						continue
+					}
+					message = ScoreboardMessage{Type: ScoreboardMessageDelta, Delta: &delta}
+				case EventTypeScoreboardFrozen:
+					frozen = true
+					message = ScoreboardMessage{Type: ScoreboardMessageFrozen}
+					if live {
+						// Keep the live scores
+						message.Scoreboard, err = loadScoreboard(trackID, live)
+						if err != nil {
+							return
+						}
+					} else {
+						message.Scoreboard, _ = ev.Data.(*Scoreboard)
+					}
+				case EventTypeScoreboardThawed:
+					frozen = false
+					message = ScoreboardMessage{Type: ScoreboardMessageThawed}
+					message.Scoreboard, _ = ev.Data.(*Scoreboard)
+				default:
+					continue
+				}
+				if err := websocket.JSON.Send(conn, message); err != nil {
+					return
+				}
+			}
+		},
+	}
+	return server, rest.Result{}
+}
+
+// Post freezes the scoreboard, saving a snapshot of the current scores.
+func (freezeRequest *ScoreboardFreezeRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	trackID := request.PathArgs["track_id"]
+	track := Track{ID: trackID}
+	if exists, err := track.exists(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	} else if !exists {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+	current, err := loadScoreboardState(trackID)
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	if current.Frozen {
+		return rest.Result{Code: 409, Message: "already frozen"}
+	}
+
+	// Snapshot and freeze
+	var scores TimeslotScores
+	if dbResult := db.SelectMany(&scores, "timeslot_scores", "track", "=", trackID); dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if dbResult := db.Delete("frozen_scores", "track", "=", trackID); dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	for _, score := range scores {
+		if dbResult := db.Insert("frozen_scores", score); dbResult.IsFailed() {
+			return rest.Result{Code: 500, Error: dbResult.Error}
+		}
+	}
+	now := time.Now()
+	state := Scoreboard{TrackID: trackID, Frozen: true, FrozenAt: &now}
+	if err := state.saveState(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+
+	scoreboard, err := loadScoreboard(trackID, false)
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	event.Publish(event.Event{
+		Type:    EventTypeScoreboardFrozen,
+		TrackID: trackID,
+		Title:   "Scoreboard frozen",
+		Message: fmt.Sprintf("The scoreboard for track %v was frozen.", trackID),
+		Data:    scoreboard,
+	})
+	freezeRequest.Scoreboard = *scoreboard
+	return rest.Result{}
+}
+
+// Post thaws the scoreboard, revealing the live scores.
+func (thawRequest *ScoreboardThawRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	trackID := request.PathArgs["track_id"]
+	current, err := loadScoreboardState(trackID)
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	if !current.Frozen {
+		return rest.Result{Code: 409, Message: "not frozen"}
+	}
+
+	// Thaw
+	state := Scoreboard{TrackID: trackID}
+	if err := state.saveState(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	if dbResult := db.Delete("frozen_scores", "track", "=", trackID); dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+
+	scoreboard, err := loadScoreboard(trackID, false)
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	event.Publish(event.Event{
+		Type:    EventTypeScoreboardThawed,
+		TrackID: trackID,
+		Title:   "Scoreboard thawed",
+		Message: fmt.Sprintf("The scoreboard for track %v was thawed.", trackID),
+		Data:    scoreboard,
+	})
+	thawRequest.Scoreboard = *scoreboard
+	return rest.Result{}
+}
+
+// applyFrozenScores replaces the scores of tracks with frozen scoreboards with the frozen snapshots.
+func (scores *TimeslotScores) applyFrozenScores(trackID string) error {
+	var states []*Scoreboard
+	whereArgs := []interface{}{"frozen", "=", true}
+	if trackID != "" {
+		whereArgs = append(whereArgs, "track", "=", trackID)
+	}
+	if dbResult := db.SelectMany(&states, "scoreboards", whereArgs...); dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	if len(states) == 0 {
+		return nil
+	}
+
+	frozenTracks := make(map[string]bool)
+	for _, state := range states {
+		frozenTracks[state.TrackID] = true
+	}
+	visibleScores := make(TimeslotScores, 0, len(*scores))
+	for _, score := range *scores {
+		if !frozenTracks[score.TrackID] {
+			visibleScores = append(visibleScores, score)
+		}
+	}
+	frozenTrackIDs := make([]string, 0, len(frozenTracks))
+	for frozenTrackID := range frozenTracks {
+		frozenTrackIDs = append(frozenTrackIDs, frozenTrackID)
+	}
+	var frozenScores TimeslotScores
+	if dbResult := db.SelectMany(&frozenScores, "frozen_scores", "track", "IN", frozenTrackIDs); dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	visibleScores = append(visibleScores, frozenScores...)
+	*scores = visibleScores
+	return nil
+}
+
+// canSeeLiveScores checks if the token may see the live scores while the scoreboard is frozen.
+func canSeeLiveScores(token rest.AccessTokenEntry) bool {
+	return token.GetRole() == rest.RoleOperator || token.GetRole() == rest.RoleAdmin
+}
+
+// loadScoreboardState gets the freeze state of the track scoreboard, which is unfrozen if never saved.
+func loadScoreboardState(trackID string) (*Scoreboard, error) {
+	state := Scoreboard{TrackID: trackID}
+	dbResult := db.Select(&state, "scoreboards", "track", "=", trackID)
+	if dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	return &state, nil
+}
+
+func (scoreboard *Scoreboard) saveState() error {
+	if dbResult := db.Delete("scoreboards", "track", "=", scoreboard.TrackID); dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	if dbResult := db.Insert("scoreboards", scoreboard); dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	return nil
+}
+
+// loadScoreboard gets the ranked scores for the track, from the frozen snapshot if frozen and not live.
+func loadScoreboard(trackID string, live bool) (*Scoreboard, error) {
+	scoreboard, err := loadScoreboardState(trackID)
+	if err != nil {
+		return nil, err
+	}
+	table := "timeslot_scores"
+	if scoreboard.Frozen && !live {
+		table = "frozen_scores"
+	}
+	var scores TimeslotScores
+	if dbResult := db.SelectMany(&scores, table, "track", "=", trackID); dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	if scores == nil {
+		scores = make(TimeslotScores, 0)
+	}
+	sortScores(scores)
+	scoreboard.Scores = scores
+	return scoreboard, nil
+}
+
+// sortScores sorts the scores highest first.
+func sortScores(scores TimeslotScores) {
+	sort.SliceStable(scores, func(i, j int) bool {
+		return scores[i].Score > scores[j].Score
+	})
+}
@@ -0,0 +1,297 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// SeatingImport is a (partial) export from the seating system, to set the seats of users and net-track stations.
+type SeatingImport struct {
+	Replace  bool                    `json:"replace"`  // Clear the seats of users not in the import
+	Users    []*SeatingImportUser    `json:"users"`    // Matched by ID or username
+	Stations []*SeatingImportStation `json:"stations"` // Matched by track and shortname
+	// Generated
+	UpdatedUsers      int      `json:"updated_users"`
+	UpdatedStations   int      `json:"updated_stations"`
+	UnmatchedUsers    []string `json:"unmatched_users"`
+	UnmatchedStations []string `json:"unmatched_stations"` // As "<track>/<shortname>"
+}
+
+// SeatingImportUser is the seat of a user.
+type SeatingImportUser struct {
+	UserID   string `json:"user"`
+	Username string `json:"username"`
+	Hall     string `json:"hall"`
+	Row      string `json:"row"`
+	Seat     string `json:"seat"`
+}
+
+// SeatingImportStation is the location of a station.
+type SeatingImportStation struct {
+	TrackID   string `json:"track"`
+	Shortname string `json:"shortname"`
+	Hall      string `json:"hall"`
+	Row       string `json:"row"`
+	Seat      string `json:"seat"`
+}
+
+// StationLocation is where to physically find a station and the participants using it.
+type StationLocation struct {
+	StationID    *uuid.UUID                `json:"station"`
+	Hall         string                    `json:"hall"`
+	Row          string                    `json:"row"`
+	Seat         string                    `json:"seat"`
+	TimeslotID   string                    `json:"timeslot"`
+	Participants []*StationLocationSeating `json:"participants"`
+}
+
+// StationLocationSeating is the seat of a participant.
+type StationLocationSeating struct {
+	UserID      *uuid.UUID `json:"user"`
+	DisplayName string     `json:"display_name"`
+	Hall        string     `json:"hall"`
+	Row         string     `json:"row"`
+	Seat        string     `json:"seat"`
+}
+
+func init() {
+	rest.AddHandler("/seating/import/", "^$", func() interface{} { return &SeatingImport{} })
+	rest.AddHandler("/station/", "^(?P<id>[^/]+)/location/$", func() interface{} { return &StationLocation{} })
+}
+
+// Post imports the seats, responding with what was updated and what didn't match anything.
+func (seatingImport *SeatingImport) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Validate
+	for _, user := range seatingImport.Users {
+		if user.UserID == "" && user.Username == "" {
+			return rest.Result{Code: 400, Message: "user without ID or username"}
+		}
+		if user.UserID != "" {
+			if _, err := uuid.Parse(user.UserID); err != nil {
+				return rest.Result{Code: 400, Message: fmt.Sprintf("invalid user ID: %v", user.UserID)}
+			}
+		}
+	}
+	for _, station := range seatingImport.Stations {
+		if station.TrackID == "" || station.Shortname == "" {
+			return rest.Result{Code: 400, Message: "station without track or shortname"}
+		}
+		var track Track
+		dbResult := db.Select(&track, "tracks", "id", "=", station.TrackID)
+		if dbResult.IsFailed() {
+			return rest.Result{Code: 500, Error: dbResult.Error}
+		}
+		if dbResult.IsSuccess() && !track.behavior().Seats {
+			return rest.Result{Code: 400, Message: fmt.Sprintf("track %v does not have seats", station.TrackID)}
+		}
+	}
+
+	// Import
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	defer tx.Rollback()
+	if seatingImport.Replace {
+		if _, err := tx.Exec("UPDATE users SET seat_hall = '', seat_row = '', seat = ''"); err != nil {
+			return rest.Result{Code: 500, Error: err}
+		}
+	}
+	seatingImport.UnmatchedUsers = make([]string, 0)
+	seatingImport.UnmatchedStations = make([]string, 0)
+	for _, user := range seatingImport.Users {
+		column, needle := "username", user.Username
+		if user.UserID != "" {
+			column, needle = "id", user.UserID
+		}
+		result, err := tx.Exec(fmt.Sprintf("UPDATE users SET seat_hall = $1, seat_row = $2, seat = $3 WHERE %v = $4", column), user.Hall, user.Row, user.Seat, needle)
+		if err != nil {
+			return rest.Result{Code: 500, Error: err}
+		}
+		if affected, err := result.RowsAffected(); err != nil {
+			return rest.Result{Code: 500, Error: err}
+		} else if affected > 0 {
+			seatingImport.UpdatedUsers++
+		} else {
+			seatingImport.UnmatchedUsers = append(seatingImport.UnmatchedUsers, needle)
+		}
+	}
+	for _, station := range seatingImport.Stations {
+		result, err := tx.Exec("UPDATE stations SET seat_hall = $1, seat_row = $2, seat = $3 WHERE track = $4 AND shortname = $5",
+			station.Hall, station.Row, station.Seat, station.TrackID, station.Shortname)
+		if err != nil {
+			return rest.Result{Code: 500, Error: err}
+		}
+		if affected, err := result.RowsAffected(); err != nil {
+			return rest.Result{Code: 500, Error: err}
+		} else if affected > 0 {
+			seatingImport.UpdatedStations++
+		} else {
+			seatingImport.UnmatchedStations = append(seatingImport.UnmatchedStations, fmt.Sprintf("%v/%v", station.TrackID, station.Shortname))
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+
+	request.Log().WithFields(log.Fields{
+		"users":     seatingImport.UpdatedUsers,
+		"stations":  seatingImport.UpdatedStations,
+		"unmatched": len(seatingImport.UnmatchedUsers) + len(seatingImport.UnmatchedStations),
+		"replace":   seatingImport.Replace,
+		"actor":     request.AccessToken.GetName(),
+	}).Info("Imported seating")
+	return rest.Result{}
+}
+
+// Get gets the location of the station and the seats of the participants of its timeslot, if any.
+func (location *StationLocation) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if !isStaff(request.AccessToken) {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+
+	// Get
+	var station Station
+	dbResult := db.Select(&station, "stations", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+	location.StationID = station.ID
+	location.Hall = station.SeatHall
+	location.Row = station.SeatRow
+	location.Seat = station.Seat
+	location.TimeslotID = station.TimeslotID
+	participants, err := station.participantSeats()
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	location.Participants = participants
+	return rest.Result{}
+}
+
+// validateSeat checks that only net-track stations have seats, since other stations aren't in the hall.
+func (station *Station) validateSeat() rest.Result {
+	if station.SeatHall == "" && station.SeatRow == "" && station.Seat == "" {
+		return rest.Result{}
+	}
+	var track Track
+	dbResult := db.Select(&track, "tracks", "id", "=", station.TrackID)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if dbResult.IsSuccess() && !track.behavior().Seats {
+		return rest.Result{Code: 400, Message: "only stations of tracks with seats may have seats"}
+	}
+	return rest.Result{}
+}
+
+// participantSeats gets the seats of the participants of the timeslot of the station, empty if not assigned.
+func (station *Station) participantSeats() ([]*StationLocationSeating, error) {
+	seats := make([]*StationLocationSeating, 0)
+	if station.TimeslotID == "" {
+		return seats, nil
+	}
+	var timeslot Timeslot
+	dbResult := db.Select(&timeslot, "timeslots", "id", "=", station.TimeslotID)
+	if dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	if !dbResult.IsSuccess() {
+		return seats, nil
+	}
+	userIDs, err := timeslot.participantIDs()
+	if err != nil {
+		return nil, err
+	}
+	for _, userID := range userIDs {
+		var user rest.User
+		dbResult := db.Select(&user, "users", "id", "=", userID)
+		if dbResult.IsFailed() {
+			return nil, dbResult.Error
+		}
+		if !dbResult.IsSuccess() {
+			continue
+		}
+		seats = append(seats, &StationLocationSeating{
+			UserID:      user.ID,
+			DisplayName: user.DisplayName,
+			Hall:        user.SeatHall,
+			Row:         user.SeatRow,
+			Seat:        user.Seat,
+		})
+	}
+	return seats, nil
+}
+
+// describeLocation describes where to find the station and its participants, for alerts. Empty if nothing is known.
+func (station *Station) describeLocation() string {
+	var parts []string
+	if seat := formatSeat(station.SeatHall, station.SeatRow, station.Seat); seat != "" {
+		parts = append(parts, fmt.Sprintf("the station is at %v", seat))
+	}
+	seats, err := station.participantSeats()
+	if err != nil {
+		log.WithError(err).WithField("station", station.ID).Warn("Failed to get participant seats")
+	}
+	for _, participant := range seats {
+		if seat := formatSeat(participant.Hall, participant.Row, participant.Seat); seat != "" {
+			parts = append(parts, fmt.Sprintf("%v is at %v", participant.DisplayName, seat))
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// formatSeat formats a seat like "hall A, row 12, seat 7", skipping empty parts.
+func formatSeat(hall string, row string, seat string) string {
+	var parts []string
+	if hall != "" {
+		parts = append(parts, "hall "+hall)
+	}
+	if row != "" {
+		parts = append(parts, "row "+row)
+	}
+	if seat != "" {
+		parts = append(parts, "seat "+seat)
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,639 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/event"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// Event types for crew shifts, sent to the affected operators.
+const (
+	EventTypeShiftSwapRequested event.Type = "shift.swap_requested" // Sent to the holder of the wanted shift
+	EventTypeShiftSwapped       event.Type = "shift.swapped"        // Sent to both operators
+	EventTypeShiftSwapDeclined  event.Type = "shift.swap_declined"  // Sent to the requester
+)
+
+// ShiftSwapStatus is the status of a shift swap request.
+type ShiftSwapStatus string
+
+const (
+	// ShiftSwapStatusPending means the other operator hasn't answered yet.
+	ShiftSwapStatusPending ShiftSwapStatus = "pending"
+	// ShiftSwapStatusAccepted means the shifts were swapped.
+	ShiftSwapStatusAccepted ShiftSwapStatus = "accepted"
+	// ShiftSwapStatusDeclined means the other operator declined, or the shifts changed before it was answered.
+	ShiftSwapStatusDeclined ShiftSwapStatus = "declined"
+)
+
+// CrewShift is a time range where an operator covers a track (or all tracks).
+type CrewShift struct {
+	ID        *uuid.UUID `column:"id" json:"id"`                 // Generated, required, unique
+	TrackID   string     `column:"track" json:"track"`           // Optional, all tracks if empty
+	BeginTime *time.Time `column:"begin_time" json:"begin_time"` // Required
+	EndTime   *time.Time `column:"end_time" json:"end_time"`     // Required
+	UserID    *uuid.UUID `column:"user" json:"user"`             // The operator covering it, open for claiming if null
+	Notes     string     `column:"notes" json:"notes"`           // Optional
+}
+
+// CrewShifts is a list of crew shifts.
+type CrewShifts []*CrewShift
+
+// ShiftSwap is a request to swap shifts with another operator.
+type ShiftSwap struct {
+	ID            *uuid.UUID      `column:"id" json:"id"`                     // Generated
+	ShiftID       *uuid.UUID      `column:"shift" json:"shift"`               // Required, the requester's shift
+	WantedShiftID *uuid.UUID      `column:"wanted_shift" json:"wanted_shift"` // Required, the other operator's shift
+	RequestedBy   *uuid.UUID      `column:"requested_by" json:"requested_by"` // Generated
+	TargetUserID  *uuid.UUID      `column:"target_user" json:"target_user"`   // Generated, the holder of the wanted shift
+	Status        ShiftSwapStatus `column:"status" json:"status"`             // Generated
+	RequestTime   *time.Time      `column:"request_time" json:"request_time"` // Generated
+	DecideTime    *time.Time      `column:"decide_time" json:"decide_time"`   // Generated
+}
+
+// ShiftSwaps is a list of shift swaps.
+type ShiftSwaps []*ShiftSwap
+
+// OnDutyOperator is an operator covering a track now, for participants to know who to ping.
+type OnDutyOperator struct {
+	DisplayName string     `json:"display_name"`
+	Username    string     `json:"username"`
+	TrackID     string     `json:"track"` // Empty if covering all tracks
+	EndTime     *time.Time `json:"end_time"`
+}
+
+// OnDutyOperators is a list of on-duty operators.
+type OnDutyOperators []*OnDutyOperator
+
+// ShiftClaimRequest is a request to take an open shift.
+type ShiftClaimRequest struct{}
+
+// ShiftReleaseRequest is a request to give up a shift, making it open again.
+type ShiftReleaseRequest struct{}
+
+// ShiftSwapAcceptRequest is a request to accept a shift swap.
+type ShiftSwapAcceptRequest struct{}
+
+// ShiftSwapDeclineRequest is a request to decline a shift swap.
+type ShiftSwapDeclineRequest struct{}
+
+func init() {
+	rest.AddHandler("/shifts/", "^$", func() interface{} { return &CrewShifts{} })
+	rest.AddHandler("/shift/", "^(?:(?P<id>[^/]+)/)?$", func() interface{} { return &CrewShift{} })
+	rest.AddHandler("/shift/", "^(?P<id>[^/]+)/claim/$", func() interface{} { return &ShiftClaimRequest{} })
+	rest.AddHandler("/shift/", "^(?P<id>[^/]+)/release/$", func() interface{} { return &ShiftReleaseRequest{} })
+	rest.AddHandler("/shift-swaps/", "^$", func() interface{} { return &ShiftSwaps{} })
+	rest.AddHandler("/shift-swap/", "^(?:(?P<id>[^/]+)/)?$", func() interface{} { return &ShiftSwap{} })
+	rest.AddHandler("/shift-swap/", "^(?P<id>[^/]+)/accept/$", func() interface{} { return &ShiftSwapAcceptRequest{} })
+	rest.AddHandler("/shift-swap/", "^(?P<id>[^/]+)/decline/$", func() interface{} { return &ShiftSwapDeclineRequest{} })
+	rest.AddHandler("/on-duty/", "^$", func() interface{} { return &OnDutyOperators{} })
+	registerPersonalData(personalDataTable{table: "crew_shifts", userColumn: "user", scrubColumns: []string{"notes"}, erasure: personalDataAnonymize})
+	registerPersonalData(personalDataTable{table: "shift_swaps", userColumn: "requested_by", erasure: personalDataDelete})
+}
+
+// Get gets shifts ordered by begin time, optionally filtered by track ("track", including shifts for all tracks), operator ("user"),
+// open shifts ("open") and time range ("from" and "until", RFC 3339).
+func (shifts *CrewShifts) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if !isStaff(request.AccessToken) {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params, prep filtering
+	var whereArgs []interface{}
+	if userID, ok := request.QueryArgs["user"]; ok {
+		whereArgs = append(whereArgs, "user", "=", userID)
+	}
+	if _, ok := request.QueryArgs["open"]; ok {
+		whereArgs = append(whereArgs, "user", "IS", nil)
+	}
+	for _, arg := range []struct{ name, column, operator string }{{"from", "end_time", ">"}, {"until", "begin_time", "<"}} {
+		if rawTime, ok := request.QueryArgs[arg.name]; ok {
+			parsedTime, err := time.Parse(time.RFC3339, rawTime)
+			if err != nil {
+				return rest.Result{Code: 400, Message: fmt.Sprintf("invalid %v time", arg.name)}
+			}
+			whereArgs = append(whereArgs, arg.column, arg.operator, parsedTime)
+		}
+	}
+
+	// Get
+	var allShifts CrewShifts
+	dbResult := db.SelectMany(&allShifts, "crew_shifts", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	trackID, hasTrackID := request.QueryArgs["track"]
+	*shifts = make(CrewShifts, 0)
+	for _, shift := range allShifts {
+		if !hasTrackID || shift.TrackID == "" || shift.TrackID == trackID {
+			*shifts = append(*shifts, shift)
+		}
+	}
+	sort.SliceStable(*shifts, func(i, j int) bool {
+		return (*shifts)[i].BeginTime.Before(*(*shifts)[j].BeginTime)
+	})
+	return rest.Result{}
+}
+
+// Get gets a single shift.
+func (shift *CrewShift) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if !isStaff(request.AccessToken) {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Get
+	return shift.load(request)
+}
+
+// Post creates a shift.
+func (shift *CrewShift) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Prepare and validate
+	newID := uuid.New()
+	shift.ID = &newID
+	if result := shift.validate(); !result.IsOk() {
+		return result
+	}
+
+	// Create
+	dbResult := db.Insert("crew_shifts", shift)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	return rest.Result{Code: 201, Location: fmt.Sprintf("%v/shift/%v/", config.Config.SitePrefix, shift.ID)}
+}
+
+// Put updates a shift, e.g. to assign it to an operator.
+func (shift *CrewShift) Put(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+	if shift.ID != nil && (*shift.ID).String() != id {
+		return rest.Result{Code: 400, Message: "mismatch between URL and JSON IDs"}
+	}
+	var existing CrewShift
+	existingDBResult := db.Select(&existing, "crew_shifts", "id", "=", id)
+	if existingDBResult.IsFailed() {
+		return rest.Result{Code: 500, Error: existingDBResult.Error}
+	}
+	if !existingDBResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+
+	// Validate
+	shift.ID = existing.ID
+	if result := shift.validate(); !result.IsOk() {
+		return result
+	}
+
+	// Update
+	dbResult := db.Update("crew_shifts", shift, "id", "=", shift.ID)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if err := declinePendingShiftSwaps(*shift.ID); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	return rest.Result{}
+}
+
+// Delete deletes a shift.
+func (shift *CrewShift) Delete(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	if result := shift.load(request); !result.IsOk() {
+		return result
+	}
+
+	// Delete
+	if err := declinePendingShiftSwaps(*shift.ID); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	dbResult := db.Delete("crew_shifts", "id", "=", shift.ID)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	return rest.Result{}
+}
+
+// Post claims the open shift for the requesting operator.
+func (claimRequest *ShiftClaimRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if !isStaff(request.AccessToken) || request.AccessToken.OwnerUserID == nil {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	var shift CrewShift
+	if result := shift.load(request); !result.IsOk() {
+		return result
+	}
+
+	// Claim, only if still open
+	dbResult, err := db.DB.Exec("UPDATE crew_shifts SET \"user\" = $1 WHERE id = $2 AND \"user\" IS NULL", request.AccessToken.OwnerUserID.String(), shift.ID.String())
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	if affected, err := dbResult.RowsAffected(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	} else if affected == 0 {
+		return rest.Result{Code: 409, Message: "shift is already taken"}
+	}
+	request.Log().WithFields(log.Fields{
+		"shift": shift.ID,
+		"actor": request.AccessToken.GetName(),
+	}).Info("Shift claimed")
+	return rest.Result{Code: 303, Location: fmt.Sprintf("%v/shift/%v/", config.Config.SitePrefix, shift.ID)}
+}
+
+// Post releases the requesting operator's shift, making it open for claiming.
+func (releaseRequest *ShiftReleaseRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if !isStaff(request.AccessToken) || request.AccessToken.OwnerUserID == nil {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	var shift CrewShift
+	if result := shift.load(request); !result.IsOk() {
+		return result
+	}
+	if !uuidPointersEqual(shift.UserID, request.AccessToken.OwnerUserID) {
+		return rest.Result{Code: 409, Message: "not your shift"}
+	}
+
+	// Release
+	if _, err := db.DB.Exec("UPDATE crew_shifts SET \"user\" = NULL WHERE id = $1", shift.ID.String()); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	if err := declinePendingShiftSwaps(*shift.ID); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	request.Log().WithFields(log.Fields{
+		"shift": shift.ID,
+		"actor": request.AccessToken.GetName(),
+	}).Info("Shift released")
+	return rest.Result{Code: 303, Location: fmt.Sprintf("%v/shift/%v/", config.Config.SitePrefix, shift.ID)}
+}
+
+// Get gets the swaps requested by or from the requesting operator (or all for admins), newest first.
+func (swaps *ShiftSwaps) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if !isStaff(request.AccessToken) {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Get
+	var allSwaps ShiftSwaps
+	var whereArgs []interface{}
+	if status, ok := request.QueryArgs["status"]; ok {
+		whereArgs = append(whereArgs, "status", "=", status)
+	}
+	dbResult := db.SelectMany(&allSwaps, "shift_swaps", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	*swaps = make(ShiftSwaps, 0)
+	for _, swap := range allSwaps {
+		if request.AccessToken.GetRole() == rest.RoleAdmin || swap.involves(request.AccessToken.OwnerUserID) {
+			*swaps = append(*swaps, swap)
+		}
+	}
+	sort.SliceStable(*swaps, func(i, j int) bool {
+		return (*swaps)[i].RequestTime.After(*(*swaps)[j].RequestTime)
+	})
+	return rest.Result{}
+}
+
+// Get gets a single swap.
+func (swap *ShiftSwap) Get(request *rest.Request) rest.Result {
+	return swap.load(request)
+}
+
+// Post requests to swap the requester's shift with another operator's shift.
+func (swap *ShiftSwap) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if !isStaff(request.AccessToken) || request.AccessToken.OwnerUserID == nil {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Validate
+	if swap.ShiftID == nil || swap.WantedShiftID == nil {
+		return rest.Result{Code: 400, Message: "missing shift IDs"}
+	}
+	var shift, wantedShift CrewShift
+	for _, item := range []struct {
+		shift *CrewShift
+		id    *uuid.UUID
+	}{{&shift, swap.ShiftID}, {&wantedShift, swap.WantedShiftID}} {
+		dbResult := db.Select(item.shift, "crew_shifts", "id", "=", item.id)
+		if dbResult.IsFailed() {
+			return rest.Result{Code: 500, Error: dbResult.Error}
+		}
+		if !dbResult.IsSuccess() {
+			return rest.Result{Code: 400, Message: "referenced shift does not exist"}
+		}
+	}
+	if !uuidPointersEqual(shift.UserID, request.AccessToken.OwnerUserID) {
+		return rest.Result{Code: 409, Message: "not your shift"}
+	}
+	if wantedShift.UserID == nil {
+		return rest.Result{Code: 409, Message: "wanted shift is open, claim it instead"}
+	}
+	if *wantedShift.UserID == *shift.UserID {
+		return rest.Result{Code: 409, Message: "both shifts are yours"}
+	}
+
+	// Create
+	newID := uuid.New()
+	now := time.Now()
+	swap.ID = &newID
+	swap.RequestedBy = request.AccessToken.OwnerUserID
+	swap.TargetUserID = wantedShift.UserID
+	swap.Status = ShiftSwapStatusPending
+	swap.RequestTime = &now
+	swap.DecideTime = nil
+	dbResult := db.Insert("shift_swaps", swap)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	swap.publish(EventTypeShiftSwapRequested, []uuid.UUID{*swap.TargetUserID}, "Shift swap requested",
+		fmt.Sprintf("%v wants to swap their shift at %v for your shift at %v.", request.AccessToken.GetName(),
+			displayTime(*shift.BeginTime).Format(reminderTimeFormat), displayTime(*wantedShift.BeginTime).Format(reminderTimeFormat)))
+
+	return rest.Result{Code: 201, Location: fmt.Sprintf("%v/shift-swap/%v/", config.Config.SitePrefix, swap.ID)}
+}
+
+// Post accepts the swap, swapping the operators of the shifts.
+func (acceptRequest *ShiftSwapAcceptRequest) Post(request *rest.Request) rest.Result {
+	// Check perms and params
+	var swap ShiftSwap
+	if result := swap.loadPendingForTarget(request); !result.IsOk() {
+		return result
+	}
+
+	// Swap, only if both shifts still belong to the same operators
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	defer tx.Rollback()
+	for _, change := range []struct{ shiftID, from, to *uuid.UUID }{
+		{swap.ShiftID, swap.RequestedBy, swap.TargetUserID},
+		{swap.WantedShiftID, swap.TargetUserID, swap.RequestedBy},
+	} {
+		result, err := tx.Exec("UPDATE crew_shifts SET \"user\" = $1 WHERE id = $2 AND \"user\" = $3", change.to.String(), change.shiftID.String(), change.from.String())
+		if err != nil {
+			return rest.Result{Code: 500, Error: err}
+		}
+		if affected, err := result.RowsAffected(); err != nil {
+			return rest.Result{Code: 500, Error: err}
+		} else if affected == 0 {
+			return rest.Result{Code: 409, Message: "the shifts changed since the swap was requested"}
+		}
+	}
+	now := time.Now()
+	if _, err := tx.Exec("UPDATE shift_swaps SET status = $1, decide_time = $2 WHERE id = $3", ShiftSwapStatusAccepted, now, swap.ID.String()); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	if err := tx.Commit(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	swap.Status = ShiftSwapStatusAccepted
+	swap.DecideTime = &now
+
+	// Other swaps for these shifts are no longer valid
+	for _, shiftID := range []*uuid.UUID{swap.ShiftID, swap.WantedShiftID} {
+		if err := declinePendingShiftSwaps(*shiftID); err != nil {
+			return rest.Result{Code: 500, Error: err}
+		}
+	}
+	swap.publish(EventTypeShiftSwapped, []uuid.UUID{*swap.RequestedBy, *swap.TargetUserID}, "Shifts swapped",
+		fmt.Sprintf("%v accepted the shift swap.", request.AccessToken.GetName()))
+	return rest.Result{Code: 303, Location: fmt.Sprintf("%v/shift-swap/%v/", config.Config.SitePrefix, swap.ID)}
+}
+
+// Post declines the swap.
+func (declineRequest *ShiftSwapDeclineRequest) Post(request *rest.Request) rest.Result {
+	// Check perms and params
+	var swap ShiftSwap
+	if result := swap.loadPendingForTarget(request); !result.IsOk() {
+		return result
+	}
+
+	// Decline
+	now := time.Now()
+	swap.Status = ShiftSwapStatusDeclined
+	swap.DecideTime = &now
+	dbResult := db.Update("shift_swaps", &swap, "id", "=", swap.ID)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	swap.publish(EventTypeShiftSwapDeclined, []uuid.UUID{*swap.RequestedBy}, "Shift swap declined",
+		fmt.Sprintf("%v declined the shift swap.", request.AccessToken.GetName()))
+	return rest.Result{Code: 303, Location: fmt.Sprintf("%v/shift-swap/%v/", config.Config.SitePrefix, swap.ID)}
+}
+
+// Get gets the operators on duty now, optionally for a track ("track", including operators covering all tracks).
+func (operators *OnDutyOperators) Get(request *rest.Request) rest.Result {
+	trackID, hasTrackID := request.QueryArgs["track"]
+	onDuty, err := findOnDutyOperators(request.Context(), trackID, hasTrackID, time.Now())
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	*operators = onDuty
+	return rest.Result{}
+}
+
+// findOnDutyOperators finds the operators with shifts covering the time, for the track (if filtered) or all tracks.
+func findOnDutyOperators(ctx context.Context, trackID string, filterTrack bool, now time.Time) (OnDutyOperators, error) {
+	var shifts CrewShifts
+	dbResult := db.SelectManyContext(ctx, &shifts, "crew_shifts", "begin_time", "<=", now, "end_time", ">", now, "user", "IS NOT", nil)
+	if dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	sort.SliceStable(shifts, func(i, j int) bool {
+		return shifts[i].BeginTime.Before(*shifts[j].BeginTime)
+	})
+	// Look up the users in one batch instead of per shift
+	userIDs := make([]string, 0, len(shifts))
+	for _, shift := range shifts {
+		if filterTrack && shift.TrackID != "" && shift.TrackID != trackID {
+			continue
+		}
+		userIDs = append(userIDs, shift.UserID.String())
+	}
+	if len(userIDs) == 0 {
+		return make(OnDutyOperators, 0), nil
+	}
+	var users []*rest.User
+	userDBResult := db.SelectManyContext(ctx, &users, "users", "id", "IN", userIDs)
+	if userDBResult.IsFailed() {
+		return nil, userDBResult.Error
+	}
+	userMap := make(map[uuid.UUID]*rest.User, len(users))
+	for _, user := range users {
+		userMap[*user.ID] = user
+	}
+
+	operators := make(OnDutyOperators, 0)
+	for _, shift := range shifts {
+		if filterTrack && shift.TrackID != "" && shift.TrackID != trackID {
+			continue
+		}
+		user, userOk := userMap[*shift.UserID]
+		if !userOk {
+			continue
+		}
+		operators = append(operators, &OnDutyOperator{
+			DisplayName: user.DisplayName,
+			Username:    user.Username,
+			TrackID:     shift.TrackID,
+			EndTime:     shift.EndTime,
+		})
+	}
+	return operators, nil
+}
+
+func (shift *CrewShift) load(request *rest.Request) rest.Result {
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+	dbResult := db.Select(shift, "crew_shifts", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+	return rest.Result{}
+}
+
+func (shift *CrewShift) validate() rest.Result {
+	switch {
+	case shift.BeginTime == nil || shift.EndTime == nil:
+		return rest.Result{Code: 400, Message: "missing begin or end time"}
+	case !shift.EndTime.After(*shift.BeginTime):
+		return rest.Result{Code: 400, Message: "end time must be after begin time"}
+	}
+	if shift.TrackID != "" {
+		track := Track{ID: shift.TrackID}
+		if exists, err := track.exists(); err != nil {
+			return rest.Result{Code: 500, Error: err}
+		} else if !exists {
+			return rest.Result{Code: 400, Message: "referenced track does not exist"}
+		}
+	}
+	if shift.UserID != nil {
+		var user rest.User
+		dbResult := db.Select(&user, "users", "id", "=", shift.UserID)
+		if dbResult.IsFailed() {
+			return rest.Result{Code: 500, Error: dbResult.Error}
+		}
+		if !dbResult.IsSuccess() {
+			return rest.Result{Code: 400, Message: "referenced user does not exist"}
+		}
+		if user.Role != rest.RoleOperator && user.Role != rest.RoleAdmin {
+			return rest.Result{Code: 400, Message: "referenced user is not an operator/admin"}
+		}
+	}
+	return rest.Result{}
+}
+
+func (swap *ShiftSwap) load(request *rest.Request) rest.Result {
+	if !isStaff(request.AccessToken) {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+	dbResult := db.Select(swap, "shift_swaps", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() || (request.AccessToken.GetRole() != rest.RoleAdmin && !swap.involves(request.AccessToken.OwnerUserID)) {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+	return rest.Result{}
+}
+
+// loadPendingForTarget loads the swap, if pending and the requester is the one who must answer it.
+func (swap *ShiftSwap) loadPendingForTarget(request *rest.Request) rest.Result {
+	if result := swap.load(request); !result.IsOk() {
+		return result
+	}
+	if !uuidPointersEqual(swap.TargetUserID, request.AccessToken.OwnerUserID) {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+	if swap.Status != ShiftSwapStatusPending {
+		return rest.Result{Code: 409, Message: fmt.Sprintf("swap is already %v", swap.Status)}
+	}
+	return rest.Result{}
+}
+
+func (swap *ShiftSwap) involves(userID *uuid.UUID) bool {
+	return userID != nil && (uuidPointersEqual(swap.RequestedBy, userID) || uuidPointersEqual(swap.TargetUserID, userID))
+}
+
+func (swap *ShiftSwap) publish(eventType event.Type, userIDs []uuid.UUID, title string, message string) {
+	event.Publish(event.Event{
+		Type:    eventType,
+		UserIDs: userIDs,
+		Title:   title,
+		Message: message,
+		Data:    swap,
+	})
+}
+
+// declinePendingShiftSwaps declines pending swaps involving the shift, since its operator or time changed.
+func declinePendingShiftSwaps(shiftID uuid.UUID) error {
+	_, err := db.DB.Exec("UPDATE shift_swaps SET status = $1, decide_time = $2 WHERE status = $3 AND (shift = $4 OR wanted_shift = $4)",
+		ShiftSwapStatusDeclined, time.Now(), ShiftSwapStatusPending, shiftID.String())
+	return err
+}
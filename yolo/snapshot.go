@@ -0,0 +1,288 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/provision"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultMaxStationSnapshots = 3
+
+// StationSnapshot is a checkpoint of the instance of a dynamic station, which operators may restore.
+type StationSnapshot struct {
+	ID          *uuid.UUID `column:"id" json:"id"`                   // Generated
+	StationID   *uuid.UUID `column:"station" json:"station"`         // Required
+	TimeslotID  string     `column:"timeslot" json:"timeslot"`       // Generated, the timeslot assigned to the station at the time, if any
+	Name        string     `column:"name" json:"name"`               // Generated, the snapshot name in the provisioner
+	Description string     `column:"description" json:"description"` // Optional
+	CreatedBy   string     `column:"created_by" json:"created_by"`   // Generated
+	Timestamp   *time.Time `column:"timestamp" json:"timestamp"`     // Generated
+}
+
+// StationSnapshots is a list of station snapshots.
+type StationSnapshots []*StationSnapshot
+
+// StationSnapshotRestoreRequest is a request to roll a station back to a snapshot.
+type StationSnapshotRestoreRequest struct{}
+
+func init() {
+	rest.AddHandler("/station-snapshots/", "^$", func() interface{} { return &StationSnapshots{} })
+	rest.AddHandler("/station-snapshot/", "^(?:(?P<id>[^/]+)/)?$", func() interface{} { return &StationSnapshot{} })
+	rest.AddHandler("/station-snapshot/", "^(?P<id>[^/]+)/restore/$", func() interface{} { return &StationSnapshotRestoreRequest{} })
+	registerPersonalData(personalDataTable{table: "station_snapshots", actorColumns: []string{"created_by"}, scrubColumns: []string{"description"}, erasure: personalDataAnonymize})
+}
+
+// Get gets the snapshots of a station (the "station" query arg), newest first.
+// Participants only see the snapshots taken during their timeslot.
+func (snapshots *StationSnapshots) Get(request *rest.Request) rest.Result {
+	// Check params
+	stationID, stationIDExists := request.QueryArgs["station"]
+	if !stationIDExists || stationID == "" {
+		return rest.Result{Code: 400, Message: "missing station ID"}
+	}
+
+	// Check perms
+	var station Station
+	if result := loadSnapshotStation(request.AccessToken, stationID, &station); !result.IsOk() {
+		return result
+	}
+
+	// Get
+	whereArgs := []interface{}{"station", "=", station.ID}
+	if !isStaff(request.AccessToken) {
+		whereArgs = append(whereArgs, "timeslot", "=", station.TimeslotID)
+	}
+	dbResult := db.SelectMany(snapshots, "station_snapshots", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	sort.SliceStable(*snapshots, func(i, j int) bool {
+		return (*snapshots)[i].Timestamp.After(*(*snapshots)[j].Timestamp)
+	})
+	return rest.Result{}
+}
+
+// Get gets a single snapshot.
+func (snapshot *StationSnapshot) Get(request *rest.Request) rest.Result {
+	_, result := snapshot.load(request)
+	return result
+}
+
+// Post takes a snapshot of the station, within the snapshot quota of the station.
+func (snapshot *StationSnapshot) Post(request *rest.Request) rest.Result {
+	// Check params and perms
+	if snapshot.StationID == nil {
+		return rest.Result{Code: 400, Message: "missing station ID"}
+	}
+	var station Station
+	if result := loadSnapshotStation(request.AccessToken, snapshot.StationID.String(), &station); !result.IsOk() {
+		return result
+	}
+	snapshotter, result := stationSnapshotter(&station)
+	if !result.IsOk() {
+		return result
+	}
+
+	// Check quota
+	var count int
+	if err := db.DB.QueryRow("SELECT COUNT(*) FROM station_snapshots WHERE station = $1", station.ID.String()).Scan(&count); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	maxSnapshots := config.Config.ServerTracks[station.TrackID].MaxSnapshots
+	if maxSnapshots <= 0 {
+		maxSnapshots = defaultMaxStationSnapshots
+	}
+	if count >= maxSnapshots {
+		return rest.Result{Code: 409, Message: fmt.Sprintf("station already has %v snapshots, delete one first", count)}
+	}
+
+	// Take snapshot
+	newID := uuid.New()
+	now := time.Now()
+	snapshot.ID = &newID
+	snapshot.TimeslotID = station.TimeslotID
+	snapshot.Name = "techo-" + strings.ReplaceAll(newID.String(), "-", "")[:12]
+	snapshot.Description = strings.TrimSpace(snapshot.Description)
+	snapshot.CreatedBy = request.AccessToken.GetName()
+	snapshot.Timestamp = &now
+	if err := snapshotter.CreateSnapshot(station.instanceID(), snapshot.Name); err != nil {
+		station.publishProvisionFailed("snapshot", err)
+		return rest.Result{Code: 500, Error: err}
+	}
+	dbResult := db.Insert("station_snapshots", snapshot)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	request.Log().WithFields(log.Fields{
+		"station":  station.ID,
+		"snapshot": snapshot.Name,
+		"actor":    snapshot.CreatedBy,
+	}).Info("Station snapshot taken")
+
+	return rest.Result{Code: 201, Location: fmt.Sprintf("%v/station-snapshot/%v/", config.Config.SitePrefix, snapshot.ID)}
+}
+
+// Delete deletes a snapshot, freeing quota.
+func (snapshot *StationSnapshot) Delete(request *rest.Request) rest.Result {
+	// Check params and perms
+	station, result := snapshot.load(request)
+	if !result.IsOk() {
+		return result
+	}
+	snapshotter, result := stationSnapshotter(station)
+	if !result.IsOk() {
+		return result
+	}
+
+	// Delete
+	if err := snapshotter.DeleteSnapshot(station.instanceID(), snapshot.Name); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	dbResult := db.Delete("station_snapshots", "id", "=", snapshot.ID)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	return rest.Result{}
+}
+
+// Post rolls the station instance back to the snapshot, e.g. if the participant broke it beyond repair.
+func (restoreRequest *StationSnapshotRestoreRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if !isStaff(request.AccessToken) {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	var snapshot StationSnapshot
+	station, result := snapshot.load(request)
+	if !result.IsOk() {
+		return result
+	}
+	snapshotter, result := stationSnapshotter(station)
+	if !result.IsOk() {
+		return result
+	}
+
+	// Restore
+	if err := snapshotter.RestoreSnapshot(station.instanceID(), snapshot.Name); err != nil {
+		station.publishProvisionFailed("restore", err)
+		return rest.Result{Code: 500, Error: err}
+	}
+	if err := station.saveInstanceState(provision.InstanceStatePending); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	request.Log().WithFields(log.Fields{
+		"station":  station.ID,
+		"snapshot": snapshot.Name,
+		"actor":    request.AccessToken.GetName(),
+	}).Info("Station restored from snapshot")
+	return rest.Result{Code: 303, Location: fmt.Sprintf("%v/station/%v/", config.Config.SitePrefix, station.ID)}
+}
+
+// load loads the snapshot from the "id" path arg and its station, if the token may see it.
+func (snapshot *StationSnapshot) load(request *rest.Request) (*Station, rest.Result) {
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return nil, rest.Result{Code: 400, Message: "missing ID"}
+	}
+	dbResult := db.Select(snapshot, "station_snapshots", "id", "=", id)
+	if dbResult.IsFailed() {
+		return nil, rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		return nil, rest.Result{Code: 404, Message: "not found"}
+	}
+	var station Station
+	if result := loadSnapshotStation(request.AccessToken, snapshot.StationID.String(), &station); !result.IsOk() {
+		return nil, result
+	}
+	if !isStaff(request.AccessToken) && snapshot.TimeslotID != station.TimeslotID {
+		return nil, rest.UnauthorizedResult(request.AccessToken)
+	}
+	return &station, rest.Result{}
+}
+
+// loadSnapshotStation loads the station, if the token is a participant of it or an operator/admin.
+func loadSnapshotStation(token rest.AccessTokenEntry, stationID string, station *Station) rest.Result {
+	dbResult := db.Select(station, "stations", "id", "=", stationID)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		if isStaff(token) {
+			return rest.Result{Code: 404, Message: "station not found"}
+		}
+		return rest.UnauthorizedResult(token)
+	}
+	return station.checkParticipantPerms(token)
+}
+
+// stationSnapshotter gets the provisioner of the non-terminated station, if it supports snapshots.
+func stationSnapshotter(station *Station) (provision.Snapshotter, rest.Result) {
+	if station.Status == StationStatusTerminated {
+		return nil, rest.Result{Code: 400, Message: "station is terminated"}
+	}
+	provisioner, provisionerErr := provision.Get(station.TrackID)
+	if provisionerErr == provision.ErrNotConfigured {
+		return nil, rest.Result{Code: 400, Message: "track is not configured for dynamic stations"}
+	}
+	if provisionerErr != nil {
+		return nil, rest.Result{Code: 500, Error: provisionerErr}
+	}
+	snapshotter, snapshotterOk := provisioner.(provision.Snapshotter)
+	if !snapshotterOk {
+		return nil, rest.Result{Code: 400, Message: "provisioning driver does not support snapshots"}
+	}
+	return snapshotter, rest.Result{}
+}
+
+// deleteSnapshots deletes the snapshots of the station, e.g. before resetting it.
+// Snapshots already gone with the instance are only forgotten, so failing to delete them from the provisioner is only logged.
+func (station *Station) deleteSnapshots(provisioner provision.Provisioner) error {
+	var snapshots StationSnapshots
+	if dbResult := db.SelectMany(&snapshots, "station_snapshots", "station", "=", station.ID); dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	if snapshotter, ok := provisioner.(provision.Snapshotter); ok {
+		for _, snapshot := range snapshots {
+			if err := snapshotter.DeleteSnapshot(station.instanceID(), snapshot.Name); err != nil {
+				log.WithError(err).WithFields(log.Fields{
+					"station":  station.ID,
+					"snapshot": snapshot.Name,
+				}).Warn("Failed to delete station snapshot")
+			}
+		}
+	}
+	if dbResult := db.Delete("station_snapshots", "station", "=", station.ID); dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/event"
+	"github.com/gathering/tech-online-backend/helper"
+	"github.com/gathering/tech-online-backend/jobs"
+	"github.com/gathering/tech-online-backend/provision"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	maxSSHKeysPerUser       = 10
+	sshKeyInjectionAttempts = 10
+	sshKeyInjectionInterval = 30 * time.Second
+)
+
+// EventTypeStationSSHKeysInjected is the event for when the participants' SSH keys got added to their station.
+const EventTypeStationSSHKeysInjected event.Type = "station.ssh_keys_injected"
+
+// SSHKey is an SSH public key for a user, which gets added to dynamic stations assigned to the user (if supported).
+type SSHKey struct {
+	ID          *uuid.UUID `column:"id" json:"id"`                   // Generated, required, unique
+	UserID      *uuid.UUID `column:"user" json:"user"`               // Defaults to the current user, only admins may set others
+	Name        string     `column:"name" json:"name"`               // Defaults to the key comment
+	Key         string     `column:"key" json:"key"`                 // Required, authorized_keys format without options
+	Fingerprint string     `column:"fingerprint" json:"fingerprint"` // Generated, SHA256
+	Timestamp   *time.Time `column:"timestamp" json:"timestamp"`     // Generated
+}
+
+// SSHKeys is a list of SSH keys.
+type SSHKeys []*SSHKey
+
+func init() {
+	rest.AddHandler("/ssh-keys/", "^$", func() interface{} { return &SSHKeys{} })
+	rest.AddHandler("/ssh-key/", "^(?:(?P<id>[^/]+)/)?$", func() interface{} { return &SSHKey{} })
+}
+
+// Get gets the SSH keys of the current user.
+// Operators/admins may get them for other users using the "user" query arg.
+func (keys *SSHKeys) Get(request *rest.Request) rest.Result {
+	// Check params and perms
+	var whereArgs []interface{}
+	if userID, ok := request.QueryArgs["user"]; ok && (request.AccessToken.GetRole() == rest.RoleOperator || request.AccessToken.GetRole() == rest.RoleAdmin) {
+		whereArgs = append(whereArgs, "user", "=", userID)
+	} else if request.AccessToken.OwnerUserID != nil {
+		whereArgs = append(whereArgs, "user", "=", request.AccessToken.OwnerUserID)
+	} else {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Get
+	dbResult := db.SelectMany(keys, "ssh_keys", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	sort.SliceStable(*keys, func(i, j int) bool {
+		return (*keys)[i].Timestamp.Before(*(*keys)[j].Timestamp)
+	})
+	return rest.Result{}
+}
+
+// Get gets a single SSH key.
+func (key *SSHKey) Get(request *rest.Request) rest.Result {
+	return key.loadForRequest(request)
+}
+
+// Post adds an SSH key.
+func (key *SSHKey) Post(request *rest.Request) rest.Result {
+	// Check perms, only admins may add keys for others
+	if key.UserID == nil || request.AccessToken.GetRole() != rest.RoleAdmin {
+		if request.AccessToken.OwnerUserID == nil {
+			return rest.UnauthorizedResult(request.AccessToken)
+		}
+		key.UserID = request.AccessToken.OwnerUserID
+	}
+
+	// Overwrite stuff
+	newID := uuid.New()
+	key.ID = &newID
+	now := time.Now()
+	key.Timestamp = &now
+
+	// Validate and normalize
+	publicKey, err := helper.ParseSSHPublicKey(key.Key)
+	if err != nil {
+		return rest.Result{Code: 400, Message: fmt.Sprintf("invalid SSH public key: %v", err)}
+	}
+	key.Key = publicKey.String()
+	key.Fingerprint = publicKey.Fingerprint()
+	if key.Name == "" {
+		key.Name = publicKey.Comment
+	}
+	count, err := countUserSSHKeys(*key.UserID)
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	if count >= maxSSHKeysPerUser {
+		return rest.Result{Code: 400, Message: fmt.Sprintf("too many SSH keys, max %v per user", maxSSHKeysPerUser)}
+	}
+	if exists, err := key.existsForUser(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	} else if exists {
+		return rest.Result{Code: 409, Message: "duplicate"}
+	}
+
+	// Create and redirect
+	dbResult := db.Insert("ssh_keys", key)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	return rest.Result{Code: 201, Location: fmt.Sprintf("%v/ssh-key/%v/", config.Config.SitePrefix, key.ID)}
+}
+
+// Delete deletes an SSH key. Stations which already got it keep it.
+func (key *SSHKey) Delete(request *rest.Request) rest.Result {
+	if result := key.loadForRequest(request); !result.IsOk() {
+		return result
+	}
+	dbResult := db.Delete("ssh_keys", "id", "=", key.ID)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	return rest.Result{}
+}
+
+// loadForRequest loads the key from the path ID, if owned by the current user or if operator/admin.
+func (key *SSHKey) loadForRequest(request *rest.Request) rest.Result {
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+
+	// Get
+	dbResult := db.Select(key, "ssh_keys", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		if request.AccessToken.OwnerUserID == nil || *request.AccessToken.OwnerUserID != *key.UserID {
+			return rest.UnauthorizedResult(request.AccessToken)
+		}
+	}
+	return rest.Result{}
+}
+
+func (key *SSHKey) existsForUser() (bool, error) {
+	var count int
+	row := db.DB.QueryRow("SELECT COUNT(*) FROM ssh_keys WHERE \"user\" = $1 AND fingerprint = $2", key.UserID, key.Fingerprint)
+	rowErr := row.Scan(&count)
+	if rowErr != nil {
+		return false, rowErr
+	}
+	return count > 0, nil
+}
+
+func countUserSSHKeys(userID uuid.UUID) (int, error) {
+	var count int
+	row := db.DB.QueryRow("SELECT COUNT(*) FROM ssh_keys WHERE \"user\" = $1", userID)
+	rowErr := row.Scan(&count)
+	return count, rowErr
+}
+
+// queueSSHKeyInjection adds the SSH keys of the timeslot participants to the station instance in the background, if the provisioner supports it.
+// It retries for a while since freshly provisioned instances take time to boot, and gives up if the station gets unassigned.
+func (station *Station) queueSSHKeyInjection(timeslot Timeslot) {
+	provisioner, err := provision.Get(station.TrackID)
+	if err == provision.ErrNotConfigured {
+		return
+	}
+	logger := log.WithFields(log.Fields{
+		"station":  station.ID,
+		"timeslot": timeslot.ID,
+	})
+	if err != nil {
+		logger.WithError(err).Warn("Failed to get provisioner for SSH key injection")
+		return
+	}
+	injector, ok := provisioner.(provision.KeyInjector)
+	if !ok {
+		return
+	}
+
+	participantIDs, err := timeslot.participantIDs()
+	if err != nil {
+		logger.WithError(err).Warn("Failed to get participants for SSH key injection")
+		return
+	}
+	var keys SSHKeys
+	for _, userID := range participantIDs {
+		var userKeys SSHKeys
+		if dbResult := db.SelectMany(&userKeys, "ssh_keys", "user", "=", userID); dbResult.IsFailed() {
+			logger.WithError(dbResult.Error).Warn("Failed to get SSH keys for injection")
+			return
+		}
+		keys = append(keys, userKeys...)
+	}
+	if len(keys) == 0 {
+		return
+	}
+	var lines []string
+	for _, key := range keys {
+		lines = append(lines, key.Key)
+	}
+
+	jobs.Submit(jobs.Job{
+		Name:       "ssh-key-injection",
+		Fields:     log.Fields{"station": station.ID, "timeslot": timeslot.ID},
+		Attempts:   sshKeyInjectionAttempts,
+		RetryDelay: sshKeyInjectionInterval,
+		Run: func() error {
+			// Stop if reassigned meanwhile
+			var currentStation Station
+			dbResult := db.Select(&currentStation, "stations", "id", "=", station.ID)
+			if dbResult.IsFailed() {
+				return dbResult.Error
+			}
+			if !dbResult.IsSuccess() || currentStation.TimeslotID != timeslot.ID.String() {
+				return nil
+			}
+
+			if err := injector.InjectSSHKeys(station.instanceID(), lines); err != nil {
+				return err
+			}
+			logger.WithField("keys", len(lines)).Info("Injected participant SSH keys into station")
+			timeslot.publishEvent(EventTypeStationSSHKeysInjected, "Your SSH keys were added",
+				fmt.Sprintf("Your SSH keys (%v) were added to station %v (%v), so you can log in with them.", len(lines), station.Name, station.Shortname), station.ID)
+			return nil
+		},
+	})
+}
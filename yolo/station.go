@@ -21,16 +21,18 @@ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
 package yolo
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"net/http"
-	"strconv"
+	"sync"
+	"time"
 
+	"github.com/gathering/tech-online-backend/bmc"
 	"github.com/gathering/tech-online-backend/config"
 	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/event"
+	"github.com/gathering/tech-online-backend/jobs"
+	"github.com/gathering/tech-online-backend/provision"
 	"github.com/gathering/tech-online-backend/rest"
+	"github.com/gathering/tech-online-backend/scheduler"
 	"github.com/google/uuid"
 
 	log "github.com/sirupsen/logrus"
@@ -57,21 +59,67 @@ const (
 	StationStatusMaintenance StationStatus = "maintenance"
 )
 
+const instanceRefreshInterval = 30 * time.Second
+
+// EventTypeStationProvisionFailed is the event for failed provisioning actions and instances entering the error state, sent to operators/admins.
+const EventTypeStationProvisionFailed event.Type = "station.provision_failed"
+
+// stationProvisionLock serializes counting and creating dynamic stations.
+var stationProvisionLock sync.Mutex
+
+// stationDestroyQueuedMessage is the instance message of terminated stations until their destroy job is done
+const stationDestroyQueuedMessage = "waiting for destroy"
+
+// Stations with destroy jobs in the worker pool, so the instance refresh only requeues lost ones (e.g. after restarts)
+var queuedStationDestroys = make(map[string]bool)
+var queuedStationDestroysLock sync.Mutex
+
 // DefaultDefaultStationStatus is the default value for the default state of station.
 // The default state of a station decides which state it gets e.g. after getting reprovisioned.
 const DefaultDefaultStationStatus = StationStatusAvailable
 
 // Station is station.
 type Station struct {
-	ID            *uuid.UUID    `column:"id" json:"id"`               // Generated, required, unique
-	TrackID       string        `column:"track" json:"track"`         // Required
-	Shortname     string        `column:"shortname" json:"shortname"` // Required
-	Name          string        `column:"name" json:"name"`
-	DefaultStatus StationStatus `column:"default_status" json:"default_status"` // Required
-	Status        StationStatus `column:"status" json:"status"`                 // Required
-	Credentials   string        `column:"credentials" json:"credentials"`       // Host, port, password, etc. (typically hidden)
-	Notes         string        `column:"notes" json:"notes"`                   // Misc. notes
-	TimeslotID    string        `column:"timeslot" json:"timeslot"`             // Timeslot currently assigned to this station, if any
+	ID                *uuid.UUID              `column:"id" json:"id" brief:"true"`               // Generated, required, unique
+	TrackID           string                  `column:"track" json:"track" brief:"true"`         // Required
+	Shortname         string                  `column:"shortname" json:"shortname" brief:"true"` // Required
+	Name              string                  `column:"name" json:"name" brief:"true"`
+	DefaultStatus     StationStatus           `column:"default_status" json:"default_status"`         // Required
+	Status            StationStatus           `column:"status" json:"status" brief:"true"`            // Required
+	Credentials       string                  `column:"credentials" json:"credentials"`               // Host, port, password, etc. (typically hidden)
+	Notes             string                  `column:"notes" json:"notes"`                           // Misc. notes
+	TimeslotID        string                  `column:"timeslot" json:"timeslot"`                     // Timeslot currently assigned to this station, if any
+	Address           string                  `column:"address" json:"address"`                       // Host/IP address used for health checks
+	Health            StationHealth           `column:"health" json:"health" brief:"true"`            // Set by the health checker
+	LastHealthCheck   *time.Time              `column:"last_health_check" json:"last_health_check"`   // Set by the health checker
+	InstanceID        string                  `column:"instance_id" json:"instance_id"`               // Provisioner instance backing a dynamic station
+	InstanceState     provision.InstanceState `column:"instance_state" json:"instance_state"`         // Last known provisioner instance state
+	InstanceMessage   string                  `column:"instance_message" json:"instance_message"`     // Details about the instance state, e.g. errors
+	ConsoleAddress    string                  `column:"console_address" json:"console_address"`       // TCP address of the console (e.g. VNC or serial), if not provided by the provisioner
+	Maintenance       bool                    `column:"maintenance" json:"maintenance"`               // Manually put under maintenance
+	MaintenanceBegin  *time.Time              `column:"maintenance_begin" json:"maintenance_begin"`   // Scheduled maintenance window, open-ended if either is missing
+	MaintenanceEnd    *time.Time              `column:"maintenance_end" json:"maintenance_end"`       // See above
+	MaintenanceNotice string                  `column:"maintenance_notice" json:"maintenance_notice"` // Shown to participants while under maintenance
+	UnderMaintenance  bool                    `column:"-" json:"under_maintenance" brief:"true"`      // Computed from the flag and window
+	GondulSwitch      string                  `column:"gondul_switch" json:"gondul_switch"`           // Name of the switch in Gondul, defaults to the shortname
+	SwitchDistro      string                  `column:"switch_distro" json:"switch_distro"`           // Synced from Gondul, the upstream distribution switch
+	SwitchPort        string                  `column:"switch_port" json:"switch_port"`               // Synced from Gondul, the port on the distribution switch
+	ManagementIPv4    string                  `column:"management_ipv4" json:"management_ipv4"`       // Synced from Gondul
+	ManagementIPv6    string                  `column:"management_ipv6" json:"management_ipv6"`       // Synced from Gondul
+	NetworkSyncTime   *time.Time              `column:"network_sync_time" json:"network_sync_time"`   // Last time the network data was synced
+	TeardownHold      *time.Time              `column:"teardown_hold" json:"teardown_hold"`           // Set by operators to postpone automatic teardown until then
+	BMCDriver         bmc.Driver              `column:"bmc_driver" json:"bmc_driver"`                 // "ipmi" or "redfish" for physical stations with power control through a BMC
+	BMCAddress        string                  `column:"bmc_address" json:"bmc_address"`               // Host (IPMI) or URL (Redfish) of the BMC (hidden)
+	BMCCredentials    string                  `column:"bmc_credentials" json:"bmc_credentials"`       // Name of the BMC credentials in the config (hidden)
+	VLANID            *int                    `column:"vlan_id" json:"vlan_id"`                       // Allocated from the IPAM pool of the track, if any
+	IPv4Prefix        string                  `column:"ipv4_prefix" json:"ipv4_prefix"`               // See above
+	IPv6Prefix        string                  `column:"ipv6_prefix" json:"ipv6_prefix"`               // See above
+	DNSName           string                  `column:"dns_name" json:"dns_name"`                     // Hostname pointing at the station while assigned, managed by the backend
+	DNSTarget         string                  `column:"dns_target" json:"dns_target"`                 // Address the hostname points at
+	SeatHall          string                  `column:"seat_hall" json:"seat_hall"`                   // Physical location of net-track stations, from the seating system
+	SeatRow           string                  `column:"seat_row" json:"seat_row"`                     // See above
+	Seat              string                  `column:"seat" json:"seat"`                             // See above
+	TerminatedTime    *time.Time              `column:"terminated_time" json:"terminated_time"`       // Generated, when the station was terminated, for retention
 }
 
 // Stations is a list of stations.
@@ -85,30 +133,36 @@ type StationProvisionRequest struct {
 type StationTerminateRequest struct {
 }
 
-type serverCreateStationRequest struct {
-	Username string `json:"username"`
-	UID      string `json:"uid"`
-	TaskType string `json:"task_type"`
-}
+// StationResetRequest is a request to reset the instance of a dynamic station to a clean state, if the driver supports it.
+type StationResetRequest struct{}
 
-type serverCreateStationResponse struct {
-	ID              int    `json:"id"`
-	FQDN            string `json:"fqdn"`
-	Zone            string `json:"zone"`
-	Username        string `json:"orc_vm_username"`
-	Password        string `json:"orc_vm_password"`
-	IPv4Address     string `json:"public_ipv4"`
-	IPv6Address     string `json:"public_ipv6"`
-	SSHPort         int    `json:"ssh_port"`
-	VLANID          int    `json:"vlan_id"`
-	VLANIPv4Address string `json:"vlan_ip"`
-}
+// StationPowerRequest is a request to control the power of the instance of a dynamic station, if the driver supports it.
+type StationPowerRequest struct{}
 
 func init() {
 	rest.AddHandler("/stations/", "^$", func() interface{} { return &Stations{} })
 	rest.AddHandler("/station/", "^(?:(?P<id>[^/]+)/)?$", func() interface{} { return &Station{} })
+	rest.SetCachePolicy(&Stations{}, rest.CachePolicy{NoStore: true})
+	rest.SetCachePolicy(&Station{}, rest.CachePolicy{NoStore: true})
 	rest.AddHandler("/track/", "^(?P<track_id>[^/]+)/provision-station/$", func() interface{} { return &StationProvisionRequest{} })
 	rest.AddHandler("/station/", "^(?P<id>[^/]+)/terminate/$", func() interface{} { return &StationTerminateRequest{} })
+	rest.AddHandler("/station/", "^(?P<id>[^/]+)/reset/$", func() interface{} { return &StationResetRequest{} })
+	rest.AddHandler("/station/", "^(?P<id>[^/]+)/power/$", func() interface{} { return &StationPowerRequest{} })
+	scheduler.AddJob("refresh-station-instances", instanceRefreshInterval, refreshAllStationInstances)
+}
+
+// QueryFilterFields gets the fields which may be filtered with query operators.
+func (stations *Stations) QueryFilterFields() rest.QueryFilterFields {
+	return rest.QueryFilterFields{
+		"track":             rest.QueryFilterString,
+		"shortname":         rest.QueryFilterString,
+		"name":              rest.QueryFilterString,
+		"status":            rest.QueryFilterString,
+		"health":            rest.QueryFilterString,
+		"last_health_check": rest.QueryFilterTime,
+		"maintenance":       rest.QueryFilterBool,
+		"terminated_time":   rest.QueryFilterTime,
+	}
 }
 
 // Get gets multiple stations.
@@ -123,12 +177,16 @@ func (stations *Stations) Get(request *rest.Request) rest.Result {
 	if status, ok := request.QueryArgs["status"]; ok {
 		whereArgs = append(whereArgs, "status", "=", status)
 	}
+	if health, ok := request.QueryArgs["health"]; ok {
+		whereArgs = append(whereArgs, "health", "=", health)
+	}
 	if defaultStatus, ok := request.QueryArgs["default-status"]; ok {
 		whereArgs = append(whereArgs, "default_status", "=", defaultStatus)
 	}
 	if timeslotID, ok := request.QueryArgs["timeslot"]; ok {
 		whereArgs = append(whereArgs, "timeslot", "=", timeslotID)
 	}
+	whereArgs = append(whereArgs, request.Filters...)
 
 	// Fetch stations to TMP list
 	tmpStations := make(Stations, 0)
@@ -137,31 +195,22 @@ func (stations *Stations) Get(request *rest.Request) rest.Result {
 		return rest.Result{Code: 500, Error: dbResult.Error}
 	}
 
+	now := time.Now()
+	for _, station := range tmpStations {
+		station.UnderMaintenance = station.isUnderMaintenance(now)
+	}
+
 	// Allow all info if operator/admin
-	if request.AccessToken.GetRole() == rest.RoleOperator && request.AccessToken.GetRole() == rest.RoleAdmin {
+	if request.AccessToken.GetRole() == rest.RoleOperator || request.AccessToken.GetRole() == rest.RoleAdmin {
 		*stations = tmpStations
 		return rest.Result{}
 	}
 
-	// Hide credentials and timeslot if not assigned to self through timeslot
+	// Hide credentials if not assigned to self through timeslot
 	for _, station := range tmpStations {
-		credentials := station.Credentials
-		station.Credentials = ""
-		requestUserID := request.AccessToken.OwnerUserID
-		if requestUserID != nil && station.TimeslotID != "" {
-			var timeslot Timeslot
-			timeslotDBResult := db.Select(&timeslot, "timeslots",
-				"id", "=", station.TimeslotID,
-				"user", "=", requestUserID,
-			)
-			if timeslotDBResult.IsFailed() {
-				return rest.Result{Code: 500, Error: timeslotDBResult.Error}
-			}
-			if timeslotDBResult.IsSuccess() {
-				station.Credentials = credentials
-			}
+		if result := station.hideCredentialsUnlessParticipant(request.AccessToken); !result.IsOk() {
+			return result
 		}
-
 		*stations = append(*stations, station)
 	}
 	return rest.Result{}
@@ -185,30 +234,16 @@ func (station *Station) Get(request *rest.Request) rest.Result {
 		return rest.Result{Code: 404, Message: "not found"}
 	}
 
+	tmpStation.UnderMaintenance = tmpStation.isUnderMaintenance(time.Now())
+
 	// Allow all info if operator/admin
-	if request.AccessToken.GetRole() == rest.RoleOperator && request.AccessToken.GetRole() == rest.RoleAdmin {
-		*station = tmpStation
+	*station = tmpStation
+	if request.AccessToken.GetRole() == rest.RoleOperator || request.AccessToken.GetRole() == rest.RoleAdmin {
 		return rest.Result{}
 	}
 
-	// Hide credentials if not the active user
-	credentials := station.Credentials
-	station.Credentials = ""
-	requestUserID := request.AccessToken.OwnerUserID
-	if requestUserID != nil && station.TimeslotID != "" {
-		var timeslot Timeslot
-		timeslotDBResult := db.Select(&timeslot, "timeslots",
-			"id", "=", station.TimeslotID,
-			"user", "=", requestUserID,
-		)
-		if timeslotDBResult.IsFailed() {
-			return rest.Result{Code: 500, Error: timeslotDBResult.Error}
-		}
-		if timeslotDBResult.IsSuccess() {
-			station.Credentials = credentials
-		}
-	}
-	return rest.Result{}
+	// Hide credentials if not the active user or team
+	return station.hideCredentialsUnlessParticipant(request.AccessToken)
 }
 
 // Post creates a new station.
@@ -224,6 +259,13 @@ func (station *Station) Post(request *rest.Request) rest.Result {
 		station.ID = &newID
 	}
 
+	// Allocate VLAN and prefixes not set manually
+	stationNetworkLock.Lock()
+	defer stationNetworkLock.Unlock()
+	if err := station.allocateNetwork(); err != nil {
+		return station.networkAllocationFailedResult(err)
+	}
+
 	// Validate
 	if result := station.validate(); !result.IsOk() {
 		return result
@@ -263,9 +305,33 @@ func (station *Station) Put(request *rest.Request) rest.Result {
 	if result := station.validate(); !result.IsOk() {
 		return result
 	}
+	previousStatus, result := station.checkStatusTransition()
+	if !result.IsOk() {
+		return result
+	}
+	station.updateTerminatedTime(previousStatus)
 
 	// Create or update
-	return station.createOrUpdate()
+	if result := station.createOrUpdate(); !result.IsOk() {
+		return result
+	}
+	station.publishStatusTransition(previousStatus)
+	return rest.Result{Warnings: station.warnings()}
+}
+
+// warnings gets notes for the client about the saved station, for things preventing assignment.
+func (station *Station) warnings() []string {
+	if station.TimeslotID != "" || (station.Status != StationStatusReady && station.Status != StationStatusAvailable) {
+		return nil
+	}
+	var warnings []string
+	if station.Health == StationHealthUnhealthy {
+		warnings = append(warnings, "the station is unhealthy and won't be assigned")
+	}
+	if station.isUnderMaintenance(time.Now()) {
+		warnings = append(warnings, "the station is under maintenance and won't be assigned")
+	}
+	return warnings
 }
 
 // Delete deletes a station.
@@ -363,6 +429,22 @@ func (station *Station) validate() rest.Result {
 		return rest.Result{Code: 400, Message: "missing track ID"}
 	case !station.validateStatus():
 		return rest.Result{Code: 400, Message: "missing or invalid default status or status"}
+	case station.MaintenanceBegin != nil && station.MaintenanceEnd != nil && !station.MaintenanceEnd.After(*station.MaintenanceBegin):
+		return rest.Result{Code: 400, Message: "maintenance end must be after maintenance begin"}
+	}
+	if result := station.validateBMC(); !result.IsOk() {
+		return result
+	}
+	if result := station.validateNetwork(); !result.IsOk() {
+		return result
+	}
+	if result := station.validateSeat(); !result.IsOk() {
+		return result
+	}
+	if station.Health == "" {
+		station.Health = StationHealthUnknown
+	} else if !validateStationHealth(station.Health) {
+		return rest.Result{Code: 400, Message: "invalid health"}
 	}
 
 	if exists, err := station.anotherExistsWithTrackShortname(); err != nil {
@@ -402,27 +484,70 @@ func (station *Station) validate() rest.Result {
 	return rest.Result{}
 }
 
+// hideCredentialsUnlessParticipant clears the credentials unless the token's user is a participant of the assigned timeslot
+// and the credential policy of the track type allows it.
+// The console address is always cleared, participants use the console proxy instead.
+func (station *Station) hideCredentialsUnlessParticipant(token rest.AccessTokenEntry) rest.Result {
+	credentials := station.Credentials
+	station.Credentials = ""
+	station.ConsoleAddress = ""
+	station.BMCAddress = ""
+	station.BMCCredentials = ""
+	if token.OwnerUserID == nil || station.TimeslotID == "" {
+		return rest.Result{}
+	}
+
+	var track Track
+	trackDBResult := db.Select(&track, "tracks", "id", "=", station.TrackID)
+	if trackDBResult.IsFailed() {
+		return rest.Result{Code: 500, Error: trackDBResult.Error}
+	}
+	if !trackDBResult.IsSuccess() || track.behavior().CredentialPolicy != CredentialPolicyParticipants {
+		return rest.Result{}
+	}
+
+	var timeslot Timeslot
+	timeslotDBResult := db.Select(&timeslot, "timeslots", "id", "=", station.TimeslotID)
+	if timeslotDBResult.IsFailed() {
+		return rest.Result{Code: 500, Error: timeslotDBResult.Error}
+	}
+	if !timeslotDBResult.IsSuccess() {
+		return rest.Result{}
+	}
+	if isParticipant, err := timeslot.isParticipant(token.OwnerUserID); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	} else if isParticipant {
+		station.Credentials = credentials
+	}
+	return rest.Result{}
+}
+
+// checkParticipantPerms returns an error result unless the token is an operator/admin or a participant of the timeslot assigned to the station.
+func (station *Station) checkParticipantPerms(token rest.AccessTokenEntry) rest.Result {
+	if token.GetRole() == rest.RoleOperator || token.GetRole() == rest.RoleAdmin {
+		return rest.Result{}
+	}
+	if station.TimeslotID == "" {
+		return rest.UnauthorizedResult(token)
+	}
+	var timeslot Timeslot
+	dbResult := db.Select(&timeslot, "timeslots", "id", "=", station.TimeslotID)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		return rest.UnauthorizedResult(token)
+	}
+	return timeslot.checkParticipantPerms(token)
+}
+
 func (station *Station) validateStatus() bool {
 	return validateStationStatus(station.DefaultStatus) && validateStationStatus(station.Status)
 }
 
 func validateStationStatus(status StationStatus) bool {
-	switch status {
-	case StationStatusAvailable:
-		fallthrough
-	case StationStatusReady:
-		fallthrough
-	case StationStatusDirty:
-		fallthrough
-	case StationStatusTerminated:
-		fallthrough
-	case StationStatusProvisioning:
-		fallthrough
-	case StationStatusMaintenance:
-		return true
-	default:
-		return false
-	}
+	_, ok := stationStatusTransitions[status]
+	return ok
 }
 
 func (station *Station) anotherExistsWithTrackShortname() (bool, error) {
@@ -447,6 +572,11 @@ func (station *Station) anotherExistsWithTimeslot() (bool, error) {
 
 // Post attempts to manually create a new station, if the track supports it.
 func (createRequest *StationProvisionRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
 	trackID, trackIDExists := request.PathArgs["track_id"]
 	if !trackIDExists || trackID == "" {
 		return rest.Result{Code: 400, Message: "missing track ID"}
@@ -472,16 +602,24 @@ func (station *Station) Provision(trackID string) rest.Result {
 	}
 
 	// Check if track type supports it and if the config is present
-	if track.Type != trackTypeServer {
+	behavior := track.behavior()
+	if !behavior.hasDynamicStations() {
 		return rest.Result{Code: 400, Message: "track type does not support dynamic stations"}
 	}
-	trackConfig, trackConfigOk := config.Config.ServerTracks[trackID]
-	if !trackConfigOk || trackConfig.BaseURL == "" {
+	provisioner, provisionerErr := behavior.Provisioner(trackID)
+	if provisionerErr == provision.ErrNotConfigured {
 		return rest.Result{Code: 400, Message: "track is not configured for dynamic stations"}
 	}
+	if provisionerErr != nil {
+		return rest.Result{Code: 500, Error: provisionerErr}
+	}
+	_, maxStations, _ := behavior.instanceLimits(trackID)
+
+	// Don't let concurrent provisioning exceed the limit
+	stationProvisionLock.Lock()
+	defer stationProvisionLock.Unlock()
 
 	// Check limit, excluding terminated ones
-	maxStations := trackConfig.MaxInstancesHard
 	if maxStations > 0 {
 		currentRow := db.DB.QueryRow("SELECT COUNT(*) FROM stations WHERE track = $1 AND status != $2", track.ID, StationStatusTerminated)
 		var count int
@@ -494,55 +632,36 @@ func (station *Station) Provision(trackID string) rest.Result {
 		}
 	}
 
-	// Call station service
-	serviceURL := trackConfig.BaseURL + "/api/entry/new"
-	serviceRequestData := serverCreateStationRequest{
-		Username: "tech",
-		UID:      "techo",
-		TaskType: trackConfig.TaskType,
-	}
-	requestJSON, requestJSONError := json.Marshal(serviceRequestData)
-	if requestJSONError != nil {
-		return rest.Result{Code: 500, Error: requestJSONError}
-	}
-	serviceRequest, serviceRequestErr := http.NewRequest("POST", serviceURL, bytes.NewBuffer(requestJSON))
-	if serviceRequestErr != nil {
-		return rest.Result{Code: 500, Error: serviceRequestErr}
-	}
-	serviceRequest.SetBasicAuth(trackConfig.AuthUsername, trackConfig.AuthPassword)
-	serviceRequest.Header.Set("Content-Type", "application/json")
-	serviceClient := &http.Client{}
-	serviceResponse, serviceResponseErr := serviceClient.Do(serviceRequest)
-	if serviceResponseErr != nil {
-		return rest.Result{Code: 500, Error: serviceResponseErr}
-	}
-	defer serviceResponse.Body.Close()
-	if serviceResponse.StatusCode < 200 || serviceResponse.StatusCode > 299 {
-		return rest.Result{Code: 500, Error: fmt.Errorf("response contained non-2XX status: %v", serviceResponse.Status)}
+	// Allocate network, passed to the driver if supported
+	newID := uuid.New()
+	station.ID = &newID
+	station.TrackID = trackID
+	stationNetworkLock.Lock()
+	defer stationNetworkLock.Unlock()
+	if err := station.allocateNetwork(); err != nil {
+		return station.networkAllocationFailedResult(err)
 	}
-	serviceResponseBody, serviceResponseBodyErr := ioutil.ReadAll(serviceResponse.Body)
-	if serviceResponseBodyErr != nil {
-		return rest.Result{Code: 500, Error: serviceResponseBodyErr}
+
+	// Create instance
+	var instance *provision.Instance
+	var instanceErr error
+	if networkCreator, ok := provisioner.(provision.NetworkCreator); ok && station.hasNetwork() {
+		instance, instanceErr = networkCreator.CreateOnNetwork(station.network())
+	} else {
+		instance, instanceErr = provisioner.Create()
 	}
-	var responseData serverCreateStationResponse
-	if err := json.Unmarshal(serviceResponseBody, &responseData); err != nil {
-		return rest.Result{Code: 500, Error: err}
+	if instanceErr != nil {
+		publishStaffEvent(EventTypeStationProvisionFailed, trackID, "Station provisioning failed",
+			fmt.Sprintf("Failed to create a station for track %v: %v", trackID, instanceErr), nil)
+		return rest.Result{Code: 500, Error: instanceErr}
 	}
-	log.Tracef("VM service created new instance: %v", responseData.ID)
 
 	// Create station
-	newID := uuid.New()
-	station.ID = &newID
-	station.TrackID = trackID
-	station.Shortname = strconv.Itoa(responseData.ID)
-	station.Name = fmt.Sprintf("Station #%v", responseData.ID)
+	station.Shortname = instance.ID
+	station.Name = fmt.Sprintf("Station #%v", instance.ID)
 	station.Status = StationStatusMaintenance
-	// Markdown
-	station.Credentials = fmt.Sprintf("**Username**: %v\n\n**Password**: %v\n\n**Public address (IPv4)**: %v\n\n**Public address (IPv6)**: %v\n\n**SSH port**: %v",
-		responseData.Username, responseData.Password, responseData.IPv4Address, responseData.IPv6Address, responseData.SSHPort)
-	// Markdown
-	station.Notes = fmt.Sprintf("**FQDN**: %v\n\n**Zone**: %v\n\n**VLAN ID**: %v\n\n**VLAN Address (IPv4)**: %v\n\nNote that the station may take a few minutes to start before you can connect.",
-		responseData.FQDN, responseData.Zone, responseData.VLANID, responseData.VLANIPv4Address)
+	station.InstanceID = instance.ID
+	station.applyInstance(instance)
 	if result := station.validate(); !result.IsOk() {
 		return result
 	}
@@ -559,6 +678,11 @@ func (station *Station) Provision(trackID string) rest.Result {
 
 // Post attempts to manually destroy a station, if the track supports it.
 func (destroyRequest *StationTerminateRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
 	id, idExists := request.PathArgs["id"]
 	if !idExists || id == "" {
 		return rest.Result{Code: 400, Message: "missing ID"}
@@ -596,39 +720,362 @@ func (station *Station) Terminate() rest.Result {
 	}
 
 	// Check if track type supports it and if the config is present
-	if track.Type != trackTypeServer {
+	behavior := track.behavior()
+	if !behavior.hasDynamicStations() {
 		return rest.Result{Code: 400, Message: "track type does not support dynamic stations"}
 	}
-	trackConfig, trackConfigOk := config.Config.ServerTracks[track.ID]
-	if !trackConfigOk || trackConfig.BaseURL == "" {
+	provisioner, provisionerErr := behavior.Provisioner(track.ID)
+	if provisionerErr == provision.ErrNotConfigured {
 		return rest.Result{Code: 400, Message: "track type is not configured for dynamic stations"}
 	}
-
-	// Call station service
-	serviceURL := fmt.Sprintf("%v/api/entry/%v", trackConfig.BaseURL, station.Shortname)
-	serviceRequest, serviceRequestErr := http.NewRequest("DELETE", serviceURL, nil)
-	if serviceRequestErr != nil {
-		return rest.Result{Code: 500, Error: serviceRequestErr}
-	}
-	serviceRequest.SetBasicAuth(trackConfig.AuthUsername, trackConfig.AuthPassword)
-	serviceClient := &http.Client{}
-	serviceResponse, serviceResponseErr := serviceClient.Do(serviceRequest)
-	if serviceResponseErr != nil {
-		return rest.Result{Code: 500, Error: serviceResponseErr}
+	if provisionerErr != nil {
+		return rest.Result{Code: 500, Error: provisionerErr}
 	}
-	defer serviceResponse.Body.Close()
-	if serviceResponse.StatusCode < 200 || serviceResponse.StatusCode > 299 {
-		return rest.Result{Code: 500, Error: fmt.Errorf("response contained non-2XX status: %v", serviceResponse.Status)}
-	}
-	log.Tracef("VM service destroyed instance: %v", station.ID)
 
-	// Change state to terminated and remove any assigned timeslot
+	// Change state to terminated and remove any assigned timeslot, the instance is destroyed in the background
+	previousStatus := station.Status
+	now := time.Now()
 	station.Status = StationStatusTerminated
+	station.TerminatedTime = &now
 	station.TimeslotID = ""
+	station.InstanceState = provision.InstanceStateDestroying
+	station.InstanceMessage = stationDestroyQueuedMessage
 
 	dbResult := db.Update("stations", station, "id", "=", station.ID)
 	if dbResult.IsFailed() {
 		return rest.Result{Code: 500, Error: dbResult.Error}
 	}
+	station.publishStatusTransition(previousStatus)
+	station.queueDNSSync()
+	station.queueDestroy(provisioner)
 	return rest.Result{}
 }
+
+// queueDestroy destroys the instance of the terminated station in the worker pool, then deletes its snapshots and releases its network.
+// The network stays reserved until then (or if it fails), since the instance may still be using it.
+// Does nothing if a destroy is already queued for the station.
+func (station *Station) queueDestroy(provisioner provision.Provisioner) {
+	stationID := station.ID
+	instanceID := station.instanceID()
+	queuedStationDestroysLock.Lock()
+	if queuedStationDestroys[stationID.String()] {
+		queuedStationDestroysLock.Unlock()
+		return
+	}
+	queuedStationDestroys[stationID.String()] = true
+	queuedStationDestroysLock.Unlock()
+	unqueue := func() {
+		queuedStationDestroysLock.Lock()
+		delete(queuedStationDestroys, stationID.String())
+		queuedStationDestroysLock.Unlock()
+	}
+	submitted := jobs.Submit(jobs.Job{
+		Name:   "station-destroy",
+		Fields: log.Fields{"station": stationID, "instance": instanceID},
+		Run: func() error {
+			if err := provisioner.Destroy(instanceID); err != nil {
+				return err
+			}
+
+			// Snapshots are gone with the instance
+			if dbResult := db.Delete("station_snapshots", "station", "=", stationID); dbResult.IsFailed() {
+				return dbResult.Error
+			}
+			state, message := provision.InstanceStateDestroyed, ""
+			if inspector, ok := provisioner.(provision.Inspector); ok {
+				// Some drivers destroy in the background
+				if instance, err := inspector.Inspect(instanceID); err == nil {
+					state, message = instance.State, instance.Message
+				}
+			}
+			if _, err := db.DB.Exec("UPDATE stations SET instance_state = $1, instance_message = $2, vlan_id = NULL, ipv4_prefix = '', ipv6_prefix = '' WHERE id = $3",
+				state, message, stationID); err != nil {
+				return err
+			}
+			unqueue()
+			return nil
+		},
+		GiveUp: func(err error) {
+			unqueue()
+			station.publishProvisionFailed("terminate", err)
+			if _, dbErr := db.DB.Exec("UPDATE stations SET instance_state = $1, instance_message = $2 WHERE id = $3",
+				provision.InstanceStateError, fmt.Sprintf("destroy failed: %v", err), stationID); dbErr != nil {
+				log.WithError(dbErr).WithField("station", stationID).Warn("Failed to save failed station destroy")
+			}
+		},
+	})
+	if !submitted {
+		// Not queued (e.g. when shutting down), left for the instance refresh to requeue
+		if _, err := db.DB.Exec("UPDATE stations SET instance_state = $1, instance_message = $2 WHERE id = $3",
+			provision.InstanceStateDestroying, stationDestroyQueuedMessage, stationID); err != nil {
+			log.WithError(err).WithField("station", stationID).Warn("Failed to save unqueued station destroy")
+		}
+	}
+}
+
+// Post resets the instance backing a dynamic station to a clean state, in the worker pool since it may take minutes.
+// Dirty stations get their default status afterwards, other stations keep their status and timeslot.
+func (resetRequest *StationResetRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Get station and provisioner
+	var station Station
+	provisioner, result := loadDynamicStation(request, &station)
+	if !result.IsOk() {
+		return result
+	}
+	resetter, resetterOk := provisioner.(provision.Resetter)
+	if !resetterOk {
+		return rest.Result{Code: 400, Message: "provisioning driver does not support resetting"}
+	}
+
+	// Mark as pending and reset in the background, snapshots don't survive resetting
+	if _, err := db.DB.Exec("UPDATE stations SET instance_state = $1, instance_message = '' WHERE id = $2", provision.InstanceStatePending, station.ID); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	jobs.Submit(jobs.Job{
+		Name:   "station-reset",
+		Fields: log.Fields{"station": station.ID},
+		Run: func() error {
+			if err := station.deleteSnapshots(provisioner); err != nil {
+				return err
+			}
+			if err := resetter.Reset(station.instanceID()); err != nil {
+				return err
+			}
+
+			// Release dirty stations only once clean
+			previousStatus := station.Status
+			if station.Status != StationStatusDirty {
+				return nil
+			}
+			station.Status = station.DefaultStatus
+			updateResult, err := db.DB.Exec("UPDATE stations SET status = $1 WHERE id = $2 AND status = $3", station.Status, station.ID, StationStatusDirty)
+			if err != nil {
+				return err
+			}
+			if rows, err := updateResult.RowsAffected(); err == nil && rows > 0 {
+				station.publishStatusTransition(previousStatus)
+			}
+			return nil
+		},
+		GiveUp: func(err error) {
+			station.publishProvisionFailed("reset", err)
+			if _, dbErr := db.DB.Exec("UPDATE stations SET instance_state = $1, instance_message = $2 WHERE id = $3",
+				provision.InstanceStateError, fmt.Sprintf("reset failed: %v", err), station.ID); dbErr != nil {
+				log.WithError(dbErr).WithField("station", station.ID).Warn("Failed to save failed station reset")
+			}
+		},
+	})
+	request.Log().WithFields(log.Fields{
+		"station": station.ID,
+		"actor":   request.AccessToken.GetName(),
+	}).Info("Queued station reset")
+	return rest.Result{Code: 202, Location: fmt.Sprintf("%v/station/%v/", config.Config.SitePrefix, station.ID)}
+}
+
+// Post starts, stops (hard) or reboots (hard) the instance of a dynamic station, using the "action" query arg.
+func (powerRequest *StationPowerRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Get station and provisioner
+	var station Station
+	provisioner, result := loadDynamicStation(request, &station)
+	if !result.IsOk() {
+		return result
+	}
+	powerController, powerControllerOk := provisioner.(provision.PowerController)
+	if !powerControllerOk {
+		return rest.Result{Code: 400, Message: "provisioning driver does not support power control"}
+	}
+
+	// Run action in the background
+	action := request.QueryArgs["action"]
+	var run func(instanceID string) error
+	switch action {
+	case "start":
+		run = powerController.Start
+	case "stop":
+		run = powerController.Stop
+	case "reboot":
+		run = powerController.Reboot
+	default:
+		return rest.Result{Code: 400, Message: "missing or invalid action"}
+	}
+	instanceID := station.instanceID()
+	jobs.Submit(jobs.Job{
+		Name:   "station-power",
+		Fields: log.Fields{"station": station.ID, "action": action},
+		Run: func() error {
+			return run(instanceID)
+		},
+		GiveUp: func(err error) {
+			station.publishProvisionFailed(action, err)
+		},
+	})
+	request.Log().WithFields(log.Fields{
+		"station": station.ID,
+		"action":  action,
+		"actor":   request.AccessToken.GetName(),
+	}).Info("Queued station power action")
+	return rest.Result{Code: 202, Location: fmt.Sprintf("%v/station/%v/", config.Config.SitePrefix, station.ID)}
+}
+
+// publishProvisionFailed notifies staff that a provisioning action failed for the station.
+func (station *Station) publishProvisionFailed(action string, err error) {
+	station.publishStaffEvent(EventTypeStationProvisionFailed, fmt.Sprintf("Station %v %v failed", station.Shortname, action),
+		fmt.Sprintf("Failed to %v the instance of station %v: %v", action, station.Shortname, err))
+}
+
+// loadDynamicStation loads the non-terminated station from the "id" path arg, plus the provisioner for its track.
+func loadDynamicStation(request *rest.Request, station *Station) (provision.Provisioner, rest.Result) {
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return nil, rest.Result{Code: 400, Message: "missing ID"}
+	}
+	stationDBResult := db.Select(station, "stations", "id", "=", id)
+	if stationDBResult.IsFailed() {
+		return nil, rest.Result{Code: 500, Error: stationDBResult.Error}
+	}
+	if !stationDBResult.IsSuccess() {
+		return nil, rest.Result{Code: 404, Message: "not found"}
+	}
+	if station.Status == StationStatusTerminated {
+		return nil, rest.Result{Code: 400, Message: "station is terminated"}
+	}
+
+	provisioner, provisionerErr := provision.Get(station.TrackID)
+	if provisionerErr == provision.ErrNotConfigured {
+		return nil, rest.Result{Code: 400, Message: "track is not configured for dynamic stations"}
+	}
+	if provisionerErr != nil {
+		return nil, rest.Result{Code: 500, Error: provisionerErr}
+	}
+	return provisioner, rest.Result{}
+}
+
+// instanceID gets the provisioner instance ID.
+// Stations created before instance IDs were stored used the instance ID as the shortname.
+func (station *Station) instanceID() string {
+	if station.InstanceID != "" {
+		return station.InstanceID
+	}
+	return station.Shortname
+}
+
+// applyInstance sets the instance state, address, credentials and notes from the instance.
+func (station *Station) applyInstance(instance *provision.Instance) {
+	station.InstanceState = instance.State
+	station.InstanceMessage = instance.Message
+	station.Address = instance.FQDN
+	if station.Address == "" {
+		station.Address = instance.IPv4Address
+	}
+	// Markdown
+	station.Credentials = fmt.Sprintf("**Username**: %v\n\n**Password**: %v\n\n**Public address (IPv4)**: %v\n\n**Public address (IPv6)**: %v\n\n**SSH port**: %v",
+		instance.Username, instance.Password, instance.IPv4Address, instance.IPv6Address, instance.SSHPort)
+	// Markdown
+	station.Notes = fmt.Sprintf("**FQDN**: %v\n\n**Zone**: %v\n\n**VLAN ID**: %v\n\n**VLAN Address (IPv4)**: %v\n\nNote that the station may take a few minutes to start before you can connect.",
+		instance.FQDN, instance.Zone, instance.VLANID, instance.VLANIPv4Address)
+}
+
+// refreshAllStationInstances updates the instance state (and addresses, once known) of dynamic stations,
+// for tracks with drivers able to inspect instances.
+// It also requeues destroys of terminated stations which were lost, e.g. when restarting before they were done.
+func refreshAllStationInstances() error {
+	for trackID := range config.Config.ServerTracks {
+		provisioner, err := provision.Get(trackID)
+		if err == provision.ErrNotConfigured {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := requeueTrackStationDestroys(trackID, provisioner); err != nil {
+			return err
+		}
+		inspector, inspectorOk := provisioner.(provision.Inspector)
+		if !inspectorOk {
+			continue
+		}
+		if err := refreshTrackStationInstances(trackID, inspector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// requeueTrackStationDestroys queues destroys for the terminated stations still waiting for one, unless already queued.
+func requeueTrackStationDestroys(trackID string, provisioner provision.Provisioner) error {
+	var stations Stations
+	dbResult := db.SelectMany(&stations, "stations",
+		"track", "=", trackID,
+		"status", "=", StationStatusTerminated,
+		"instance_state", "=", provision.InstanceStateDestroying,
+		"instance_message", "=", stationDestroyQueuedMessage,
+	)
+	if dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	for _, station := range stations {
+		station.queueDestroy(provisioner)
+	}
+	return nil
+}
+
+func refreshTrackStationInstances(trackID string, inspector provision.Inspector) error {
+	var stations Stations
+	dbResult := db.SelectMany(&stations, "stations", "track", "=", trackID, "instance_id", "!=", "")
+	if dbResult.IsFailed() {
+		return dbResult.Error
+	}
+
+	for _, station := range stations {
+		if station.Status == StationStatusTerminated && station.InstanceState == provision.InstanceStateDestroyed {
+			continue
+		}
+		if station.Status == StationStatusTerminated && station.InstanceState == provision.InstanceStateDestroying && station.InstanceMessage == stationDestroyQueuedMessage {
+			// The destroy job (requeued if lost) isn't done yet and keeps the network reserved by the state
+			continue
+		}
+		instance, err := inspector.Inspect(station.InstanceID)
+		if err != nil {
+			log.WithError(err).WithField("station", station.ID).Warn("Failed to inspect station instance")
+			continue
+		}
+
+		// Only update the instance fields, the rest of the station may have changed since it was loaded
+		newAddress := instance.FQDN
+		if newAddress == "" {
+			newAddress = instance.IPv4Address
+		}
+		previousState := station.InstanceState
+		if newAddress != "" && newAddress != station.Address {
+			station.applyInstance(instance)
+			_, err = db.DB.Exec("UPDATE stations SET instance_state = $1, instance_message = $2, address = $3, credentials = $4, notes = $5 WHERE id = $6",
+				station.InstanceState, station.InstanceMessage, station.Address, station.Credentials, station.Notes, station.ID)
+		} else if instance.State != station.InstanceState || instance.Message != station.InstanceMessage {
+			_, err = db.DB.Exec("UPDATE stations SET instance_state = $1, instance_message = $2 WHERE id = $3", instance.State, instance.Message, station.ID)
+		}
+		if err != nil {
+			return err
+		}
+		if instance.State != previousState {
+			log.WithFields(log.Fields{
+				"station": station.ID,
+				"state":   instance.State,
+			}).Debug("Station instance state changed")
+			if instance.State == provision.InstanceStateError {
+				station.publishStaffEvent(EventTypeStationProvisionFailed, fmt.Sprintf("Station %v instance failed", station.Shortname),
+					fmt.Sprintf("The instance of station %v entered the error state: %v", station.Shortname, instance.Message))
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,297 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/event"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// EventTypeStationNoteAdded is the event for new operator notes, sent to operators/admins.
+const EventTypeStationNoteAdded event.Type = "station.note_added"
+
+// StationNote is an operator note about an intervention on a station, e.g. "rebooted router".
+// Notes are append-only so they may be trusted as a log.
+type StationNote struct {
+	ID         *uuid.UUID `column:"id" json:"id"`               // Generated
+	StationID  *uuid.UUID `column:"station" json:"station"`     // Required
+	TimeslotID string     `column:"timeslot" json:"timeslot"`   // Generated, the timeslot assigned to the station at the time, if any
+	Author     string     `column:"author" json:"author"`       // Generated
+	Timestamp  *time.Time `column:"timestamp" json:"timestamp"` // Generated
+	Message    string     `column:"message" json:"message"`     // Required
+}
+
+// StationNotes is a list of station notes.
+type StationNotes []*StationNote
+
+// StationTimelineEntry is something that happened to a station.
+type StationTimelineEntry struct {
+	Timestamp  *time.Time `json:"timestamp"`
+	Kind       string     `json:"kind"` // "note", "assign", "unassign", "console", "hint" or "power"
+	Actor      string     `json:"actor"`
+	TimeslotID string     `json:"timeslot"`
+	Message    string     `json:"message"`
+}
+
+// StationTimeline is the audit trail of a station, newest first.
+type StationTimeline []*StationTimelineEntry
+
+func init() {
+	rest.AddHandler("/station-notes/", "^$", func() interface{} { return &StationNotes{} })
+	rest.AddHandler("/station-note/", "^(?:(?P<id>[^/]+)/)?$", func() interface{} { return &StationNote{} })
+	rest.AddHandler("/station/", "^(?P<id>[^/]+)/timeline/$", func() interface{} { return &StationTimeline{} })
+	registerPersonalData(personalDataTable{table: "station_notes", actorColumns: []string{"author"}, erasure: personalDataAnonymize})
+}
+
+// Get gets station notes, newest first.
+func (notes *StationNotes) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params, prep filtering
+	var whereArgs []interface{}
+	if stationID, ok := request.QueryArgs["station"]; ok {
+		whereArgs = append(whereArgs, "station", "=", stationID)
+	}
+	if timeslotID, ok := request.QueryArgs["timeslot"]; ok {
+		whereArgs = append(whereArgs, "timeslot", "=", timeslotID)
+	}
+	if author, ok := request.QueryArgs["author"]; ok {
+		whereArgs = append(whereArgs, "author", "=", author)
+	}
+
+	// Get
+	dbResult := db.SelectMany(notes, "station_notes", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	sort.SliceStable(*notes, func(i, j int) bool {
+		return (*notes)[i].Timestamp.After(*(*notes)[j].Timestamp)
+	})
+	if request.ListLimit > 0 && len(*notes) > request.ListLimit {
+		*notes = (*notes)[:request.ListLimit]
+	}
+	return rest.Result{}
+}
+
+// Get gets a single station note.
+func (note *StationNote) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+
+	// Get
+	dbResult := db.Select(note, "station_notes", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+	return rest.Result{}
+}
+
+// Post adds a note to a station.
+func (note *StationNote) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Validate
+	note.Message = strings.TrimSpace(note.Message)
+	if note.StationID == nil {
+		return rest.Result{Code: 400, Message: "missing station ID"}
+	}
+	if note.Message == "" {
+		return rest.Result{Code: 400, Message: "missing message"}
+	}
+	var station Station
+	stationDBResult := db.Select(&station, "stations", "id", "=", note.StationID)
+	if stationDBResult.IsFailed() {
+		return rest.Result{Code: 500, Error: stationDBResult.Error}
+	}
+	if !stationDBResult.IsSuccess() {
+		return rest.Result{Code: 400, Message: "referenced station does not exist"}
+	}
+
+	// Create
+	newID := uuid.New()
+	now := time.Now()
+	note.ID = &newID
+	note.TimeslotID = station.TimeslotID
+	note.Author = request.AccessToken.GetName()
+	note.Timestamp = &now
+	dbResult := db.Insert("station_notes", note)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	request.Log().WithFields(log.Fields{
+		"station": station.ID,
+		"note":    note.ID,
+		"actor":   note.Author,
+	}).Info("Station note added")
+	publishStaffEvent(EventTypeStationNoteAdded, station.TrackID, fmt.Sprintf("Note on station %v", station.Shortname),
+		fmt.Sprintf("%v: %v", note.Author, note.Message), note)
+
+	return rest.Result{Code: 201, Location: fmt.Sprintf("%v/station-note/%v/", config.Config.SitePrefix, note.ID)}
+}
+
+// Delete deletes a station note, e.g. if written for the wrong station.
+func (note *StationNote) Delete(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+
+	// Delete
+	dbResult := db.Delete("station_notes", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if dbResult.Affected == 0 {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+	request.Log().WithFields(log.Fields{
+		"note":  id,
+		"actor": request.AccessToken.GetName(),
+	}).Info("Station note deleted")
+	return rest.Result{}
+}
+
+// Get builds the timeline of notes, assignments, console sessions, hint unlocks and BMC power actions for the station.
+func (timeline *StationTimeline) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+
+	// Get everything
+	var notes StationNotes
+	if dbResult := db.SelectMany(&notes, "station_notes", "station", "=", id); dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	var assignments StationAssignments
+	if dbResult := db.SelectMany(&assignments, "station_assignments", "station", "=", id); dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	var sessions ConsoleSessions
+	if dbResult := db.SelectMany(&sessions, "console_sessions", "station", "=", id); dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	var unlocks HintUnlocks
+	if dbResult := db.SelectMany(&unlocks, "hint_unlocks", "station", "=", id); dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	var powerActions BMCPowerActions
+	if dbResult := db.SelectMany(&powerActions, "bmc_power_actions", "station", "=", id); dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+
+	// Merge
+	*timeline = make(StationTimeline, 0, len(notes)+len(assignments)+len(sessions)+len(unlocks)+len(powerActions))
+	for _, note := range notes {
+		*timeline = append(*timeline, &StationTimelineEntry{
+			Timestamp:  note.Timestamp,
+			Kind:       "note",
+			Actor:      note.Author,
+			TimeslotID: note.TimeslotID,
+			Message:    note.Message,
+		})
+	}
+	for _, assignment := range assignments {
+		*timeline = append(*timeline, &StationTimelineEntry{
+			Timestamp:  assignment.Timestamp,
+			Kind:       string(assignment.Action),
+			Actor:      assignment.Actor,
+			TimeslotID: assignment.TimeslotID.String(),
+			Message:    fmt.Sprintf("Station %ved (%v)", assignment.Action, assignment.Source),
+		})
+	}
+	for _, session := range sessions {
+		*timeline = append(*timeline, &StationTimelineEntry{
+			Timestamp:  session.StartTime,
+			Kind:       "console",
+			Actor:      session.Actor,
+			TimeslotID: session.TimeslotID,
+			Message:    "Console session started",
+		})
+	}
+	for _, unlock := range unlocks {
+		*timeline = append(*timeline, &StationTimelineEntry{
+			Timestamp:  unlock.Timestamp,
+			Kind:       "hint",
+			Actor:      unlock.Actor,
+			TimeslotID: unlock.TimeslotID.String(),
+			Message:    fmt.Sprintf("Hint %v unlocked", unlock.HintID),
+		})
+	}
+	for _, powerAction := range powerActions {
+		message := fmt.Sprintf("Power %v through BMC", powerAction.Action)
+		if !powerAction.Success {
+			message = fmt.Sprintf("%v failed: %v", message, powerAction.Error)
+		}
+		*timeline = append(*timeline, &StationTimelineEntry{
+			Timestamp:  powerAction.Timestamp,
+			Kind:       "power",
+			Actor:      powerAction.Actor,
+			TimeslotID: powerAction.TimeslotID,
+			Message:    message,
+		})
+	}
+	sort.SliceStable(*timeline, func(i, j int) bool {
+		return (*timeline)[i].Timestamp.After(*(*timeline)[j].Timestamp)
+	})
+	if request.ListLimit > 0 && len(*timeline) > request.ListLimit {
+		*timeline = (*timeline)[:request.ListLimit]
+	}
+	return rest.Result{}
+}
@@ -0,0 +1,133 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/event"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+)
+
+// EventTypeStationStatusChanged is the event for station status transitions, sent to operators/admins.
+const EventTypeStationStatusChanged event.Type = "station.status_changed" // Data is a StationStatusTransition
+
+// stationStatusTransitions contains the statuses each status may change to. Keeping the same status is always allowed.
+// Terminated is final, stations are never reused after their instance is destroyed.
+var stationStatusTransitions = map[StationStatus][]StationStatus{
+	StationStatusAvailable:    {StationStatusReady, StationStatusDirty, StationStatusMaintenance, StationStatusTerminated},
+	StationStatusReady:        {StationStatusAvailable, StationStatusDirty, StationStatusMaintenance, StationStatusTerminated},
+	StationStatusDirty:        {StationStatusProvisioning, StationStatusAvailable, StationStatusReady, StationStatusMaintenance, StationStatusTerminated},
+	StationStatusProvisioning: {StationStatusAvailable, StationStatusReady, StationStatusDirty, StationStatusMaintenance, StationStatusTerminated},
+	StationStatusMaintenance:  {StationStatusAvailable, StationStatusReady, StationStatusDirty, StationStatusProvisioning, StationStatusTerminated},
+	StationStatusTerminated:   {},
+}
+
+// StationStatusTransition is a change of station status.
+type StationStatusTransition struct {
+	StationID *uuid.UUID    `json:"station"`
+	Shortname string        `json:"shortname"`
+	From      StationStatus `json:"from"`
+	To        StationStatus `json:"to"`
+}
+
+// StationStatusMachine describes the station statuses and the allowed transitions between them.
+type StationStatusMachine struct {
+	Statuses    []StationStatus                   `json:"statuses"`
+	Transitions map[StationStatus][]StationStatus `json:"transitions"`
+}
+
+func init() {
+	rest.AddHandler("/station-statuses/", "^$", func() interface{} { return &StationStatusMachine{} })
+}
+
+// Get gets the station statuses and transitions.
+func (machine *StationStatusMachine) Get(request *rest.Request) rest.Result {
+	machine.Statuses = []StationStatus{
+		StationStatusAvailable,
+		StationStatusReady,
+		StationStatusDirty,
+		StationStatusProvisioning,
+		StationStatusMaintenance,
+		StationStatusTerminated,
+	}
+	machine.Transitions = stationStatusTransitions
+	return rest.Result{}
+}
+
+// canTransitionStationStatus checks if a station may change from one status to another.
+func canTransitionStationStatus(from StationStatus, to StationStatus) bool {
+	if from == to {
+		return true
+	}
+	for _, allowed := range stationStatusTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// checkStatusTransition loads the current status of the station and checks if the new status is allowed.
+// Returns the current status, or the invalid status if the station doesn't exist yet.
+func (station *Station) checkStatusTransition() (StationStatus, rest.Result) {
+	var current StationStatus
+	row := db.DB.QueryRow("SELECT status FROM stations WHERE id = $1", station.ID)
+	if err := row.Scan(&current); err == sql.ErrNoRows {
+		return StationStatusInvalid, rest.Result{}
+	} else if err != nil {
+		return StationStatusInvalid, rest.Result{Code: 500, Error: err}
+	}
+	if !canTransitionStationStatus(current, station.Status) {
+		return current, rest.Result{Code: 400, Message: fmt.Sprintf("invalid status transition from %v to %v", current, station.Status)}
+	}
+	return current, rest.Result{}
+}
+
+// updateTerminatedTime sets the terminated time when the station is terminated and clears it if no longer terminated.
+func (station *Station) updateTerminatedTime(previous StationStatus) {
+	if station.Status != StationStatusTerminated {
+		station.TerminatedTime = nil
+	} else if previous != StationStatusTerminated || station.TerminatedTime == nil {
+		now := time.Now()
+		station.TerminatedTime = &now
+	}
+}
+
+// publishStatusTransition notifies staff if the status changed from the previous status.
+// Nothing is published for new stations (invalid previous status).
+func (station *Station) publishStatusTransition(previous StationStatus) {
+	if previous == StationStatusInvalid || previous == station.Status {
+		return
+	}
+	transition := StationStatusTransition{
+		StationID: station.ID,
+		Shortname: station.Shortname,
+		From:      previous,
+		To:        station.Status,
+	}
+	publishStaffEvent(EventTypeStationStatusChanged, station.TrackID, fmt.Sprintf("Station %v is %v", station.Shortname, station.Status),
+		fmt.Sprintf("Station %v changed status from %v to %v.", station.Shortname, previous, station.Status), transition)
+}
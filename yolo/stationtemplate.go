@@ -0,0 +1,409 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base32"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/gathering/tech-online-backend/bmc"
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	maxBulkStations                = 500
+	stationPasswordLengthBytes     = 10
+	defaultStationShortnamePattern = "{{.N}}"
+)
+
+// StationTemplate is a template for creating many similar stations at once.
+// The patterns are Go text templates with ".N" (the station number), ".Track" and, except for the shortname, ".Shortname".
+// The credentials pattern also gets ".Password", a new random password per station.
+// Use e.g. `{{printf "ws%02d" .N}}` for zero-padded numbers.
+type StationTemplate struct {
+	ID                  *uuid.UUID    `column:"id" json:"id"`                                       // Generated
+	TrackID             string        `column:"track" json:"track"`                                 // Required
+	Name                string        `column:"name" json:"name"`                                   // Required, describes the template
+	ShortnamePattern    string        `column:"shortname_pattern" json:"shortname_pattern"`         // Defaults to "{{.N}}"
+	NamePattern         string        `column:"name_pattern" json:"name_pattern"`                   // E.g. "Station {{.N}}"
+	DefaultStatus       StationStatus `column:"default_status" json:"default_status"`               // Defaults to the default default status, also the initial status
+	CredentialsPattern  string        `column:"credentials_pattern" json:"credentials_pattern"`     // E.g. "ssh tech@{{.Shortname}}.techo.example, password {{.Password}}", no credentials if empty
+	AddressPattern      string        `column:"address_pattern" json:"address_pattern"`             // E.g. "10.10.{{.N}}.10", for health checks
+	GondulSwitchPattern string        `column:"gondul_switch_pattern" json:"gondul_switch_pattern"` // E.g. "e{{.N}}-1", defaults to the shortname
+	AllocateNetwork     bool          `column:"allocate_network" json:"allocate_network"`           // Allocate VLANs and prefixes from the IPAM pools of the track
+	BMCDriver           bmc.Driver    `column:"bmc_driver" json:"bmc_driver"`                       // For physical stations with power control
+	BMCAddressPattern   string        `column:"bmc_address_pattern" json:"bmc_address_pattern"`     // E.g. "10.20.{{.N}}.1"
+	BMCCredentials      string        `column:"bmc_credentials" json:"bmc_credentials"`             // Name of the BMC credentials in the config
+	Notes               string        `column:"notes" json:"notes"`                                 // Copied to the stations
+}
+
+// StationTemplates is a list of station templates.
+type StationTemplates []*StationTemplate
+
+// StationPatternData is the template data of the station template patterns.
+type StationPatternData struct {
+	N         int
+	Track     string
+	Shortname string
+	Password  string
+}
+
+// StationBulkCreateRequest is a request to create stations for a track from a template.
+type StationBulkCreateRequest struct {
+	TemplateID *uuid.UUID `json:"template"` // Required
+	Count      int        `json:"count"`    // Required, at most 500
+	Start      int        `json:"start"`    // First station number, defaults to 1
+	Stations   Stations   `json:"stations"` // Generated, the created stations
+}
+
+func init() {
+	rest.AddHandler("/station-templates/", "^$", func() interface{} { return &StationTemplates{} })
+	rest.AddHandler("/station-template/", "^(?:(?P<id>[^/]+)/)?$", func() interface{} { return &StationTemplate{} })
+	rest.AddHandler("/track/", "^(?P<track_id>[^/]+)/stations/bulk/$", func() interface{} { return &StationBulkCreateRequest{} })
+}
+
+// Get gets all station templates, optionally for the "track" query arg.
+func (templates *StationTemplates) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params, prep filtering
+	var whereArgs []interface{}
+	if trackID, ok := request.QueryArgs["track"]; ok {
+		whereArgs = append(whereArgs, "track", "=", trackID)
+	}
+
+	// Get
+	*templates = make(StationTemplates, 0)
+	dbResult := db.SelectMany(templates, "station_templates", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	return rest.Result{}
+}
+
+// Get gets a single station template.
+func (stationTemplate *StationTemplate) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+
+	// Get
+	dbResult := db.Select(stationTemplate, "station_templates", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+	return rest.Result{}
+}
+
+// Post creates a station template.
+func (stationTemplate *StationTemplate) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Prepare and validate
+	newID := uuid.New()
+	stationTemplate.ID = &newID
+	if result := stationTemplate.validate(); !result.IsOk() {
+		return result
+	}
+
+	// Create
+	dbResult := db.Insert("station_templates", stationTemplate)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	return rest.Result{Code: 201, Location: fmt.Sprintf("%v/station-template/%v/", config.Config.SitePrefix, stationTemplate.ID)}
+}
+
+// Put updates a station template. Stations already created from it are not changed.
+func (stationTemplate *StationTemplate) Put(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+	if stationTemplate.ID != nil && (*stationTemplate.ID).String() != id {
+		return rest.Result{Code: 400, Message: "mismatch between URL and JSON IDs"}
+	}
+	var oldTemplate StationTemplate
+	oldDBResult := db.Select(&oldTemplate, "station_templates", "id", "=", id)
+	if oldDBResult.IsFailed() {
+		return rest.Result{Code: 500, Error: oldDBResult.Error}
+	}
+	if !oldDBResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+
+	// Validate
+	stationTemplate.ID = oldTemplate.ID
+	if result := stationTemplate.validate(); !result.IsOk() {
+		return result
+	}
+
+	// Update
+	dbResult := db.Update("station_templates", stationTemplate, "id", "=", stationTemplate.ID)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	return rest.Result{}
+}
+
+// Delete deletes a station template. Stations already created from it are not changed.
+func (stationTemplate *StationTemplate) Delete(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+
+	// Delete
+	dbResult := db.Delete("station_templates", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if dbResult.Affected == 0 {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+	return rest.Result{}
+}
+
+// Post creates stations from the template, numbered from the start. Nothing is created if any of the shortnames are taken.
+// The stations are created one by one, so if network allocation fails, the stations created so far are kept and listed in the details.
+func (bulkRequest *StationBulkCreateRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	trackID := request.PathArgs["track_id"]
+	if bulkRequest.TemplateID == nil {
+		return rest.Result{Code: 400, Message: "missing template"}
+	}
+	if bulkRequest.Count < 1 || bulkRequest.Count > maxBulkStations {
+		return rest.Result{Code: 400, Message: fmt.Sprintf("count must be 1 to %v", maxBulkStations)}
+	}
+	if bulkRequest.Start == 0 {
+		bulkRequest.Start = 1
+	}
+	if bulkRequest.Start < 0 {
+		return rest.Result{Code: 400, Message: "negative start"}
+	}
+	var stationTemplate StationTemplate
+	templateDBResult := db.Select(&stationTemplate, "station_templates", "id", "=", bulkRequest.TemplateID)
+	if templateDBResult.IsFailed() {
+		return rest.Result{Code: 500, Error: templateDBResult.Error}
+	}
+	if !templateDBResult.IsSuccess() {
+		return rest.Result{Code: 400, Message: "referenced template does not exist"}
+	}
+	if stationTemplate.TrackID != trackID {
+		return rest.Result{Code: 400, Message: "template is for another track"}
+	}
+
+	// Stamp out the stations and check that the shortnames are free
+	stations := make(Stations, 0, bulkRequest.Count)
+	shortnames := make(map[string]bool)
+	for n := bulkRequest.Start; n < bulkRequest.Start+bulkRequest.Count; n++ {
+		station, err := stationTemplate.stamp(n)
+		if err != nil {
+			return rest.Result{Code: 400, Message: fmt.Sprintf("station %v: %v", n, err)}
+		}
+		if shortnames[station.Shortname] {
+			return rest.Result{Code: 400, Message: fmt.Sprintf("shortname pattern gives duplicate shortname %v", station.Shortname)}
+		}
+		shortnames[station.Shortname] = true
+		if exists, err := station.existsShortname(); err != nil {
+			return rest.Result{Code: 500, Error: err}
+		} else if exists {
+			return rest.Result{Code: 409, Message: fmt.Sprintf("station %v already exists in the track", station.Shortname)}
+		}
+		stations = append(stations, station)
+	}
+
+	// Create, allocating the networks one by one as they must see the previous ones
+	stationNetworkLock.Lock()
+	defer stationNetworkLock.Unlock()
+	bulkRequest.Stations = make(Stations, 0, len(stations))
+	for _, station := range stations {
+		if stationTemplate.AllocateNetwork {
+			if err := station.allocateNetwork(); err != nil {
+				request.Log().WithError(err).WithField("created", len(bulkRequest.Stations)).Warn("Bulk station creation stopped by network allocation")
+				return rest.Result{Code: 409, Message: fmt.Sprintf("failed to allocate network for station %v: %v", station.Shortname, err), Details: bulkRequest.Stations}
+			}
+		}
+		if result := station.validate(); !result.IsOk() {
+			if result.Error == nil {
+				result.Message = fmt.Sprintf("station %v: %v", station.Shortname, result.Message)
+				result.Details = bulkRequest.Stations
+			}
+			return result
+		}
+		if result := station.create(); !result.IsOk() {
+			return result
+		}
+		bulkRequest.Stations = append(bulkRequest.Stations, station)
+	}
+	request.Log().WithFields(log.Fields{
+		"track":    trackID,
+		"template": stationTemplate.ID,
+		"count":    len(bulkRequest.Stations),
+		"actor":    request.AccessToken.GetName(),
+	}).Info("Stations created from template")
+
+	bulkRequest.TemplateID = stationTemplate.ID
+	return rest.Result{Code: 201}
+}
+
+// stamp creates (without saving) the station with the number from the template.
+func (stationTemplate *StationTemplate) stamp(n int) (*Station, error) {
+	data := StationPatternData{
+		N:     n,
+		Track: stationTemplate.TrackID,
+	}
+	shortname, err := renderStationPattern(stationTemplate.ShortnamePattern, data)
+	if err != nil {
+		return nil, fmt.Errorf("shortname: %w", err)
+	}
+	if shortname == "" || strings.Contains(shortname, "/") {
+		return nil, fmt.Errorf("invalid shortname %q", shortname)
+	}
+	data.Shortname = shortname
+
+	newID := uuid.New()
+	station := &Station{
+		ID:             &newID,
+		TrackID:        stationTemplate.TrackID,
+		Shortname:      shortname,
+		DefaultStatus:  stationTemplate.DefaultStatus,
+		Status:         stationTemplate.DefaultStatus,
+		Notes:          stationTemplate.Notes,
+		BMCDriver:      stationTemplate.BMCDriver,
+		BMCCredentials: stationTemplate.BMCCredentials,
+	}
+	if strings.Contains(stationTemplate.CredentialsPattern, ".Password") {
+		if data.Password, err = generateStationPassword(); err != nil {
+			return nil, err
+		}
+	}
+	for _, field := range []struct {
+		name    string
+		pattern string
+		value   *string
+	}{
+		{"name", stationTemplate.NamePattern, &station.Name},
+		{"credentials", stationTemplate.CredentialsPattern, &station.Credentials},
+		{"address", stationTemplate.AddressPattern, &station.Address},
+		{"gondul switch", stationTemplate.GondulSwitchPattern, &station.GondulSwitch},
+		{"BMC address", stationTemplate.BMCAddressPattern, &station.BMCAddress},
+	} {
+		if field.pattern == "" {
+			continue
+		}
+		if *field.value, err = renderStationPattern(field.pattern, data); err != nil {
+			return nil, fmt.Errorf("%v: %w", field.name, err)
+		}
+	}
+	return station, nil
+}
+
+func (stationTemplate *StationTemplate) validate() rest.Result {
+	stationTemplate.Name = strings.TrimSpace(stationTemplate.Name)
+	if stationTemplate.Name == "" {
+		return rest.Result{Code: 400, Message: "missing name"}
+	}
+	if stationTemplate.ShortnamePattern == "" {
+		stationTemplate.ShortnamePattern = defaultStationShortnamePattern
+	}
+	if stationTemplate.DefaultStatus == "" {
+		stationTemplate.DefaultStatus = DefaultDefaultStationStatus
+	}
+	if !validateStationStatus(stationTemplate.DefaultStatus) || stationTemplate.DefaultStatus == StationStatusTerminated {
+		return rest.Result{Code: 400, Message: "invalid default status"}
+	}
+	track := Track{ID: stationTemplate.TrackID}
+	if exists, err := track.exists(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	} else if !exists {
+		return rest.Result{Code: 400, Message: "referenced track does not exist"}
+	}
+
+	// Render a sample station to check the patterns
+	sample, err := stationTemplate.stamp(1)
+	if err != nil {
+		return rest.Result{Code: 400, Message: fmt.Sprintf("invalid pattern: %v", err)}
+	}
+	return sample.validateBMC()
+}
+
+func renderStationPattern(pattern string, data StationPatternData) (string, error) {
+	parsed, err := template.New("station").Option("missingkey=error").Parse(pattern)
+	if err != nil {
+		return "", err
+	}
+	var rendered bytes.Buffer
+	if err := parsed.Execute(&rendered, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(rendered.String()), nil
+}
+
+// generateStationPassword generates a random password for station credentials.
+func generateStationPassword() (string, error) {
+	raw := make([]byte, stationPasswordLengthBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(raw)), nil
+}
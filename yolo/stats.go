@@ -0,0 +1,303 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"sort"
+	"time"
+
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+)
+
+// TrackTaskStats is the completion statistics of all tasks of a track, e.g. for presenters and track owners.
+type TrackTaskStats struct {
+	TrackID   string       `json:"track"`
+	Timestamp *time.Time   `json:"timestamp"` // When it was computed
+	Timeslots int          `json:"timeslots"` // Timeslots with any tests
+	Tasks     []*TaskStats `json:"tasks"`
+}
+
+// TaskStats is the completion statistics of a task, based on the tests of each timeslot.
+// A task is passed for a timeslot when it has tests for the timeslot and they all pass.
+type TaskStats struct {
+	TaskShortname           string         `json:"task_shortname"`
+	Name                    string         `json:"name"`
+	Sequence                *int           `json:"sequence"`
+	Timeslots               int            `json:"timeslots"`                  // Timeslots with tests for the task
+	PassedTimeslots         int            `json:"passed_timeslots"`           // Timeslots where the task is currently passed
+	PassedStations          int            `json:"passed_stations"`            // Distinct stations of the passed timeslots
+	PassedTeams             int            `json:"passed_teams"`               // Distinct teams of the passed timeslots
+	PassRate                float64        `json:"pass_rate"`                  // Passed timeslots divided by timeslots with tests
+	AverageFirstPassSeconds *int           `json:"average_first_pass_seconds"` // From the beginning of the timeslot until the task was first passed, null if never passed
+	Hotspots                []*TestHotspot `json:"hotspots"`                   // Currently failing tests, most failing first
+}
+
+// TestHotspot is a test which currently fails on one or more stations.
+type TestHotspot struct {
+	Shortname string `json:"shortname"`
+	Name      string `json:"name"`
+	Failing   int    `json:"failing"` // Stations where the test currently fails
+	Total     int    `json:"total"`   // Stations with the test
+}
+
+func init() {
+	rest.AddHandler("/stats/", "^track/(?P<id>[^/]+)/tasks/$", func() interface{} { return &TrackTaskStats{} })
+}
+
+// Get computes the task statistics for the track.
+func (stats *TrackTaskStats) Get(request *rest.Request) rest.Result {
+	// Check perms
+	switch request.AccessToken.GetRole() {
+	case rest.RoleOperator, rest.RoleAdmin, rest.RoleTester:
+	default:
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	trackID, trackIDExists := request.PathArgs["id"]
+	if !trackIDExists || trackID == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+	track := Track{ID: trackID}
+	if exists, err := track.exists(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	} else if !exists {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+
+	// Get
+	var tasks Tasks
+	if dbResult := db.SelectMany(&tasks, "tasks", "track", "=", trackID); dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	var timeslotTests Tests
+	if dbResult := db.SelectMany(&timeslotTests, "tests", "track", "=", trackID, "timeslot", "!=", ""); dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	var currentTests Tests
+	if dbResult := db.SelectMany(&currentTests, "tests", "track", "=", trackID, "timeslot", "=", ""); dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	var history TestHistory
+	if dbResult := db.SelectMany(&history, "test_history", "track", "=", trackID, "timeslot", "!=", ""); dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	var timeslots Timeslots
+	if dbResult := db.SelectMany(&timeslots, "timeslots", "track", "=", trackID); dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+
+	// Compute
+	now := time.Now()
+	stats.TrackID = trackID
+	stats.Timestamp = &now
+	stats.Tasks = computeTaskStats(tasks, timeslotTests, currentTests, history, timeslots)
+	timeslotIDs := make(map[string]bool)
+	for _, test := range timeslotTests {
+		timeslotIDs[test.TimeslotID] = true
+	}
+	stats.Timeslots = len(timeslotIDs)
+	return rest.Result{}
+}
+
+// computeTaskStats computes the statistics for each task from the timeslot tests (for completion),
+// the current station tests (for hotspots) and the test history (for time to first pass).
+func computeTaskStats(tasks Tasks, timeslotTests Tests, currentTests Tests, history TestHistory, timeslots Timeslots) []*TaskStats {
+	timeslotMap := make(map[string]*Timeslot)
+	for _, timeslot := range timeslots {
+		timeslotMap[timeslot.ID.String()] = timeslot
+	}
+
+	// Group the tests by task and timeslot
+	type taskTimeslot struct {
+		task     string
+		timeslot string
+	}
+	groupedTests := make(map[taskTimeslot][]*Test)
+	for _, test := range timeslotTests {
+		key := taskTimeslot{test.TaskShortname, test.TimeslotID}
+		groupedTests[key] = append(groupedTests[key], test)
+	}
+	groupedHistory := make(map[taskTimeslot][]*TestHistoryEntry)
+	for _, entry := range history {
+		key := taskTimeslot{entry.TaskShortname, entry.TimeslotID}
+		groupedHistory[key] = append(groupedHistory[key], entry)
+	}
+
+	statsMap := make(map[string]*TaskStats)
+	allStats := make([]*TaskStats, 0, len(tasks))
+	for _, task := range tasks {
+		taskStats := &TaskStats{
+			TaskShortname: task.Shortname,
+			Name:          task.Name,
+			Sequence:      task.Sequence,
+			Hotspots:      make([]*TestHotspot, 0),
+		}
+		statsMap[task.Shortname] = taskStats
+		allStats = append(allStats, taskStats)
+	}
+
+	// Completion and time to first pass
+	passedStations := make(map[string]map[string]bool)
+	passedTeams := make(map[string]map[uuid.UUID]bool)
+	firstPassTotals := make(map[string]time.Duration)
+	firstPassCounts := make(map[string]int)
+	for key, tests := range groupedTests {
+		taskStats, ok := statsMap[key.task]
+		if !ok {
+			continue
+		}
+		taskStats.Timeslots++
+		passed := true
+		for _, test := range tests {
+			if test.StatusSuccess == nil || !*test.StatusSuccess {
+				passed = false
+			}
+		}
+		if passed {
+			taskStats.PassedTimeslots++
+			if passedStations[key.task] == nil {
+				passedStations[key.task] = make(map[string]bool)
+				passedTeams[key.task] = make(map[uuid.UUID]bool)
+			}
+			passedStations[key.task][tests[0].StationShortname] = true
+			if timeslot, ok := timeslotMap[key.timeslot]; ok && timeslot.TeamID != nil {
+				passedTeams[key.task][*timeslot.TeamID] = true
+			}
+		}
+
+		var begin *time.Time
+		if timeslot, ok := timeslotMap[key.timeslot]; ok {
+			begin = timeslot.BeginTime
+		}
+		if firstPass := firstTaskPass(tests, groupedHistory[key]); firstPass != nil {
+			if begin == nil {
+				begin = firstHistoryTimestamp(groupedHistory[key])
+			}
+			if begin != nil && !firstPass.Before(*begin) {
+				firstPassTotals[key.task] += firstPass.Sub(*begin)
+				firstPassCounts[key.task]++
+			}
+		}
+	}
+	for shortname, taskStats := range statsMap {
+		taskStats.PassedStations = len(passedStations[shortname])
+		taskStats.PassedTeams = len(passedTeams[shortname])
+		if taskStats.Timeslots > 0 {
+			taskStats.PassRate = float64(taskStats.PassedTimeslots) / float64(taskStats.Timeslots)
+		}
+		if count := firstPassCounts[shortname]; count > 0 {
+			average := int((firstPassTotals[shortname] / time.Duration(count)).Seconds())
+			taskStats.AverageFirstPassSeconds = &average
+		}
+	}
+
+	// Hotspots
+	hotspots := make(map[string]map[string]*TestHotspot)
+	for _, test := range currentTests {
+		taskStats, ok := statsMap[test.TaskShortname]
+		if !ok {
+			continue
+		}
+		if hotspots[test.TaskShortname] == nil {
+			hotspots[test.TaskShortname] = make(map[string]*TestHotspot)
+		}
+		hotspot, ok := hotspots[test.TaskShortname][test.Shortname]
+		if !ok {
+			hotspot = &TestHotspot{Shortname: test.Shortname, Name: test.Name}
+			hotspots[test.TaskShortname][test.Shortname] = hotspot
+			taskStats.Hotspots = append(taskStats.Hotspots, hotspot)
+		}
+		hotspot.Total++
+		if test.StatusSuccess == nil || !*test.StatusSuccess {
+			hotspot.Failing++
+		}
+	}
+	for _, taskStats := range allStats {
+		failing := make([]*TestHotspot, 0, len(taskStats.Hotspots))
+		for _, hotspot := range taskStats.Hotspots {
+			if hotspot.Failing > 0 {
+				failing = append(failing, hotspot)
+			}
+		}
+		sort.SliceStable(failing, func(i, j int) bool {
+			if failing[i].Failing != failing[j].Failing {
+				return failing[i].Failing > failing[j].Failing
+			}
+			return failing[i].Shortname < failing[j].Shortname
+		})
+		taskStats.Hotspots = failing
+	}
+
+	sort.SliceStable(allStats, func(i, j int) bool {
+		if (allStats[i].Sequence == nil) != (allStats[j].Sequence == nil) {
+			return allStats[i].Sequence != nil
+		}
+		if allStats[i].Sequence != nil && *allStats[i].Sequence != *allStats[j].Sequence {
+			return *allStats[i].Sequence < *allStats[j].Sequence
+		}
+		return allStats[i].TaskShortname < allStats[j].TaskShortname
+	})
+	return allStats
+}
+
+// firstTaskPass replays the history of the tests of a task within a timeslot and finds when they first all passed.
+// Only the tests which currently exist are considered.
+func firstTaskPass(tests []*Test, history []*TestHistoryEntry) *time.Time {
+	statuses := make(map[string]bool)
+	for _, test := range tests {
+		statuses[test.Shortname] = false
+	}
+	sorted := make([]*TestHistoryEntry, len(history))
+	copy(sorted, history)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Timestamp.Before(*sorted[j].Timestamp)
+	})
+	for _, entry := range sorted {
+		if _, ok := statuses[entry.Shortname]; !ok {
+			continue
+		}
+		statuses[entry.Shortname] = entry.StatusSuccess
+		allPassed := true
+		for _, passed := range statuses {
+			if !passed {
+				allPassed = false
+				break
+			}
+		}
+		if allPassed {
+			return entry.Timestamp
+		}
+	}
+	return nil
+}
+
+func firstHistoryTimestamp(history []*TestHistoryEntry) *time.Time {
+	var first *time.Time
+	for _, entry := range history {
+		if first == nil || entry.Timestamp.Before(*first) {
+			first = entry.Timestamp
+		}
+	}
+	return first
+}
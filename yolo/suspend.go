@@ -0,0 +1,224 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/jobs"
+	"github.com/gathering/tech-online-backend/provision"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/gathering/tech-online-backend/scheduler"
+	log "github.com/sirupsen/logrus"
+)
+
+// StationSuspendRequest is a request to suspend the instance of a dynamic station to disk, if the driver supports it.
+type StationSuspendRequest struct{}
+
+// StationResumeRequest is a request to resume the suspended instance of a dynamic station.
+type StationResumeRequest struct{}
+
+func init() {
+	rest.AddHandler("/station/", "^(?P<id>[^/]+)/suspend/$", func() interface{} { return &StationSuspendRequest{} })
+	rest.AddHandler("/station/", "^(?P<id>[^/]+)/resume/$", func() interface{} { return &StationResumeRequest{} })
+	scheduler.AddAction("suspend-idle-stations", suspendIdleStations)
+	scheduler.AddAction("resume-suspended-stations", resumeSuspendedStations)
+}
+
+// Post suspends the station instance, keeping the participant's work.
+func (suspendRequest *StationSuspendRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Get station and provisioner
+	var station Station
+	provisioner, result := loadDynamicStation(request, &station)
+	if !result.IsOk() {
+		return result
+	}
+	suspender, suspenderOk := provisioner.(provision.Suspender)
+	if !suspenderOk {
+		return rest.Result{Code: 400, Message: "provisioning driver does not support suspending"}
+	}
+	if station.InstanceState == provision.InstanceStateSuspended {
+		return rest.Result{Code: 409, Message: "station is already suspended"}
+	}
+
+	// Suspend in the background
+	jobs.Submit(jobs.Job{
+		Name:     "station-suspend",
+		Fields:   log.Fields{"station": station.ID},
+		Attempts: 1, // Failures are published to staff
+		Run: func() error {
+			return station.suspend(suspender)
+		},
+	})
+	request.Log().WithFields(log.Fields{
+		"station": station.ID,
+		"actor":   request.AccessToken.GetName(),
+	}).Info("Queued station suspend")
+	return rest.Result{Code: 202, Location: fmt.Sprintf("%v/station/%v/", config.Config.SitePrefix, station.ID)}
+}
+
+// Post resumes the suspended station instance.
+func (resumeRequest *StationResumeRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Get station and provisioner
+	var station Station
+	provisioner, result := loadDynamicStation(request, &station)
+	if !result.IsOk() {
+		return result
+	}
+	suspender, suspenderOk := provisioner.(provision.Suspender)
+	if !suspenderOk {
+		return rest.Result{Code: 400, Message: "provisioning driver does not support suspending"}
+	}
+	if station.InstanceState != provision.InstanceStateSuspended {
+		return rest.Result{Code: 409, Message: "station is not suspended"}
+	}
+
+	// Resume in the background
+	jobs.Submit(jobs.Job{
+		Name:     "station-resume",
+		Fields:   log.Fields{"station": station.ID},
+		Attempts: 1, // Failures are published to staff
+		Run: func() error {
+			return station.resume(suspender)
+		},
+	})
+	request.Log().WithFields(log.Fields{
+		"station": station.ID,
+		"actor":   request.AccessToken.GetName(),
+	}).Info("Queued station resume")
+	return rest.Result{Code: 202, Location: fmt.Sprintf("%v/station/%v/", config.Config.SitePrefix, station.ID)}
+}
+
+// suspend suspends the instance and records the new instance state.
+// The instance refresh job takes over from there.
+func (station *Station) suspend(suspender provision.Suspender) error {
+	if err := suspender.Suspend(station.instanceID()); err != nil {
+		station.publishProvisionFailed("suspend", err)
+		return err
+	}
+	return station.saveInstanceState(provision.InstanceStateSuspended)
+}
+
+// resume resumes the instance, which is pending until the instance refresh job sees it running.
+func (station *Station) resume(suspender provision.Suspender) error {
+	if err := suspender.Resume(station.instanceID()); err != nil {
+		station.publishProvisionFailed("resume", err)
+		return err
+	}
+	return station.saveInstanceState(provision.InstanceStatePending)
+}
+
+func (station *Station) saveInstanceState(state provision.InstanceState) error {
+	station.InstanceState = state
+	_, err := db.DB.Exec("UPDATE stations SET instance_state = $1 WHERE id = $2", state, station.ID)
+	return err
+}
+
+// isSuspended checks if the station instance is suspended.
+// Suspended stations are not assigned, and get no health alerts or task checks.
+func (station *Station) isSuspended() bool {
+	return station.InstanceState == provision.InstanceStateSuspended
+}
+
+// suspendIdleStations suspends the running dynamic stations which are not in use by an ongoing timeslot, e.g. overnight.
+func suspendIdleStations() error {
+	now := time.Now()
+	return forEachSuspenderStation(func(station *Station, suspender provision.Suspender) error {
+		if station.InstanceState != provision.InstanceStateRunning {
+			return nil
+		}
+		if station.TimeslotID != "" {
+			var timeslot Timeslot
+			dbResult := db.Select(&timeslot, "timeslots", "id", "=", station.TimeslotID)
+			if dbResult.IsFailed() {
+				return dbResult.Error
+			}
+			if dbResult.IsSuccess() && timeslot.isOngoing(now) {
+				return nil
+			}
+		}
+		return station.suspend(suspender)
+	})
+}
+
+// resumeSuspendedStations resumes all suspended dynamic stations.
+func resumeSuspendedStations() error {
+	return forEachSuspenderStation(func(station *Station, suspender provision.Suspender) error {
+		if !station.isSuspended() {
+			return nil
+		}
+		return station.resume(suspender)
+	})
+}
+
+// forEachSuspenderStation runs the function for the non-terminated stations of server tracks with drivers supporting suspending.
+// Failures are logged and the rest of the stations are still handled.
+func forEachSuspenderStation(handle func(station *Station, suspender provision.Suspender) error) error {
+	failures := 0
+	for trackID := range config.Config.ServerTracks {
+		provisioner, err := provision.Get(trackID)
+		if err == provision.ErrNotConfigured {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		suspender, suspenderOk := provisioner.(provision.Suspender)
+		if !suspenderOk {
+			continue
+		}
+		var stations Stations
+		if dbResult := db.SelectMany(&stations, "stations", "track", "=", trackID, "instance_id", "!=", ""); dbResult.IsFailed() {
+			return dbResult.Error
+		}
+		for _, station := range stations {
+			if station.Status == StationStatusTerminated {
+				continue
+			}
+			if err := handle(station, suspender); err != nil {
+				log.WithError(err).WithField("station", station.ID).Warn("Failed to suspend or resume station")
+				failures++
+			}
+		}
+	}
+	if failures > 0 {
+		return fmt.Errorf("%v stations failed", failures)
+	}
+	return nil
+}
+
+// isOngoing checks if the time is within the timeslot.
+func (timeslot *Timeslot) isOngoing(now time.Time) bool {
+	return timeslot.BeginTime != nil && timeslot.EndTime != nil && !now.Before(*timeslot.BeginTime) && now.Before(*timeslot.EndTime)
+}
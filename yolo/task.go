@@ -22,7 +22,9 @@ package yolo
 
 import (
 	"fmt"
+	"sort"
 
+	"github.com/gathering/tech-online-backend/attachment"
 	"github.com/gathering/tech-online-backend/config"
 	"github.com/gathering/tech-online-backend/db"
 	"github.com/gathering/tech-online-backend/rest"
@@ -31,12 +33,15 @@ import (
 
 // Task is the components of a track.
 type Task struct {
-	ID          *uuid.UUID `column:"id" json:"id"`               // Generated, required, unique
-	TrackID     string     `column:"track" json:"track"`         // Required
-	Shortname   string     `column:"shortname" json:"shortname"` // Required, unique together with track
-	Name        string     `column:"name" json:"name"`           // Required
+	ID          *uuid.UUID `column:"id" json:"id" brief:"true"`               // Generated, required, unique
+	TrackID     string     `column:"track" json:"track" brief:"true"`         // Required
+	Shortname   string     `column:"shortname" json:"shortname" brief:"true"` // Required, unique together with track
+	Name        string     `column:"name" json:"name" brief:"true"`           // Required
 	Description string     `column:"description" json:"description"`
-	Sequence    *int       `column:"sequence" json:"sequence,omitempty"`
+	Sequence    *int       `column:"sequence" json:"sequence,omitempty" brief:"true"`
+	Points      int        `column:"points" json:"points" brief:"true"` // Awarded when all tests for the task pass
+	DependsOn   []string   `column:"-" json:"depends_on"`               // Shortnames of tasks which must be passed first, from the task dependencies table
+	Locked      bool       `column:"-" json:"locked,omitempty"`         // If the dependencies are not passed yet, for participants on tracks with task unlocking
 }
 
 // Tasks is a list of tasks.
@@ -47,6 +52,17 @@ func init() {
 	rest.AddHandler("/task/", "^(?:(?P<id>[^/]+)/)?$", func() interface{} { return &Task{} })
 }
 
+// QueryFilterFields gets the fields which may be filtered with query operators.
+func (tasks *Tasks) QueryFilterFields() rest.QueryFilterFields {
+	return rest.QueryFilterFields{
+		"track":     rest.QueryFilterString,
+		"shortname": rest.QueryFilterString,
+		"name":      rest.QueryFilterString,
+		"sequence":  rest.QueryFilterInt,
+		"points":    rest.QueryFilterInt,
+	}
+}
+
 // Get gets multiple tasks.
 func (tasks *Tasks) Get(request *rest.Request) rest.Result {
 	// TODO order by sequence
@@ -59,15 +75,84 @@ func (tasks *Tasks) Get(request *rest.Request) rest.Result {
 	if shortname, ok := request.QueryArgs["shortname"]; ok {
 		whereArgs = append(whereArgs, "shortname", "=", shortname)
 	}
+	whereArgs = append(whereArgs, request.Filters...)
 
 	// Get
 	dbResult := db.SelectMany(tasks, "tasks", whereArgs...)
 	if dbResult.IsFailed() {
 		return rest.Result{Code: 500, Error: dbResult.Error}
 	}
+
+	// Add dependencies and lock or hide tasks for participants
+	trackDependencies := make(map[string]map[string][]string)
+	for _, task := range *tasks {
+		if _, ok := trackDependencies[task.TrackID]; !ok {
+			dependencyMap, err := loadTaskDependencies(request.Context(), task.TrackID)
+			if err != nil {
+				return rest.Result{Code: 500, Error: err}
+			}
+			trackDependencies[task.TrackID] = dependencyMap
+		}
+		task.DependsOn = trackDependencies[task.TrackID][task.Shortname]
+		if task.DependsOn == nil {
+			task.DependsOn = make([]string, 0)
+		}
+	}
+	if err := tasks.applyUnlocking(request.AccessToken, request.QueryArgs["station-shortname"]); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
 	return rest.Result{}
 }
 
+// applyUnlocking locks or hides the tasks with prerequisites not passed by the station (shortname, optional), if enabled for the tracks.
+func (tasks *Tasks) applyUnlocking(token rest.AccessTokenEntry, stationShortname string) error {
+	trackCompletion := make(map[string]map[string]bool)
+	var visibleTasks Tasks
+	for _, task := range *tasks {
+		mode := taskUnlockingMode(task.TrackID, token)
+		if mode == TaskUnlockingNone || len(task.DependsOn) == 0 {
+			visibleTasks = append(visibleTasks, task)
+			continue
+		}
+		completion, ok := trackCompletion[task.TrackID]
+		if !ok {
+			completion = make(map[string]bool)
+			if stationShortname != "" {
+				tests, err := loadStationTests(task.TrackID, stationShortname)
+				if err != nil {
+					return err
+				}
+				completion = taskCompletion(tests)
+			}
+			trackCompletion[task.TrackID] = completion
+		}
+		if isTaskUnlocked(task.DependsOn, completion) {
+			visibleTasks = append(visibleTasks, task)
+			continue
+		}
+		if mode == TaskUnlockingLock {
+			task.Locked = true
+			task.Description = ""
+			visibleTasks = append(visibleTasks, task)
+		}
+	}
+	if visibleTasks == nil {
+		visibleTasks = make(Tasks, 0)
+	}
+	*tasks = visibleTasks
+	return nil
+}
+
+// sortBySequence sorts the tasks by sequence, with the tasks without a sequence last.
+func (tasks Tasks) sortBySequence() {
+	sort.SliceStable(tasks, func(i, j int) bool {
+		if tasks[i].Sequence == nil || tasks[j].Sequence == nil {
+			return tasks[j].Sequence == nil && tasks[i].Sequence != nil
+		}
+		return *tasks[i].Sequence < *tasks[j].Sequence
+	})
+}
+
 // Get gets a single task.
 func (task *Task) Get(request *rest.Request) rest.Result {
 	// Check params
@@ -84,6 +169,18 @@ func (task *Task) Get(request *rest.Request) rest.Result {
 	if !dbResult.IsSuccess() {
 		return rest.Result{Code: 404, Message: "not found"}
 	}
+	if err := task.loadDependencies(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+
+	// Lock or hide for participants
+	tasks := Tasks{task}
+	if err := tasks.applyUnlocking(request.AccessToken, request.QueryArgs["station-shortname"]); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	if len(tasks) == 0 {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
 	return rest.Result{}
 }
 
@@ -108,8 +205,12 @@ func (task *Task) Post(request *rest.Request) rest.Result {
 	if !result.IsOk() {
 		return result
 	}
+	if err := task.saveDependencies(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
 	result.Code = 201
 	result.Location = fmt.Sprintf("%v/task/%v/", config.Config.SitePrefix, task.ID)
+	result.Warnings = task.warnings()
 	return result
 }
 
@@ -135,7 +236,23 @@ func (task *Task) Put(request *rest.Request) rest.Result {
 	}
 
 	// Create or update
-	return task.createOrUpdate()
+	result := task.createOrUpdate()
+	if !result.IsOk() {
+		return result
+	}
+	if err := task.saveDependencies(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	result.Warnings = task.warnings()
+	return result
+}
+
+// warnings gets notes for the client about the saved task.
+func (task *Task) warnings() []string {
+	if task.Sequence == nil {
+		return []string{"missing sequence, the task is sorted last"}
+	}
+	return nil
 }
 
 // Delete deletes a task.
@@ -155,22 +272,36 @@ func (task *Task) Delete(request *rest.Request) rest.Result {
 		return rest.Result{Code: 400, Message: "invalid ID"}
 	}
 
-	// Check if exists
-	task.ID = &id
-	exists, err := task.exists()
-	if err != nil {
-		return rest.Result{Code: 500, Error: err}
+	// Get it
+	selectDBResult := db.Select(task, "tasks", "id", "=", id)
+	if selectDBResult.IsFailed() {
+		return rest.Result{Code: 500, Error: selectDBResult.Error}
 	}
-	if !exists {
+	if !selectDBResult.IsSuccess() {
 		return rest.Result{Code: 404, Message: "not found"}
 	}
 
-	// Delete
+	// Delete, including the checks
+	if err := task.delete(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	return rest.Result{}
+}
+
+// delete deletes the task together with its checks, dependencies and attachments.
+func (task *Task) delete() error {
 	dbResult := db.Delete("tasks", "id", "=", task.ID)
 	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
+		return dbResult.Error
 	}
-	return rest.Result{}
+	checksDBResult := db.Delete("task_checks", "track", "=", task.TrackID, "task_shortname", "=", task.Shortname)
+	if checksDBResult.IsFailed() {
+		return checksDBResult.Error
+	}
+	if err := task.deleteDependencies(); err != nil {
+		return err
+	}
+	return attachment.DeleteForOwner(attachment.OwnerTypeTask, task.ID.String())
 }
 
 func (task *Task) create() rest.Result {
@@ -249,7 +380,7 @@ func (task *Task) validate() rest.Result {
 		return rest.Result{Code: 400, Message: "referenced track does not exist"}
 	}
 
-	return rest.Result{}
+	return task.validateDependencies()
 }
 
 func (task *Task) existsTaskShortnameWithDifferentID() (bool, error) {
@@ -0,0 +1,444 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package yolo
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/probe"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/gathering/tech-online-backend/scheduler"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	testRunnerSchedulerInterval   = 10 * time.Second
+	defaultTaskCheckInterval      = 60 * time.Second
+	defaultTaskCheckTimeout       = 10 * time.Second
+	defaultMaxConcurrentTaskCheck = 20
+)
+
+// TaskCheck is a declarative check of a task, run against the stations of the track by the built-in test runner.
+// Each run of a check results in a test with the same shortname, name, description and sequence for the station.
+type TaskCheck struct {
+	ID              *uuid.UUID `column:"id" json:"id"`                         // Generated, required, unique
+	TrackID         string     `column:"track" json:"track"`                   // Required
+	TaskShortname   string     `column:"task_shortname" json:"task_shortname"` // Required
+	Shortname       string     `column:"shortname" json:"shortname"`           // Required, shortname of the resulting tests, unique together with track and task
+	Name            string     `column:"name" json:"name"`                     // Required
+	Description     string     `column:"description" json:"description"`
+	Sequence        *int       `column:"sequence" json:"sequence"`
+	Enabled         bool       `column:"enabled" json:"enabled"`
+	Kind            probe.Kind `column:"kind" json:"kind"`         // Required, "icmp" (ping), "tcp", "http" or "ssh"
+	Port            int        `column:"port" json:"port"`         // Required for TCP, optional for HTTP and SSH
+	Path            string     `column:"path" json:"path"`         // HTTP path, defaults to "/"
+	Command         string     `column:"command" json:"command"`   // SSH command, defaults to "true"
+	Username        string     `column:"username" json:"username"` // SSH username, defaults to the configured test runner username
+	Expect          string     `column:"expect" json:"expect"`     // Substring the HTTP response body or SSH command output must contain, optional
+	TimeoutSeconds  int        `column:"timeout_seconds" json:"timeout_seconds"`
+	IntervalSeconds int        `column:"interval_seconds" json:"interval_seconds"`
+}
+
+// TaskChecks is a list of task checks.
+type TaskChecks []*TaskCheck
+
+// Last run time per check, only used by the test runner.
+var lastTaskCheckRuns = make(map[uuid.UUID]time.Time)
+var lastTaskCheckRunsLock sync.Mutex
+
+func init() {
+	rest.AddHandler("/task-checks/", "^$", func() interface{} { return &TaskChecks{} })
+	rest.AddHandler("/task-check/", "^(?:(?P<id>[^/]+)/)?$", func() interface{} { return &TaskCheck{} })
+	scheduler.AddJob("run-task-checks", testRunnerSchedulerInterval, runDueTaskChecks)
+	scheduler.AddAction("run-all-task-checks", runAllTaskChecks)
+}
+
+// Get gets multiple task checks.
+// They may contain hints about the solutions, so only for staff and testers.
+func (checks *TaskChecks) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if !canSeeTaskChecks(request.AccessToken.GetRole()) {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params, prep filtering
+	var whereArgs []interface{}
+	if trackID, ok := request.QueryArgs["track"]; ok {
+		whereArgs = append(whereArgs, "track", "=", trackID)
+	}
+	if taskShortname, ok := request.QueryArgs["task-shortname"]; ok {
+		whereArgs = append(whereArgs, "task_shortname", "=", taskShortname)
+	}
+
+	// Get
+	dbResult := db.SelectMany(checks, "task_checks", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	return rest.Result{}
+}
+
+// Get gets a single task check.
+func (check *TaskCheck) Get(request *rest.Request) rest.Result {
+	// Check perms
+	if !canSeeTaskChecks(request.AccessToken.GetRole()) {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+
+	// Get
+	dbResult := db.Select(check, "task_checks", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+	return rest.Result{}
+}
+
+// Post creates a new task check.
+func (check *TaskCheck) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Prepare and validate
+	if check.ID == nil {
+		newID := uuid.New()
+		check.ID = &newID
+	}
+	if result := check.validate(); !result.IsOk() {
+		return result
+	}
+	if exists, err := check.exists(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	} else if exists {
+		return rest.Result{Code: 409, Message: "duplicate"}
+	}
+
+	// Create and redirect
+	dbResult := db.Insert("task_checks", check)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	return rest.Result{Code: 201, Location: fmt.Sprintf("%v/task-check/%v/", config.Config.SitePrefix, check.ID)}
+}
+
+// Put updates a task check.
+func (check *TaskCheck) Put(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	rawID, rawIDExists := request.PathArgs["id"]
+	if !rawIDExists || rawID == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+	id, uuidError := uuid.Parse(rawID)
+	if uuidError != nil {
+		return rest.Result{Code: 400, Message: "invalid ID"}
+	}
+
+	// Validate
+	if check.ID != nil && *check.ID != id {
+		return rest.Result{Code: 400, Message: "mismatch between URL and JSON IDs"}
+	}
+	check.ID = &id
+	if result := check.validate(); !result.IsOk() {
+		return result
+	}
+	if exists, err := check.exists(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	} else if !exists {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+
+	// Update
+	dbResult := db.Update("task_checks", check, "id", "=", check.ID)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	return rest.Result{}
+}
+
+// Delete deletes a task check. Tests from earlier runs are kept.
+func (check *TaskCheck) Delete(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	rawID, rawIDExists := request.PathArgs["id"]
+	if !rawIDExists || rawID == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+	id, uuidError := uuid.Parse(rawID)
+	if uuidError != nil {
+		return rest.Result{Code: 400, Message: "invalid ID"}
+	}
+
+	// Check if it exists
+	check.ID = &id
+	exists, err := check.exists()
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	if !exists {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+
+	// Delete it
+	dbResult := db.Delete("task_checks", "id", "=", check.ID)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	return rest.Result{}
+}
+
+func canSeeTaskChecks(role rest.Role) bool {
+	switch role {
+	case rest.RoleTester, rest.RoleOperator, rest.RoleAdmin:
+		return true
+	default:
+		return false
+	}
+}
+
+func (check *TaskCheck) exists() (bool, error) {
+	var count int
+	row := db.DB.QueryRow("SELECT COUNT(*) FROM task_checks WHERE id = $1", check.ID)
+	rowErr := row.Scan(&count)
+	if rowErr != nil {
+		return false, rowErr
+	}
+	return count > 0, nil
+}
+
+func (check *TaskCheck) existsShortnameWithDifferentID() (bool, error) {
+	var count int
+	row := db.DB.QueryRow("SELECT COUNT(*) FROM task_checks WHERE track = $1 AND task_shortname = $2 AND shortname = $3 AND id != $4",
+		check.TrackID, check.TaskShortname, check.Shortname, check.ID)
+	rowErr := row.Scan(&count)
+	if rowErr != nil {
+		return false, rowErr
+	}
+	return count > 0, nil
+}
+
+// validateFields checks the fields of the check, without looking anything up.
+func (check *TaskCheck) validateFields() rest.Result {
+	switch {
+	case check.ID == nil:
+		return rest.Result{Code: 400, Message: "missing ID"}
+	case check.TrackID == "":
+		return rest.Result{Code: 400, Message: "missing track ID"}
+	case check.TaskShortname == "":
+		return rest.Result{Code: 400, Message: "missing task shortname"}
+	case check.Shortname == "":
+		return rest.Result{Code: 400, Message: "missing shortname"}
+	case check.Name == "":
+		return rest.Result{Code: 400, Message: "missing name"}
+	case !probe.ValidateKind(check.Kind):
+		return rest.Result{Code: 400, Message: "invalid kind"}
+	case check.Kind == probe.KindTCP && check.Port <= 0:
+		return rest.Result{Code: 400, Message: "missing port"}
+	case check.Port < 0 || check.Port > 65535:
+		return rest.Result{Code: 400, Message: "invalid port"}
+	case check.Kind == probe.KindSSH && check.Username == "" && config.Config.TestRunner.SSHUsername == "":
+		return rest.Result{Code: 400, Message: "missing username (no default SSH username configured)"}
+	case check.TimeoutSeconds < 0:
+		return rest.Result{Code: 400, Message: "invalid timeout"}
+	case check.IntervalSeconds < 0:
+		return rest.Result{Code: 400, Message: "invalid interval"}
+	}
+	return rest.Result{}
+}
+
+func (check *TaskCheck) validate() rest.Result {
+	if result := check.validateFields(); !result.IsOk() {
+		return result
+	}
+
+	task := Task{TrackID: check.TrackID, Shortname: check.TaskShortname}
+	if exists, err := task.existsShortname(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	} else if !exists {
+		return rest.Result{Code: 400, Message: "referenced task does not exist"}
+	}
+	if exists, err := check.existsShortnameWithDifferentID(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	} else if exists {
+		return rest.Result{Code: 409, Message: "shortname is already used with a different check for the task"}
+	}
+
+	return rest.Result{}
+}
+
+// runDueTaskChecks runs all enabled checks which are due.
+func runDueTaskChecks() error {
+	return runTaskChecks(false)
+}
+
+// runAllTaskChecks runs all enabled checks now, regardless of their intervals, e.g. for scheduled test batches.
+func runAllTaskChecks() error {
+	return runTaskChecks(true)
+}
+
+// runTaskChecks runs enabled checks against the stations of their tracks and saves the results as tests.
+// Only due checks are run unless forced.
+func runTaskChecks(force bool) error {
+	if config.Config.TestRunner.Disabled {
+		return nil
+	}
+
+	var checks TaskChecks
+	dbResult := db.SelectMany(&checks, "task_checks", "enabled", "=", true)
+	if dbResult.IsFailed() {
+		return dbResult.Error
+	}
+
+	now := time.Now()
+	var dueChecks TaskChecks
+	lastTaskCheckRunsLock.Lock()
+	for _, check := range checks {
+		interval := defaultTaskCheckInterval
+		if check.IntervalSeconds > 0 {
+			interval = time.Duration(check.IntervalSeconds) * time.Second
+		}
+		if !force && now.Sub(lastTaskCheckRuns[*check.ID]) < interval {
+			continue
+		}
+		lastTaskCheckRuns[*check.ID] = now
+		dueChecks = append(dueChecks, check)
+	}
+	lastTaskCheckRunsLock.Unlock()
+	if len(dueChecks) == 0 {
+		return nil
+	}
+
+	// Run concurrently, but not too many at once
+	maxConcurrent := defaultMaxConcurrentTaskCheck
+	if config.Config.TestRunner.MaxConcurrentChecks > 0 {
+		maxConcurrent = config.Config.TestRunner.MaxConcurrentChecks
+	}
+	var waitGroup sync.WaitGroup
+	semaphore := make(chan struct{}, maxConcurrent)
+	trackStations := make(map[string]Stations)
+	for _, check := range dueChecks {
+		stations, ok := trackStations[check.TrackID]
+		if !ok {
+			dbResult := db.SelectMany(&stations, "stations", "track", "=", check.TrackID)
+			if dbResult.IsFailed() {
+				return dbResult.Error
+			}
+			trackStations[check.TrackID] = stations
+		}
+		for _, station := range stations {
+			// Stations which are gone, not up yet or under maintenance would just fail
+			if station.Address == "" || station.Status == StationStatusTerminated || station.Status == StationStatusProvisioning || station.Status == StationStatusMaintenance || station.isUnderMaintenance(now) || station.isSuspended() {
+				continue
+			}
+			waitGroup.Add(1)
+			semaphore <- struct{}{}
+			go func(check *TaskCheck, station *Station) {
+				defer waitGroup.Done()
+				defer func() { <-semaphore }()
+				if err := check.run(station); err != nil {
+					log.WithError(err).WithFields(log.Fields{
+						"check":   check.ID,
+						"station": station.ID,
+					}).Warn("Failed to save task check result")
+				}
+			}(check, station)
+		}
+	}
+	waitGroup.Wait()
+	return nil
+}
+
+// run runs the check against the station and saves the result as a test.
+func (check *TaskCheck) run(station *Station) error {
+	result := probe.Probe(check.target(station.Address))
+
+	success := result.OK
+	description := "OK"
+	if result.Error != nil {
+		description = result.Error.Error()
+	}
+	newID := uuid.New()
+	now := time.Now()
+	test := Test{
+		ID:                &newID,
+		TrackID:           check.TrackID,
+		TaskShortname:     check.TaskShortname,
+		Shortname:         check.Shortname,
+		StationShortname:  station.Shortname,
+		Name:              check.Name,
+		Description:       check.Description,
+		Sequence:          check.Sequence,
+		Timestamp:         &now,
+		StatusSuccess:     &success,
+		StatusDescription: description,
+	}
+	if result := test.save(); !result.IsOk() {
+		if result.Error != nil {
+			return result.Error
+		}
+		return fmt.Errorf("%v", result.Message)
+	}
+	return nil
+}
+
+func (check *TaskCheck) target(address string) probe.Target {
+	target := probe.Target{
+		Kind:    check.Kind,
+		Address: probeAddress(check.Kind, address, check.Port, check.Path),
+		Timeout: defaultTaskCheckTimeout,
+		Expect:  check.Expect,
+	}
+	if check.TimeoutSeconds > 0 {
+		target.Timeout = time.Duration(check.TimeoutSeconds) * time.Second
+	}
+	if check.Kind == probe.KindSSH {
+		target.Port = check.Port
+		target.Username = check.Username
+		if target.Username == "" {
+			target.Username = config.Config.TestRunner.SSHUsername
+		}
+		target.IdentityFile = config.Config.TestRunner.SSHIdentityFile
+		target.Command = check.Command
+	}
+	return target
+}
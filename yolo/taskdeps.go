@@ -0,0 +1,197 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package yolo
+
+import (
+	"context"
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+)
+
+// Task unlocking modes, per track.
+const (
+	// TaskUnlockingNone shows all tasks regardless of dependencies.
+	TaskUnlockingNone = ""
+	// TaskUnlockingLock shows tasks with unpassed dependencies as locked, without the description.
+	TaskUnlockingLock = "lock"
+	// TaskUnlockingHide hides tasks with unpassed dependencies.
+	TaskUnlockingHide = "hide"
+)
+
+// TaskDependency is a prerequisite of a task, i.e. the other task must be passed first.
+type TaskDependency struct {
+	TrackID       string `column:"track" json:"track"`
+	TaskShortname string `column:"task_shortname" json:"task_shortname"`
+	DependsOn     string `column:"depends_on" json:"depends_on"` // Shortname of the other task in the same track
+}
+
+// TaskDependencies is a list of task dependencies.
+type TaskDependencies []*TaskDependency
+
+// loadTaskDependencies loads the dependencies of all tasks in the track, as task shortname to prerequisite shortnames.
+func loadTaskDependencies(ctx context.Context, trackID string) (map[string][]string, error) {
+	var dependencies TaskDependencies
+	dbResult := db.SelectManyContext(ctx, &dependencies, "task_dependencies", "track", "=", trackID)
+	if dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	dependencyMap := make(map[string][]string)
+	for _, dependency := range dependencies {
+		dependencyMap[dependency.TaskShortname] = append(dependencyMap[dependency.TaskShortname], dependency.DependsOn)
+	}
+	return dependencyMap, nil
+}
+
+func (task *Task) loadDependencies() error {
+	var dependencies TaskDependencies
+	dbResult := db.SelectMany(&dependencies, "task_dependencies", "track", "=", task.TrackID, "task_shortname", "=", task.Shortname)
+	if dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	task.DependsOn = make([]string, 0, len(dependencies))
+	for _, dependency := range dependencies {
+		task.DependsOn = append(task.DependsOn, dependency.DependsOn)
+	}
+	return nil
+}
+
+// saveDependencies replaces the saved dependencies of the task.
+func (task *Task) saveDependencies() error {
+	if dbResult := db.Delete("task_dependencies", "track", "=", task.TrackID, "task_shortname", "=", task.Shortname); dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	for _, dependsOn := range task.DependsOn {
+		dependency := TaskDependency{
+			TrackID:       task.TrackID,
+			TaskShortname: task.Shortname,
+			DependsOn:     dependsOn,
+		}
+		if dbResult := db.Insert("task_dependencies", dependency); dbResult.IsFailed() {
+			return dbResult.Error
+		}
+	}
+	return nil
+}
+
+// deleteDependencies deletes the dependencies of the task and the dependencies on it.
+func (task *Task) deleteDependencies() error {
+	_, err := db.DB.Exec("DELETE FROM task_dependencies WHERE track = $1 AND (task_shortname = $2 OR depends_on = $2)", task.TrackID, task.Shortname)
+	return err
+}
+
+// validateDependencies checks that the prerequisites exist in the same track and don't form cycles.
+func (task *Task) validateDependencies() rest.Result {
+	seen := make(map[string]bool)
+	for _, dependsOn := range task.DependsOn {
+		if dependsOn == task.Shortname {
+			return rest.Result{Code: 400, Message: "task can't depend on itself"}
+		}
+		if seen[dependsOn] {
+			return rest.Result{Code: 400, Message: "duplicate dependency"}
+		}
+		seen[dependsOn] = true
+		other := Task{TrackID: task.TrackID, Shortname: dependsOn}
+		if exists, err := other.existsShortname(); err != nil {
+			return rest.Result{Code: 500, Error: err}
+		} else if !exists {
+			return rest.Result{Code: 400, Message: "referenced dependency task does not exist"}
+		}
+	}
+
+	dependencyMap, err := loadTaskDependencies(context.Background(), task.TrackID)
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	dependencyMap[task.Shortname] = task.DependsOn
+	if hasDependencyCycle(dependencyMap, task.Shortname) {
+		return rest.Result{Code: 400, Message: "dependencies would form a cycle"}
+	}
+	return rest.Result{}
+}
+
+// hasDependencyCycle checks if the task can reach itself through the dependencies.
+func hasDependencyCycle(dependencyMap map[string][]string, start string) bool {
+	visited := make(map[string]bool)
+	stack := append([]string{}, dependencyMap[start]...)
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if current == start {
+			return true
+		}
+		if visited[current] {
+			continue
+		}
+		visited[current] = true
+		stack = append(stack, dependencyMap[current]...)
+	}
+	return false
+}
+
+// taskCompletion finds which tasks are passed from the tests of a station, i.e. have tests which all pass.
+func taskCompletion(tests []Test) map[string]bool {
+	testCounts := make(map[string]int)
+	passedCounts := make(map[string]int)
+	for _, test := range tests {
+		testCounts[test.TaskShortname]++
+		if test.StatusSuccess != nil && *test.StatusSuccess {
+			passedCounts[test.TaskShortname]++
+		}
+	}
+	completion := make(map[string]bool)
+	for taskShortname, count := range testCounts {
+		completion[taskShortname] = count > 0 && passedCounts[taskShortname] == count
+	}
+	return completion
+}
+
+// isTaskUnlocked checks if all prerequisites of the task are passed.
+func isTaskUnlocked(dependsOn []string, completion map[string]bool) bool {
+	for _, dependency := range dependsOn {
+		if !completion[dependency] {
+			return false
+		}
+	}
+	return true
+}
+
+// taskUnlockingMode gets the unlocking mode of the track, or none if the token may see everything.
+func taskUnlockingMode(trackID string, token rest.AccessTokenEntry) string {
+	switch token.GetRole() {
+	case rest.RoleOperator, rest.RoleAdmin, rest.RoleTester:
+		return TaskUnlockingNone
+	}
+	return config.Config.Tracks[trackID].TaskUnlocking
+}
+
+// loadStationTests loads the latest tests for the station (shortname).
+func loadStationTests(trackID string, stationShortname string) ([]Test, error) {
+	var tests Tests
+	dbResult := db.SelectMany(&tests, "tests", "track", "=", trackID, "station_shortname", "=", stationShortname, "timeslot", "=", "")
+	if dbResult.IsFailed() {
+		return nil, dbResult.Error
+	}
+	plainTests := make([]Test, 0, len(tests))
+	for _, test := range tests {
+		plainTests = append(plainTests, *test)
+	}
+	return plainTests, nil
+}
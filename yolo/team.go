@@ -0,0 +1,479 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"fmt"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+)
+
+const inviteCodeLengthBytes = 5 // 8 base32 characters
+
+// Team is a group of users participating together in a track.
+// A user may only be a member of one team per track.
+type Team struct {
+	ID         *uuid.UUID  `column:"id" json:"id" brief:"true"`                // Generated, required, unique
+	TrackID    string      `column:"track" json:"track" brief:"true"`          // Required
+	Name       string      `column:"name" json:"name" brief:"true"`            // Required, unique together with track
+	InviteCode string      `column:"invite_code" json:"invite_code,omitempty"` // Generated, only shown to members and operators/admins
+	MemberIDs  []uuid.UUID `column:"-" json:"members"`                         // From the team members table
+}
+
+// Teams is a list of teams.
+type Teams []*Team
+
+// TeamMember is a membership of a user in a team.
+type TeamMember struct {
+	TeamID   *uuid.UUID `column:"team" json:"team"`
+	UserID   *uuid.UUID `column:"user" json:"user"`
+	JoinTime *time.Time `column:"join_time" json:"join_time"`
+}
+
+// TeamMembers is a list of team members.
+type TeamMembers []*TeamMember
+
+// TeamJoinRequest is a request to join the team with the invite code.
+type TeamJoinRequest struct {
+	InviteCode string `json:"invite_code"`
+}
+
+// TeamLeaveRequest is a request to leave a team, or to remove a member from it.
+type TeamLeaveRequest struct{}
+
+func init() {
+	rest.AddHandler("/teams/", "^$", func() interface{} { return &Teams{} })
+	rest.AddHandler("/teams/", "^join/$", func() interface{} { return &TeamJoinRequest{} })
+	rest.AddHandler("/team/", "^(?:(?P<id>[^/]+)/)?$", func() interface{} { return &Team{} })
+	rest.AddHandler("/team/", "^(?P<id>[^/]+)/leave/$", func() interface{} { return &TeamLeaveRequest{} })
+}
+
+// Get gets multiple teams.
+func (teams *Teams) Get(request *rest.Request) rest.Result {
+	// Check params, prep filtering
+	var whereArgs []interface{}
+	if trackID, ok := request.QueryArgs["track"]; ok {
+		whereArgs = append(whereArgs, "track", "=", trackID)
+	}
+
+	// Get
+	var allTeams Teams
+	dbResult := db.SelectMany(&allTeams, "teams", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	userID, filterUser := request.QueryArgs["user"]
+	for _, team := range allTeams {
+		if err := team.loadMembers(); err != nil {
+			return rest.Result{Code: 500, Error: err}
+		}
+		if filterUser && !team.hasMemberString(userID) {
+			continue
+		}
+		team.hideInviteCode(request.AccessToken)
+		*teams = append(*teams, team)
+	}
+	return rest.Result{}
+}
+
+// Get gets a single team.
+func (team *Team) Get(request *rest.Request) rest.Result {
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+
+	// Get
+	if result := team.load(id); !result.IsOk() {
+		return result
+	}
+	team.hideInviteCode(request.AccessToken)
+	return rest.Result{}
+}
+
+// Post creates a new team.
+// Participants become the only member of the team, while operators/admins may specify the members.
+func (team *Team) Post(request *rest.Request) rest.Result {
+	// Check perms
+	isPrivileged := request.AccessToken.GetRole() == rest.RoleOperator || request.AccessToken.GetRole() == rest.RoleAdmin
+	if !isPrivileged && request.AccessToken.OwnerUserID == nil {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Overwrite stuff
+	if team.ID == nil {
+		newID := uuid.New()
+		team.ID = &newID
+	}
+	inviteCode, inviteCodeErr := generateInviteCode()
+	if inviteCodeErr != nil {
+		return rest.Result{Code: 500, Error: inviteCodeErr}
+	}
+	team.InviteCode = inviteCode
+	if !isPrivileged {
+		team.MemberIDs = []uuid.UUID{*request.AccessToken.OwnerUserID}
+	}
+
+	// Validate
+	if result := team.validate(); !result.IsOk() {
+		return result
+	}
+	// Members are validated against the ones accepted so far, ignoring duplicates
+	requestedMemberIDs := team.MemberIDs
+	team.MemberIDs = make([]uuid.UUID, 0, len(requestedMemberIDs))
+	for _, userID := range requestedMemberIDs {
+		if team.hasMember(userID) {
+			continue
+		}
+		if result := team.validateNewMember(userID); !result.IsOk() {
+			return result
+		}
+		team.MemberIDs = append(team.MemberIDs, userID)
+	}
+
+	// Create and redirect
+	if exists, err := team.exists(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	} else if exists {
+		return rest.Result{Code: 409, Message: "duplicate"}
+	}
+	if err := team.insertWithMembers(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	return rest.Result{Code: 201, Location: fmt.Sprintf("%v/team/%v/", config.Config.SitePrefix, team.ID)}
+}
+
+// Put updates a team's name.
+// Members are managed through joining and leaving.
+func (team *Team) Put(request *rest.Request) rest.Result {
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+	var existingTeam Team
+	if result := existingTeam.load(id); !result.IsOk() {
+		return result
+	}
+
+	// Check perms
+	if !existingTeam.isAllowedToManage(request.AccessToken) {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Validate
+	if team.ID != nil && team.ID.String() != id {
+		return rest.Result{Code: 400, Message: "mismatch between URL and JSON IDs"}
+	}
+	if team.TrackID != "" && team.TrackID != existingTeam.TrackID {
+		return rest.Result{Code: 400, Message: "cannot change track"}
+	}
+	existingTeam.Name = team.Name
+	if result := existingTeam.validate(); !result.IsOk() {
+		return result
+	}
+
+	// Update
+	dbResult := db.Update("teams", &existingTeam, "id", "=", existingTeam.ID)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	return rest.Result{}
+}
+
+// Delete deletes a team.
+func (team *Team) Delete(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+
+	// Check if it exists
+	if result := team.load(id); !result.IsOk() {
+		return result
+	}
+
+	// Delete it and the memberships
+	dbResult := db.Delete("team_members", "team", "=", team.ID)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	dbResult = db.Delete("teams", "id", "=", team.ID)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	return rest.Result{}
+}
+
+// Post adds the current user to the team with the invite code.
+func (joinRequest *TeamJoinRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	userID := request.AccessToken.OwnerUserID
+	if userID == nil {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Find team
+	if joinRequest.InviteCode == "" {
+		return rest.Result{Code: 400, Message: "missing invite code"}
+	}
+	var team Team
+	dbResult := db.Select(&team, "teams", "invite_code", "=", joinRequest.InviteCode)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "invalid invite code"}
+	}
+	if err := team.loadMembers(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+
+	// Validate and join
+	if result := team.validateNewMember(*userID); !result.IsOk() {
+		return result
+	}
+	if err := team.addMember(*userID); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	return rest.Result{Code: 303, Location: fmt.Sprintf("%v/team/%v/", config.Config.SitePrefix, team.ID)}
+}
+
+// Post removes the current user from the team.
+// Operators/admins may remove other users by specifying the "user" query arg.
+func (leaveRequest *TeamLeaveRequest) Post(request *rest.Request) rest.Result {
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+	var team Team
+	if result := team.load(id); !result.IsOk() {
+		return result
+	}
+
+	// Check perms and find user
+	var userID uuid.UUID
+	if rawUserID, ok := request.QueryArgs["user"]; ok {
+		if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+			return rest.UnauthorizedResult(request.AccessToken)
+		}
+		parsedUserID, parseErr := uuid.Parse(rawUserID)
+		if parseErr != nil {
+			return rest.Result{Code: 400, Message: "invalid user ID"}
+		}
+		userID = parsedUserID
+	} else {
+		if request.AccessToken.OwnerUserID == nil {
+			return rest.UnauthorizedResult(request.AccessToken)
+		}
+		userID = *request.AccessToken.OwnerUserID
+	}
+	if !team.hasMember(userID) {
+		return rest.Result{Code: 404, Message: "user is not a member of the team"}
+	}
+
+	// Leave
+	dbResult := db.Delete("team_members", "team", "=", team.ID, "user", "=", userID)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	return rest.Result{}
+}
+
+func (team *Team) load(id string) rest.Result {
+	dbResult := db.Select(team, "teams", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+	if err := team.loadMembers(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	return rest.Result{}
+}
+
+func (team *Team) loadMembers() error {
+	var members TeamMembers
+	dbResult := db.SelectMany(&members, "team_members", "team", "=", team.ID)
+	if dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	team.MemberIDs = make([]uuid.UUID, 0, len(members))
+	for _, member := range members {
+		team.MemberIDs = append(team.MemberIDs, *member.UserID)
+	}
+	return nil
+}
+
+func (team *Team) addMember(userID uuid.UUID) error {
+	now := time.Now()
+	member := TeamMember{
+		TeamID:   team.ID,
+		UserID:   &userID,
+		JoinTime: &now,
+	}
+	dbResult := db.Insert("team_members", member)
+	if dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	return nil
+}
+
+// insertWithMembers inserts the team and its members in one transaction, so no team is left without its members.
+func (team *Team) insertWithMembers() error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO teams (id, track, name, invite_code) VALUES ($1, $2, $3, $4)",
+		team.ID.String(), team.TrackID, team.Name, team.InviteCode); err != nil {
+		tx.Rollback()
+		return err
+	}
+	now := time.Now()
+	for _, userID := range team.MemberIDs {
+		if _, err := tx.Exec("INSERT INTO team_members (team, \"user\", join_time) VALUES ($1, $2, $3)",
+			team.ID.String(), userID.String(), now); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (team *Team) hasMember(userID uuid.UUID) bool {
+	for _, memberID := range team.MemberIDs {
+		if memberID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+func (team *Team) hasMemberString(rawUserID string) bool {
+	userID, err := uuid.Parse(rawUserID)
+	return err == nil && team.hasMember(userID)
+}
+
+// isAllowedToManage checks if the token is an operator/admin or a member of the team.
+func (team *Team) isAllowedToManage(token rest.AccessTokenEntry) bool {
+	if token.GetRole() == rest.RoleOperator || token.GetRole() == rest.RoleAdmin {
+		return true
+	}
+	return token.OwnerUserID != nil && team.hasMember(*token.OwnerUserID)
+}
+
+func (team *Team) hideInviteCode(token rest.AccessTokenEntry) {
+	if !team.isAllowedToManage(token) {
+		team.InviteCode = ""
+	}
+}
+
+func (team *Team) exists() (bool, error) {
+	var count int
+	row := db.DB.QueryRow("SELECT COUNT(*) FROM teams WHERE id = $1 OR (track = $2 AND name = $3)", team.ID, team.TrackID, team.Name)
+	rowErr := row.Scan(&count)
+	if rowErr != nil {
+		return false, rowErr
+	}
+	return count > 0, nil
+}
+
+func (team *Team) validate() rest.Result {
+	switch {
+	case team.ID == nil:
+		return rest.Result{Code: 400, Message: "missing ID"}
+	case team.TrackID == "":
+		return rest.Result{Code: 400, Message: "missing track ID"}
+	case team.Name == "":
+		return rest.Result{Code: 400, Message: "missing name"}
+	}
+
+	track := Track{ID: team.TrackID}
+	if exists, err := track.exists(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	} else if !exists {
+		return rest.Result{Code: 400, Message: "referenced track does not exist"}
+	}
+
+	return rest.Result{}
+}
+
+// validateNewMember checks if the user may join the team, without adding it.
+func (team *Team) validateNewMember(userID uuid.UUID) rest.Result {
+	user := rest.User{ID: &userID}
+	if exists, err := user.ExistsWithID(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	} else if !exists {
+		return rest.Result{Code: 400, Message: "referenced user does not exist"}
+	}
+	if team.hasMember(userID) {
+		return rest.Result{Code: 409, Message: "user is already a member of the team"}
+	}
+	if maxSize := config.Config.Tracks[team.TrackID].MaxTeamSize; maxSize > 0 && len(team.MemberIDs) >= maxSize {
+		return rest.Result{Code: 409, Message: "team is full"}
+	}
+
+	// One team per track
+	var count int
+	row := db.DB.QueryRow("SELECT COUNT(*) FROM team_members INNER JOIN teams ON teams.id = team_members.team WHERE teams.track = $1 AND team_members.\"user\" = $2", team.TrackID, userID)
+	if err := row.Scan(&count); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	if count > 0 {
+		return rest.Result{Code: 409, Message: "user is already in a team for this track"}
+	}
+
+	return rest.Result{}
+}
+
+// isTeamMember checks if the user is a member of the team.
+func isTeamMember(teamID uuid.UUID, userID uuid.UUID) (bool, error) {
+	dbResult := db.Exists("team_members", "team", "=", teamID, "user", "=", userID)
+	if dbResult.IsFailed() {
+		return false, dbResult.Error
+	}
+	return dbResult.IsSuccess(), nil
+}
+
+func generateInviteCode() (string, error) {
+	raw := make([]byte, inviteCodeLengthBytes)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.EncodeToString(raw), nil
+}
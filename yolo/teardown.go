@@ -0,0 +1,202 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/event"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/gathering/tech-online-backend/scheduler"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	teardownSchedulerInterval  = 1 * time.Minute
+	defaultTeardownGrace       = 5 * time.Minute
+	defaultTeardownWarningLead = 5 * time.Minute
+)
+
+// Event types for automatic teardown, sent to the participants of the timeslot.
+const (
+	EventTypeStationTeardownWarning event.Type = "station.teardown_warning" // The station will be released soon
+	EventTypeStationTornDown        event.Type = "station.torn_down"        // The timeslot was ended and the station released
+)
+
+// ReminderKindTeardown is the reminder kind for teardown warnings.
+const ReminderKindTeardown = "teardown"
+
+// StationTeardownHoldRequest is a request to postpone the automatic teardown of a station.
+type StationTeardownHoldRequest struct {
+	Until *time.Time `json:"until"` // Clears the hold if null
+}
+
+func init() {
+	rest.AddHandler("/station/", "^(?P<id>[^/]+)/teardown-hold/$", func() interface{} { return &StationTeardownHoldRequest{} })
+	scheduler.AddJob("teardown-expired-stations", teardownSchedulerInterval, teardownExpiredStations)
+}
+
+// Put sets or clears the teardown hold of a station.
+func (holdRequest *StationTeardownHoldRequest) Put(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	id, idExists := request.PathArgs["id"]
+	if !idExists || id == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+
+	// Get station
+	var station Station
+	dbResult := db.Select(&station, "stations", "id", "=", id)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	if !dbResult.IsSuccess() {
+		return rest.Result{Code: 404, Message: "not found"}
+	}
+
+	// Validate
+	if holdRequest.Until != nil && !holdRequest.Until.After(time.Now()) {
+		return rest.Result{Code: 400, Message: "hold must be in the future"}
+	}
+
+	// Update only the hold, forgetting the warning so it's sent again before the new teardown time
+	if _, err := db.DB.Exec("UPDATE stations SET teardown_hold = $1 WHERE id = $2", holdRequest.Until, station.ID); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	if station.TimeslotID != "" {
+		var timeslot Timeslot
+		if timeslotDBResult := db.Select(&timeslot, "timeslots", "id", "=", station.TimeslotID); timeslotDBResult.IsFailed() {
+			return rest.Result{Code: 500, Error: timeslotDBResult.Error}
+		} else if timeslotDBResult.IsSuccess() {
+			if err := timeslot.clearReminders(ReminderKindTeardown); err != nil {
+				return rest.Result{Code: 500, Error: err}
+			}
+		}
+	}
+	request.Log().WithFields(log.Fields{
+		"station": station.ID,
+		"until":   holdRequest.Until,
+		"actor":   request.AccessToken.GetName(),
+	}).Info("Station teardown hold changed")
+	return rest.Result{Code: 303, Location: fmt.Sprintf("%v/station/%v/", config.Config.SitePrefix, station.ID)}
+}
+
+// teardownExpiredStations ends expired timeslots for tracks with teardown enabled, warning the participants first.
+// A station is torn down after the end time of its timeslot plus the grace time, or after the teardown hold if later.
+func teardownExpiredStations() error {
+	now := time.Now()
+	tracks := make(map[string]*Track)
+	for trackID, trackConfig := range config.Config.Tracks {
+		if !trackConfig.Teardown.Enabled {
+			continue
+		}
+		var track Track
+		dbResult := db.Select(&track, "tracks", "id", "=", trackID)
+		if dbResult.IsFailed() {
+			return dbResult.Error
+		}
+		if dbResult.IsSuccess() {
+			tracks[trackID] = &track
+		}
+	}
+
+	for trackID, track := range tracks {
+		var stations Stations
+		if dbResult := db.SelectMany(&stations, "stations", "track", "=", trackID, "timeslot", "!=", ""); dbResult.IsFailed() {
+			return dbResult.Error
+		}
+		for _, station := range stations {
+			if err := teardownStationIfExpired(track, station, now); err != nil {
+				log.WithError(err).WithField("station", station.ID).Warn("Failed to tear down expired station")
+			}
+		}
+	}
+	return nil
+}
+
+func teardownStationIfExpired(track *Track, station *Station, now time.Time) error {
+	var timeslot Timeslot
+	dbResult := db.Select(&timeslot, "timeslots", "id", "=", station.TimeslotID)
+	if dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	if !dbResult.IsSuccess() || timeslot.EndTime == nil {
+		return nil
+	}
+	teardownConfig := config.Config.Tracks[track.ID].Teardown
+	teardownTime := station.teardownTime(*timeslot.EndTime, teardownConfig)
+
+	// Warn first
+	if now.Before(teardownTime) {
+		warningLead := defaultTeardownWarningLead
+		if teardownConfig.WarningLeadSeconds > 0 {
+			warningLead = time.Duration(teardownConfig.WarningLeadSeconds) * time.Second
+		}
+		if now.Before(teardownTime.Add(-warningLead)) {
+			return nil
+		}
+		if sent, err := timeslot.hasReminder(ReminderKindTeardown); err != nil || sent {
+			return err
+		}
+		if err := timeslot.saveReminder(ReminderKindTeardown); err != nil {
+			return err
+		}
+		timeslot.publishEvent(EventTypeStationTeardownWarning, "Your station will be released soon",
+			fmt.Sprintf("Your timeslot has ended and station %v will be released at %v. Save anything you want to keep.", station.Name, displayTime(teardownTime).Format("15:04")), station)
+		return nil
+	}
+
+	// Tear down, keeping the end time of the timeslot
+	if result := timeslot.finish(track, station, *timeslot.EndTime); !result.IsOk() {
+		if result.Error != nil {
+			return result.Error
+		}
+		return fmt.Errorf("%v", result.Message)
+	}
+	log.WithFields(log.Fields{
+		"station":  station.ID,
+		"timeslot": timeslot.ID,
+	}).Info("Tore down expired station")
+	timeslot.publishEvent(EventTypeStationTornDown, "Your station was released",
+		fmt.Sprintf("Your timeslot for track %v has ended and station %v was released.", track.ID, station.Name), station)
+	return nil
+}
+
+// teardownTime is when the station is torn down, after the grace time or the hold if later.
+func (station *Station) teardownTime(endTime time.Time, teardownConfig config.TeardownConfig) time.Time {
+	grace := defaultTeardownGrace
+	if teardownConfig.GraceSeconds > 0 {
+		grace = time.Duration(teardownConfig.GraceSeconds) * time.Second
+	}
+	teardownTime := endTime.Add(grace)
+	if station.TeardownHold != nil && station.TeardownHold.After(teardownTime) {
+		teardownTime = *station.TeardownHold
+	}
+	return teardownTime
+}
@@ -24,35 +24,70 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/gathering/tech-online-backend/attachment"
 	"github.com/gathering/tech-online-backend/config"
 	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/event"
 	"github.com/gathering/tech-online-backend/rest"
 	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// Event types for tests changing status, sent to the participants of the station timeslot (if any).
+const (
+	EventTypeTestPassed event.Type = "test.passed" // Failed before
+	EventTypeTestFailed event.Type = "test.failed" // Passed before
 )
 
 // Test is a test of a task.
 // Track ID, task shortname and station shortname are used because clients aren't expected to know the task or station UUIDs.
 type Test struct {
-	ID                *uuid.UUID `column:"id" json:"id"`                               // Generated, required, unique
-	TrackID           string     `column:"track" json:"track"`                         // Required
-	TaskShortname     string     `column:"task_shortname" json:"task_shortname"`       // Required
-	Shortname         string     `column:"shortname" json:"shortname"`                 // Required
-	StationShortname  string     `column:"station_shortname" json:"station_shortname"` // Required
-	TimeslotID        string     `column:"timeslot" json:"timeslot"`                   // Automatic, NULL if no current timeslot
-	Name              string     `column:"name" json:"name"`                           // Required
-	Description       string     `column:"description" json:"description"`
-	Sequence          *int       `column:"sequence" json:"sequence"`
-	Timestamp         *time.Time `column:"timestamp" json:"timestamp"`           // Generated, required
-	StatusSuccess     *bool      `column:"status_success" json:"status_success"` // Required
-	StatusDescription string     `column:"status_description" json:"status_description"`
+	ID                *uuid.UUID             `column:"id" json:"id" brief:"true"`                               // Generated, required, unique
+	TrackID           string                 `column:"track" json:"track" brief:"true"`                         // Required
+	TaskShortname     string                 `column:"task_shortname" json:"task_shortname" brief:"true"`       // Required
+	Shortname         string                 `column:"shortname" json:"shortname" brief:"true"`                 // Required
+	StationShortname  string                 `column:"station_shortname" json:"station_shortname" brief:"true"` // Required
+	TimeslotID        string                 `column:"timeslot" json:"timeslot"`                                // Automatic, NULL if no current timeslot
+	Name              string                 `column:"name" json:"name"`                                        // Required
+	Description       string                 `column:"description" json:"description"`
+	Sequence          *int                   `column:"sequence" json:"sequence"`
+	Timestamp         *time.Time             `column:"timestamp" json:"timestamp"`                        // Generated, required
+	StatusSuccess     *bool                  `column:"status_success" json:"status_success" brief:"true"` // Required
+	StatusDescription string                 `column:"status_description" json:"status_description"`
+	Artifacts         attachment.Attachments `column:"-" json:"artifacts,omitempty"` // Only for single tests, uploaded as attachments for the test
 }
 
 // Tests is a list of tests.
 type Tests []*Test
 
+// TestTransition is the event data for a test changing status.
+type TestTransition struct {
+	Test              *Test      `json:"test"`
+	TaskName          string     `json:"task_name"`
+	StationID         *uuid.UUID `json:"station_id"`
+	StationName       string     `json:"station_name"`
+	PreviousTimestamp *time.Time `json:"previous_timestamp"` // When the previous status was reported
+}
+
 func init() {
 	rest.AddHandler("/tests/", "^$", func() interface{} { return &Tests{} })
 	rest.AddHandler("/test/", "^(?:(?P<id>[^/]+)/)?$", func() interface{} { return &Test{} })
+	rest.SetCachePolicy(&Tests{}, rest.CachePolicy{NoStore: true})
+	rest.SetCachePolicy(&Test{}, rest.CachePolicy{NoStore: true})
+}
+
+// QueryFilterFields gets the fields which may be filtered with query operators, also for bulk deletes.
+func (tests *Tests) QueryFilterFields() rest.QueryFilterFields {
+	return rest.QueryFilterFields{
+		"track":             rest.QueryFilterString,
+		"task_shortname":    rest.QueryFilterString,
+		"shortname":         rest.QueryFilterString,
+		"station_shortname": rest.QueryFilterString,
+		"timeslot":          rest.QueryFilterString,
+		"sequence":          rest.QueryFilterInt,
+		"timestamp":         rest.QueryFilterTime,
+		"status_success":    rest.QueryFilterBool,
+	}
 }
 
 // Get gets multiple tests.
@@ -79,6 +114,7 @@ func (tests *Tests) Get(request *rest.Request) rest.Result {
 	if _, ok := request.QueryArgs["latest"]; ok {
 		whereArgs = append(whereArgs, "timeslot", "=", "")
 	}
+	whereArgs = append(whereArgs, request.Filters...)
 
 	// Get
 	dbResult := db.SelectMany(tests, "tests", whereArgs...)
@@ -89,25 +125,22 @@ func (tests *Tests) Get(request *rest.Request) rest.Result {
 }
 
 // Post posts multiple tests which may overwrite old ones.
+// All tests are validated before any are saved, see rest.WriteItems for the per-item errors.
 func (tests *Tests) Post(request *rest.Request) rest.Result {
 	// Check perms
 	if request.AccessToken.GetRole() != rest.RoleTester && request.AccessToken.GetRole() != rest.RoleAdmin {
 		return rest.UnauthorizedResult(request.AccessToken)
 	}
 
-	// Feed individual tests to the individual post endpoint, stop on first error
-	totalResult := rest.Result{}
-	for _, test := range *tests {
-		result := test.Post(request)
-		if !result.IsOk() {
-			return result
-		}
-	}
-
-	return totalResult
+	// Prepare and validate all, then save each
+	return rest.WriteItems(request, len(*tests), func(i int) rest.Result {
+		return (*tests)[i].prepare()
+	}, func(i int) rest.Result {
+		return (*tests)[i].save()
+	})
 }
 
-// Delete delete multiple tests.
+// Delete deletes multiple tests, as a bulk delete (see rest.CheckBulkDelete).
 func (tests *Tests) Delete(request *rest.Request) rest.Result {
 	// Check perms
 	if request.AccessToken.GetRole() != rest.RoleTester && request.AccessToken.GetRole() != rest.RoleAdmin {
@@ -134,20 +167,30 @@ func (tests *Tests) Delete(request *rest.Request) rest.Result {
 	if _, ok := request.QueryArgs["latest"]; ok {
 		whereArgs = append(whereArgs, "timeslot", "=", "")
 	}
+	whereArgs = append(whereArgs, request.Filters...)
+	if result := rest.CheckBulkDelete(request, whereArgs); !result.IsOk() {
+		return result
+	}
 
-	// Find all to delete
+	// Find all to delete, to respond with them
 	dbResult := db.SelectMany(tests, "tests", whereArgs...)
 	if dbResult.IsFailed() {
 		return rest.Result{Code: 500, Error: dbResult.Error}
 	}
 
-	// Delete one by one, exit on first error
+	// Delete all in one go, including the artifacts
+	ids := make([]uuid.UUID, 0, len(*tests))
+	rawIDs := make([]string, 0, len(*tests))
 	for _, test := range *tests {
-		dbResult := db.Delete("tests", "id", "=", test.ID)
-		if dbResult.IsFailed() {
-			return rest.Result{Code: 500, Error: dbResult.Error}
-		}
+		ids = append(ids, *test.ID)
+		rawIDs = append(rawIDs, test.ID.String())
+	}
+	deleteDBResult := db.Delete("tests", "id", "IN", rawIDs)
+	if deleteDBResult.IsFailed() {
+		return rest.Result{Code: 500, Error: deleteDBResult.Error}
 	}
+	deleteTestArtifacts(ids)
+	request.Log().WithField("tests", deleteDBResult.Affected).Info("Bulk deleted tests")
 
 	return rest.Result{}
 }
@@ -168,6 +211,9 @@ func (test *Test) Get(request *rest.Request) rest.Result {
 	if !dbResult.IsSuccess() {
 		return rest.Result{Code: 404, Message: "not found"}
 	}
+	if err := test.loadArtifacts(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
 	return rest.Result{}
 }
 
@@ -178,18 +224,71 @@ func (test *Test) Post(request *rest.Request) rest.Result {
 		return rest.UnauthorizedResult(request.AccessToken)
 	}
 
-	// Overwrite certain fields
+	// Prepare and validate
+	if result := test.prepare(); !result.IsOk() {
+		return result
+	}
+
+	// Save
+	result := test.save()
+	if !result.IsOk() {
+		return result
+	}
+	result.Code = 201
+	result.Location = fmt.Sprintf("%v/test/%v", config.Config.SitePrefix, test.ID)
+	return result
+}
+
+// prepare overwrites the generated fields of a posted test and validates it.
+func (test *Test) prepare() rest.Result {
 	newID := uuid.New()
 	test.ID = &newID
 	test.TimeslotID = ""
 	now := time.Now()
 	test.Timestamp = &now
+	return test.validate()
+}
 
-	// Validate
-	if result := test.validate(); !result.IsOk() {
-		return result
+// Delete deletes a test.
+func (test *Test) Delete(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleTester && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params
+	rawID, rawIDExists := request.PathArgs["id"]
+	if !rawIDExists || rawID == "" {
+		return rest.Result{Code: 400, Message: "missing ID"}
+	}
+	id, uuidError := uuid.Parse(rawID)
+	if uuidError != nil {
+		return rest.Result{Code: 400, Message: "invalid ID"}
+	}
+
+	// Check if it exists
+	test.ID = &id
+	exists, err := test.exists()
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	if !exists {
+		return rest.Result{Code: 404, Message: "not found"}
 	}
 
+	// Delete it
+	dbResult := db.Delete("tests", "id", "=", test.ID)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	deleteTestArtifacts([]uuid.UUID{*test.ID})
+	return rest.Result{}
+}
+
+// save binds the test to the active timeslot of the station (if any) and saves it, overwriting old equivalent tests.
+// A clone without the timeslot is saved too, as the latest result for the station.
+// Status changes are added to the history and the timeslot score is updated.
+func (test *Test) save() rest.Result {
 	// Bind to the active timeslot, if any
 	var station Station
 	stationDBResult := db.Select(&station, "stations",
@@ -204,12 +303,39 @@ func (test *Test) Post(request *rest.Request) rest.Result {
 	}
 	test.TimeslotID = station.TimeslotID
 
-	// Delete old equivalent tests, both without timeslot and with the current timeslot
-	_, deleteErr := db.DB.Exec("DELETE FROM tests WHERE track = $1 AND task_shortname = $2 AND shortname = $3 AND station_shortname = $4 AND (timeslot = $5 OR timeslot = '')",
+	// Find the previous status within the same timeslot (or outside timeslots), to detect transitions
+	var previousTest Test
+	previousDBResult := db.Select(&previousTest, "tests",
+		"track", "=", test.TrackID,
+		"task_shortname", "=", test.TaskShortname,
+		"shortname", "=", test.Shortname,
+		"station_shortname", "=", test.StationShortname,
+		"timeslot", "=", test.TimeslotID,
+	)
+	if previousDBResult.IsFailed() {
+		return rest.Result{Code: 500, Error: previousDBResult.Error}
+	}
+
+	// Delete old equivalent tests, both without timeslot and with the current timeslot, including their artifacts
+	deletedRows, deleteErr := db.DB.Query("DELETE FROM tests WHERE track = $1 AND task_shortname = $2 AND shortname = $3 AND station_shortname = $4 AND (timeslot = $5 OR timeslot = '') RETURNING id",
 		test.TrackID, test.TaskShortname, test.Shortname, test.StationShortname, test.TimeslotID)
 	if deleteErr != nil {
 		return rest.Result{Code: 500, Error: deleteErr}
 	}
+	var deletedIDs []uuid.UUID
+	for deletedRows.Next() {
+		var deletedID uuid.UUID
+		if err := deletedRows.Scan(&deletedID); err != nil {
+			deletedRows.Close()
+			return rest.Result{Code: 500, Error: err}
+		}
+		deletedIDs = append(deletedIDs, deletedID)
+	}
+	deletedRows.Close()
+	if err := deletedRows.Err(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	deleteTestArtifacts(deletedIDs)
 
 	// Save clone without timeslot
 	if test.TimeslotID != "" {
@@ -224,48 +350,70 @@ func (test *Test) Post(request *rest.Request) rest.Result {
 	}
 
 	// Save original with timeslot
-	result := test.create()
-	if !result.IsOk() {
+	if result := test.create(); !result.IsOk() {
 		return result
 	}
-	result.Code = 201
-	result.Location = fmt.Sprintf("%v/test/%v", config.Config.SitePrefix, test.ID)
-	return result
-}
-
-// Delete deletes a test.
-func (test *Test) Delete(request *rest.Request) rest.Result {
-	// Check perms
-	if request.AccessToken.GetRole() != rest.RoleTester && request.AccessToken.GetRole() != rest.RoleAdmin {
-		return rest.UnauthorizedResult(request.AccessToken)
+	if err := test.saveHistory(); err != nil {
+		return rest.Result{Code: 500, Error: err}
 	}
-
-	// Check params
-	rawID, rawIDExists := request.PathArgs["id"]
-	if !rawIDExists || rawID == "" {
-		return rest.Result{Code: 400, Message: "missing ID"}
+	if test.TimeslotID != "" {
+		if err := saveTimeslotScore(test.TimeslotID); err != nil {
+			log.WithError(err).WithField("timeslot", test.TimeslotID).Warn("Failed to update score after saving test")
+		}
 	}
-	id, uuidError := uuid.Parse(rawID)
-	if uuidError != nil {
-		return rest.Result{Code: 400, Message: "invalid ID"}
+
+	if previousDBResult.IsSuccess() && previousTest.StatusSuccess != nil && *previousTest.StatusSuccess != *test.StatusSuccess {
+		test.publishTransition(&station, previousTest.Timestamp)
 	}
+	return rest.Result{}
+}
 
-	// Check if it exists
-	test.ID = &id
-	exists, err := test.exists()
-	if err != nil {
-		return rest.Result{Code: 500, Error: err}
+// publishTransition publishes an event for the test changing status, to the participants of the station timeslot (if any).
+func (test *Test) publishTransition(station *Station, previousTimestamp *time.Time) {
+	transition := TestTransition{
+		Test:              test,
+		StationID:         station.ID,
+		StationName:       station.Name,
+		PreviousTimestamp: previousTimestamp,
 	}
-	if !exists {
-		return rest.Result{Code: 404, Message: "not found"}
+	var task Task
+	if dbResult := db.Select(&task, "tasks", "track", "=", test.TrackID, "shortname", "=", test.TaskShortname); dbResult.IsSuccess() {
+		transition.TaskName = task.Name
 	}
 
-	// Delete it
-	dbResult := db.Delete("tests", "id", "=", test.ID)
-	if dbResult.IsFailed() {
-		return rest.Result{Code: 500, Error: dbResult.Error}
+	var userIDs []uuid.UUID
+	if test.TimeslotID != "" {
+		var timeslot Timeslot
+		if dbResult := db.Select(&timeslot, "timeslots", "id", "=", test.TimeslotID); dbResult.IsSuccess() {
+			var err error
+			userIDs, err = timeslot.participantIDs()
+			if err != nil {
+				log.WithError(err).WithField("timeslot", test.TimeslotID).Warn("Failed to get participants for test event")
+			}
+		}
 	}
-	return rest.Result{}
+
+	eventType := EventTypeTestPassed
+	title := fmt.Sprintf("Test passed: %v", test.Name)
+	status := "passing"
+	if !*test.StatusSuccess {
+		eventType = EventTypeTestFailed
+		title = fmt.Sprintf("Test failed: %v", test.Name)
+		status = "failing"
+	}
+	message := fmt.Sprintf("Test %v (%v) for task %v on station %v (track %v) is now %v.",
+		test.Name, test.Shortname, test.TaskShortname, test.StationShortname, test.TrackID, status)
+	if test.StatusDescription != "" {
+		message += fmt.Sprintf(" Details: %v", test.StatusDescription)
+	}
+	event.Publish(event.Event{
+		Type:    eventType,
+		TrackID: test.TrackID,
+		UserIDs: userIDs,
+		Title:   title,
+		Message: message,
+		Data:    transition,
+	})
 }
 
 func (test *Test) create() rest.Result {
@@ -0,0 +1,103 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"github.com/gathering/tech-online-backend/attachment"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// Test artifacts are attachments (e.g. pcaps, config dumps and screenshots) uploaded by checkers for a test.
+// Since tests are replaced when reposted, the artifacts of replaced tests are deleted with them.
+
+func init() {
+	attachment.RegisterOwnerType(attachment.OwnerTypeTest, attachment.OwnerTypeHandler{
+		Exists:    testExists,
+		CanUpload: canUploadTestArtifacts,
+		CanView:   canViewTestArtifacts,
+	})
+}
+
+func testExists(testID string) (bool, error) {
+	if _, err := uuid.Parse(testID); err != nil {
+		return false, nil
+	}
+	dbResult := db.Exists("tests", "id", "=", testID)
+	if dbResult.IsFailed() {
+		return false, dbResult.Error
+	}
+	return dbResult.IsSuccess(), nil
+}
+
+func canUploadTestArtifacts(token rest.AccessTokenEntry) bool {
+	return token.GetRole() == rest.RoleTester
+}
+
+// canViewTestArtifacts allows testers and the participants of the test timeslot, in addition to operators/admins.
+func canViewTestArtifacts(testID string, token rest.AccessTokenEntry) (bool, error) {
+	if token.GetRole() == rest.RoleTester {
+		return true, nil
+	}
+	if token.OwnerUserID == nil {
+		return false, nil
+	}
+	var test Test
+	dbResult := db.Select(&test, "tests", "id", "=", testID)
+	if dbResult.IsFailed() {
+		return false, dbResult.Error
+	}
+	if !dbResult.IsSuccess() || test.TimeslotID == "" {
+		return false, nil
+	}
+	var timeslot Timeslot
+	timeslotDBResult := db.Select(&timeslot, "timeslots", "id", "=", test.TimeslotID)
+	if timeslotDBResult.IsFailed() {
+		return false, timeslotDBResult.Error
+	}
+	if !timeslotDBResult.IsSuccess() {
+		return false, nil
+	}
+	return timeslot.isParticipant(token.OwnerUserID)
+}
+
+// loadArtifacts loads the metadata of the test artifacts.
+func (test *Test) loadArtifacts() error {
+	var artifacts attachment.Attachments
+	dbResult := db.SelectMany(&artifacts, "attachments", "owner_type", "=", attachment.OwnerTypeTest, "owner_id", "=", test.ID.String())
+	if dbResult.IsFailed() {
+		return dbResult.Error
+	}
+	test.Artifacts = artifacts
+	return nil
+}
+
+// deleteTestArtifacts deletes the artifacts of tests about to be deleted.
+// Failures are only logged, since the tests are gone either way.
+func deleteTestArtifacts(testIDs []uuid.UUID) {
+	for _, testID := range testIDs {
+		if err := attachment.DeleteForOwner(attachment.OwnerTypeTest, testID.String()); err != nil {
+			log.WithError(err).WithField("test", testID).Warn("Failed to delete test artifacts")
+		}
+	}
+}
@@ -0,0 +1,157 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+package yolo
+
+import (
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/google/uuid"
+)
+
+// TestHistoryEntry is a status change of a test, i.e. the start of a period where it had the same status (within the same timeslot).
+type TestHistoryEntry struct {
+	ID                *uuid.UUID `column:"id" json:"id"`
+	TrackID           string     `column:"track" json:"track"`
+	TaskShortname     string     `column:"task_shortname" json:"task_shortname"`
+	Shortname         string     `column:"shortname" json:"shortname"`
+	StationShortname  string     `column:"station_shortname" json:"station_shortname"`
+	TimeslotID        string     `column:"timeslot" json:"timeslot"`
+	Name              string     `column:"name" json:"name"`
+	Timestamp         *time.Time `column:"timestamp" json:"timestamp"` // When the status was first reported
+	StatusSuccess     bool       `column:"status_success" json:"status_success"`
+	StatusDescription string     `column:"status_description" json:"status_description"` // As first reported
+	EndTimestamp      *time.Time `column:"-" json:"end_timestamp"`                       // When the next status was first reported, null if still current
+	DurationSeconds   int        `column:"-" json:"duration_seconds"`                    // Until the end or now
+}
+
+// TestHistory is the status changes of tests, ordered by test and time.
+type TestHistory []*TestHistoryEntry
+
+func init() {
+	rest.AddHandler("/test-history/", "^(?P<track_id>[^/]+)/(?P<station_shortname>[^/]+)/(?P<task_shortname>[^/]+)/$", func() interface{} { return &TestHistory{} })
+}
+
+// Get gets the status changes of the tests of a task for a station, with durations.
+// Use the "test" query arg to limit to a single test (shortname), "timeslot" to limit to a timeslot
+// and "since"/"until" (RFC 3339) to limit the time range.
+func (history *TestHistory) Get(request *rest.Request) rest.Result {
+	// Check params, prep filtering
+	whereArgs := []interface{}{
+		"track", "=", request.PathArgs["track_id"],
+		"station_shortname", "=", request.PathArgs["station_shortname"],
+		"task_shortname", "=", request.PathArgs["task_shortname"],
+	}
+	if shortname, ok := request.QueryArgs["test"]; ok {
+		whereArgs = append(whereArgs, "shortname", "=", shortname)
+	}
+	if timeslotID, ok := request.QueryArgs["timeslot"]; ok {
+		whereArgs = append(whereArgs, "timeslot", "=", timeslotID)
+	}
+	var since, until *time.Time
+	for _, arg := range []struct {
+		name   string
+		target **time.Time
+	}{{"since", &since}, {"until", &until}} {
+		if rawTime, ok := request.QueryArgs[arg.name]; ok {
+			parsedTime, err := time.Parse(time.RFC3339, rawTime)
+			if err != nil {
+				return rest.Result{Code: 400, Message: "invalid " + arg.name + " time"}
+			}
+			*arg.target = &parsedTime
+		}
+	}
+	if until != nil {
+		whereArgs = append(whereArgs, "timestamp", "<", until)
+	}
+
+	// Get
+	dbResult := db.SelectMany(history, "test_history", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	history.calculateDurations(time.Now())
+
+	// Periods which ended before the range are not interesting, but the one which was current at the start is
+	if since != nil {
+		var filtered TestHistory
+		for _, entry := range *history {
+			if entry.EndTimestamp == nil || !entry.EndTimestamp.Before(*since) {
+				filtered = append(filtered, entry)
+			}
+		}
+		*history = filtered
+	}
+	return rest.Result{}
+}
+
+// calculateDurations sorts the entries by test and time and sets the end times and durations.
+func (history *TestHistory) calculateDurations(now time.Time) {
+	entries := *history
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Shortname != entries[j].Shortname {
+			return entries[i].Shortname < entries[j].Shortname
+		}
+		return entries[i].Timestamp.Before(*entries[j].Timestamp)
+	})
+	for i, entry := range entries {
+		end := now
+		if i+1 < len(entries) && entries[i+1].Shortname == entry.Shortname {
+			nextTimestamp := *entries[i+1].Timestamp
+			entry.EndTimestamp = &nextTimestamp
+			end = nextTimestamp
+		}
+		entry.DurationSeconds = int(end.Sub(*entry.Timestamp) / time.Second)
+	}
+}
+
+// saveHistory adds the test to the history if the status or timeslot changed since the last entry for the station.
+func (test *Test) saveHistory() error {
+	var lastSuccess bool
+	var lastTimeslotID sql.NullString
+	row := db.DB.QueryRow("SELECT status_success, timeslot FROM test_history WHERE track = $1 AND task_shortname = $2 AND shortname = $3 AND station_shortname = $4 ORDER BY timestamp DESC LIMIT 1",
+		test.TrackID, test.TaskShortname, test.Shortname, test.StationShortname)
+	err := row.Scan(&lastSuccess, &lastTimeslotID)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == nil && lastSuccess == *test.StatusSuccess && lastTimeslotID.String == test.TimeslotID {
+		return nil
+	}
+
+	newID := uuid.New()
+	entry := TestHistoryEntry{
+		ID:                &newID,
+		TrackID:           test.TrackID,
+		TaskShortname:     test.TaskShortname,
+		Shortname:         test.Shortname,
+		StationShortname:  test.StationShortname,
+		TimeslotID:        test.TimeslotID,
+		Name:              test.Name,
+		Timestamp:         test.Timestamp,
+		StatusSuccess:     *test.StatusSuccess,
+		StatusDescription: test.StatusDescription,
+	}
+	dbResult := db.Insert("test_history", entry)
+	return dbResult.Error
+}
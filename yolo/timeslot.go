@@ -26,20 +26,30 @@ import (
 
 	"github.com/gathering/tech-online-backend/config"
 	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/event"
 	"github.com/gathering/tech-online-backend/rest"
 	"github.com/google/uuid"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
 )
 
 // Timeslot is a participation object used both for registration (without time and station), planning (with time) and station binding (station with this timeslot).
 type Timeslot struct {
-	ID        *uuid.UUID `column:"id" json:"id"`                 // Generated, required, unique
-	UserID    *uuid.UUID `column:"user" json:"user"`             // Required
-	TrackID   string     `column:"track" json:"track"`           // Required
-	BeginTime *time.Time `column:"begin_time" json:"begin_time"` // Empty upon registration, used strictly for manual purposes
-	EndTime   *time.Time `column:"end_time" json:"end_time"`     // Empty upon registration, used strictly for manual purposes
-	Notes     string     `column:"notes" json:"notes"`           // Optional
+	ID           *uuid.UUID       `column:"id" json:"id" brief:"true"`                 // Generated, required, unique
+	UserID       *uuid.UUID       `column:"user" json:"user" brief:"true"`             // Required
+	TrackID      string           `column:"track" json:"track" brief:"true"`           // Required
+	BeginTime    *time.Time       `column:"begin_time" json:"begin_time" brief:"true"` // Empty upon registration, used strictly for manual purposes
+	EndTime      *time.Time       `column:"end_time" json:"end_time" brief:"true"`     // Empty upon registration, used strictly for manual purposes
+	Notes        string           `column:"notes" json:"notes"`                        // Optional
+	TeamID       *uuid.UUID       `column:"team" json:"team"`                          // Optional, lets all members of the team (including the user) use the timeslot
+	NoAutoAssign bool             `column:"no_auto_assign" json:"no_auto_assign"`      // Prevents automatic station assignment, set when an operator unassigns the station
+	Category     TimeslotCategory `column:"category" json:"category" brief:"true"`     // Decides the booking rules and assignment priority, defaults to participant
+	State        TimeslotState    `column:"state" json:"state" brief:"true"`           // Requested or approved (default) when created, then changed by the lifecycle endpoints and the scheduler
 }
 
+// EventTypeTimeslotBooked is published when a timeslot is created. It has no recipients, it's meant for the event bus and webhooks.
+const EventTypeTimeslotBooked event.Type = "timeslot.booked" // Data is the timeslot
+
 // Timeslots is a list of timeslots.
 type Timeslots []*Timeslot
 
@@ -52,10 +62,23 @@ type TimeslotEndRequest struct{}
 func init() {
 	rest.AddHandler("/timeslots/", "^$", func() interface{} { return &Timeslots{} })
 	rest.AddHandler("/timeslot/", "^(?:(?P<id>[^/]+)/)?$", func() interface{} { return &Timeslot{} })
+	rest.SetCachePolicy(&Timeslots{}, rest.CachePolicy{NoStore: true})
+	rest.SetCachePolicy(&Timeslot{}, rest.CachePolicy{NoStore: true})
 	rest.AddHandler("/timeslot/", "^(?P<id>[^/]+)/begin/$", func() interface{} { return &TimeslotBeginRequest{} })
 	rest.AddHandler("/timeslot/", "^(?P<id>[^/]+)/end/$", func() interface{} { return &TimeslotEndRequest{} })
 }
 
+// QueryFilterFields gets the fields which may be filtered with query operators, also for bulk deletes.
+func (timeslots *Timeslots) QueryFilterFields() rest.QueryFilterFields {
+	return rest.QueryFilterFields{
+		"track":      rest.QueryFilterString,
+		"category":   rest.QueryFilterString,
+		"state":      rest.QueryFilterString,
+		"begin_time": rest.QueryFilterTime,
+		"end_time":   rest.QueryFilterTime,
+	}
+}
+
 // Get gets multiple timeslots.
 func (timeslots *Timeslots) Get(request *rest.Request) rest.Result {
 	// Check params and prep filtering
@@ -64,9 +87,19 @@ func (timeslots *Timeslots) Get(request *rest.Request) rest.Result {
 	if userID, ok := request.QueryArgs["user"]; ok {
 		whereArgs = append(whereArgs, "user", "=", userID)
 	}
+	if teamID, ok := request.QueryArgs["team"]; ok {
+		whereArgs = append(whereArgs, "team", "=", teamID)
+	}
 	if trackID, ok := request.QueryArgs["track"]; ok {
 		whereArgs = append(whereArgs, "track", "=", trackID)
 	}
+	if category, ok := request.QueryArgs["category"]; ok {
+		whereArgs = append(whereArgs, "category", "=", category)
+	}
+	if state, ok := request.QueryArgs["state"]; ok {
+		whereArgs = append(whereArgs, "state", "=", state)
+	}
+	whereArgs = append(whereArgs, request.Filters...)
 
 	// Find
 	dbResult := db.SelectMany(timeslots, "timeslots", whereArgs...)
@@ -74,7 +107,7 @@ func (timeslots *Timeslots) Get(request *rest.Request) rest.Result {
 		return rest.Result{Code: 500, Error: dbResult.Error}
 	}
 
-	// If not operator/admin, hide all non-self-assigned
+	// If not operator/admin, hide all non-self-assigned (including through teams)
 	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
 		oldTimeslots := *timeslots
 		*timeslots = make(Timeslots, 0)
@@ -84,7 +117,9 @@ func (timeslots *Timeslots) Get(request *rest.Request) rest.Result {
 			return rest.Result{}
 		}
 		for _, timeslot := range oldTimeslots {
-			if timeslot.UserID == requestUserID {
+			if isParticipant, err := timeslot.isParticipant(requestUserID); err != nil {
+				return rest.Result{Code: 500, Error: err}
+			} else if isParticipant {
 				*timeslots = append(*timeslots, timeslot)
 			}
 		}
@@ -119,6 +154,64 @@ func (timeslots *Timeslots) Get(request *rest.Request) rest.Result {
 	return rest.Result{}
 }
 
+// Delete deletes multiple timeslots with their scores, as a bulk delete (see rest.CheckBulkDelete), e.g. to reset a track between heats.
+// Timeslots with assigned stations must be ended first.
+func (timeslots *Timeslots) Delete(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Check params, prep filtering
+	var whereArgs []interface{}
+	if userID, ok := request.QueryArgs["user"]; ok {
+		whereArgs = append(whereArgs, "user", "=", userID)
+	}
+	if teamID, ok := request.QueryArgs["team"]; ok {
+		whereArgs = append(whereArgs, "team", "=", teamID)
+	}
+	if trackID, ok := request.QueryArgs["track"]; ok {
+		whereArgs = append(whereArgs, "track", "=", trackID)
+	}
+	if category, ok := request.QueryArgs["category"]; ok {
+		whereArgs = append(whereArgs, "category", "=", category)
+	}
+	whereArgs = append(whereArgs, request.Filters...)
+	if result := rest.CheckBulkDelete(request, whereArgs); !result.IsOk() {
+		return result
+	}
+
+	// Find all to delete, to respond with them
+	dbResult := db.SelectMany(timeslots, "timeslots", whereArgs...)
+	if dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	ids := make([]string, 0, len(*timeslots))
+	var activeIDs []string
+	for _, timeslot := range *timeslots {
+		if active, err := timeslot.isActiveWithStation(); err != nil {
+			return rest.Result{Code: 500, Error: err}
+		} else if active {
+			activeIDs = append(activeIDs, timeslot.ID.String())
+		}
+		ids = append(ids, timeslot.ID.String())
+	}
+	if len(activeIDs) > 0 {
+		return rest.Result{Code: 409, Message: "some timeslots have assigned stations, end them first", Details: activeIDs}
+	}
+
+	// Delete all in one go
+	if dbResult := db.Delete("timeslot_scores", "timeslot", "IN", ids); dbResult.IsFailed() {
+		return rest.Result{Code: 500, Error: dbResult.Error}
+	}
+	deleteDBResult := db.Delete("timeslots", "id", "IN", ids)
+	if deleteDBResult.IsFailed() {
+		return rest.Result{Code: 500, Error: deleteDBResult.Error}
+	}
+	request.Log().WithField("timeslots", deleteDBResult.Affected).Info("Bulk deleted timeslots")
+	return rest.Result{}
+}
+
 // Get gets a single timeslot.
 func (timeslot *Timeslot) Get(request *rest.Request) rest.Result {
 	// Check params
@@ -136,9 +229,11 @@ func (timeslot *Timeslot) Get(request *rest.Request) rest.Result {
 		return rest.Result{Code: 404, Message: "not found"}
 	}
 
-	// Only show if operator/admin or if self-assigned
+	// Only show if operator/admin or if self-assigned (including through teams)
 	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
-		if *request.AccessToken.OwnerUserID != *timeslot.UserID {
+		if isParticipant, err := timeslot.isParticipant(request.AccessToken.OwnerUserID); err != nil {
+			return rest.Result{Code: 500, Error: err}
+		} else if !isParticipant {
 			return rest.UnauthorizedResult(request.AccessToken)
 		}
 	}
@@ -155,16 +250,27 @@ func (timeslot *Timeslot) Post(request *rest.Request) rest.Result {
 	}
 
 	// Validate
+	if result := timeslot.validateNewState(); !result.IsOk() {
+		return result
+	}
 	if result := timeslot.validate(); !result.IsOk() {
 		return result
 	}
 
 	// Only allow if operator/admin or if self-assigned
 	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
-		if *request.AccessToken.OwnerUserID == *timeslot.UserID {
+		if request.AccessToken.OwnerUserID != nil && *request.AccessToken.OwnerUserID == *timeslot.UserID {
 			// Limit access to certain fields if self-assigned and not operator/admin
 			timeslot.BeginTime = nil
 			timeslot.EndTime = nil
+			categoryConfig, _ := timeslot.categoryConfig()
+			if !categoryConfig.SelfBooking {
+				return rest.Result{Code: 403, Message: "category may only be booked by operators/admins"}
+			}
+			timeslot.State = TimeslotStateApproved
+			if categoryConfig.RequireApproval {
+				timeslot.State = TimeslotStateRequested
+			}
 		} else {
 			return rest.UnauthorizedResult(request.AccessToken)
 		}
@@ -175,6 +281,10 @@ func (timeslot *Timeslot) Post(request *rest.Request) rest.Result {
 	if !result.IsOk() {
 		return result
 	}
+	timeslot.publishBooked()
+	if timeslot.BeginTime != nil {
+		timeslot.publishScheduled()
+	}
 	result.Code = 201
 	result.Location = fmt.Sprintf("%v/timeslot/%v/", config.Config.SitePrefix, timeslot.ID)
 	return result
@@ -197,12 +307,37 @@ func (timeslot *Timeslot) Put(request *rest.Request) rest.Result {
 	if timeslot.ID != nil && (*timeslot.ID).String() != id {
 		return rest.Result{Code: 400, Message: "mismatch between URL and JSON IDs"}
 	}
+	var previous Timeslot
+	previousDBResult := db.Select(&previous, "timeslots", "id", "=", id)
+	if previousDBResult.IsFailed() {
+		return rest.Result{Code: 500, Error: previousDBResult.Error}
+	}
+	if previousDBResult.IsSuccess() {
+		// The state is changed through the lifecycle endpoints only
+		if timeslot.State != "" && timeslot.State != previous.State {
+			return rest.Result{Code: 400, Message: "state may only be changed through the lifecycle endpoints (approve, begin, end, cancel and no-show)"}
+		}
+		timeslot.State = previous.State
+	} else if result := timeslot.validateNewState(); !result.IsOk() {
+		return result
+	}
 	if result := timeslot.validate(); !result.IsOk() {
 		return result
 	}
 
 	// Update or create
-	return timeslot.createOrUpdate()
+	result := timeslot.createOrUpdate()
+	if !result.IsOk() {
+		return result
+	}
+	if timeslot.BeginTime != nil && (previous.BeginTime == nil || !previous.BeginTime.Equal(*timeslot.BeginTime)) {
+		timeslot.publishScheduled()
+	} else if timeslot.EndTime != nil && (previous.EndTime == nil || !previous.EndTime.Equal(*timeslot.EndTime)) {
+		if err := timeslot.clearReminders(ReminderKindEnding); err != nil {
+			request.Log().WithError(err).WithField("timeslot", timeslot.ID).Warn("Failed to clear ending reminder of changed timeslot")
+		}
+	}
+	return result
 }
 
 // Delete deletes a timeslot.
@@ -240,7 +375,21 @@ func (timeslot *Timeslot) Delete(request *rest.Request) rest.Result {
 	return rest.Result{}
 }
 
+// validateNewState sets the default state of a new timeslot and checks that it's a valid initial state.
+func (timeslot *Timeslot) validateNewState() rest.Result {
+	if timeslot.State == "" {
+		timeslot.State = TimeslotStateApproved
+	}
+	if timeslot.State != TimeslotStateRequested && timeslot.State != TimeslotStateApproved {
+		return rest.Result{Code: 400, Message: "new timeslots must be requested or approved"}
+	}
+	return rest.Result{}
+}
+
 func (timeslot *Timeslot) create() rest.Result {
+	if timeslot.State == "" {
+		timeslot.State = TimeslotStateApproved
+	}
 	if exists, err := timeslot.exists(); err != nil {
 		return rest.Result{Code: 500, Error: err}
 	} else if exists {
@@ -254,6 +403,17 @@ func (timeslot *Timeslot) create() rest.Result {
 	return rest.Result{}
 }
 
+// publishBooked publishes that the timeslot was created.
+func (timeslot *Timeslot) publishBooked() {
+	event.Publish(event.Event{
+		Type:    EventTypeTimeslotBooked,
+		TrackID: timeslot.TrackID,
+		Title:   "Timeslot booked",
+		Message: fmt.Sprintf("A timeslot for track %v was booked.", timeslot.TrackID),
+		Data:    timeslot,
+	})
+}
+
 func (timeslot *Timeslot) createOrUpdate() rest.Result {
 	exists, existsErr := timeslot.exists()
 	if existsErr != nil {
@@ -264,6 +424,9 @@ func (timeslot *Timeslot) createOrUpdate() rest.Result {
 	if exists {
 		dbResult = db.Update("timeslots", timeslot, "id", "=", timeslot.ID)
 	} else {
+		if timeslot.State == "" {
+			timeslot.State = TimeslotStateApproved
+		}
 		dbResult = db.Insert("timeslots", timeslot)
 	}
 	if dbResult.IsFailed() {
@@ -315,6 +478,9 @@ func (timeslot *Timeslot) validate() rest.Result {
 	case timeslot.BeginTime != nil && timeslot.EndTime != nil && timeslot.EndTime.Before(*timeslot.BeginTime):
 		return rest.Result{Code: 400, Message: "cannot end before it begins"}
 	}
+	if result := timeslot.validateCategory(); !result.IsOk() {
+		return result
+	}
 
 	user := rest.User{ID: timeslot.UserID}
 	if exists, err := user.ExistsWithID(); err != nil {
@@ -336,14 +502,50 @@ func (timeslot *Timeslot) validate() rest.Result {
 		return rest.Result{Code: 409, Message: "user currently has timeslot for this track"}
 	}
 
-	return rest.Result{}
+	// Check the team, if any
+	if timeslot.TeamID != nil {
+		var team Team
+		if result := team.load(timeslot.TeamID.String()); result.Code == 404 {
+			return rest.Result{Code: 400, Message: "referenced team does not exist"}
+		} else if !result.IsOk() {
+			return result
+		}
+		if team.TrackID != timeslot.TrackID {
+			return rest.Result{Code: 400, Message: "referenced team is for another track"}
+		}
+		if !team.hasMember(*timeslot.UserID) {
+			return rest.Result{Code: 400, Message: "user is not a member of the referenced team"}
+		}
+		if has, err := timeslot.teamHasAnotherUnfinishedTimeslot(); err != nil {
+			return rest.Result{Code: 500, Error: err}
+		} else if has {
+			return rest.Result{Code: 409, Message: "team currently has timeslot for this track"}
+		}
+	}
+
+	// Check for overlapping timeslots with the same participants or station
+	return timeslot.checkConflicts()
 }
 
-// Check if the user has another non-ended timeslot for the current track.
+// Check if the user has another non-ended (and not completed, cancelled or no-show) timeslot for the current track.
 func (timeslot *Timeslot) userHasAnotherUnfinishedTimeslot() (bool, error) {
 	now := time.Now()
 	var count int
-	row := db.DB.QueryRow("SELECT COUNT(*) FROM timeslots WHERE id != $1 AND track = $2 AND user = $3 AND (end_time IS NULL OR end_time >= $4)", timeslot.ID, timeslot.TrackID, timeslot.UserID, now)
+	row := db.DB.QueryRow("SELECT COUNT(*) FROM timeslots WHERE id != $1 AND track = $2 AND \"user\" = $3 AND (end_time IS NULL OR end_time >= $4) AND state = ANY($5)",
+		timeslot.ID, timeslot.TrackID, timeslot.UserID, now, pq.Array(unfinishedTimeslotStates))
+	rowErr := row.Scan(&count)
+	if rowErr != nil {
+		return false, rowErr
+	}
+	return count > 0, nil
+}
+
+// Check if the team has another non-ended (and not completed, cancelled or no-show) timeslot for the current track.
+func (timeslot *Timeslot) teamHasAnotherUnfinishedTimeslot() (bool, error) {
+	now := time.Now()
+	var count int
+	row := db.DB.QueryRow("SELECT COUNT(*) FROM timeslots WHERE id != $1 AND track = $2 AND team = $3 AND (end_time IS NULL OR end_time >= $4) AND state = ANY($5)",
+		timeslot.ID, timeslot.TrackID, timeslot.TeamID, now, pq.Array(unfinishedTimeslotStates))
 	rowErr := row.Scan(&count)
 	if rowErr != nil {
 		return false, rowErr
@@ -351,6 +553,33 @@ func (timeslot *Timeslot) userHasAnotherUnfinishedTimeslot() (bool, error) {
 	return count > 0, nil
 }
 
+// isParticipant checks if the user is the owner of the timeslot or a member of its team.
+func (timeslot *Timeslot) isParticipant(userID *uuid.UUID) (bool, error) {
+	if userID == nil {
+		return false, nil
+	}
+	if timeslot.UserID != nil && *timeslot.UserID == *userID {
+		return true, nil
+	}
+	if timeslot.TeamID != nil {
+		return isTeamMember(*timeslot.TeamID, *userID)
+	}
+	return false, nil
+}
+
+// checkParticipantPerms returns an error result unless the token is an operator/admin or a participant of the timeslot.
+func (timeslot *Timeslot) checkParticipantPerms(token rest.AccessTokenEntry) rest.Result {
+	if token.GetRole() == rest.RoleOperator || token.GetRole() == rest.RoleAdmin {
+		return rest.Result{}
+	}
+	if isParticipant, err := timeslot.isParticipant(token.OwnerUserID); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	} else if !isParticipant {
+		return rest.UnauthorizedResult(token)
+	}
+	return rest.Result{}
+}
+
 // Post attempts to find an available station to bind to the timeslot.
 // It allows users to automatically get assigned to a "ready" net-track station,
 // or a server-track station if below the soft limit.
@@ -380,10 +609,54 @@ func (beginRequest *TimeslotBeginRequest) Post(request *rest.Request) rest.Resul
 	}
 
 	// Check perms
-	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin && *request.AccessToken.OwnerUserID != *timeslot.UserID {
-		return rest.UnauthorizedResult(request.AccessToken)
+	if result := timeslot.checkParticipantPerms(request.AccessToken); !result.IsOk() {
+		return result
+	}
+
+	station, result := timeslot.begin(&track, request.AccessToken.GetRole() == rest.RoleOperator || request.AccessToken.GetRole() == rest.RoleAdmin)
+	if !result.IsOk() {
+		return result
 	}
 
+	return rest.Result{Code: 303, Location: fmt.Sprintf("%v/station/%v/", config.Config.SitePrefix, station.ID)}
+}
+
+// begin finds an available station (or provisions one for server tracks) and binds it to the timeslot, starting (activating) it now.
+// Only approved (or active) timeslots may begin.
+// Privileged (operators/admins) may also use available (not only ready) stations, go up to the hard limit for dynamic stations
+// and exceed the max active timeslots of the category.
+func (timeslot *Timeslot) begin(track *Track, privileged bool) (*Station, rest.Result) {
+	if result := timeslot.checkMayBegin(); !result.IsOk() {
+		return nil, result
+	}
+	if !privileged {
+		if result := timeslot.checkCategoryCapacity(); !result.IsOk() {
+			return nil, result
+		}
+	}
+	station, result := timeslot.assignStation(track, privileged)
+	if !result.IsOk() {
+		return nil, result
+	}
+
+	// Update timeslot
+	// Warning: Potential race condition, but people are slow.
+	beginTime := time.Now()
+	timeslot.BeginTime = &beginTime
+	endTime := time.Now().AddDate(1000, 0, 0) // +1000 years
+	timeslot.EndTime = &endTime
+	timeslot.State = TimeslotStateActive
+	if result := timeslot.createOrUpdate(); !result.IsOk() {
+		return nil, result
+	}
+	station.queueDNSSync()
+
+	return station, rest.Result{}
+}
+
+// assignStation finds an available station (or provisions one for server tracks) and binds it to the timeslot, without changing the timeslot.
+// See begin for the privileged arg.
+func (timeslot *Timeslot) assignStation(track *Track, privileged bool) (*Station, rest.Result) {
 	// Find all ready/available stations
 	var unboundStations Stations
 	unboundStationsDBResult := db.SelectMany(&unboundStations, "stations",
@@ -391,13 +664,17 @@ func (beginRequest *TimeslotBeginRequest) Post(request *rest.Request) rest.Resul
 		"timeslot", "=", "",
 	)
 	if unboundStationsDBResult.IsFailed() {
-		return rest.Result{Code: 500, Error: unboundStationsDBResult.Error}
+		return nil, rest.Result{Code: 500, Error: unboundStationsDBResult.Error}
 	}
 	var choosableStations Stations
+	now := time.Now()
 	for _, station := range unboundStations {
+		if station.Health == StationHealthUnhealthy || station.isUnderMaintenance(now) || station.isSuspended() {
+			continue
+		}
 		if station.Status == StationStatusReady {
 			choosableStations = append(choosableStations, station)
-		} else if station.Status == StationStatusAvailable && (request.AccessToken.GetRole() == rest.RoleOperator || request.AccessToken.GetRole() == rest.RoleAdmin) {
+		} else if station.Status == StationStatusAvailable && privileged {
 			choosableStations = append(choosableStations, station)
 		}
 	}
@@ -409,12 +686,13 @@ func (beginRequest *TimeslotBeginRequest) Post(request *rest.Request) rest.Resul
 		chosenStation = choosableStations[0]
 	}
 
-	// If server and no available, try to allocate one
-	if track.Type == trackTypeServer && chosenStation == nil {
+	// If dynamic and no available, try to allocate one
+	behavior := track.behavior()
+	if behavior.hasDynamicStations() && chosenStation == nil {
 		// Check if dynamic provisioning enabled
-		trackConfig, trackConfigOk := config.Config.ServerTracks[track.ID]
-		if !trackConfigOk || trackConfig.BaseURL == "" {
-			return rest.Result{Code: 404, Message: "no available stations and track not configured for dynamic stations"}
+		softLimit, hardLimit, _ := behavior.instanceLimits(track.ID)
+		if _, err := behavior.Provisioner(track.ID); err != nil {
+			return nil, rest.Result{Code: 404, Message: "no available stations and track not configured for dynamic stations"}
 		}
 
 		// Check current count
@@ -422,49 +700,41 @@ func (beginRequest *TimeslotBeginRequest) Post(request *rest.Request) rest.Resul
 		var count int
 		currentRowErr := currentRow.Scan(&count)
 		if currentRowErr != nil {
-			return rest.Result{Code: 500, Error: currentRowErr}
+			return nil, rest.Result{Code: 500, Error: currentRowErr}
 		}
 
 		// Check if allowed
-		if request.AccessToken.GetRole() == rest.RoleOperator || request.AccessToken.GetRole() == rest.RoleAdmin {
-			if count >= trackConfig.MaxInstancesHard {
-				return rest.Result{Code: 404, Message: "no available stations and hard limit for dynamic stations reached"}
+		if privileged {
+			if count >= hardLimit {
+				return nil, rest.Result{Code: 404, Message: "no available stations and hard limit for dynamic stations reached"}
 			}
 		} else {
-			if count >= trackConfig.MaxInstancesSoft {
-				return rest.Result{Code: 404, Message: "no available stations and soft limit for dynamic stations reached"}
+			if count >= softLimit {
+				return nil, rest.Result{Code: 404, Message: "no available stations and soft limit for dynamic stations reached"}
 			}
 		}
 
 		// Allocate one
 		chosenStation = &Station{}
 		if result := chosenStation.Provision(track.ID); !result.IsOk() {
-			return result
+			return nil, result
 		}
 	}
 
 	// Check if an available station was found or created
 	if chosenStation == nil {
-		return rest.Result{Code: 404, Message: "no available stations"}
+		return nil, rest.Result{Code: 404, Message: "no available stations"}
 	}
 
 	// Update station, but keep the station status as-is
 	chosenStation.TimeslotID = timeslot.ID.String()
 	if result := chosenStation.createOrUpdate(); !result.IsOk() {
-		return result
+		return nil, result
 	}
+	injectionStation := *chosenStation
+	injectionStation.queueSSHKeyInjection(*timeslot)
 
-	// Update timeslot
-	// Warning: Potential race condition, but people are slow.
-	beginTime := time.Now()
-	timeslot.BeginTime = &beginTime
-	endTime := time.Now().AddDate(1000, 0, 0) // +1000 years
-	timeslot.EndTime = &endTime
-	if result := timeslot.createOrUpdate(); !result.IsOk() {
-		return result
-	}
-
-	return rest.Result{Code: 303, Location: fmt.Sprintf("%v/station/%v/", config.Config.SitePrefix, chosenStation.ID)}
+	return chosenStation, rest.Result{}
 }
 
 // Post ends a timeslot.
@@ -503,8 +773,8 @@ func (endRequest *TimeslotEndRequest) Post(request *rest.Request) rest.Result {
 	}
 
 	// Check perms
-	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin && *request.AccessToken.OwnerUserID != *timeslot.UserID {
-		return rest.UnauthorizedResult(request.AccessToken)
+	if result := timeslot.checkParticipantPerms(request.AccessToken); !result.IsOk() {
+		return result
 	}
 
 	// Validate stuff
@@ -512,21 +782,31 @@ func (endRequest *TimeslotEndRequest) Post(request *rest.Request) rest.Result {
 		return rest.Result{Code: 400, Message: "inconsistency between timeslot track and assigned station track (contact support)"}
 	}
 
-	// Update end time (and begin time if invalid)
-	now := time.Now()
-	timeslot.EndTime = &now
+	return timeslot.finish(&track, &station, time.Now())
+}
+
+// finish ends and completes the timeslot at the end time, releasing the station (net stations become dirty, server stations are terminated)
+// and letting the next in the queue have a go.
+func (timeslot *Timeslot) finish(track *Track, station *Station, endTime time.Time) rest.Result {
+	// Update end time (and begin time if invalid) and complete it
+	timeslot.EndTime = &endTime
 	if timeslot.BeginTime == nil || timeslot.BeginTime.After(*timeslot.EndTime) {
-		timeslot.BeginTime = &now
+		timeslot.BeginTime = &endTime
 	}
+	timeslot.State = TimeslotStateCompleted
 
 	// Handle station according to track type
 	station.TimeslotID = ""
-	if track.Type == trackTypeNet {
-		station.Status = StationStatusDirty
-	} else if track.Type == trackTypeServer {
+	station.TeardownHold = nil
+	previousStatus := station.Status
+	behavior := track.behavior()
+	if behavior.hasDynamicStations() {
+		// Saved and published by terminate
 		if result := station.Terminate(); !result.IsOk() {
 			return result
 		}
+	} else if behavior.ReleasedStatus != "" {
+		station.Status = behavior.ReleasedStatus
 	} else {
 		return rest.Result{Code: 400, Message: "unknown track type (contact support)"}
 	}
@@ -535,8 +815,18 @@ func (endRequest *TimeslotEndRequest) Post(request *rest.Request) rest.Result {
 	if result := timeslot.createOrUpdate(); !result.IsOk() {
 		return result
 	}
-	if result := station.createOrUpdate(); !result.IsOk() {
-		return result
+	if !behavior.hasDynamicStations() {
+		// Terminated stations are updated by the destroy job, so they must not be overwritten here
+		if result := station.createOrUpdate(); !result.IsOk() {
+			return result
+		}
+		station.publishStatusTransition(previousStatus)
+		station.queueDNSSync()
+	}
+
+	// Let the next in the queue have a go (if the station is ready)
+	if err := promoteQueue(track.ID); err != nil {
+		log.WithError(err).WithField("track", track.ID).Warn("Failed to promote queue after finishing timeslot")
 	}
 
 	return rest.Result{}
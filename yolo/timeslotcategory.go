@@ -0,0 +1,159 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/rest"
+)
+
+// TimeslotCategory is the kind of timeslot, deciding the booking rules and the assignment priority.
+type TimeslotCategory string
+
+const (
+	// TimeslotCategoryParticipant is the normal kind, for participants.
+	TimeslotCategoryParticipant TimeslotCategory = "participant"
+	// TimeslotCategorySponsorDemo is for sponsors demonstrating the tracks, going before participants.
+	TimeslotCategorySponsorDemo TimeslotCategory = "sponsor_demo"
+	// TimeslotCategoryCrewTesting is for the crew testing stations, going after participants.
+	TimeslotCategoryCrewTesting TimeslotCategory = "crew_testing"
+)
+
+// DefaultTimeslotCategory is the category for timeslots without one.
+const DefaultTimeslotCategory = TimeslotCategoryParticipant
+
+// defaultTimeslotCategories are the rules for the built-in categories, unless configured.
+var defaultTimeslotCategories = map[TimeslotCategory]config.TimeslotCategoryConfig{
+	TimeslotCategoryParticipant: {Priority: 0, SelfBooking: true},
+	TimeslotCategorySponsorDemo: {Priority: 10, MaxActive: 2},
+	TimeslotCategoryCrewTesting: {Priority: -10},
+}
+
+// TimeslotCategoryInfo is a timeslot category with its rules.
+type TimeslotCategoryInfo struct {
+	Category           TimeslotCategory `json:"category"`
+	Priority           int              `json:"priority"`
+	SelfBooking        bool             `json:"self_booking"`
+	MaxDurationSeconds int              `json:"max_duration_seconds"`
+	MaxActive          int              `json:"max_active"`
+	RequireApproval    bool             `json:"require_approval"`
+}
+
+// TimeslotCategoryInfos is a list of timeslot categories.
+type TimeslotCategoryInfos []*TimeslotCategoryInfo
+
+func init() {
+	rest.AddHandler("/timeslot-categories/", "^$", func() interface{} { return &TimeslotCategoryInfos{} })
+}
+
+// Get gets all categories with their rules, highest priority first.
+func (infos *TimeslotCategoryInfos) Get(request *rest.Request) rest.Result {
+	*infos = make(TimeslotCategoryInfos, 0)
+	for category, categoryConfig := range timeslotCategories() {
+		*infos = append(*infos, &TimeslotCategoryInfo{
+			Category:           category,
+			Priority:           categoryConfig.Priority,
+			SelfBooking:        categoryConfig.SelfBooking,
+			MaxDurationSeconds: categoryConfig.MaxDurationSeconds,
+			MaxActive:          categoryConfig.MaxActive,
+			RequireApproval:    categoryConfig.RequireApproval,
+		})
+	}
+	sort.SliceStable(*infos, func(i, j int) bool {
+		a, b := (*infos)[i], (*infos)[j]
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		return a.Category < b.Category
+	})
+	return rest.Result{}
+}
+
+// timeslotCategories gets the built-in categories, replaced or extended by the configured ones.
+func timeslotCategories() map[TimeslotCategory]config.TimeslotCategoryConfig {
+	categories := make(map[TimeslotCategory]config.TimeslotCategoryConfig, len(defaultTimeslotCategories)+len(config.Config.TimeslotCategories))
+	for category, categoryConfig := range defaultTimeslotCategories {
+		categories[category] = categoryConfig
+	}
+	for rawCategory, categoryConfig := range config.Config.TimeslotCategories {
+		categories[TimeslotCategory(rawCategory)] = categoryConfig
+	}
+	return categories
+}
+
+// categoryConfig gets the rules for the category of the timeslot, and false if the category doesn't exist.
+func (timeslot *Timeslot) categoryConfig() (config.TimeslotCategoryConfig, bool) {
+	category := timeslot.Category
+	if category == "" {
+		category = DefaultTimeslotCategory
+	}
+	categoryConfig, ok := timeslotCategories()[category]
+	return categoryConfig, ok
+}
+
+// validateCategory sets the default category and checks the duration limit. Who may book it is checked by the caller.
+func (timeslot *Timeslot) validateCategory() rest.Result {
+	if timeslot.Category == "" {
+		timeslot.Category = DefaultTimeslotCategory
+	}
+	categoryConfig, ok := timeslot.categoryConfig()
+	if !ok {
+		return rest.Result{Code: 400, Message: "invalid category"}
+	}
+	if categoryConfig.MaxDurationSeconds > 0 && timeslot.BeginTime != nil && timeslot.EndTime != nil &&
+		timeslot.EndTime.Sub(*timeslot.BeginTime) > time.Duration(categoryConfig.MaxDurationSeconds)*time.Second {
+		return rest.Result{Code: 400, Message: fmt.Sprintf("timeslots of category %v may last at most %v minutes", timeslot.Category, categoryConfig.MaxDurationSeconds/60)}
+	}
+	return rest.Result{}
+}
+
+// priority gets the assignment priority of the timeslot, where higher goes first.
+func (timeslot *Timeslot) priority() int {
+	categoryConfig, _ := timeslot.categoryConfig()
+	return categoryConfig.Priority
+}
+
+// checkCategoryCapacity returns 409 if the category of the timeslot already has the max number of active timeslots in the track.
+func (timeslot *Timeslot) checkCategoryCapacity() rest.Result {
+	categoryConfig, _ := timeslot.categoryConfig()
+	if categoryConfig.MaxActive <= 0 {
+		return rest.Result{}
+	}
+	category := timeslot.Category
+	if category == "" {
+		category = DefaultTimeslotCategory
+	}
+	var count int
+	row := db.DB.QueryRow("SELECT COUNT(*) FROM stations JOIN timeslots ON timeslots.id = stations.timeslot WHERE stations.track = $1 AND timeslots.category = $2 AND timeslots.id != $3",
+		timeslot.TrackID, category, timeslot.ID)
+	if err := row.Scan(&count); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	if count >= categoryConfig.MaxActive {
+		return rest.Result{Code: 409, Message: fmt.Sprintf("max active timeslots of category %v reached", category)}
+	}
+	return rest.Result{}
+}
@@ -0,0 +1,285 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/db"
+	"github.com/gathering/tech-online-backend/event"
+	"github.com/gathering/tech-online-backend/rest"
+	"github.com/gathering/tech-online-backend/scheduler"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const timeslotStateSchedulerInterval = 30 * time.Second
+
+// TimeslotState is the lifecycle state of a timeslot.
+type TimeslotState string
+
+const (
+	// TimeslotStateRequested means a participant booked it, but it awaits approval by an operator/admin (see require_approval of the category).
+	TimeslotStateRequested TimeslotState = "requested"
+	// TimeslotStateApproved means it may begin, either when the participant begins it or at the begin time if planned.
+	TimeslotStateApproved TimeslotState = "approved"
+	// TimeslotStateActive means it has begun and got a station.
+	TimeslotStateActive TimeslotState = "active"
+	// TimeslotStateCompleted means it was ended after being active.
+	TimeslotStateCompleted TimeslotState = "completed"
+	// TimeslotStateCancelled means a participant or an operator/admin cancelled it before it began.
+	TimeslotStateCancelled TimeslotState = "cancelled"
+	// TimeslotStateNoShow means it ended without ever becoming active.
+	TimeslotStateNoShow TimeslotState = "no_show"
+)
+
+// timeslotStateTransitions contains the states each state may change to. Completed, cancelled and no-show are final.
+var timeslotStateTransitions = map[TimeslotState][]TimeslotState{
+	TimeslotStateRequested: {TimeslotStateApproved, TimeslotStateCancelled},
+	TimeslotStateApproved:  {TimeslotStateActive, TimeslotStateCancelled, TimeslotStateNoShow},
+	TimeslotStateActive:    {TimeslotStateCompleted},
+	TimeslotStateCompleted: {},
+	TimeslotStateCancelled: {},
+	TimeslotStateNoShow:    {},
+}
+
+// unfinishedTimeslotStates are the states of timeslots which may still be used.
+var unfinishedTimeslotStates = []string{string(TimeslotStateRequested), string(TimeslotStateApproved), string(TimeslotStateActive)}
+
+// EventTypeTimeslotStateChanged is published to the participants when a timeslot is approved, cancelled or marked as a no-show.
+const EventTypeTimeslotStateChanged event.Type = "timeslot.state_changed" // Data is a TimeslotStateTransition
+
+// TimeslotStateTransition is a change of timeslot state.
+type TimeslotStateTransition struct {
+	TimeslotID *uuid.UUID    `json:"timeslot"`
+	From       TimeslotState `json:"from"`
+	To         TimeslotState `json:"to"`
+}
+
+// TimeslotStateMachine describes the timeslot states and the allowed transitions between them.
+type TimeslotStateMachine struct {
+	States      []TimeslotState                   `json:"states"`
+	Transitions map[TimeslotState][]TimeslotState `json:"transitions"`
+}
+
+// TimeslotApproveRequest is a request to approve a requested timeslot.
+type TimeslotApproveRequest struct{}
+
+// TimeslotCancelRequest is a request to cancel a timeslot which hasn't begun.
+type TimeslotCancelRequest struct{}
+
+// TimeslotNoShowRequest is a request to mark an approved timeslot as a no-show.
+type TimeslotNoShowRequest struct{}
+
+func init() {
+	rest.AddHandler("/timeslot-states/", "^$", func() interface{} { return &TimeslotStateMachine{} })
+	rest.AddHandler("/timeslot/", "^(?P<id>[^/]+)/approve/$", func() interface{} { return &TimeslotApproveRequest{} })
+	rest.AddHandler("/timeslot/", "^(?P<id>[^/]+)/cancel/$", func() interface{} { return &TimeslotCancelRequest{} })
+	rest.AddHandler("/timeslot/", "^(?P<id>[^/]+)/no-show/$", func() interface{} { return &TimeslotNoShowRequest{} })
+	scheduler.AddJob("advance-timeslot-states", timeslotStateSchedulerInterval, advanceTimeslotStates)
+}
+
+// Get gets the timeslot states and transitions.
+func (machine *TimeslotStateMachine) Get(request *rest.Request) rest.Result {
+	machine.States = []TimeslotState{
+		TimeslotStateRequested,
+		TimeslotStateApproved,
+		TimeslotStateActive,
+		TimeslotStateCompleted,
+		TimeslotStateCancelled,
+		TimeslotStateNoShow,
+	}
+	machine.Transitions = timeslotStateTransitions
+	return rest.Result{}
+}
+
+// Post approves a requested timeslot.
+func (approveRequest *TimeslotApproveRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Get
+	var timeslot Timeslot
+	var track Track
+	if result := loadTimeslotAndTrack(request, &timeslot, &track); !result.IsOk() {
+		return result
+	}
+
+	// Approve
+	if result := timeslot.transition(TimeslotStateApproved, request.AccessToken.GetName()); !result.IsOk() {
+		return result
+	}
+	timeslot.publishEvent(EventTypeTimeslotStateChanged, "Your timeslot was approved",
+		fmt.Sprintf("Your timeslot for track %v was approved.", timeslot.TrackID), timeslot.stateTransition(TimeslotStateRequested))
+	return rest.Result{Code: 303, Location: fmt.Sprintf("%v/timeslot/%v/", config.Config.SitePrefix, timeslot.ID)}
+}
+
+// Post cancels a timeslot which hasn't begun.
+// May be called by the participants of the timeslot or by operators/admins.
+func (cancelRequest *TimeslotCancelRequest) Post(request *rest.Request) rest.Result {
+	// Get
+	var timeslot Timeslot
+	var track Track
+	if result := loadTimeslotAndTrack(request, &timeslot, &track); !result.IsOk() {
+		return result
+	}
+
+	// Check perms
+	if result := timeslot.checkParticipantPerms(request.AccessToken); !result.IsOk() {
+		return result
+	}
+
+	// Cancel
+	previous := timeslot.State
+	if result := timeslot.transition(TimeslotStateCancelled, request.AccessToken.GetName()); !result.IsOk() {
+		return result
+	}
+	if err := promoteQueue(timeslot.TrackID); err != nil {
+		request.Log().WithError(err).WithField("track", timeslot.TrackID).Warn("Failed to promote queue after cancelling timeslot")
+	}
+	timeslot.publishEvent(EventTypeTimeslotStateChanged, "Your timeslot was cancelled",
+		fmt.Sprintf("Your timeslot for track %v was cancelled.", timeslot.TrackID), timeslot.stateTransition(previous))
+	return rest.Result{Code: 303, Location: fmt.Sprintf("%v/timeslot/%v/", config.Config.SitePrefix, timeslot.ID)}
+}
+
+// Post marks an approved timeslot as a no-show, e.g. if the participants don't turn up for a planned timeslot.
+// The scheduler does it too for approved timeslots which end without becoming active.
+func (noShowRequest *TimeslotNoShowRequest) Post(request *rest.Request) rest.Result {
+	// Check perms
+	if request.AccessToken.GetRole() != rest.RoleOperator && request.AccessToken.GetRole() != rest.RoleAdmin {
+		return rest.UnauthorizedResult(request.AccessToken)
+	}
+
+	// Get
+	var timeslot Timeslot
+	var track Track
+	if result := loadTimeslotAndTrack(request, &timeslot, &track); !result.IsOk() {
+		return result
+	}
+
+	// Mark
+	if result := timeslot.transition(TimeslotStateNoShow, request.AccessToken.GetName()); !result.IsOk() {
+		return result
+	}
+	return rest.Result{Code: 303, Location: fmt.Sprintf("%v/timeslot/%v/", config.Config.SitePrefix, timeslot.ID)}
+}
+
+// canTransitionTimeslotState checks if a timeslot may change from one state to another.
+func canTransitionTimeslotState(from TimeslotState, to TimeslotState) bool {
+	for _, allowed := range timeslotStateTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// transition changes the state of the timeslot if allowed, saving only the state.
+// Returns 409 if not allowed, including if stations are assigned when leaving approved for anything but active.
+func (timeslot *Timeslot) transition(to TimeslotState, actor string) rest.Result {
+	from := timeslot.State
+	if !canTransitionTimeslotState(from, to) {
+		return rest.Result{Code: 409, Message: fmt.Sprintf("timeslot may not change from %v to %v", from, to)}
+	}
+	if to == TimeslotStateCancelled || to == TimeslotStateNoShow {
+		if hasStation, err := timeslot.isActiveWithStation(); err != nil {
+			return rest.Result{Code: 500, Error: err}
+		} else if hasStation {
+			return rest.Result{Code: 409, Message: "timeslot has an assigned station, unassign it first"}
+		}
+	}
+	// Only if unchanged meanwhile
+	dbResult, err := db.DB.Exec("UPDATE timeslots SET state = $1 WHERE id = $2 AND state = $3", to, timeslot.ID, from)
+	if err != nil {
+		return rest.Result{Code: 500, Error: err}
+	}
+	if affected, err := dbResult.RowsAffected(); err != nil {
+		return rest.Result{Code: 500, Error: err}
+	} else if affected == 0 {
+		return rest.Result{Code: 409, Message: "timeslot changed meanwhile, try again"}
+	}
+	timeslot.State = to
+	log.WithFields(log.Fields{
+		"timeslot": timeslot.ID,
+		"from":     from,
+		"to":       to,
+		"actor":    actor,
+	}).Info("Timeslot state changed")
+	return rest.Result{}
+}
+
+// stateTransition gets the transition from the previous state to the current one, for events.
+func (timeslot *Timeslot) stateTransition(previous TimeslotState) TimeslotStateTransition {
+	return TimeslotStateTransition{TimeslotID: timeslot.ID, From: previous, To: timeslot.State}
+}
+
+// isUnfinished checks if the timeslot may still be used, i.e. it's not completed, cancelled or a no-show.
+func (timeslot *Timeslot) isUnfinished() bool {
+	return timeslot.State == TimeslotStateRequested || timeslot.State == TimeslotStateApproved || timeslot.State == TimeslotStateActive
+}
+
+// checkMayBegin returns 409 unless the timeslot is approved (or already active, e.g. when replacing the station).
+func (timeslot *Timeslot) checkMayBegin() rest.Result {
+	if timeslot.State != TimeslotStateApproved && timeslot.State != TimeslotStateActive {
+		return rest.Result{Code: 409, Message: fmt.Sprintf("timeslot is %v", timeslot.State)}
+	}
+	return rest.Result{}
+}
+
+// advanceTimeslotStates activates approved timeslots with stations once they begin, completes active timeslots which have ended
+// and released their station, and marks approved timeslots which ended without becoming active as no-shows.
+func advanceTimeslotStates() error {
+	now := time.Now()
+	var timeslots Timeslots
+	dbResult := db.SelectMany(&timeslots, "timeslots", "state", "IN", []string{string(TimeslotStateApproved), string(TimeslotStateActive)})
+	if dbResult.IsFailed() {
+		return dbResult.Error
+	}
+
+	for _, timeslot := range timeslots {
+		hasStation, err := timeslot.isActiveWithStation()
+		if err != nil {
+			return err
+		}
+		began := timeslot.BeginTime == nil || !timeslot.BeginTime.After(now)
+		ended := timeslot.EndTime != nil && !timeslot.EndTime.After(now)
+
+		var to TimeslotState
+		switch {
+		case timeslot.State == TimeslotStateApproved && hasStation && began:
+			to = TimeslotStateActive
+		case timeslot.State == TimeslotStateApproved && !hasStation && ended:
+			to = TimeslotStateNoShow
+		case timeslot.State == TimeslotStateActive && !hasStation && ended:
+			to = TimeslotStateCompleted
+		default:
+			continue
+		}
+		if result := timeslot.transition(to, "scheduler"); !result.IsOk() {
+			log.WithField("timeslot", timeslot.ID).WithError(resultError(result)).Warn("Failed to advance timeslot state")
+		}
+	}
+	return nil
+}
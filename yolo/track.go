@@ -22,6 +22,7 @@ package yolo
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/gathering/tech-online-backend/config"
 	"github.com/gathering/tech-online-backend/db"
@@ -38,9 +39,10 @@ const (
 
 // Track is a track.
 type Track struct {
-	ID   string    `column:"id" json:"id"`     // Generated, required, unique
-	Type TrackType `column:"type" json:"type"` // Required
-	Name string    `column:"name" json:"name"` // Required
+	ID       string    `column:"id" json:"id" brief:"true"`     // Generated, required, unique
+	Type     TrackType `column:"type" json:"type" brief:"true"` // Required
+	Name     string    `column:"name" json:"name" brief:"true"` // Required
+	Archived bool      `column:"archived" json:"archived"`      // Read-only for non-admins, set after the event
 }
 
 // Tracks is a list of tracks.
@@ -49,6 +51,8 @@ type Tracks []*Track
 func init() {
 	rest.AddHandler("/tracks/", "^$", func() interface{} { return &Tracks{} })
 	rest.AddHandler("/track/", "^(?:(?P<id>[^/]+)/)?$", func() interface{} { return &Track{} })
+	rest.SetCachePolicy(&Tracks{}, rest.CachePolicy{MaxAge: 5 * time.Minute, Public: true})
+	rest.SetCachePolicy(&Track{}, rest.CachePolicy{MaxAge: 5 * time.Minute, Public: true})
 }
 
 // Get gets multiple tracks.
@@ -225,12 +229,6 @@ func (track *Track) validate() rest.Result {
 }
 
 func (track *Track) validateType() bool {
-	switch track.Type {
-	case trackTypeNet:
-		fallthrough
-	case trackTypeServer:
-		return true
-	default:
-		return false
-	}
+	_, ok := trackTypeBehavior(track.Type)
+	return ok
 }
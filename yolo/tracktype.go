@@ -0,0 +1,183 @@
+/*
+Tech:Online Backend
+Copyright 2020, Kristian Lyngstøl <kly@kly.no>
+Copyright 2021-2022, Håvard Ose Nordstrand <hon@hon.one>
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package yolo
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gathering/tech-online-backend/config"
+	"github.com/gathering/tech-online-backend/provision"
+	"github.com/gathering/tech-online-backend/rest"
+)
+
+// CredentialPolicy decides who may see the credentials of stations, besides admins.
+type CredentialPolicy string
+
+const (
+	// CredentialPolicyParticipants shows the credentials to the participants of the assigned timeslot and operators.
+	CredentialPolicyParticipants CredentialPolicy = "participants"
+	// CredentialPolicyStaff shows the credentials to operators only, e.g. for stations crew log into for participants.
+	CredentialPolicyStaff CredentialPolicy = "staff"
+)
+
+// Aggregate views of tracks, which the frontend shows for types listing them.
+const (
+	TrackViewStations = "stations" // Stations with status and health, see /custom/track-stations/
+	TrackViewTasks    = "tasks"    // Tasks and tests of a station, see /custom/station-tasks-tests/
+	TrackViewSeating  = "seating"  // Where stations and participants sit
+	TrackViewNetwork  = "network"  // Switch and port data of stations
+	TrackViewCapacity = "capacity" // Station demand forecast, see /stats/capacity/
+)
+
+// TrackTypeBehavior is how a track type handles its stations. Types are registered with RegisterTrackType,
+// so new types (e.g. "cloud" or "wifi") don't need changes in the handlers.
+type TrackTypeBehavior struct {
+	// Provisioner gets the provisioner for dynamic stations of the track, or provision.ErrNotConfigured if not configured for the track.
+	// Nil for types with static stations only.
+	Provisioner func(trackID string) (provision.Provisioner, error)
+	// InstanceLimits gets the soft and hard max stations of the track with dynamic stations, ok if configured.
+	// The soft limit applies to participants, the hard limit to operators/admins.
+	InstanceLimits func(trackID string) (soft int, hard int, ok bool)
+	// ReleasedStatus is the status of static stations when their timeslot ends, for cleaning by crew.
+	// Dynamic stations are terminated instead.
+	ReleasedStatus StationStatus
+	// DefaultHealthCheck is used for tracks without a health check in the track config, none if the kind is empty.
+	DefaultHealthCheck config.HealthCheckConfig
+	// CredentialPolicy decides who may see station credentials.
+	CredentialPolicy CredentialPolicy
+	// Seats is if stations are physical and may have seats.
+	Seats bool
+	// NetworkData is if stations are connected to switches known by Gondul.
+	NetworkData bool
+	// Views are the aggregate views the frontend shows for the track.
+	Views []string
+}
+
+// TrackTypeInfo is a registered track type and the parts of its behavior which clients adapt to.
+type TrackTypeInfo struct {
+	Type             TrackType        `json:"type"`
+	DynamicStations  bool             `json:"dynamic_stations"`
+	CredentialPolicy CredentialPolicy `json:"credential_policy"`
+	Seats            bool             `json:"seats"`
+	NetworkData      bool             `json:"network_data"`
+	Views            []string         `json:"views"`
+}
+
+// TrackTypeInfos is a list of registered track types.
+type TrackTypeInfos []*TrackTypeInfo
+
+var trackTypes = make(map[TrackType]*TrackTypeBehavior)
+var trackTypesLock sync.RWMutex
+
+func init() {
+	RegisterTrackType(trackTypeNet, TrackTypeBehavior{
+		ReleasedStatus:   StationStatusDirty,
+		CredentialPolicy: CredentialPolicyParticipants,
+		Seats:            true,
+		NetworkData:      true,
+		Views:            []string{TrackViewStations, TrackViewTasks, TrackViewSeating, TrackViewNetwork, TrackViewCapacity},
+	})
+	RegisterTrackType(trackTypeServer, TrackTypeBehavior{
+		Provisioner:      provision.Get,
+		InstanceLimits:   serverTrackInstanceLimits,
+		ReleasedStatus:   StationStatusDirty,
+		CredentialPolicy: CredentialPolicyParticipants,
+		Views:            []string{TrackViewStations, TrackViewTasks, TrackViewCapacity},
+	})
+	rest.AddHandler("/track-types/", "^$", func() interface{} { return &TrackTypeInfos{} })
+	rest.SetCachePolicy(&TrackTypeInfos{}, rest.CachePolicy{MaxAge: time.Hour, Public: true})
+}
+
+// RegisterTrackType makes a track type available, replacing any existing behavior for it. Should be called from init functions.
+func RegisterTrackType(trackType TrackType, behavior TrackTypeBehavior) {
+	trackTypesLock.Lock()
+	defer trackTypesLock.Unlock()
+	trackTypes[trackType] = &behavior
+}
+
+// trackTypeBehavior gets the behavior of the track type, or false if not registered.
+func trackTypeBehavior(trackType TrackType) (*TrackTypeBehavior, bool) {
+	trackTypesLock.RLock()
+	defer trackTypesLock.RUnlock()
+	behavior, ok := trackTypes[trackType]
+	return behavior, ok
+}
+
+// behavior gets the behavior of the track type, an empty behavior (static stations, no features) if unknown.
+func (track *Track) behavior() *TrackTypeBehavior {
+	if behavior, ok := trackTypeBehavior(track.Type); ok {
+		return behavior
+	}
+	return &TrackTypeBehavior{}
+}
+
+// hasDynamicStations checks if the track type may provision stations.
+func (behavior *TrackTypeBehavior) hasDynamicStations() bool {
+	return behavior.Provisioner != nil
+}
+
+// instanceLimits gets the soft and hard max stations for the track, ok if it has dynamic stations with limits.
+func (behavior *TrackTypeBehavior) instanceLimits(trackID string) (int, int, bool) {
+	if behavior.InstanceLimits == nil {
+		return 0, 0, false
+	}
+	return behavior.InstanceLimits(trackID)
+}
+
+// healthCheck gets the health check of the track, from the track config or the type default.
+func (behavior *TrackTypeBehavior) healthCheck(trackID string) config.HealthCheckConfig {
+	if checkConfig := config.Config.Tracks[trackID].HealthCheck; checkConfig.Kind != "" {
+		return checkConfig
+	}
+	return behavior.DefaultHealthCheck
+}
+
+func serverTrackInstanceLimits(trackID string) (int, int, bool) {
+	trackConfig, ok := config.Config.ServerTracks[trackID]
+	return trackConfig.MaxInstancesSoft, trackConfig.MaxInstancesHard, ok
+}
+
+// Get gets the registered track types, sorted by type.
+func (infos *TrackTypeInfos) Get(request *rest.Request) rest.Result {
+	trackTypesLock.RLock()
+	defer trackTypesLock.RUnlock()
+	*infos = make(TrackTypeInfos, 0, len(trackTypes))
+	for trackType, behavior := range trackTypes {
+		views := behavior.Views
+		if views == nil {
+			views = []string{}
+		}
+		*infos = append(*infos, &TrackTypeInfo{
+			Type:             trackType,
+			DynamicStations:  behavior.hasDynamicStations(),
+			CredentialPolicy: behavior.CredentialPolicy,
+			Seats:            behavior.Seats,
+			NetworkData:      behavior.NetworkData,
+			Views:            views,
+		})
+	}
+	sort.Slice(*infos, func(i, j int) bool {
+		return (*infos)[i].Type < (*infos)[j].Type
+	})
+	return rest.Result{}
+}